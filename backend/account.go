@@ -0,0 +1,700 @@
+package backend
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// exportDir is where account export archives are written
+const exportDir = "./data/exports"
+
+// Account job kinds and statuses
+const (
+	AccountJobExport = "export"
+	AccountJobDelete = "delete"
+
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// AccountJob tracks an account export or deletion running in the background.
+// Jobs outlive the user they belong to so deletions can be audited.
+type AccountJob struct {
+	ID         string                 `json:"id"`
+	UserID     string                 `json:"user_id"`
+	Kind       string                 `json:"kind"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	ResultPath string                 `json:"-"`
+	Summary    map[string]interface{} `json:"summary,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+	// DownloadURL is set on completed exports
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// Account job operations
+
+const accountJobColumns = `id, user_id, kind, status, error, result_path, summary, created_at, updated_at`
+
+// CreateAccountJob records a queued job
+func (s *Store) CreateAccountJob(ctx context.Context, userID, kind string) (*AccountJob, error) {
+	now := time.Now()
+	job := &AccountJob{ID: uuid.New().String(), UserID: userID, Kind: kind, Status: JobQueued, CreatedAt: now, UpdatedAt: now}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO account_jobs (`+accountJobColumns+`) VALUES (?, ?, ?, ?, '', '', '{}', ?, ?)
+	`, job.ID, job.UserID, job.Kind, job.Status, now.Unix(), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetAccountJob retrieves a job by ID
+func (s *Store) GetAccountJob(ctx context.Context, id string) (*AccountJob, error) {
+	var job AccountJob
+	var summaryJSON string
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, `SELECT `+accountJobColumns+` FROM account_jobs WHERE id = ?`, id).Scan(
+		&job.ID, &job.UserID, &job.Kind, &job.Status, &job.Error, &job.ResultPath, &summaryJSON, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("job")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job.CreatedAt = time.Unix(createdAt, 0)
+	job.UpdatedAt = time.Unix(updatedAt, 0)
+	if summaryJSON != "" {
+		json.Unmarshal([]byte(summaryJSON), &job.Summary)
+	}
+	return &job, nil
+}
+
+// UpdateAccountJob saves a job's status, error, result and summary
+func (s *Store) UpdateAccountJob(ctx context.Context, job *AccountJob) error {
+	job.UpdatedAt = time.Now()
+	summaryJSON, _ := json.Marshal(job.Summary)
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE account_jobs SET status = ?, error = ?, result_path = ?, summary = ?, updated_at = ? WHERE id = ?
+	`, job.Status, job.Error, job.ResultPath, string(summaryJSON), job.UpdatedAt.Unix(), job.ID)
+	return err
+}
+
+// ListUserExportPaths returns the export archives written for a user
+func (s *Store) ListUserExportPaths(ctx context.Context, userID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT result_path FROM account_jobs WHERE user_id = ? AND result_path != ''
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make([]string, 0)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// ClearUserExportPaths forgets the export archives written for a user
+func (s *Store) ClearUserExportPaths(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE account_jobs SET result_path = '' WHERE user_id = ?`, userID)
+	return err
+}
+
+// ListWorkspaceNotebookIDs returns the IDs of a workspace's notebooks
+func (s *Store) ListWorkspaceNotebookIDs(ctx context.Context, workspaceID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM notebooks WHERE workspace_id = ? ORDER BY created_at`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteUser deletes a user, their settings, suggestion feedback,
+// notifications and push devices; their memberships cascade
+func (s *Store) DeleteUser(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM settings WHERE scope = ? AND owner_id = ?`, SettingScopeUser, id); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM suggestion_feedback WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM notifications WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM push_devices WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	// Blocked messages stay in the workspace's moderation log, anonymized
+	if _, err := s.db.ExecContext(ctx, `UPDATE moderation_events SET user_id = '' WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	// and ratings of answers on the answers, so experiment results hold
+	if _, err := s.db.ExecContext(ctx, `UPDATE message_feedback SET user_id = '' WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	return err
+}
+
+// Account jobs
+
+// startAccountJob records a job and runs it in the background. The job's
+// summary is filled in by run and saved with the final status.
+func (s *Server) startAccountJob(ctx context.Context, userID, kind string, run func(ctx context.Context, job *AccountJob) error) (*AccountJob, error) {
+	job, err := s.store.CreateAccountJob(ctx, userID, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := *job
+	s.runJob(func() {
+		ctx := context.Background()
+		job.Status = JobRunning
+		s.store.UpdateAccountJob(ctx, job)
+
+		job.Summary = make(map[string]interface{})
+		if err := run(ctx, job); err != nil {
+			golog.Errorf("account %s job %s failed: %v", kind, job.ID, err)
+			job.Status = JobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = JobCompleted
+		}
+		if err := s.store.UpdateAccountJob(ctx, job); err != nil {
+			golog.Errorf("failed to save account job %s: %v", job.ID, err)
+		}
+		s.notifyAccountJob(ctx, job)
+	})
+
+	return &queued, nil
+}
+
+// notifyAccountJob tells a user their export is ready or their job failed.
+// Successful deletions have no one left to tell.
+func (s *Server) notifyAccountJob(ctx context.Context, job *AccountJob) {
+	n := Notification{
+		Kind: NotificationJob,
+		Link: "/api/account/jobs/" + job.ID,
+		Data: map[string]interface{}{"job_id": job.ID, "kind": job.Kind, "status": job.Status},
+	}
+	switch {
+	case job.Status == JobFailed:
+		n.Title, n.Body = fmt.Sprintf("Your account %s failed", job.Kind), job.Error
+	case job.Kind == AccountJobExport:
+		n.Title, n.Body = "Your account export is ready", "Download it from the link below."
+	default:
+		return
+	}
+	s.notify(ctx, []string{job.UserID}, n)
+}
+
+// ownedData returns the workspaces whose data belongs to a user alone (they
+// are the only member) and the shared workspaces they are a member of
+func (s *Server) ownedData(ctx context.Context, userID string) (owned, shared []Workspace, err error) {
+	workspaces, err := s.store.ListUserWorkspaces(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ws := range workspaces {
+		n, err := s.store.CountWorkspaceMembers(ctx, ws.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n == 1 {
+			owned = append(owned, ws)
+		} else {
+			shared = append(shared, ws)
+		}
+	}
+	return owned, shared, nil
+}
+
+// exportAccount writes a zip of everything belonging to a user: their
+// profile and memberships, and the full contents (notebooks, sources, notes,
+// chats and files) of workspaces where they are the only member
+func (s *Server) exportAccount(ctx context.Context, job *AccountJob) error {
+	user, err := s.store.GetUser(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+	owned, shared, err := s.ownedData(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return fmt.Errorf("failed to create export directory: %w", err)
+	}
+	path := filepath.Join(exportDir, job.ID+".zip")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	writeJSON := func(name string, v interface{}) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	copyFile := func(name, src string) error {
+		in, err := os.Open(src)
+		if err != nil {
+			// Files removed from disk are left out rather than failing the export
+			return nil
+		}
+		defer in.Close()
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, in)
+		return err
+	}
+
+	settings, err := s.settings(ctx, SettingScopeUser, user.ID)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	if err := writeJSON("account.json", map[string]interface{}{
+		"user":              user,
+		"settings":          settings,
+		"workspaces":        owned,
+		"shared_workspaces": shared,
+		"exported_at":       time.Now(),
+	}); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	notebookCount := 0
+	for _, ws := range owned {
+		ids, err := s.store.ListWorkspaceNotebookIDs(ctx, ws.ID)
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		for _, id := range ids {
+			prefix := fmt.Sprintf("workspaces/%s/notebooks/%s/", ws.ID, id)
+			if err := s.exportNotebookData(ctx, id, prefix, writeJSON, copyFile); err != nil {
+				os.Remove(path)
+				return err
+			}
+			notebookCount++
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	job.ResultPath = path
+	job.Summary["workspaces"] = len(owned)
+	job.Summary["notebooks"] = notebookCount
+	return nil
+}
+
+// exportNotebookData writes a notebook's records and stored files under prefix
+func (s *Server) exportNotebookData(ctx context.Context, notebookID, prefix string,
+	writeJSON func(string, interface{}) error, copyFile func(string, string) error) error {
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	attachments, err := s.store.ListAttachments(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	summaries, err := s.store.ListChatSessions(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	sessions := make([]*ChatSession, 0, len(summaries))
+	for _, summary := range summaries {
+		if session, err := s.store.GetChatSession(ctx, summary.ID); err == nil {
+			sessions = append(sessions, session)
+		}
+	}
+	references, err := s.store.ListNotebookReferences(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+
+	if err := writeJSON(prefix+"notebook.json", map[string]interface{}{
+		"notebook":      notebook,
+		"sources":       sources,
+		"notes":         notes,
+		"attachments":   attachments,
+		"chat_sessions": sessions,
+		"references":    s.resolveReferences(ctx, references),
+	}); err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if path := sourceUploadPath(&source); path != "" {
+			if err := copyFile(prefix+"files/"+source.FileName, path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, att := range attachments {
+		if err := copyFile(prefix+"attachments/"+att.ID+"-"+att.FileName, att.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceUploadPath returns the stored upload behind a file source, if any
+func sourceUploadPath(source *Source) string {
+	path, _ := source.Metadata["path"].(string)
+	if path == "" || !strings.HasPrefix(filepath.Clean(path), filepath.Clean("./data/uploads")) {
+		return ""
+	}
+	return path
+}
+
+// purgeNotebook permanently deletes a notebook with its embeddings, uploaded
+// files and attachments
+func (s *Server) purgeNotebook(ctx context.Context, notebookID string) error {
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	attachments, err := s.store.ListAttachments(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	quarantined, err := s.store.ListQuarantinedFiles(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if path := sourceUploadPath(&source); path != "" {
+			os.Remove(path)
+		}
+	}
+	for _, att := range attachments {
+		os.Remove(att.Path)
+		if att.ThumbnailPath != "" {
+			os.Remove(att.ThumbnailPath)
+		}
+	}
+	for _, file := range quarantined {
+		os.Remove(file.Path)
+	}
+
+	// Deleting the notebook drops its embeddings
+	return s.store.DeleteNotebook(ctx, notebookID)
+}
+
+// deleteAccount hard-deletes a user. Workspaces where they are the only
+// member are deleted with all their notebooks; in shared workspaces only the
+// membership goes, and if they were the last owner the longest-standing
+// remaining member becomes owner. Their export archives are removed and their
+// ID and email are redacted from the audit logs.
+func (s *Server) deleteAccount(ctx context.Context, job *AccountJob) error {
+	user, err := s.store.GetUser(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+	owned, shared, err := s.ownedData(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	notebookCount := 0
+	for _, ws := range owned {
+		ids, err := s.store.ListWorkspaceNotebookIDs(ctx, ws.ID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := s.purgeNotebook(ctx, id); err != nil {
+				return fmt.Errorf("failed to delete notebook %s: %w", id, err)
+			}
+			notebookCount++
+		}
+		// The default workspace always exists; it becomes open again once its last member goes
+		if ws.ID != DefaultWorkspaceID {
+			if err := s.store.DeleteWorkspace(ctx, ws.ID); err != nil {
+				return err
+			}
+		}
+		s.agentsMu.Lock()
+		delete(s.workspaceAgents, ws.ID)
+		s.agentsMu.Unlock()
+	}
+
+	for _, ws := range shared {
+		if err := s.handOverWorkspace(ctx, ws.ID, user.ID); err != nil {
+			return err
+		}
+	}
+
+	paths, err := s.store.ListUserExportPaths(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	if err := s.store.ClearUserExportPaths(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if err := s.store.DeleteUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	redacted, err := redactAuditLogs(user.ID, user.Email)
+	if err != nil {
+		return fmt.Errorf("user deleted but audit log redaction failed: %w", err)
+	}
+
+	job.Summary["workspaces_deleted"] = len(owned)
+	job.Summary["workspaces_left"] = len(shared)
+	job.Summary["notebooks_deleted"] = notebookCount
+	job.Summary["audit_files_redacted"] = redacted
+	return nil
+}
+
+// handOverWorkspace removes a user from a shared workspace, promoting the
+// longest-standing remaining member when no other owner would be left
+func (s *Server) handOverWorkspace(ctx context.Context, workspaceID, userID string) error {
+	members, err := s.store.ListWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	var successor string
+	for _, m := range members {
+		if m.UserID == userID {
+			continue
+		}
+		if m.Role == RoleOwner {
+			successor = ""
+			break
+		}
+		if successor == "" {
+			successor = m.UserID
+		}
+	}
+	if successor != "" {
+		if err := s.store.SetWorkspaceMember(ctx, workspaceID, successor, RoleOwner); err != nil {
+			return err
+		}
+	}
+
+	return s.store.RemoveWorkspaceMember(ctx, workspaceID, userID)
+}
+
+// auditRedaction replaces identifiers of deleted users in the audit logs
+const auditRedaction = "[deleted user]"
+
+// redactAuditLogs rewrites the audit log files, replacing every occurrence of
+// the given terms, and returns how many files changed
+func redactAuditLogs(terms ...string) (int, error) {
+	files, err := filepath.Glob("./logs/audit.log.*")
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return changed, err
+		}
+		text := string(data)
+		for _, term := range terms {
+			if term != "" {
+				text = strings.ReplaceAll(text, term, auditRedaction)
+			}
+		}
+		if text == string(data) {
+			continue
+		}
+
+		// Write beside the file and rename so a crash never leaves a partial log
+		tmp := file + ".redact"
+		if err := os.WriteFile(tmp, []byte(text), 0644); err != nil {
+			return changed, err
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			os.Remove(tmp)
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Account handlers
+
+// accountJobResponse adds the download link to completed exports
+func accountJobResponse(job *AccountJob, prefix string) *AccountJob {
+	if job.Kind == AccountJobExport && job.Status == JobCompleted && job.ResultPath != "" {
+		job.DownloadURL = prefix + job.ID + "/download"
+	}
+	return job
+}
+
+func (s *Server) handleExportAccount(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "An API token is required to export an account"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	s.startAccountJobResponse(c, user.ID, AccountJobExport, s.exportAccount)
+}
+
+func (s *Server) handleDeleteAccount(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "An API token is required to delete an account"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	s.startAccountJobResponse(c, user.ID, AccountJobDelete, s.deleteAccount)
+}
+
+func (s *Server) handleAdminExportUser(c *gin.Context) {
+	if _, err := s.store.GetUser(context.Background(), c.Param("userId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "User not found"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	s.startAccountJobResponse(c, c.Param("userId"), AccountJobExport, s.exportAccount)
+}
+
+func (s *Server) handleAdminDeleteUser(c *gin.Context) {
+	if _, err := s.store.GetUser(context.Background(), c.Param("userId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "User not found"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	s.startAccountJobResponse(c, c.Param("userId"), AccountJobDelete, s.deleteAccount)
+}
+
+// startAccountJobResponse starts a job and answers 202 with it
+func (s *Server) startAccountJobResponse(c *gin.Context, userID, kind string, run func(context.Context, *AccountJob) error) {
+	job, err := s.startAccountJob(context.Background(), userID, kind, run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to start job"})
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+// loadAccountJob finds a job visible to the caller; users only see their own
+func (s *Server) loadAccountJob(c *gin.Context, admin bool) (*AccountJob, bool) {
+	job, err := s.store.GetAccountJob(context.Background(), c.Param("jobId"))
+	if err == nil && !admin {
+		if user := currentUser(c); user == nil || user.ID != job.UserID {
+			err = notFoundError("job")
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Job not found"})
+		return nil, false
+	}
+	return job, true
+}
+
+func (s *Server) handleGetAccountJob(c *gin.Context) {
+	if job, ok := s.loadAccountJob(c, false); ok {
+		c.JSON(http.StatusOK, accountJobResponse(job, "/api/account/jobs/"))
+	}
+}
+
+func (s *Server) handleDownloadAccountExport(c *gin.Context) {
+	if job, ok := s.loadAccountJob(c, false); ok {
+		serveAccountExport(c, job)
+	}
+}
+
+func (s *Server) handleAdminGetAccountJob(c *gin.Context) {
+	if job, ok := s.loadAccountJob(c, true); ok {
+		c.JSON(http.StatusOK, accountJobResponse(job, "/api/admin/account-jobs/"))
+	}
+}
+
+func (s *Server) handleAdminDownloadAccountExport(c *gin.Context) {
+	if job, ok := s.loadAccountJob(c, true); ok {
+		serveAccountExport(c, job)
+	}
+}
+
+// serveAccountExport sends a completed export archive
+func serveAccountExport(c *gin.Context, job *AccountJob) {
+	if job.Kind != AccountJobExport || job.Status != JobCompleted || job.ResultPath == "" {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Export is not ready"})
+		return
+	}
+	c.FileAttachment(job.ResultPath, fmt.Sprintf("notex-export-%s.zip", job.CreatedAt.Format("20060102")))
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/kataras/golog"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeDomains lists the server's own domains in ACME_DOMAINS
+func acmeDomains(cfg Config) []string {
+	var domains []string
+	for _, domain := range strings.Split(cfg.ACMEDomains, ",") {
+		if domain = normalizeDomain(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// newACMEManager returns the certificate manager for ACME_DOMAINS and the
+// workspaces' custom domains. Certificates are kept in ACME_CACHE_DIR; other
+// host names get none, so nobody can make the server request certificates
+// for names that are not its own.
+func (s *Server) newACMEManager() *autocert.Manager {
+	own := acmeDomains(s.cfg)
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(s.cfg.ACMECacheDir),
+		Email:  s.cfg.ACMEEmail,
+		Client: &acme.Client{DirectoryURL: s.cfg.ACMEDirectoryURL},
+		HostPolicy: func(ctx context.Context, host string) error {
+			if slices.Contains(own, host) || s.siteWorkspace(ctx, host) != "" {
+				return nil
+			}
+			return fmt.Errorf("%s is not one of the server's domains", host)
+		},
+	}
+}
+
+// serveACME serves HTTPS on HTTPS_PORT, and with ACME_HTTP_PORT set, HTTP-01
+// challenges and redirects to HTTPS there, until Shutdown
+func (s *Server) serveACME() error {
+	manager := s.newACMEManager()
+	if s.cfg.ACMEDNSProvider != "" {
+		s.loadDNSCertificates(context.Background())
+	}
+
+	tlsListener, err := net.Listen("tcp", net.JoinHostPort(s.cfg.ServerHost, s.cfg.HTTPSPort))
+	if err != nil {
+		return err
+	}
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.GetCertificate = s.getCertificate(manager)
+	httpsServer := &http.Server{Handler: s.handler(), TLSConfig: tlsConfig}
+	s.acmeServers = append(s.acmeServers, httpsServer)
+	golog.Infof("serving HTTPS on %s with certificates from %s", tlsListener.Addr(), s.cfg.ACMEDirectoryURL)
+	s.runJob(func() {
+		if err := httpsServer.ServeTLS(tlsListener, "", ""); err != nil && err != http.ErrServerClosed {
+			golog.Errorf("https server: %v", err)
+		}
+	})
+
+	if s.cfg.ACMEHTTPPort == "" {
+		return nil
+	}
+	challengeListener, err := net.Listen("tcp", net.JoinHostPort(s.cfg.ServerHost, s.cfg.ACMEHTTPPort))
+	if err != nil {
+		return err
+	}
+	challengeServer := &http.Server{Handler: manager.HTTPHandler(nil)}
+	s.acmeServers = append(s.acmeServers, challengeServer)
+	s.runJob(func() {
+		if err := challengeServer.Serve(challengeListener); err != nil && err != http.ErrServerClosed {
+			golog.Errorf("acme challenge server: %v", err)
+		}
+	})
+	return nil
+}
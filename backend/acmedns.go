@@ -0,0 +1,427 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DNS-01 providers for ACME_DNS_PROVIDER
+const (
+	dnsProviderCloudflare = "cloudflare"
+	dnsProviderExec       = "exec"
+)
+
+const (
+	// dnsCertificateSchedule is how often the DNS-01 certificates are checked
+	dnsCertificateSchedule = "@every 12h"
+	// dnsRenewBefore is how long before it expires a certificate is renewed
+	dnsRenewBefore = 30 * 24 * time.Hour
+	// dnsIssueTimeout bounds one certificate order, propagation wait included
+	dnsIssueTimeout = 10 * time.Minute
+	// acmeAccountKey is the cache entry autocert keeps the account key in,
+	// so both use one account
+	acmeAccountKey = "acme_account+key"
+)
+
+// DNSProvider creates the TXT records of DNS-01 challenges
+type DNSProvider interface {
+	// Present creates a TXT record with the value at fqdn and returns a
+	// function that removes it
+	Present(ctx context.Context, fqdn, value string) (cleanup func(context.Context) error, err error)
+}
+
+// newDNSProvider returns the provider ACME_DNS_PROVIDER names, or nil
+func newDNSProvider(cfg Config) DNSProvider {
+	switch cfg.ACMEDNSProvider {
+	case dnsProviderCloudflare:
+		return &cloudflareDNS{
+			url:    strings.TrimRight(cfg.CloudflareAPIURL, "/"),
+			token:  cfg.CloudflareAPIToken,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+	case dnsProviderExec:
+		return execDNS{command: strings.Fields(cfg.ACMEDNSExec)}
+	}
+	return nil
+}
+
+// execDNS runs a command to create and remove records, called as
+// "<command> present|cleanup <fqdn> <value>" like lego's exec provider
+type execDNS struct {
+	command []string
+}
+
+func (e execDNS) run(ctx context.Context, action, fqdn, value string) error {
+	args := append(e.command[1:len(e.command):len(e.command)], action, fqdn, value)
+	if output, err := exec.CommandContext(ctx, e.command[0], args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ACME_DNS_EXEC %s failed: %w, output: %s", action, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func (e execDNS) Present(ctx context.Context, fqdn, value string) (func(context.Context) error, error) {
+	if err := e.run(ctx, "present", fqdn, value); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error { return e.run(ctx, "cleanup", fqdn, value) }, nil
+}
+
+// cloudflareDNS creates records through the Cloudflare API, with a token
+// that may edit the DNS of the domains' zones
+type cloudflareDNS struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// call sends a request to the API and decodes the result into v
+func (cf *cloudflareDNS) call(ctx context.Context, method, path string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cf.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cf.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := cf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s %s: status %d: %s", method, path, resp.StatusCode, strings.Join(messages, "; "))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, v)
+}
+
+// zone finds the zone holding fqdn, trying its parent domains in turn
+func (cf *cloudflareDNS) zone(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		name := strings.Join(labels[i:], ".")
+		if err := cf.call(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone holds %s", fqdn)
+}
+
+func (cf *cloudflareDNS) Present(ctx context.Context, fqdn, value string) (func(context.Context) error, error) {
+	zone, err := cf.zone(ctx, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	if err := cf.call(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", map[string]interface{}{
+		"type": "TXT", "name": fqdn, "content": value, "ttl": 120,
+	}, &record); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		return cf.call(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+record.ID, nil, nil)
+	}, nil
+}
+
+// dnsCertificates holds the certificates issued with DNS-01, by the domain
+// in ACME_DOMAINS they are for
+type dnsCertificates struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+func (d *dnsCertificates) get(domain string) *tls.Certificate {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.certs[domain]
+}
+
+func (d *dnsCertificates) set(domain string, cert *tls.Certificate) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.certs == nil {
+		d.certs = make(map[string]*tls.Certificate)
+	}
+	d.certs[domain] = cert
+}
+
+// dnsDomain returns the entry of ACME_DOMAINS that covers host, directly or
+// as a wildcard, when certificates come from a DNS provider
+func (s *Server) dnsDomain(host string) (string, bool) {
+	if s.cfg.ACMEDNSProvider == "" {
+		return "", false
+	}
+	_, parent, _ := strings.Cut(host, ".")
+	for _, domain := range acmeDomains(s.cfg) {
+		if domain == host || (parent != "" && domain == "*."+parent) {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// getCertificate serves the DNS-01 certificates, and leaves the other host
+// names to autocert
+func (s *Server) getCertificate(manager *autocert.Manager) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		host := normalizeDomain(hello.ServerName)
+		domain, ok := s.dnsDomain(host)
+		if !ok {
+			return manager.GetCertificate(hello)
+		}
+		if cert := s.dnsCerts.get(domain); cert != nil {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("the certificate for %s is not issued yet", host)
+	}
+}
+
+// dnsCacheKey is the cache entry of a domain's DNS-01 certificate, apart
+// from autocert's
+func dnsCacheKey(domain string) string {
+	return "dns01+" + strings.ReplaceAll(domain, "*", "_")
+}
+
+// loadDNSCertificates reads the DNS-01 certificates not loaded yet from
+// ACME_CACHE_DIR, where they were saved when issued
+func (s *Server) loadDNSCertificates(ctx context.Context) {
+	cache := autocert.DirCache(s.cfg.ACMECacheDir)
+	for _, domain := range acmeDomains(s.cfg) {
+		if s.dnsCerts.get(domain) != nil {
+			continue
+		}
+		data, err := cache.Get(ctx, dnsCacheKey(domain))
+		if err == autocert.ErrCacheMiss {
+			continue
+		}
+		if err == nil {
+			var cert tls.Certificate
+			if cert, err = tls.X509KeyPair(data, data); err == nil {
+				s.dnsCerts.set(domain, &cert)
+				continue
+			}
+		}
+		golog.Errorf("failed to load the certificate for %s: %v", domain, err)
+	}
+}
+
+// renewDNSCertificates issues a certificate for each domain in ACME_DOMAINS
+// that has none or whose certificate expires within dnsRenewBefore
+func (s *Server) renewDNSCertificates(ctx context.Context) error {
+	s.loadDNSCertificates(ctx)
+
+	var errs []error
+	for _, domain := range acmeDomains(s.cfg) {
+		if cert := s.dnsCerts.get(domain); cert != nil && time.Until(cert.Leaf.NotAfter) > dnsRenewBefore {
+			continue
+		}
+		issueCtx, cancel := context.WithTimeout(ctx, dnsIssueTimeout)
+		cert, err := s.issueDNSCertificate(issueCtx, domain)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+			continue
+		}
+		s.dnsCerts.set(domain, cert)
+		golog.Infof("issued a certificate for %s, valid until %s", domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return errors.Join(errs...)
+}
+
+// acmeClient returns a client registered with the account autocert uses,
+// creating the account when there is none yet
+func (s *Server) acmeClient(ctx context.Context, cache autocert.Cache) (*acme.Client, error) {
+	var key *ecdsa.PrivateKey
+	data, err := cache.Get(ctx, acmeAccountKey)
+	switch {
+	case err == autocert.ErrCacheMiss:
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := cache.Put(ctx, acmeAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM key in %s", acmeAccountKey)
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %w", acmeAccountKey, err)
+		}
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: s.cfg.ACMEDirectoryURL}
+	account := &acme.Account{}
+	if s.cfg.ACMEEmail != "" {
+		account.Contact = []string{"mailto:" + s.cfg.ACMEEmail}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("failed to register the ACME account: %w", err)
+	}
+	return client, nil
+}
+
+// issueDNSCertificate orders a certificate for a domain, answering its
+// challenges with TXT records, and saves it in ACME_CACHE_DIR
+func (s *Server) issueDNSCertificate(ctx context.Context, domain string) (*tls.Certificate, error) {
+	provider := newDNSProvider(s.cfg)
+	cache := autocert.DirCache(s.cfg.ACMECacheDir)
+	client, err := s.acmeClient(ctx, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	var accept []*acme.Challenge
+	var authorizations []string
+	var cleanups []func(context.Context) error
+	defer func() {
+		for _, cleanup := range cleanups {
+			if err := cleanup(context.Background()); err != nil {
+				golog.Warnf("failed to remove the challenge record for %s: %v", domain, err)
+			}
+		}
+	}()
+	for _, u := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			return nil, fmt.Errorf("the CA offers no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		cleanup, err := provider.Present(ctx, "_acme-challenge."+authz.Identifier.Value, value)
+		if err != nil {
+			return nil, err
+		}
+		cleanups = append(cleanups, cleanup)
+		accept = append(accept, challenge)
+		authorizations = append(authorizations, authz.URI)
+	}
+
+	if len(accept) > 0 {
+		select {
+		case <-time.After(time.Duration(s.cfg.ACMEDNSWait) * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	for i, challenge := range accept {
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if _, err := client.WaitAuthorization(ctx, authorizations[i]); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	pem.Encode(&data, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	cert, err := tls.X509KeyPair(data.Bytes(), data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Put(ctx, dnsCacheKey(domain), data.Bytes()); err != nil {
+		golog.Errorf("failed to save the certificate for %s: %v", domain, err)
+	}
+	return &cert, nil
+}
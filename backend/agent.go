@@ -13,6 +13,7 @@ import (
 	ollamallm "github.com/tmc/langchaingo/llms/ollama"
 	"github.com/tmc/langchaingo/llms/openai"
 	"github.com/tmc/langchaingo/prompts"
+	"github.com/tmc/langchaingo/schema"
 )
 
 // Agent handles AI operations for generating notes and chat responses
@@ -21,47 +22,59 @@ type Agent struct {
 	llm         llms.Model
 	cfg         Config
 	provider    LLMProvider
+	prompts     *PromptStore
+	// structured caches the LLMs constrained to each output schema
+	structured structuredLLMs
 }
 
-// NewAgent creates a new agent
-func NewAgent(cfg Config, vectorStore *VectorStore) (*Agent, error) {
+// NewAgent creates a new agent. prompts may be nil to use the built-in prompts only.
+func NewAgent(cfg Config, vectorStore *VectorStore, prompts *PromptStore) (*Agent, error) {
 	llm, err := createLLM(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LLM: %w", err)
 	}
+	if llm, err = newResilientLLM(cfg, llm); err != nil {
+		return nil, err
+	}
 
-	provider := NewGeminiClient(cfg.GoogleAPIKey, llm)
+	provider := NewGeminiClient(cfg, llm)
 
 	return &Agent{
 		vectorStore: vectorStore,
 		llm:         llm,
 		cfg:         cfg,
 		provider:    provider,
+		prompts:     prompts,
 	}, nil
 }
 
-// createLLM creates an LLM based on configuration
-func createLLM(cfg Config) (llms.Model, error) {
+// createLLM creates an LLM based on configuration. The extra options apply
+// to OpenAI-compatible providers.
+func createLLM(cfg Config, extra ...openai.Option) (llms.Model, error) {
+	// resilientLLM does the retrying
+	client := providerHTTPClient(cfg, 0, 0)
 	if cfg.IsOllama() {
 		return ollamallm.New(
 			ollamallm.WithModel(cfg.OllamaModel),
 			ollamallm.WithServerURL(cfg.OllamaBaseURL),
+			ollamallm.WithHTTPClient(client),
 		)
 	}
 
 	opts := []openai.Option{
 		openai.WithToken(cfg.OpenAIAPIKey),
 		openai.WithModel(cfg.OpenAIModel),
+		openai.WithHTTPClient(client),
 	}
 	if cfg.OpenAIBaseURL != "" {
 		opts = append(opts, openai.WithBaseURL(cfg.OpenAIBaseURL))
 	}
 
-	return openai.New(opts...)
+	return openai.New(append(opts, extra...)...)
 }
 
-// GenerateTransformation generates a note based on transformation type
-func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationRequest, sources []Source) (*TransformationResponse, error) {
+// transformationPrompt fills a transformation type's prompt with the sources
+func (a *Agent) transformationPrompt(req *TransformationRequest, sources []Source) (string, error) {
 	// Build context from sources
 	var sourceContext strings.Builder
 	for i, src := range sources {
@@ -88,11 +101,11 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 	}
 
 	// Build prompt using f-string format (no Go template reserved names issue)
-	promptTemplate := getTransformationPrompt(req.Type)
+	promptTemplate := a.prompts.Get(transformationPromptName(req.Type))
 
 	prompt := prompts.NewPromptTemplate(
 		promptTemplate,
-		[]string{"sources", "type", "length", "format", "prompt"},
+		transformationPromptVars,
 	)
 	prompt.TemplateFormat = prompts.TemplateFormatFString
 
@@ -104,18 +117,41 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 		"prompt":  req.Prompt,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to format prompt: %w", err)
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+	return promptValue + languageInstruction(req.Language), nil
+}
+
+// sourceSummaries lists the sources a generation used
+func sourceSummaries(sources []Source) []SourceSummary {
+	summaries := make([]SourceSummary, len(sources))
+	for i, src := range sources {
+		summaries[i] = SourceSummary{
+			ID:   src.ID,
+			Name: src.Name,
+			Type: src.Type,
+		}
+	}
+	return summaries
+}
+
+// GenerateTransformation generates a note based on transformation type
+func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationRequest, sources []Source) (*TransformationResponse, error) {
+	promptValue, err := a.transformationPrompt(req, sources)
+	if err != nil {
+		return nil, err
 	}
 
 	// Generate response
 	var response string
 	var genErr error
+	ctx, answered := withAnsweredBy(ctx)
 
 	if req.Type == "ppt" {
 		response, genErr = a.provider.GenerateTextWithModel(ctx, promptValue, "gemini-3-flash-preview")
 	} else if req.Type == "insight" {
 		// For insight type: first generate a summary, then call DeepInsight
-		ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+		ctx, cancel := withTimeout(ctx, a.cfg.LLMTimeout)
 		defer cancel()
 
 		// Step 1: Generate summary
@@ -130,7 +166,7 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 			return nil, fmt.Errorf("failed to generate deep insight: %w", err)
 		}
 	} else {
-		ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+		ctx, cancel := withTimeout(ctx, a.cfg.LLMTimeout)
 		defer cancel()
 		response, genErr = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
 	}
@@ -139,32 +175,78 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 		return nil, fmt.Errorf("failed to generate response: %w", genErr)
 	}
 
-	// Build source summaries
-	sourceSummaries := make([]SourceSummary, len(sources))
-	for i, src := range sources {
-		sourceSummaries[i] = SourceSummary{
-			ID:   src.ID,
-			Name: src.Name,
-			Type: src.Type,
-		}
+	metadata := map[string]interface{}{
+		"length": req.Length,
+		"format": req.Format,
+	}
+	if answered.Provider != "" {
+		metadata["answered_by"] = *answered
 	}
 
 	return &TransformationResponse{
 		Type:      req.Type,
 		Content:   response,
-		Sources:   sourceSummaries,
+		Sources:   sourceSummaries(sources),
 		CreatedAt: time.Now(),
-		Metadata: map[string]interface{}{
-			"length": req.Length,
-			"format": req.Format,
-		},
+		Metadata:  metadata,
 	}, nil
 }
 
+// ChatOptions customizes a chat query
+type ChatOptions struct {
+	// Settings customizes the prompt and may be nil
+	Settings *ChatSettings
+	// Tools the model may call while answering
+	Tools []*ChatTool
+	// WebResults are blended into the context as labeled web citations
+	WebResults []WebResult
+	// NotebookIDs lists the notebooks to retrieve from; defaults to the chat's notebook
+	NotebookIDs []string
+	// NotebookNames labels sources by notebook when several are queried
+	NotebookNames map[string]string
+	// Language is the notebook's language tag for the answer; "" keeps the
+	// prompt's own
+	Language string
+	// Partial, when set, receives the answer as the provider streams it.
+	// Answers using tools are not streamed.
+	Partial *strings.Builder
+	// VerifyCitations checks the answer's citations as VERIFY_CITATIONS does
+	VerifyCitations bool
+	// Variant overrides how sources are retrieved, for an experiment
+	Variant *ExperimentVariant
+	// ChatPrompt replaces the active chat prompt template when set
+	ChatPrompt string
+}
+
 // Chat performs a chat query with RAG
-func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []ChatMessage) (*ChatResponse, error) {
+func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []ChatMessage, opts ChatOptions) (*ChatResponse, error) {
+	settings := opts.Settings
+	verify := a.cfg.VerifyCitations || opts.VerifyCitations
+	if verify && (settings == nil || settings.CitationStyle == "") {
+		// Verification needs to know what each sentence cites
+		numbered := ChatSettings{CitationStyle: "numbered"}
+		if settings != nil {
+			numbered = *settings
+			numbered.CitationStyle = "numbered"
+		}
+		settings = &numbered
+	}
+
+	notebookIDs := opts.NotebookIDs
+	if len(notebookIDs) == 0 {
+		notebookIDs = []string{notebookID}
+	}
+
 	// Perform similarity search to find relevant sources
-	docs, err := a.vectorStore.SimilaritySearch(ctx, message, a.cfg.MaxSources)
+	searchCtx, cancelSearch := withTimeout(ctx, a.cfg.QueryTimeout)
+	var docs []schema.Document
+	var err error
+	if v := opts.Variant; v != nil {
+		docs, err = a.retrieveVariant(searchCtx, message, notebookIDs, v)
+	} else {
+		docs, err = a.vectorStore.SimilaritySearch(searchCtx, message, a.cfg.MaxSources, notebookIDs)
+	}
+	cancelSearch()
 	if err != nil {
 		return nil, fmt.Errorf("failed to search documents: %w", err)
 	}
@@ -176,8 +258,22 @@ func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []
 		for i, doc := range docs {
 			contextBuilder.WriteString(fmt.Sprintf("[来源 %d] %s\n", i+1, doc.PageContent))
 			if source, ok := doc.Metadata["source"].(string); ok {
-				contextBuilder.WriteString(fmt.Sprintf("来源: %s\n\n", source))
+				if name := opts.NotebookNames[docNotebookID(doc)]; name != "" && len(notebookIDs) > 1 {
+					contextBuilder.WriteString(fmt.Sprintf("来源: %s（笔记本: %s）\n\n", source, name))
+				} else {
+					contextBuilder.WriteString(fmt.Sprintf("来源: %s\n\n", source))
+				}
+			}
+		}
+	}
+	if len(opts.WebResults) > 0 {
+		contextBuilder.WriteString("网络搜索结果（引用时请标注为 [网页 N] 并注明链接，以区别于笔记本来源）：\n\n")
+		for i, r := range opts.WebResults {
+			text := r.Content
+			if text == "" {
+				text = r.Snippet
 			}
+			contextBuilder.WriteString(fmt.Sprintf("[网页 %d] %s\n%s\n链接: %s\n\n", i+1, r.Title, text, r.URL))
 		}
 	}
 
@@ -195,9 +291,13 @@ func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []
 	}
 
 	// Create RAG prompt using f-string format
+	chatPrompt := opts.ChatPrompt
+	if chatPrompt == "" {
+		chatPrompt = a.prompts.Get("chat")
+	}
 	promptTemplate := prompts.NewPromptTemplate(
-		chatSystemPrompt(),
-		[]string{"history", "context", "question"},
+		chatPromptWithSettings(a.prompts.Get("chat_persona"), chatPrompt, settings),
+		chatPromptVars,
 	)
 	promptTemplate.TemplateFormat = prompts.TemplateFormatFString
 
@@ -209,40 +309,98 @@ func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []
 	if err != nil {
 		return nil, fmt.Errorf("failed to format prompt: %w", err)
 	}
+	promptValue += languageInstruction(opts.Language)
 
 	// Generate response
-	ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+	ctx, cancel := withTimeout(ctx, a.cfg.LLMTimeout)
 	defer cancel()
+	ctx, answered := withAnsweredBy(ctx)
 
-	response, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+	var options []llms.CallOption
+	if settings != nil && settings.Temperature != nil {
+		options = append(options, llms.WithTemperature(*settings.Temperature))
+	}
+
+	var response string
+	var toolCalls []ToolCallTrace
+	if len(opts.Tools) > 0 {
+		response, toolCalls, err = a.generateWithTools(ctx, notebookID, promptValue, opts.Tools, options)
+	} else {
+		if opts.Partial != nil {
+			options = append(options, llms.WithStreamingFunc(func(_ context.Context, chunk []byte) error {
+				opts.Partial.Write(chunk)
+				return nil
+			}))
+		}
+		response, err = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue, options...)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate response: %w", err)
 	}
 
 	// Build source summaries
 	sourceSummaries := make([]SourceSummary, 0, len(docs))
-	sourceMap := make(map[string]bool)
+	sourceMap := make(map[string]int)
 	for _, doc := range docs {
 		if source, ok := doc.Metadata["source"].(string); ok {
-			if !sourceMap[source] {
+			id := source
+			if sourceID, ok := doc.Metadata["source_id"].(string); ok {
+				id = sourceID
+			}
+			i, seen := sourceMap[id]
+			if !seen {
+				nbID := docNotebookID(doc)
 				sourceSummaries = append(sourceSummaries, SourceSummary{
-					ID:   source,
-					Name: source,
-					Type: "file",
+					ID:           id,
+					Name:         source,
+					Type:         "file",
+					NotebookID:   nbID,
+					NotebookName: opts.NotebookNames[nbID],
 				})
-				sourceMap[source] = true
+				i = len(sourceSummaries) - 1
+				sourceMap[id] = i
+			}
+			// Record the cited chunk so it can be resolved to a passage
+			if chunk, ok := doc.Metadata["chunk"].(int); ok {
+				sourceSummaries[i].Chunks = append(sourceSummaries[i].Chunks, chunk)
 			}
 		}
 	}
+	for _, r := range opts.WebResults {
+		sourceSummaries = append(sourceSummaries, SourceSummary{
+			ID:   r.URL,
+			Name: r.Title,
+			Type: "web",
+			URL:  r.URL,
+		})
+	}
 
-	return &ChatResponse{
+	metadata := map[string]interface{}{
+		"docs_retrieved": len(docs),
+		"web_results":    len(opts.WebResults),
+		"notebooks":      len(notebookIDs),
+	}
+	if answered.Provider != "" {
+		metadata["answered_by"] = *answered
+	}
+
+	chatResponse := &ChatResponse{
 		Message:   response,
 		Sources:   sourceSummaries,
+		ToolCalls: toolCalls,
 		SessionID: notebookID,
-		Metadata: map[string]interface{}{
-			"docs_retrieved": len(docs),
-		},
-	}, nil
+		Metadata:  metadata,
+	}
+	if verify {
+		a.verifyAnswer(ctx, chatResponse, docs, opts.Language)
+	}
+	return chatResponse, nil
+}
+
+// docNotebookID returns the notebook a retrieved document was indexed from
+func docNotebookID(doc schema.Document) string {
+	id, _ := doc.Metadata["notebook_id"].(string)
+	return id
 }
 
 // Slide represents a parsed PPT slide
@@ -397,6 +555,95 @@ func (a *Agent) GenerateSummary(ctx context.Context, sources []Source, length st
 	return resp.Content, nil
 }
 
+// maxSuggestedTags bounds how many tags SuggestTags returns
+const maxSuggestedTags = 5
+
+// SuggestTags proposes a few short tags for filing sources or notes
+func (a *Agent) SuggestTags(ctx context.Context, sources []Source) ([]string, error) {
+	req := &TransformationRequest{
+		Type:   "tags",
+		Length: "short",
+		Format: "text",
+	}
+
+	resp, err := a.GenerateTransformation(ctx, req, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTags(resp.Content), nil
+}
+
+// tagListMarker matches bullets, numbering and hashes before a tag
+var tagListMarker = regexp.MustCompile(`^(?:[-*•]\s*|\d+[.)]\s*|#)+`)
+
+// parseTags splits a model's comma or line separated tag list, dropping
+// list markers, hashes and duplicates
+func parseTags(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '，' || r == '、' || r == '\n' || r == ';'
+	})
+	seen := make(map[string]bool)
+	tags := make([]string, 0, len(fields))
+	for _, f := range fields {
+		tag := tagListMarker.ReplaceAllString(strings.TrimSpace(f), "")
+		tag = strings.TrimSpace(strings.Trim(tag, "\"'`"))
+		key := strings.ToLower(tag)
+		if tag == "" || len(tag) > 50 || seen[key] {
+			continue
+		}
+		seen[key] = true
+		tags = append(tags, tag)
+		if len(tags) == maxSuggestedTags {
+			break
+		}
+	}
+	return tags
+}
+
+// Entity types
+const (
+	EntityPerson       = "person"
+	EntityOrganization = "organization"
+	EntityProject      = "project"
+)
+
+// ExtractedEntity is an entity the LLM found in a text
+type ExtractedEntity struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// ExtractEntities finds the people, organizations and projects a source or
+// note mentions
+func (a *Agent) ExtractEntities(ctx context.Context, sources []Source) ([]ExtractedEntity, error) {
+	req := &TransformationRequest{
+		Type:   "entities",
+		Format: "JSON",
+	}
+
+	var out struct {
+		Entities []ExtractedEntity `json:"entities"`
+	}
+	if _, err := a.GenerateStructured(ctx, req, sources, &out); err != nil {
+		return nil, err
+	}
+
+	// The schema fixes the types; names may still repeat or be blank
+	seen := make(map[string]bool)
+	var entities []ExtractedEntity
+	for _, e := range out.Entities {
+		name := strings.TrimSpace(e.Name)
+		key := e.Type + "|" + strings.ToLower(name)
+		if name == "" || len(name) > 100 || seen[key] {
+			continue
+		}
+		seen[key] = true
+		entities = append(entities, ExtractedEntity{Type: e.Type, Name: name})
+	}
+	return entities, nil
+}
+
 // callDeepInsight executes the DeepInsight CLI tool and returns the generated report
 func (a *Agent) callDeepInsight(ctx context.Context, summary string) (string, error) {
 	// Create a temporary file for the report output
@@ -404,7 +651,7 @@ func (a *Agent) callDeepInsight(ctx context.Context, summary string) (string, er
 
 	// Execute DeepInsight command
 	// DeepInsight -o report.md "summary text"
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	defer cancel()
 	output, err := execCommandContext(ctx, "./DeepInsight", "-o", tmpFile, escapeShellArg(summary))
 	if err != nil {
@@ -0,0 +1,282 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How much a contradiction or gap matters
+const (
+	AnalysisSeverityHigh   = "high"
+	AnalysisSeverityMedium = "medium"
+	AnalysisSeverityLow    = "low"
+)
+
+// analysisSeverityRank orders findings most severe first
+var analysisSeverityRank = map[string]int{
+	AnalysisSeverityHigh:   0,
+	AnalysisSeverityMedium: 1,
+	AnalysisSeverityLow:    2,
+}
+
+// AnalysisClaim is one side of a contradiction
+type AnalysisClaim struct {
+	SourceID   string `json:"source_id,omitempty"`
+	SourceName string `json:"source_name,omitempty"`
+	Claim      string `json:"claim"`
+	Quote      string `json:"quote"`
+	// Verified is set when the quote was found in the source as given
+	Verified bool `json:"verified"`
+}
+
+// Contradiction is a set of claims in the sources that cannot all be true
+type Contradiction struct {
+	Topic       string          `json:"topic"`
+	Claims      []AnalysisClaim `json:"claims"`
+	Explanation string          `json:"explanation"`
+	Severity    string          `json:"severity"`
+}
+
+// KnowledgeGap is a question the sources leave open
+type KnowledgeGap struct {
+	Question   string `json:"question"`
+	Reason     string `json:"reason"`
+	Suggestion string `json:"suggestion"`
+	Severity   string `json:"severity"`
+}
+
+// AnalysisReport is what a contradiction and gap analysis found, most severe
+// first
+type AnalysisReport struct {
+	Contradictions []Contradiction `json:"contradictions"`
+	Gaps           []KnowledgeGap  `json:"gaps"`
+}
+
+// analysisOutput is the analysis as the model writes it, citing sources by
+// their number in the prompt
+type analysisOutput struct {
+	Contradictions []struct {
+		Topic  string `json:"topic"`
+		Claims []struct {
+			Source int    `json:"source"`
+			Claim  string `json:"claim"`
+			Quote  string `json:"quote"`
+		} `json:"claims"`
+		Explanation string `json:"explanation"`
+		Severity    string `json:"severity"`
+	} `json:"contradictions"`
+	Gaps []KnowledgeGap `json:"gaps"`
+}
+
+// buildAnalysisReport resolves the sources the model cited by number and
+// checks its quotes against them
+func buildAnalysisReport(out *analysisOutput, sources []Source) *AnalysisReport {
+	report := &AnalysisReport{Contradictions: []Contradiction{}, Gaps: []KnowledgeGap{}}
+	for _, c := range out.Contradictions {
+		contradiction := Contradiction{Topic: c.Topic, Claims: []AnalysisClaim{}, Explanation: c.Explanation, Severity: c.Severity}
+		for _, claim := range c.Claims {
+			ac := AnalysisClaim{Claim: claim.Claim, Quote: claim.Quote}
+			if claim.Source >= 1 && claim.Source <= len(sources) {
+				src := sources[claim.Source-1]
+				ac.SourceID, ac.SourceName = src.ID, src.Name
+				ac.Verified = quoteIn(src.Content, claim.Quote)
+			}
+			contradiction.Claims = append(contradiction.Claims, ac)
+		}
+		report.Contradictions = append(report.Contradictions, contradiction)
+	}
+	report.Gaps = append(report.Gaps, out.Gaps...)
+
+	sort.SliceStable(report.Contradictions, func(i, j int) bool {
+		return analysisSeverityRank[report.Contradictions[i].Severity] < analysisSeverityRank[report.Contradictions[j].Severity]
+	})
+	sort.SliceStable(report.Gaps, func(i, j int) bool {
+		return analysisSeverityRank[report.Gaps[i].Severity] < analysisSeverityRank[report.Gaps[j].Severity]
+	})
+	return report
+}
+
+// quoteIn reports whether a quote occurs in a text, ignoring differences in
+// whitespace and case
+func quoteIn(text, quote string) bool {
+	quote = strings.ToLower(strings.Join(strings.Fields(quote), " "))
+	if quote == "" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(strings.Join(strings.Fields(text), " ")), quote)
+}
+
+// analysisLabels are the words of a report note in one language
+type analysisLabels struct {
+	contradictions, noContradictions string
+	gaps, noGaps                     string
+	severity                         string
+	severities                       map[string]string
+	unknownSource, quoteNotFound     string
+	suggestion                       string
+	// open, close and colon are the language's parentheses and colon
+	open, close, colon string
+}
+
+// analysisLabelsByLanguage are the report labels by language code; notes of
+// notebooks without a language use Chinese, like the built-in prompts
+var analysisLabelsByLanguage = map[string]*analysisLabels{
+	"zh": {contradictions: "矛盾", noContradictions: "未发现来源之间的矛盾。", gaps: "缺口", noGaps: "未发现来源没有回答的问题。",
+		severity: "严重程度", severities: map[string]string{AnalysisSeverityHigh: "高", AnalysisSeverityMedium: "中", AnalysisSeverityLow: "低"},
+		unknownSource: "未知来源", quoteNotFound: "未在来源中找到这段原文", suggestion: "建议", open: "（", close: "）", colon: "："},
+	"ja": {contradictions: "矛盾", noContradictions: "ソース間の矛盾は見つかりませんでした。", gaps: "不足", noGaps: "ソースが答えていない問いは見つかりませんでした。",
+		severity: "重要度", severities: map[string]string{AnalysisSeverityHigh: "高", AnalysisSeverityMedium: "中", AnalysisSeverityLow: "低"},
+		unknownSource: "不明なソース", quoteNotFound: "この引用はソースに見つかりませんでした", suggestion: "提案", open: "（", close: "）", colon: "："},
+	"ko": {contradictions: "모순", noContradictions: "출처 간의 모순을 찾지 못했습니다.", gaps: "공백", noGaps: "출처가 답하지 않은 질문을 찾지 못했습니다.",
+		severity: "심각도", severities: map[string]string{AnalysisSeverityHigh: "높음", AnalysisSeverityMedium: "중간", AnalysisSeverityLow: "낮음"},
+		unknownSource: "알 수 없는 출처", quoteNotFound: "이 인용문을 출처에서 찾지 못했습니다", suggestion: "제안", open: " (", close: ")", colon: ": "},
+	"en": {contradictions: "Contradictions", noContradictions: "No contradictions were found between the sources.", gaps: "Gaps", noGaps: "No questions were found that the sources leave open.",
+		severity: "severity", severities: map[string]string{AnalysisSeverityHigh: "high", AnalysisSeverityMedium: "medium", AnalysisSeverityLow: "low"},
+		unknownSource: "Unknown source", quoteNotFound: "this quote was not found in the source", suggestion: "Suggestion", open: " (", close: ")", colon: ": "},
+	"de": {contradictions: "Widersprüche", noContradictions: "Zwischen den Quellen wurden keine Widersprüche gefunden.", gaps: "Lücken", noGaps: "Es wurden keine Fragen gefunden, die die Quellen offen lassen.",
+		severity: "Schweregrad", severities: map[string]string{AnalysisSeverityHigh: "hoch", AnalysisSeverityMedium: "mittel", AnalysisSeverityLow: "niedrig"},
+		unknownSource: "Unbekannte Quelle", quoteNotFound: "dieses Zitat wurde in der Quelle nicht gefunden", suggestion: "Vorschlag", open: " (", close: ")", colon: ": "},
+	"fr": {contradictions: "Contradictions", noContradictions: "Aucune contradiction n'a été trouvée entre les sources.", gaps: "Lacunes", noGaps: "Aucune question laissée ouverte par les sources n'a été trouvée.",
+		severity: "gravité", severities: map[string]string{AnalysisSeverityHigh: "élevée", AnalysisSeverityMedium: "moyenne", AnalysisSeverityLow: "faible"},
+		unknownSource: "Source inconnue", quoteNotFound: "cette citation est introuvable dans la source", suggestion: "Suggestion", open: " (", close: ")", colon: " : "},
+	"es": {contradictions: "Contradicciones", noContradictions: "No se encontraron contradicciones entre las fuentes.", gaps: "Lagunas", noGaps: "No se encontraron preguntas que las fuentes dejen abiertas.",
+		severity: "gravedad", severities: map[string]string{AnalysisSeverityHigh: "alta", AnalysisSeverityMedium: "media", AnalysisSeverityLow: "baja"},
+		unknownSource: "Fuente desconocida", quoteNotFound: "esta cita no se encontró en la fuente", suggestion: "Sugerencia", open: " (", close: ")", colon: ": "},
+	"it": {contradictions: "Contraddizioni", noContradictions: "Non sono state trovate contraddizioni tra le fonti.", gaps: "Lacune", noGaps: "Non sono state trovate domande lasciate aperte dalle fonti.",
+		severity: "gravità", severities: map[string]string{AnalysisSeverityHigh: "alta", AnalysisSeverityMedium: "media", AnalysisSeverityLow: "bassa"},
+		unknownSource: "Fonte sconosciuta", quoteNotFound: "questa citazione non è stata trovata nella fonte", suggestion: "Suggerimento", open: " (", close: ")", colon: ": "},
+	"pt": {contradictions: "Contradições", noContradictions: "Não foram encontradas contradições entre as fontes.", gaps: "Lacunas", noGaps: "Não foram encontradas perguntas que as fontes deixem em aberto.",
+		severity: "gravidade", severities: map[string]string{AnalysisSeverityHigh: "alta", AnalysisSeverityMedium: "média", AnalysisSeverityLow: "baixa"},
+		unknownSource: "Fonte desconhecida", quoteNotFound: "esta citação não foi encontrada na fonte", suggestion: "Sugestão", open: " (", close: ")", colon: ": "},
+	"nl": {contradictions: "Tegenstrijdigheden", noContradictions: "Er zijn geen tegenstrijdigheden tussen de bronnen gevonden.", gaps: "Hiaten", noGaps: "Er zijn geen vragen gevonden die de bronnen openlaten.",
+		severity: "ernst", severities: map[string]string{AnalysisSeverityHigh: "hoog", AnalysisSeverityMedium: "gemiddeld", AnalysisSeverityLow: "laag"},
+		unknownSource: "Onbekende bron", quoteNotFound: "dit citaat is niet in de bron gevonden", suggestion: "Suggestie", open: " (", close: ")", colon: ": "},
+}
+
+// analysisLabelsFor returns the report labels for a language tag
+func analysisLabelsFor(tag string) *analysisLabels {
+	if lang, _ := lookupLanguage(tag); lang != nil {
+		if labels, ok := analysisLabelsByLanguage[lang.Code]; ok {
+			return labels
+		}
+	}
+	return analysisLabelsByLanguage["zh"]
+}
+
+// markdown renders the report as the content of a note, labeled in the
+// notebook's language
+func (r *AnalysisReport) markdown(language string) string {
+	l := analysisLabelsFor(language)
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s%s%d%s\n\n", l.contradictions, l.open, len(r.Contradictions), l.close)
+	if len(r.Contradictions) == 0 {
+		b.WriteString(l.noContradictions + "\n\n")
+	}
+	for i, c := range r.Contradictions {
+		fmt.Fprintf(&b, "### %d. %s%s%s%s%s%s\n\n", i+1, c.Topic, l.open, l.severity, l.colon, l.severities[c.Severity], l.close)
+		for _, claim := range c.Claims {
+			name := claim.SourceName
+			if name == "" {
+				name = l.unknownSource
+			}
+			fmt.Fprintf(&b, "- **%s**%s%s\n", name, l.colon, claim.Claim)
+			if claim.Quote != "" {
+				fmt.Fprintf(&b, "  > %s\n", strings.Join(strings.Fields(claim.Quote), " "))
+				if !claim.Verified {
+					fmt.Fprintf(&b, "  >\n  > %s%s%s\n", strings.TrimSpace(l.open), l.quoteNotFound, l.close)
+				}
+			}
+		}
+		if len(c.Claims) > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s\n\n", c.Explanation)
+	}
+
+	fmt.Fprintf(&b, "## %s%s%d%s\n\n", l.gaps, l.open, len(r.Gaps), l.close)
+	if len(r.Gaps) == 0 {
+		b.WriteString(l.noGaps + "\n\n")
+	}
+	for i, g := range r.Gaps {
+		fmt.Fprintf(&b, "### %d. %s%s%s%s%s%s\n\n%s\n\n**%s%s** %s\n\n", i+1, g.Question, l.open, l.severity, l.colon, l.severities[g.Severity], l.close,
+			g.Reason, l.suggestion, strings.TrimSpace(l.colon), g.Suggestion)
+	}
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+// AnalysisRequest asks for a contradiction and gap analysis
+type AnalysisRequest struct {
+	// SourceIDs are the sources to analyze; without them, the notebook's
+	// sources included in retrieval
+	SourceIDs []string `json:"source_ids" binding:"dive,uuid"`
+	// Focus narrows the analysis to what the user cares about
+	Focus string `json:"focus" binding:"max=1000"`
+}
+
+// Analysis handlers
+
+// handleAnalyzeSources scans a notebook's sources for contradictory claims
+// and open questions, and saves the report as an "analysis" note whose
+// metadata holds it in structured form. Claims link to their sources, so
+// each finding can be checked and followed up.
+func (s *Server) handleAnalyzeSources(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
+	notebookID := c.Param("id")
+
+	var req AnalysisRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	treq := TransformationRequest{
+		Type:      "analysis",
+		SourceIDs: req.SourceIDs,
+		Format:    "JSON",
+		Language:  s.notebookLanguage(ctx, notebookID),
+	}
+	if focus := strings.TrimSpace(req.Focus); focus != "" {
+		treq.Prompt = "重点关注：" + focus
+	}
+	sources, ok := s.transformSources(c, ctx, notebookID, &treq)
+	if !ok {
+		return
+	}
+
+	var out analysisOutput
+	response, err := s.notebookAgent(ctx, notebookID).GenerateStructured(ctx, &treq, sources, &out)
+	if err != nil {
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Analysis failed: %v", err)})
+		return
+	}
+	report := buildAnalysisReport(&out, sources)
+
+	metadata := response.Metadata
+	delete(metadata, "length")
+	metadata["report"] = report
+	if req.Focus != "" {
+		metadata["focus"] = strings.TrimSpace(req.Focus)
+	}
+	note := &Note{
+		NotebookID: notebookID,
+		Title:      getTitleForType(treq.Type),
+		Content:    report.markdown(treq.Language),
+		Type:       treq.Type,
+		SourceIDs:  treq.SourceIDs,
+		Metadata:   metadata,
+	}
+	// The report is kept even if the client went away meanwhile
+	if err := s.createNote(context.WithoutCancel(ctx), note); err != nil {
+		storeErrorResponse(c, err, "Failed to save analysis")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"note": note, "report": report})
+}
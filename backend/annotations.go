@@ -0,0 +1,388 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// maxHighlightLength bounds a highlighted passage in bytes
+const maxHighlightLength = 5000
+
+// highlightColors are the colors a highlight can have; the first is the default
+var highlightColors = []string{"yellow", "green", "blue", "pink", "purple", "orange"}
+
+// SourceHighlight is a passage a user highlighted in a source's extracted
+// text, with an optional comment. Start and End are byte offsets into the
+// content, updated when the source changes; Detached is set once the passage
+// is gone from it.
+type SourceHighlight struct {
+	ID        string    `json:"id"`
+	SourceID  string    `json:"source_id"`
+	Text      string    `json:"text"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	Detached  bool      `json:"detached,omitempty"`
+	Color     string    `json:"color"`
+	Comment   string    `json:"comment,omitempty"`
+	NoteID    string    `json:"note_id,omitempty"` // The note made from the highlight
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const highlightColumns = `id, source_id, text, start, color, comment, note_id, created_at, updated_at`
+
+func scanSourceHighlight(row rowScanner) (*SourceHighlight, error) {
+	var h SourceHighlight
+	var createdAt, updatedAt int64
+	if err := row.Scan(&h.ID, &h.SourceID, &h.Text, &h.Start, &h.Color, &h.Comment, &h.NoteID, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	h.End = h.Start + len(h.Text)
+	h.CreatedAt = time.Unix(createdAt, 0)
+	h.UpdatedAt = time.Unix(updatedAt, 0)
+	return &h, nil
+}
+
+// Source highlight operations
+
+// CreateSourceHighlight stores a new highlight
+func (s *Store) CreateSourceHighlight(ctx context.Context, h *SourceHighlight) error {
+	h.ID = uuid.New().String()
+	now := time.Now()
+	h.CreatedAt = now
+	h.UpdatedAt = now
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO source_highlights (`+highlightColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, h.ID, h.SourceID, h.Text, h.Start, h.Color, h.Comment, h.NoteID, now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetSourceHighlight retrieves a highlight by ID
+func (s *Store) GetSourceHighlight(ctx context.Context, id string) (*SourceHighlight, error) {
+	h, err := scanSourceHighlight(s.db.QueryRowContext(ctx, `SELECT `+highlightColumns+` FROM source_highlights WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("highlight")
+	}
+	return h, err
+}
+
+func (s *Store) queryHighlights(ctx context.Context, query string, args ...interface{}) ([]SourceHighlight, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	highlights := make([]SourceHighlight, 0)
+	for rows.Next() {
+		h, err := scanSourceHighlight(rows)
+		if err != nil {
+			return nil, err
+		}
+		highlights = append(highlights, *h)
+	}
+
+	return highlights, rows.Err()
+}
+
+// ListSourceHighlights retrieves a source's highlights in reading order
+func (s *Store) ListSourceHighlights(ctx context.Context, sourceID string) ([]SourceHighlight, error) {
+	return s.queryHighlights(ctx, `
+		SELECT `+highlightColumns+` FROM source_highlights WHERE source_id = ? ORDER BY start, created_at
+	`, sourceID)
+}
+
+// ListNotebookHighlights retrieves the highlights of every source in a notebook
+func (s *Store) ListNotebookHighlights(ctx context.Context, notebookID string) ([]SourceHighlight, error) {
+	return s.queryHighlights(ctx, `
+		SELECT h.id, h.source_id, h.text, h.start, h.color, h.comment, h.note_id, h.created_at, h.updated_at
+		FROM source_highlights h JOIN sources s ON s.id = h.source_id
+		WHERE s.notebook_id = ? ORDER BY h.source_id, h.start
+	`, notebookID)
+}
+
+// UpdateSourceHighlight saves a highlight's color, comment and note
+func (s *Store) UpdateSourceHighlight(ctx context.Context, h *SourceHighlight) error {
+	h.UpdatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE source_highlights SET color = ?, comment = ?, note_id = ?, updated_at = ? WHERE id = ?
+	`, h.Color, h.Comment, h.NoteID, h.UpdatedAt.Unix(), h.ID)
+	return err
+}
+
+// DeleteSourceHighlight deletes a highlight
+func (s *Store) DeleteSourceHighlight(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM source_highlights WHERE id = ?`, id)
+	return err
+}
+
+// locateHighlight finds a highlight's passage in the source's current content
+func locateHighlight(content string, h *SourceHighlight) {
+	anchor := CommentAnchor{Quote: h.Text, Start: h.Start}
+	locateAnchor(content, &anchor)
+	h.Start, h.End, h.Detached = anchor.Start, anchor.Start+len(h.Text), anchor.Detached
+}
+
+// highlightColor checks a color, defaulting an empty one
+func highlightColor(color string) (string, bool) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if color == "" {
+		return highlightColors[0], true
+	}
+	for _, c := range highlightColors {
+		if c == color {
+			return color, true
+		}
+	}
+	return "", false
+}
+
+// highlightNote is the note a highlight becomes: the passage quoted, then
+// the comment
+func highlightNote(source *Source, h *SourceHighlight) *Note {
+	title := strings.Join(strings.Fields(h.Text), " ")
+	if r := []rune(title); len(r) > 60 {
+		title = strings.TrimSpace(string(r[:60])) + "…"
+	}
+
+	var content strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(h.Text), "\n") {
+		content.WriteString("> " + line + "\n")
+	}
+	content.WriteString("\n— " + source.Name + "\n")
+	if h.Comment != "" {
+		content.WriteString("\n" + h.Comment + "\n")
+	}
+
+	return &Note{
+		NotebookID: source.NotebookID,
+		Title:      title,
+		Content:    content.String(),
+		Type:       "highlight",
+		SourceIDs:  []string{source.ID},
+		Metadata:   map[string]interface{}{"highlight_id": h.ID, "highlight_color": h.Color},
+	}
+}
+
+// Server helpers
+
+// syncHighlights hands a source's highlighted passages to the vector store,
+// which ranks the chunks containing them higher
+func (s *Server) syncHighlights(ctx context.Context, sourceID string) {
+	highlights, err := s.store.ListSourceHighlights(ctx, sourceID)
+	if err != nil {
+		golog.Warnf("failed to load highlights of source %s: %v", sourceID, err)
+		return
+	}
+	passages := make([]string, 0, len(highlights))
+	for _, h := range highlights {
+		passages = append(passages, h.Text)
+	}
+	s.vectorStore.SetSourceHighlights(sourceID, passages)
+}
+
+// loadNotebookHighlights hands the highlights of a notebook being loaded to
+// the vector store
+func (s *Server) loadNotebookHighlights(ctx context.Context, notebookID string) {
+	highlights, err := s.store.ListNotebookHighlights(ctx, notebookID)
+	if err != nil {
+		golog.Warnf("failed to load highlights of notebook %s: %v", notebookID, err)
+		return
+	}
+	passages := map[string][]string{}
+	for _, h := range highlights {
+		passages[h.SourceID] = append(passages[h.SourceID], h.Text)
+	}
+	for sourceID, p := range passages {
+		s.vectorStore.SetSourceHighlights(sourceID, p)
+	}
+}
+
+// sourceHighlight loads :highlightId and checks it belongs to the source
+func (s *Server) sourceHighlight(c *gin.Context, source *Source) (*SourceHighlight, bool) {
+	h, err := s.store.GetSourceHighlight(c.Request.Context(), c.Param("highlightId"))
+	if err != nil || h.SourceID != source.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Highlight not found"})
+		return nil, false
+	}
+	locateHighlight(source.Content, h)
+	return h, true
+}
+
+// Source highlight handlers
+
+// handleListSourceHighlights lists a source's highlights in reading order
+func (s *Server) handleListSourceHighlights(c *gin.Context) {
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	highlights, err := s.store.ListSourceHighlights(c.Request.Context(), source.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list highlights"})
+		return
+	}
+	for i := range highlights {
+		locateHighlight(source.Content, &highlights[i])
+	}
+
+	c.JSON(http.StatusOK, highlights)
+}
+
+// handleCreateSourceHighlight highlights a passage of the source's text.
+// start says where the selection began; without it, or when the text isn't
+// there, the first occurrence is highlighted.
+func (s *Server) handleCreateSourceHighlight(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Text    string `json:"text" binding:"required"`
+		Start   *int   `json:"start"`
+		Color   string `json:"color"`
+		Comment string `json:"comment" binding:"max=2000"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	var fields fieldErrors
+	h := &SourceHighlight{SourceID: source.ID, Text: req.Text, Start: -1, Comment: strings.TrimSpace(req.Comment)}
+	if req.Start != nil {
+		h.Start = *req.Start
+	}
+	if strings.TrimSpace(h.Text) == "" || len(h.Text) > maxHighlightLength {
+		fields.add("text", "must be 1 to %d characters", maxHighlightLength)
+	} else if locateHighlight(source.Content, h); h.Detached {
+		fields.add("text", "is not in the source")
+	}
+	color, ok := highlightColor(req.Color)
+	if !ok {
+		fields.add("color", "must be one of %s", strings.Join(highlightColors, ", "))
+	}
+	if validationResponse(c, fields.err()) {
+		return
+	}
+	h.Color = color
+
+	if err := s.store.CreateSourceHighlight(ctx, h); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create highlight"})
+		return
+	}
+	s.syncHighlights(ctx, source.ID)
+
+	c.JSON(http.StatusCreated, h)
+}
+
+// handleUpdateSourceHighlight changes a highlight's color or comment
+func (s *Server) handleUpdateSourceHighlight(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Color   *string `json:"color"`
+		Comment *string `json:"comment" binding:"omitempty,max=2000"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	h, ok := s.sourceHighlight(c, source)
+	if !ok {
+		return
+	}
+
+	if req.Color != nil {
+		color, ok := highlightColor(*req.Color)
+		if !ok {
+			validationResponse(c, invalidField("color", "must be one of %s", strings.Join(highlightColors, ", ")))
+			return
+		}
+		h.Color = color
+	}
+	if req.Comment != nil {
+		h.Comment = strings.TrimSpace(*req.Comment)
+	}
+
+	if err := s.store.UpdateSourceHighlight(ctx, h); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update highlight"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h)
+}
+
+func (s *Server) handleDeleteSourceHighlight(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	h, ok := s.sourceHighlight(c, source)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteSourceHighlight(ctx, h.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete highlight"})
+		return
+	}
+	s.syncHighlights(ctx, source.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleHighlightToNote turns a highlight into a note quoting it, which
+// references the source. A highlight only becomes one note; converting it
+// again returns 409 while that note exists.
+func (s *Server) handleHighlightToNote(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	h, ok := s.sourceHighlight(c, source)
+	if !ok {
+		return
+	}
+	if h.NoteID != "" {
+		if _, err := s.store.GetNote(ctx, h.NoteID); err == nil {
+			c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: fmt.Sprintf("The highlight is already note %s", h.NoteID)})
+			return
+		}
+	}
+
+	note := highlightNote(source, h)
+	if err := s.createNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to create note")
+		return
+	}
+	ref := &NoteReference{NoteID: note.ID, TargetType: RefSource, TargetID: source.ID, Label: "highlight"}
+	if err := s.store.CreateReference(ctx, ref); err != nil {
+		golog.Warnf("failed to reference source %s from note %s: %v", source.ID, note.ID, err)
+	}
+
+	h.NoteID = note.ID
+	if err := s.store.UpdateSourceHighlight(ctx, h); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update highlight"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, note)
+}
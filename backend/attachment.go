@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Attachment is a binary file stored alongside a source or note
+type Attachment struct {
+	ID          string                 `json:"id"`
+	NotebookID  string                 `json:"notebook_id"`
+	SourceID    string                 `json:"source_id,omitempty"`
+	NoteID      string                 `json:"note_id,omitempty"`
+	FileName    string                 `json:"file_name"`
+	ContentType string                 `json:"content_type"`
+	FileSize    int64                  `json:"file_size"`
+	Path        string                 `json:"-"`
+	URL         string                 `json:"url"`
+	CreatedAt   time.Time              `json:"created_at"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// A small JPEG of an image or of a PDF's first page, if one was made
+	ThumbnailPath string `json:"-"`
+	ThumbnailURL  string `json:"thumbnail_url,omitempty"`
+}
+
+// Attachment operations
+
+// CreateAttachment records a stored file
+func (s *Store) CreateAttachment(ctx context.Context, att *Attachment) error {
+	att.ID = uuid.New().String()
+	att.CreatedAt = time.Now()
+	att.URL = attachmentURL(att.ID)
+	att.ThumbnailURL = thumbnailURL(att.ID, att.ThumbnailPath)
+
+	metadataJSON, _ := json.Marshal(att.Metadata)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO attachments (`+attachmentColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, att.ID, att.NotebookID, att.SourceID, att.NoteID, att.FileName, att.ContentType, att.FileSize, att.Path,
+		att.CreatedAt.Unix(), string(metadataJSON), att.ThumbnailPath)
+
+	return err
+}
+
+const attachmentColumns = `id, notebook_id, source_id, note_id, file_name, content_type, file_size, path, created_at, metadata, thumbnail_path`
+
+// GetAttachment retrieves an attachment by ID
+func (s *Store) GetAttachment(ctx context.Context, id string) (*Attachment, error) {
+	att, err := scanAttachment(s.db.QueryRowContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("attachment")
+	}
+	return att, err
+}
+
+// ListAttachments retrieves a notebook's attachments
+func (s *Store) ListAttachments(ctx context.Context, notebookID string) ([]Attachment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+attachmentColumns+` FROM attachments WHERE notebook_id = ? ORDER BY created_at
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]Attachment, 0)
+	for rows.Next() {
+		att, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *att)
+	}
+
+	return attachments, rows.Err()
+}
+
+// SetAttachmentThumbnail records the thumbnail made for an attachment
+func (s *Store) SetAttachmentThumbnail(ctx context.Context, id, path string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE attachments SET thumbnail_path = ? WHERE id = ?`, path, id)
+	return err
+}
+
+// MoveNoteAttachments hands a note's attachments to the note or source it
+// was filed as
+func (s *Store) MoveNoteAttachments(ctx context.Context, noteID, notebookID, sourceID, toNoteID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE attachments SET notebook_id = ?, source_id = ?, note_id = ?
+		WHERE note_id = ?
+	`, notebookID, sourceID, toNoteID, noteID)
+	return err
+}
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	var att Attachment
+	var metadataJSON string
+	var createdAt int64
+
+	if err := row.Scan(&att.ID, &att.NotebookID, &att.SourceID, &att.NoteID, &att.FileName, &att.ContentType,
+		&att.FileSize, &att.Path, &createdAt, &metadataJSON, &att.ThumbnailPath); err != nil {
+		return nil, err
+	}
+
+	att.CreatedAt = time.Unix(createdAt, 0)
+	att.URL = attachmentURL(att.ID)
+	att.ThumbnailURL = thumbnailURL(att.ID, att.ThumbnailPath)
+
+	if metadataJSON != "" {
+		json.Unmarshal([]byte(metadataJSON), &att.Metadata)
+	} else {
+		att.Metadata = make(map[string]interface{})
+	}
+
+	return &att, nil
+}
+
+func attachmentURL(id string) string {
+	return "/api/attachments/" + id
+}
+
+func thumbnailURL(id, path string) string {
+	if path == "" {
+		return ""
+	}
+	return attachmentURL(id) + "/thumbnail"
+}
+
+// Attachment handlers
+
+// workspaceAttachment loads :attachmentId. Signed links may fetch any
+// attachment; other requests only those of the caller's workspace, and
+// others are answered 404 as if they did not exist.
+func (s *Server) workspaceAttachment(c *gin.Context) (*Attachment, bool) {
+	ctx := c.Request.Context()
+
+	att, err := s.store.GetAttachment(ctx, c.Param("attachmentId"))
+	if err == nil && !signedRequest(c) {
+		var nb *Notebook
+		if nb, err = s.store.GetNotebook(ctx, att.NotebookID); err == nil && nb.WorkspaceID != currentWorkspace(c).ID {
+			err = notFoundError("attachment")
+		}
+	}
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load attachment")
+		return nil, false
+	}
+	return att, true
+}
+
+func (s *Server) handleGetAttachment(c *gin.Context) {
+	att, ok := s.workspaceAttachment(c)
+	if !ok {
+		return
+	}
+
+	if att.ContentType != "" {
+		c.Header("Content-Type", att.ContentType)
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", att.FileName))
+	c.File(att.Path)
+}
@@ -0,0 +1,264 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BenchOptions sizes the synthetic data set the benchmark seeds
+type BenchOptions struct {
+	Notebooks          int
+	NotesPerNotebook   int
+	SourcesPerNotebook int
+	// Queries is how many searches are timed
+	Queries int
+	// Dimensions of the synthetic embeddings; 0 benchmarks keyword search only
+	Dimensions int
+}
+
+// DefaultBenchOptions is a data set that runs in a few seconds
+var DefaultBenchOptions = BenchOptions{
+	Notebooks:          10,
+	NotesPerNotebook:   20,
+	SourcesPerNotebook: 10,
+	Queries:            200,
+	Dimensions:         256,
+}
+
+// BenchResult summarizes the latencies of one operation
+type BenchResult struct {
+	Operation string
+	Count     int
+	Mean      time.Duration
+	P50       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+	Max       time.Duration
+}
+
+// benchTimer collects latencies per operation in the order first seen
+type benchTimer struct {
+	order   []string
+	samples map[string][]time.Duration
+}
+
+func (t *benchTimer) time(operation string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if t.samples[operation] == nil {
+		t.order = append(t.order, operation)
+	}
+	t.samples[operation] = append(t.samples[operation], time.Since(start))
+	return err
+}
+
+func (t *benchTimer) results() []BenchResult {
+	results := make([]BenchResult, 0, len(t.order))
+	for _, op := range t.order {
+		samples := t.samples[op]
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		var total time.Duration
+		for _, d := range samples {
+			total += d
+		}
+		percentile := func(p int) time.Duration {
+			return samples[min(len(samples)-1, len(samples)*p/100)]
+		}
+		results = append(results, BenchResult{
+			Operation: op,
+			Count:     len(samples),
+			Mean:      total / time.Duration(len(samples)),
+			P50:       percentile(50),
+			P95:       percentile(95),
+			P99:       percentile(99),
+			Max:       samples[len(samples)-1],
+		})
+	}
+	return results
+}
+
+// benchWords is the vocabulary of the synthetic notes and sources
+var benchWords = strings.Fields(`notebook source chapter retrieval index vector
+	memory latency cache query answer summary history science river mountain
+	language model energy market protein climate network signal theory method
+	result evidence archive library question context document paragraph`)
+
+// benchText returns n words of deterministic filler text
+func benchText(r *rand.Rand, n int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = benchWords[r.Intn(len(benchWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+// hashEmbedder makes deterministic embeddings from a text's words, so the
+// benchmark exercises the vector math without calling a provider
+type hashEmbedder struct {
+	dims int
+}
+
+func (e hashEmbedder) CreateEmbedding(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, e.dims)
+		for _, word := range strings.Fields(text) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			v[int(h.Sum32())%e.dims]++
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+// RunBenchmark seeds a throwaway store and vector index in a temporary
+// directory and measures store, cache, search and retrieval latencies.
+// Progress is written to out.
+func RunBenchmark(ctx context.Context, cfg Config, opts BenchOptions, out io.Writer) ([]BenchResult, error) {
+	dir, err := os.MkdirTemp("", "notex-bench-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Never touch the real data or call the configured providers
+	cfg.StorePath = filepath.Join(dir, "bench.db")
+	cfg.SQLitePath = filepath.Join(dir, "vector.db")
+	cfg.VectorIndexDir = filepath.Join(dir, "index")
+	cfg.EnableEmbeddings = false
+	cfg.ProcessorPluginDir = ""
+
+	raw, err := NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	store := NewCachedStore(raw, 5*time.Minute)
+	defer store.Close()
+
+	vs, err := NewVectorStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Dimensions > 0 {
+		vs.embedder = &batchEmbedder{
+			client:    hashEmbedder{dims: opts.Dimensions},
+			batchSize: openAIEmbeddingBatchSize,
+			slots:     make(chan struct{}, max(1, cfg.EmbeddingConcurrency)),
+		}
+	}
+
+	timer := &benchTimer{samples: make(map[string][]time.Duration)}
+	r := rand.New(rand.NewSource(1))
+
+	fmt.Fprintf(out, "seeding %d notebooks with %d notes and %d sources each\n",
+		opts.Notebooks, opts.NotesPerNotebook, opts.SourcesPerNotebook)
+	var notebookIDs []string
+	for n := 0; n < opts.Notebooks; n++ {
+		var nb *Notebook
+		err := timer.time("store.create_notebook", func() (err error) {
+			nb, err = raw.CreateNotebook(ctx, fmt.Sprintf("Bench notebook %d", n), "", nil)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		notebookIDs = append(notebookIDs, nb.ID)
+
+		for i := 0; i < opts.NotesPerNotebook; i++ {
+			note := &Note{NotebookID: nb.ID, Title: benchText(r, 4), Content: benchText(r, 300), Type: "custom"}
+			if err := timer.time("store.create_note", func() error { return raw.CreateNote(ctx, note) }); err != nil {
+				return nil, err
+			}
+		}
+		for i := 0; i < opts.SourcesPerNotebook; i++ {
+			source := &Source{NotebookID: nb.ID, Name: benchText(r, 3), Type: "text", Content: benchText(r, 2000)}
+			if err := timer.time("store.create_source", func() error { return raw.CreateSource(ctx, source) }); err != nil {
+				return nil, err
+			}
+			err := timer.time("index.ingest_source", func() error {
+				chunks := vs.splitText(source.Content, cfg.ChunkSize, cfg.ChunkOverlap)
+				_, err := vs.IngestChunks(ctx, source.Name, chunks, sourceIndexMetadata(source))
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(notebookIDs) == 0 {
+		return timer.results(), nil
+	}
+
+	fmt.Fprintf(out, "timing reads and %d queries\n", opts.Queries)
+	for i := 0; i < opts.Queries; i++ {
+		id := notebookIDs[i%len(notebookIDs)]
+		if err := timer.time("store.list_notes", func() error {
+			_, err := raw.ListNotes(ctx, id)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if err := timer.time("store.list_sources", func() error {
+			_, err := raw.ListSources(ctx, id)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		// The first read fills the cache, later ones are hits
+		if err := timer.time("cache.list_sources", func() error {
+			_, err := store.ListSources(ctx, id)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	queries := make([]string, 20)
+	for i := range queries {
+		queries[i] = benchText(r, 5)
+	}
+	for i := 0; i < opts.Queries; i++ {
+		id := notebookIDs[i%len(notebookIDs)]
+		query := queries[i%len(queries)]
+		if err := timer.time("vector.search", func() error {
+			_, err := vs.search(ctx, query, cfg.MaxSources, []string{id}, RetrieverHybrid)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if err := timer.time("vector.retrieval", func() error {
+			_, err := vs.SimilaritySearch(ctx, query, cfg.MaxSources, []string{id})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := timer.time("index.save", func() error {
+		vs.SaveIndexes(ctx)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return timer.results(), nil
+}
+
+// WriteBenchResults prints results as an aligned table
+func WriteBenchResults(out io.Writer, results []BenchResult) {
+	fmt.Fprintf(out, "%-22s %7s %10s %10s %10s %10s %10s\n", "operation", "count", "mean", "p50", "p95", "p99", "max")
+	for _, r := range results {
+		fmt.Fprintf(out, "%-22s %7d %10s %10s %10s %10s %10s\n", r.Operation, r.Count,
+			r.Mean.Round(time.Microsecond), r.P50.Round(time.Microsecond), r.P95.Round(time.Microsecond),
+			r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond))
+	}
+}
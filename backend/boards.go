@@ -0,0 +1,665 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// defaultBoardColumns are the columns of a board created without any
+var defaultBoardColumns = []string{"To do", "Doing", "Done"}
+
+// Board is a task board in a notebook: columns of cards, each card a note
+type Board struct {
+	ID         string        `json:"id"`
+	NotebookID string        `json:"notebook_id"`
+	Name       string        `json:"name"`
+	Columns    []BoardColumn `json:"columns,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+// BoardColumn is a column of a board, in position order
+type BoardColumn struct {
+	ID       string      `json:"id"`
+	BoardID  string      `json:"board_id"`
+	Name     string      `json:"name"`
+	Position int         `json:"position"`
+	Cards    []BoardCard `json:"cards"`
+}
+
+// BoardCard places a note in a column
+type BoardCard struct {
+	ID       string `json:"id"`
+	BoardID  string `json:"board_id"`
+	ColumnID string `json:"column_id"`
+	NoteID   string `json:"note_id"`
+	Position int    `json:"position"`
+	// Title of the note, for rendering the card
+	Title string `json:"title"`
+}
+
+// Board operations
+
+// CreateBoard creates a board with the named columns
+func (s *Store) CreateBoard(ctx context.Context, board *Board, columns []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	board.ID = uuid.New().String()
+	board.CreatedAt = time.Now()
+	board.UpdatedAt = board.CreatedAt
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO boards (id, notebook_id, name, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+	`, board.ID, board.NotebookID, board.Name, board.CreatedAt.Unix(), board.UpdatedAt.Unix()); err != nil {
+		return err
+	}
+
+	board.Columns = make([]BoardColumn, 0, len(columns))
+	for i, name := range columns {
+		col := BoardColumn{ID: uuid.New().String(), BoardID: board.ID, Name: name, Position: i, Cards: []BoardCard{}}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO board_columns (id, board_id, name, position) VALUES (?, ?, ?, ?)
+		`, col.ID, col.BoardID, col.Name, col.Position); err != nil {
+			return err
+		}
+		board.Columns = append(board.Columns, col)
+	}
+	return tx.Commit()
+}
+
+func scanBoard(row rowScanner) (*Board, error) {
+	var b Board
+	var createdAt, updatedAt int64
+	if err := row.Scan(&b.ID, &b.NotebookID, &b.Name, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	b.CreatedAt = time.Unix(createdAt, 0)
+	b.UpdatedAt = time.Unix(updatedAt, 0)
+	return &b, nil
+}
+
+// GetBoard returns a board without its columns
+func (s *Store) GetBoard(ctx context.Context, id string) (*Board, error) {
+	b, err := scanBoard(s.db.QueryRowContext(ctx, `
+		SELECT id, notebook_id, name, created_at, updated_at FROM boards WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("board")
+	}
+	return b, err
+}
+
+// ListBoards returns a notebook's boards, without their columns
+func (s *Store) ListBoards(ctx context.Context, notebookID string) ([]Board, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, name, created_at, updated_at FROM boards WHERE notebook_id = ? ORDER BY created_at
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	boards := []Board{}
+	for rows.Next() {
+		b, err := scanBoard(rows)
+		if err != nil {
+			return nil, err
+		}
+		boards = append(boards, *b)
+	}
+	return boards, rows.Err()
+}
+
+// LoadBoardColumns fills in a board's columns and their cards
+func (s *Store) LoadBoardColumns(ctx context.Context, board *Board) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, board_id, name, position FROM board_columns WHERE board_id = ? ORDER BY position
+	`, board.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	board.Columns = []BoardColumn{}
+	index := make(map[string]int)
+	for rows.Next() {
+		col := BoardColumn{Cards: []BoardCard{}}
+		if err := rows.Scan(&col.ID, &col.BoardID, &col.Name, &col.Position); err != nil {
+			return err
+		}
+		index[col.ID] = len(board.Columns)
+		board.Columns = append(board.Columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cards, err := s.db.QueryContext(ctx, `
+		SELECT c.id, c.board_id, c.column_id, c.note_id, c.position, n.title
+		FROM board_cards c JOIN notes n ON n.id = c.note_id
+		WHERE c.board_id = ? ORDER BY c.position
+	`, board.ID)
+	if err != nil {
+		return err
+	}
+	defer cards.Close()
+	for cards.Next() {
+		var card BoardCard
+		if err := cards.Scan(&card.ID, &card.BoardID, &card.ColumnID, &card.NoteID, &card.Position, &card.Title); err != nil {
+			return err
+		}
+		if i, ok := index[card.ColumnID]; ok {
+			board.Columns[i].Cards = append(board.Columns[i].Cards, card)
+		}
+	}
+	return cards.Err()
+}
+
+// RenameBoard changes a board's name
+func (s *Store) RenameBoard(ctx context.Context, board *Board) error {
+	board.UpdatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `UPDATE boards SET name = ?, updated_at = ? WHERE id = ?`, board.Name, board.UpdatedAt.Unix(), board.ID)
+	return err
+}
+
+// DeleteBoard deletes a board with its columns and cards. The notes stay.
+func (s *Store) DeleteBoard(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM boards WHERE id = ?`, id)
+	return err
+}
+
+// touchBoard marks a board as changed
+func touchBoard(ctx context.Context, tx *sql.Tx, boardID string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE boards SET updated_at = ? WHERE id = ?`, time.Now().Unix(), boardID)
+	return err
+}
+
+// placeAt moves id to position among the rows of table whose scope column
+// equals scopeID, numbering them 0, 1, 2... A position past the end, or
+// negative, means the end. id must already be in scope.
+func placeAt(ctx context.Context, tx *sql.Tx, table, scope, scopeID, id string, position int) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM `+table+` WHERE `+scope+` = ? AND id != ? ORDER BY position`, scopeID, id)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var other string
+		if err := rows.Scan(&other); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, other)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if id != "" {
+		if position < 0 || position > len(ids) {
+			position = len(ids)
+		}
+		ids = append(ids[:position], append([]string{id}, ids[position:]...)...)
+	}
+	for i, other := range ids {
+		if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET position = ? WHERE id = ?`, i, other); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBoardColumn returns a column without its cards
+func (s *Store) GetBoardColumn(ctx context.Context, id string) (*BoardColumn, error) {
+	col := BoardColumn{Cards: []BoardCard{}}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, board_id, name, position FROM board_columns WHERE id = ?
+	`, id).Scan(&col.ID, &col.BoardID, &col.Name, &col.Position)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("column")
+	}
+	return &col, err
+}
+
+// SaveBoardColumn adds a column, or renames and moves an existing one, at
+// its position
+func (s *Store) SaveBoardColumn(ctx context.Context, col *BoardColumn, create bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if create {
+		col.ID = uuid.New().String()
+		_, err = tx.ExecContext(ctx, `INSERT INTO board_columns (id, board_id, name, position) VALUES (?, ?, ?, -1)`, col.ID, col.BoardID, col.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE board_columns SET name = ? WHERE id = ?`, col.Name, col.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := placeAt(ctx, tx, "board_columns", "board_id", col.BoardID, col.ID, col.Position); err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT position FROM board_columns WHERE id = ?`, col.ID).Scan(&col.Position); err != nil {
+		return err
+	}
+	if err := touchBoard(ctx, tx, col.BoardID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteBoardColumn deletes a column and its cards. The notes stay.
+func (s *Store) DeleteBoardColumn(ctx context.Context, col *BoardColumn) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM board_columns WHERE id = ?`, col.ID); err != nil {
+		return err
+	}
+	if err := placeAt(ctx, tx, "board_columns", "board_id", col.BoardID, "", 0); err != nil {
+		return err
+	}
+	if err := touchBoard(ctx, tx, col.BoardID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetBoardCard returns a card
+func (s *Store) GetBoardCard(ctx context.Context, id string) (*BoardCard, error) {
+	var card BoardCard
+	err := s.db.QueryRowContext(ctx, `
+		SELECT c.id, c.board_id, c.column_id, c.note_id, c.position, n.title
+		FROM board_cards c JOIN notes n ON n.id = c.note_id WHERE c.id = ?
+	`, id).Scan(&card.ID, &card.BoardID, &card.ColumnID, &card.NoteID, &card.Position, &card.Title)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("card")
+	}
+	return &card, err
+}
+
+// SaveBoardCard adds a card, or moves an existing one to its column and
+// position. fromColumn is the column a moved card was in.
+func (s *Store) SaveBoardCard(ctx context.Context, card *BoardCard, create bool, fromColumn string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if create {
+		card.ID = uuid.New().String()
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO board_cards (id, board_id, column_id, note_id, position, created_at) VALUES (?, ?, ?, ?, -1, ?)
+		`, card.ID, card.BoardID, card.ColumnID, card.NoteID, time.Now().Unix())
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE board_cards SET column_id = ? WHERE id = ?`, card.ColumnID, card.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if fromColumn != "" && fromColumn != card.ColumnID {
+		if err := placeAt(ctx, tx, "board_cards", "column_id", fromColumn, "", 0); err != nil {
+			return err
+		}
+	}
+	if err := placeAt(ctx, tx, "board_cards", "column_id", card.ColumnID, card.ID, card.Position); err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT position FROM board_cards WHERE id = ?`, card.ID).Scan(&card.Position); err != nil {
+		return err
+	}
+	if err := touchBoard(ctx, tx, card.BoardID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteBoardCard takes a card off its board. The note stays.
+func (s *Store) DeleteBoardCard(ctx context.Context, card *BoardCard) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM board_cards WHERE id = ?`, card.ID); err != nil {
+		return err
+	}
+	if err := placeAt(ctx, tx, "board_cards", "column_id", card.ColumnID, "", 0); err != nil {
+		return err
+	}
+	if err := touchBoard(ctx, tx, card.BoardID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// notebookBoard loads :boardId and checks it belongs to :id
+func (s *Server) notebookBoard(c *gin.Context) (*Board, bool) {
+	b, err := s.store.GetBoard(c.Request.Context(), c.Param("boardId"))
+	if err != nil || b.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Board not found"})
+		return nil, false
+	}
+	return b, true
+}
+
+// boardColumn loads :columnId and checks it belongs to :boardId
+func (s *Server) boardColumn(c *gin.Context, board *Board, id string) (*BoardColumn, bool) {
+	col, err := s.store.GetBoardColumn(c.Request.Context(), id)
+	if err != nil || col.BoardID != board.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Column not found"})
+		return nil, false
+	}
+	return col, true
+}
+
+// boardCard loads :cardId and checks it belongs to :boardId
+func (s *Server) boardCard(c *gin.Context, board *Board) (*BoardCard, bool) {
+	card, err := s.store.GetBoardCard(c.Request.Context(), c.Param("cardId"))
+	if err != nil || card.BoardID != board.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Card not found"})
+		return nil, false
+	}
+	return card, true
+}
+
+// respondBoard answers with the board as it is now, columns and cards included
+func (s *Server) respondBoard(c *gin.Context, status int, board *Board) {
+	if err := s.store.LoadBoardColumns(c.Request.Context(), board); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load board"})
+		return
+	}
+	c.JSON(status, board)
+}
+
+// Board handlers
+
+func (s *Server) handleListBoards(c *gin.Context) {
+	boards, err := s.store.ListBoards(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list boards"})
+		return
+	}
+	c.JSON(http.StatusOK, boards)
+}
+
+// handleCreateBoard creates a board, with To do, Doing and Done columns
+// unless others are given
+func (s *Server) handleCreateBoard(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	var req struct {
+		Name    string   `json:"name" binding:"required,max=200"`
+		Columns []string `json:"columns" binding:"omitempty,max=50,dive,required,max=100"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	columns := req.Columns
+	if columns == nil {
+		columns = defaultBoardColumns
+	}
+	board := &Board{NotebookID: notebookID, Name: strings.TrimSpace(req.Name)}
+	if err := s.store.CreateBoard(ctx, board, columns); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create board"})
+		return
+	}
+	c.JSON(http.StatusCreated, board)
+}
+
+func (s *Server) handleGetBoard(c *gin.Context) {
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	s.respondBoard(c, http.StatusOK, board)
+}
+
+func (s *Server) handleUpdateBoard(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required,max=200"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	board.Name = strings.TrimSpace(req.Name)
+	if err := s.store.RenameBoard(c.Request.Context(), board); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update board"})
+		return
+	}
+	s.respondBoard(c, http.StatusOK, board)
+}
+
+func (s *Server) handleDeleteBoard(c *gin.Context) {
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteBoard(c.Request.Context(), board.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete board"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleCreateBoardColumn adds a column, at the end unless a position is given
+func (s *Server) handleCreateBoardColumn(c *gin.Context) {
+	var req struct {
+		Name     string `json:"name" binding:"required,max=100"`
+		Position *int   `json:"position"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+
+	col := &BoardColumn{BoardID: board.ID, Name: strings.TrimSpace(req.Name), Position: -1, Cards: []BoardCard{}}
+	if req.Position != nil {
+		col.Position = *req.Position
+	}
+	if err := s.store.SaveBoardColumn(c.Request.Context(), col, true); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create column"})
+		return
+	}
+	c.JSON(http.StatusCreated, col)
+}
+
+// handleUpdateBoardColumn renames a column or, with a position, drags it
+// to another place on the board
+func (s *Server) handleUpdateBoardColumn(c *gin.Context) {
+	var req struct {
+		Name     *string `json:"name" binding:"omitempty,min=1,max=100"`
+		Position *int    `json:"position"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	col, ok := s.boardColumn(c, board, c.Param("columnId"))
+	if !ok {
+		return
+	}
+
+	if req.Name != nil {
+		col.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Position != nil {
+		col.Position = *req.Position
+	}
+	if err := s.store.SaveBoardColumn(c.Request.Context(), col, false); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update column"})
+		return
+	}
+	s.respondBoard(c, http.StatusOK, board)
+}
+
+// handleDeleteBoardColumn deletes a column and its cards; the notes stay
+func (s *Server) handleDeleteBoardColumn(c *gin.Context) {
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	col, ok := s.boardColumn(c, board, c.Param("columnId"))
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteBoardColumn(c.Request.Context(), col); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete column"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleCreateBoardCard puts a note on the board. Give note_id for an
+// existing note of the notebook, or a title (and content) to create one.
+func (s *Server) handleCreateBoardCard(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		ColumnID string `json:"column_id" binding:"required"`
+		NoteID   string `json:"note_id"`
+		Title    string `json:"title" binding:"max=200"`
+		Content  string `json:"content"`
+		Position *int   `json:"position"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if (req.NoteID == "") == (strings.TrimSpace(req.Title) == "") {
+		validationResponse(c, invalidField("note_id", "is required unless title is given, and not allowed with it"))
+		return
+	}
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	col, ok := s.boardColumn(c, board, req.ColumnID)
+	if !ok {
+		return
+	}
+
+	var note *Note
+	if req.NoteID != "" {
+		n, err := s.store.GetNote(ctx, req.NoteID)
+		if err != nil || n.NotebookID != board.NotebookID {
+			validationResponse(c, invalidField("note_id", "is not a note in this notebook"))
+			return
+		}
+		note = n
+	} else {
+		note = &Note{
+			NotebookID: board.NotebookID,
+			Title:      strings.TrimSpace(req.Title),
+			Content:    req.Content,
+			Type:       "task",
+			SourceIDs:  []string{},
+			Metadata:   map[string]interface{}{"board_id": board.ID},
+		}
+		if err := s.createNote(ctx, note); err != nil {
+			storeErrorResponse(c, err, "Failed to create note")
+			return
+		}
+	}
+
+	card := &BoardCard{BoardID: board.ID, ColumnID: col.ID, NoteID: note.ID, Position: -1, Title: note.Title}
+	if req.Position != nil {
+		card.Position = *req.Position
+	}
+	if err := s.store.SaveBoardCard(ctx, card, true, ""); err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "The note is already on this board"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create card"})
+		return
+	}
+	c.JSON(http.StatusCreated, card)
+}
+
+// handleMoveBoardCard drags a card to a position in the same or another column
+func (s *Server) handleMoveBoardCard(c *gin.Context) {
+	var req struct {
+		ColumnID string `json:"column_id"`
+		Position *int   `json:"position"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	card, ok := s.boardCard(c, board)
+	if !ok {
+		return
+	}
+
+	from := card.ColumnID
+	if req.ColumnID != "" {
+		col, ok := s.boardColumn(c, board, req.ColumnID)
+		if !ok {
+			return
+		}
+		card.ColumnID = col.ID
+	}
+	card.Position = -1
+	if req.Position != nil {
+		card.Position = *req.Position
+	}
+	if err := s.store.SaveBoardCard(c.Request.Context(), card, false, from); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to move card"})
+		return
+	}
+	s.respondBoard(c, http.StatusOK, board)
+}
+
+// handleDeleteBoardCard takes a card off the board; the note stays
+func (s *Server) handleDeleteBoardCard(c *gin.Context) {
+	board, ok := s.notebookBoard(c)
+	if !ok {
+		return
+	}
+	card, ok := s.boardCard(c, board)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteBoardCard(c.Request.Context(), card); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete card"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead allows for the form fields and boundaries around an
+// uploaded file
+const multipartOverhead = 1 << 20
+
+// uploadRoutes accept file uploads or pasted source content, so they are
+// limited by MAX_UPLOAD_SIZE_MB instead of MAX_REQUEST_BODY_MB
+var uploadRoutes = map[string]bool{
+	"/api/upload":                          true,
+	"/api/notebooks/:id/sources":           true,
+	"/api/notebooks/:id/sources/:sourceId": true,
+	"/api/notebooks/:id/import/highlights": true,
+	"/api/notebooks/:id/import/bibtex":     true,
+	"/api/upload/sessions/:uploadId":       true,
+	"/api/admin/instance/import":           true,
+}
+
+// fixedBodyLimits are routes with their own limit. Chat questions may be
+// asked by voice.
+var fixedBodyLimits = map[string]int64{
+	"/api/clip":               maxClipSize,
+	"/api/inbound/email":      maxInboundEmailSize,
+	"/api/notebooks/:id/chat": maxAudioSize + multipartOverhead,
+	"/api/notebooks/:id/chat/sessions/:sessionId/messages": maxAudioSize + multipartOverhead,
+}
+
+// bodyLimit returns the largest request body a route accepts, or 0 for no limit
+func (s *Server) bodyLimit(route string) int64 {
+	if limit, ok := fixedBodyLimits[route]; ok {
+		return limit
+	}
+	if uploadRoutes[route] {
+		if limit := s.uploadSizeLimit(); limit > 0 {
+			return limit + multipartOverhead
+		}
+		return 0
+	}
+	return int64(s.cfg.MaxRequestBodyMB) << 20
+}
+
+// BodyLimitMiddleware refuses request bodies larger than the route allows
+// with 413. Bodies that declare their length are refused before anything is
+// read; others are cut off once they pass the limit, and bindJSON and the
+// upload handlers turn that into 413 as well.
+func (s *Server) BodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := s.bodyLimit(c.FullPath())
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, bodyTooLargeError(limit))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+func bodyTooLargeError(limit int64) ErrorResponse {
+	return ErrorResponse{
+		Code:  CodePayloadTooLarge,
+		Error: fmt.Sprintf("Request body is larger than the %s limit", formatBytes(limit)),
+	}
+}
+
+// bodyTooLargeResponse writes 413 if err came from reading past the body
+// limit, and reports whether it did
+func bodyTooLargeResponse(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, bodyTooLargeError(tooLarge.Limit))
+	return true
+}
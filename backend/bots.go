@@ -0,0 +1,876 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// Chat platforms a bot can be connected through
+const (
+	BotTelegram = "telegram"
+	BotSlack    = "slack"
+)
+
+// What a bot does with a message that does not start with a command
+const (
+	BotModeChat    = "chat"
+	BotModeCapture = "capture"
+)
+
+// Commands a message to a bot can start with
+const (
+	botAskCommand     = "/ask"
+	botCaptureCommand = "/capture"
+	botNewCommand     = "/new"
+)
+
+const (
+	// slackMaxClockSkew bounds the age of a signed Slack request, so a
+	// captured one can't be replayed later
+	slackMaxClockSkew = 5 * time.Minute
+	// botReplyTimeout bounds posting an answer back to the platform
+	botReplyTimeout = 15 * time.Second
+	// telegramMaxMessage is the longest message Telegram accepts, in characters
+	telegramMaxMessage = 4096
+)
+
+// errBotUnauthorized is returned for webhooks that fail the platform's
+// signature or secret check
+var errBotUnauthorized = errors.New("invalid webhook signature")
+
+// slackMentionPattern matches the user mentions Slack writes into message text
+var slackMentionPattern = regexp.MustCompile(`<@[A-Z0-9]+(\|[^>]*)?>`)
+
+// BotConnection connects a Telegram or Slack bot to a notebook. Messages to
+// the bot become chat questions or captures in the notebook.
+type BotConnection struct {
+	ID         string `json:"id"`
+	NotebookID string `json:"notebook_id"`
+	Platform   string `json:"platform"` // "telegram" or "slack"
+	Mode       string `json:"mode"`     // "chat" or "capture"
+	// Token is the secret part of the webhook URL; Telegram also sends it
+	// as its secret token
+	Token            string    `json:"token"`
+	WebhookPath      string    `json:"webhook_path"`
+	BotToken         string    `json:"-"`
+	HasBotToken      bool      `json:"has_bot_token"`
+	SigningSecret    string    `json:"-"`
+	HasSigningSecret bool      `json:"has_signing_secret"`
+	AllowedUsers     []string  `json:"allowed_users"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func scanBotConnection(row rowScanner) (*BotConnection, error) {
+	var b BotConnection
+	var usersJSON string
+	var createdAt, updatedAt int64
+
+	if err := row.Scan(&b.ID, &b.NotebookID, &b.Platform, &b.Mode, &b.Token, &b.BotToken, &b.SigningSecret, &usersJSON, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	b.WebhookPath = "/api/inbound/bots/" + b.Token
+	b.HasBotToken = b.BotToken != ""
+	b.HasSigningSecret = b.SigningSecret != ""
+	b.AllowedUsers = []string{}
+	if usersJSON != "" {
+		json.Unmarshal([]byte(usersJSON), &b.AllowedUsers)
+	}
+	b.CreatedAt = time.Unix(createdAt, 0)
+	b.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &b, nil
+}
+
+// Bot connection operations
+
+const botConnectionColumns = `id, notebook_id, platform, mode, token, bot_token, signing_secret, allowed_users, created_at, updated_at`
+
+// CreateBotConnection stores a new connection with a fresh webhook token
+func (s *Store) CreateBotConnection(ctx context.Context, b *BotConnection) error {
+	b.ID = uuid.New().String()
+	b.Token = randomToken(16)
+	b.WebhookPath = "/api/inbound/bots/" + b.Token
+	if b.AllowedUsers == nil {
+		b.AllowedUsers = []string{}
+	}
+	now := time.Now()
+	b.CreatedAt = now
+	b.UpdatedAt = now
+	usersJSON, _ := json.Marshal(b.AllowedUsers)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO bot_connections (`+botConnectionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, b.ID, b.NotebookID, b.Platform, b.Mode, b.Token, b.BotToken, b.SigningSecret, string(usersJSON), now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetBotConnection retrieves a connection by ID
+func (s *Store) GetBotConnection(ctx context.Context, id string) (*BotConnection, error) {
+	b, err := scanBotConnection(s.db.QueryRowContext(ctx, `
+		SELECT `+botConnectionColumns+` FROM bot_connections WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("bot")
+	}
+	return b, err
+}
+
+// GetBotConnectionByToken looks up a connection by the token in its webhook URL
+func (s *Store) GetBotConnectionByToken(ctx context.Context, token string) (*BotConnection, error) {
+	b, err := scanBotConnection(s.db.QueryRowContext(ctx, `
+		SELECT `+botConnectionColumns+` FROM bot_connections WHERE token = ?
+	`, token))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("bot")
+	}
+	return b, err
+}
+
+// ListBotConnections retrieves a notebook's bot connections
+func (s *Store) ListBotConnections(ctx context.Context, notebookID string) ([]BotConnection, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+botConnectionColumns+` FROM bot_connections WHERE notebook_id = ? ORDER BY created_at, id
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := make([]BotConnection, 0)
+	for rows.Next() {
+		b, err := scanBotConnection(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, *b)
+	}
+
+	return bots, rows.Err()
+}
+
+// UpdateBotConnection saves a connection's settings and optionally rotates
+// its webhook token
+func (s *Store) UpdateBotConnection(ctx context.Context, b *BotConnection, rotate bool) error {
+	if rotate {
+		b.Token = randomToken(16)
+		b.WebhookPath = "/api/inbound/bots/" + b.Token
+	}
+	if b.AllowedUsers == nil {
+		b.AllowedUsers = []string{}
+	}
+	b.UpdatedAt = time.Now()
+	b.HasBotToken = b.BotToken != ""
+	b.HasSigningSecret = b.SigningSecret != ""
+	usersJSON, _ := json.Marshal(b.AllowedUsers)
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE bot_connections SET mode = ?, token = ?, bot_token = ?, signing_secret = ?, allowed_users = ?, updated_at = ?
+		WHERE id = ?
+	`, b.Mode, b.Token, b.BotToken, b.SigningSecret, string(usersJSON), b.UpdatedAt.Unix(), b.ID)
+
+	return err
+}
+
+// DeleteBotConnection deletes a connection and forgets its conversations
+func (s *Store) DeleteBotConnection(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM bot_connections WHERE id = ?`, id)
+	return err
+}
+
+// GetBotThread returns the chat session a platform thread continues, or ""
+func (s *Store) GetBotThread(ctx context.Context, connectionID, threadKey string) (string, error) {
+	var sessionID string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT session_id FROM bot_threads WHERE connection_id = ? AND thread_key = ?
+	`, connectionID, threadKey).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return sessionID, err
+}
+
+// SetBotThread records the chat session a platform thread continues
+func (s *Store) SetBotThread(ctx context.Context, connectionID, threadKey, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO bot_threads (connection_id, thread_key, session_id, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (connection_id, thread_key) DO UPDATE SET session_id = excluded.session_id, created_at = excluded.created_at
+	`, connectionID, threadKey, sessionID, time.Now().Unix())
+	return err
+}
+
+// DeleteBotThread makes a platform thread start a new chat session
+func (s *Store) DeleteBotThread(ctx context.Context, connectionID, threadKey string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM bot_threads WHERE connection_id = ? AND thread_key = ?`, connectionID, threadKey)
+	return err
+}
+
+// userAllowed reports whether the sender of msg is on the allow-list, by
+// user ID or user name; an empty list accepts everyone
+func (b *BotConnection) userAllowed(msg *botMessage) bool {
+	if len(b.AllowedUsers) == 0 {
+		return true
+	}
+	for _, allowed := range b.AllowedUsers {
+		allowed = strings.TrimPrefix(strings.TrimSpace(allowed), "@")
+		if allowed == "" {
+			continue
+		}
+		if allowed == msg.UserID || (msg.UserName != "" && strings.EqualFold(allowed, msg.UserName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Platforms
+
+// botMessage is a platform-neutral view of a message sent to a bot
+type botMessage struct {
+	UserID   string
+	UserName string
+	Text     string
+	// Channel is where the message was sent; Thread groups the messages of
+	// one conversation in it
+	Channel string
+	Thread  string
+	// ReplyTo is the message the answer replies to
+	ReplyTo string
+}
+
+// botPlatform receives messages from a chat service and posts answers back
+type botPlatform interface {
+	// parse checks a webhook's signature and reads the message in it. A nil
+	// message is an update to acknowledge without acting on it; a non-nil
+	// response is sent back in place of the acknowledgement.
+	parse(c *gin.Context, conn *BotConnection, body []byte) (msg *botMessage, response any, err error)
+	// reply posts text as an answer to msg
+	reply(ctx context.Context, conn *BotConnection, msg *botMessage, text string) error
+}
+
+// botPlatform returns the platform of a connection
+func (s *Server) botPlatform(name string) botPlatform {
+	if name == BotSlack {
+		return slackBot{apiURL: strings.TrimRight(s.cfg.SlackAPIURL, "/")}
+	}
+	return telegramBot{apiURL: strings.TrimRight(s.cfg.TelegramAPIURL, "/")}
+}
+
+// postBotAPI calls a platform's JSON API and decodes the answer into out
+func postBotAPI(ctx context.Context, endpoint, authorization string, payload, out any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, botReplyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil {
+		return fmt.Errorf("API returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// telegramBot talks to the Telegram Bot API
+type telegramBot struct {
+	apiURL string
+}
+
+func (t telegramBot) parse(c *gin.Context, conn *BotConnection, body []byte) (*botMessage, any, error) {
+	secret := c.GetHeader("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(conn.Token)) != 1 {
+		return nil, nil, errBotUnauthorized
+	}
+
+	var update struct {
+		Message *struct {
+			MessageID int64  `json:"message_id"`
+			Text      string `json:"text"`
+			Caption   string `json:"caption"`
+			Chat      struct {
+				ID int64 `json:"id"`
+			} `json:"chat"`
+			From *struct {
+				ID       int64  `json:"id"`
+				IsBot    bool   `json:"is_bot"`
+				Username string `json:"username"`
+			} `json:"from"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &update); err != nil {
+		return nil, nil, err
+	}
+
+	// Edits, channel posts, joins and the like are acknowledged and dropped
+	m := update.Message
+	if m == nil || m.From == nil || m.From.IsBot {
+		return nil, nil, nil
+	}
+	text := m.Text
+	if text == "" {
+		text = m.Caption
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil, nil
+	}
+
+	chat := strconv.FormatInt(m.Chat.ID, 10)
+	return &botMessage{
+		UserID:   strconv.FormatInt(m.From.ID, 10),
+		UserName: m.From.Username,
+		Text:     text,
+		Channel:  chat,
+		Thread:   chat,
+		ReplyTo:  strconv.FormatInt(m.MessageID, 10),
+	}, nil, nil
+}
+
+func (t telegramBot) reply(ctx context.Context, conn *BotConnection, msg *botMessage, text string) error {
+	if utf8.RuneCountInString(text) > telegramMaxMessage {
+		text = string([]rune(text)[:telegramMaxMessage-1]) + "…"
+	}
+	payload := map[string]any{"chat_id": msg.Channel, "text": text}
+	if id, err := strconv.ParseInt(msg.ReplyTo, 10, 64); err == nil {
+		payload["reply_parameters"] = map[string]any{"message_id": id, "allow_sending_without_reply": true}
+	}
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := postBotAPI(ctx, t.apiURL+"/bot"+conn.BotToken+"/sendMessage", "", payload, &result); err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("telegram: %s", result.Description)
+	}
+	return nil
+}
+
+// slackBot talks to the Slack Events and Web APIs
+type slackBot struct {
+	apiURL string
+}
+
+func (sl slackBot) parse(c *gin.Context, conn *BotConnection, body []byte) (*botMessage, any, error) {
+	if !slackSignatureValid(c, conn.SigningSecret, body) {
+		return nil, nil, errBotUnauthorized
+	}
+
+	var payload struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Event     struct {
+			Type        string `json:"type"`
+			Subtype     string `json:"subtype"`
+			BotID       string `json:"bot_id"`
+			User        string `json:"user"`
+			Text        string `json:"text"`
+			Channel     string `json:"channel"`
+			ChannelType string `json:"channel_type"`
+			TS          string `json:"ts"`
+			ThreadTS    string `json:"thread_ts"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, nil, err
+	}
+
+	if payload.Type == "url_verification" {
+		return nil, gin.H{"challenge": payload.Challenge}, nil
+	}
+	// The first delivery was acknowledged and is being answered already
+	if c.GetHeader("X-Slack-Retry-Num") != "" {
+		return nil, nil, nil
+	}
+
+	// Mentions in channels arrive as app_mention, and again as message if the
+	// bot also reads the channel, so plain messages count only in DMs
+	ev := payload.Event
+	if payload.Type != "event_callback" || ev.BotID != "" || ev.Subtype != "" || ev.User == "" {
+		return nil, nil, nil
+	}
+	if ev.Type != "app_mention" && (ev.Type != "message" || ev.ChannelType != "im") {
+		return nil, nil, nil
+	}
+	text := strings.TrimSpace(slackMentionPattern.ReplaceAllString(ev.Text, ""))
+	if text == "" {
+		return nil, nil, nil
+	}
+
+	thread := ev.ThreadTS
+	if thread == "" {
+		thread = ev.TS
+	}
+	return &botMessage{
+		UserID:  ev.User,
+		Text:    text,
+		Channel: ev.Channel,
+		Thread:  ev.Channel + ":" + thread,
+		ReplyTo: thread,
+	}, nil, nil
+}
+
+// slackSignatureValid checks a request's v0 signature, an HMAC-SHA256 of
+// its timestamp and body, and that it was sent recently
+func slackSignatureValid(c *gin.Context, secret string, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	timestamp := c.GetHeader("X-Slack-Request-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > slackMaxClockSkew || age < -slackMaxClockSkew {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(c.GetHeader("X-Slack-Signature")))
+}
+
+func (sl slackBot) reply(ctx context.Context, conn *BotConnection, msg *botMessage, text string) error {
+	payload := map[string]any{"channel": msg.Channel, "thread_ts": msg.ReplyTo, "text": text}
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := postBotAPI(ctx, sl.apiURL+"/chat.postMessage", "Bearer "+conn.BotToken, payload, &result); err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("slack: %s", result.Error)
+	}
+	return nil
+}
+
+// Answering messages
+
+// botCommand splits a leading command off a message. Telegram addresses
+// commands in groups as "/ask@SomeBot", so the bot's name is dropped.
+func botCommand(text string) (command, rest string) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return "", text
+	}
+	command, rest, _ = strings.Cut(text, " ")
+	command, _, _ = strings.Cut(command, "@")
+	switch command = strings.ToLower(command); command {
+	case botAskCommand, botCaptureCommand, botNewCommand:
+		return command, strings.TrimSpace(rest)
+	}
+	return "", text
+}
+
+// answerBotMessage acts on a message and posts the answer back
+func (s *Server) answerBotMessage(conn *BotConnection, msg *botMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.LLMTimeout)*time.Second)
+	defer cancel()
+
+	command, text := botCommand(msg.Text)
+	mode := conn.Mode
+	switch command {
+	case botAskCommand:
+		mode = BotModeChat
+	case botCaptureCommand:
+		mode = BotModeCapture
+	case botNewCommand:
+		if err := s.store.DeleteBotThread(ctx, conn.ID, msg.Thread); err != nil {
+			golog.Errorf("failed to reset bot thread: %v", err)
+		}
+		s.postBotReply(conn, msg, "Starting a new conversation.")
+		return
+	}
+	if text == "" {
+		s.postBotReply(conn, msg, fmt.Sprintf("Send %s followed by a question, or %s followed by something to save.", botAskCommand, botCaptureCommand))
+		return
+	}
+
+	var answer string
+	var err error
+	if mode == BotModeCapture {
+		answer, err = s.botCapture(ctx, conn, text)
+	} else {
+		answer, err = s.botChat(ctx, conn, msg, text)
+	}
+	if err != nil {
+		answer = botErrorText(err)
+		golog.Warnf("bot %s failed to answer a message in notebook %s: %v", conn.ID, conn.NotebookID, err)
+	}
+	s.postBotReply(conn, msg, answer)
+}
+
+// postBotReply posts an answer back, logging failures since nobody is
+// waiting for them
+func (s *Server) postBotReply(conn *BotConnection, msg *botMessage, text string) {
+	if err := s.botPlatform(conn.Platform).reply(context.Background(), conn, msg, text); err != nil {
+		golog.Errorf("failed to post bot %s reply: %v", conn.ID, err)
+	}
+}
+
+// botErrorText is what the sender is told when a message fails. Problems
+// with the message itself are explained; anything else is only logged.
+func botErrorText(err error) string {
+	var blocked *ModerationError
+	var quota *QuotaError
+	var invalid *ValidationError
+	var stored *storeError
+	if errors.As(err, &blocked) || errors.As(err, &quota) || errors.As(err, &invalid) || errors.As(err, &stored) {
+		return "Sorry, " + err.Error() + "."
+	}
+	return "Sorry, something went wrong. Please try again later."
+}
+
+// botChat asks the notebook a question, continuing the thread's chat session
+func (s *Server) botChat(ctx context.Context, conn *BotConnection, msg *botMessage, question string) (string, error) {
+	if err := s.loadNotebookVectorIndex(ctx, conn.NotebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	if err := s.moderate(ctx, moderationInput{NotebookID: conn.NotebookID, Stage: ModerationStagePrompt, Text: question}); err != nil {
+		return "", err
+	}
+	session, err := s.botSession(ctx, conn, msg)
+	if err != nil {
+		return "", err
+	}
+	release, err := s.chatQueue.wait(ctx, "bot:"+conn.ID, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := s.runChat(ctx, conn.NotebookID, ChatRequest{Message: question}, session, nil)
+	release()
+	if err != nil {
+		return "", err
+	}
+	if err := s.moderate(ctx, moderationInput{NotebookID: conn.NotebookID, Stage: ModerationStageAnswer, Text: response.Message}); err != nil {
+		s.store.AddChatMessage(ctx, session.ID, "user", question, nil, nil, nil)
+		return "", err
+	}
+
+	sourceIDs := make([]string, len(response.Sources))
+	for i, src := range response.Sources {
+		sourceIDs[i] = src.ID
+	}
+	s.store.AddChatMessage(ctx, session.ID, "user", question, nil, nil, nil)
+	s.store.AddChatMessage(ctx, session.ID, "assistant", response.Message, sourceIDs, response.ToolCalls, answerMetadata(response))
+
+	var b strings.Builder
+	b.WriteString(response.Message)
+	if len(response.Sources) > 0 {
+		b.WriteString("\n\nSources:")
+		for i, src := range response.Sources {
+			fmt.Fprintf(&b, "\n%d. %s", i+1, src.Name)
+			if src.URL != "" {
+				fmt.Fprintf(&b, " (%s)", src.URL)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// botSession returns the chat session of the message's thread, starting
+// one titled after the question when the thread is new
+func (s *Server) botSession(ctx context.Context, conn *BotConnection, msg *botMessage) (*ChatSession, error) {
+	sessionID, err := s.store.GetBotThread(ctx, conn.ID, msg.Thread)
+	if err != nil {
+		return nil, err
+	}
+	if sessionID != "" {
+		if session, err := s.store.GetChatSession(ctx, sessionID); err == nil {
+			return session, nil
+		}
+	}
+
+	_, text := botCommand(msg.Text)
+	session, err := s.store.CreateChatSession(ctx, conn.NotebookID, captureTitle(&CaptureRequest{Text: text}))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.SetBotThread(ctx, conn.ID, msg.Thread, session.ID); err != nil {
+		return nil, err
+	}
+	return s.store.GetChatSession(ctx, session.ID)
+}
+
+// botCapture saves a message as a capture note in the notebook. A message
+// that is only a link saves the page behind it.
+func (s *Server) botCapture(ctx context.Context, conn *BotConnection, text string) (string, error) {
+	if err := s.checkWritable(ctx, conn.NotebookID); err != nil {
+		return "", err
+	}
+	nb, err := s.store.GetNotebook(ctx, conn.NotebookID)
+	if err != nil {
+		return "", err
+	}
+
+	req := CaptureRequest{Text: text}
+	if u, err := url.Parse(text); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && !strings.ContainsAny(text, " \n") {
+		req = CaptureRequest{URL: text}
+	}
+	note := &Note{
+		NotebookID: conn.NotebookID,
+		Title:      captureTitle(&req),
+		Content:    req.Text,
+		Type:       NoteTypeCapture,
+		SourceIDs:  []string{},
+		Metadata: map[string]interface{}{
+			"captured_at":    time.Now(),
+			"captured_via":   conn.Platform,
+			"capture_status": CaptureProcessed,
+		},
+	}
+	if req.URL != "" {
+		note.Content = req.URL
+		note.Metadata["url"] = req.URL
+		note.Metadata["capture_status"] = CapturePending
+	}
+	if err := s.createNote(ctx, note); err != nil {
+		return "", err
+	}
+	if req.URL != "" {
+		s.processCapture(note, req)
+	}
+
+	return fmt.Sprintf("Saved to %s: %s", nb.Name, note.Title), nil
+}
+
+// Bot handlers
+
+// handleBotWebhook receives messages from Telegram and Slack. It answers at
+// once, since both retry webhooks that take a few seconds, and posts the
+// answer back when it is ready.
+func (s *Server) handleBotWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	conn, err := s.store.GetBotConnectionByToken(ctx, c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Bot not found"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		if !bodyTooLargeResponse(c, err) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read body"})
+		}
+		return
+	}
+
+	msg, response, err := s.botPlatform(conn.Platform).parse(c, conn, body)
+	switch {
+	case errors.Is(err, errBotUnauthorized):
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Invalid webhook signature"})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: fmt.Sprintf("Failed to parse update: %v", err)})
+		return
+	case response != nil:
+		c.JSON(http.StatusOK, response)
+		return
+	case msg == nil:
+		c.JSON(http.StatusOK, gin.H{"accepted": false, "reason": "ignored"})
+		return
+	}
+
+	if !conn.userAllowed(msg) {
+		golog.Warnf("bot message from %s rejected by allow-list of bot %s", msg.UserID, conn.ID)
+		c.JSON(http.StatusOK, gin.H{"accepted": false, "reason": "user not allowed"})
+		return
+	}
+
+	s.runJob(func() { s.answerBotMessage(conn, msg) })
+	c.JSON(http.StatusOK, gin.H{"accepted": true})
+}
+
+func validateBotConnection(b *BotConnection) error {
+	var fields fieldErrors
+	if b.Platform != BotTelegram && b.Platform != BotSlack {
+		fields.add("platform", "must be one of %s, %s", BotTelegram, BotSlack)
+	}
+	if b.Mode != BotModeChat && b.Mode != BotModeCapture {
+		fields.add("mode", "must be one of %s, %s", BotModeChat, BotModeCapture)
+	}
+	if strings.TrimSpace(b.BotToken) == "" {
+		fields.add("bot_token", "is required")
+	}
+	if b.Platform == BotSlack && strings.TrimSpace(b.SigningSecret) == "" {
+		fields.add("signing_secret", "is required for Slack")
+	}
+	return fields.err()
+}
+
+// notebookBot loads :botId and checks it belongs to :id
+func (s *Server) notebookBot(c *gin.Context) (*BotConnection, bool) {
+	b, err := s.store.GetBotConnection(context.Background(), c.Param("botId"))
+	if err != nil || b.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Bot not found"})
+		return nil, false
+	}
+	return b, true
+}
+
+func (s *Server) handleListBots(c *gin.Context) {
+	ctx := context.Background()
+
+	bots, err := s.store.ListBotConnections(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list bots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, bots)
+}
+
+func (s *Server) handleCreateBot(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	var req struct {
+		Platform      string   `json:"platform"`
+		Mode          string   `json:"mode"`
+		BotToken      string   `json:"bot_token"`
+		SigningSecret string   `json:"signing_secret"`
+		AllowedUsers  []string `json:"allowed_users"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = BotModeChat
+	}
+
+	b := BotConnection{
+		NotebookID:    notebookID,
+		Platform:      req.Platform,
+		Mode:          req.Mode,
+		BotToken:      strings.TrimSpace(req.BotToken),
+		SigningSecret: strings.TrimSpace(req.SigningSecret),
+		AllowedUsers:  req.AllowedUsers,
+	}
+	if err := validateBotConnection(&b); err != nil {
+		validationResponse(c, err)
+		return
+	}
+	b.HasBotToken = true
+	b.HasSigningSecret = b.SigningSecret != ""
+
+	if err := s.store.CreateBotConnection(ctx, &b); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create bot"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, b)
+}
+
+// handleUpdateBot changes a bot's settings. Secrets that are left out keep
+// their values.
+func (s *Server) handleUpdateBot(c *gin.Context) {
+	ctx := context.Background()
+
+	existing, ok := s.notebookBot(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Mode          string   `json:"mode"`
+		BotToken      string   `json:"bot_token"`
+		SigningSecret string   `json:"signing_secret"`
+		AllowedUsers  []string `json:"allowed_users"`
+		RotateToken   bool     `json:"rotate_token"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	b := *existing
+	if req.Mode != "" {
+		b.Mode = req.Mode
+	}
+	if token := strings.TrimSpace(req.BotToken); token != "" {
+		b.BotToken = token
+	}
+	if secret := strings.TrimSpace(req.SigningSecret); secret != "" {
+		b.SigningSecret = secret
+	}
+	if req.AllowedUsers != nil {
+		b.AllowedUsers = req.AllowedUsers
+	}
+	if err := validateBotConnection(&b); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	if err := s.store.UpdateBotConnection(ctx, &b, req.RotateToken); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update bot"})
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+func (s *Server) handleDeleteBot(c *gin.Context) {
+	ctx := context.Background()
+
+	b, ok := s.notebookBot(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteBotConnection(ctx, b.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete bot"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Bot deleted"})
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bundlePart encodes one part of a notebook bundle and returns it with a
+// short hash of it for the bundle's ETag
+func bundlePart(v interface{}) (json.RawMessage, string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:4]), nil
+}
+
+// handleGetNotebookBundle returns everything the UI shows when a notebook
+// opens: the notebook, its notes, sources and chat sessions, in one
+// response. The parts come from the store's caches, and the ETag joins a
+// hash of each, so an unchanged notebook answers If-None-Match with 304.
+func (s *Server) handleGetNotebookBundle(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	nb, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	var notes []Note
+	var sources []Source
+	if nb.Type == NotebookTypeSmart {
+		results, err := s.smartResults(ctx, nb)
+		if err != nil {
+			storeErrorResponse(c, err, "Failed to load notebook")
+			return
+		}
+		notes, sources = results.Notes, results.Sources
+	} else {
+		if notes, err = s.store.ListNotes(ctx, notebookID); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+			return
+		}
+		if sources, err = s.store.ListSources(ctx, notebookID); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
+			return
+		}
+	}
+	sessions, err := s.store.ListChatSessions(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list chat sessions"})
+		return
+	}
+
+	names := []string{"notebook", "notes", "sources", "chat_sessions"}
+	values := []interface{}{nb, notes, sources, sessions}
+	bundle := make(map[string]json.RawMessage, len(names))
+	hashes := make([]string, len(names))
+	for i, name := range names {
+		data, hash, err := bundlePart(values[i])
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to encode notebook"})
+			return
+		}
+		bundle[name], hashes[i] = data, hash
+	}
+
+	etag := `"` + strings.Join(hashes, "-") + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if match := c.GetHeader("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.JSON(http.StatusOK, bundle)
+}
@@ -12,6 +12,8 @@ type Cache struct {
 	data  map[string]*cacheEntry
 	ttl   time.Duration
 	stats CacheStats
+	stop  chan struct{}
+	once  sync.Once
 }
 
 type cacheEntry struct {
@@ -30,6 +32,7 @@ func NewCache(ttl time.Duration) *Cache {
 	c := &Cache{
 		data: make(map[string]*cacheEntry),
 		ttl:  ttl,
+		stop: make(chan struct{}),
 	}
 	// Start cleanup goroutine
 	go c.cleanupLoop()
@@ -104,11 +107,21 @@ func (c *Cache) cleanupLoop() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		c.cleanup()
+	for {
+		select {
+		case <-ticker.C:
+			c.cleanup()
+		case <-c.stop:
+			return
+		}
 	}
 }
 
+// Close stops the cleanup goroutine
+func (c *Cache) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
 // cleanup removes expired entries
 func (c *Cache) cleanup() {
 	c.mu.Lock()
@@ -147,16 +160,90 @@ func (c *Cache) Size() int {
 type CachedStore struct {
 	*Store
 	cache *Cache
+	// bus tells the rest of the server about changes made through the store
+	bus *eventBus
+
+	// generations counts changes to each notebook's notes and sources, so
+	// results computed from them can tell when they are out of date
+	genMu       sync.Mutex
+	generations map[string]uint64
 }
 
 // NewCachedStore creates a new cached store
 func NewCachedStore(store *Store, ttl time.Duration) *CachedStore {
-	return &CachedStore{
-		Store: store,
-		cache: NewCache(ttl),
+	cs := &CachedStore{
+		Store:       store,
+		cache:       NewCache(ttl),
+		bus:         &eventBus{},
+		generations: make(map[string]uint64),
+	}
+	// The cache is brought up to date before anyone else hears of a change
+	cs.bus.subscribe(cs.invalidate)
+	return cs
+}
+
+// Subscribe has h called on every change made through the store
+func (cs *CachedStore) Subscribe(h storeEventHandler) {
+	cs.bus.subscribe(h)
+}
+
+// invalidate drops the cached data a change made out of date
+func (cs *CachedStore) invalidate(ctx context.Context, ev StoreEvent) {
+	switch ev.Kind {
+	case ChangeNotebook:
+		cs.cache.Delete(notebookKey(ev.ID))
+		cs.cache.Delete(notebookListKey())
+		if ev.Op == ChangeDeleted {
+			cs.cache.InvalidatePattern(notesListKey(ev.ID))
+			cs.cache.InvalidatePattern(sourcesListKey(ev.ID))
+			cs.bumpGeneration(ev.ID)
+			cs.cache.InvalidatePattern(chatSessionsKey(ev.ID))
+		}
+	case ChangeNote:
+		if ev.PreviousNotebookID != "" && ev.PreviousNotebookID != ev.NotebookID {
+			cs.invalidateNotes(ev.PreviousNotebookID)
+		}
+		cs.invalidateNotes(ev.NotebookID)
+	case ChangeSource:
+		cs.invalidateSources(ev.NotebookID)
+	case ChangeChatSession:
+		cs.cache.Delete(chatSessionsKey(ev.NotebookID))
 	}
 }
 
+// Generation returns how many times a notebook's notes or sources have
+// changed through this store
+func (cs *CachedStore) Generation(notebookID string) uint64 {
+	cs.genMu.Lock()
+	defer cs.genMu.Unlock()
+	return cs.generations[notebookID]
+}
+
+// bumpGeneration records a change to a notebook's notes or sources
+func (cs *CachedStore) bumpGeneration(notebookID string) {
+	cs.genMu.Lock()
+	cs.generations[notebookID]++
+	cs.genMu.Unlock()
+}
+
+// invalidateNotes drops a notebook's cached notes after they changed
+func (cs *CachedStore) invalidateNotes(notebookID string) {
+	cs.cache.Delete(notesListKey(notebookID))
+	cs.bumpGeneration(notebookID)
+}
+
+// invalidateSources drops a notebook's cached sources after they changed
+func (cs *CachedStore) invalidateSources(notebookID string) {
+	cs.cache.Delete(sourcesListKey(notebookID))
+	cs.bumpGeneration(notebookID)
+}
+
+// Close stops the cache and closes the underlying store
+func (cs *CachedStore) Close() error {
+	cs.cache.Close()
+	return cs.Store.Close()
+}
+
 // Cache key generators
 func notebookListKey() string {
 	return "notebooks:list"
@@ -223,9 +310,7 @@ func (cs *CachedStore) UpdateNotebook(ctx context.Context, id string, name, desc
 		return nil, err
 	}
 
-	// Invalidate caches
-	cs.cache.Delete(notebookKey(id))
-	cs.cache.Delete(notebookListKey())
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNotebook, Op: ChangeUpdated, ID: id, NotebookID: id, WorkspaceID: notebook.WorkspaceID})
 
 	return notebook, nil
 }
@@ -237,25 +322,37 @@ func (cs *CachedStore) CreateNotebook(ctx context.Context, name, description str
 		return nil, err
 	}
 
-	// Invalidate list cache
-	cs.cache.Delete(notebookListKey())
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNotebook, Op: ChangeCreated, ID: notebook.ID, NotebookID: notebook.ID, WorkspaceID: notebook.WorkspaceID})
+
+	return notebook, nil
+}
+
+// CreateNotebookInWorkspace creates a notebook in a workspace and invalidates cache
+func (cs *CachedStore) CreateNotebookInWorkspace(ctx context.Context, workspaceID, name, description string, metadata map[string]interface{}) (*Notebook, error) {
+	notebook, err := cs.Store.CreateNotebookInWorkspace(ctx, workspaceID, name, description, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNotebook, Op: ChangeCreated, ID: notebook.ID, NotebookID: notebook.ID, WorkspaceID: workspaceID})
 
 	return notebook, nil
 }
 
 // DeleteNotebook deletes a notebook and invalidates cache
 func (cs *CachedStore) DeleteNotebook(ctx context.Context, id string) error {
-	err := cs.Store.DeleteNotebook(ctx, id)
+	// Get the notebook first to find its workspace
+	notebook, err := cs.Store.GetNotebook(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = cs.Store.DeleteNotebook(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	// Invalidate caches
-	cs.cache.Delete(notebookKey(id))
-	cs.cache.Delete(notebookListKey())
-	cs.cache.InvalidatePattern(notesListKey(id))
-	cs.cache.InvalidatePattern(sourcesListKey(id))
-	cs.cache.InvalidatePattern(chatSessionsKey(id))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNotebook, Op: ChangeDeleted, ID: id, NotebookID: id, WorkspaceID: notebook.WorkspaceID})
 
 	return nil
 }
@@ -286,8 +383,34 @@ func (cs *CachedStore) CreateNote(ctx context.Context, note *Note) error {
 		return err
 	}
 
-	// Invalidate notes list cache for this notebook
-	cs.cache.Delete(notesListKey(note.NotebookID))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNote, Op: ChangeCreated, ID: note.ID, NotebookID: note.NotebookID})
+
+	return nil
+}
+
+// UpdateNote updates a note and invalidates the lists it was and is in
+func (cs *CachedStore) UpdateNote(ctx context.Context, note *Note) error {
+	before, err := cs.Store.GetNote(ctx, note.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.Store.UpdateNote(ctx, note); err != nil {
+		return err
+	}
+
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNote, Op: ChangeUpdated, ID: note.ID, NotebookID: note.NotebookID, PreviousNotebookID: before.NotebookID})
+
+	return nil
+}
+
+// UpdateNoteIfUnchanged updates a note unless it changed since base was read
+func (cs *CachedStore) UpdateNoteIfUnchanged(ctx context.Context, note, base *Note) error {
+	if err := cs.Store.UpdateNoteIfUnchanged(ctx, note, base); err != nil {
+		return err
+	}
+
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNote, Op: ChangeUpdated, ID: note.ID, NotebookID: note.NotebookID, PreviousNotebookID: base.NotebookID})
 
 	return nil
 }
@@ -305,8 +428,7 @@ func (cs *CachedStore) DeleteNote(ctx context.Context, id string) error {
 		return err
 	}
 
-	// Invalidate notes list cache for this notebook
-	cs.cache.Delete(notesListKey(note.NotebookID))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeNote, Op: ChangeDeleted, ID: id, NotebookID: note.NotebookID})
 
 	return nil
 }
@@ -337,8 +459,53 @@ func (cs *CachedStore) CreateSource(ctx context.Context, source *Source) error {
 		return err
 	}
 
-	// Invalidate sources list cache for this notebook
-	cs.cache.Delete(sourcesListKey(source.NotebookID))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeSource, Op: ChangeCreated, ID: source.ID, NotebookID: source.NotebookID})
+
+	return nil
+}
+
+// UpdateSource updates a source and invalidates cache
+func (cs *CachedStore) UpdateSource(ctx context.Context, source *Source) error {
+	err := cs.Store.UpdateSource(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeSource, Op: ChangeUpdated, ID: source.ID, NotebookID: source.NotebookID})
+
+	return nil
+}
+
+// UpdateSourceMetadata replaces a source's metadata and invalidates cache
+func (cs *CachedStore) UpdateSourceMetadata(ctx context.Context, id string, metadata map[string]interface{}) error {
+	source, err := cs.Store.GetSource(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.Store.UpdateSourceMetadata(ctx, id, metadata); err != nil {
+		return err
+	}
+
+	source.Metadata = metadata
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeSource, Op: ChangeUpdated, ID: id, NotebookID: source.NotebookID})
+
+	return nil
+}
+
+// SetSourceIncluded toggles retrieval for a source and invalidates cache
+func (cs *CachedStore) SetSourceIncluded(ctx context.Context, id string, included bool) error {
+	source, err := cs.Store.GetSource(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.Store.SetSourceIncluded(ctx, id, included); err != nil {
+		return err
+	}
+
+	source.IncludedInRetrieval = included
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeSource, Op: ChangeUpdated, ID: id, NotebookID: source.NotebookID})
 
 	return nil
 }
@@ -356,8 +523,7 @@ func (cs *CachedStore) DeleteSource(ctx context.Context, id string) error {
 		return err
 	}
 
-	// Invalidate sources list cache for this notebook
-	cs.cache.Delete(sourcesListKey(source.NotebookID))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeSource, Op: ChangeDeleted, ID: id, NotebookID: source.NotebookID})
 
 	return nil
 }
@@ -388,12 +554,27 @@ func (cs *CachedStore) CreateChatSession(ctx context.Context, notebookID, title
 		return nil, err
 	}
 
-	// Invalidate chat sessions list cache for this notebook
-	cs.cache.Delete(chatSessionsKey(notebookID))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeChatSession, Op: ChangeCreated, ID: session.ID, NotebookID: notebookID})
 
 	return session, nil
 }
 
+// SetChatSessionNotebooks changes the notebooks a chat session queries and invalidates cache
+func (cs *CachedStore) SetChatSessionNotebooks(ctx context.Context, id string, notebookIDs []string) error {
+	session, err := cs.Store.GetChatSession(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.Store.SetChatSessionNotebooks(ctx, id, notebookIDs); err != nil {
+		return err
+	}
+
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeChatSession, Op: ChangeUpdated, ID: id, NotebookID: session.NotebookID})
+
+	return nil
+}
+
 // DeleteChatSession deletes a chat session and invalidates cache
 func (cs *CachedStore) DeleteChatSession(ctx context.Context, id string) error {
 	// Get the session first to find its notebook ID
@@ -407,8 +588,7 @@ func (cs *CachedStore) DeleteChatSession(ctx context.Context, id string) error {
 		return err
 	}
 
-	// Invalidate chat sessions list cache for this notebook
-	cs.cache.Delete(chatSessionsKey(session.NotebookID))
+	cs.bus.emit(ctx, StoreEvent{Kind: ChangeChatSession, Op: ChangeDeleted, ID: id, NotebookID: session.NotebookID})
 
 	return nil
 }
@@ -0,0 +1,241 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// NoteTypeCapture marks notes made by quick capture
+const NoteTypeCapture = "capture"
+
+// Capture processing states, kept in the note's capture_status metadata
+const (
+	CapturePending   = "pending"
+	CaptureProcessed = "done"
+	CaptureFailed    = "failed"
+)
+
+// captureTitleLength is how much of the text becomes the title when none is given
+const captureTitleLength = 80
+
+// CaptureRequest is a quick capture from a global hotkey, share sheet or
+// script. At least one of text, url and image is needed.
+type CaptureRequest struct {
+	Text      string `json:"text"`
+	URL       string `json:"url" binding:"omitempty,url"`
+	Title     string `json:"title" binding:"max=200"`
+	Image     string `json:"image"` // Base64 PNG/JPEG, optionally as a data URL
+	Summarize bool   `json:"summarize"`
+	Tag       bool   `json:"tag"`
+}
+
+// CaptureResponse acknowledges a capture before its background work is done
+type CaptureResponse struct {
+	NoteID     string `json:"note_id"`
+	NotebookID string `json:"notebook_id"`
+	Status     string `json:"status"`
+}
+
+// captureTitle picks a title: the one given, the first line of the text,
+// or the page the URL points at
+func captureTitle(req *CaptureRequest) string {
+	if title := strings.TrimSpace(req.Title); title != "" {
+		return title
+	}
+	if line, _, _ := strings.Cut(strings.TrimSpace(req.Text), "\n"); line != "" {
+		line = strings.TrimSpace(line)
+		if utf8.RuneCountInString(line) > captureTitleLength {
+			line = string([]rune(line)[:captureTitleLength]) + "…"
+		}
+		return line
+	}
+	if u, err := url.Parse(req.URL); err == nil && u.Host != "" {
+		return u.Host + u.Path
+	}
+	return "Image capture"
+}
+
+// bindCapture reads a capture from JSON, or from a text/plain body with the
+// other fields in the query string, which is all a hotkey script needs
+func bindCapture(c *gin.Context, req *CaptureRequest) bool {
+	if !strings.HasPrefix(c.ContentType(), "text/plain") {
+		return bindJSON(c, req)
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		if !bodyTooLargeResponse(c, err) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read body"})
+		}
+		return false
+	}
+	req.Text = string(body)
+	req.URL = c.Query("url")
+	req.Title = c.Query("title")
+	req.Summarize = c.Query("summarize") == "true"
+	req.Tag = c.Query("tag") == "true"
+	if req.URL != "" {
+		if u, err := url.Parse(req.URL); err != nil || u.Host == "" {
+			validationResponse(c, invalidField("url", "must be an absolute URL"))
+			return false
+		}
+	}
+	if len(req.Title) > 200 {
+		validationResponse(c, invalidField("title", "must be at most 200 characters"))
+		return false
+	}
+	return true
+}
+
+// processCapture does the slow part of a capture after it was acknowledged:
+// fetching a bare URL, storing the image, and summarizing or tagging
+func (s *Server) processCapture(note *Note, req CaptureRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.IngestTimeout)*time.Second)
+	defer cancel()
+
+	var problems []string
+	if strings.TrimSpace(req.Text) == "" && req.URL != "" {
+		if content, err := s.vectorStore.ExtractFromURL(ctx, req.URL); err != nil {
+			problems = append(problems, "fetching the page failed: "+err.Error())
+		} else {
+			note.Content = content
+		}
+	}
+
+	if req.Image != "" {
+		att, err := s.saveCaptureImage(ctx, note, req.Image)
+		if err != nil {
+			problems = append(problems, "saving the image failed: "+err.Error())
+		} else {
+			note.Metadata["attachment_id"] = att.ID
+		}
+	}
+
+	if (req.Summarize || req.Tag) && strings.TrimSpace(note.Content) != "" {
+		agent := s.notebookAgent(ctx, note.NotebookID)
+		sources := []Source{{Name: note.Title, Type: NoteTypeCapture, Content: note.Content}}
+		if req.Summarize {
+			if summary, err := agent.GenerateSummary(ctx, sources, "short"); err != nil {
+				problems = append(problems, "summarizing failed: "+err.Error())
+			} else {
+				note.Metadata["summary"] = summary
+			}
+		}
+		if req.Tag {
+			if tags, err := agent.SuggestTags(ctx, sources); err != nil {
+				problems = append(problems, "tagging failed: "+err.Error())
+			} else {
+				note.Metadata["tags"] = tags
+			}
+		}
+	}
+
+	note.Metadata["capture_status"] = CaptureProcessed
+	if len(problems) > 0 {
+		note.Metadata["capture_status"] = CaptureFailed
+		note.Metadata["capture_error"] = strings.Join(problems, "; ")
+		golog.Warnf("capture %s: %s", note.ID, strings.Join(problems, "; "))
+	}
+	if err := s.store.UpdateNote(ctx, note); err != nil {
+		golog.Errorf("failed to save processed capture %s: %v", note.ID, err)
+	}
+}
+
+// saveCaptureImage stores a captured image as an attachment of the note
+func (s *Server) saveCaptureImage(ctx context.Context, note *Note, encoded string) (*Attachment, error) {
+	data, contentType, err := decodeImageData(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkStorageQuota(ctx, note.NotebookID, int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	uniqueName, path, size, err := saveUploadData("capture"+imageExtensions[contentType], bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	att := &Attachment{
+		NotebookID:  note.NotebookID,
+		NoteID:      note.ID,
+		FileName:    uniqueName,
+		ContentType: contentType,
+		FileSize:    size,
+		Path:        path,
+		Metadata:    map[string]interface{}{"kind": "capture"},
+	}
+	s.thumbnailAttachment(ctx, att)
+	if err := s.store.CreateAttachment(ctx, att); err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// Capture handlers
+
+// handleCapture files a capture in the workspace's inbox and answers at
+// once; anything that needs the network or the LLM happens afterwards, and
+// the note's capture_status metadata says when it is done
+func (s *Server) handleCapture(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req CaptureRequest
+	if !bindCapture(c, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" && req.URL == "" && req.Image == "" {
+		validationResponse(c, invalidField("text", "is required unless url or image is given"))
+		return
+	}
+
+	inbox, err := s.inboxNotebook(ctx, currentWorkspace(c))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to open the inbox")
+		return
+	}
+
+	content := strings.TrimSpace(req.Text)
+	if content == "" {
+		content = req.URL
+	}
+	metadata := map[string]interface{}{
+		"captured_at":    time.Now(),
+		"capture_status": CaptureProcessed,
+	}
+	if req.URL != "" {
+		metadata["url"] = req.URL
+	}
+	background := req.Image != "" || req.Summarize || req.Tag || strings.TrimSpace(req.Text) == ""
+	if background {
+		metadata["capture_status"] = CapturePending
+	}
+
+	note := &Note{
+		NotebookID: inbox.ID,
+		Title:      captureTitle(&req),
+		Content:    content,
+		Type:       NoteTypeCapture,
+		SourceIDs:  []string{},
+		Metadata:   metadata,
+	}
+	if err := s.createNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to save capture")
+		return
+	}
+
+	status := http.StatusCreated
+	if background {
+		status = http.StatusAccepted
+		captured := *note
+		s.runJob(func() { s.processCapture(&captured, req) })
+	}
+	c.JSON(status, CaptureResponse{NoteID: note.ID, NotebookID: inbox.ID, Status: metadata["capture_status"].(string)})
+}
@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of items recorded in the change journal
+const (
+	ChangeNotebook    = "notebook"
+	ChangeNote        = "note"
+	ChangeSource      = "source"
+	ChangeChatSession = "chat_session"
+)
+
+// Change operations
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// changeRetention is how long the change journal is kept. Clients with an
+// older cursor refetch their lists in full.
+const changeRetention = 30 * 24 * time.Hour
+
+// changePruneSchedule is when old journal entries are dropped
+const changePruneSchedule = "@hourly"
+
+// changeTables are the tables the journal follows, with the kind recorded
+// for their rows and the column whose value scopes a list of them
+var changeTables = []struct{ table, kind, scope string }{
+	{"notebooks", ChangeNotebook, "workspace_id"},
+	{"notes", ChangeNote, "notebook_id"},
+	{"sources", ChangeSource, "notebook_id"},
+	{"chat_sessions", ChangeChatSession, "notebook_id"},
+}
+
+// ensureChangeTriggers has SQLite record every insert, update and delete of
+// the followed tables in the change journal. Triggers also see writes that
+// bypass the cache and rows removed by cascading deletes. An update that
+// moves a row to another scope is recorded as its deletion from the old
+// scope and its creation in the new one. The triggers are recreated on
+// every start, so a changed definition reaches existing databases.
+func (s *Store) ensureChangeTriggers() error {
+	for _, t := range changeTables {
+		record := func(row, op string) string {
+			return fmt.Sprintf(`
+					INSERT INTO changes (kind, item_id, scope_id, op, changed_at)
+					VALUES ('%s', %s.id, %[2]s.%s, '%s', CAST(strftime('%%s', 'now') AS INTEGER));`,
+				t.kind, row, t.scope, op)
+		}
+		for _, trigger := range []struct{ name, event, when, body string }{
+			{ChangeCreated, "INSERT", "", record("NEW", ChangeCreated)},
+			{ChangeUpdated, "UPDATE", "OLD." + t.scope + " IS NEW." + t.scope, record("NEW", ChangeUpdated)},
+			{"moved", "UPDATE", "OLD." + t.scope + " IS NOT NEW." + t.scope, record("OLD", ChangeDeleted) + record("NEW", ChangeCreated)},
+			{ChangeDeleted, "DELETE", "", record("OLD", ChangeDeleted)},
+		} {
+			name := "changes_" + t.table + "_" + trigger.name
+			when := ""
+			if trigger.when != "" {
+				when = " WHEN " + trigger.when
+			}
+			if _, err := s.db.Exec(`DROP TRIGGER IF EXISTS ` + name); err != nil {
+				return err
+			}
+			if _, err := s.db.Exec(fmt.Sprintf(`
+				CREATE TRIGGER %s AFTER %s ON %s%s
+				BEGIN%s
+				END`, name, trigger.event, t.table, when, trigger.body)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ChangeSet is what changed in a list since a cursor. An item is reported
+// once, by its net change: one created and deleted since is left out, and
+// one created and then updated is only created.
+type ChangeSet struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Deleted []string `json:"deleted"`
+	Cursor  int64    `json:"cursor"`
+}
+
+// Change journal operations
+
+// ChangeCursor returns the journal's latest cursor, and the oldest cursor
+// it can still answer for, which is later than 0 once old entries have
+// been pruned
+func (s *Store) ChangeCursor(ctx context.Context) (latest, oldest int64, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'changes'), 0)`).Scan(&latest)
+	if err != nil {
+		return 0, 0, err
+	}
+	var first sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT MIN(seq) FROM changes`).Scan(&first); err != nil {
+		return 0, 0, err
+	}
+	oldest = latest
+	if first.Valid {
+		oldest = first.Int64 - 1
+	}
+	return latest, oldest, nil
+}
+
+// ListChanges returns the net changes to a kind of item within a scope (a
+// notebook, or for notebooks a workspace) after the since cursor
+func (s *Store) ListChanges(ctx context.Context, kind, scopeID string, since int64) (*ChangeSet, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, item_id, op FROM changes
+		WHERE kind = ? AND scope_id = ? AND seq > ?
+		ORDER BY seq
+	`, kind, scopeID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	set := &ChangeSet{Created: []string{}, Updated: []string{}, Deleted: []string{}, Cursor: since}
+	first := map[string]string{}
+	last := map[string]string{}
+	var order []string
+	for rows.Next() {
+		var seq int64
+		var id, op string
+		if err := rows.Scan(&seq, &id, &op); err != nil {
+			return nil, err
+		}
+		if _, seen := first[id]; !seen {
+			first[id] = op
+			order = append(order, id)
+		}
+		last[id] = op
+		set.Cursor = seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range order {
+		switch {
+		case last[id] == ChangeDeleted && first[id] == ChangeCreated:
+		case last[id] == ChangeDeleted:
+			set.Deleted = append(set.Deleted, id)
+		case first[id] == ChangeCreated:
+			set.Created = append(set.Created, id)
+		default:
+			set.Updated = append(set.Updated, id)
+		}
+	}
+	return set, nil
+}
+
+// ListChangedScopes returns the scopes in which items of the given kinds
+// changed after the since cursor
+func (s *Store) ListChangedScopes(ctx context.Context, since int64, kinds ...string) ([]string, error) {
+	query := `SELECT DISTINCT scope_id FROM changes WHERE seq > ? AND kind IN (?` + strings.Repeat(", ?", len(kinds)-1) + `)`
+	args := []interface{}{since}
+	for _, kind := range kinds {
+		args = append(args, kind)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scopes []string
+	for rows.Next() {
+		var scope string
+		if err := rows.Scan(&scope); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, rows.Err()
+}
+
+// PruneChanges drops journal entries recorded before the given time
+func (s *Store) PruneChanges(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM changes WHERE changed_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// listChanges answers a list request carrying ?since=<cursor> with the IDs
+// created, updated and deleted since then, and reports whether it did. Full
+// lists get the current cursor in an X-Change-Cursor header to start from;
+// it is read before the list, so a change made meanwhile is reported again
+// rather than missed.
+func (s *Server) listChanges(c *gin.Context, kind, scopeID string) bool {
+	since, latest, ok := s.sinceCursor(c)
+	if !ok {
+		return true
+	}
+	if since < 0 {
+		c.Header("X-Change-Cursor", strconv.FormatInt(latest, 10))
+		return false
+	}
+
+	set, err := s.store.ListChanges(c.Request.Context(), kind, scopeID, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to read changes"})
+		return true
+	}
+	// Later changes elsewhere move the cursor on too, so the next request
+	// does not scan them again
+	if set.Cursor < latest {
+		set.Cursor = latest
+	}
+	c.JSON(http.StatusOK, set)
+	return true
+}
+
+// sinceCursor reads the ?since= cursor of a request, with the journal's
+// latest cursor. since is -1 without one; ok is false when the cursor was
+// refused and an error written.
+func (s *Server) sinceCursor(c *gin.Context) (since, latest int64, ok bool) {
+	latest, oldest, err := s.store.ChangeCursor(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to read changes"})
+		return 0, 0, false
+	}
+
+	raw := c.Query("since")
+	if raw == "" {
+		return -1, latest, true
+	}
+	since, err = strconv.ParseInt(raw, 10, 64)
+	if err != nil || since < 0 {
+		validationResponse(c, invalidField("since", "must be a cursor from X-Change-Cursor or a previous response"))
+		return 0, 0, false
+	}
+	if since < oldest || since > latest {
+		c.JSON(http.StatusGone, ErrorResponse{Code: CodeCursorExpired, Error: "Cursor has expired; fetch the full list again"})
+		return 0, 0, false
+	}
+	return since, latest, true
+}
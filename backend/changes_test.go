@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestListChangesOfMovedNote(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	from, err := store.CreateNotebook(ctx, "From", "", nil)
+	if err != nil {
+		t.Fatalf("CreateNotebook: %v", err)
+	}
+	to, err := store.CreateNotebook(ctx, "To", "", nil)
+	if err != nil {
+		t.Fatalf("CreateNotebook: %v", err)
+	}
+	note := &Note{NotebookID: from.ID, Title: "Moving", Content: "content", Type: "custom"}
+	if err := store.CreateNote(ctx, note); err != nil {
+		t.Fatalf("CreateNote: %v", err)
+	}
+	since, _, err := store.ChangeCursor(ctx)
+	if err != nil {
+		t.Fatalf("ChangeCursor: %v", err)
+	}
+
+	note.NotebookID = to.ID
+	if err := store.UpdateNote(ctx, note); err != nil {
+		t.Fatalf("UpdateNote: %v", err)
+	}
+	note.Title = "Moved"
+	if err := store.UpdateNote(ctx, note); err != nil {
+		t.Fatalf("UpdateNote: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		notebookID string
+		want       ChangeSet
+	}{
+		{name: "old notebook", notebookID: from.ID, want: ChangeSet{Created: []string{}, Updated: []string{}, Deleted: []string{note.ID}}},
+		{name: "new notebook", notebookID: to.ID, want: ChangeSet{Created: []string{note.ID}, Updated: []string{}, Deleted: []string{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.ListChanges(ctx, ChangeNote, tt.notebookID, since)
+			if err != nil {
+				t.Fatalf("ListChanges: %v", err)
+			}
+			got.Cursor = 0
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ListChanges = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errChatQueueFull is returned when a chat cannot even wait its turn
+var errChatQueueFull = errors.New("too many chats are waiting to be answered; try again shortly")
+
+// chatQueueRetryAfter is the Retry-After sent with a full queue
+const chatQueueRetryAfter = 10 * time.Second
+
+// chatQueue bounds how many chats are answered at once. Chats over the
+// limit wait in a queue of bounded size, served round-robin between users
+// so one user's burst does not hold everyone else up.
+type chatQueue struct {
+	mu      sync.Mutex
+	limit   int
+	size    int
+	running int
+	waiting int
+	// users are those with waiting chats, in the order they are served
+	users []*chatQueueUser
+}
+
+// chatQueueUser is one user's waiting chats, oldest first
+type chatQueueUser struct {
+	key     string
+	waiters []*chatWaiter
+}
+
+type chatWaiter struct {
+	ready    chan struct{}
+	granted  bool
+	position int
+	// moved is told the waiter's new place in the queue, counting from 1
+	moved func(position int)
+}
+
+// newChatQueue returns a queue answering limit chats at once with up to
+// size waiting; a limit of 0 lets every chat through
+func newChatQueue(limit, size int) *chatQueue {
+	return &chatQueue{limit: limit, size: size}
+}
+
+// wait returns once a chat of the user identified by key may be answered,
+// or with errChatQueueFull or the context's error. The returned release
+// must be called when the answer is done. moved, which may be nil, is told
+// the chat's place in the queue whenever it changes while it waits.
+func (q *chatQueue) wait(ctx context.Context, key string, moved func(position int)) (release func(), err error) {
+	if q == nil || q.limit <= 0 {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	if q.running < q.limit && q.waiting == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.releaser(), nil
+	}
+	if q.waiting >= q.size {
+		q.mu.Unlock()
+		return nil, errChatQueueFull
+	}
+
+	w := &chatWaiter{ready: make(chan struct{}), moved: moved}
+	var user *chatQueueUser
+	for _, u := range q.users {
+		if u.key == key {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		user = &chatQueueUser{key: key}
+		q.users = append(q.users, user)
+	}
+	user.waiters = append(user.waiters, w)
+	q.waiting++
+	q.renumber()
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return q.releaser(), nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.granted {
+		// Let in just as the caller gave up; pass the turn on
+		q.running--
+		q.dispatch()
+		return nil, ctx.Err()
+	}
+	for i, u := range q.users {
+		if u != user {
+			continue
+		}
+		for j, other := range u.waiters {
+			if other == w {
+				u.waiters = append(u.waiters[:j], u.waiters[j+1:]...)
+				break
+			}
+		}
+		if len(u.waiters) == 0 {
+			q.users = append(q.users[:i], q.users[i+1:]...)
+		}
+		break
+	}
+	q.waiting--
+	q.renumber()
+	return nil, ctx.Err()
+}
+
+// releaser returns a function giving back a running chat's turn, once
+func (q *chatQueue) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.running--
+			q.dispatch()
+		})
+	}
+}
+
+// dispatch lets waiting chats in while there is room, taking the oldest
+// chat of each user in turn. Callers hold q.mu.
+func (q *chatQueue) dispatch() {
+	changed := false
+	for q.running < q.limit && len(q.users) > 0 {
+		user := q.users[0]
+		w := user.waiters[0]
+		user.waiters = user.waiters[1:]
+		q.users = q.users[1:]
+		if len(user.waiters) > 0 {
+			q.users = append(q.users, user)
+		}
+		q.running++
+		q.waiting--
+		w.granted = true
+		close(w.ready)
+		changed = true
+	}
+	if changed {
+		q.renumber()
+	}
+}
+
+// renumber works out the order the waiting chats will be served in, round
+// by round over the users, and tells those whose place changed. Callers
+// hold q.mu.
+func (q *chatQueue) renumber() {
+	position := 0
+	for round, more := 0, true; more; round++ {
+		more = false
+		for _, u := range q.users {
+			if round >= len(u.waiters) {
+				continue
+			}
+			more = true
+			position++
+			w := u.waiters[round]
+			if w.position != position {
+				w.position = position
+				if w.moved != nil {
+					w.moved(position)
+				}
+			}
+		}
+	}
+}
+
+// queueChat waits for a chat's turn to be answered, telling the user's
+// event clients its place in the queue meanwhile. Anonymous callers share no
+// event clients of their own, so they are not told. Unless it fails, release
+// must be called once the answer is done.
+func (s *Server) queueChat(c *gin.Context, ctx context.Context, sessionID string) (release func(), err error) {
+	userID := settingsOwner(c)
+	key := userID
+	if key == "" {
+		key = "ip:" + c.ClientIP()
+	}
+	notebookID := c.Param("id")
+	queued := false
+	start := time.Now()
+	release, err = s.chatQueue.wait(ctx, key, func(position int) {
+		queued = true
+		if userID == "" {
+			return
+		}
+		s.events.publishUser(userID, Event{Type: "chat.queued", Data: gin.H{
+			"notebook_id": notebookID,
+			"session_id":  sessionID,
+			"position":    position,
+		}})
+	})
+	if err == nil && queued && userID != "" {
+		s.events.publishUser(userID, Event{Type: "chat.started", Data: gin.H{
+			"notebook_id": notebookID,
+			"session_id":  sessionID,
+			"waited_ms":   time.Since(start).Milliseconds(),
+		}})
+	}
+	return release, err
+}
+
+// chatQueueFullResponse answers 503 when err is errChatQueueFull, and
+// reports whether it did
+func chatQueueFullResponse(c *gin.Context, err error) bool {
+	if !errors.Is(err, errChatQueueFull) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(chatQueueRetryAfter.Seconds())))
+	c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: err.Error()})
+	return true
+}
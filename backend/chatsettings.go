@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChatSettings customizes how a notebook's chat answers questions.
+// Empty fields fall back to the defaults.
+type ChatSettings struct {
+	NotebookID    string    `json:"notebook_id"`
+	SystemPrompt  string    `json:"system_prompt"`
+	Tone          string    `json:"tone"`
+	AnswerLength  string    `json:"answer_length"`  // "short", "medium", "long"
+	CitationStyle string    `json:"citation_style"` // "inline", "numbered", "none"
+	Temperature   *float64  `json:"temperature,omitempty"`
+	Tools         []string  `json:"tools"` // chat tools the model may call
+	IsDefault     bool      `json:"is_default"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+var answerLengths = map[string]bool{"": true, "short": true, "medium": true, "long": true}
+
+var chatCitationStyles = map[string]bool{"": true, "inline": true, "numbered": true, "none": true}
+
+// GetChatSettings retrieves a notebook's chat settings, returning defaults if none are saved
+func (s *Store) GetChatSettings(ctx context.Context, notebookID string) (*ChatSettings, error) {
+	settings := ChatSettings{NotebookID: notebookID}
+	var temperature sql.NullFloat64
+	var toolsJSON string
+	var updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT system_prompt, tone, answer_length, citation_style, temperature, COALESCE(tools, ''), updated_at
+		FROM notebook_chat_settings WHERE notebook_id = ?
+	`, notebookID).Scan(&settings.SystemPrompt, &settings.Tone, &settings.AnswerLength,
+		&settings.CitationStyle, &temperature, &toolsJSON, &updatedAt)
+	if err == sql.ErrNoRows {
+		settings.IsDefault = true
+		settings.Tools = []string{}
+		return &settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if toolsJSON != "" {
+		json.Unmarshal([]byte(toolsJSON), &settings.Tools)
+	}
+	if settings.Tools == nil {
+		settings.Tools = []string{}
+	}
+
+	if temperature.Valid {
+		settings.Temperature = &temperature.Float64
+	}
+	settings.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &settings, nil
+}
+
+// SaveChatSettings stores a notebook's chat settings
+func (s *Store) SaveChatSettings(ctx context.Context, settings *ChatSettings) error {
+	now := time.Now()
+	settings.UpdatedAt = now
+	settings.IsDefault = false
+
+	var temperature interface{}
+	if settings.Temperature != nil {
+		temperature = *settings.Temperature
+	}
+	if settings.Tools == nil {
+		settings.Tools = []string{}
+	}
+	toolsJSON, _ := json.Marshal(settings.Tools)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notebook_chat_settings (notebook_id, system_prompt, tone, answer_length, citation_style, temperature, tools, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(notebook_id) DO UPDATE SET
+			system_prompt = excluded.system_prompt, tone = excluded.tone,
+			answer_length = excluded.answer_length, citation_style = excluded.citation_style,
+			temperature = excluded.temperature, tools = excluded.tools, updated_at = excluded.updated_at
+	`, settings.NotebookID, settings.SystemPrompt, settings.Tone, settings.AnswerLength,
+		settings.CitationStyle, temperature, string(toolsJSON), now.Unix())
+
+	return err
+}
+
+// DeleteChatSettings resets a notebook's chat settings to the defaults
+func (s *Store) DeleteChatSettings(ctx context.Context, notebookID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM notebook_chat_settings WHERE notebook_id = ?`, notebookID)
+	return err
+}
+
+// Chat settings handlers
+
+func (s *Server) handleGetChatSettings(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	settings, err := s.store.GetChatSettings(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get chat settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+func (s *Server) handleUpdateChatSettings(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	var settings ChatSettings
+	if !bindJSON(c, &settings) {
+		return
+	}
+
+	if !answerLengths[settings.AnswerLength] {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "answer_length must be one of short, medium, long"})
+		return
+	}
+	if !chatCitationStyles[settings.CitationStyle] {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "citation_style must be one of inline, numbered, none"})
+		return
+	}
+	if t := settings.Temperature; t != nil && (*t < 0 || *t > 2) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "temperature must be between 0 and 2"})
+		return
+	}
+	registry := s.toolRegistry()
+	for _, name := range settings.Tools {
+		if _, ok := registry[name]; !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: fmt.Sprintf("unknown tool: %s", name)})
+			return
+		}
+	}
+
+	settings.NotebookID = notebookID
+	if err := s.store.SaveChatSettings(ctx, &settings); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save chat settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+func (s *Server) handleResetChatSettings(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if err := s.store.DeleteChatSettings(ctx, notebookID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to reset chat settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ChatSettings{NotebookID: notebookID, Tools: []string{}, IsDefault: true})
+}
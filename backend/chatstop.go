@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// errChatStopped is the cause of a chat's context when it was stopped with
+// POST .../chat/sessions/:sessionId/stop
+var errChatStopped = errors.New("chat stopped on request")
+
+// chatRun is an answer being generated for a chat session
+type chatRun struct {
+	cancel context.CancelCauseFunc
+	// partial is the answer streamed so far. Only the request generating
+	// it writes and reads it, the latter once generation has returned.
+	partial strings.Builder
+}
+
+// chatRuns tracks the answers being generated for each session so they can
+// be stopped from another request
+type chatRuns struct {
+	mu     sync.Mutex
+	active map[string]map[*chatRun]bool
+}
+
+// start registers an answer for a session. The returned context is canceled
+// with errChatStopped when the session is stopped; call done when the
+// answer is finished.
+func (r *chatRuns) start(ctx context.Context, sessionID string) (context.Context, *chatRun, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	run := &chatRun{cancel: cancel}
+
+	r.mu.Lock()
+	if r.active == nil {
+		r.active = make(map[string]map[*chatRun]bool)
+	}
+	if r.active[sessionID] == nil {
+		r.active[sessionID] = make(map[*chatRun]bool)
+	}
+	r.active[sessionID][run] = true
+	r.mu.Unlock()
+
+	return ctx, run, func() {
+		r.mu.Lock()
+		delete(r.active[sessionID], run)
+		if len(r.active[sessionID]) == 0 {
+			delete(r.active, sessionID)
+		}
+		r.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// stop cancels the answers being generated for a session and returns how
+// many there were
+func (r *chatRuns) stop(sessionID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for run := range r.active[sessionID] {
+		run.cancel(errChatStopped)
+	}
+	return len(r.active[sessionID])
+}
+
+// chatStopped reports whether a chat's context was canceled by a stop request
+func chatStopped(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errChatStopped)
+}
+
+// stoppedChatResponse records the part of a stopped answer generated so far
+// as the session's reply, marked as stopped, and returns it to the client
+// that asked. Nothing is recorded when the provider had sent nothing yet.
+func (s *Server) stoppedChatResponse(c *gin.Context, ctx context.Context, sessionID string, run *chatRun) {
+	// The request's context is canceled; the partial answer is saved anyway
+	ctx = context.WithoutCancel(ctx)
+
+	if !s.moderateChat(c, ctx, sessionID, ModerationStageAnswer, run.partial.String()) {
+		return
+	}
+
+	response := &ChatResponse{
+		Message:   run.partial.String(),
+		Sources:   []SourceSummary{},
+		SessionID: sessionID,
+		Metadata:  map[string]interface{}{"stopped": true},
+	}
+	if response.Message != "" {
+		msg, err := s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, nil, nil, response.Metadata)
+		if err != nil {
+			golog.Errorf("failed to save stopped answer of session %s: %v", sessionID, err)
+		} else {
+			response.MessageID = msg.ID
+			s.saveLLMCalls(ctx, sessionID, msg.ID)
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleStopChat stops the answers being generated for a chat session. Each
+// request waiting on one gets the partial answer, which is also saved.
+func (s *Server) handleStopChat(c *gin.Context) {
+	session, ok := s.notebookChatSession(c, c.Param("sessionId"))
+	if !ok {
+		return
+	}
+
+	stopped := s.chatRuns.stop(session.ID)
+	if stopped == 0 {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "No answer is being generated for this session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stopped": stopped})
+}
@@ -0,0 +1,795 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Citation holds structured bibliographic metadata for a source
+type Citation struct {
+	Key       string   `json:"key,omitempty"`
+	Type      string   `json:"type"` // "article", "book", "inproceedings", "webpage", ...
+	Title     string   `json:"title"`
+	Authors   []string `json:"authors,omitempty"` // "Last, First" form
+	Year      string   `json:"year,omitempty"`
+	Container string   `json:"container,omitempty"` // Journal, book title or proceedings
+	Publisher string   `json:"publisher,omitempty"`
+	Volume    string   `json:"volume,omitempty"`
+	Issue     string   `json:"issue,omitempty"`
+	Pages     string   `json:"pages,omitempty"`
+	DOI       string   `json:"doi,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Abstract  string   `json:"abstract,omitempty"`
+}
+
+// CitationImportResult summarizes a BibTeX or Zotero import
+type CitationImportResult struct {
+	Imported  int      `json:"imported"`
+	Skipped   int      `json:"skipped"`
+	SourceIDs []string `json:"source_ids"`
+}
+
+// FormattedCitation is a citation rendered in a given style
+type FormattedCitation struct {
+	SourceID string `json:"source_id"`
+	Style    string `json:"style"`
+	Text     string `json:"text"`
+}
+
+// citationStyles lists the supported output styles
+var citationStyles = map[string]bool{"apa": true, "mla": true, "chicago": true}
+
+// Citation handlers
+
+func (s *Server) handleImportBibTeX(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	var data []byte
+	fh, err := c.FormFile("file")
+	if bodyTooLargeResponse(c, err) {
+		return
+	}
+	if err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read file"})
+			return
+		}
+		data, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read file"})
+			return
+		}
+	} else {
+		var err error
+		data, err = io.ReadAll(io.LimitReader(c.Request.Body, 20<<20))
+		if bodyTooLargeResponse(c, err) {
+			return
+		}
+		if err != nil || len(data) == 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "BibTeX file or request body required"})
+			return
+		}
+	}
+
+	citations, err := parseBibTeX(string(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: fmt.Sprintf("Failed to parse BibTeX: %v", err)})
+		return
+	}
+
+	result, err := s.importCitations(ctx, notebookID, citations, "bibtex")
+	if err != nil {
+		golog.Errorf("failed to import bibtex: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to import citations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) handleImportZotero(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	var req struct {
+		LibraryType  string `json:"library_type"` // "user" (default) or "group"
+		LibraryID    string `json:"library_id" binding:"required"`
+		APIKey       string `json:"api_key"`
+		CollectionID string `json:"collection_id"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	citations, err := fetchZoteroLibrary(ctx, req.LibraryType, req.LibraryID, req.APIKey, req.CollectionID)
+	if err != nil {
+		golog.Errorf("failed to fetch zotero library: %v", err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Failed to fetch Zotero library: %v", err)})
+		return
+	}
+
+	result, err := s.importCitations(ctx, notebookID, citations, "zotero")
+	if err != nil {
+		golog.Errorf("failed to import zotero items: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to import citations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) handleGetCitation(c *gin.Context) {
+	style := strings.ToLower(c.DefaultQuery("style", "apa"))
+	if !citationStyles[style] {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "style must be one of apa, mla, chicago"})
+		return
+	}
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, FormattedCitation{
+		SourceID: source.ID,
+		Style:    style,
+		Text:     FormatCitation(sourceCitation(source), style),
+	})
+}
+
+// handleBibliography renders citations for the notebook's sources, optionally limited by ?source_ids=a,b
+func (s *Server) handleBibliography(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	style := strings.ToLower(c.DefaultQuery("style", "apa"))
+	if !citationStyles[style] {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "style must be one of apa, mla, chicago"})
+		return
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
+		return
+	}
+
+	wanted := make(map[string]bool)
+	if ids := c.Query("source_ids"); ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			wanted[strings.TrimSpace(id)] = true
+		}
+	}
+
+	entries := make([]FormattedCitation, 0, len(sources))
+	for i := range sources {
+		if len(wanted) > 0 && !wanted[sources[i].ID] {
+			continue
+		}
+		entries = append(entries, FormattedCitation{
+			SourceID: sources[i].ID,
+			Style:    style,
+			Text:     FormatCitation(sourceCitation(&sources[i]), style),
+		})
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// importCitations creates one source per citation, skipping entries already
+// present in the notebook (matched by DOI or citation key)
+func (s *Server) importCitations(ctx context.Context, notebookID string, citations []Citation, origin string) (*CitationImportResult, error) {
+	existing, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i := range existing {
+		if cit := sourceCitation(&existing[i]); cit != nil && existing[i].Type == "citation" {
+			seen[citationIdentity(cit)] = true
+		}
+	}
+
+	result := &CitationImportResult{SourceIDs: []string{}}
+	for i := range citations {
+		cit := citations[i]
+		identity := citationIdentity(&cit)
+		if cit.Title == "" || seen[identity] {
+			result.Skipped++
+			continue
+		}
+		seen[identity] = true
+
+		var content strings.Builder
+		content.WriteString(cit.Title)
+		content.WriteString("\n\n")
+		content.WriteString(FormatCitation(&cit, "apa"))
+		if cit.Abstract != "" {
+			content.WriteString("\n\n")
+			content.WriteString(cit.Abstract)
+		}
+
+		source := &Source{
+			NotebookID: notebookID,
+			Name:       cit.Title,
+			Type:       "citation",
+			URL:        cit.URL,
+			Content:    content.String(),
+			Metadata: map[string]interface{}{
+				"citation":        cit,
+				"citation_origin": origin,
+			},
+		}
+		if err := s.ingestSource(ctx, source); err != nil {
+			return nil, err
+		}
+		result.Imported++
+		result.SourceIDs = append(result.SourceIDs, source.ID)
+	}
+
+	return result, nil
+}
+
+func citationIdentity(cit *Citation) string {
+	if cit.DOI != "" {
+		return "doi:" + strings.ToLower(cit.DOI)
+	}
+	if cit.Key != "" {
+		return "key:" + cit.Key
+	}
+	return "title:" + strings.ToLower(cit.Title) + "|" + cit.Year
+}
+
+// sourceCitation returns the source's structured citation, or a minimal one
+// derived from its name, URL and creation date for sources imported without one
+func sourceCitation(source *Source) *Citation {
+	if raw, ok := source.Metadata["citation"]; ok {
+		var cit Citation
+		if data, err := json.Marshal(raw); err == nil && json.Unmarshal(data, &cit) == nil && cit.Title != "" {
+			return &cit
+		}
+	}
+
+	cit := &Citation{
+		Type:  "webpage",
+		Title: source.Name,
+		URL:   source.URL,
+		Year:  strconv.Itoa(source.CreatedAt.Year()),
+	}
+	if source.URL == "" {
+		cit.Type = "document"
+	}
+	if author, ok := source.Metadata["author"].(string); ok && author != "" {
+		cit.Authors = []string{author}
+	}
+	return cit
+}
+
+// FormatCitation renders a citation in APA, MLA or Chicago (author-date) style
+func FormatCitation(cit *Citation, style string) string {
+	var sb strings.Builder
+	title := strings.TrimSuffix(strings.TrimSpace(cit.Title), ".")
+	isArticle := cit.Container != "" && cit.Type != "book"
+
+	switch style {
+	case "mla":
+		if authors := formatAuthorsMLA(cit.Authors); authors != "" {
+			sb.WriteString(authors + ". ")
+		}
+		if isArticle {
+			sb.WriteString("\"" + title + ".\" ")
+			sb.WriteString(cit.Container)
+			if cit.Volume != "" {
+				sb.WriteString(", vol. " + cit.Volume)
+			}
+			if cit.Issue != "" {
+				sb.WriteString(", no. " + cit.Issue)
+			}
+		} else {
+			sb.WriteString(title)
+			if cit.Publisher != "" {
+				sb.WriteString(". " + cit.Publisher)
+			}
+		}
+		if cit.Year != "" {
+			sb.WriteString(", " + cit.Year)
+		}
+		if cit.Pages != "" {
+			sb.WriteString(", pp. " + cit.Pages)
+		}
+		sb.WriteString(".")
+		if link := citationLink(cit); link != "" {
+			sb.WriteString(" " + strings.TrimPrefix(strings.TrimPrefix(link, "https://"), "http://") + ".")
+		}
+
+	case "chicago":
+		if authors := formatAuthorsChicago(cit.Authors); authors != "" {
+			sb.WriteString(authors + ". ")
+		}
+		if cit.Year != "" {
+			sb.WriteString(cit.Year + ". ")
+		}
+		if isArticle {
+			sb.WriteString("\"" + title + ".\" " + cit.Container)
+			if cit.Volume != "" {
+				sb.WriteString(" " + cit.Volume)
+			}
+			if cit.Issue != "" {
+				sb.WriteString(" (" + cit.Issue + ")")
+			}
+			if cit.Pages != "" {
+				sb.WriteString(": " + cit.Pages)
+			}
+			sb.WriteString(".")
+		} else {
+			sb.WriteString(title + ".")
+			if cit.Publisher != "" {
+				sb.WriteString(" " + cit.Publisher + ".")
+			}
+		}
+		if link := citationLink(cit); link != "" {
+			sb.WriteString(" " + link + ".")
+		}
+
+	default: // apa
+		if authors := formatAuthorsAPA(cit.Authors); authors != "" {
+			sb.WriteString(authors + " ")
+		}
+		year := cit.Year
+		if year == "" {
+			year = "n.d."
+		}
+		sb.WriteString("(" + year + "). ")
+		sb.WriteString(title + ".")
+		if isArticle {
+			sb.WriteString(" " + cit.Container)
+			if cit.Volume != "" {
+				sb.WriteString(", " + cit.Volume)
+			}
+			if cit.Issue != "" {
+				sb.WriteString("(" + cit.Issue + ")")
+			}
+			if cit.Pages != "" {
+				sb.WriteString(", " + cit.Pages)
+			}
+			sb.WriteString(".")
+		} else if cit.Publisher != "" {
+			sb.WriteString(" " + cit.Publisher + ".")
+		}
+		if link := citationLink(cit); link != "" {
+			sb.WriteString(" " + link)
+		}
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+func citationLink(cit *Citation) string {
+	if cit.DOI != "" {
+		return "https://doi.org/" + strings.TrimPrefix(cit.DOI, "https://doi.org/")
+	}
+	return cit.URL
+}
+
+// splitAuthorName splits "Last, First" or "First Last" into (last, first)
+func splitAuthorName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if comma := strings.Index(name, ","); comma >= 0 {
+		return strings.TrimSpace(name[:comma]), strings.TrimSpace(name[comma+1:])
+	}
+	fields := strings.Fields(name)
+	if len(fields) <= 1 {
+		return name, ""
+	}
+	return fields[len(fields)-1], strings.Join(fields[:len(fields)-1], " ")
+}
+
+func initials(first string) string {
+	var parts []string
+	for _, word := range strings.FieldsFunc(first, func(r rune) bool { return r == ' ' || r == '-' || r == '.' }) {
+		r := []rune(word)
+		if len(r) > 0 {
+			parts = append(parts, string(unicode.ToUpper(r[0]))+".")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatAuthorsAPA(authors []string) string {
+	names := make([]string, 0, len(authors))
+	for _, a := range authors {
+		last, first := splitAuthorName(a)
+		if first != "" {
+			names = append(names, last+", "+initials(first))
+		} else {
+			names = append(names, last)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	case 2:
+		return names[0] + ", & " + names[1]
+	}
+	if len(names) > 20 {
+		names = append(names[:19], "... "+names[len(names)-1])
+	}
+	return strings.Join(names[:len(names)-1], ", ") + ", & " + names[len(names)-1]
+}
+
+func formatAuthorsMLA(authors []string) string {
+	switch len(authors) {
+	case 0:
+		return ""
+	case 1:
+		last, first := splitAuthorName(authors[0])
+		return strings.TrimSuffix(strings.TrimSpace(last+", "+first), ",")
+	case 2:
+		last, first := splitAuthorName(authors[0])
+		last2, first2 := splitAuthorName(authors[1])
+		return strings.TrimSpace(last+", "+first) + ", and " + strings.TrimSpace(first2+" "+last2)
+	}
+	last, first := splitAuthorName(authors[0])
+	return strings.TrimSpace(last+", "+first) + ", et al"
+}
+
+func formatAuthorsChicago(authors []string) string {
+	names := make([]string, 0, len(authors))
+	for i, a := range authors {
+		last, first := splitAuthorName(a)
+		if i == 0 {
+			names = append(names, strings.TrimSuffix(strings.TrimSpace(last+", "+first), ","))
+		} else {
+			names = append(names, strings.TrimSpace(first+" "+last))
+		}
+	}
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	case 2:
+		return names[0] + ", and " + names[1]
+	}
+	if len(names) > 10 {
+		return strings.Join(names[:7], ", ") + ", et al"
+	}
+	return strings.Join(names[:len(names)-1], ", ") + ", and " + names[len(names)-1]
+}
+
+// BibTeX parsing
+
+// parseBibTeX parses the entries of a .bib file; @string, @preamble and @comment blocks are ignored
+func parseBibTeX(input string) ([]Citation, error) {
+	var citations []Citation
+	p := &bibParser{src: []rune(input)}
+
+	for {
+		at := p.indexOf('@')
+		if at < 0 {
+			break
+		}
+		p.pos = at + 1
+		entryType := strings.ToLower(strings.TrimSpace(p.readUntilAny("{(")))
+		if p.pos >= len(p.src) {
+			break
+		}
+		open := p.src[p.pos]
+		close := '}'
+		if open == '(' {
+			close = ')'
+		}
+		p.pos++
+
+		if entryType == "comment" || entryType == "string" || entryType == "preamble" {
+			p.skipBalanced(open, close)
+			continue
+		}
+
+		key := strings.TrimSpace(p.readUntilAny(","))
+		p.pos++
+		fields, err := p.readFields(close)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", key, err)
+		}
+		citations = append(citations, bibEntryToCitation(entryType, key, fields))
+	}
+
+	if len(citations) == 0 {
+		return nil, fmt.Errorf("no entries found")
+	}
+	return citations, nil
+}
+
+type bibParser struct {
+	src []rune
+	pos int
+}
+
+func (p *bibParser) indexOf(r rune) int {
+	for i := p.pos; i < len(p.src); i++ {
+		if p.src[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *bibParser) readUntilAny(chars string) string {
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(chars, p.src[p.pos]) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *bibParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *bibParser) skipBalanced(open, close rune) {
+	depth := 1
+	for p.pos < len(p.src) && depth > 0 {
+		switch p.src[p.pos] {
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+		p.pos++
+	}
+}
+
+func (p *bibParser) readFields(close rune) (map[string]string, error) {
+	fields := make(map[string]string)
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("unexpected end of input")
+		}
+		if p.src[p.pos] == close {
+			p.pos++
+			return fields, nil
+		}
+		if p.src[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSpace(p.readUntilAny("=" + string(close))))
+		if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+			continue
+		}
+		p.pos++
+
+		var parts []string
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.src) {
+				return nil, fmt.Errorf("unterminated field %s", name)
+			}
+			switch p.src[p.pos] {
+			case '{':
+				p.pos++
+				start := p.pos
+				p.skipBalanced('{', '}')
+				parts = append(parts, string(p.src[start:p.pos-1]))
+			case '"':
+				p.pos++
+				start := p.pos
+				depth := 0
+				for p.pos < len(p.src) && (p.src[p.pos] != '"' || depth > 0) {
+					if p.src[p.pos] == '{' {
+						depth++
+					} else if p.src[p.pos] == '}' {
+						depth--
+					}
+					p.pos++
+				}
+				parts = append(parts, string(p.src[start:p.pos]))
+				p.pos++
+			default:
+				parts = append(parts, strings.TrimSpace(p.readUntilAny("#,"+string(close))))
+			}
+			p.skipSpace()
+			if p.pos < len(p.src) && p.src[p.pos] == '#' {
+				p.pos++
+				continue
+			}
+			break
+		}
+		fields[name] = cleanBibValue(strings.Join(parts, ""))
+	}
+}
+
+var (
+	bibCommandRe   = regexp.MustCompile(`\\[a-zA-Z]+\s*`)
+	bibAuthorSepRe = regexp.MustCompile(`\s+and\s+`)
+	yearRe         = regexp.MustCompile(`\d{4}`)
+)
+
+// cleanBibValue strips braces and simple LaTeX commands from a field value
+func cleanBibValue(v string) string {
+	v = strings.NewReplacer(`\&`, "&", `\%`, "%", `\_`, "_", `\$`, "$", "~", " ", "--", "–").Replace(v)
+	v = bibCommandRe.ReplaceAllString(v, "")
+	v = strings.NewReplacer("{", "", "}", "", `\`, "").Replace(v)
+	return strings.Join(strings.Fields(v), " ")
+}
+
+func bibEntryToCitation(entryType, key string, f map[string]string) Citation {
+	cit := Citation{
+		Key:       key,
+		Type:      entryType,
+		Title:     f["title"],
+		Year:      f["year"],
+		Publisher: firstNonEmpty(f["publisher"], f["institution"], f["school"], f["organization"]),
+		Volume:    f["volume"],
+		Issue:     firstNonEmpty(f["number"], f["issue"]),
+		Pages:     strings.ReplaceAll(f["pages"], "–", "-"),
+		DOI:       f["doi"],
+		URL:       f["url"],
+		Abstract:  f["abstract"],
+		Container: firstNonEmpty(f["journal"], f["journaltitle"], f["booktitle"]),
+	}
+	if cit.Year == "" && len(f["date"]) >= 4 {
+		cit.Year = f["date"][:4]
+	}
+	if authors := firstNonEmpty(f["author"], f["editor"]); authors != "" {
+		for _, a := range bibAuthorSepRe.Split(authors, -1) {
+			if a = strings.TrimSpace(a); a != "" {
+				cit.Authors = append(cit.Authors, a)
+			}
+		}
+	}
+	return cit
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Zotero
+
+// fetchZoteroLibrary pages through the Zotero Web API v3 and maps items to citations
+func fetchZoteroLibrary(ctx context.Context, libraryType, libraryID, apiKey, collectionID string) ([]Citation, error) {
+	if libraryType == "" {
+		libraryType = "user"
+	}
+	if libraryType != "user" && libraryType != "group" {
+		return nil, fmt.Errorf("library_type must be 'user' or 'group'")
+	}
+
+	base := fmt.Sprintf("https://api.zotero.org/%ss/%s", libraryType, url.PathEscape(libraryID))
+	if collectionID != "" {
+		base += "/collections/" + url.PathEscape(collectionID)
+	}
+	base += "/items/top"
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	var citations []Citation
+
+	for start := 0; ; start += 100 {
+		reqURL := fmt.Sprintf("%s?format=json&limit=100&start=%d", base, start)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Zotero-API-Version", "3")
+		if apiKey != "" {
+			req.Header.Set("Zotero-API-Key", apiKey)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("zotero returned %s", resp.Status)
+		}
+
+		var items []struct {
+			Key  string `json:"key"`
+			Data struct {
+				ItemType         string `json:"itemType"`
+				Title            string `json:"title"`
+				AbstractNote     string `json:"abstractNote"`
+				PublicationTitle string `json:"publicationTitle"`
+				BookTitle        string `json:"bookTitle"`
+				Publisher        string `json:"publisher"`
+				Volume           string `json:"volume"`
+				Issue            string `json:"issue"`
+				Pages            string `json:"pages"`
+				Date             string `json:"date"`
+				DOI              string `json:"DOI"`
+				URL              string `json:"url"`
+				Creators         []struct {
+					CreatorType string `json:"creatorType"`
+					FirstName   string `json:"firstName"`
+					LastName    string `json:"lastName"`
+					Name        string `json:"name"`
+				} `json:"creators"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, fmt.Errorf("invalid zotero response: %w", err)
+		}
+
+		for _, item := range items {
+			d := item.Data
+			if d.ItemType == "attachment" || d.ItemType == "note" {
+				continue
+			}
+			cit := Citation{
+				Key:       item.Key,
+				Type:      d.ItemType,
+				Title:     d.Title,
+				Container: firstNonEmpty(d.PublicationTitle, d.BookTitle),
+				Publisher: d.Publisher,
+				Volume:    d.Volume,
+				Issue:     d.Issue,
+				Pages:     d.Pages,
+				DOI:       d.DOI,
+				URL:       d.URL,
+				Abstract:  d.AbstractNote,
+				Year:      yearRe.FindString(d.Date),
+			}
+			for _, cr := range d.Creators {
+				if cr.CreatorType != "author" && cr.CreatorType != "editor" {
+					continue
+				}
+				if cr.Name != "" {
+					cit.Authors = append(cit.Authors, cr.Name)
+				} else {
+					cit.Authors = append(cit.Authors, strings.TrimSuffix(cr.LastName+", "+cr.FirstName, ", "))
+				}
+			}
+			citations = append(citations, cit)
+		}
+
+		total, _ := strconv.Atoi(resp.Header.Get("Total-Results"))
+		if len(items) < 100 || start+100 >= total {
+			break
+		}
+	}
+
+	return citations, nil
+}
@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// How well the passages a sentence cites support it
+const (
+	CitationSupported   = "supported"
+	CitationPartial     = "partial"
+	CitationUnsupported = "unsupported"
+)
+
+const (
+	// maxCheckedClaims bounds how many cited sentences of an answer are
+	// checked
+	maxCheckedClaims = 20
+	// maxCheckedPassage is how much of a cited passage the judge is shown
+	maxCheckedPassage = 1500
+)
+
+// citationMarker matches the numbered citations the chat prompt asks for:
+// [来源 1], [来源 1, 3] or [Source 2]
+var citationMarker = regexp.MustCompile(`\s*\[(?:来源|Source)\s*(\d+(?:\s*[,，、]\s*\d+)*)\]`)
+
+// CheckedClaim is a sentence of an answer and how well the passages it
+// cites support it
+type CheckedClaim struct {
+	Sentence string `json:"sentence"`
+	// Passages are the cited [来源 N] numbers, and SourceIDs the sources
+	// they were retrieved from
+	Passages  []int    `json:"passages"`
+	SourceIDs []string `json:"source_ids"`
+	Verdict   string   `json:"verdict"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// CitationCheck is the outcome of checking an answer's citations, saved in
+// the message metadata as "citation_check"
+type CitationCheck struct {
+	Checked     int            `json:"checked"`
+	Unsupported int            `json:"unsupported"`
+	Partial     int            `json:"partial"`
+	Claims      []CheckedClaim `json:"claims"`
+}
+
+// citedSentences splits an answer into sentences and returns those citing
+// passages, with the numbers they cite. A citation standing on its own
+// after a sentence belongs to that sentence.
+func citedSentences(answer string) []CheckedClaim {
+	var sentences []string
+	var current strings.Builder
+	runes := []rune(answer)
+	for i, r := range runes {
+		current.WriteRune(r)
+		end := strings.ContainsRune("。！？!?\n", r) ||
+			(r == '.' && (i+1 == len(runes) || unicode.IsSpace(runes[i+1])))
+		if end {
+			sentences = append(sentences, current.String())
+			current.Reset()
+		}
+	}
+	sentences = append(sentences, current.String())
+
+	var claims []CheckedClaim
+	previous := ""
+	for _, sentence := range sentences {
+		var passages []int
+		for _, m := range citationMarker.FindAllStringSubmatch(sentence, -1) {
+			for _, n := range strings.FieldsFunc(m[1], func(r rune) bool { return !unicode.IsDigit(r) }) {
+				if p, err := strconv.Atoi(n); err == nil {
+					passages = append(passages, p)
+				}
+			}
+		}
+		text := strings.TrimSpace(citationMarker.ReplaceAllString(sentence, ""))
+		if strings.TrimFunc(text, func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSpace(r) }) == "" {
+			// Citations alone belong to the sentence before them
+			if len(passages) == 0 || previous == "" {
+				continue
+			}
+			if n := len(claims); n > 0 && claims[n-1].Sentence == previous {
+				claims[n-1].Passages = append(claims[n-1].Passages, passages...)
+			} else {
+				claims = append(claims, CheckedClaim{Sentence: previous, Passages: passages})
+			}
+			continue
+		}
+		previous = text
+		if len(passages) > 0 {
+			claims = append(claims, CheckedClaim{Sentence: text, Passages: passages})
+		}
+	}
+	return claims
+}
+
+// citationCheckSchema is the shape verdicts are generated in
+var citationCheckSchema = &OutputSchema{Name: "citation_check", Schema: objectSchema(map[string]*jsonSchema{
+	"verdicts": arraySchema(objectSchema(map[string]*jsonSchema{
+		"claim":   {Type: "integer", Description: "the number of the sentence"},
+		"verdict": {Type: "string", Enum: []string{CitationSupported, CitationPartial, CitationUnsupported}},
+		"reason":  stringSchema("one sentence on why"),
+	})),
+})}
+
+func citationCheckPrompt(claims []CheckedClaim, docs []schema.Document, language string) string {
+	var b strings.Builder
+	b.WriteString("你是一个严格的事实核查员。下面是一个回答中的若干句子，每句后面列出了它引用的来源段落。请逐句判断所引用的段落是否支持这句话：supported 表示段落明确支持句中的全部说法；partial 表示只支持其中一部分，或需要段落之外的推断；unsupported 表示段落没有提到或与之矛盾。只根据给出的段落判断，不要使用常识。reason 用一句话说明理由。每句输出一项，claim 为句子的编号。\n")
+	for i, claim := range claims {
+		fmt.Fprintf(&b, "\n## 句子 %d\n%s\n", i+1, claim.Sentence)
+		for _, p := range claim.Passages {
+			text := docs[p-1].PageContent
+			if runes := []rune(text); len(runes) > maxCheckedPassage {
+				text = string(runes[:maxCheckedPassage]) + "…"
+			}
+			fmt.Fprintf(&b, "\n[来源 %d]\n%s\n", p, text)
+		}
+	}
+	if language != "" {
+		b.WriteString(languageInstruction(language))
+	} else {
+		b.WriteString("\n**注意：reason 请使用中文。**")
+	}
+	return b.String()
+}
+
+// checkCitations has the LLM judge whether the retrieved passages each
+// sentence of an answer cites support it. Citations of passages that were
+// not retrieved are unsupported without asking.
+func (a *Agent) checkCitations(ctx context.Context, answer string, docs []schema.Document, language string) (*CitationCheck, error) {
+	check := &CitationCheck{Claims: []CheckedClaim{}}
+	var judged []CheckedClaim
+	var judgedAt []int
+	for _, claim := range citedSentences(answer) {
+		if len(check.Claims) == maxCheckedClaims {
+			break
+		}
+		claim.SourceIDs = []string{}
+		valid := true
+		for _, p := range claim.Passages {
+			if p < 1 || p > len(docs) {
+				valid = false
+				continue
+			}
+			if id, ok := docs[p-1].Metadata["source_id"].(string); ok && !slices.Contains(claim.SourceIDs, id) {
+				claim.SourceIDs = append(claim.SourceIDs, id)
+			}
+		}
+		if !valid {
+			claim.Verdict = CitationUnsupported
+			claim.Reason = "cites a passage that was not retrieved"
+		} else {
+			judged = append(judged, claim)
+			judgedAt = append(judgedAt, len(check.Claims))
+		}
+		check.Claims = append(check.Claims, claim)
+	}
+
+	if len(judged) > 0 {
+		var out struct {
+			Verdicts []struct {
+				Claim   int    `json:"claim"`
+				Verdict string `json:"verdict"`
+				Reason  string `json:"reason"`
+			} `json:"verdicts"`
+		}
+		if _, _, _, err := a.generateJSON(ctx, citationCheckSchema, citationCheckPrompt(judged, docs, language), &out); err != nil {
+			return nil, err
+		}
+		for _, v := range out.Verdicts {
+			if v.Claim >= 1 && v.Claim <= len(judged) {
+				claim := &check.Claims[judgedAt[v.Claim-1]]
+				claim.Verdict, claim.Reason = v.Verdict, strings.TrimSpace(v.Reason)
+			}
+		}
+	}
+
+	// Sentences the judge skipped are left unchecked
+	kept := check.Claims[:0]
+	for _, claim := range check.Claims {
+		switch claim.Verdict {
+		case "":
+			continue
+		case CitationUnsupported:
+			check.Unsupported++
+		case CitationPartial:
+			check.Partial++
+		}
+		kept = append(kept, claim)
+	}
+	check.Claims = kept
+	check.Checked = len(kept)
+	return check, nil
+}
+
+// verifyAnswer checks an answer's citations into its metadata. A failed
+// check is logged and leaves the answer unchecked.
+func (a *Agent) verifyAnswer(ctx context.Context, response *ChatResponse, docs []schema.Document, language string) {
+	check, err := a.checkCitations(ctx, response.Message, docs, language)
+	if err != nil {
+		golog.Warnf("failed to verify the citations of an answer: %v", err)
+		return
+	}
+	response.Metadata["citation_check"] = check
+}
@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// maxClipSize bounds the clip payload, which includes a base64 screenshot
+const maxClipSize = 25 << 20
+
+// ClipRequest is the payload sent by the browser extension
+type ClipRequest struct {
+	NotebookID string                 `json:"notebook_id" binding:"required,uuid"`
+	URL        string                 `json:"url" binding:"required,url"`
+	Title      string                 `json:"title" binding:"max=200"`
+	HTML       string                 `json:"html"`       // Selected HTML, empty to clip the whole page
+	Text       string                 `json:"text"`       // Plain-text selection, used when HTML is empty
+	Screenshot string                 `json:"screenshot"` // Base64 PNG/JPEG, optionally as a data URL
+	Metadata   map[string]interface{} `json:"metadata" binding:"metadata"`
+}
+
+// ClipResponse returns the IDs created for a clip
+type ClipResponse struct {
+	SourceID      string `json:"source_id"`
+	NotebookID    string `json:"notebook_id"`
+	AttachmentID  string `json:"attachment_id,omitempty"`
+	AttachmentURL string `json:"attachment_url,omitempty"`
+	ChunkCount    int    `json:"chunk_count"`
+}
+
+func (s *Server) handleClip(c *gin.Context) {
+	ctx := context.Background()
+
+	var req ClipRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	pageURL, err := url.Parse(req.URL)
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") {
+		validationResponse(c, invalidField("url", "must be an absolute http(s) URL"))
+		return
+	}
+
+	if _, err := s.store.GetNotebook(ctx, req.NotebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	// Prefer the selection sent by the extension; fall back to fetching the page
+	content := ""
+	switch {
+	case strings.TrimSpace(req.HTML) != "":
+		content = htmlToText(req.HTML)
+	case strings.TrimSpace(req.Text) != "":
+		content = strings.TrimSpace(req.Text)
+	default:
+		content, err = s.vectorStore.ExtractFromURL(ctx, req.URL)
+		if err != nil {
+			golog.Errorf("failed to fetch clipped page: %v", err)
+			c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Failed to fetch URL content: %v", err)})
+			return
+		}
+	}
+
+	if content == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Clip has no readable content"})
+		return
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = pageURL.Host + pageURL.Path
+	}
+
+	metadata := req.Metadata
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["clipped_at"] = time.Now()
+	metadata["clip_selection"] = req.HTML != "" || req.Text != ""
+
+	source := &Source{
+		NotebookID: req.NotebookID,
+		Name:       title,
+		Type:       "clip",
+		URL:        req.URL,
+		Content:    content,
+		Metadata:   metadata,
+	}
+
+	if err := s.ingestSource(ctx, source); err != nil {
+		golog.Errorf("failed to create clip source: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create source"})
+		return
+	}
+
+	resp := ClipResponse{
+		SourceID:   source.ID,
+		NotebookID: source.NotebookID,
+		ChunkCount: source.ChunkCount,
+	}
+
+	if req.Screenshot != "" {
+		att, err := s.saveClipScreenshot(ctx, source, req.Screenshot)
+		if err != nil {
+			// The text clip is already saved, so report the screenshot failure without failing the request
+			golog.Errorf("failed to save clip screenshot: %v", err)
+		} else {
+			resp.AttachmentID = att.ID
+			resp.AttachmentURL = att.URL
+		}
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// saveClipScreenshot decodes a base64 image (raw or data URL) and stores it as an attachment of the source
+func (s *Server) saveClipScreenshot(ctx context.Context, source *Source, encoded string) (*Attachment, error) {
+	data, contentType, err := decodeImageData(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkStorageQuota(ctx, source.NotebookID, int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	uniqueName, path, size, err := saveUploadData("clip"+imageExtensions[contentType], bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	att := &Attachment{
+		NotebookID:  source.NotebookID,
+		SourceID:    source.ID,
+		FileName:    uniqueName,
+		ContentType: contentType,
+		FileSize:    size,
+		Path:        path,
+		Metadata:    map[string]interface{}{"kind": "clip_screenshot", "url": source.URL},
+	}
+	s.thumbnailAttachment(ctx, att)
+	if err := s.store.CreateAttachment(ctx, att); err != nil {
+		return nil, err
+	}
+
+	return att, nil
+}
+
+// imageExtensions are the image types accepted inline, by file extension
+var imageExtensions = map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/webp": ".webp"}
+
+// decodeImageData decodes a base64 image, optionally given as a data URL,
+// and returns it with its content type
+func decodeImageData(encoded string) ([]byte, string, error) {
+	contentType := "image/png"
+	if strings.HasPrefix(encoded, "data:") {
+		comma := strings.Index(encoded, ",")
+		if comma < 0 {
+			return nil, "", fmt.Errorf("malformed data URL")
+		}
+		header := encoded[5:comma]
+		if semi := strings.Index(header, ";"); semi >= 0 {
+			header = header[:semi]
+		}
+		if header != "" {
+			contentType = header
+		}
+		encoded = encoded[comma+1:]
+	}
+
+	if _, ok := imageExtensions[contentType]; !ok {
+		return nil, "", fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid base64 image: %w", err)
+	}
+	return data, contentType, nil
+}
@@ -0,0 +1,489 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxCommentLength bounds a comment's body in bytes
+const maxCommentLength = 10000
+
+// mentionPattern finds @mentions: an email address, its local part, or a
+// name written without spaces
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.+-]+(?:@[\w-]+(?:\.[\w-]+)+)?)`)
+
+// CommentAnchor pins a comment to a quote from the note. Start is where the
+// quote was last found; Detached is set once the note no longer contains it.
+type CommentAnchor struct {
+	Quote    string `json:"quote"`
+	Start    int    `json:"start"`
+	Detached bool   `json:"detached,omitempty"`
+}
+
+// Comment is a remark on a note, either starting a thread or replying in one.
+// Only thread roots carry an anchor and can be resolved.
+type Comment struct {
+	ID         string         `json:"id"`
+	NoteID     string         `json:"note_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	AuthorID   string         `json:"author_id,omitempty"` // "" when auth is off
+	AuthorName string         `json:"author_name,omitempty"`
+	Body       string         `json:"body"`
+	Anchor     *CommentAnchor `json:"anchor,omitempty"`
+	Mentions   []string       `json:"mentions"` // IDs of the mentioned users
+	ResolvedAt *time.Time     `json:"resolved_at,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	Replies    []Comment      `json:"replies,omitempty"`
+}
+
+const commentColumns = `id, note_id, parent_id, author_id, author_name, body, anchor_quote, anchor_start, mentions, resolved_at, created_at, updated_at`
+
+func scanComment(row rowScanner) (*Comment, error) {
+	var cm Comment
+	var parentID sql.NullString
+	var quote, mentionsJSON string
+	var start int
+	var resolvedAt sql.NullInt64
+	var createdAt, updatedAt int64
+
+	if err := row.Scan(&cm.ID, &cm.NoteID, &parentID, &cm.AuthorID, &cm.AuthorName, &cm.Body,
+		&quote, &start, &mentionsJSON, &resolvedAt, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	cm.ParentID = parentID.String
+	if quote != "" {
+		cm.Anchor = &CommentAnchor{Quote: quote, Start: start}
+	}
+	json.Unmarshal([]byte(mentionsJSON), &cm.Mentions)
+	if cm.Mentions == nil {
+		cm.Mentions = []string{}
+	}
+	if resolvedAt.Valid {
+		t := time.Unix(resolvedAt.Int64, 0)
+		cm.ResolvedAt = &t
+	}
+	cm.CreatedAt = time.Unix(createdAt, 0)
+	cm.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &cm, nil
+}
+
+// Comment operations
+
+// CreateComment stores a new comment or reply
+func (s *Store) CreateComment(ctx context.Context, cm *Comment) error {
+	cm.ID = uuid.New().String()
+	now := time.Now()
+	cm.CreatedAt = now
+	cm.UpdatedAt = now
+
+	var parentID interface{}
+	if cm.ParentID != "" {
+		parentID = cm.ParentID
+	}
+	quote, start := "", 0
+	if cm.Anchor != nil {
+		quote, start = cm.Anchor.Quote, cm.Anchor.Start
+	}
+	mentionsJSON, _ := json.Marshal(cm.Mentions)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO note_comments (`+commentColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, ?, ?)
+	`, cm.ID, cm.NoteID, parentID, cm.AuthorID, cm.AuthorName, cm.Body, quote, start, string(mentionsJSON), now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetComment retrieves a comment by ID
+func (s *Store) GetComment(ctx context.Context, id string) (*Comment, error) {
+	cm, err := scanComment(s.db.QueryRowContext(ctx, `SELECT `+commentColumns+` FROM note_comments WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("comment")
+	}
+	return cm, err
+}
+
+// ListComments retrieves a note's comments and replies, oldest first
+func (s *Store) ListComments(ctx context.Context, noteID string) ([]Comment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+commentColumns+` FROM note_comments WHERE note_id = ? ORDER BY created_at, id
+	`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]Comment, 0)
+	for rows.Next() {
+		cm, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, *cm)
+	}
+
+	return comments, rows.Err()
+}
+
+// UpdateComment saves a comment's body, mentions and resolution
+func (s *Store) UpdateComment(ctx context.Context, cm *Comment) error {
+	cm.UpdatedAt = time.Now()
+
+	var resolvedAt interface{}
+	if cm.ResolvedAt != nil {
+		resolvedAt = cm.ResolvedAt.Unix()
+	}
+	mentionsJSON, _ := json.Marshal(cm.Mentions)
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE note_comments SET body = ?, mentions = ?, resolved_at = ?, updated_at = ? WHERE id = ?
+	`, cm.Body, string(mentionsJSON), resolvedAt, cm.UpdatedAt.Unix(), cm.ID)
+
+	return err
+}
+
+// DeleteComment deletes a comment and, for a thread root, its replies
+func (s *Store) DeleteComment(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM note_comments WHERE id = ?`, id)
+	return err
+}
+
+// locateAnchor finds an anchor's quote in the note's current content,
+// preferring the place it was last seen
+func locateAnchor(content string, anchor *CommentAnchor) {
+	if anchor.Start >= 0 && anchor.Start+len(anchor.Quote) <= len(content) &&
+		content[anchor.Start:anchor.Start+len(anchor.Quote)] == anchor.Quote {
+		anchor.Detached = false
+		return
+	}
+	if i := strings.Index(content, anchor.Quote); i >= 0 {
+		anchor.Start, anchor.Detached = i, false
+		return
+	}
+	anchor.Detached = true
+}
+
+// commentThreads nests replies under their thread roots and re-locates the
+// roots' anchors in the note
+func commentThreads(note *Note, comments []Comment) []Comment {
+	index := map[string]int{}
+	threads := make([]Comment, 0)
+	for _, cm := range comments {
+		if cm.ParentID == "" {
+			if cm.Anchor != nil {
+				locateAnchor(note.Content, cm.Anchor)
+			}
+			index[cm.ID] = len(threads)
+			threads = append(threads, cm)
+		}
+	}
+	for _, cm := range comments {
+		if i, ok := index[cm.ParentID]; ok {
+			threads[i].Replies = append(threads[i].Replies, cm)
+		}
+	}
+	return threads
+}
+
+// parseMentions finds the workspace members a comment @mentions. A mention
+// matches a member's email, the part before the @, or their name without
+// spaces, ignoring case.
+func parseMentions(body string, members []WorkspaceMember) []string {
+	mentioned := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		handle := strings.ToLower(strings.TrimRight(m[1], ".-"))
+		for _, member := range members {
+			email := strings.ToLower(member.Email)
+			local, _, _ := strings.Cut(email, "@")
+			name := strings.ToLower(strings.Join(strings.Fields(member.Name), ""))
+			if (handle == email || handle == local || (name != "" && handle == name)) && !seen[member.UserID] {
+				seen[member.UserID] = true
+				mentioned = append(mentioned, member.UserID)
+			}
+		}
+	}
+	return mentioned
+}
+
+// Server helpers
+
+// noteComment loads :commentId and checks it belongs to the note
+func (s *Server) noteComment(c *gin.Context, note *Note) (*Comment, bool) {
+	cm, err := s.store.GetComment(c.Request.Context(), c.Param("commentId"))
+	if err != nil || cm.NoteID != note.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Comment not found"})
+		return nil, false
+	}
+	return cm, true
+}
+
+// commentEvent is the payload of comment events
+func commentEvent(note *Note, cm *Comment) gin.H {
+	return gin.H{"notebook_id": note.NotebookID, "note_id": note.ID, "comment": cm}
+}
+
+// notifyComment tells the note's workspace about a new comment: every
+// client gets a comment.created event, and members other than the author a
+// notification, which for those it mentions is a mention. Workspaces without
+// members are open to every caller, so their comments go to every client.
+func (s *Server) notifyComment(ctx context.Context, note *Note, cm *Comment, members []WorkspaceMember) {
+	ev := Event{Type: "comment.created", Data: commentEvent(note, cm)}
+	if len(members) == 0 {
+		s.events.publishAll(ev)
+	}
+	for _, m := range members {
+		s.events.publishUser(m.UserID, ev)
+	}
+
+	mentioned := map[string]bool{}
+	for _, id := range cm.Mentions {
+		mentioned[id] = true
+	}
+	var others []string
+	for _, m := range members {
+		if !mentioned[m.UserID] && m.UserID != cm.AuthorID {
+			others = append(others, m.UserID)
+		}
+	}
+	s.notifyMentions(ctx, note, cm, cm.Mentions)
+	s.notify(ctx, others, Notification{
+		Kind:  NotificationComment,
+		Title: fmt.Sprintf("%s commented on %q", commentAuthor(cm), note.Title),
+		Body:  cm.Body,
+		Link:  commentLink(note),
+		Data:  commentEvent(note, cm),
+	})
+}
+
+// notifyMentions notifies users that a comment mentions them. Authors aren't
+// told about mentioning themselves.
+func (s *Server) notifyMentions(ctx context.Context, note *Note, cm *Comment, userIDs []string) {
+	var recipients []string
+	for _, id := range userIDs {
+		if id != cm.AuthorID {
+			recipients = append(recipients, id)
+		}
+	}
+	s.notify(ctx, recipients, Notification{
+		Kind:  NotificationMention,
+		Title: fmt.Sprintf("%s mentioned you on %q", commentAuthor(cm), note.Title),
+		Body:  cm.Body,
+		Link:  commentLink(note),
+		Data:  commentEvent(note, cm),
+	})
+}
+
+// commentAuthor names a comment's author in notifications
+func commentAuthor(cm *Comment) string {
+	if cm.AuthorName == "" {
+		return "Someone"
+	}
+	return cm.AuthorName
+}
+
+// commentLink is the API path of a note's comments
+func commentLink(note *Note) string {
+	return "/api/notes/" + note.ID + "/comments"
+}
+
+// Comment handlers
+
+// handleListComments lists a note's comment threads, replies nested
+func (s *Server) handleListComments(c *gin.Context) {
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	comments, err := s.store.ListComments(c.Request.Context(), note.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list comments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, commentThreads(note, comments))
+}
+
+// handleCreateComment starts a thread, optionally anchored to a quote from
+// the note, or replies in one. Replying to a reply answers its thread.
+func (s *Server) handleCreateComment(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Body     string         `json:"body" binding:"required"`
+		ParentID string         `json:"parent_id" binding:"omitempty,uuid"`
+		Anchor   *CommentAnchor `json:"anchor"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+
+	var fields fieldErrors
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" || len(req.Body) > maxCommentLength {
+		fields.add("body", "must be 1 to %d characters", maxCommentLength)
+	}
+	if req.Anchor != nil {
+		if req.ParentID != "" {
+			fields.add("anchor", "replies can't be anchored")
+		} else if req.Anchor.Quote == "" {
+			fields.add("anchor.quote", "is required")
+		} else if locateAnchor(note.Content, req.Anchor); req.Anchor.Detached {
+			fields.add("anchor.quote", "is not in the note")
+		}
+	}
+	if validationResponse(c, fields.err()) {
+		return
+	}
+
+	cm := &Comment{NoteID: note.ID, Body: req.Body, Anchor: req.Anchor}
+	if req.ParentID != "" {
+		parent, err := s.store.GetComment(ctx, req.ParentID)
+		if err != nil || parent.NoteID != note.ID {
+			validationResponse(c, invalidField("parent_id", "is not a comment on this note"))
+			return
+		}
+		cm.ParentID = parent.ID
+		if parent.ParentID != "" {
+			cm.ParentID = parent.ParentID
+		}
+	}
+	if user := currentUser(c); user != nil {
+		cm.AuthorID, cm.AuthorName = user.ID, user.Name
+		if cm.AuthorName == "" {
+			cm.AuthorName = user.Email
+		}
+	}
+
+	members, err := s.store.ListWorkspaceMembers(ctx, currentWorkspace(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load workspace members"})
+		return
+	}
+	cm.Mentions = parseMentions(cm.Body, members)
+
+	if err := s.store.CreateComment(ctx, cm); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create comment"})
+		return
+	}
+	s.notifyComment(ctx, note, cm, members)
+
+	c.JSON(http.StatusCreated, cm)
+}
+
+// handleUpdateComment edits a comment's body, which only its author may do,
+// or resolves and reopens a thread. Users newly mentioned by an edit are
+// notified.
+func (s *Server) handleUpdateComment(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Body     *string `json:"body"`
+		Resolved *bool   `json:"resolved"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	cm, ok := s.noteComment(c, note)
+	if !ok {
+		return
+	}
+
+	var fields fieldErrors
+	if req.Body != nil {
+		if user := currentUser(c); cm.AuthorID != "" && (user == nil || user.ID != cm.AuthorID) {
+			c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Only the author can edit a comment"})
+			return
+		}
+		if body := strings.TrimSpace(*req.Body); body == "" || len(body) > maxCommentLength {
+			fields.add("body", "must be 1 to %d characters", maxCommentLength)
+		} else {
+			cm.Body = body
+		}
+	}
+	if req.Resolved != nil && cm.ParentID != "" {
+		fields.add("resolved", "only threads can be resolved, not replies")
+	}
+	if validationResponse(c, fields.err()) {
+		return
+	}
+
+	if req.Resolved != nil {
+		cm.ResolvedAt = nil
+		if *req.Resolved {
+			now := time.Now()
+			cm.ResolvedAt = &now
+		}
+	}
+
+	var added []string
+	if req.Body != nil {
+		members, err := s.store.ListWorkspaceMembers(ctx, currentWorkspace(c).ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load workspace members"})
+			return
+		}
+		before := map[string]bool{}
+		for _, id := range cm.Mentions {
+			before[id] = true
+		}
+		cm.Mentions = parseMentions(cm.Body, members)
+		for _, id := range cm.Mentions {
+			if !before[id] {
+				added = append(added, id)
+			}
+		}
+	}
+
+	if err := s.store.UpdateComment(ctx, cm); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update comment"})
+		return
+	}
+	s.notifyMentions(ctx, note, cm, added)
+
+	c.JSON(http.StatusOK, cm)
+}
+
+// handleDeleteComment deletes a comment, and a thread's replies with it. The
+// author and workspace owners may do so.
+func (s *Server) handleDeleteComment(c *gin.Context) {
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	cm, ok := s.noteComment(c, note)
+	if !ok {
+		return
+	}
+	user := currentUser(c)
+	if cm.AuthorID != "" && (user == nil || user.ID != cm.AuthorID) && currentWorkspace(c).Role != RoleOwner {
+		c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Only the author or a workspace owner can delete a comment"})
+		return
+	}
+
+	if err := s.store.DeleteComment(c.Request.Context(), cm.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete comment"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package backend
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// compressMinSize is the smallest response worth compressing; smaller ones
+// are sent as is
+const compressMinSize = 1024
+
+// incompressibleTypes are content type prefixes that are already compressed
+var incompressibleTypes = []string{
+	"image/", "audio/", "video/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/pdf", "application/octet-stream",
+}
+
+// Content codings the server compresses with, in order of preference
+// when a client accepts both equally
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+var serverEncodings = []string{encodingBrotli, encodingGzip}
+
+// compressor is a pooled brotli or gzip stream
+type compressor interface {
+	io.Writer
+	Reset(io.Writer)
+	Flush() error
+	Close() error
+}
+
+var compressors = map[string]*sync.Pool{
+	encodingBrotli: {New: func() any { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }},
+	encodingGzip: {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+}
+
+// CompressionMiddleware compresses responses with brotli or gzip, whichever
+// the client prefers of those it accepts. Small responses, range requests
+// and content that is already compressed pass through unchanged. Streamed
+// responses stay streamed: each flush sends what has been compressed so far.
+func CompressionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressResponseWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = w
+		c.Header("Vary", "Accept-Encoding")
+		defer w.finish()
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks the coding to compress with from an
+// Accept-Encoding header: the one of serverEncodings with the highest
+// quality, brotli on a tie, or "" when the client accepts neither
+func negotiateEncoding(header string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range serverEncodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressResponseWriter holds back the start of a response until it knows
+// whether compressing is worthwhile, then either compresses or passes through
+type compressResponseWriter struct {
+	gin.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	cw       compressor
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.decide(false)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < compressMinSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Status reports the status the handler set even while it is held back
+func (w *compressResponseWriter) Status() int {
+	if !w.decided && w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *compressResponseWriter) Written() bool {
+	return w.decided || len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+func (w *compressResponseWriter) Size() int {
+	if !w.decided {
+		return len(w.buf)
+	}
+	return w.ResponseWriter.Size()
+}
+
+// Flush sends everything written so far, starting compression if the
+// response is large enough or long-lived enough to be flushed
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) > 0)
+	}
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.Hijack()
+}
+
+// decide sends the held-back status and bytes, compressed when the response
+// qualifies and compress is true
+func (w *compressResponseWriter) decide(compress bool) error {
+	w.decided = true
+	header := w.Header()
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if compress && w.compressible(status) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The compressed bytes differ, so the tag can only be weak
+			header.Set("ETag", "W/"+etag)
+		}
+		w.cw = compressors[w.encoding].Get().(compressor)
+		w.cw.Reset(w.ResponseWriter)
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.cw != nil {
+		_, err = w.cw.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressResponseWriter) compressible(status int) bool {
+	header := w.Header()
+	if status < 200 || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf)
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// finish sends a response that stayed below the size threshold and closes
+// the compressed stream
+func (w *compressResponseWriter) finish() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.cw != nil {
+		w.cw.Close()
+		compressors[w.encoding].Put(w.cw)
+		w.cw = nil
+	}
+}
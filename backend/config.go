@@ -1,60 +1,389 @@
 package backend
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
+	"github.com/kataras/golog"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 )
 
-// Config holds the application configuration
+// Config holds the application configuration.
+//
+// Every field is named by its env tag. Values are resolved in this order, each
+// overriding the previous: the default tag, the config file (YAML or TOML, keys
+// are the lowercased env names, optionally grouped in sections such as
+// server: {port: 8080}), environment variables (including .env files) and
+// command-line overrides. Fields tagged secret are redacted in /api/admin/config;
+// fields tagged reload:"hot" are applied without a restart when the file changes.
 type Config struct {
 	// Server settings
-	ServerHost string
-	ServerPort string
+	ServerHost string `env:"SERVER_HOST" default:"0.0.0.0"`
+	ServerPort string `env:"SERVER_PORT" default:"8080"`
+	// When set, every request must carry this token and come to localhost;
+	// -desktop generates one
+	DesktopToken string `env:"DESKTOP_TOKEN" secret:"true"`
+	// Behind a reverse proxy: the path prefix the server is reached under,
+	// such as /notex, and the proxies (comma-separated IPs and CIDR ranges)
+	// whose X-Forwarded-* headers are believed for client IPs and URLs
+	BasePath       string `env:"BASE_PATH"`
+	TrustedProxies string `env:"TRUSTED_PROXIES" default:"127.0.0.1,::1"`
+	// URL users reach the server at, base path included, for links in
+	// emails and webhooks, which are sent outside a request
+	PublicURL string `env:"PUBLIC_URL"`
+	// Browser pages on other origins allowed to call the API (comma
+	// separated, or * for any), whether they may send cookies, and how many
+	// seconds browsers may cache a preflight
+	CORSAllowedOrigins   string `env:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowCredentials bool   `env:"CORS_ALLOW_CREDENTIALS" default:"false"`
+	CORSMaxAge           int    `env:"CORS_MAX_AGE" default:"600"`
+	// Refuse changes from pages on other origins, and require the
+	// X-CSRF-Token header to match the notex_csrf cookie on changes signed in
+	// with a cookie
+	CSRFProtection bool `env:"CSRF_PROTECTION" default:"true"`
+	// Seconds to wait for in-flight requests and jobs on shutdown
+	ShutdownTimeout int `env:"SHUTDOWN_TIMEOUT" default:"30"`
+	// Seconds an operation may run before it is stopped, 0 for no limit: LLM
+	// generations, fetching and extracting sources, and retrieval searches
+	LLMTimeout    int `env:"LLM_TIMEOUT" default:"300"`
+	IngestTimeout int `env:"INGEST_TIMEOUT" default:"600"`
+	QueryTimeout  int `env:"QUERY_TIMEOUT" default:"30"`
+
+	// Logging ("debug", "info", "warn", "error" or "disable")
+	LogLevel string `env:"LOG_LEVEL" default:"info" reload:"hot"`
+	// Serve Go runtime profiles at /api/admin/debug/pprof
+	EnablePprof bool `env:"ENABLE_PPROF" default:"false"`
+
+	// API rate limit per client IP (0 disables); burst defaults to the per-minute limit
+	RateLimitPerMinute int `env:"RATE_LIMIT_PER_MINUTE" default:"0" reload:"hot"`
+	RateLimitBurst     int `env:"RATE_LIMIT_BURST" default:"0" reload:"hot"`
+	// Chats answered at once (0 for no limit); more wait in a queue of up to
+	// CHAT_QUEUE_SIZE, served in turn between users
+	ChatConcurrency int `env:"CHAT_CONCURRENCY" default:"8"`
+	ChatQueueSize   int `env:"CHAT_QUEUE_SIZE" default:"100"`
+
+	// Largest accepted upload or source content in megabytes, 0 for unlimited
+	MaxUploadSizeMB int `env:"MAX_UPLOAD_SIZE_MB" default:"100"`
+	// Largest accepted body for other API requests in megabytes, 0 for unlimited
+	MaxRequestBodyMB int `env:"MAX_REQUEST_BODY_MB" default:"10"`
+	// Longest side of attachment thumbnails and PDF previews in pixels, 0 to disable
+	ThumbnailSize int `env:"THUMBNAIL_SIZE" default:"320"`
+	// Key for signed download links; generated and kept in ./data when empty.
+	// Changing it invalidates every link handed out.
+	DownloadSigningKey string `env:"DOWNLOAD_SIGNING_KEY" secret:"true"`
+	// Minutes a signed download link stays valid unless the request asks otherwise
+	DownloadURLMinutes int `env:"DOWNLOAD_URL_MINUTES" default:"60"`
+	// Hours a resumable upload may go without a chunk before it is removed
+	UploadSessionHours int `env:"UPLOAD_SESSION_HOURS" default:"24"`
+	// Malware scanning of uploads: a clamd address ("host:port" or
+	// "unix:/path"), or a command given the file path that exits 1 when
+	// it finds something. Flagged files are quarantined.
+	ScanClamAVAddr string `env:"SCAN_CLAMAV_ADDR" default:""`
+	ScanCommand    string `env:"SCAN_COMMAND" default:""`
+	// Compress responses with Brotli or gzip for clients that accept them
+	EnableCompression bool `env:"ENABLE_COMPRESSION" default:"true"`
+
+	// Storage quotas in megabytes, 0 for unlimited. Workspaces can set their own.
+	WorkspaceStorageQuotaMB int `env:"WORKSPACE_STORAGE_QUOTA_MB" default:"0"`
+	UserStorageQuotaMB      int `env:"USER_STORAGE_QUOTA_MB" default:"0"`
+
+	// Retention rules in days, 0 disables a rule. In dry-run mode scheduled
+	// runs only report what they would change.
+	RetentionArchiveIdleDays int  `env:"RETENTION_ARCHIVE_IDLE_DAYS" default:"0"`
+	RetentionChatDays        int  `env:"RETENTION_CHAT_DAYS" default:"0"`
+	RetentionTrashDays       int  `env:"RETENTION_TRASH_DAYS" default:"0"`
+	RetentionDryRun          bool `env:"RETENTION_DRY_RUN" default:"false"`
+
+	// Local-only mode: no outgoing connections except to localhost and the
+	// comma-separated hosts, IPs and CIDR ranges of LOCAL_ALLOWED_HOSTS.
+	// Configured cloud providers fail validation.
+	LocalOnly         bool   `env:"LOCAL_ONLY" default:"false"`
+	LocalAllowedHosts string `env:"LOCAL_ALLOWED_HOSTS"`
 
 	// LLM settings
-	OpenAIAPIKey      string
-	OpenAIBaseURL     string
-	OpenAIModel       string
-	EmbeddingModel    string
-	GoogleAPIKey      string
-	OllamaBaseURL     string
-	OllamaModel       string
+	OpenAIAPIKey   string `env:"OPENAI_API_KEY" secret:"true"`
+	OpenAIBaseURL  string `env:"OPENAI_BASE_URL"`
+	OpenAIModel    string `env:"OPENAI_MODEL" default:"gpt-4o-mini"`
+	EmbeddingModel string `env:"EMBEDDING_MODEL" default:"text-embedding-3-small"`
+	GoogleAPIKey   string `env:"GOOGLE_API_KEY" secret:"true"`
+	OllamaBaseURL  string `env:"OLLAMA_BASE_URL" default:"http://localhost:11434"`
+	OllamaModel    string `env:"OLLAMA_MODEL" default:"llama3.2"`
+	// Times an LLM call is retried when the provider answers 429 or 5xx,
+	// before failing over to the fallback provider when one is configured.
+	// The fallback is an OpenAI-compatible API, used when its model is set.
+	LLMMaxRetries      int    `env:"LLM_MAX_RETRIES" default:"2"`
+	LLMFallbackAPIKey  string `env:"LLM_FALLBACK_API_KEY" secret:"true"`
+	LLMFallbackBaseURL string `env:"LLM_FALLBACK_BASE_URL"`
+	LLMFallbackModel   string `env:"LLM_FALLBACK_MODEL"`
+	// Have OpenAI-compatible providers constrain structured output to its
+	// JSON schema. Turn off for providers without json_schema response
+	// formats; output is then only validated and repaired.
+	LLMNativeStructuredOutput bool `env:"LLM_NATIVE_STRUCTURED_OUTPUT" default:"true"`
+	// Have the LLM check that the passages each sentence of a chat answer
+	// cites support it, and flag those they do not in the message metadata
+	VerifyCitations bool `env:"VERIFY_CITATIONS" default:"false"`
+	// Save the LLM requests and responses behind each chat answer, with
+	// secrets and personal data masked, for /api/admin/llm-calls
+	LLMDebugLog bool `env:"LLM_DEBUG_LOG" default:"false"`
+
+	// Requests to the LLM, embedding, speech, transcription, image and
+	// moderation providers go through PROVIDER_PROXY when set (otherwise
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply) and also trust the
+	// certificates of the PEM file PROVIDER_CA_BUNDLE. PROVIDER_TIMEOUT is
+	// the seconds a call may take, 0 for each provider's default;
+	// PROVIDER_MAX_RETRIES applies to speech, transcription, image and
+	// moderation calls, and EMBEDDING_MAX_RETRIES to rate-limited embedding
+	// batches.
+	ProviderProxy       string `env:"PROVIDER_PROXY" secret:"true"`
+	ProviderCABundle    string `env:"PROVIDER_CA_BUNDLE"`
+	ProviderTimeout     int    `env:"PROVIDER_TIMEOUT" default:"0"`
+	ProviderMaxRetries  int    `env:"PROVIDER_MAX_RETRIES" default:"2"`
+	EmbeddingMaxRetries int    `env:"EMBEDDING_MAX_RETRIES" default:"5"`
+
+	// After PROVIDER_BREAKER_FAILURES failed calls in a row (0 turns this
+	// off) a provider's calls fail at once for PROVIDER_BREAKER_COOLDOWN
+	// seconds, after which a single call is let through to try it again
+	ProviderBreakerFailures int `env:"PROVIDER_BREAKER_FAILURES" default:"5"`
+	ProviderBreakerCooldown int `env:"PROVIDER_BREAKER_COOLDOWN" default:"30"`
+
+	// Mask personal data (REDACT_PII_KINDS: email, phone, name) in what is
+	// sent to the LLM and embedding providers, restoring it in the replies.
+	// Names are those after a title and those in REDACT_PII_NAMES.
+	RedactPII      bool   `env:"REDACT_PII" default:"false"`
+	RedactPIIKinds string `env:"REDACT_PII_KINDS" default:"email,phone,name"`
+	RedactPIINames string `env:"REDACT_PII_NAMES"`
+
+	// Embeddings for semantic retrieval. When disabled, retrieval matches keywords.
+	EnableEmbeddings     bool   `env:"ENABLE_EMBEDDINGS" default:"false"`
+	OllamaEmbeddingModel string `env:"OLLAMA_EMBEDDING_MODEL" default:"nomic-embed-text"`
+	EmbeddingBatchSize   int    `env:"EMBEDDING_BATCH_SIZE" default:"0"` // 0 uses the provider's default
+	EmbeddingConcurrency int    `env:"EMBEDDING_CONCURRENCY" default:"4"`
 
 	// Vector store settings
-	VectorStoreType    string // "memory", "supabase", "pgvector", "redis", "sqlite"
-	SupabaseURL        string
-	SupabaseKey        string
-	PostgreSQLURL      string
-	RedisURL           string
-	SQLitePath         string
+	VectorStoreType string `env:"VECTOR_STORE_TYPE" default:"sqlite"` // "memory", "supabase", "pgvector", "redis", "sqlite"
+	SupabaseURL     string `env:"SUPABASE_URL"`
+	SupabaseKey     string `env:"SUPABASE_KEY" secret:"true"`
+	PostgreSQLURL   string `env:"POSTGRES_URL"`
+	RedisURL        string `env:"REDIS_URL" default:"redis://localhost:6379"`
+	SQLitePath      string `env:"SQLITE_PATH" default:"./data/vector.db"`
+
+	// Vector index files, one per notebook; an empty directory keeps indexes in memory only
+	VectorIndexDir      string `env:"VECTOR_INDEX_DIR" default:"./data/index"`
+	MaxActiveNotebooks  int    `env:"MAX_ACTIVE_NOTEBOOKS" default:"0"`  // 0 keeps every used notebook loaded
+	NotebookIdleMinutes int    `env:"NOTEBOOK_IDLE_MINUTES" default:"0"` // 0 never unloads idle notebooks
+	// Vector storage: "none" (float32), "int8" or "pq" (product quantization
+	// with one byte per PQSubvectorDims dimensions)
+	VectorQuantization string `env:"VECTOR_QUANTIZATION" default:"none"`
+	PQSubvectorDims    int    `env:"PQ_SUBVECTOR_DIMS" default:"8"`
+	// Seconds search results are reused for repeated queries (0 disables)
+	RetrievalCacheSeconds int `env:"RETRIEVAL_CACHE_SECONDS" default:"600"`
 
 	// Store settings (for checkpoints)
-	StoreType          string // "memory", "sqlite", "postgres", "redis"
-	StorePath          string
+	StoreType string `env:"STORE_TYPE" default:"sqlite"` // "memory", "sqlite", "postgres", "redis"
+	StorePath string `env:"STORE_PATH" default:"./data/checkpoints.db"`
 
 	// Application settings
-	MaxSources         int
-	MaxContextLength   int
-	ChunkSize          int
-	ChunkOverlap       int
+	MaxSources       int `env:"MAX_SOURCES" default:"5"`
+	MaxContextLength int `env:"MAX_CONTEXT_LENGTH" default:"128000"`
+	ChunkSize        int `env:"CHUNK_SIZE" default:"1000"`
+	ChunkOverlap     int `env:"CHUNK_OVERLAP" default:"200"`
 
 	// Podcast generation
-	EnablePodcast      bool
-	PodcastVoice       string
+	EnablePodcast bool   `env:"ENABLE_PODCAST" default:"true"`
+	PodcastVoice  string `env:"PODCAST_VOICE" default:"alloy"`
+
+	// Entity extraction: people, organizations and projects mentioned in
+	// new sources and notes are indexed by the LLM
+	EnableEntities bool `env:"ENABLE_ENTITY_EXTRACTION" default:"false"`
+
+	// Images generated into notes: "gemini" (uses GOOGLE_API_KEY) or "openai"
+	// (uses the OpenAI settings). IMAGE_MODEL defaults to the provider's own.
+	ImageProvider string `env:"IMAGE_PROVIDER" default:"gemini"`
+	ImageModel    string `env:"IMAGE_MODEL"`
+
+	// Questions asked by voice are transcribed with an OpenAI-compatible
+	// audio API, by default the OpenAI settings'. With Ollama,
+	// TRANSCRIPTION_BASE_URL must name one.
+	TranscriptionModel   string `env:"TRANSCRIPTION_MODEL" default:"whisper-1"`
+	TranscriptionBaseURL string `env:"TRANSCRIPTION_BASE_URL"`
+	TranscriptionAPIKey  string `env:"TRANSCRIPTION_API_KEY" secret:"true"`
+
+	// Reading answers and notes aloud: "openai" uses the OpenAI settings and
+	// is off with Ollama. TTS_MODEL defaults to the provider's own.
+	TTSProvider string `env:"TTS_PROVIDER" default:"openai"`
+	TTSModel    string `env:"TTS_MODEL"`
+	TTSVoice    string `env:"TTS_VOICE" default:"alloy"`
+
+	// Moderation of chat messages and answers: "openai" (uses the OpenAI
+	// settings) or "keywords", which blocks MODERATION_BLOCKED_TERMS
+	// (comma-separated). Off when empty; workspaces can change the policy.
+	ModerationProvider     string `env:"MODERATION_PROVIDER"`
+	ModerationModel        string `env:"MODERATION_MODEL"`
+	ModerationBlockedTerms string `env:"MODERATION_BLOCKED_TERMS"`
 
 	// Document conversion
-	EnableMarkitdown   bool
+	EnableMarkitdown bool `env:"ENABLE_MARKITDOWN" default:"true"`
+
+	// Image understanding: a vision-capable model describes uploaded images
+	// and the figures on PDF pages, and the descriptions are indexed with the
+	// source's text. VISION_MODEL defaults to the chat model.
+	EnableVision   bool   `env:"ENABLE_VISION" default:"false"`
+	VisionModel    string `env:"VISION_MODEL"`
+	VisionMaxPages int    `env:"VISION_MAX_PAGES" default:"10"` // PDF pages with figures described per source
+
+	// Email ingestion
+	EmailIngestDomain  string `env:"EMAIL_INGEST_DOMAIN"`
+	EmailWebhookSecret string `env:"EMAIL_WEBHOOK_SECRET" secret:"true"`
+
+	// Telegram and Slack APIs chat bots post their answers to
+	TelegramAPIURL string `env:"TELEGRAM_API_URL" default:"https://api.telegram.org"`
+	SlackAPIURL    string `env:"SLACK_API_URL" default:"https://slack.com/api"`
+
+	// Directory of source processor plugins (*.json subprocess manifests, *.so Go plugins)
+	ProcessorPluginDir string `env:"PROCESSOR_PLUGIN_DIR"`
+
+	// Minutes between upstream checks of URL sources (0 disables)
+	SourceCheckInterval int `env:"SOURCE_CHECK_INTERVAL" default:"1440"`
+
+	// Minutes between regenerating the topics of changed notebooks (0 disables)
+	TopicInterval int `env:"TOPIC_INTERVAL" default:"60"`
+
+	// Schedules of background jobs replacing their defaults, as
+	// job=schedule pairs separated by semicolons; a schedule is a cron
+	// expression, "@every" a duration, or "off". Runs start up to JOB_JITTER
+	// seconds after they are due.
+	JobSchedules string `env:"JOB_SCHEDULES"`
+	JobJitter    int    `env:"JOB_JITTER" default:"30"`
+
+	// Attempts at delivering a webhook before giving up on it; attempts
+	// are spaced from 30 seconds, doubling up to an hour
+	WebhookMaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" default:"8"`
+
+	// Web search for chat ("searxng", "brave" or "bing")
+	WebSearchProvider   string `env:"WEB_SEARCH_PROVIDER"`
+	WebSearchURL        string `env:"WEB_SEARCH_URL"`
+	WebSearchAPIKey     string `env:"WEB_SEARCH_API_KEY" secret:"true"`
+	WebSearchResults    int    `env:"WEB_SEARCH_RESULTS" default:"3"`
+	WebSearchFetchPages bool   `env:"WEB_SEARCH_FETCH_PAGES" default:"true"`
+
+	// Push notifications to mobile apps. APNs signs in with an auth key
+	// (.p8 file), its key ID, the team ID and the app's bundle ID as topic;
+	// APNS_URL is https://api.sandbox.push.apple.com for development builds.
+	// FCM signs in with a service account key file.
+	APNSKeyFile        string `env:"APNS_KEY_FILE"`
+	APNSKeyID          string `env:"APNS_KEY_ID"`
+	APNSTeamID         string `env:"APNS_TEAM_ID"`
+	APNSTopic          string `env:"APNS_TOPIC"`
+	APNSURL            string `env:"APNS_URL" default:"https://api.push.apple.com"`
+	FCMCredentialsFile string `env:"FCM_CREDENTIALS_FILE"`
+	FCMURL             string `env:"FCM_URL" default:"https://fcm.googleapis.com"`
+
+	// Published notes: the title of the public pages and feed, and the
+	// theme notes are published with unless they choose one
+	PublishTitle string `env:"PUBLISH_TITLE" default:"Notex"`
+	PublishTheme string `env:"PUBLISH_THEME" default:"light"`
+
+	// HTTPS with certificates from an ACME CA such as Let's Encrypt, for
+	// ACME_DOMAINS (comma separated) and the workspaces' custom domains.
+	// HTTPS is served on HTTPS_PORT besides SERVER_PORT; ACME_HTTP_PORT,
+	// when set, answers HTTP-01 challenges and redirects to HTTPS.
+	ACMEEnabled      bool   `env:"ACME_ENABLED" default:"false"`
+	ACMEEmail        string `env:"ACME_EMAIL"`
+	ACMEDirectoryURL string `env:"ACME_DIRECTORY_URL" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	ACMEDomains      string `env:"ACME_DOMAINS"`
+	ACMECacheDir     string `env:"ACME_CACHE_DIR" default:"./data/acme"`
+	HTTPSPort        string `env:"HTTPS_PORT" default:"443"`
+	ACMEHTTPPort     string `env:"ACME_HTTP_PORT"`
+	// With a DNS provider (cloudflare or exec), certificates for
+	// ACME_DOMAINS, wildcards included, are issued with DNS-01 challenges
+	// instead, waiting ACME_DNS_WAIT seconds for the TXT record to spread.
+	// ACME_DNS_EXEC is a command run as "<command> present|cleanup <fqdn>
+	// <value>".
+	ACMEDNSProvider    string `env:"ACME_DNS_PROVIDER"`
+	ACMEDNSWait        int    `env:"ACME_DNS_WAIT" default:"60"`
+	ACMEDNSExec        string `env:"ACME_DNS_EXEC"`
+	CloudflareAPIToken string `env:"CLOUDFLARE_API_TOKEN" secret:"true"`
+	CloudflareAPIURL   string `env:"CLOUDFLARE_API_URL" default:"https://api.cloudflare.com/client/v4"`
+
+	// Outgoing email for notifications (disabled when SMTPHost is empty)
+	SMTPHost     string `env:"SMTP_HOST"`
+	SMTPPort     int    `env:"SMTP_PORT" default:"587"`
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	SMTPPassword string `env:"SMTP_PASSWORD" secret:"true"`
+	SMTPFrom     string `env:"SMTP_FROM"`
 
 	// Demo settings
-	AllowDelete                      bool
-	AllowMultipleNotesOfSameType     bool
+	AllowDelete                  bool `env:"ALLOW_DELETE" default:"true"`
+	AllowMultipleNotesOfSameType bool `env:"ALLOW_MULTIPLE_NOTES_OF_SAME_TYPE" default:"true"`
 
 	// LangSmith tracing (optional)
-	LangChainAPIKey    string
-	LangChainProject   string
+	LangChainAPIKey  string `env:"LANGCHAIN_API_KEY" secret:"true"`
+	LangChainProject string `env:"LANGCHAIN_PROJECT" default:"open-notebook"`
+
+	// How the configuration was loaded, for reloads and the debug endpoint
+	options ConfigOptions
+	sources map[string]string
+}
+
+// ConfigOptions controls where configuration is read from
+type ConfigOptions struct {
+	// File is the YAML or TOML config file. When empty, NOTEX_CONFIG is used,
+	// then the first of notex.yaml, notex.yml and notex.toml that exists.
+	File string
+	// Overrides are KEY=value settings from the command line
+	Overrides map[string]string
+}
+
+// Where a setting's value came from
+const (
+	configFromDefault = "default"
+	configFromFile    = "file"
+	configFromEnv     = "env"
+	configFromFlag    = "flag"
+)
+
+var defaultConfigFiles = []string{"notex.yaml", "notex.yml", "notex.toml"}
+
+// configField describes one settable Config field
+type configField struct {
+	Key     string // env name, e.g. SERVER_PORT
+	FileKey string // config file name, e.g. server_port
+	Index   int
+	Default string
+	Secret  bool
+	HotLoad bool
+}
+
+// configFields lists the Config fields in declaration order
+func configFields() []configField {
+	t := reflect.TypeOf(Config{})
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		fields = append(fields, configField{
+			Key:     key,
+			FileKey: strings.ToLower(key),
+			Index:   i,
+			Default: f.Tag.Get("default"),
+			Secret:  f.Tag.Get("secret") == "true",
+			HotLoad: f.Tag.Get("reload") == "hot",
+		})
+	}
+	return fields
 }
 
 // loadEnv loads .env file if it exists (ignoring errors if file not found)
@@ -66,40 +395,74 @@ func loadEnv() {
 	_ = godotenv.Load(".env.local")
 }
 
-// LoadConfig loads configuration from environment variables with defaults
+// LoadConfig loads configuration from the default config file and environment
+// variables. Invalid values are logged and left at their defaults; use
+// LoadConfigWithOptions to get them as errors.
 func LoadConfig() Config {
+	cfg, err := LoadConfigWithOptions(ConfigOptions{})
+	if err != nil {
+		golog.Errorf("configuration problems, using defaults for invalid values:\n%v", err)
+	}
+	return cfg
+}
+
+// LoadConfigWithOptions loads configuration from defaults, the config file,
+// environment variables and command-line overrides. It reports every problem
+// found, not just the first; invalid values are left at their defaults.
+func LoadConfigWithOptions(opts ConfigOptions) (Config, error) {
 	// Load .env file first (if exists)
 	loadEnv()
 
-	cfg := Config{
-		ServerHost:       getEnv("SERVER_HOST", "0.0.0.0"),
-		ServerPort:       getEnv("SERVER_PORT", "8080"),
-		OpenAIAPIKey:     getEnv("OPENAI_API_KEY", ""),
-		OpenAIBaseURL:    getEnv("OPENAI_BASE_URL", ""),
-		OpenAIModel:      getEnv("OPENAI_MODEL", "gpt-4o-mini"),
-		EmbeddingModel:   getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
-		GoogleAPIKey:     getEnv("GOOGLE_API_KEY", ""),
-		OllamaBaseURL:    getEnv("OLLAMA_BASE_URL", "http://localhost:11434"),
-		OllamaModel:      getEnv("OLLAMA_MODEL", "llama3.2"),
-		VectorStoreType:  getEnv("VECTOR_STORE_TYPE", "sqlite"),
-		SupabaseURL:      getEnv("SUPABASE_URL", ""),
-		SupabaseKey:      getEnv("SUPABASE_KEY", ""),
-		PostgreSQLURL:    getEnv("POSTGRES_URL", ""),
-		RedisURL:         getEnv("REDIS_URL", "redis://localhost:6379"),
-		SQLitePath:       getEnv("SQLITE_PATH", "./data/vector.db"),
-		StoreType:        getEnv("STORE_TYPE", "sqlite"),
-		StorePath:        getEnv("STORE_PATH", "./data/checkpoints.db"),
-		MaxSources:       getEnvInt("MAX_SOURCES", 5),
-		MaxContextLength: getEnvInt("MAX_CONTEXT_LENGTH", 128000),
-		ChunkSize:        getEnvInt("CHUNK_SIZE", 1000),
-		ChunkOverlap:     getEnvInt("CHUNK_OVERLAP", 200),
-		EnablePodcast:    getEnvBool("ENABLE_PODCAST", true),
-		PodcastVoice:     getEnv("PODCAST_VOICE", "alloy"),
-		EnableMarkitdown:           getEnvBool("ENABLE_MARKITDOWN", true),
-		AllowDelete:                getEnvBool("ALLOW_DELETE", true),
-		AllowMultipleNotesOfSameType: getEnvBool("ALLOW_MULTIPLE_NOTES_OF_SAME_TYPE", true),
-		LangChainAPIKey:  getEnv("LANGCHAIN_API_KEY", ""),
-		LangChainProject: getEnv("LANGCHAIN_PROJECT", "open-notebook"),
+	cfg := Config{options: opts, sources: make(map[string]string)}
+	v := reflect.ValueOf(&cfg).Elem()
+	fields := configFields()
+	var problems []error
+
+	set := func(f configField, raw, source string) {
+		if err := setConfigValue(v.Field(f.Index), raw); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v (from %s)", f.Key, err, source))
+			return
+		}
+		cfg.sources[f.Key] = source
+	}
+
+	for _, f := range fields {
+		set(f, f.Default, configFromDefault)
+	}
+
+	file, err := resolveConfigFile(opts.File)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			problems = append(problems, err)
+		}
+		for _, name := range sortedKeys(values) {
+			f, ok := findConfigField(fields, name)
+			if !ok {
+				problems = append(problems, unknownSettingError(name, file, fields))
+				continue
+			}
+			set(f, values[name], configFromFile+" "+file)
+		}
+	}
+	cfg.options.File = file
+
+	for _, f := range fields {
+		if value, ok := os.LookupEnv(f.Key); ok && value != "" {
+			set(f, value, configFromEnv)
+		}
+	}
+
+	for _, name := range sortedKeys(opts.Overrides) {
+		f, ok := findConfigField(fields, name)
+		if !ok {
+			problems = append(problems, unknownSettingError(name, "command line", fields))
+			continue
+		}
+		set(f, opts.Overrides[name], configFromFlag)
 	}
 
 	// Auto-detect provider from base URL or model name
@@ -109,28 +472,196 @@ func LoadConfig() Config {
 		}
 	}
 
-	return cfg
+	return cfg, errors.Join(problems...)
+}
+
+// findConfigField looks a setting up by env or file name
+func findConfigField(fields []configField, name string) (configField, bool) {
+	name = strings.ToLower(name)
+	for _, f := range fields {
+		if f.FileKey == name {
+			return f, true
+		}
+	}
+	return configField{}, false
 }
 
-// ValidateConfig validates the configuration
+// resolveConfigFile picks the config file to read, or "" when there is none
+func resolveConfigFile(path string) (string, error) {
+	if path == "" {
+		path = os.Getenv("NOTEX_CONFIG")
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("config file %s: %w", path, err)
+		}
+		return path, nil
+	}
+
+	for _, name := range defaultConfigFiles {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// readConfigFile parses a YAML or TOML file into flat lowercase keys
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	doc := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.NewDecoder(bytes.NewReader(data)).Decode(&doc)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flattenConfig("", doc, values)
+	return values, nil
+}
+
+// flattenConfig turns sections into underscore-joined keys: server: {port: 1} becomes server_port
+func flattenConfig(prefix string, doc map[string]any, out map[string]string) {
+	for k, v := range doc {
+		key := strings.ToLower(k)
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		switch val := v.(type) {
+		case map[string]any:
+			flattenConfig(key, val, out)
+		case nil:
+			out[key] = ""
+		default:
+			out[key] = fmt.Sprint(val)
+		}
+	}
+}
+
+func setConfigValue(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
+
+// unknownSettingError reports a misspelt name, suggesting the closest known one
+func unknownSettingError(name, where string, fields []configField) error {
+	best, bestDist := "", 3
+	for _, f := range fields {
+		if d := editDistance(strings.ToLower(name), f.FileKey); d < bestDist {
+			best, bestDist = f.FileKey, d
+			if strings.ToUpper(name) == name {
+				best = f.Key
+			}
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown setting %q in %s (did you mean %q?)", name, where, best)
+	}
+	return fmt.Errorf("unknown setting %q in %s", name, where)
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true, "fatal": true, "disable": true}
+
+// ValidateConfig validates the configuration, reporting every problem found
 func ValidateConfig(cfg Config) error {
-	// Check if at least one LLM provider is configured
+	return validateConfig(cfg, true)
+}
+
+// ValidateSetupConfig checks the configuration like ValidateConfig, except
+// that no LLM provider is needed yet: the server can start in setup mode and
+// configure one
+func ValidateSetupConfig(cfg Config) error {
+	return validateConfig(cfg, false)
+}
+
+// ErrNoProvider is reported when no LLM provider is configured
+var ErrNoProvider = errors.New("either OPENAI_API_KEY or OLLAMA_BASE_URL must be set")
+
+// ProviderConfigured reports whether cfg names an LLM provider to use
+func ProviderConfigured(cfg Config) bool {
 	hasOpenAI := cfg.OpenAIAPIKey != ""
 	hasOllama := cfg.OpenAIBaseURL != "" && contains(cfg.OpenAIBaseURL, "11434")
+	return hasOpenAI || hasOllama
+}
 
-	if !hasOpenAI && !hasOllama {
-		return fmt.Errorf("either OPENAI_API_KEY or OLLAMA_BASE_URL must be set")
+func validateConfig(cfg Config, requireProvider bool) error {
+	var problems []error
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	// Check if at least one LLM provider is configured
+	if requireProvider && !ProviderConfigured(cfg) {
+		problems = append(problems, ErrNoProvider)
 	}
 
 	// Validate vector store configuration
 	switch cfg.VectorStoreType {
 	case "supabase":
 		if cfg.SupabaseURL == "" || cfg.SupabaseKey == "" {
-			return fmt.Errorf("SUPABASE_URL and SUPABASE_KEY required for supabase vector store")
+			fail("SUPABASE_URL and SUPABASE_KEY required for supabase vector store")
 		}
 	case "pgvector", "postgres":
 		if cfg.PostgreSQLURL == "" {
-			return fmt.Errorf("POSTGRES_URL required for postgres vector store")
+			fail("POSTGRES_URL required for postgres vector store")
 		}
 	case "redis":
 		// Redis URL has default
@@ -139,38 +670,243 @@ func ValidateConfig(cfg Config) error {
 	case "memory":
 		// No validation needed
 	default:
-		return fmt.Errorf("unknown vector store type: %s", cfg.VectorStoreType)
+		fail("unknown vector store type: %s (use sqlite, memory, supabase, postgres or redis)", cfg.VectorStoreType)
 	}
 
-	return nil
+	if _, ok := imageProviders[cfg.ImageProvider]; !ok {
+		fail("IMAGE_PROVIDER must be one of %s, got %q", imageProviderNames(), cfg.ImageProvider)
+	}
+	if _, ok := ttsProviders[cfg.TTSProvider]; !ok {
+		fail("TTS_PROVIDER must be one of %s, got %q", ttsProviderNames(), cfg.TTSProvider)
+	}
+	if _, ok := moderationProviders[cfg.ModerationProvider]; cfg.ModerationProvider != "" && !ok {
+		fail("MODERATION_PROVIDER must be one of %s, got %q", moderationProviderNames(), cfg.ModerationProvider)
+	}
+	if cfg.ProviderProxy != "" {
+		if _, err := parseProviderProxy(cfg.ProviderProxy); err != nil {
+			fail("PROVIDER_PROXY: %v", err)
+		}
+	}
+	if cfg.ProviderCABundle != "" {
+		if _, err := providerCertPool(cfg.ProviderCABundle); err != nil {
+			fail("PROVIDER_CA_BUNDLE: %v", err)
+		}
+	}
+	if _, err := parseJobSchedules(cfg.JobSchedules); err != nil {
+		fail("JOB_SCHEDULES: %v", err)
+	}
+	for _, problem := range localOnlyProblems(cfg) {
+		fail("%s", problem)
+	}
+	for _, kind := range strings.Split(cfg.RedactPIIKinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" && piiPatterns[kind] == nil {
+			fail("REDACT_PII_KINDS may only name email, phone and name, got %q", kind)
+		}
+	}
+
+	switch cfg.VectorQuantization {
+	case quantizationNone, quantizationInt8, quantizationPQ:
+	default:
+		fail("VECTOR_QUANTIZATION must be one of none, int8 or pq, got %q", cfg.VectorQuantization)
+	}
+	if cfg.PQSubvectorDims <= 0 {
+		fail("PQ_SUBVECTOR_DIMS must be positive, got %d", cfg.PQSubvectorDims)
+	}
+	if cfg.WebhookMaxAttempts <= 0 {
+		fail("WEBHOOK_MAX_ATTEMPTS must be positive, got %d", cfg.WebhookMaxAttempts)
+	}
+	if cfg.APNSKeyFile != "" && (cfg.APNSKeyID == "" || cfg.APNSTeamID == "" || cfg.APNSTopic == "") {
+		fail("APNS_KEY_FILE needs APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC")
+	}
+	if _, ok := publishThemes[cfg.PublishTheme]; !ok {
+		fail("PUBLISH_THEME must be one of %s, got %q", publishThemeNames(), cfg.PublishTheme)
+	}
+	if cfg.ACMEEnabled {
+		if port, err := strconv.Atoi(cfg.HTTPSPort); err != nil || port < 1 || port > 65535 {
+			fail("HTTPS_PORT must be a port number between 1 and 65535, got %q", cfg.HTTPSPort)
+		}
+		if port, err := strconv.Atoi(cfg.ACMEHTTPPort); cfg.ACMEHTTPPort != "" && (err != nil || port < 1 || port > 65535) {
+			fail("ACME_HTTP_PORT must be a port number between 1 and 65535, got %q", cfg.ACMEHTTPPort)
+		}
+		for _, domain := range acmeDomains(cfg) {
+			if wildcard := strings.TrimPrefix(domain, "*."); wildcard != domain && cfg.ACMEDNSProvider != "" {
+				domain = wildcard
+			}
+			if !validDomain(domain) {
+				fail("ACME_DOMAINS may only hold domain names, and wildcards with ACME_DNS_PROVIDER, got %q", domain)
+			}
+		}
+		switch cfg.ACMEDNSProvider {
+		case "":
+		case dnsProviderCloudflare:
+			if cfg.CloudflareAPIToken == "" {
+				fail("ACME_DNS_PROVIDER=cloudflare needs CLOUDFLARE_API_TOKEN")
+			}
+		case dnsProviderExec:
+			if strings.TrimSpace(cfg.ACMEDNSExec) == "" {
+				fail("ACME_DNS_PROVIDER=exec needs ACME_DNS_EXEC")
+			}
+		default:
+			fail("ACME_DNS_PROVIDER must be cloudflare or exec, got %q", cfg.ACMEDNSProvider)
+		}
+		if cfg.ACMEDNSProvider != "" && len(acmeDomains(cfg)) == 0 {
+			fail("ACME_DNS_PROVIDER needs ACME_DOMAINS")
+		}
+		if cfg.ACMEDNSWait < 0 {
+			fail("ACME_DNS_WAIT must not be negative, got %d", cfg.ACMEDNSWait)
+		}
+	}
+
+	if port, err := strconv.Atoi(cfg.ServerPort); err != nil || port < 1 || port > 65535 {
+		fail("SERVER_PORT must be a port number between 1 and 65535, got %q", cfg.ServerPort)
+	}
+	if cfg.BasePath != "" && !basePathPattern.MatchString(cfg.BasePath) {
+		fail("BASE_PATH must be a URL path such as /notex, got %q", cfg.BasePath)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		fail("TRUSTED_PROXIES: %v", err)
+	}
+	if u, err := url.Parse(cfg.PublicURL); cfg.PublicURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		fail("PUBLIC_URL must be an http or https URL, got %q", cfg.PublicURL)
+	}
+	if policy, err := newCORSPolicy(cfg); err != nil {
+		fail("CORS_ALLOWED_ORIGINS: %v", err)
+	} else if policy.any && cfg.CORSAllowCredentials {
+		fail("CORS_ALLOW_CREDENTIALS needs CORS_ALLOWED_ORIGINS to list the origins, not *")
+	}
+	if !logLevels[strings.ToLower(cfg.LogLevel)] {
+		fail("LOG_LEVEL must be one of debug, info, warn, error or disable, got %q", cfg.LogLevel)
+	}
+	if cfg.ChunkSize <= 0 {
+		fail("CHUNK_SIZE must be positive, got %d", cfg.ChunkSize)
+	} else if cfg.ChunkOverlap < 0 || cfg.ChunkOverlap >= cfg.ChunkSize {
+		fail("CHUNK_OVERLAP must be at least 0 and less than CHUNK_SIZE (%d), got %d", cfg.ChunkSize, cfg.ChunkOverlap)
+	}
+	for key, value := range map[string]int{
+		"MAX_SOURCES":               cfg.MaxSources,
+		"MAX_CONTEXT_LENGTH":        cfg.MaxContextLength,
+		"SHUTDOWN_TIMEOUT":          cfg.ShutdownTimeout,
+		"LLM_TIMEOUT":               cfg.LLMTimeout,
+		"LLM_MAX_RETRIES":           cfg.LLMMaxRetries,
+		"PROVIDER_TIMEOUT":          cfg.ProviderTimeout,
+		"PROVIDER_MAX_RETRIES":      cfg.ProviderMaxRetries,
+		"EMBEDDING_MAX_RETRIES":     cfg.EmbeddingMaxRetries,
+		"PROVIDER_BREAKER_FAILURES": cfg.ProviderBreakerFailures,
+		"PROVIDER_BREAKER_COOLDOWN": cfg.ProviderBreakerCooldown,
+		"VISION_MAX_PAGES":          cfg.VisionMaxPages,
+		"INGEST_TIMEOUT":            cfg.IngestTimeout,
+		"QUERY_TIMEOUT":             cfg.QueryTimeout,
+		"EMBEDDING_BATCH_SIZE":      cfg.EmbeddingBatchSize,
+		"EMBEDDING_CONCURRENCY":     cfg.EmbeddingConcurrency,
+		"MAX_ACTIVE_NOTEBOOKS":      cfg.MaxActiveNotebooks,
+		"NOTEBOOK_IDLE_MINUTES":     cfg.NotebookIdleMinutes,
+		"SOURCE_CHECK_INTERVAL":     cfg.SourceCheckInterval,
+		"TOPIC_INTERVAL":            cfg.TopicInterval,
+		"JOB_JITTER":                cfg.JobJitter,
+		"RATE_LIMIT_PER_MINUTE":     cfg.RateLimitPerMinute,
+		"RATE_LIMIT_BURST":          cfg.RateLimitBurst,
+		"CORS_MAX_AGE":              cfg.CORSMaxAge,
+		"CHAT_CONCURRENCY":          cfg.ChatConcurrency,
+		"CHAT_QUEUE_SIZE":           cfg.ChatQueueSize,
+		"WEB_SEARCH_RESULTS":        cfg.WebSearchResults,
+
+		"RETRIEVAL_CACHE_SECONDS": cfg.RetrievalCacheSeconds,
+
+		"MAX_UPLOAD_SIZE_MB":         cfg.MaxUploadSizeMB,
+		"MAX_REQUEST_BODY_MB":        cfg.MaxRequestBodyMB,
+		"UPLOAD_SESSION_HOURS":       cfg.UploadSessionHours,
+		"THUMBNAIL_SIZE":             cfg.ThumbnailSize,
+		"DOWNLOAD_URL_MINUTES":       cfg.DownloadURLMinutes,
+		"WORKSPACE_STORAGE_QUOTA_MB": cfg.WorkspaceStorageQuotaMB,
+		"USER_STORAGE_QUOTA_MB":      cfg.UserStorageQuotaMB,
+
+		"RETENTION_ARCHIVE_IDLE_DAYS": cfg.RetentionArchiveIdleDays,
+		"RETENTION_CHAT_DAYS":         cfg.RetentionChatDays,
+		"RETENTION_TRASH_DAYS":        cfg.RetentionTrashDays,
+	} {
+		if value < 0 {
+			fail("%s must not be negative, got %d", key, value)
+		}
+	}
+	for key, value := range map[string]string{
+		"OPENAI_BASE_URL": cfg.OpenAIBaseURL,
+		"OLLAMA_BASE_URL": cfg.OllamaBaseURL,
+		"SUPABASE_URL":    cfg.SupabaseURL,
+		"WEB_SEARCH_URL":  cfg.WebSearchURL,
+
+		"LLM_FALLBACK_BASE_URL": cfg.LLMFallbackBaseURL,
+	} {
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("%s must be an absolute URL such as http://host:port, got %q", key, value)
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+	return errors.Join(problems...)
+}
+
+// ConfigFile returns the config file the configuration was read from, if any
+func (c *Config) ConfigFile() string {
+	return c.options.File
+}
+
+// ConfigSetting is one setting as shown by the config debug endpoint
+type ConfigSetting struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Source    string `json:"source"`
+	HotReload bool   `json:"hot_reload,omitempty"`
 }
 
-// getEnv gets an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// Redacted lists every setting with secrets and URL passwords hidden
+func (c *Config) Redacted() []ConfigSetting {
+	v := reflect.ValueOf(c).Elem()
+	fields := configFields()
+	settings := make([]ConfigSetting, 0, len(fields))
+	for _, f := range fields {
+		value := fmt.Sprint(v.Field(f.Index).Interface())
+		switch {
+		case f.Secret && value != "":
+			value = "[redacted]"
+		case strings.Contains(value, "://"):
+			if u, err := url.Parse(value); err == nil {
+				value = u.Redacted()
+			}
+		}
+		source := c.sources[f.Key]
+		if source == "" {
+			source = configFromDefault
+		}
+		settings = append(settings, ConfigSetting{Key: f.Key, Value: value, Source: source, HotReload: f.HotLoad})
 	}
-	return defaultValue
+	return settings
 }
 
-// getEnvInt gets an environment variable as an integer or returns a default value
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intVal, err := strconv.Atoi(value); err == nil {
-			return intVal
+// secretValues returns the values of the secret settings that are set
+func (c *Config) secretValues() []string {
+	v := reflect.ValueOf(c).Elem()
+	var secrets []string
+	for _, f := range configFields() {
+		if value := fmt.Sprint(v.Field(f.Index).Interface()); f.Secret && value != "" {
+			secrets = append(secrets, value)
 		}
 	}
-	return defaultValue
+	return secrets
 }
 
-// getEnvBool gets an environment variable as a boolean or returns a default value
-func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		if boolVal, err := strconv.ParseBool(value); err == nil {
-			return boolVal
+// changedSettings returns the keys whose values differ between two configs
+func changedSettings(old, updated *Config) []configField {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(updated).Elem()
+	var changed []configField
+	for _, f := range configFields() {
+		if ov.Field(f.Index).Interface() != nv.Field(f.Index).Interface() {
+			changed = append(changed, f)
 		}
 	}
-	return defaultValue
+	return changed
 }
 
 // contains checks if a string contains a substring
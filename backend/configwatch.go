@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// startConfigWatcher reloads the config file whenever it changes on disk
+func (s *Server) startConfigWatcher(path string) {
+	golog.Infof("watching %s for configuration changes", path)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	stamp := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	modTime, size := stamp()
+
+	for {
+		select {
+		case <-ticker.C:
+			m, sz := stamp()
+			if sz < 0 || (m.Equal(modTime) && sz == size) {
+				continue
+			}
+			modTime, size = m, sz
+			if err := s.ReloadConfig(); err != nil {
+				golog.Errorf("config reload failed, keeping current settings: %v", err)
+			}
+		case <-s.stopping:
+			return
+		}
+	}
+}
+
+// ReloadConfig re-reads the configuration and applies the settings that can
+// change without a restart (log level and rate limits). Changes to other
+// settings are logged and take effect on the next restart.
+func (s *Server) ReloadConfig() error {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	updated, err := LoadConfigWithOptions(s.liveCfg.options)
+	if err != nil {
+		return err
+	}
+	if err := ValidateConfig(updated); err != nil {
+		return err
+	}
+
+	var applied, pending []string
+	for _, f := range changedSettings(&s.liveCfg, &updated) {
+		if f.HotLoad {
+			applied = append(applied, f.Key)
+		} else {
+			pending = append(pending, f.Key)
+		}
+	}
+
+	applyLiveSettings(updated, s.rateLimiter)
+	// Keep restart-only settings as they are so the debug view matches what is running
+	live := s.liveCfg
+	live.LogLevel = updated.LogLevel
+	live.RateLimitPerMinute = updated.RateLimitPerMinute
+	live.RateLimitBurst = updated.RateLimitBurst
+	for _, key := range applied {
+		live.sources[key] = updated.sources[key]
+	}
+	s.liveCfg = live
+
+	if len(applied) > 0 {
+		golog.Infof("configuration reloaded: %s", strings.Join(applied, ", "))
+	}
+	if len(pending) > 0 {
+		golog.Warnf("configuration changes need a restart to take effect: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// applyLiveSettings applies the hot-reloadable settings
+func applyLiveSettings(cfg Config, rl *rateLimiter) {
+	golog.SetLevel(strings.ToLower(cfg.LogLevel))
+	rl.SetLimits(cfg.RateLimitPerMinute, cfg.RateLimitBurst)
+}
+
+// handleGetConfig returns the running configuration with secrets redacted
+func (s *Server) handleGetConfig(c *gin.Context) {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"file":     s.liveCfg.ConfigFile(),
+		"settings": s.liveCfg.Redacted(),
+	})
+}
+
+func (s *Server) handleReloadConfig(c *gin.Context) {
+	if err := s.ReloadConfig(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Code: CodeValidationFailed, Error: err.Error()})
+		return
+	}
+
+	s.handleGetConfig(c)
+}
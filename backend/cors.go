@@ -0,0 +1,155 @@
+package backend
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// csrfCookie holds the token the page echoes in csrfHeader; it is not
+	// HttpOnly, so the page can read it
+	csrfCookie = "notex_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// corsExposedHeaders are the response headers cross-origin pages may read
+var corsExposedHeaders = strings.Join([]string{
+	"ETag", "Location", "Retry-After", "Idempotent-Replayed", "X-Change-Cursor", "Upload-Offset", "Upload-Length",
+}, ", ")
+
+// corsPolicy is who may call the API from a page on another origin
+type corsPolicy struct {
+	any         bool
+	origins     map[string]bool
+	credentials bool
+	maxAge      int
+	// protection refuses changes from other origins than these
+	protection *http.CrossOriginProtection
+}
+
+// newCORSPolicy parses CORS_ALLOWED_ORIGINS: "*", or origins such as
+// https://app.example.com
+func newCORSPolicy(cfg Config) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		origins:     make(map[string]bool),
+		credentials: cfg.CORSAllowCredentials,
+		maxAge:      cfg.CORSMaxAge,
+		protection:  http.NewCrossOriginProtection(),
+	}
+	for _, origin := range strings.Split(cfg.CORSAllowedOrigins, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			policy.any = true
+		default:
+			if err := policy.protection.AddTrustedOrigin(origin); err != nil {
+				return nil, err
+			}
+			policy.origins[origin] = true
+		}
+	}
+	return policy, nil
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.any || p.origins[origin]
+}
+
+// CORSMiddleware lets the pages of CORS_ALLOWED_ORIGINS call the API and
+// signed download links, answering their preflight requests. Other origins
+// get no CORS headers, so browsers keep them from reading responses.
+func (s *Server) CORSMiddleware() gin.HandlerFunc {
+	policy, _ := newCORSPolicy(s.cfg)
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		p := c.Request.URL.Path
+		if origin == "" || !(strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/dl/")) {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		if !policy.allows(origin) {
+			c.Next()
+			return
+		}
+
+		if policy.credentials {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+		} else if policy.any {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+			if headers := c.GetHeader("Access-Control-Request-Headers"); headers != "" {
+				c.Header("Access-Control-Allow-Headers", headers)
+			}
+			c.Header("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposedHeaders)
+		c.Next()
+	}
+}
+
+// safeMethod reports whether a method only reads
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// CSRFMiddleware keeps pages on other sites from making changes through a
+// visitor's browser: changes from other origins than CORS_ALLOWED_ORIGINS
+// are refused unless they carry an Authorization header, which browsers
+// never add by themselves. It also hands out the notex_csrf cookie that
+// requireCSRFToken checks. Published pages on custom domains are left alone.
+func (s *Server) CSRFMiddleware() gin.HandlerFunc {
+	policy, _ := newCORSPolicy(s.cfg)
+	return func(c *gin.Context) {
+		if !s.cfg.CSRFProtection || publishedSiteOf(c).domain {
+			c.Next()
+			return
+		}
+
+		token, err := c.Cookie(csrfCookie)
+		if err != nil || token == "" {
+			token = randomToken(16)
+			setCookie(c, &http.Cookie{Name: csrfCookie, Value: token, Path: "/", SameSite: http.SameSiteStrictMode})
+		}
+
+		if !safeMethod(c.Request.Method) && !policy.any && c.GetHeader("Authorization") == "" {
+			if err := policy.protection.Check(c.Request); err != nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Changes from other sites are not allowed; add the site to CORS_ALLOWED_ORIGINS"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// requireCSRFToken has a change signed in with a cookie echo the notex_csrf
+// cookie in the X-CSRF-Token header, as the embedded frontend does; a page
+// on another site can make the browser send the cookie but cannot read it.
+// Middleware that signs callers in with a cookie calls it.
+func (s *Server) requireCSRFToken(c *gin.Context) bool {
+	if !s.cfg.CSRFProtection || safeMethod(c.Request.Method) {
+		return true
+	}
+	token, err := c.Cookie(csrfCookie)
+	if err != nil || token == "" || !tokenMatches(c.GetHeader(csrfHeader), token) {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Missing or invalid CSRF token; send the notex_csrf cookie's value in X-CSRF-Token"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Duplicate handling policies for newly added sources
+const (
+	// DuplicateLink reuses an existing source in the same notebook and links
+	// to the original when the content already exists in another notebook
+	DuplicateLink = "link"
+	// DuplicateAllow always stores a full copy
+	DuplicateAllow = "allow"
+	// DuplicateReject refuses to add content that already exists
+	DuplicateReject = "reject"
+)
+
+// DuplicateError is returned when a source is rejected as a duplicate
+type DuplicateError struct {
+	Existing *Source
+}
+
+func (e *DuplicateError) Error() string {
+	return "duplicate of source " + e.Existing.ID + " (" + e.Existing.Name + ")"
+}
+
+// DuplicateGroup lists sources in a notebook that share the same content
+type DuplicateGroup struct {
+	ContentHash string   `json:"content_hash"`
+	Sources     []Source `json:"sources"`
+}
+
+// normalizeDuplicatePolicy maps a user supplied policy to a known one
+func normalizeDuplicatePolicy(policy string) string {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case DuplicateAllow:
+		return DuplicateAllow
+	case DuplicateReject:
+		return DuplicateReject
+	default:
+		return DuplicateLink
+	}
+}
+
+// ingestSourceDedup stores and indexes a source, applying the duplicate policy.
+// When an existing source in the same notebook is reused it is returned as
+// duplicateOf and source is left unsaved.
+func (s *Server) ingestSourceDedup(ctx context.Context, source *Source, policy string) (*Source, error) {
+	policy = normalizeDuplicatePolicy(policy)
+	source.ContentHash = ContentHash(source.Content)
+
+	if source.ContentHash != "" && policy != DuplicateAllow {
+		matches, err := s.store.FindSourcesByHash(ctx, source.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var original *Source
+		for i := range matches {
+			match := &matches[i]
+			if match.NotebookID == source.NotebookID {
+				if policy == DuplicateReject {
+					return nil, &DuplicateError{Existing: match}
+				}
+				golog.Infof("source %s duplicates %s in notebook %s, reusing it", source.Name, match.ID, source.NotebookID)
+				return match, nil
+			}
+			if original == nil && match.LinkedSourceID == "" {
+				original = match
+			}
+		}
+
+		if original != nil {
+			if policy == DuplicateReject {
+				return nil, &DuplicateError{Existing: original}
+			}
+			source.LinkedSourceID = original.ID
+		}
+	}
+
+	return nil, s.ingestSource(ctx, source)
+}
+
+// Duplicate handlers
+
+func (s *Server) handleListDuplicateSources(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
+		return
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	seen := make(map[string]bool)
+	for _, src := range sources {
+		if src.ContentHash == "" || seen[src.ContentHash] {
+			continue
+		}
+		seen[src.ContentHash] = true
+
+		// Include copies and links held by other notebooks
+		matches, err := s.store.FindSourcesByHash(ctx, src.ContentHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to find duplicates"})
+			return
+		}
+		if len(matches) < 2 {
+			continue
+		}
+
+		for i := range matches {
+			matches[i].Content = ""
+		}
+		groups = append(groups, DuplicateGroup{ContentHash: src.ContentHash, Sources: matches})
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+// duplicateResponse writes a 409 for a rejected duplicate and reports whether err was one
+func duplicateResponse(c *gin.Context, err error) bool {
+	var dup *DuplicateError
+	if !errors.As(err, &dup) {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":    dup.Error(),
+		"code":     CodeConflict,
+		"existing": dup.Existing,
+	})
+	return true
+}
@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// desktopTokenParam carries the access token in the link the browser is
+// opened with; it is swapped for a cookie on first use
+const desktopTokenParam = "desktop_token"
+
+// desktopCookie holds the access token for the rest of the browser session
+const desktopCookie = "notex_desktop"
+
+// DesktopLaunchURL is the link that opens the app at addr and signs the
+// browser in with token
+func DesktopLaunchURL(addr, token string) string {
+	return "http://" + addr + "/?" + desktopTokenParam + "=" + token
+}
+
+// DesktopTokenMiddleware guards a server bound for one local user. Every
+// request must come to a loopback host name, which stops DNS rebinding, and
+// carry DESKTOP_TOKEN in the cookie set by the launch link or in the
+// X-Desktop-Token header. Probes are exempt.
+func (s *Server) DesktopTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := s.cfg.DesktopToken
+		if token == "" || c.Request.URL.Path == "/healthz" || c.Request.URL.Path == "/readyz" {
+			c.Next()
+			return
+		}
+
+		if !isLoopbackHost(c.Request.Host) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Desktop mode only answers on localhost"})
+			return
+		}
+
+		// The launch link: keep the token in a cookie and drop it from the URL
+		if given := c.Query(desktopTokenParam); given != "" {
+			if !tokenMatches(given, token) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Invalid desktop token"})
+				return
+			}
+			setCookie(c, &http.Cookie{
+				Name:     desktopCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			query := c.Request.URL.Query()
+			query.Del(desktopTokenParam)
+			target := requestBasePath(c) + c.Request.URL.Path
+			if encoded := query.Encode(); encoded != "" {
+				target += "?" + encoded
+			}
+			c.Redirect(http.StatusFound, target)
+			c.Abort()
+			return
+		}
+
+		given := c.GetHeader("X-Desktop-Token")
+		if cookie, err := c.Cookie(desktopCookie); err == nil && given == "" {
+			given = cookie
+		}
+		if !tokenMatches(given, token) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Open notex from the link it printed at startup"})
+			return
+		}
+		if c.GetHeader("X-Desktop-Token") == "" && !s.requireCSRFToken(c) {
+			return
+		}
+		c.Next()
+	}
+}
+
+func tokenMatches(given, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// isLoopbackHost reports whether a Host header names this machine
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,629 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// EmailInbox is the inbound email address assigned to a notebook
+type EmailInbox struct {
+	NotebookID     string    `json:"notebook_id"`
+	Address        string    `json:"address,omitempty"`
+	Token          string    `json:"token"`
+	AllowedSenders []string  `json:"allowed_senders"`
+	Mode           string    `json:"mode"` // "source" or "note"
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// inboundEmail is a provider-neutral view of a received email
+type inboundEmail struct {
+	Recipients  []string
+	From        string
+	Subject     string
+	Text        string
+	Attachments []emailAttachment
+}
+
+type emailAttachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+// maxInboundEmailSize bounds the size of a single inbound email payload
+const maxInboundEmailSize = 50 << 20
+
+// Email inbox operations
+
+// GetEmailInbox returns the notebook's inbox, if it has one
+func (s *Store) GetEmailInbox(ctx context.Context, notebookID string) (*EmailInbox, error) {
+	inbox, err := s.scanEmailInbox(s.db.QueryRowContext(ctx, `
+		SELECT notebook_id, token, allowed_senders, mode, created_at, updated_at
+		FROM email_inboxes WHERE notebook_id = ?
+	`, notebookID))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("email inbox")
+	}
+	return inbox, err
+}
+
+// GetOrCreateEmailInbox returns the notebook's inbox, creating one with a fresh token if needed
+func (s *Store) GetOrCreateEmailInbox(ctx context.Context, notebookID string) (*EmailInbox, error) {
+	inbox, err := s.GetEmailInbox(ctx, notebookID)
+	if err == nil {
+		return inbox, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	now := time.Now()
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO email_inboxes (notebook_id, token, allowed_senders, mode, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, notebookID, randomToken(10), "[]", "source", now.Unix(), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetOrCreateEmailInbox(ctx, notebookID)
+}
+
+// GetEmailInboxByToken looks up an inbox by the local part of its address
+func (s *Store) GetEmailInboxByToken(ctx context.Context, token string) (*EmailInbox, error) {
+	inbox, err := s.scanEmailInbox(s.db.QueryRowContext(ctx, `
+		SELECT notebook_id, token, allowed_senders, mode, created_at, updated_at
+		FROM email_inboxes WHERE token = ?
+	`, token))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("email inbox")
+	}
+	return inbox, err
+}
+
+// UpdateEmailInbox saves the inbox settings and optionally rotates its token
+func (s *Store) UpdateEmailInbox(ctx context.Context, notebookID string, allowedSenders []string, mode string, rotate bool) (*EmailInbox, error) {
+	inbox, err := s.GetOrCreateEmailInbox(ctx, notebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	token := inbox.Token
+	if rotate {
+		token = randomToken(10)
+	}
+	if allowedSenders == nil {
+		allowedSenders = []string{}
+	}
+	sendersJSON, _ := json.Marshal(allowedSenders)
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE email_inboxes SET token = ?, allowed_senders = ?, mode = ?, updated_at = ?
+		WHERE notebook_id = ?
+	`, token, string(sendersJSON), mode, time.Now().Unix(), notebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetOrCreateEmailInbox(ctx, notebookID)
+}
+
+func (s *Store) scanEmailInbox(row *sql.Row) (*EmailInbox, error) {
+	var inbox EmailInbox
+	var sendersJSON string
+	var createdAt, updatedAt int64
+
+	if err := row.Scan(&inbox.NotebookID, &inbox.Token, &sendersJSON, &inbox.Mode, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	inbox.CreatedAt = time.Unix(createdAt, 0)
+	inbox.UpdatedAt = time.Unix(updatedAt, 0)
+	inbox.AllowedSenders = []string{}
+	if sendersJSON != "" {
+		json.Unmarshal([]byte(sendersJSON), &inbox.AllowedSenders)
+	}
+
+	return &inbox, nil
+}
+
+// senderAllowed reports whether from matches the allow-list. Entries are either
+// full addresses or "@domain" suffixes; an empty list accepts every sender.
+func (inbox *EmailInbox) senderAllowed(from string) bool {
+	if len(inbox.AllowedSenders) == 0 {
+		return true
+	}
+
+	addr := strings.ToLower(from)
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		addr = strings.ToLower(parsed.Address)
+	}
+
+	for _, allowed := range inbox.AllowedSenders {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if strings.HasPrefix(allowed, "@") {
+			if strings.HasSuffix(addr, allowed) {
+				return true
+			}
+		} else if addr == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Email handlers
+
+func (s *Server) emailAddress(token string) string {
+	if s.cfg.EmailIngestDomain == "" {
+		return ""
+	}
+	return token + "@" + s.cfg.EmailIngestDomain
+}
+
+func (s *Server) handleGetEmailInbox(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	inbox, err := s.store.GetEmailInbox(ctx, notebookID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook has no email inbox; create one with POST"})
+		return
+	}
+	if err != nil {
+		golog.Errorf("failed to get email inbox: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get email inbox"})
+		return
+	}
+	inbox.Address = s.emailAddress(inbox.Token)
+
+	c.JSON(http.StatusOK, inbox)
+}
+
+// handleCreateEmailInbox gives a notebook an email address, or returns the
+// one it already has
+func (s *Server) handleCreateEmailInbox(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	status := http.StatusOK
+	inbox, err := s.store.GetEmailInbox(ctx, notebookID)
+	if errors.Is(err, ErrNotFound) {
+		status = http.StatusCreated
+		inbox, err = s.store.GetOrCreateEmailInbox(ctx, notebookID)
+	}
+	if err != nil {
+		golog.Errorf("failed to create email inbox: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create email inbox"})
+		return
+	}
+	inbox.Address = s.emailAddress(inbox.Token)
+
+	c.JSON(status, inbox)
+}
+
+func (s *Server) handleUpdateEmailInbox(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	var req struct {
+		AllowedSenders []string `json:"allowed_senders"`
+		Mode           string   `json:"mode"`
+		RotateAddress  bool     `json:"rotate_address"`
+	}
+
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = "source"
+	}
+	if req.Mode != "source" && req.Mode != "note" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "mode must be 'source' or 'note'"})
+		return
+	}
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	inbox, err := s.store.UpdateEmailInbox(ctx, notebookID, req.AllowedSenders, req.Mode, req.RotateAddress)
+	if err != nil {
+		golog.Errorf("failed to update email inbox: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update email inbox"})
+		return
+	}
+	inbox.Address = s.emailAddress(inbox.Token)
+
+	c.JSON(http.StatusOK, inbox)
+}
+
+// handleInboundEmail receives emails forwarded by a mail provider's inbound webhook.
+// Both form-encoded payloads (Mailgun/SendGrid style) and raw RFC 822 messages are accepted.
+func (s *Server) handleInboundEmail(c *gin.Context) {
+	ctx := context.Background()
+
+	if s.cfg.EmailWebhookSecret == "" {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: "Email ingestion is not configured"})
+		return
+	}
+
+	secret := c.GetHeader("X-Webhook-Secret")
+	if secret == "" {
+		secret = c.Query("secret")
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.cfg.EmailWebhookSecret)) != 1 {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Invalid webhook secret"})
+		return
+	}
+
+	email, err := parseInboundEmail(c)
+	if err != nil {
+		if bodyTooLargeResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: fmt.Sprintf("Failed to parse email: %v", err)})
+		return
+	}
+
+	inbox := s.findEmailInbox(ctx, email.Recipients)
+	if inbox == nil {
+		// Acknowledge so the provider does not retry mail for unknown addresses
+		golog.Warnf("inbound email for unknown recipients %v dropped", email.Recipients)
+		c.JSON(http.StatusOK, gin.H{"accepted": false, "reason": "unknown recipient"})
+		return
+	}
+
+	if !inbox.senderAllowed(email.From) {
+		golog.Warnf("inbound email from %s rejected by allow-list of notebook %s", email.From, inbox.NotebookID)
+		c.JSON(http.StatusOK, gin.H{"accepted": false, "reason": "sender not allowed"})
+		return
+	}
+
+	sourceIDs, noteID, err := s.ingestEmail(ctx, inbox, email)
+	if err != nil {
+		golog.Errorf("failed to ingest email: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to ingest email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accepted":    true,
+		"notebook_id": inbox.NotebookID,
+		"source_ids":  sourceIDs,
+		"note_id":     noteID,
+	})
+}
+
+// findEmailInbox resolves the first recipient that maps to a notebook inbox.
+// Plus-addressing (token+anything@domain) is supported.
+func (s *Server) findEmailInbox(ctx context.Context, recipients []string) *EmailInbox {
+	for _, rcpt := range recipients {
+		addrs, err := mail.ParseAddressList(rcpt)
+		if err != nil {
+			addrs = []*mail.Address{{Address: strings.TrimSpace(rcpt)}}
+		}
+		for _, addr := range addrs {
+			at := strings.LastIndex(addr.Address, "@")
+			if at <= 0 {
+				continue
+			}
+			if s.cfg.EmailIngestDomain != "" && !strings.EqualFold(addr.Address[at+1:], s.cfg.EmailIngestDomain) {
+				continue
+			}
+			local := strings.ToLower(addr.Address[:at])
+			if plus := strings.Index(local, "+"); plus > 0 {
+				local = local[:plus]
+			}
+			if inbox, err := s.store.GetEmailInboxByToken(ctx, local); err == nil {
+				return inbox
+			}
+		}
+	}
+	return nil
+}
+
+// ingestEmail stores the email body as a source or note and every attachment as a file source
+func (s *Server) ingestEmail(ctx context.Context, inbox *EmailInbox, email *inboundEmail) ([]string, string, error) {
+	subject := strings.TrimSpace(email.Subject)
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	meta := map[string]interface{}{
+		"email_from":    email.From,
+		"email_subject": email.Subject,
+		"received_at":   time.Now(),
+	}
+
+	sourceIDs := make([]string, 0, len(email.Attachments)+1)
+	noteID := ""
+
+	if strings.TrimSpace(email.Text) != "" {
+		if inbox.Mode == "note" {
+			note := &Note{
+				NotebookID: inbox.NotebookID,
+				Title:      subject,
+				Content:    email.Text,
+				Type:       "email",
+				SourceIDs:  []string{},
+				Metadata:   meta,
+			}
+			if err := s.createNote(ctx, note); err != nil {
+				return nil, "", err
+			}
+			noteID = note.ID
+		} else {
+			source := &Source{
+				NotebookID: inbox.NotebookID,
+				Name:       subject,
+				Type:       "email",
+				Content:    email.Text,
+				Metadata:   meta,
+			}
+			if err := s.ingestSource(ctx, source); err != nil {
+				return nil, "", err
+			}
+			sourceIDs = append(sourceIDs, source.ID)
+		}
+	}
+
+	for _, att := range email.Attachments {
+		uniqueName, path, size, err := saveUploadData(att.FileName, bytes.NewReader(att.Data))
+		if err != nil {
+			golog.Errorf("failed to save email attachment %s: %v", att.FileName, err)
+			continue
+		}
+		upload := savedUpload{
+			NotebookID:  inbox.NotebookID,
+			Name:        att.FileName,
+			FileName:    uniqueName,
+			Path:        path,
+			Size:        size,
+			ContentType: att.ContentType,
+		}
+		if err := s.scanUpload(ctx, upload, "email", email.From); err != nil {
+			// Flagged attachments are quarantined, the rest of the email is kept
+			continue
+		}
+
+		content, err := s.vectorStore.ExtractDocument(ctx, path)
+		if err != nil {
+			golog.Errorf("failed to extract email attachment %s: %v", att.FileName, err)
+		}
+
+		source := &Source{
+			NotebookID: inbox.NotebookID,
+			Name:       att.FileName,
+			Type:       "file",
+			FileName:   uniqueName,
+			FileSize:   size,
+			Content:    content,
+			Metadata: map[string]interface{}{
+				"path":          path,
+				"content_type":  att.ContentType,
+				"email_from":    email.From,
+				"email_subject": email.Subject,
+			},
+		}
+		if err := s.ingestSource(ctx, source); err != nil {
+			golog.Errorf("failed to create source for attachment %s: %v", att.FileName, err)
+			os.Remove(path)
+			continue
+		}
+		sourceIDs = append(sourceIDs, source.ID)
+	}
+
+	golog.Infof("📧 email from %s ingested into notebook %s (%d sources)", email.From, inbox.NotebookID, len(sourceIDs))
+	return sourceIDs, noteID, nil
+}
+
+// parseInboundEmail normalizes the webhook payload into an inboundEmail
+func parseInboundEmail(c *gin.Context) (*inboundEmail, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType == "message/rfc822" || mediaType == "text/plain" {
+		return parseRawEmail(c.Request.Body)
+	}
+
+	if err := c.Request.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	if c.Request.Form == nil {
+		if err := c.Request.ParseForm(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Some providers post the raw MIME message as a single form field
+	if raw := firstFormValue(c, "email", "body-mime"); raw != "" {
+		return parseRawEmail(strings.NewReader(raw))
+	}
+
+	email := &inboundEmail{
+		From:    firstFormValue(c, "sender", "from"),
+		Subject: firstFormValue(c, "subject"),
+		Text:    firstFormValue(c, "stripped-text", "body-plain", "text"),
+	}
+	if rcpt := firstFormValue(c, "recipient", "to"); rcpt != "" {
+		email.Recipients = strings.Split(rcpt, ",")
+	}
+	if email.Text == "" {
+		if htmlBody := firstFormValue(c, "body-html", "html"); htmlBody != "" {
+			email.Text = htmlToText(htmlBody)
+		}
+	}
+
+	if c.Request.MultipartForm != nil {
+		for _, files := range c.Request.MultipartForm.File {
+			for _, fh := range files {
+				f, err := fh.Open()
+				if err != nil {
+					return nil, err
+				}
+				data, err := io.ReadAll(f)
+				f.Close()
+				if err != nil {
+					return nil, err
+				}
+				email.Attachments = append(email.Attachments, emailAttachment{
+					FileName:    fh.Filename,
+					ContentType: fh.Header.Get("Content-Type"),
+					Data:        data,
+				})
+			}
+		}
+	}
+
+	if len(email.Recipients) == 0 {
+		return nil, fmt.Errorf("missing recipient")
+	}
+	return email, nil
+}
+
+func firstFormValue(c *gin.Context, keys ...string) string {
+	for _, key := range keys {
+		if v := c.Request.FormValue(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseRawEmail parses an RFC 822 message, walking multipart bodies for text and attachments
+func parseRawEmail(r io.Reader) (*inboundEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+
+	email := &inboundEmail{
+		From:    msg.Header.Get("From"),
+		Subject: subject,
+	}
+	for _, h := range []string{"Delivered-To", "X-Original-To", "To", "Cc"} {
+		if v := msg.Header.Get(h); v != "" {
+			email.Recipients = append(email.Recipients, v)
+		}
+	}
+
+	var plain, htmlBody string
+	err = walkMIMEPart(msg.Header, msg.Body, func(contentType, fileName string, data []byte) {
+		switch {
+		case fileName != "":
+			email.Attachments = append(email.Attachments, emailAttachment{FileName: fileName, ContentType: contentType, Data: data})
+		case contentType == "text/plain" && plain == "":
+			plain = string(data)
+		case contentType == "text/html" && htmlBody == "":
+			htmlBody = string(data)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	email.Text = plain
+	if email.Text == "" && htmlBody != "" {
+		email.Text = htmlToText(htmlBody)
+	}
+
+	if len(email.Recipients) == 0 {
+		return nil, fmt.Errorf("missing recipient")
+	}
+	return email, nil
+}
+
+// mimeHeader is satisfied by both mail.Header and textproto.MIMEHeader
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// walkMIMEPart decodes a MIME entity and calls fn for every leaf part
+func walkMIMEPart(header mimeHeader, body io.Reader, fn func(contentType, fileName string, data []byte)) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkMIMEPart(part.Header, part, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	var reader io.Reader = body
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(body)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	fileName := ""
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		fileName = dparams["filename"]
+	}
+	if fileName == "" {
+		fileName = params["name"]
+	}
+
+	fn(mediaType, fileName, data)
+	return nil
+}
@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+	ollamallm "github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// Provider batch sizes. OpenAI accepts up to 2048 inputs per request, but
+// smaller batches stay under its per-request token limit; Ollama embeds
+// inputs one after another, so large batches only delay the first result.
+const (
+	openAIEmbeddingBatchSize = 256
+	ollamaEmbeddingBatchSize = 32
+)
+
+// embeddingBackoff is the wait before the first retry; it doubles each time
+const embeddingBackoff = time.Second
+
+// embedder turns texts into vectors. The langchaingo OpenAI and Ollama
+// clients implement it.
+type embedder interface {
+	CreateEmbedding(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// batchEmbedder embeds many texts in provider-sized batches. A fixed number
+// of batches are in flight at once across every caller, so concurrent
+// uploads queue for a slot instead of piling requests onto the provider.
+type batchEmbedder struct {
+	client    embedder
+	batchSize int
+	slots     chan struct{}
+	// retries is how many times a rate-limited batch is retried
+	retries int
+	// redactor masks personal data before texts are sent; nil when off
+	redactor *piiRedactor
+	// host is whose circuit breaker the batches go through
+	host string
+}
+
+// newBatchEmbedder returns the embedder for the configured provider, or nil
+// when embeddings are disabled
+func newBatchEmbedder(cfg Config) (*batchEmbedder, error) {
+	if !cfg.EnableEmbeddings {
+		return nil, nil
+	}
+
+	var client embedder
+	batchSize := openAIEmbeddingBatchSize
+	if cfg.IsOllama() {
+		llm, err := ollamallm.New(
+			ollamallm.WithModel(cfg.OllamaEmbeddingModel),
+			ollamallm.WithServerURL(cfg.OllamaBaseURL),
+			ollamallm.WithHTTPClient(providerHTTPClient(cfg, 0, 0)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		client = llm
+		batchSize = ollamaEmbeddingBatchSize
+	} else {
+		opts := []openai.Option{
+			openai.WithToken(cfg.OpenAIAPIKey),
+			openai.WithEmbeddingModel(cfg.EmbeddingModel),
+			openai.WithHTTPClient(providerHTTPClient(cfg, 0, 0)),
+		}
+		if cfg.OpenAIBaseURL != "" {
+			opts = append(opts, openai.WithBaseURL(cfg.OpenAIBaseURL))
+		}
+		llm, err := openai.New(opts...)
+		if err != nil {
+			return nil, err
+		}
+		client = llm
+	}
+
+	if cfg.EmbeddingBatchSize > 0 {
+		batchSize = cfg.EmbeddingBatchSize
+	}
+	workers := cfg.EmbeddingConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	return &batchEmbedder{client: client, batchSize: batchSize, slots: make(chan struct{}, workers), retries: cfg.EmbeddingMaxRetries, redactor: newPIIRedactor(cfg), host: providerHost(cfg.OpenAIBaseURL)}, nil
+}
+
+// Embed returns one vector per text, in order. It stops at the first batch
+// that fails for a reason other than rate limiting.
+func (e *batchEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+batches:
+	for start := 0; start < len(texts); start += e.batchSize {
+		end := min(start+e.batchSize, len(texts))
+
+		// Wait for a free slot; this is the backpressure on large sources
+		select {
+		case e.slots <- struct{}{}:
+		case <-batchCtx.Done():
+			break batches
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			defer func() { <-e.slots }()
+
+			batch, err := e.embedBatch(batchCtx, texts[start:end])
+			if err != nil {
+				fail(err)
+				return
+			}
+			copy(vectors[start:end], batch)
+		}(start, end)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return vectors, nil
+}
+
+// embedBatch embeds one batch, backing off and retrying while the provider
+// reports rate limiting
+func (e *batchEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	if e.redactor != nil {
+		texts = e.redactor.redactTexts(texts)
+	}
+	backoff := embeddingBackoff
+	for attempt := 0; ; attempt++ {
+		// The clients hide the breaker's error behind their own
+		if err := providerUnavailable(e.host); err != nil {
+			return nil, err
+		}
+		vectors, err := e.client.CreateEmbedding(ctx, texts)
+		if err == nil {
+			if len(vectors) != len(texts) {
+				return nil, fmt.Errorf("embedding provider returned %d vectors for %d texts", len(vectors), len(texts))
+			}
+			return vectors, nil
+		}
+		if attempt == e.retries || !isRateLimitError(err) {
+			return nil, err
+		}
+
+		// Jitter keeps parallel batches from retrying in lockstep
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		golog.Warnf("embedding rate limited, retrying batch of %d in %s", len(texts), wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// isRateLimitError reports whether a provider turned a request away for
+// going too fast. The langchaingo clients only say so in the error text.
+func isRateLimitError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "429") || strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests")
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, or 0
+// when they differ in length or either is all zeros
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,457 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// mentionSnippetRadius is how much text around a mention its snippet shows
+const mentionSnippetRadius = 100
+
+// Entity is a person, organization or project mentioned in a workspace
+type Entity struct {
+	ID           string    `json:"id"`
+	WorkspaceID  string    `json:"workspace_id"`
+	Type         string    `json:"type"`
+	Name         string    `json:"name"`
+	MentionCount int       `json:"mention_count"`
+	URL          string    `json:"url"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// EntityMention is a source or note that mentions an entity
+type EntityMention struct {
+	EntityID     string    `json:"entity_id"`
+	NotebookID   string    `json:"notebook_id"`
+	NotebookName string    `json:"notebook_name"`
+	SourceID     string    `json:"source_id,omitempty"`
+	NoteID       string    `json:"note_id,omitempty"`
+	Title        string    `json:"title"`
+	Snippet      string    `json:"snippet,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// EntityPage is everything known about an entity: where it is mentioned and
+// which entities are mentioned alongside it
+type EntityPage struct {
+	Entity
+	Mentions []EntityMention `json:"mentions"`
+	Related  []Entity        `json:"related"`
+}
+
+// foundEntity is an extracted entity with the text around its mention
+type foundEntity struct {
+	ExtractedEntity
+	Snippet string
+}
+
+func entityURL(id string) string {
+	return "/api/entities/" + id
+}
+
+// entityColumns are selected by the entity queries, with the mention count
+const entityColumns = `e.id, e.workspace_id, e.type, e.name, e.created_at, e.updated_at,
+	(SELECT COUNT(*) FROM entity_mentions m WHERE m.entity_id = e.id)`
+
+func scanEntity(row rowScanner) (*Entity, error) {
+	var e Entity
+	var createdAt, updatedAt int64
+	if err := row.Scan(&e.ID, &e.WorkspaceID, &e.Type, &e.Name, &createdAt, &updatedAt, &e.MentionCount); err != nil {
+		return nil, err
+	}
+	e.CreatedAt = time.Unix(createdAt, 0)
+	e.UpdatedAt = time.Unix(updatedAt, 0)
+	e.URL = entityURL(e.ID)
+	return &e, nil
+}
+
+func queryEntities(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Entity, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entities := []Entity{}
+	for rows.Next() {
+		e, err := scanEntity(rows)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, *e)
+	}
+	return entities, rows.Err()
+}
+
+// ReplaceEntityMentions records the entities a source or note mentions,
+// replacing what was found in it before. Exactly one of sourceID and noteID
+// is set. Entities no longer mentioned anywhere are removed.
+func (s *Store) ReplaceEntityMentions(ctx context.Context, workspaceID, sourceID, noteID string, found []foundEntity) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sourceID != "" {
+		_, err = tx.ExecContext(ctx, `DELETE FROM entity_mentions WHERE source_id = ?`, sourceID)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM entity_mentions WHERE note_id = ?`, noteID)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, f := range found {
+		key := strings.ToLower(f.Name)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO entities (id, workspace_id, type, name, name_key, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(workspace_id, type, name_key) DO UPDATE SET updated_at = excluded.updated_at
+		`, uuid.New().String(), workspaceID, f.Type, f.Name, key, now, now); err != nil {
+			return err
+		}
+		var entityID string
+		if err := tx.QueryRowContext(ctx, `
+			SELECT id FROM entities WHERE workspace_id = ? AND type = ? AND name_key = ?
+		`, workspaceID, f.Type, key).Scan(&entityID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO entity_mentions (entity_id, source_id, note_id, snippet, created_at) VALUES (?, NULLIF(?, ''), NULLIF(?, ''), ?, ?)
+		`, entityID, sourceID, noteID, f.Snippet, now); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM entities WHERE workspace_id = ? AND NOT EXISTS (SELECT 1 FROM entity_mentions m WHERE m.entity_id = entities.id)
+	`, workspaceID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListEntities returns a workspace's mentioned entities, most mentioned
+// first, optionally of one type or with names containing query
+func (s *Store) ListEntities(ctx context.Context, workspaceID, entityType, query string) ([]Entity, error) {
+	where := `e.workspace_id = ?`
+	args := []interface{}{workspaceID}
+	if entityType != "" {
+		where += ` AND e.type = ?`
+		args = append(args, entityType)
+	}
+	if query != "" {
+		where += ` AND instr(e.name_key, ?) > 0`
+		args = append(args, strings.ToLower(query))
+	}
+	return queryEntities(ctx, s.db, `
+		SELECT `+entityColumns+` FROM entities e WHERE `+where+`
+		AND EXISTS (SELECT 1 FROM entity_mentions m WHERE m.entity_id = e.id)
+		ORDER BY 7 DESC, e.name
+	`, args...)
+}
+
+// GetEntity returns an entity
+func (s *Store) GetEntity(ctx context.Context, id string) (*Entity, error) {
+	e, err := scanEntity(s.db.QueryRowContext(ctx, `SELECT `+entityColumns+` FROM entities e WHERE e.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("entity")
+	}
+	return e, err
+}
+
+// mentionColumns describe a mention with the notebook and title of what
+// mentions it, joined as m, n (note), src (source) and nb (notebook)
+const mentionColumns = `m.entity_id, COALESCE(n.notebook_id, src.notebook_id), COALESCE(nb.name, ''),
+	COALESCE(m.source_id, ''), COALESCE(m.note_id, ''), COALESCE(n.title, src.name, ''), m.snippet, m.created_at`
+
+const mentionJoins = `FROM entity_mentions m
+	LEFT JOIN notes n ON n.id = m.note_id
+	LEFT JOIN sources src ON src.id = m.source_id
+	LEFT JOIN notebooks nb ON nb.id = COALESCE(n.notebook_id, src.notebook_id)`
+
+func (s *Store) queryMentions(ctx context.Context, query string, args ...interface{}) ([]EntityMention, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := []EntityMention{}
+	for rows.Next() {
+		var m EntityMention
+		var createdAt int64
+		if err := rows.Scan(&m.EntityID, &m.NotebookID, &m.NotebookName, &m.SourceID, &m.NoteID, &m.Title, &m.Snippet, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(createdAt, 0)
+		mentions = append(mentions, m)
+	}
+	return mentions, rows.Err()
+}
+
+// ListEntityMentions returns every mention of an entity, newest first
+func (s *Store) ListEntityMentions(ctx context.Context, entityID string) ([]EntityMention, error) {
+	return s.queryMentions(ctx, `SELECT `+mentionColumns+` `+mentionJoins+`
+		WHERE m.entity_id = ? ORDER BY m.created_at DESC`, entityID)
+}
+
+// ListWorkspaceMentions returns the mentions in a workspace, or in one of
+// its notebooks when notebookID is set
+func (s *Store) ListWorkspaceMentions(ctx context.Context, workspaceID, notebookID string) ([]EntityMention, error) {
+	query := `SELECT ` + mentionColumns + ` ` + mentionJoins + `
+		JOIN entities e ON e.id = m.entity_id WHERE e.workspace_id = ?`
+	args := []interface{}{workspaceID}
+	if notebookID != "" {
+		query += ` AND nb.id = ?`
+		args = append(args, notebookID)
+	}
+	return s.queryMentions(ctx, query, args...)
+}
+
+// ListRelatedEntities returns the entities mentioned in the same sources and
+// notes as an entity, those sharing the most first
+func (s *Store) ListRelatedEntities(ctx context.Context, entityID string, limit int) ([]Entity, error) {
+	return queryEntities(ctx, s.db, `
+		SELECT `+entityColumns+` FROM entities e
+		JOIN (
+			SELECT other.entity_id, COUNT(*) AS shared FROM entity_mentions self
+			JOIN entity_mentions other ON other.entity_id != self.entity_id
+				AND (other.source_id = self.source_id OR other.note_id = self.note_id)
+			WHERE self.entity_id = ?
+			GROUP BY other.entity_id
+		) r ON r.entity_id = e.id
+		ORDER BY r.shared DESC, e.name LIMIT ?
+	`, entityID, limit)
+}
+
+// mentionSnippet is the text around the first mention of name, or "" when
+// the name does not appear as written
+func mentionSnippet(content, name string) string {
+	lower := strings.ToLower(content)
+	i := strings.Index(lower, strings.ToLower(name))
+	if i < 0 || len(lower) != len(content) {
+		return ""
+	}
+	start := max(i-mentionSnippetRadius, 0)
+	end := min(i+len(name)+mentionSnippetRadius, len(content))
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+	snippet := strings.Join(strings.Fields(content[start:end]), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(content) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// extractEntities indexes the entities a source or note mentions. Exactly
+// one of sourceID and noteID is set.
+func (s *Server) extractEntities(ctx context.Context, notebookID, sourceID, noteID, title, content string) error {
+	nb, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+
+	var found []foundEntity
+	if strings.TrimSpace(content) != "" {
+		entities, err := s.notebookAgent(ctx, notebookID).ExtractEntities(ctx, []Source{{Name: title, Content: content}})
+		if err != nil {
+			return err
+		}
+		for _, e := range entities {
+			found = append(found, foundEntity{ExtractedEntity: e, Snippet: mentionSnippet(content, e.Name)})
+		}
+	}
+	return s.store.ReplaceEntityMentions(ctx, nb.WorkspaceID, sourceID, noteID, found)
+}
+
+// extractEntitiesLater indexes a new source's or note's entities in the
+// background when entity extraction is on
+func (s *Server) extractEntitiesLater(notebookID, sourceID, noteID, title, content string) {
+	if !s.cfg.EnableEntities {
+		return
+	}
+	s.runJob(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.LLMTimeout)*time.Second)
+		defer cancel()
+		if err := s.extractEntities(ctx, notebookID, sourceID, noteID, title, content); err != nil {
+			golog.Warnf("failed to extract entities from %q: %v", title, err)
+		}
+	})
+}
+
+// workspaceEntity loads the :entityId entity, which must be in the caller's workspace
+func (s *Server) workspaceEntity(c *gin.Context) (*Entity, bool) {
+	e, err := s.store.GetEntity(c.Request.Context(), c.Param("entityId"))
+	if err != nil || e.WorkspaceID != currentWorkspace(c).ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Entity not found"})
+		return nil, false
+	}
+	return e, true
+}
+
+// GraphNode is an entity, source or note in the graph
+type GraphNode struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"` // entity, source or note
+	Type  string `json:"type,omitempty"`
+	Label string `json:"label"`
+	// URL is the entity page for entities
+	URL        string `json:"url,omitempty"`
+	NotebookID string `json:"notebook_id,omitempty"`
+}
+
+// GraphEdge links a source or note to an entity it mentions
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// Entity handlers
+
+// handleListEntities lists the workspace's entities. Filter with ?type=
+// (person, organization or project) and ?q= (part of the name).
+func (s *Server) handleListEntities(c *gin.Context) {
+	entityType := c.Query("type")
+	if entityType != "" && entityType != EntityPerson && entityType != EntityOrganization && entityType != EntityProject {
+		validationResponse(c, invalidField("type", "must be person, organization or project"))
+		return
+	}
+	entities, err := s.store.ListEntities(c.Request.Context(), currentWorkspace(c).ID, entityType, c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list entities"})
+		return
+	}
+	c.JSON(http.StatusOK, entities)
+}
+
+// handleGetEntity returns an entity's page: every mention and the entities
+// mentioned alongside it
+func (s *Server) handleGetEntity(c *gin.Context) {
+	ctx := c.Request.Context()
+	e, ok := s.workspaceEntity(c)
+	if !ok {
+		return
+	}
+	mentions, err := s.store.ListEntityMentions(ctx, e.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list mentions"})
+		return
+	}
+	related, err := s.store.ListRelatedEntities(ctx, e.ID, 20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list related entities"})
+		return
+	}
+	c.JSON(http.StatusOK, EntityPage{Entity: *e, Mentions: mentions, Related: related})
+}
+
+// handleExtractNotebookEntities indexes the entities of every source and
+// note in a notebook again, in the background
+func (s *Server) handleExtractNotebookEntities(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
+		return
+	}
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+		return
+	}
+
+	s.runJob(func() {
+		for _, src := range sources {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.LLMTimeout)*time.Second)
+			if err := s.extractEntities(ctx, notebookID, src.ID, "", src.Name, src.Content); err != nil {
+				golog.Warnf("failed to extract entities from source %s: %v", src.ID, err)
+			}
+			cancel()
+		}
+		for _, note := range notes {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.LLMTimeout)*time.Second)
+			if err := s.extractEntities(ctx, notebookID, "", note.ID, note.Title, note.Content); err != nil {
+				golog.Warnf("failed to extract entities from note %s: %v", note.ID, err)
+			}
+			cancel()
+		}
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"sources": len(sources), "notes": len(notes)})
+}
+
+// handleGetGraph returns the workspace's entities and the sources and notes
+// that mention them as a graph, or one notebook's with ?notebook_id=
+func (s *Server) handleGetGraph(c *gin.Context) {
+	ctx := c.Request.Context()
+	ws := currentWorkspace(c)
+
+	notebookID := c.Query("notebook_id")
+	if notebookID != "" {
+		nb, err := s.store.GetNotebook(ctx, notebookID)
+		if err != nil || nb.WorkspaceID != ws.ID {
+			validationResponse(c, invalidField("notebook_id", "is not a notebook in this workspace"))
+			return
+		}
+	}
+
+	entities, err := s.store.ListEntities(ctx, ws.ID, "", "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list entities"})
+		return
+	}
+	mentions, err := s.store.ListWorkspaceMentions(ctx, ws.ID, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list mentions"})
+		return
+	}
+
+	byID := make(map[string]*Entity, len(entities))
+	for i := range entities {
+		byID[entities[i].ID] = &entities[i]
+	}
+	nodes := []GraphNode{}
+	edges := []GraphEdge{}
+	added := make(map[string]bool)
+	for _, m := range mentions {
+		e, ok := byID[m.EntityID]
+		if !ok {
+			continue
+		}
+		if !added[e.ID] {
+			added[e.ID] = true
+			nodes = append(nodes, GraphNode{ID: e.ID, Kind: "entity", Type: e.Type, Label: e.Name, URL: e.URL})
+		}
+		from, kind := m.NoteID, "note"
+		if m.SourceID != "" {
+			from, kind = m.SourceID, "source"
+		}
+		if !added[from] {
+			added[from] = true
+			nodes = append(nodes, GraphNode{ID: from, Kind: kind, Label: m.Title, NotebookID: m.NotebookID})
+		}
+		edges = append(edges, GraphEdge{From: from, To: e.ID, Kind: "mentions"})
+	}
+	c.JSON(http.StatusOK, gin.H{"nodes": nodes, "edges": edges})
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Error codes returned in ErrorResponse.Code so clients can branch on the
+// kind of failure without parsing messages
+const (
+	CodeInvalidRequest   = "INVALID_REQUEST"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeNotFound         = "NOT_FOUND"
+	CodeConflict         = "CONFLICT"
+	CodeQuotaExceeded    = "QUOTA_EXCEEDED"
+	CodeValidationFailed = "VALIDATION_FAILED"
+	CodePayloadTooLarge  = "PAYLOAD_TOO_LARGE"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeProviderError    = "PROVIDER_ERROR"
+	CodeUnavailable      = "UNAVAILABLE"
+	CodeTimeout          = "TIMEOUT"
+	CodeCursorExpired    = "CURSOR_EXPIRED"
+	CodeContentBlocked   = "CONTENT_BLOCKED"
+	CodeInternal         = "INTERNAL"
+
+	// Two-factor authentication: a workspace requires it, or a destructive
+	// change needs a code
+	CodeTwoFactorRequired = "TWO_FACTOR_REQUIRED"
+	CodeStepUpRequired    = "STEP_UP_REQUIRED"
+)
+
+// statusCodes is the default error code for each HTTP status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusBadGateway:            CodeProviderError,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusGatewayTimeout:        CodeTimeout,
+	http.StatusGone:                  CodeCursorExpired,
+}
+
+// codeForStatus returns the default error code for an HTTP status
+func codeForStatus(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return CodeInternal
+}
+
+// Store errors wrap these so handlers can tell them apart with errors.Is
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+)
+
+// storeError is a store failure of a known kind with its own message
+type storeError struct {
+	kind error
+	msg  string
+}
+
+func (e *storeError) Error() string { return e.msg }
+func (e *storeError) Unwrap() error { return e.kind }
+
+// notFoundError reports a missing record, such as "notebook not found"
+func notFoundError(what string) error {
+	return &storeError{kind: ErrNotFound, msg: what + " not found"}
+}
+
+// conflictError reports a write that clashes with existing data
+func conflictError(msg string) error {
+	return &storeError{kind: ErrConflict, msg: msg}
+}
+
+// isUniqueViolation reports whether err is a SQLite unique constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// storeErrorResponse writes the response for an error from the store or
+// ingestion: typed errors get their own status and code, anything else is a
+// 500 with the fallback message
+func storeErrorResponse(c *gin.Context, err error, fallback string) {
+	switch {
+	case validationResponse(c, err), duplicateResponse(c, err), quotaResponse(c, err):
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: err.Error()})
+	case errors.Is(err, ErrConflict):
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fallback})
+	}
+}
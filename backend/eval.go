@@ -0,0 +1,615 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+const (
+	// maxEvalCases bounds the test questions of a notebook, and so the
+	// length of a run
+	maxEvalCases = 200
+	// evalPrompts are the prompts whose active versions a run records
+	evalPromptChat    = "chat"
+	evalPromptPersona = "chat_persona"
+)
+
+// EvalCase is a test question for a notebook's chat, with the sources a
+// good answer draws on and, optionally, what it should say
+type EvalCase struct {
+	ID                string    `json:"id"`
+	NotebookID        string    `json:"notebook_id"`
+	Question          string    `json:"question"`
+	ExpectedSourceIDs []string  `json:"expected_source_ids"`
+	ExpectedAnswer    string    `json:"expected_answer,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// EvalScores are the measures of an answer, or their means over a run.
+// A measure is null when it does not apply, such as precision for an answer
+// citing nothing.
+type EvalScores struct {
+	// RetrievalRecall is the share of the expected sources retrieved
+	RetrievalRecall *float64 `json:"retrieval_recall"`
+	// CitationPrecision is the share of the cited sources that were
+	// expected, and CitationRecall the share of the expected sources cited
+	CitationPrecision *float64 `json:"citation_precision"`
+	CitationRecall    *float64 `json:"citation_recall"`
+	// Supported is the share of cited sentences their passages support
+	Supported *float64 `json:"supported"`
+	// AnswerScore grades the answer against the expected one, from 1 to 5
+	AnswerScore *float64 `json:"answer_score"`
+}
+
+// EvalResult is how a run answered one case
+type EvalResult struct {
+	CaseID             string   `json:"case_id"`
+	Question           string   `json:"question"`
+	Answer             string   `json:"answer"`
+	RetrievedSourceIDs []string `json:"retrieved_source_ids"`
+	CitedSourceIDs     []string `json:"cited_source_ids"`
+	EvalScores
+	// Reason explains the answer score
+	Reason string `json:"reason,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EvalRun is one run of a notebook's cases against the chat pipeline as it
+// is configured at the time, with the prompt versions in use, so runs can
+// be compared as prompts change
+type EvalRun struct {
+	ID         string `json:"id"`
+	NotebookID string `json:"notebook_id"`
+	Status     string `json:"status"` // JobRunning, JobCompleted or JobFailed
+	Error      string `json:"error,omitempty"`
+	// Prompts are the active versions of the chat prompts, 0 for built-in
+	Prompts map[string]int `json:"prompts"`
+	Model   string         `json:"model,omitempty"`
+	Cases   int            `json:"cases"`
+	Failed  int            `json:"failed"`
+	EvalScores
+	// Results are left out of run listings
+	Results    []EvalResult `json:"results,omitempty"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+}
+
+// Store
+
+const evalCaseColumns = `id, notebook_id, question, expected_source_ids, expected_answer, created_at, updated_at`
+
+func scanEvalCase(row rowScanner) (*EvalCase, error) {
+	var ec EvalCase
+	var expectedJSON string
+	var createdAt, updatedAt int64
+	if err := row.Scan(&ec.ID, &ec.NotebookID, &ec.Question, &expectedJSON, &ec.ExpectedAnswer, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(expectedJSON), &ec.ExpectedSourceIDs)
+	if ec.ExpectedSourceIDs == nil {
+		ec.ExpectedSourceIDs = []string{}
+	}
+	ec.CreatedAt = time.Unix(createdAt, 0)
+	ec.UpdatedAt = time.Unix(updatedAt, 0)
+	return &ec, nil
+}
+
+// CreateEvalCase adds a test question to a notebook
+func (s *Store) CreateEvalCase(ctx context.Context, ec *EvalCase) error {
+	ec.ID = uuid.New().String()
+	ec.CreatedAt = time.Now()
+	ec.UpdatedAt = ec.CreatedAt
+	expectedJSON, _ := json.Marshal(ec.ExpectedSourceIDs)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO eval_cases (`+evalCaseColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, ec.ID, ec.NotebookID, ec.Question, string(expectedJSON), ec.ExpectedAnswer, ec.CreatedAt.Unix(), ec.UpdatedAt.Unix())
+	return err
+}
+
+// GetEvalCase retrieves a test question
+func (s *Store) GetEvalCase(ctx context.Context, id string) (*EvalCase, error) {
+	ec, err := scanEvalCase(s.db.QueryRowContext(ctx, `SELECT `+evalCaseColumns+` FROM eval_cases WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("eval case not found")
+	}
+	return ec, err
+}
+
+// ListEvalCases retrieves a notebook's test questions, oldest first
+func (s *Store) ListEvalCases(ctx context.Context, notebookID string) ([]EvalCase, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+evalCaseColumns+` FROM eval_cases WHERE notebook_id = ? ORDER BY created_at, rowid
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cases := make([]EvalCase, 0)
+	for rows.Next() {
+		ec, err := scanEvalCase(rows)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, *ec)
+	}
+	return cases, rows.Err()
+}
+
+// UpdateEvalCase saves a test question's question and expectations
+func (s *Store) UpdateEvalCase(ctx context.Context, ec *EvalCase) error {
+	ec.UpdatedAt = time.Now()
+	expectedJSON, _ := json.Marshal(ec.ExpectedSourceIDs)
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE eval_cases SET question = ?, expected_source_ids = ?, expected_answer = ?, updated_at = ?
+		WHERE id = ?
+	`, ec.Question, string(expectedJSON), ec.ExpectedAnswer, ec.UpdatedAt.Unix(), ec.ID)
+	return err
+}
+
+// DeleteEvalCase removes a test question; past runs keep their results
+func (s *Store) DeleteEvalCase(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM eval_cases WHERE id = ?`, id)
+	return err
+}
+
+// CreateEvalRun records a run as running, unless the notebook already has
+// one running, which is returned as errEvalRunning
+func (s *Store) CreateEvalRun(ctx context.Context, run *EvalRun) error {
+	run.ID = uuid.New().String()
+	run.Status = JobRunning
+	run.StartedAt = time.Now()
+	promptsJSON, _ := json.Marshal(run.Prompts)
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO eval_runs (id, notebook_id, status, prompts, cases, started_at)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM eval_runs WHERE notebook_id = ? AND status = ?)
+	`, run.ID, run.NotebookID, run.Status, string(promptsJSON), run.Cases, run.StartedAt.UnixMilli(), run.NotebookID, JobRunning)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEvalRunning
+	}
+	return nil
+}
+
+// FinishEvalRun saves a run's outcome
+func (s *Store) FinishEvalRun(ctx context.Context, run *EvalRun) error {
+	scoresJSON, _ := json.Marshal(run.EvalScores)
+	resultsJSON, _ := json.Marshal(run.Results)
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE eval_runs SET status = ?, error = ?, model = ?, failed = ?, scores = ?, results = ?, finished_at = ?
+		WHERE id = ?
+	`, run.Status, run.Error, run.Model, run.Failed, string(scoresJSON), string(resultsJSON), finishedAt.UnixMilli(), run.ID)
+	return err
+}
+
+// FailInterruptedEvalRuns marks the runs a restart cut short as failed
+func (s *Store) FailInterruptedEvalRuns(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE eval_runs SET status = ?, error = 'interrupted by a restart', finished_at = ? WHERE status = ?
+	`, JobFailed, time.Now().UnixMilli(), JobRunning)
+	return err
+}
+
+// GetEvalRun retrieves a run with its results
+func (s *Store) GetEvalRun(ctx context.Context, id string) (*EvalRun, error) {
+	rows, err := s.queryEvalRuns(ctx, true, `WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("eval run not found")
+	}
+	return &rows[0], nil
+}
+
+// ListEvalRuns retrieves a notebook's most recent runs without their
+// results, newest first
+func (s *Store) ListEvalRuns(ctx context.Context, notebookID string, limit int) ([]EvalRun, error) {
+	return s.queryEvalRuns(ctx, false, `WHERE notebook_id = ? ORDER BY started_at DESC, rowid DESC LIMIT ?`, notebookID, limit)
+}
+
+func (s *Store) queryEvalRuns(ctx context.Context, withResults bool, where string, args ...interface{}) ([]EvalRun, error) {
+	results := `''`
+	if withResults {
+		results = `results`
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, status, error, prompts, model, cases, failed, scores, `+results+`, started_at, finished_at
+		FROM eval_runs `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]EvalRun, 0)
+	for rows.Next() {
+		var run EvalRun
+		var promptsJSON, scoresJSON, resultsJSON string
+		var startedAt, finishedAt int64
+		if err := rows.Scan(&run.ID, &run.NotebookID, &run.Status, &run.Error, &promptsJSON, &run.Model, &run.Cases, &run.Failed,
+			&scoresJSON, &resultsJSON, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(promptsJSON), &run.Prompts)
+		json.Unmarshal([]byte(scoresJSON), &run.EvalScores)
+		if resultsJSON != "" {
+			json.Unmarshal([]byte(resultsJSON), &run.Results)
+		}
+		run.StartedAt = time.UnixMilli(startedAt)
+		if finishedAt > 0 {
+			t := time.UnixMilli(finishedAt)
+			run.FinishedAt = &t
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+var errEvalRunning = errors.New("an evaluation of this notebook is already running")
+
+// Running
+
+// answerScoreSchema is the shape answer grades are generated in
+var answerScoreSchema = &OutputSchema{Name: "answer_score", Schema: objectSchema(map[string]*jsonSchema{
+	"score":  {Type: "integer", Description: "1 to 5"},
+	"reason": stringSchema("one sentence on why"),
+})}
+
+func answerScorePrompt(question, expected, answer string) string {
+	return fmt.Sprintf("你是一个严格的评估员。请对照参考答案，评价回答对问题的回答质量，给出 1 到 5 的整数分：5 表示完整准确地涵盖了参考答案的要点；4 表示基本准确但略有遗漏；3 表示只涵盖部分要点；2 表示大部分缺失或含有错误；1 表示错误或没有回答问题。措辞和语言不同不扣分。reason 用一句话说明理由。\n\n## 问题\n%s\n\n## 参考答案\n%s\n\n## 回答\n%s\n", question, expected, answer)
+}
+
+// scoreAnswer has the LLM grade an answer against the expected one
+func (a *Agent) scoreAnswer(ctx context.Context, question, expected, answer string) (float64, string, error) {
+	var out struct {
+		Score  int    `json:"score"`
+		Reason string `json:"reason"`
+	}
+	if _, _, _, err := a.generateJSON(ctx, answerScoreSchema, answerScorePrompt(question, expected, answer), &out); err != nil {
+		return 0, "", err
+	}
+	score := min(max(out.Score, 1), 5)
+	return float64(score), strings.TrimSpace(out.Reason), nil
+}
+
+// share returns n of total as a fraction, or nil when total is 0
+func share(n, total int) *float64 {
+	if total == 0 {
+		return nil
+	}
+	f := float64(n) / float64(total)
+	return &f
+}
+
+// overlap counts the ids that are also in expected
+func overlap(ids, expected []string) int {
+	n := 0
+	for _, id := range ids {
+		if slices.Contains(expected, id) {
+			n++
+		}
+	}
+	return n
+}
+
+// evaluateCase answers a case as the notebook's chat would, without
+// history, and measures the answer
+func (s *Server) evaluateCase(ctx context.Context, ec *EvalCase) EvalResult {
+	result := EvalResult{CaseID: ec.ID, Question: ec.Question, RetrievedSourceIDs: []string{}, CitedSourceIDs: []string{}}
+	ctx, cancel := withTimeout(ctx, s.cfg.LLMTimeout)
+	defer cancel()
+
+	settings, err := s.store.GetChatSettings(ctx, ec.NotebookID)
+	if err != nil {
+		golog.Errorf("failed to load chat settings: %v", err)
+	}
+	agent := s.notebookAgent(ctx, ec.NotebookID)
+	response, err := agent.Chat(ctx, ec.NotebookID, ec.Question, nil, ChatOptions{
+		Settings:        settings,
+		Tools:           s.notebookTools(settings),
+		NotebookIDs:     []string{ec.NotebookID},
+		Language:        s.notebookLanguage(ctx, ec.NotebookID),
+		VerifyCitations: true,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Answer = response.Message
+	if answered, ok := response.Metadata["answered_by"].(AnsweredBy); ok {
+		result.Model = answered.Model
+	}
+
+	for _, src := range response.Sources {
+		if src.Type != "web" {
+			result.RetrievedSourceIDs = append(result.RetrievedSourceIDs, src.ID)
+		}
+	}
+	if check, ok := response.Metadata["citation_check"].(*CitationCheck); ok {
+		supported := 0
+		for _, claim := range check.Claims {
+			if claim.Verdict == CitationSupported {
+				supported++
+			}
+			for _, id := range claim.SourceIDs {
+				if !slices.Contains(result.CitedSourceIDs, id) {
+					result.CitedSourceIDs = append(result.CitedSourceIDs, id)
+				}
+			}
+		}
+		result.Supported = share(supported, check.Checked)
+	}
+	if len(ec.ExpectedSourceIDs) > 0 {
+		result.RetrievalRecall = share(overlap(result.RetrievedSourceIDs, ec.ExpectedSourceIDs), len(ec.ExpectedSourceIDs))
+		result.CitationPrecision = share(overlap(result.CitedSourceIDs, ec.ExpectedSourceIDs), len(result.CitedSourceIDs))
+		result.CitationRecall = share(overlap(result.CitedSourceIDs, ec.ExpectedSourceIDs), len(ec.ExpectedSourceIDs))
+	}
+
+	if ec.ExpectedAnswer != "" {
+		score, reason, err := agent.scoreAnswer(ctx, ec.Question, ec.ExpectedAnswer, response.Message)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to score the answer: %v", err)
+		} else {
+			result.AnswerScore, result.Reason = &score, reason
+		}
+	}
+	return result
+}
+
+// meanScores averages each measure over the results it applies to
+func meanScores(results []EvalResult) EvalScores {
+	var sums [5]float64
+	var counts [5]int
+	for _, r := range results {
+		for i, v := range []*float64{r.RetrievalRecall, r.CitationPrecision, r.CitationRecall, r.Supported, r.AnswerScore} {
+			if v != nil {
+				sums[i] += *v
+				counts[i]++
+			}
+		}
+	}
+	mean := func(i int) *float64 {
+		if counts[i] == 0 {
+			return nil
+		}
+		m := sums[i] / float64(counts[i])
+		return &m
+	}
+	return EvalScores{RetrievalRecall: mean(0), CitationPrecision: mean(1), CitationRecall: mean(2), Supported: mean(3), AnswerScore: mean(4)}
+}
+
+// startEvalRun records a run of a notebook's cases and answers them in the
+// background, one at a time
+func (s *Server) startEvalRun(ctx context.Context, notebookID string, cases []EvalCase) (*EvalRun, error) {
+	run := &EvalRun{
+		NotebookID: notebookID,
+		Cases:      len(cases),
+		Prompts: map[string]int{
+			evalPromptChat:    s.prompts.activeVersion(evalPromptChat),
+			evalPromptPersona: s.prompts.activeVersion(evalPromptPersona),
+		},
+	}
+	if err := s.store.CreateEvalRun(ctx, run); err != nil {
+		return nil, err
+	}
+
+	started := *run
+	s.runJob(func() {
+		ctx := context.Background()
+		for i := range cases {
+			select {
+			case <-s.stopping:
+				run.Status, run.Error = JobFailed, "stopped by a shutdown"
+			default:
+			}
+			if run.Status == JobFailed {
+				break
+			}
+			result := s.evaluateCase(ctx, &cases[i])
+			if result.Error != "" {
+				run.Failed++
+			}
+			if run.Model == "" {
+				run.Model = result.Model
+			}
+			run.Results = append(run.Results, result)
+		}
+		run.EvalScores = meanScores(run.Results)
+		if run.Status != JobFailed {
+			run.Status = JobCompleted
+		}
+		if err := s.store.FinishEvalRun(ctx, run); err != nil {
+			golog.Errorf("failed to save eval run %s: %v", run.ID, err)
+		}
+		golog.Infof("eval run %s of notebook %s finished: %d cases, %d failed", run.ID, notebookID, len(run.Results), run.Failed)
+	})
+	return &started, nil
+}
+
+// Handlers
+
+// validateEvalCase trims a case and checks its expected sources belong to
+// the notebook
+func (s *Server) validateEvalCase(ctx context.Context, ec *EvalCase) error {
+	var fields fieldErrors
+	ec.Question = strings.TrimSpace(ec.Question)
+	ec.ExpectedAnswer = strings.TrimSpace(ec.ExpectedAnswer)
+	if ec.Question == "" {
+		fields.add("question", "is required")
+	}
+	if ec.ExpectedSourceIDs == nil {
+		ec.ExpectedSourceIDs = []string{}
+	}
+	if len(ec.ExpectedSourceIDs) == 0 && ec.ExpectedAnswer == "" {
+		fields.add("expected_source_ids", "or expected_answer is required")
+	}
+	for _, id := range ec.ExpectedSourceIDs {
+		if src, err := s.store.GetSource(ctx, id); err != nil || src.NotebookID != ec.NotebookID {
+			fields.add("expected_source_ids", "%s is not a source of this notebook", id)
+		}
+	}
+	return fields.err()
+}
+
+// notebookEvalCase loads :caseId and checks it belongs to :id
+func (s *Server) notebookEvalCase(c *gin.Context) (*EvalCase, bool) {
+	ec, err := s.store.GetEvalCase(c.Request.Context(), c.Param("caseId"))
+	if err != nil || ec.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Eval case not found"})
+		return nil, false
+	}
+	return ec, true
+}
+
+func (s *Server) handleListEvalCases(c *gin.Context) {
+	cases, err := s.store.ListEvalCases(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list eval cases"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cases": cases})
+}
+
+func (s *Server) handleCreateEvalCase(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+	var ec EvalCase
+	if !bindJSON(c, &ec) {
+		return
+	}
+	ec.NotebookID = notebookID
+	if validationResponse(c, s.validateEvalCase(ctx, &ec)) {
+		return
+	}
+	if cases, err := s.store.ListEvalCases(ctx, notebookID); err == nil && len(cases) >= maxEvalCases {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: fmt.Sprintf("A notebook can have at most %d eval cases", maxEvalCases)})
+		return
+	}
+
+	if err := s.store.CreateEvalCase(ctx, &ec); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create eval case"})
+		return
+	}
+	c.JSON(http.StatusCreated, ec)
+}
+
+func (s *Server) handleUpdateEvalCase(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	existing, ok := s.notebookEvalCase(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Question          string   `json:"question"`
+		ExpectedSourceIDs []string `json:"expected_source_ids"`
+		ExpectedAnswer    string   `json:"expected_answer"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ec := *existing
+	ec.Question, ec.ExpectedSourceIDs, ec.ExpectedAnswer = req.Question, req.ExpectedSourceIDs, req.ExpectedAnswer
+	if validationResponse(c, s.validateEvalCase(ctx, &ec)) {
+		return
+	}
+
+	if err := s.store.UpdateEvalCase(ctx, &ec); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update eval case"})
+		return
+	}
+	c.JSON(http.StatusOK, ec)
+}
+
+func (s *Server) handleDeleteEvalCase(c *gin.Context) {
+	ec, ok := s.notebookEvalCase(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteEvalCase(c.Request.Context(), ec.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete eval case"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleStartEvalRun runs every case of the notebook in the background; the
+// run is polled for its results
+func (s *Server) handleStartEvalRun(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+	cases, err := s.store.ListEvalCases(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list eval cases"})
+		return
+	}
+	if len(cases) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "The notebook has no eval cases"})
+		return
+	}
+
+	run, err := s.startEvalRun(ctx, notebookID, cases)
+	if errors.Is(err, errEvalRunning) {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to start eval run"})
+		return
+	}
+	c.JSON(http.StatusAccepted, run)
+}
+
+func (s *Server) handleListEvalRuns(c *gin.Context) {
+	runs, err := s.store.ListEvalRuns(c.Request.Context(), c.Param("id"), 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list eval runs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+func (s *Server) handleGetEvalRun(c *gin.Context) {
+	run, err := s.store.GetEvalRun(c.Request.Context(), c.Param("runId"))
+	if err != nil || run.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Eval run not found"})
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// StoreEvent is a change made to the data. The CachedStore emits one as it
+// makes the change, to drop the cached data; the handlers of the server's
+// side effects get them from the outbox.
+type StoreEvent struct {
+	Kind string // ChangeNotebook, ChangeNote, ChangeSource or ChangeChatSession
+	Op   string // ChangeCreated, ChangeUpdated or ChangeDeleted
+	ID   string
+	// NotebookID is the notebook the item is in, or the notebook itself
+	NotebookID string
+	// PreviousNotebookID is the notebook an updated note moved out of
+	PreviousNotebookID string
+	// WorkspaceID is set for notebook events, which may outlive the notebook
+	WorkspaceID string
+	// Note and Source are the item as it was when the event was delivered,
+	// unless it was deleted by then
+	Note   *Note
+	Source *Source
+	Time   time.Time
+}
+
+// Type names the event the way WebSocket clients see it, e.g. "note.created"
+func (ev StoreEvent) Type() string {
+	return ev.Kind + "." + ev.Op
+}
+
+// storeEventHandler reacts to a store event. Handlers run one event at a
+// time, so they must be quick and hand slow work off, and may see an event
+// again after a crash.
+type storeEventHandler func(ctx context.Context, ev StoreEvent)
+
+// eventBus passes store events to its handlers, in the order they subscribed
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers []storeEventHandler
+}
+
+// subscribe adds a handler for every later event
+func (b *eventBus) subscribe(h storeEventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// emit passes ev to every handler
+func (b *eventBus) emit(ctx context.Context, ev StoreEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		h(ctx, ev)
+	}
+}
+
+// subscribeStoreEvents connects the side effects of data changes to the
+// events delivered from the outbox, and has changes made through the store
+// delivered at once
+func (s *Server) subscribeStoreEvents() {
+	s.store.Subscribe(func(context.Context, StoreEvent) { s.outbox.notify() })
+	s.outbox.subscribe(s.pushStoreEvent)
+	s.outbox.subscribe(s.indexEntitiesOnCreate)
+	s.outbox.subscribe(s.syncVectorsOnChange)
+}
+
+// pushStoreEvent tells the WebSocket clients of the item's workspace about
+// a change. Workspaces without members are open to every caller, so their
+// changes go to every client.
+func (s *Server) pushStoreEvent(ctx context.Context, ev StoreEvent) {
+	workspaceID := ev.WorkspaceID
+	if workspaceID == "" {
+		nb, err := s.store.GetNotebook(ctx, ev.NotebookID)
+		if err != nil {
+			return
+		}
+		workspaceID = nb.WorkspaceID
+	}
+	members, err := s.store.ListWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		golog.Warnf("failed to list members of workspace %s for %s: %v", workspaceID, ev.Type(), err)
+		return
+	}
+
+	data := gin.H{"id": ev.ID, "notebook_id": ev.NotebookID}
+	if ev.PreviousNotebookID != "" && ev.PreviousNotebookID != ev.NotebookID {
+		data["previous_notebook_id"] = ev.PreviousNotebookID
+	}
+	out := Event{Type: ev.Type(), Data: data, Time: ev.Time}
+	if len(members) == 0 {
+		s.events.publishAll(out)
+	}
+	for _, m := range members {
+		s.events.publishUser(m.UserID, out)
+	}
+}
+
+// indexEntitiesOnCreate indexes the entities of new notes and sources
+func (s *Server) indexEntitiesOnCreate(ctx context.Context, ev StoreEvent) {
+	if ev.Op != ChangeCreated {
+		return
+	}
+	switch {
+	case ev.Note != nil:
+		s.extractEntitiesLater(ev.NotebookID, "", ev.ID, ev.Note.Title, ev.Note.Content)
+	case ev.Source != nil:
+		s.extractEntitiesLater(ev.NotebookID, ev.ID, "", ev.Source.Name, ev.Source.Content)
+	}
+}
+
+// syncVectorsOnChange keeps the vector store in step with the sources:
+// deleted sources and notebooks lose their chunks, and a source's retrieval
+// setting applies at once
+func (s *Server) syncVectorsOnChange(ctx context.Context, ev StoreEvent) {
+	switch {
+	case ev.Kind == ChangeNotebook && ev.Op == ChangeDeleted:
+		s.vectorMutex.Lock()
+		s.unloadNotebook(ev.ID, true)
+		s.vectorMutex.Unlock()
+	case ev.Kind == ChangeSource && ev.Op == ChangeDeleted:
+		s.vectorStore.DeleteSource(ctx, ev.ID)
+	case ev.Kind == ChangeSource && ev.Op == ChangeUpdated && ev.Source != nil:
+		s.vectorStore.SetSourceExcluded(ev.ID, !ev.Source.IncludedInRetrieval)
+	}
+}
@@ -0,0 +1,627 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Experiment statuses
+const (
+	ExperimentRunning = "running"
+	ExperimentStopped = "stopped"
+)
+
+const (
+	// maxExperimentVariants bounds the variants of an experiment
+	maxExperimentVariants = 5
+	// maxNeighborChunks bounds how far a variant widens retrieved chunks
+	maxNeighborChunks = 3
+	// rerankCandidates is how many times the passages a reranking variant
+	// retrieves before the LLM picks the best
+	rerankCandidates = 3
+)
+
+// ExperimentVariant is one arm of an experiment: how sources are retrieved
+// and which chat prompt answers. Zero values keep the notebook's defaults.
+type ExperimentVariant struct {
+	Name string `json:"name"`
+	// Weight is the variant's share of chat sessions relative to the others
+	Weight int `json:"weight"`
+	// MaxSources is how many passages are retrieved; 0 is MAX_SOURCES
+	MaxSources int `json:"max_sources,omitempty"`
+	// NeighborChunks joins each passage with this many chunks of its source
+	// on either side, standing in for a larger chunk size
+	NeighborChunks int `json:"neighbor_chunks,omitempty"`
+	// Retriever is RetrieverHybrid, RetrieverKeyword or RetrieverSemantic
+	Retriever string `json:"retriever,omitempty"`
+	// Rerank has the LLM reorder a wider set of passages before answering
+	Rerank bool `json:"rerank"`
+	// PromptVersion is a stored version of the chat prompt; 0 is the active one
+	PromptVersion int `json:"prompt_version,omitempty"`
+}
+
+// Experiment splits a notebook's chat sessions between variants, so their
+// answers can be compared by the feedback they get
+type Experiment struct {
+	ID          string              `json:"id"`
+	NotebookID  string              `json:"notebook_id"`
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Status      string              `json:"status"`
+	Variants    []ExperimentVariant `json:"variants"`
+	CreatedAt   time.Time           `json:"created_at"`
+	StoppedAt   *time.Time          `json:"stopped_at,omitempty"`
+}
+
+// ExperimentAssignment records the variant that answered a message
+type ExperimentAssignment struct {
+	ExperimentID string `json:"id"`
+	Variant      string `json:"variant"`
+}
+
+// VariantResult sums up the answers a variant gave and how they were rated
+type VariantResult struct {
+	Variant  string `json:"variant"`
+	Messages int    `json:"messages"`
+	Rated    int    `json:"rated"`
+	Positive int    `json:"positive"`
+	Negative int    `json:"negative"`
+	// PositiveRate is the share of rated answers rated positively, null
+	// while none are rated
+	PositiveRate *float64 `json:"positive_rate"`
+}
+
+// MessageFeedback is a user's rating of a chat answer: 1 for good, -1 for bad
+type MessageFeedback struct {
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Rating    int       `json:"rating"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errExperimentRunning = errors.New("the notebook already has a running experiment; stop it first")
+
+// variantFor picks the variant of a chat session. A session always gets the
+// same variant, so a conversation is answered one way throughout.
+func (e *Experiment) variantFor(sessionID string) *ExperimentVariant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.ID + ":" + sessionID))
+	n := int(h.Sum32() % uint32(total))
+	for i := range e.Variants {
+		if n < e.Variants[i].Weight {
+			return &e.Variants[i]
+		}
+		n -= e.Variants[i].Weight
+	}
+	return nil
+}
+
+// Store
+
+const experimentColumns = `id, notebook_id, name, description, status, variants, created_at, stopped_at`
+
+func scanExperiment(row rowScanner) (*Experiment, error) {
+	var e Experiment
+	var variantsJSON string
+	var createdAt, stoppedAt int64
+	if err := row.Scan(&e.ID, &e.NotebookID, &e.Name, &e.Description, &e.Status, &variantsJSON, &createdAt, &stoppedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(variantsJSON), &e.Variants)
+	e.CreatedAt = time.Unix(createdAt, 0)
+	if stoppedAt > 0 {
+		t := time.Unix(stoppedAt, 0)
+		e.StoppedAt = &t
+	}
+	return &e, nil
+}
+
+// CreateExperiment starts an experiment, unless the notebook already has one
+// running, which is returned as errExperimentRunning
+func (s *Store) CreateExperiment(ctx context.Context, e *Experiment) error {
+	e.ID = uuid.New().String()
+	e.Status = ExperimentRunning
+	e.CreatedAt = time.Now()
+	variantsJSON, _ := json.Marshal(e.Variants)
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO experiments (id, notebook_id, name, description, status, variants, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM experiments WHERE notebook_id = ? AND status = ?)
+	`, e.ID, e.NotebookID, e.Name, e.Description, e.Status, string(variantsJSON), e.CreatedAt.Unix(), e.NotebookID, ExperimentRunning)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errExperimentRunning
+	}
+	return nil
+}
+
+// GetExperiment retrieves an experiment
+func (s *Store) GetExperiment(ctx context.Context, id string) (*Experiment, error) {
+	e, err := scanExperiment(s.db.QueryRowContext(ctx, `SELECT `+experimentColumns+` FROM experiments WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("experiment not found")
+	}
+	return e, err
+}
+
+// RunningExperiment retrieves a notebook's running experiment, or nil when
+// it has none
+func (s *Store) RunningExperiment(ctx context.Context, notebookID string) (*Experiment, error) {
+	e, err := scanExperiment(s.db.QueryRowContext(ctx, `
+		SELECT `+experimentColumns+` FROM experiments WHERE notebook_id = ? AND status = ?
+	`, notebookID, ExperimentRunning))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+// ListExperiments retrieves a notebook's experiments, newest first
+func (s *Store) ListExperiments(ctx context.Context, notebookID string) ([]Experiment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+experimentColumns+` FROM experiments WHERE notebook_id = ? ORDER BY created_at DESC, rowid DESC
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	experiments := make([]Experiment, 0)
+	for rows.Next() {
+		e, err := scanExperiment(rows)
+		if err != nil {
+			return nil, err
+		}
+		experiments = append(experiments, *e)
+	}
+	return experiments, rows.Err()
+}
+
+// StopExperiment ends an experiment; its results are kept
+func (s *Store) StopExperiment(ctx context.Context, e *Experiment) error {
+	stoppedAt := time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE experiments SET status = ?, stopped_at = ? WHERE id = ? AND status = ?
+	`, ExperimentStopped, stoppedAt.Unix(), e.ID, ExperimentRunning)
+	if err != nil {
+		return err
+	}
+	e.Status, e.StoppedAt = ExperimentStopped, &stoppedAt
+	return nil
+}
+
+// DeleteExperiment removes an experiment. The answers it served keep their
+// variant in their metadata.
+func (s *Store) DeleteExperiment(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM experiments WHERE id = ?`, id)
+	return err
+}
+
+// ExperimentResults counts each variant's answers and their ratings, from
+// the chat messages still kept
+func (s *Store) ExperimentResults(ctx context.Context, e *Experiment) ([]VariantResult, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT json_extract(m.metadata, '$.experiment.variant') AS variant, COUNT(*),
+			COUNT(f.rating), COALESCE(SUM(f.rating > 0), 0), COALESCE(SUM(f.rating < 0), 0)
+		FROM chat_messages m
+		JOIN chat_sessions cs ON cs.id = m.session_id
+		LEFT JOIN message_feedback f ON f.message_id = m.id
+		WHERE cs.notebook_id = ? AND m.role = 'assistant' AND json_extract(m.metadata, '$.experiment.id') = ?
+		GROUP BY variant
+	`, e.NotebookID, e.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]VariantResult)
+	for rows.Next() {
+		var r VariantResult
+		if err := rows.Scan(&r.Variant, &r.Messages, &r.Rated, &r.Positive, &r.Negative); err != nil {
+			return nil, err
+		}
+		counts[r.Variant] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]VariantResult, len(e.Variants))
+	for i, v := range e.Variants {
+		r := counts[v.Name]
+		r.Variant = v.Name
+		r.PositiveRate = share(r.Positive, r.Rated)
+		results[i] = r
+	}
+	return results, nil
+}
+
+// SetMessageFeedback saves a rating of an answer, replacing an earlier one
+func (s *Store) SetMessageFeedback(ctx context.Context, f *MessageFeedback) error {
+	f.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO message_feedback (message_id, user_id, rating, comment, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(message_id) DO UPDATE SET
+			user_id = excluded.user_id, rating = excluded.rating,
+			comment = excluded.comment, created_at = excluded.created_at
+	`, f.MessageID, f.UserID, f.Rating, f.Comment, f.CreatedAt.Unix())
+	return err
+}
+
+// SessionRatings retrieves the ratings of a chat session's answers by
+// message ID
+func (s *Store) SessionRatings(ctx context.Context, sessionID string) (map[string]int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT f.message_id, f.rating FROM message_feedback f
+		JOIN chat_messages m ON m.id = f.message_id
+		WHERE m.session_id = ?
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := make(map[string]int)
+	for rows.Next() {
+		var messageID string
+		var rating int
+		if err := rows.Scan(&messageID, &rating); err != nil {
+			return nil, err
+		}
+		ratings[messageID] = rating
+	}
+	return ratings, rows.Err()
+}
+
+// DeleteMessageFeedback removes the rating of an answer
+func (s *Store) DeleteMessageFeedback(ctx context.Context, messageID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM message_feedback WHERE message_id = ?`, messageID)
+	return err
+}
+
+// Answering
+
+// rerankSchema is the shape passage rankings are generated in
+var rerankSchema = &OutputSchema{Name: "rerank", Schema: objectSchema(map[string]*jsonSchema{
+	"passages": {Type: "array", Description: "passage numbers, most relevant first", Items: &jsonSchema{Type: "integer"}},
+})}
+
+func rerankPrompt(question string, docs []schema.Document) string {
+	var b strings.Builder
+	b.WriteString("你是一个检索结果排序器。请按与问题的相关程度，从高到低列出最能帮助回答问题的段落编号，不相关的段落不要列出。\n\n## 问题\n")
+	b.WriteString(question)
+	b.WriteString("\n")
+	for i, doc := range docs {
+		fmt.Fprintf(&b, "\n## 段落 %d\n%s\n", i+1, doc.PageContent)
+	}
+	return b.String()
+}
+
+// rerank has the LLM order the passages by relevance and keeps the first n.
+// Passages it leaves out follow in their retrieved order, so a failed or
+// partial ranking still answers from the best of what was retrieved.
+func (a *Agent) rerank(ctx context.Context, question string, docs []schema.Document, n int) []schema.Document {
+	if len(docs) <= 1 {
+		return docs
+	}
+	var out struct {
+		Passages []int `json:"passages"`
+	}
+	if _, _, _, err := a.generateJSON(ctx, rerankSchema, rerankPrompt(question, docs), &out); err != nil {
+		golog.Warnf("failed to rerank passages, keeping the retrieved order: %v", err)
+	}
+
+	ranked := make([]schema.Document, 0, len(docs))
+	used := make([]bool, len(docs))
+	for _, p := range out.Passages {
+		if p >= 1 && p <= len(docs) && !used[p-1] {
+			used[p-1] = true
+			ranked = append(ranked, docs[p-1])
+		}
+	}
+	for i, doc := range docs {
+		if !used[i] {
+			ranked = append(ranked, doc)
+		}
+	}
+	return ranked[:min(n, len(ranked))]
+}
+
+// retrieveVariant retrieves the passages of a chat the way a variant does
+func (a *Agent) retrieveVariant(ctx context.Context, message string, notebookIDs []string, v *ExperimentVariant) ([]schema.Document, error) {
+	numDocs := a.cfg.MaxSources
+	if v.MaxSources > 0 {
+		numDocs = v.MaxSources
+	}
+	candidates := numDocs
+	if v.Rerank {
+		candidates *= rerankCandidates
+	}
+	docs, err := a.vectorStore.Retrieve(ctx, message, candidates, notebookIDs, v.Retriever)
+	if err != nil {
+		return nil, err
+	}
+	if v.Rerank {
+		docs = a.rerank(ctx, message, docs, numDocs)
+	}
+	return a.vectorStore.widenPassages(docs, v.NeighborChunks), nil
+}
+
+// applyExperiment assigns a chat session to a variant of the notebook's
+// running experiment, if any, setting up opts to answer as it does
+func (s *Server) applyExperiment(ctx context.Context, notebookID, sessionID string, opts *ChatOptions) *ExperimentAssignment {
+	e, err := s.store.RunningExperiment(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to load the running experiment: %v", err)
+		return nil
+	}
+	if e == nil {
+		return nil
+	}
+	v := e.variantFor(sessionID)
+	if v == nil {
+		return nil
+	}
+	if v.PromptVersion > 0 {
+		version, err := s.store.getPromptVersion(ctx, "chat", v.PromptVersion)
+		if err != nil {
+			// Deleted since the experiment started; the session is left out
+			golog.Errorf("experiment %s: variant %s: %v", e.ID, v.Name, err)
+			return nil
+		}
+		opts.ChatPrompt = version.Template
+	}
+	opts.Variant = v
+	return &ExperimentAssignment{ExperimentID: e.ID, Variant: v.Name}
+}
+
+// getPromptVersion retrieves a stored version of a prompt
+func (s *Store) getPromptVersion(ctx context.Context, name string, version int) (*PromptVersion, error) {
+	versions, err := s.queryPromptVersions(ctx, `
+		SELECT name, version, template, description, active, created_at
+		FROM prompt_templates WHERE name = ? AND version = ?
+	`, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errPromptVersionNotFound
+	}
+	return &versions[0], nil
+}
+
+// Handlers
+
+// validateExperiment trims an experiment and checks its variants
+func (s *Server) validateExperiment(ctx context.Context, e *Experiment) error {
+	var fields fieldErrors
+	e.Name = strings.TrimSpace(e.Name)
+	e.Description = strings.TrimSpace(e.Description)
+	if e.Name == "" {
+		fields.add("name", "is required")
+	}
+	if len(e.Variants) < 2 || len(e.Variants) > maxExperimentVariants {
+		fields.add("variants", "must have 2 to %d variants", maxExperimentVariants)
+	}
+
+	names := make(map[string]bool)
+	for i := range e.Variants {
+		v := &e.Variants[i]
+		field := fmt.Sprintf("variants[%d]", i)
+		v.Name = strings.TrimSpace(v.Name)
+		switch {
+		case v.Name == "":
+			fields.add(field+".name", "is required")
+		case names[v.Name]:
+			fields.add(field+".name", "%q is used by another variant", v.Name)
+		}
+		names[v.Name] = true
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		if v.Weight < 1 || v.Weight > 100 {
+			fields.add(field+".weight", "must be between 1 and 100")
+		}
+		if v.MaxSources < 0 || v.MaxSources > 50 {
+			fields.add(field+".max_sources", "must be between 0 and 50")
+		}
+		if v.NeighborChunks < 0 || v.NeighborChunks > maxNeighborChunks {
+			fields.add(field+".neighbor_chunks", "must be between 0 and %d", maxNeighborChunks)
+		}
+		switch v.Retriever {
+		case "", RetrieverHybrid, RetrieverKeyword, RetrieverSemantic:
+		default:
+			fields.add(field+".retriever", "must be %s, %s or %s", RetrieverHybrid, RetrieverKeyword, RetrieverSemantic)
+		}
+		if v.PromptVersion < 0 {
+			fields.add(field+".prompt_version", "must not be negative")
+		} else if v.PromptVersion > 0 {
+			if _, err := s.store.getPromptVersion(ctx, "chat", v.PromptVersion); err != nil {
+				fields.add(field+".prompt_version", "chat prompt version %d does not exist", v.PromptVersion)
+			}
+		}
+	}
+	return fields.err()
+}
+
+// notebookExperiment loads :experimentId and checks it belongs to :id
+func (s *Server) notebookExperiment(c *gin.Context) (*Experiment, bool) {
+	e, err := s.store.GetExperiment(c.Request.Context(), c.Param("experimentId"))
+	if err != nil || e.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Experiment not found"})
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *Server) handleListExperiments(c *gin.Context) {
+	experiments, err := s.store.ListExperiments(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list experiments"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"experiments": experiments})
+}
+
+// handleCreateExperiment starts an experiment; chat sessions are split
+// between its variants from then on
+func (s *Server) handleCreateExperiment(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+	var e Experiment
+	if !bindJSON(c, &e) {
+		return
+	}
+	e.NotebookID = notebookID
+	if validationResponse(c, s.validateExperiment(ctx, &e)) {
+		return
+	}
+
+	err := s.store.CreateExperiment(ctx, &e)
+	if errors.Is(err, errExperimentRunning) {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create experiment"})
+		return
+	}
+	c.JSON(http.StatusCreated, e)
+}
+
+func (s *Server) handleGetExperiment(c *gin.Context) {
+	e, ok := s.notebookExperiment(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+func (s *Server) handleStopExperiment(c *gin.Context) {
+	e, ok := s.notebookExperiment(c)
+	if !ok {
+		return
+	}
+	if e.Status == ExperimentRunning {
+		if err := s.store.StopExperiment(c.Request.Context(), e); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to stop experiment"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+func (s *Server) handleDeleteExperiment(c *gin.Context) {
+	e, ok := s.notebookExperiment(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteExperiment(c.Request.Context(), e.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete experiment"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleExperimentResults sums up the answers and ratings of each variant
+func (s *Server) handleExperimentResults(c *gin.Context) {
+	e, ok := s.notebookExperiment(c)
+	if !ok {
+		return
+	}
+	results, err := s.store.ExperimentResults(c.Request.Context(), e)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to sum up experiment results"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"experiment": e, "variants": results})
+}
+
+// chatAnswer loads :messageId and checks it is an answer in :sessionId of :id
+func (s *Server) chatAnswer(c *gin.Context) (*ChatMessage, bool) {
+	ctx := c.Request.Context()
+	session, err := s.store.GetChatSession(ctx, c.Param("sessionId"))
+	if err != nil || session.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat session not found"})
+		return nil, false
+	}
+	msg, err := s.store.getChatMessage(ctx, c.Param("messageId"))
+	if err != nil || msg.SessionID != session.ID || msg.Role != "assistant" {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat answer not found"})
+		return nil, false
+	}
+	return msg, true
+}
+
+// handleSetMessageFeedback rates an answer
+func (s *Server) handleSetMessageFeedback(c *gin.Context) {
+	msg, ok := s.chatAnswer(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Rating  int    `json:"rating"`
+		Comment string `json:"comment"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	var fields fieldErrors
+	if req.Rating != 1 && req.Rating != -1 {
+		fields.add("rating", "must be 1 or -1")
+	}
+	if len(req.Comment) > 2000 {
+		fields.add("comment", "must be at most 2000 bytes")
+	}
+	if validationResponse(c, fields.err()) {
+		return
+	}
+
+	f := MessageFeedback{MessageID: msg.ID, UserID: settingsOwner(c), Rating: req.Rating, Comment: strings.TrimSpace(req.Comment)}
+	if err := s.store.SetMessageFeedback(c.Request.Context(), &f); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save feedback"})
+		return
+	}
+	c.JSON(http.StatusOK, f)
+}
+
+func (s *Server) handleDeleteMessageFeedback(c *gin.Context) {
+	msg, ok := s.chatAnswer(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteMessageFeedback(c.Request.Context(), msg.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete feedback"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
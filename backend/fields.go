@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fieldSelection is the fields a list request asked for with ?fields=a,b, so
+// sidebars can leave out note bodies and source text. A nil selection keeps
+// every field.
+type fieldSelection map[string]bool
+
+// jsonFields lists the JSON names of a struct type's fields, including those
+// of embedded structs
+func jsonFields(t reflect.Type, names map[string]bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" {
+			jsonFields(f.Type, names)
+			continue
+		}
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+}
+
+// parseFields reads ?fields= for a list of row, checking each name is a
+// field of it. id is always kept so clients can fetch the rest later.
+func parseFields(c *gin.Context, row interface{}) (fieldSelection, error) {
+	raw := strings.TrimSpace(c.Query("fields"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	known := map[string]bool{}
+	jsonFields(reflect.TypeOf(row), known)
+	selected := fieldSelection{"id": true}
+	var fields fieldErrors
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !known[name] {
+			names := make([]string, 0, len(known))
+			for n := range known {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			fields.add("fields", "unknown field %q; use %s", name, strings.Join(names, ", "))
+			continue
+		}
+		selected[name] = true
+	}
+	return selected, fields.err()
+}
+
+// project trims a row to the selected fields
+func (f fieldSelection) project(row interface{}) interface{} {
+	if f == nil {
+		return row
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return row
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return row
+	}
+	for name := range all {
+		if !f[name] {
+			delete(all, name)
+		}
+	}
+	return all
+}
+
+// projectRows trims every row of a slice to the selected fields
+func (f fieldSelection) projectRows(rows interface{}) interface{} {
+	if f == nil {
+		return rows
+	}
+	v := reflect.ValueOf(rows)
+	projected := make([]interface{}, v.Len())
+	for i := range projected {
+		projected[i] = f.project(v.Index(i).Interface())
+	}
+	return projected
+}
@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fineTuneMessage is a message of a fine-tuning example. Weight 0 keeps an
+// answer as context without training on it.
+type fineTuneMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Weight  *int   `json:"weight,omitempty"`
+}
+
+// fineTuneExample is one line of a fine-tuning file in the chat messages
+// format
+type fineTuneExample struct {
+	Messages []fineTuneMessage `json:"messages"`
+}
+
+// fineTuneExampleOf turns a chat session into a fine-tuning example, with
+// its text masked. Questions left unanswered are dropped. Answers rated
+// down, and with likedOnly those not rated up, are kept as context with
+// weight 0. Sessions with no answer left to train on give nil.
+func fineTuneExampleOf(masker *llmCallMasker, session *ChatSession, ratings map[string]int, likedOnly bool, system string) *fineTuneExample {
+	rd := masker.redactor.begin()
+	example := &fineTuneExample{}
+	if system != "" {
+		example.Messages = append(example.Messages, fineTuneMessage{Role: "system", Content: masker.maskText(rd, system)})
+	}
+
+	trained := 0
+	messages := session.Messages
+	for i := 0; i+1 < len(messages); i++ {
+		question, answer := messages[i], messages[i+1]
+		if question.Role != "user" || answer.Role != "assistant" ||
+			strings.TrimSpace(question.Content) == "" || strings.TrimSpace(answer.Content) == "" {
+			continue
+		}
+		reply := fineTuneMessage{Role: "assistant", Content: masker.maskText(rd, answer.Content)}
+		if rating := ratings[answer.ID]; rating < 0 || (likedOnly && rating == 0) {
+			zero := 0
+			reply.Weight = &zero
+		} else {
+			trained++
+		}
+		example.Messages = append(example.Messages,
+			fineTuneMessage{Role: "user", Content: masker.maskText(rd, question.Content)}, reply)
+		i++
+	}
+	if trained == 0 {
+		return nil
+	}
+	return example
+}
+
+// handleFineTuneExport downloads chat sessions as a JSONL fine-tuning file,
+// one session per line, with personal data and secrets masked
+func (s *Server) handleFineTuneExport(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+	var req struct {
+		// SessionIDs picks the sessions to export; empty exports them all
+		SessionIDs []string `json:"session_ids"`
+		// LikedOnly trains only on answers rated up
+		LikedOnly bool `json:"liked_only"`
+		// SystemPrompt starts every example when set
+		SystemPrompt string `json:"system_prompt"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	var sessionIDs []string
+	if len(req.SessionIDs) == 0 {
+		sessions, err := s.store.ListChatSessions(ctx, notebookID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list chat sessions"})
+			return
+		}
+		for _, session := range sessions {
+			sessionIDs = append(sessionIDs, session.ID)
+		}
+	} else {
+		sessionIDs = req.SessionIDs
+	}
+
+	masker := newLLMCallMasker(s.cfg)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	var fields fieldErrors
+	examples := 0
+	for _, id := range sessionIDs {
+		session, err := s.store.GetChatSession(ctx, id)
+		if err != nil || session.NotebookID != notebookID {
+			fields.add("session_ids", "%s is not a chat session of this notebook", id)
+			continue
+		}
+		ratings, err := s.store.SessionRatings(ctx, session.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load answer ratings"})
+			return
+		}
+		if example := fineTuneExampleOf(masker, session, ratings, req.LikedOnly, strings.TrimSpace(req.SystemPrompt)); example != nil {
+			enc.Encode(example)
+			examples++
+		}
+	}
+	if validationResponse(c, fields.err()) {
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(notebook.Name+"-finetune", "jsonl")))
+	c.Header("X-Example-Count", strconv.Itoa(examples))
+	c.Data(http.StatusOK, ndjsonContentType, buf.Bytes())
+}
@@ -0,0 +1,436 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// SourceFreshness records what was last seen upstream for a URL source
+type SourceFreshness struct {
+	SourceID        string    `json:"source_id"`
+	ETag            string    `json:"etag,omitempty"`
+	LastModified    string    `json:"last_modified,omitempty"`
+	UpstreamHash    string    `json:"upstream_hash,omitempty"`
+	UpstreamContent string    `json:"-"`
+	Stale           bool      `json:"stale"`
+	CheckedAt       time.Time `json:"checked_at"`
+	ChangedAt       time.Time `json:"changed_at,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// StaleSource pairs a source with its freshness state
+type StaleSource struct {
+	Source    Source          `json:"source"`
+	Freshness SourceFreshness `json:"freshness"`
+}
+
+// SourceFreshnessResponse is the freshness state of a source with the upstream diff
+type SourceFreshnessResponse struct {
+	SourceFreshness
+	Diff []DiffLine `json:"diff,omitempty"`
+}
+
+// DiffLine is one line of a line-based diff; Op is "+", "-" or " "
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// freshnessHTTPClient is used for the conditional HEAD requests
+var freshnessHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// GetSourceFreshness retrieves the freshness state of a source, returning an
+// unchecked state if the source has never been checked
+func (s *Store) GetSourceFreshness(ctx context.Context, sourceID string) (*SourceFreshness, error) {
+	f := SourceFreshness{SourceID: sourceID}
+	var checkedAt, changedAt int64
+	var stale int
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT etag, last_modified, upstream_hash, upstream_content, stale, checked_at, changed_at, error
+		FROM source_freshness WHERE source_id = ?
+	`, sourceID).Scan(&f.ETag, &f.LastModified, &f.UpstreamHash, &f.UpstreamContent, &stale, &checkedAt, &changedAt, &f.Error)
+	if err == sql.ErrNoRows {
+		return &f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f.Stale = stale == 1
+	f.CheckedAt = time.Unix(checkedAt, 0)
+	if changedAt > 0 {
+		f.ChangedAt = time.Unix(changedAt, 0)
+	}
+
+	return &f, nil
+}
+
+// SaveSourceFreshness stores the freshness state of a source
+func (s *Store) SaveSourceFreshness(ctx context.Context, f *SourceFreshness) error {
+	var changedAt int64
+	if !f.ChangedAt.IsZero() {
+		changedAt = f.ChangedAt.Unix()
+	}
+	stale := 0
+	if f.Stale {
+		stale = 1
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO source_freshness (source_id, etag, last_modified, upstream_hash, upstream_content, stale, checked_at, changed_at, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(source_id) DO UPDATE SET
+			etag = excluded.etag, last_modified = excluded.last_modified,
+			upstream_hash = excluded.upstream_hash, upstream_content = excluded.upstream_content,
+			stale = excluded.stale, checked_at = excluded.checked_at,
+			changed_at = excluded.changed_at, error = excluded.error
+	`, f.SourceID, f.ETag, f.LastModified, f.UpstreamHash, f.UpstreamContent, stale, f.CheckedAt.Unix(), changedAt, f.Error)
+
+	return err
+}
+
+// ListURLSources retrieves every URL source across notebooks
+func (s *Store) ListURLSources(ctx context.Context) ([]Source, error) {
+	return s.querySources(ctx, sourceSelect+` WHERE s.type = 'url' AND s.url != '' ORDER BY s.created_at ASC`)
+}
+
+// ListStaleSources retrieves the sources of a notebook whose upstream content changed
+func (s *Store) ListStaleSources(ctx context.Context, notebookID string) ([]StaleSource, error) {
+	sources, err := s.querySources(ctx, sourceSelect+`
+		JOIN source_freshness f ON f.source_id = s.id
+		WHERE s.notebook_id = ? AND f.stale = 1
+		ORDER BY f.changed_at DESC`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]StaleSource, 0, len(sources))
+	for _, src := range sources {
+		f, err := s.GetSourceFreshness(ctx, src.ID)
+		if err != nil {
+			return nil, err
+		}
+		src.Content = ""
+		result = append(result, StaleSource{Source: src, Freshness: *f})
+	}
+
+	return result, nil
+}
+
+// checkAllSources checks every URL source once
+func (s *Server) checkAllSources(ctx context.Context) error {
+	sources, err := s.store.ListURLSources(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list url sources: %w", err)
+	}
+
+	stale := 0
+	for i := range sources {
+		f, err := s.checkSourceFreshness(ctx, &sources[i])
+		if err != nil {
+			golog.Errorf("failed to check source %s: %v", sources[i].ID, err)
+			continue
+		}
+		if f.Stale {
+			stale++
+		}
+	}
+
+	golog.Infof("checked %d url sources, %d stale", len(sources), stale)
+	return nil
+}
+
+// checkSourceFreshness compares a source with its upstream URL. A conditional
+// HEAD request avoids refetching content that has not changed.
+func (s *Server) checkSourceFreshness(ctx context.Context, source *Source) (*SourceFreshness, error) {
+	f, err := s.store.GetSourceFreshness(ctx, source.ID)
+	if err != nil {
+		return nil, err
+	}
+	f.CheckedAt = time.Now()
+	f.Error = ""
+
+	etag, lastModified, notModified := headURL(ctx, source.URL, f.ETag, f.LastModified)
+	if notModified {
+		return f, s.store.SaveSourceFreshness(ctx, f)
+	}
+
+	content, err := s.vectorStore.ExtractFromURL(ctx, source.URL)
+	if err != nil {
+		f.Error = err.Error()
+		return f, s.store.SaveSourceFreshness(ctx, f)
+	}
+
+	f.ETag = etag
+	f.LastModified = lastModified
+	hash := ContentHash(content)
+	if hash == source.ContentHash {
+		f.Stale = false
+		f.UpstreamHash = hash
+		f.UpstreamContent = ""
+	} else {
+		if hash != f.UpstreamHash {
+			f.ChangedAt = f.CheckedAt
+			golog.Infof("source %s changed upstream at %s", source.ID, source.URL)
+		}
+		f.Stale = true
+		f.UpstreamHash = hash
+		f.UpstreamContent = content
+	}
+
+	return f, s.store.SaveSourceFreshness(ctx, f)
+}
+
+// headURL issues a conditional HEAD request and reports the validators and
+// whether the resource is known to be unchanged
+func headURL(ctx context.Context, url, etag, lastModified string) (string, string, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return "", "", false
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := freshnessHTTPClient.Do(req)
+	if err != nil {
+		return "", "", false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, lastModified, true
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", false
+	}
+
+	newETag := resp.Header.Get("ETag")
+	newLastModified := resp.Header.Get("Last-Modified")
+	unchanged := (etag != "" && newETag == etag) || (etag == "" && lastModified != "" && newLastModified == lastModified)
+
+	return newETag, newLastModified, unchanged
+}
+
+// refreshSource re-ingests a source with its latest upstream content
+func (s *Server) refreshSource(ctx context.Context, source *Source) error {
+	f, err := s.store.GetSourceFreshness(ctx, source.ID)
+	if err != nil {
+		return err
+	}
+
+	content := f.UpstreamContent
+	if content == "" {
+		content, err = s.vectorStore.ExtractFromURL(ctx, source.URL)
+		if err != nil {
+			return err
+		}
+	}
+
+	source.Content = content
+	if err := s.store.UpdateSource(ctx, source); err != nil {
+		return err
+	}
+
+	chunkCount, err := s.reindexSource(ctx, source)
+	if err != nil {
+		golog.Errorf("failed to reindex source %s: %v", source.ID, err)
+	} else {
+		source.ChunkCount = chunkCount
+		s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
+	}
+
+	f.Stale = false
+	f.UpstreamHash = source.ContentHash
+	f.UpstreamContent = ""
+	f.CheckedAt = time.Now()
+	return s.store.SaveSourceFreshness(ctx, f)
+}
+
+// Freshness handlers
+
+func (s *Server) handleListStaleSources(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	stale, err := s.store.ListStaleSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list stale sources"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stale)
+}
+
+func (s *Server) handleGetSourceFreshness(c *gin.Context) {
+	ctx := context.Background()
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	f, err := s.store.GetSourceFreshness(ctx, source.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get source freshness"})
+		return
+	}
+
+	resp := SourceFreshnessResponse{SourceFreshness: *f}
+	if f.Stale && f.UpstreamContent != "" {
+		resp.Diff = lineDiff(source.Content, f.UpstreamContent)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleCheckSource(c *gin.Context) {
+	ctx := context.Background()
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	if source.Type != "url" || source.URL == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Only URL sources can be checked"})
+		return
+	}
+
+	f, err := s.checkSourceFreshness(ctx, source)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to check source: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, f)
+}
+
+func (s *Server) handleRefreshSource(c *gin.Context) {
+	ctx := context.Background()
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	if source.URL == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Source has no URL to refresh from"})
+		return
+	}
+
+	if err := s.refreshSource(ctx, source); err != nil {
+		golog.Errorf("failed to refresh source %s: %v", source.ID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to refresh source: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, source)
+}
+
+// notebookSource loads the :sourceId source and checks it belongs to the :id notebook
+func (s *Server) notebookSource(c *gin.Context) (*Source, bool) {
+	source, err := s.store.GetSource(context.Background(), c.Param("sourceId"))
+	if err != nil || source.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Source not found"})
+		return nil, false
+	}
+	return source, true
+}
+
+// maxDiffCells bounds the work done by lineDiff
+const maxDiffCells = 4_000_000
+
+// lineDiff computes a line-based diff between two texts
+func lineDiff(oldText, newText string) []DiffLine {
+	a := strings.Split(oldText, "\n")
+	b := strings.Split(newText, "\n")
+
+	// Trim the common prefix and suffix
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	result := make([]DiffLine, 0)
+	for _, line := range a[:prefix] {
+		result = append(result, DiffLine{Op: " ", Text: line})
+	}
+
+	midA := a[prefix : len(a)-suffix]
+	midB := b[prefix : len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		for _, line := range midA {
+			result = append(result, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range midB {
+			result = append(result, DiffLine{Op: "+", Text: line})
+		}
+	} else {
+		result = append(result, lcsDiff(midA, midB)...)
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		result = append(result, DiffLine{Op: " ", Text: line})
+	}
+
+	return result
+}
+
+// lcsDiff diffs two line slices using a longest common subsequence table
+func lcsDiff(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	table := make([][]int, n+1)
+	for i := range table {
+		table[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else if table[i+1][j] >= table[i][j+1] {
+				table[i][j] = table[i+1][j]
+			} else {
+				table[i][j] = table[i][j+1]
+			}
+		}
+	}
+
+	result := make([]DiffLine, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, DiffLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case table[i+1][j] >= table[i][j+1]:
+			result = append(result, DiffLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			result = append(result, DiffLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		result = append(result, DiffLine{Op: "-", Text: a[i]})
+	}
+	for ; j < m; j++ {
+		result = append(result, DiffLine{Op: "+", Text: b[j]})
+	}
+
+	return result
+}
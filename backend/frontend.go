@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The web UI is built into the binary, so a single file is all a
+// self-hosted deployment needs
+//
+//go:embed frontend
+var frontendFS embed.FS
+
+// frontendIndex is the page every client-side route is served
+const frontendIndex = "index.html"
+
+// frontendTypes are content types for assets whose extension the system
+// MIME table may not know, or may map differently between platforms
+var frontendTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".svg":         "image/svg+xml",
+	".ico":         "image/x-icon",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".woff2":       "font/woff2",
+}
+
+// frontendAsset is an embedded file ready to serve
+type frontendAsset struct {
+	content     []byte
+	contentType string
+	etag        string
+}
+
+// frontendAssets indexes the embedded files by their URL path
+type frontendAssets map[string]*frontendAsset
+
+// loadFrontendAssets reads every embedded file once, working out its
+// content type and ETag up front
+func loadFrontendAssets() (frontendAssets, error) {
+	root, err := fs.Sub(frontendFS, "frontend")
+	if err != nil {
+		return nil, err
+	}
+	assets := make(frontendAssets)
+	err = fs.WalkDir(root, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(root, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		assets["/"+name] = &frontendAsset{
+			content:     content,
+			contentType: frontendContentType(name, content),
+			etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+		}
+		return nil
+	})
+	return assets, err
+}
+
+// withBasePath points the page at the assets and API under BASE_PATH: its
+// /static links are prefixed, and a meta tag tells the script the prefix
+func (assets frontendAssets) withBasePath(base string) {
+	page, ok := assets["/"+frontendIndex]
+	if base == "" || !ok {
+		return
+	}
+	escaped := html.EscapeString(base)
+	content := strings.ReplaceAll(string(page.content), `"/static/`, `"`+escaped+`/static/`)
+	content = strings.Replace(content, "<head>", `<head>
+    <meta name="notex-base-path" content="`+escaped+`">`, 1)
+	sum := sha256.Sum256([]byte(content))
+	assets["/"+frontendIndex] = &frontendAsset{
+		content:     []byte(content),
+		contentType: page.contentType,
+		etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+	}
+}
+
+func frontendContentType(name string, content []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := frontendTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return http.DetectContentType(content)
+}
+
+// serve writes an asset, answering 304 when the client's copy is current.
+// Requests with a ?v= version can be cached for good, since a new build
+// changes the version; the page itself is always revalidated so it picks
+// up new versions.
+func (a *frontendAsset) serve(c *gin.Context, page bool) {
+	switch {
+	case page:
+		c.Header("Cache-Control", "no-cache")
+	case c.Query("v") != "":
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		c.Header("Cache-Control", "public, max-age=3600")
+	}
+	c.Header("ETag", a.etag)
+	if match := c.GetHeader("If-None-Match"); match != "" && strings.Contains(match, a.etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", a.contentType)
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Data(http.StatusOK, a.contentType, a.content)
+}
+
+// serverRoutes are path prefixes the SPA fallback never answers, so a
+// mistyped API call still gets a 404 rather than the page
+var serverRoutes = []string{"/api/", "/static/", "/uploads/", "/dl/", "/dav/", "/p/"}
+
+// handleStatic serves files under /static
+func (assets frontendAssets) handleStatic(c *gin.Context) {
+	asset, ok := assets[path.Clean("/static/"+c.Param("filepath"))]
+	if !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "File not found"})
+		return
+	}
+	asset.serve(c, false)
+}
+
+// handleFallback serves embedded files at the root, such as favicon.ico,
+// and the page for every other GET so client-side routes like
+// /notebooks/123 work when opened directly or reloaded
+func (assets frontendAssets) handleFallback(c *gin.Context) {
+	p := path.Clean(c.Request.URL.Path)
+	routed := c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+	for _, prefix := range serverRoutes {
+		if strings.HasPrefix(p+"/", prefix) {
+			routed = false
+		}
+	}
+	if !routed {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Not found"})
+		return
+	}
+
+	if asset, ok := assets[p]; ok {
+		asset.serve(c, p == "/"+frontendIndex)
+		return
+	}
+	// A missing file is a 404, not the page in its place
+	if path.Ext(p) != "" {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "File not found"})
+		return
+	}
+	if page, ok := assets["/"+frontendIndex]; ok {
+		page.serve(c, true)
+		return
+	}
+	c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Not found"})
+}
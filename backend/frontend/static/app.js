@@ -125,7 +125,9 @@ class OpenNotebook {
     constructor() {
         this.notebooks = [];
         this.currentNotebook = null;
-        this.apiBase = '/api';
+        // BASE_PATH, when the server runs under a sub-path behind a proxy
+        const basePath = document.querySelector('meta[name="notex-base-path"]');
+        this.apiBase = (basePath ? basePath.content : '') + '/api';
         this.currentChatSession = null;
         this.config = {
             allowDelete: true
@@ -345,7 +347,13 @@ class OpenNotebook {
         }
 
         try {
-            const response = await fetch(url, { ...defaults, ...options });
+            const request = { ...defaults, ...options };
+            // Echo the CSRF cookie, which changes signed in with a cookie need
+            const csrf = document.cookie.match(/(?:^|;\s*)notex_csrf=([^;]*)/);
+            if (csrf) {
+                request.headers = { ...request.headers, 'X-CSRF-Token': decodeURIComponent(csrf[1]) };
+            }
+            const response = await fetch(url, request);
             clearTimeout(id);
 
             if (!response.ok) {
@@ -629,10 +637,13 @@ class OpenNotebook {
         const noteView = document.querySelector('.note-view-container');
         if (noteView) noteView.remove();
 
+        // 一次请求取回笔记本的全部内容
+        const bundle = await this.api(`/notebooks/${id}/bundle`).catch(() => null);
+
         await Promise.all([
-            this.loadSources(),
-            this.loadNotes(),
-            this.loadChatSessions()
+            this.loadSources(bundle?.sources),
+            this.loadNotes(bundle?.notes),
+            this.loadChatSessions(bundle?.chat_sessions)
         ]);
 
         this.setStatus(`当前选择: ${this.currentNotebook.name}`);
@@ -744,7 +755,7 @@ class OpenNotebook {
     }
 
     // 来源方法
-    async loadSources() {
+    async loadSources(preloaded) {
         if (!this.currentNotebook) return;
 
         const container = document.getElementById('sourcesGrid');
@@ -756,7 +767,7 @@ class OpenNotebook {
             const cached = this.cache.get(cacheKey);
 
             // 从服务器获取最新数据
-            const sources = await this.api(`/notebooks/${this.currentNotebook.id}/sources`);
+            const sources = preloaded || await this.api(`/notebooks/${this.currentNotebook.id}/sources`);
 
             // 更新缓存
             this.cache.set(cacheKey, sources);
@@ -937,7 +948,7 @@ class OpenNotebook {
     }
 
     // 笔记方法
-    async loadNotes() {
+    async loadNotes(preloaded) {
         if (!this.currentNotebook) return;
 
         const container = document.getElementById('notesList');
@@ -950,7 +961,7 @@ class OpenNotebook {
             const cached = this.cache.get(cacheKey);
 
             // 从服务器获取最新数据
-            const notes = await this.api(`/notebooks/${this.currentNotebook.id}/notes`);
+            const notes = preloaded || await this.api(`/notebooks/${this.currentNotebook.id}/notes`);
 
             // 更新缓存
             this.cache.set(cacheKey, notes);
@@ -1425,11 +1436,11 @@ class OpenNotebook {
     }
 
     // 聊天方法
-    async loadChatSessions() {
+    async loadChatSessions(preloaded) {
         if (!this.currentNotebook) return;
 
         try {
-            await this.api(`/notebooks/${this.currentNotebook.id}/chat/sessions`);
+            if (!preloaded) await this.api(`/notebooks/${this.currentNotebook.id}/chat/sessions`);
             const container = document.getElementById('chatMessages');
             container.innerHTML = `
                 <div class="chat-welcome">
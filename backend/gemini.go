@@ -6,9 +6,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/kataras/golog"
 	"github.com/tmc/langchaingo/llms"
 	"google.golang.org/genai"
@@ -29,13 +31,15 @@ type LLMProvider interface {
 // GeminiClient is the default implementation of LLMProvider using Google GenAI
 type GeminiClient struct {
 	googleAPIKey string
+	cfg          Config     // for the proxy, CA bundle and timeout of requests
 	llm          llms.Model // maybe other llm except gemini for chat/summary etc.
 }
 
 // NewGeminiClient creates a new GeminiClient
-func NewGeminiClient(googleAPIKey string, llm llms.Model) *GeminiClient {
+func NewGeminiClient(cfg Config, llm llms.Model) *GeminiClient {
 	return &GeminiClient{
-		googleAPIKey: googleAPIKey,
+		googleAPIKey: cfg.GoogleAPIKey,
+		cfg:          cfg,
 		llm:          llm,
 	}
 }
@@ -47,14 +51,8 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string)
 		return "", fmt.Errorf("google_api_key is not set")
 	}
 
-	httpClient := &http.Client{
-		Timeout: time.Hour, // Give the model enough time to "think"
-		Transport: &http.Transport{
-			DisableKeepAlives: false,
-			MaxIdleConns:      100,
-			IdleConnTimeout:   time.Hour,
-		},
-	}
+	// Give the model enough time to "think"; failures are retried below
+	httpClient := providerHTTPClient(n.cfg, time.Hour, 0)
 
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{
 		APIKey:     n.googleAPIKey,
@@ -69,7 +67,11 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string)
 	for attempt := 1; attempt <= 3; attempt++ {
 		if attempt > 1 {
 			golog.Infof("retrying image generation (attempt %d/3)...", attempt)
-			time.Sleep(2 * time.Second)
+			select {
+			case <-time.After(2 * time.Second):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
 		} else {
 			golog.Infof("generating images with model %s using GenerateContent...", model)
 		}
@@ -109,7 +111,7 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string)
 		golog.Infof("image data received successfully, saving...")
 
 		// Save the image
-		fileName := fmt.Sprintf("infograph_%d.png", time.Now().UnixNano())
+		fileName := fmt.Sprintf(generatedImageName, time.Now().UnixNano())
 		uploadDir := "./data/uploads"
 		if err := os.MkdirAll(uploadDir, 0755); err != nil {
 			return "", fmt.Errorf("failed to create upload directory: %w", err)
@@ -135,14 +137,8 @@ func (n *GeminiClient) GenerateTextWithModel(ctx context.Context, prompt string,
 		return "", fmt.Errorf("google_api_key is not set")
 	}
 
-	httpClient := &http.Client{
-		Timeout: 5 * time.Minute, // Give the model enough time to "think"
-		Transport: &http.Transport{
-			DisableKeepAlives: false,
-			MaxIdleConns:      100,
-			IdleConnTimeout:   5 * time.Minute,
-		},
-	}
+	// Give the model enough time to "think"
+	httpClient := providerHTTPClient(n.cfg, 5*time.Minute, 0)
 
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{
 		APIKey:     n.googleAPIKey,
@@ -190,3 +186,21 @@ func (n *GeminiClient) GenerateTextWithModel(ctx context.Context, prompt string,
 func (n *GeminiClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
 	return llms.GenerateFromSinglePrompt(ctx, n.llm, prompt, options...)
 }
+
+// generatedImageName is the file name pattern for generated images
+const generatedImageName = "infograph_%d.png"
+
+// generatedImagePattern matches only generated image names; uploaded files
+// always carry a random suffix, so they never match
+var generatedImagePattern = regexp.MustCompile(`^infograph_\d+\.png$`)
+
+// handleGeneratedImage serves a generated infographic or slide image from the
+// uploads directory, refusing every other file there
+func handleGeneratedImage(c *gin.Context) {
+	fileName := c.Param("fileName")
+	if !generatedImagePattern.MatchString(fileName) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "File not found"})
+		return
+	}
+	c.File(filepath.Join("./data/uploads", fileName))
+}
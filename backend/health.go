@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dependency check states
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkDown     = "down"
+)
+
+const (
+	// healthCheckTimeout bounds each dependency check
+	healthCheckTimeout = 3 * time.Second
+	// llmCheckTTL is how long an LLM provider check result is reused
+	llmCheckTTL = 30 * time.Second
+)
+
+// DependencyStatus is the result of checking one dependency
+type DependencyStatus struct {
+	Status    string         `json:"status"` // "ok", "degraded" or "down"
+	LatencyMS int64          `json:"latency_ms"`
+	Error     string         `json:"error,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// ProbeResponse is returned by /healthz and /readyz
+type ProbeResponse struct {
+	Status    string                      `json:"status"`
+	Version   string                      `json:"version"`
+	Timestamp int64                       `json:"timestamp"`
+	Checks    map[string]DependencyStatus `json:"checks"`
+}
+
+// jobHeartbeats tracks when each background loop last ran so a stuck loop
+// can be reported
+type jobHeartbeats struct {
+	mu      sync.Mutex
+	started time.Time
+	jobs    map[string]jobHeartbeat
+}
+
+type jobHeartbeat struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func newJobHeartbeats() *jobHeartbeats {
+	return &jobHeartbeats{started: time.Now(), jobs: make(map[string]jobHeartbeat)}
+}
+
+// register declares a background loop that should beat every interval
+func (h *jobHeartbeats) register(name string, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.jobs[name] = jobHeartbeat{interval: interval}
+}
+
+// beat records that a loop has just run
+func (h *jobHeartbeats) beat(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hb := h.jobs[name]
+	hb.last = time.Now()
+	h.jobs[name] = hb
+}
+
+// check reports a loop as down when it missed three beats in a row
+func (h *jobHeartbeats) check() DependencyStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := DependencyStatus{Status: checkOK, Details: map[string]any{}}
+	var stalled []string
+	now := time.Now()
+	for name, hb := range h.jobs {
+		last := hb.last
+		if last.IsZero() {
+			last = h.started
+		}
+		detail := map[string]any{"interval_seconds": int64(hb.interval.Seconds())}
+		if !hb.last.IsZero() {
+			detail["last_run"] = hb.last.Unix()
+		}
+		if now.Sub(last) > 3*hb.interval {
+			detail["stalled"] = true
+			stalled = append(stalled, name)
+		}
+		status.Details[name] = detail
+	}
+
+	if len(stalled) > 0 {
+		status.Status = checkDown
+		status.Error = "stalled: " + strings.Join(stalled, ", ")
+	}
+	return status
+}
+
+// llmCheckCache remembers the last provider check so probes do not hit the
+// provider on every request
+type llmCheckCache struct {
+	mu      sync.Mutex
+	result  DependencyStatus
+	checked time.Time
+}
+
+// timeCheck runs a check and fills in its latency
+func timeCheck(check func() DependencyStatus) DependencyStatus {
+	start := time.Now()
+	status := check()
+	status.LatencyMS = time.Since(start).Milliseconds()
+	return status
+}
+
+func failedCheck(err error) DependencyStatus {
+	return DependencyStatus{Status: checkDown, Error: err.Error()}
+}
+
+// checkDatabase pings the SQLite store and runs a trivial query
+func (s *Server) checkDatabase(ctx context.Context) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	if err := s.store.db.PingContext(ctx); err != nil {
+		return failedCheck(err)
+	}
+	var one int
+	if err := s.store.db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return failedCheck(err)
+	}
+	return DependencyStatus{Status: checkOK}
+}
+
+// checkBlobStore verifies the uploads directory is writable
+func (s *Server) checkBlobStore() DependencyStatus {
+	dir := "./data/uploads"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return failedCheck(err)
+	}
+
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return failedCheck(err)
+	}
+	name := f.Name()
+	_, err = f.WriteString("ok")
+	f.Close()
+	os.Remove(name)
+	if err != nil {
+		return failedCheck(err)
+	}
+
+	abs, _ := filepath.Abs(dir)
+	return DependencyStatus{Status: checkOK, Details: map[string]any{"path": abs}}
+}
+
+// checkLLM checks the LLM provider answers its model listing endpoint
+func (s *Server) checkLLM(ctx context.Context) DependencyStatus {
+	s.llmCheck.mu.Lock()
+	defer s.llmCheck.mu.Unlock()
+
+	if !s.llmCheck.checked.IsZero() && time.Since(s.llmCheck.checked) < llmCheckTTL {
+		return s.llmCheck.result
+	}
+
+	s.llmCheck.result = timeCheck(func() DependencyStatus { return s.probeLLM(ctx) })
+	s.llmCheck.checked = time.Now()
+	return s.llmCheck.result
+}
+
+func (s *Server) probeLLM(ctx context.Context) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	provider := "openai"
+	var endpoint string
+	if s.cfg.IsOllama() {
+		provider = "ollama"
+		endpoint = strings.TrimSuffix(strings.TrimSuffix(s.cfg.OpenAIBaseURL, "/"), "/v1") + "/api/tags"
+	} else {
+		base := s.cfg.GetBaseURL()
+		if base == "" {
+			base = "https://api.openai.com/v1"
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/models"
+	}
+	details := map[string]any{"provider": provider, "model": s.cfg.OpenAIModel}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return DependencyStatus{Status: checkDown, Error: err.Error(), Details: details}
+	}
+	if provider == "openai" && s.cfg.OpenAIAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.OpenAIAPIKey)
+	}
+
+	resp, err := providerHTTPClient(s.cfg, 0, 0).Do(req)
+	if err != nil {
+		return DependencyStatus{Status: checkDown, Error: err.Error(), Details: details}
+	}
+	resp.Body.Close()
+
+	details["http_status"] = resp.StatusCode
+	switch {
+	case resp.StatusCode >= 500:
+		return DependencyStatus{Status: checkDown, Error: fmt.Sprintf("provider returned %s", resp.Status), Details: details}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return DependencyStatus{Status: checkDegraded, Error: "provider rejected the API key", Details: details}
+	}
+	return DependencyStatus{Status: checkOK, Details: details}
+}
+
+// probeStatus is the worst status among the checks
+func probeStatus(checks map[string]DependencyStatus) string {
+	status := checkOK
+	for _, check := range checks {
+		switch check.Status {
+		case checkDown:
+			return checkDown
+		case checkDegraded:
+			status = checkDegraded
+		}
+	}
+	return status
+}
+
+func (s *Server) writeProbe(c *gin.Context, checks map[string]DependencyStatus) {
+	status := probeStatus(checks)
+	code := http.StatusOK
+	if status == checkDown {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(code, ProbeResponse{
+		Status:    status,
+		Version:   Version,
+		Timestamp: time.Now().Unix(),
+		Checks:    checks,
+	})
+}
+
+// handleHealthz is the liveness probe: the process can reach its database and
+// its background jobs are running
+func (s *Server) handleHealthz(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	s.writeProbe(c, map[string]DependencyStatus{
+		"database": timeCheck(func() DependencyStatus { return s.checkDatabase(ctx) }),
+		"jobs":     timeCheck(s.heartbeats.check),
+	})
+}
+
+// handleReadyz is the readiness probe: every dependency needed to serve
+// requests is reachable
+func (s *Server) handleReadyz(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	if s.isStopping() {
+		s.writeProbe(c, map[string]DependencyStatus{
+			"server": {Status: checkDown, Error: "shutting down"},
+		})
+		return
+	}
+
+	checks := make(map[string]DependencyStatus)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	run := func(name string, check func() DependencyStatus) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := timeCheck(check)
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}()
+	}
+
+	run("database", func() DependencyStatus { return s.checkDatabase(ctx) })
+	run("blob_store", s.checkBlobStore)
+	run("jobs", s.heartbeats.check)
+	wg.Wait()
+
+	// The LLM check keeps its own latency since its result may be cached
+	checks["llm"] = s.checkLLM(ctx)
+
+	s.writeProbe(c, checks)
+}
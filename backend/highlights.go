@@ -0,0 +1,442 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// highlightSeparator separates highlights inside a "highlights" source; each
+// highlight is indexed as its own chunk
+const highlightSeparator = "\n\n---\n\n"
+
+// Highlight is a single imported highlight
+type Highlight struct {
+	Text          string `json:"text"`
+	Note          string `json:"note,omitempty"`
+	Location      string `json:"location,omitempty"`
+	HighlightedAt string `json:"highlighted_at,omitempty"`
+}
+
+// HighlightBook groups the highlights of one book or document
+type HighlightBook struct {
+	Title      string
+	Author     string
+	Highlights []Highlight
+}
+
+// HighlightImportResult summarizes a highlights import
+type HighlightImportResult struct {
+	Format            string   `json:"format"`
+	Books             int      `json:"books"`
+	HighlightsAdded   int      `json:"highlights_added"`
+	HighlightsSkipped int      `json:"highlights_skipped"`
+	CreatedSourceIDs  []string `json:"created_source_ids"`
+	UpdatedSourceIDs  []string `json:"updated_source_ids"`
+}
+
+func (s *Server) handleImportHighlights(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		if bodyTooLargeResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "file required"})
+		return
+	}
+
+	format := c.PostForm("format")
+	if format == "" {
+		format = detectHighlightFormat(fh.Filename)
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read file"})
+		return
+	}
+	defer f.Close()
+
+	var books []HighlightBook
+	switch format {
+	case "kindle":
+		books, err = parseKindleClippings(f)
+	case "readwise_csv":
+		books, err = parseReadwiseCSV(f)
+	case "readwise_json":
+		books, err = parseReadwiseJSON(f)
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "format must be one of kindle, readwise_csv, readwise_json"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: fmt.Sprintf("Failed to parse %s export: %v", format, err)})
+		return
+	}
+
+	result, err := s.importHighlightBooks(ctx, notebookID, books)
+	if err != nil {
+		golog.Errorf("failed to import highlights: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to import highlights"})
+		return
+	}
+	result.Format = format
+
+	c.JSON(http.StatusOK, result)
+}
+
+// importHighlightBooks creates one source per book, or appends only unseen
+// highlights to a book's existing source when the export is imported again
+func (s *Server) importHighlightBooks(ctx context.Context, notebookID string, books []HighlightBook) (*HighlightImportResult, error) {
+	result := &HighlightImportResult{
+		Books:            len(books),
+		CreatedSourceIDs: []string{},
+		UpdatedSourceIDs: []string{},
+	}
+
+	existing, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*Source)
+	for i := range existing {
+		if key, ok := existing[i].Metadata["book_key"].(string); ok && existing[i].Type == "highlights" {
+			byKey[key] = &existing[i]
+		}
+	}
+
+	for _, book := range books {
+		key := bookKey(book.Title, book.Author)
+		source := byKey[key]
+
+		seen := make(map[string]bool)
+		if source != nil {
+			if hashes, ok := source.Metadata["highlight_hashes"].([]interface{}); ok {
+				for _, h := range hashes {
+					if hs, ok := h.(string); ok {
+						seen[hs] = true
+					}
+				}
+			}
+		}
+
+		var newChunks []string
+		var newHashes []string
+		for _, hl := range book.Highlights {
+			hash := highlightHash(key, hl.Text)
+			if seen[hash] || strings.TrimSpace(hl.Text) == "" {
+				result.HighlightsSkipped++
+				continue
+			}
+			seen[hash] = true
+			newHashes = append(newHashes, hash)
+			newChunks = append(newChunks, formatHighlight(hl))
+		}
+
+		if len(newChunks) == 0 {
+			continue
+		}
+		result.HighlightsAdded += len(newChunks)
+
+		if source == nil {
+			source = &Source{
+				NotebookID: notebookID,
+				Name:       book.Title,
+				Type:       "highlights",
+				Content:    strings.Join(newChunks, highlightSeparator),
+				Metadata: map[string]interface{}{
+					"book_key":         key,
+					"author":           book.Author,
+					"highlight_hashes": newHashes,
+				},
+			}
+			if err := s.ingestSource(ctx, source); err != nil {
+				return nil, err
+			}
+			result.CreatedSourceIDs = append(result.CreatedSourceIDs, source.ID)
+			continue
+		}
+
+		hashes := make([]string, 0, len(seen))
+		for h := range seen {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+
+		chunkCount, err := s.vectorStore.IngestChunks(ctx, source.Name, newChunks, sourceIndexMetadata(source))
+		if err != nil {
+			golog.Errorf("failed to index new highlights for %s: %v", source.Name, err)
+		}
+		source.Content = source.Content + highlightSeparator + strings.Join(newChunks, highlightSeparator)
+		source.ChunkCount += chunkCount
+		source.Metadata["highlight_hashes"] = hashes
+		if err := s.store.UpdateSource(ctx, source); err != nil {
+			return nil, err
+		}
+		result.UpdatedSourceIDs = append(result.UpdatedSourceIDs, source.ID)
+	}
+
+	golog.Infof("📚 imported %d highlights (%d skipped) from %d books into notebook %s",
+		result.HighlightsAdded, result.HighlightsSkipped, result.Books, notebookID)
+	return result, nil
+}
+
+// splitHighlights splits a "highlights" source back into one chunk per highlight
+func splitHighlights(content string) []string {
+	parts := strings.Split(content, highlightSeparator)
+	chunks := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if strings.TrimSpace(p) != "" {
+			chunks = append(chunks, p)
+		}
+	}
+	return chunks
+}
+
+func formatHighlight(hl Highlight) string {
+	var sb strings.Builder
+	sb.WriteString("> ")
+	sb.WriteString(strings.ReplaceAll(strings.TrimSpace(hl.Text), "\n", "\n> "))
+	if hl.Note != "" {
+		sb.WriteString("\n\nNote: ")
+		sb.WriteString(strings.TrimSpace(hl.Note))
+	}
+	if hl.Location != "" {
+		sb.WriteString("\n\nLocation: ")
+		sb.WriteString(hl.Location)
+	}
+	return sb.String()
+}
+
+func bookKey(title, author string) string {
+	return strings.ToLower(strings.TrimSpace(title)) + "|" + strings.ToLower(strings.TrimSpace(author))
+}
+
+func highlightHash(bookKey, text string) string {
+	sum := sha1.Sum([]byte(bookKey + "\x00" + strings.Join(strings.Fields(strings.ToLower(text)), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+func detectHighlightFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return "readwise_json"
+	case ".csv":
+		return "readwise_csv"
+	case ".txt":
+		return "kindle"
+	}
+	return ""
+}
+
+// bookCollector preserves first-seen book order while grouping highlights
+type bookCollector struct {
+	order []string
+	books map[string]*HighlightBook
+}
+
+func newBookCollector() *bookCollector {
+	return &bookCollector{books: make(map[string]*HighlightBook)}
+}
+
+func (bc *bookCollector) add(title, author string, hl Highlight) *HighlightBook {
+	key := bookKey(title, author)
+	book, ok := bc.books[key]
+	if !ok {
+		book = &HighlightBook{Title: strings.TrimSpace(title), Author: strings.TrimSpace(author)}
+		bc.books[key] = book
+		bc.order = append(bc.order, key)
+	}
+	if hl.Text != "" {
+		book.Highlights = append(book.Highlights, hl)
+	}
+	return book
+}
+
+func (bc *bookCollector) result() []HighlightBook {
+	out := make([]HighlightBook, 0, len(bc.order))
+	for _, key := range bc.order {
+		out = append(out, *bc.books[key])
+	}
+	return out
+}
+
+var kindleTitleRe = regexp.MustCompile(`^(.*?)\s*\(([^()]*)\)\s*$`)
+var kindleLocationRe = regexp.MustCompile(`(?i)(page\s+[\d-]+|location\s+[\d-]+|位置\s*#?[\d-]+|第\s*[\d-]+\s*页)`)
+
+// parseKindleClippings parses a Kindle "My Clippings.txt" file
+func parseKindleClippings(r io.Reader) ([]HighlightBook, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	bc := newBookCollector()
+	for _, entry := range strings.Split(text, "==========") {
+		lines := strings.Split(strings.Trim(entry, "\n"), "\n")
+		if len(lines) < 3 {
+			continue
+		}
+
+		header := strings.TrimPrefix(strings.TrimSpace(lines[0]), "\ufeff")
+		title, author := header, ""
+		if m := kindleTitleRe.FindStringSubmatch(header); m != nil {
+			title, author = m[1], m[2]
+		}
+
+		info := strings.TrimSpace(lines[1])
+		body := strings.TrimSpace(strings.Join(lines[2:], "\n"))
+		lowerInfo := strings.ToLower(info)
+
+		location := strings.Join(kindleLocationRe.FindAllString(info, -1), ", ")
+		addedAt := ""
+		if idx := strings.LastIndex(info, "|"); idx >= 0 {
+			addedAt = strings.TrimSpace(info[idx+1:])
+			addedAt = strings.TrimPrefix(addedAt, "Added on ")
+		}
+
+		switch {
+		case strings.Contains(lowerInfo, "bookmark") || strings.Contains(info, "书签"):
+			continue
+		case strings.Contains(lowerInfo, "your note") || strings.Contains(info, "笔记"):
+			// Kindle writes notes as separate entries right after the highlight they annotate
+			book := bc.add(title, author, Highlight{})
+			if n := len(book.Highlights); n > 0 && book.Highlights[n-1].Note == "" {
+				book.Highlights[n-1].Note = body
+			} else {
+				bc.add(title, author, Highlight{Text: body, Location: location, HighlightedAt: addedAt})
+			}
+		default:
+			bc.add(title, author, Highlight{Text: body, Location: location, HighlightedAt: addedAt})
+		}
+	}
+
+	if len(bc.order) == 0 {
+		return nil, fmt.Errorf("no clippings found")
+	}
+	return bc.result(), nil
+}
+
+// parseReadwiseCSV parses the CSV export from readwise.io/export
+func parseReadwiseCSV(r io.Reader) ([]HighlightBook, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	if _, ok := cols["highlight"]; !ok {
+		return nil, fmt.Errorf("missing Highlight column")
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+
+	bc := newBookCollector()
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		location := field(rec, "location")
+		if t := field(rec, "location type"); t != "" && location != "" {
+			location = t + " " + location
+		}
+		bc.add(field(rec, "book title"), field(rec, "book author"), Highlight{
+			Text:          field(rec, "highlight"),
+			Note:          field(rec, "note"),
+			Location:      location,
+			HighlightedAt: field(rec, "highlighted at"),
+		})
+	}
+
+	return bc.result(), nil
+}
+
+// parseReadwiseJSON parses the Readwise export API format, either a bare
+// list of books or an object with a "results" list
+func parseReadwiseJSON(r io.Reader) ([]HighlightBook, error) {
+	type rwHighlight struct {
+		Text          string      `json:"text"`
+		Note          string      `json:"note"`
+		Location      interface{} `json:"location"`
+		LocationType  string      `json:"location_type"`
+		HighlightedAt string      `json:"highlighted_at"`
+	}
+	type rwBook struct {
+		Title      string        `json:"title"`
+		Author     string        `json:"author"`
+		Highlights []rwHighlight `json:"highlights"`
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var books []rwBook
+	if err := json.Unmarshal(data, &books); err != nil {
+		var wrapped struct {
+			Results []rwBook `json:"results"`
+		}
+		if err2 := json.Unmarshal(data, &wrapped); err2 != nil {
+			return nil, err
+		}
+		books = wrapped.Results
+	}
+
+	bc := newBookCollector()
+	for _, b := range books {
+		bc.add(b.Title, b.Author, Highlight{})
+		for _, h := range b.Highlights {
+			location := ""
+			if h.Location != nil {
+				location = strings.TrimSpace(h.LocationType + " " + fmt.Sprint(h.Location))
+			}
+			bc.add(b.Title, b.Author, Highlight{
+				Text:          h.Text,
+				Note:          h.Note,
+				Location:      location,
+				HighlightedAt: h.HighlightedAt,
+			})
+		}
+	}
+
+	return bc.result(), nil
+}
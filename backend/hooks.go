@@ -0,0 +1,437 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// Hook events
+const (
+	// HookNotePreSave runs before a note is saved; its output replaces the note content
+	HookNotePreSave = "note.pre_save"
+	// HookSourcePostIngest runs after a source is ingested; its output, a JSON
+	// object, is merged into the source metadata
+	HookSourcePostIngest = "source.post_ingest"
+)
+
+var hookEvents = map[string]bool{HookNotePreSave: true, HookSourcePostIngest: true}
+
+// Sandbox limits for hook scripts
+const (
+	maxHookScriptSize = 64 << 10
+	maxHookOutputSize = 1 << 20
+	hookTimeout       = 2 * time.Second
+)
+
+// Hook is a per-notebook script run on note saves or source ingestion. Scripts
+// are Jinja2 templates rendered without filesystem or network access.
+type Hook struct {
+	ID         string    `json:"id"`
+	NotebookID string    `json:"notebook_id"`
+	Name       string    `json:"name"`
+	Event      string    `json:"event"` // "note.pre_save" or "source.post_ingest"
+	Script     string    `json:"script"`
+	Enabled    bool      `json:"enabled"`
+	LastError  string    `json:"last_error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func scanHook(row rowScanner) (*Hook, error) {
+	var h Hook
+	var enabled int
+	var createdAt, updatedAt int64
+
+	if err := row.Scan(&h.ID, &h.NotebookID, &h.Name, &h.Event, &h.Script, &enabled, &h.LastError, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	h.Enabled = enabled == 1
+	h.CreatedAt = time.Unix(createdAt, 0)
+	h.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &h, nil
+}
+
+// Hook operations
+
+// CreateHook stores a new hook
+func (s *Store) CreateHook(ctx context.Context, h *Hook) error {
+	h.ID = uuid.New().String()
+	now := time.Now()
+	h.CreatedAt = now
+	h.UpdatedAt = now
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notebook_hooks (id, notebook_id, name, event, script, enabled, last_error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, '', ?, ?)
+	`, h.ID, h.NotebookID, h.Name, h.Event, h.Script, boolInt(h.Enabled), now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetHook retrieves a hook by ID
+func (s *Store) GetHook(ctx context.Context, id string) (*Hook, error) {
+	h, err := scanHook(s.db.QueryRowContext(ctx, `
+		SELECT id, notebook_id, name, event, script, enabled, last_error, created_at, updated_at
+		FROM notebook_hooks WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("hook")
+	}
+	return h, err
+}
+
+// ListHooks retrieves a notebook's hooks in the order they run
+func (s *Store) ListHooks(ctx context.Context, notebookID string) ([]Hook, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, name, event, script, enabled, last_error, created_at, updated_at
+		FROM notebook_hooks WHERE notebook_id = ? ORDER BY created_at, id
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := make([]Hook, 0)
+	for rows.Next() {
+		h, err := scanHook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *h)
+	}
+
+	return hooks, rows.Err()
+}
+
+// UpdateHook saves a hook's definition
+func (s *Store) UpdateHook(ctx context.Context, h *Hook) error {
+	h.UpdatedAt = time.Now()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE notebook_hooks SET name = ?, event = ?, script = ?, enabled = ?, last_error = ?, updated_at = ?
+		WHERE id = ?
+	`, h.Name, h.Event, h.Script, boolInt(h.Enabled), h.LastError, h.UpdatedAt.Unix(), h.ID)
+
+	return err
+}
+
+// SetHookError records the latest error of a hook, or clears it
+func (s *Store) SetHookError(ctx context.Context, id, message string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE notebook_hooks SET last_error = ? WHERE id = ?`, message, id)
+	return err
+}
+
+// DeleteHook deletes a hook
+func (s *Store) DeleteHook(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM notebook_hooks WHERE id = ?`, id)
+	return err
+}
+
+// UpdateSourceMetadata replaces a source's metadata
+func (s *Store) UpdateSourceMetadata(ctx context.Context, id string, metadata map[string]interface{}) error {
+	metadataJSON, _ := json.Marshal(metadata)
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sources SET metadata = ?, updated_at = ? WHERE id = ?
+	`, string(metadataJSON), time.Now().Unix(), id)
+	return err
+}
+
+// Hook execution
+
+// notebookHooks returns the enabled hooks of a notebook for an event
+func (s *Server) notebookHooks(ctx context.Context, notebookID, event string) []Hook {
+	hooks, err := s.store.ListHooks(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to list hooks: %v", err)
+		return nil
+	}
+
+	matching := make([]Hook, 0, len(hooks))
+	for _, h := range hooks {
+		if h.Enabled && h.Event == event {
+			matching = append(matching, h)
+		}
+	}
+	return matching
+}
+
+// recordHookResult stores or clears a hook's last error
+func (s *Server) recordHookResult(ctx context.Context, h *Hook, err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+		golog.Warnf("hook %s (%s) failed: %v", h.Name, h.ID, err)
+	}
+	if message != h.LastError {
+		s.store.SetHookError(ctx, h.ID, message)
+	}
+}
+
+// noteHookValues are the variables a note.pre_save script sees
+func noteHookValues(note *Note) map[string]any {
+	return map[string]any{
+		"content":     note.Content,
+		"title":       note.Title,
+		"type":        note.Type,
+		"notebook_id": note.NotebookID,
+	}
+}
+
+// applyNoteHooks runs the notebook's pre-save hooks in order, each seeing the
+// previous one's output. A failing hook is skipped and the note saved as is.
+func (s *Server) applyNoteHooks(ctx context.Context, note *Note) {
+	for _, h := range s.notebookHooks(ctx, note.NotebookID, HookNotePreSave) {
+		output, err := runHookScript(ctx, h.Script, noteHookValues(note))
+		s.recordHookResult(ctx, &h, err)
+		if err == nil && strings.TrimSpace(output) != "" {
+			note.Content = output
+		}
+	}
+}
+
+// createNote saves a note after running the notebook's pre-save hooks,
+// reading properties from its frontmatter and checking the storage quota
+func (s *Server) createNote(ctx context.Context, note *Note) error {
+	if err := s.checkWritable(ctx, note.NotebookID); err != nil {
+		return err
+	}
+	s.applyNoteHooks(ctx, note)
+	s.applyFrontmatter(ctx, note)
+	if err := s.checkStorageQuota(ctx, note.NotebookID, int64(len(note.Content))); err != nil {
+		return err
+	}
+	return s.store.CreateNote(ctx, note)
+}
+
+// sourceHookValues are the variables a source.post_ingest script sees
+func sourceHookValues(source *Source) map[string]any {
+	metadata := source.Metadata
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	return map[string]any{
+		"content":     source.Content,
+		"name":        source.Name,
+		"type":        source.Type,
+		"url":         source.URL,
+		"notebook_id": source.NotebookID,
+		"metadata":    metadata,
+	}
+}
+
+// parseHookMetadata decodes a post-ingest script's output; empty output adds nothing
+func parseHookMetadata(output string) (map[string]interface{}, error) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return nil, nil
+	}
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &metadata); err != nil {
+		return nil, fmt.Errorf("output must be a JSON object: %w", err)
+	}
+	return metadata, nil
+}
+
+// applySourceHooks runs the notebook's post-ingest hooks and saves the metadata they add
+func (s *Server) applySourceHooks(ctx context.Context, source *Source) {
+	hooks := s.notebookHooks(ctx, source.NotebookID, HookSourcePostIngest)
+	if len(hooks) == 0 {
+		return
+	}
+
+	changed := false
+	for _, h := range hooks {
+		output, err := runHookScript(ctx, h.Script, sourceHookValues(source))
+		var metadata map[string]interface{}
+		if err == nil {
+			metadata, err = parseHookMetadata(output)
+		}
+		s.recordHookResult(ctx, &h, err)
+		if len(metadata) > 0 {
+			mergeMetadata(source, metadata)
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := s.store.UpdateSourceMetadata(ctx, source.ID, source.Metadata); err != nil {
+			golog.Errorf("failed to save hook metadata for source %s: %v", source.ID, err)
+		}
+	}
+}
+
+// Hook handlers
+
+func validateHook(h *Hook) error {
+	var fields fieldErrors
+	if strings.TrimSpace(h.Name) == "" {
+		fields.add("name", "is required")
+	}
+	if !hookEvents[h.Event] {
+		fields.add("event", "must be one of %s, %s", HookNotePreSave, HookSourcePostIngest)
+	}
+	if strings.TrimSpace(h.Script) == "" {
+		fields.add("script", "is required")
+	} else if len(h.Script) > maxHookScriptSize {
+		fields.add("script", "must be at most %d bytes", maxHookScriptSize)
+	}
+	return fields.err()
+}
+
+// notebookHook loads :hookId and checks it belongs to :id
+func (s *Server) notebookHook(c *gin.Context) (*Hook, bool) {
+	h, err := s.store.GetHook(context.Background(), c.Param("hookId"))
+	if err != nil || h.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Hook not found"})
+		return nil, false
+	}
+	return h, true
+}
+
+func (s *Server) handleListHooks(c *gin.Context) {
+	ctx := context.Background()
+
+	hooks, err := s.store.ListHooks(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list hooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, hooks)
+}
+
+func (s *Server) handleCreateHook(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	h := Hook{Enabled: true}
+	if !bindJSON(c, &h) {
+		return
+	}
+	if err := validateHook(&h); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	h.NotebookID = notebookID
+	h.LastError = ""
+	if err := s.store.CreateHook(ctx, &h); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create hook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, h)
+}
+
+func (s *Server) handleUpdateHook(c *gin.Context) {
+	ctx := context.Background()
+
+	existing, ok := s.notebookHook(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name    string `json:"name"`
+		Event   string `json:"event"`
+		Script  string `json:"script"`
+		Enabled bool   `json:"enabled"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	h := *existing
+	h.Name, h.Event, h.Script, h.Enabled = req.Name, req.Event, req.Script, req.Enabled
+	if err := validateHook(&h); err != nil {
+		validationResponse(c, err)
+		return
+	}
+	if h.Script != existing.Script {
+		h.LastError = ""
+	}
+
+	if err := s.store.UpdateHook(ctx, &h); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update hook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h)
+}
+
+func (s *Server) handleDeleteHook(c *gin.Context) {
+	ctx := context.Background()
+
+	h, ok := s.notebookHook(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteHook(ctx, h.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete hook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Hook deleted"})
+}
+
+// handleTestHook runs a script against sample input without saving anything
+func (s *Server) handleTestHook(c *gin.Context) {
+	ctx := context.Background()
+
+	var req struct {
+		Event  string         `json:"event"`
+		Script string         `json:"script"`
+		Input  map[string]any `json:"input"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	h := Hook{Name: "test", Event: req.Event, Script: req.Script}
+	if err := validateHook(&h); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	values := req.Input
+	if values == nil {
+		values = map[string]any{}
+	}
+	values["notebook_id"] = c.Param("id")
+
+	output, err := runHookScript(ctx, req.Script, values)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"output": output}
+	if req.Event == HookSourcePostIngest {
+		metadata, err := parseHookMetadata(output)
+		if err != nil {
+			response["error"] = err.Error()
+		} else {
+			response["metadata"] = metadata
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"runtime/metrics"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/prompts"
+)
+
+// Hook scripts render in a child process running this same binary, so a
+// script that loops or grows without bound can be killed when it runs out of
+// time rather than left burning CPU and memory in the server.
+
+const (
+	// hookRendererEnv marks a process started to render one hook script
+	hookRendererEnv = "NOTEX_HOOK_RENDERER"
+	// hookMemoryLimit is how much heap a rendering process may use before it
+	// is stopped; it bounds the output while it is being built
+	hookMemoryLimit = 64 << 20
+	// hookMemoryCheckInterval is how often a rendering process checks its heap
+	hookMemoryCheckInterval = 10 * time.Millisecond
+)
+
+// Exit codes of a rendering process
+const (
+	hookExitFailed      = 1
+	hookExitOutOfMemory = 2
+)
+
+// hookRenderRequest is what the server sends a rendering process on stdin
+type hookRenderRequest struct {
+	Script string         `json:"script"`
+	Values map[string]any `json:"values"`
+}
+
+func init() {
+	if os.Getenv(hookRendererEnv) == "1" {
+		os.Exit(renderHookProcess(os.Stdin, os.Stdout, os.Stderr))
+	}
+}
+
+// runHookScript renders a hook script with the given variables under the sandbox limits
+func runHookScript(ctx context.Context, script string, values map[string]any) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	input, err := json.Marshal(hookRenderRequest{Script: script, Values: values})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode script input: %w", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to start script: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Env = append(os.Environ(), hookRendererEnv+"=1")
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to start script: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start script: %w", err)
+	}
+
+	output, readErr := io.ReadAll(io.LimitReader(stdout, maxHookOutputSize+1))
+	if len(output) > maxHookOutputSize {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return "", fmt.Errorf("script output exceeds %d bytes", maxHookOutputSize)
+	}
+	waitErr := cmd.Wait()
+
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("script exceeded %s time limit", hookTimeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		if exitErr.ExitCode() == hookExitOutOfMemory {
+			return "", fmt.Errorf("script exceeded %d MB memory limit", hookMemoryLimit>>20)
+		}
+		return "", errors.New(strings.TrimSpace(stderr.String()))
+	}
+	if waitErr != nil {
+		return "", fmt.Errorf("script failed: %w", waitErr)
+	}
+	if readErr != nil {
+		return "", fmt.Errorf("failed to read script output: %w", readErr)
+	}
+	return string(output), nil
+}
+
+// renderHookProcess is the body of a rendering process: it renders the
+// script read from in, writes the output to out and returns the exit code
+func renderHookProcess(in io.Reader, out, errOut io.Writer) int {
+	debug.SetMemoryLimit(hookMemoryLimit)
+	go watchHookMemory()
+
+	var req hookRenderRequest
+	dec := json.NewDecoder(in)
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		fmt.Fprintf(errOut, "invalid script input: %v", err)
+		return hookExitFailed
+	}
+
+	output, err := renderHookTemplate(req.Script, normalizeHookValue(req.Values).(map[string]any))
+	if err != nil {
+		fmt.Fprint(errOut, err.Error())
+		return hookExitFailed
+	}
+	io.WriteString(out, output)
+	return 0
+}
+
+// renderHookTemplate renders script, turning a panic into an error
+func renderHookTemplate(script string, values map[string]any) (output string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("script panicked: %v", r)
+		}
+	}()
+	return prompts.RenderTemplate(script, prompts.TemplateFormatJinja2, values)
+}
+
+// watchHookMemory stops the process once its heap passes hookMemoryLimit,
+// which also caps how large the output can grow while it is rendered
+func watchHookMemory() {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for range time.Tick(hookMemoryCheckInterval) {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 && sample[0].Value.Uint64() > hookMemoryLimit {
+			os.Exit(hookExitOutOfMemory)
+		}
+	}
+}
+
+// normalizeHookValue turns the JSON numbers of decoded values back into
+// integers or floats, so scripts compare and print them as before
+func normalizeHookValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if v == nil {
+			return map[string]any{}
+		}
+		for k, item := range v {
+			v[k] = normalizeHookValue(item)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeHookValue(item)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n)
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
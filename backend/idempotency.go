@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// idempotencyKeyTTL is how long a key's response is kept for replay
+const idempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// maxBufferedIdempotentBody is how much of a request body is kept in memory
+// while it is hashed; larger bodies, such as uploads, are spooled to a file
+const maxBufferedIdempotentBody = 1 << 20
+
+// idempotentResponse is a stored response for an Idempotency-Key. Status 0
+// means the first request is still running.
+type idempotentResponse struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Idempotency key operations
+
+// ReserveIdempotencyKey claims a key for a request. It returns true when the
+// caller should run the request, or the stored response when the key was
+// already used.
+func (s *Store) ReserveIdempotencyKey(ctx context.Context, scope, key, requestHash string) (*idempotentResponse, bool, error) {
+	now := time.Now()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < ?`,
+		now.Add(-idempotencyKeyTTL).Unix()); err != nil {
+		return nil, false, err
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO idempotency_keys (scope, key, request_hash, status, content_type, response, created_at)
+		VALUES (?, ?, ?, 0, '', NULL, ?)
+	`, scope, key, requestHash, now.Unix())
+	if err != nil {
+		return nil, false, err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		return nil, true, nil
+	}
+
+	var stored idempotentResponse
+	err = s.db.QueryRowContext(ctx, `
+		SELECT request_hash, status, content_type, COALESCE(response, '') FROM idempotency_keys WHERE scope = ? AND key = ?
+	`, scope, key).Scan(&stored.RequestHash, &stored.Status, &stored.ContentType, &stored.Body)
+	if err == sql.ErrNoRows {
+		// Expired between the insert and the read; let the request run
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &stored, false, nil
+}
+
+// CompleteIdempotencyKey stores the response for a reserved key
+func (s *Store) CompleteIdempotencyKey(ctx context.Context, scope, key string, status int, contentType string, body []byte) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = ?, content_type = ?, response = ? WHERE scope = ? AND key = ?
+	`, status, contentType, body, scope, key)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a reserved key so the request can be retried
+func (s *Store) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+// IdempotencyMiddleware deduplicates retried create requests that carry an
+// Idempotency-Key header. The first request runs and its response is stored;
+// retries with the same key and body get that response replayed instead of
+// creating a duplicate. Keys are scoped to the caller, workspace and route.
+// Server errors are not stored, so a failed request can be retried.
+func (s *Server) IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Idempotency-Key is too long"})
+			return
+		}
+
+		requestHash, body, err := spoolRequestBody(c.Request.Body)
+		if err != nil {
+			if bodyTooLargeResponse(c, err) {
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read request body"})
+			return
+		}
+		defer body.Close()
+		c.Request.Body = body
+
+		caller := getClientIP(c)
+		if user := currentUser(c); user != nil {
+			caller = "user:" + user.ID
+		}
+		scope := caller + " " + currentWorkspace(c).ID + " " + c.Request.Method + " " + c.Request.URL.Path
+
+		ctx := context.Background()
+		stored, reserved, err := s.store.ReserveIdempotencyKey(ctx, scope, key, requestHash)
+		if err != nil {
+			golog.Errorf("failed to reserve idempotency key: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check Idempotency-Key"})
+			return
+		}
+		if !reserved {
+			switch {
+			case stored.RequestHash != requestHash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, ErrorResponse{Code: CodeValidationFailed, Error: "Idempotency-Key was already used for a different request"})
+			case stored.Status == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "A request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(stored.Status, stored.ContentType, stored.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		w := &responseBodyWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = w
+		completed := false
+		defer func() {
+			// Release the key if the handler panicked or failed on the server side
+			if !completed {
+				s.store.ReleaseIdempotencyKey(ctx, scope, key)
+			}
+		}()
+
+		c.Next()
+
+		if status := w.Status(); status < http.StatusInternalServerError {
+			if err := s.store.CompleteIdempotencyKey(ctx, scope, key, status, w.Header().Get("Content-Type"), w.body.Bytes()); err != nil {
+				golog.Errorf("failed to store idempotent response: %v", err)
+			} else {
+				completed = true
+			}
+		}
+	}
+}
+
+// spoolRequestBody hashes a request body while reading it, and returns the
+// hash and a copy of the body to read again. Small bodies stay in memory;
+// the rest goes to a temporary file removed on Close.
+func spoolRequestBody(r io.Reader) (string, io.ReadCloser, error) {
+	hash := sha256.New()
+	var head bytes.Buffer
+	_, err := io.CopyN(io.MultiWriter(&head, hash), r, maxBufferedIdempotentBody+1)
+	if err == io.EOF {
+		return hex.EncodeToString(hash.Sum(nil)), io.NopCloser(&head), nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, err := os.CreateTemp("", "notex-request-*")
+	if err != nil {
+		return "", nil, err
+	}
+	body := &spooledBody{File: f}
+	if _, err := head.WriteTo(f); err != nil {
+		body.Close()
+		return "", nil, err
+	}
+	if _, err := io.Copy(io.MultiWriter(f, hash), r); err != nil {
+		body.Close()
+		return "", nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return "", nil, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), body, nil
+}
+
+// spooledBody is a request body spooled to a temporary file
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	b.File.Close()
+	return os.Remove(b.Name())
+}
@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	s := &Server{store: &CachedStore{Store: newTestStore(t)}}
+	calls := 0
+	router := gin.New()
+	router.POST("/items", s.IdempotencyMiddleware(), func(c *gin.Context) {
+		calls++
+		body, _ := io.ReadAll(c.Request.Body)
+		c.JSON(http.StatusCreated, gin.H{"call": calls, "body": string(body)})
+	})
+	router.POST("/fail", s.IdempotencyMiddleware(), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusInternalServerError, gin.H{"call": calls})
+	})
+
+	send := func(path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		path, key  string
+		body       string
+		wantStatus int
+		wantCalls  int
+		wantReplay bool
+	}{
+		{name: "first request runs", path: "/items", key: "a", body: `{"n":1}`, wantStatus: http.StatusCreated, wantCalls: 1},
+		{name: "retry is replayed", path: "/items", key: "a", body: `{"n":1}`, wantStatus: http.StatusCreated, wantCalls: 1, wantReplay: true},
+		{name: "same key with another body", path: "/items", key: "a", body: `{"n":2}`, wantStatus: http.StatusUnprocessableEntity, wantCalls: 1},
+		{name: "same key on another route", path: "/fail", key: "a", body: `{"n":1}`, wantStatus: http.StatusInternalServerError, wantCalls: 2},
+		{name: "server errors are not stored", path: "/fail", key: "a", body: `{"n":1}`, wantStatus: http.StatusInternalServerError, wantCalls: 3},
+		{name: "no key always runs", path: "/items", body: `{"n":1}`, wantStatus: http.StatusCreated, wantCalls: 4},
+		{name: "key too long", path: "/items", key: strings.Repeat("k", maxIdempotencyKeyLength+1), wantStatus: http.StatusBadRequest, wantCalls: 4},
+	}
+	var first string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.path, tt.key, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+			if got := w.Header().Get("Idempotent-Replayed") == "true"; got != tt.wantReplay {
+				t.Errorf("replayed = %v, want %v", got, tt.wantReplay)
+			}
+			if first == "" {
+				first = w.Body.String()
+			} else if tt.wantReplay && w.Body.String() != first {
+				t.Errorf("replayed body = %s, want %s", w.Body, first)
+			}
+		})
+	}
+}
+
+func TestSpoolRequestBody(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "in memory", size: 100},
+		{name: "at the memory limit", size: maxBufferedIdempotentBody},
+		{name: "spooled to a file", size: 3*maxBufferedIdempotentBody + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+			hash, body, err := spoolRequestBody(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("spoolRequestBody: %v", err)
+			}
+			defer body.Close()
+
+			sum := sha256.Sum256(data)
+			if want := hex.EncodeToString(sum[:]); hash != want {
+				t.Errorf("hash = %s, want %s", hash, want)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("reading the body again: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("body read again has %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// maxImagePromptNote bounds how much of a note describes the image to draw
+const maxImagePromptNote = 4000
+
+// ImageGenerator draws an image from a prompt
+type ImageGenerator interface {
+	// Generate returns the image and its content type
+	Generate(ctx context.Context, prompt string) ([]byte, string, error)
+	// Model names the model that draws, for the attachment's metadata
+	Model() string
+}
+
+// ImageProviderFactory creates an image generator from the configuration. It
+// returns nil when the provider is not configured, which disables image
+// generation.
+type ImageProviderFactory func(cfg Config) (ImageGenerator, error)
+
+// imageProviders are the IMAGE_PROVIDER values by name
+var imageProviders = map[string]ImageProviderFactory{
+	"gemini": newGeminiImageGenerator,
+	"openai": newOpenAIImageGenerator,
+}
+
+// RegisterImageProvider adds an image provider that IMAGE_PROVIDER can name.
+// Call it before the configuration is loaded.
+func RegisterImageProvider(name string, factory ImageProviderFactory) {
+	imageProviders[name] = factory
+}
+
+// imageProviderNames lists the image providers for error messages
+func imageProviderNames() string {
+	names := make([]string, 0, len(imageProviders))
+	for name := range imageProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newImageGenerator returns the configured image generator, or nil if image
+// generation is not configured
+func newImageGenerator(cfg Config) (ImageGenerator, error) {
+	factory, ok := imageProviders[cfg.ImageProvider]
+	if !ok {
+		return nil, fmt.Errorf("unknown image provider: %s", cfg.ImageProvider)
+	}
+	return factory(cfg)
+}
+
+// geminiImageGenerator draws with a Gemini image model
+type geminiImageGenerator struct {
+	client *GeminiClient
+	model  string
+}
+
+func newGeminiImageGenerator(cfg Config) (ImageGenerator, error) {
+	if cfg.GoogleAPIKey == "" {
+		return nil, nil
+	}
+	model := cfg.ImageModel
+	if model == "" {
+		model = "gemini-3-pro-image-preview"
+	}
+	return &geminiImageGenerator{client: NewGeminiClient(cfg, nil), model: model}, nil
+}
+
+func (g *geminiImageGenerator) Model() string { return g.model }
+
+func (g *geminiImageGenerator) Generate(ctx context.Context, prompt string) ([]byte, string, error) {
+	path, err := g.client.GenerateImage(ctx, g.model, prompt)
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+// openAIImageGenerator draws with an OpenAI-compatible images API
+type openAIImageGenerator struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+func newOpenAIImageGenerator(cfg Config) (ImageGenerator, error) {
+	if cfg.IsOllama() {
+		return nil, fmt.Errorf("IMAGE_PROVIDER openai needs OPENAI_API_KEY")
+	}
+	_, baseURL := llmProvider(cfg)
+	model := cfg.ImageModel
+	if model == "" {
+		model = "gpt-image-1"
+	}
+	return &openAIImageGenerator{
+		baseURL: baseURL,
+		apiKey:  cfg.OpenAIAPIKey,
+		model:   model,
+		client:  providerHTTPClient(cfg, 5*time.Minute, cfg.ProviderMaxRetries),
+	}, nil
+}
+
+func (g *openAIImageGenerator) Model() string { return g.model }
+
+func (g *openAIImageGenerator) Generate(ctx context.Context, prompt string) ([]byte, string, error) {
+	request := map[string]interface{}{"model": g.model, "prompt": prompt, "n": 1, "size": "1024x1024"}
+	if strings.HasPrefix(g.model, "dall-e") {
+		// Newer models always answer in base64 and reject the option
+		request["response_format"] = "b64_json"
+	}
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+"/images/generations", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+g.apiKey)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, "", fmt.Errorf("image API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+			URL     string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", fmt.Errorf("failed to decode image response: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return nil, "", fmt.Errorf("no image in response")
+	}
+
+	var data []byte
+	if result.Data[0].B64JSON != "" {
+		data, err = base64.StdEncoding.DecodeString(result.Data[0].B64JSON)
+	} else {
+		data, err = g.download(ctx, result.Data[0].URL)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+// download fetches an image the API answered with a link to
+func (g *openAIImageGenerator) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image download returned status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Image styles for images drawn from a note
+const (
+	ImageStyleIllustration = "illustration"
+	ImageStyleDiagram      = "diagram"
+)
+
+// noteImagePrompt asks for an image of a note's content
+func noteImagePrompt(note *Note, style, language string) string {
+	content := note.Content
+	if runes := []rune(content); len(runes) > maxImagePromptNote {
+		content = string(runes[:maxImagePromptNote])
+	}
+	kind := "一幅插图，用画面表现其中的主题和要点"
+	if style == ImageStyleDiagram {
+		kind = "一张示意图，用清晰的方框、箭头和简短标签说明其中的结构、流程或关系"
+	}
+	extra := "**注意：图中的文字请使用中文，并尽量少用文字。**"
+	if language != "" {
+		extra = languageInstruction(language)
+	}
+	return fmt.Sprintf("请根据以下笔记内容创作%s。\n\n标题：%s\n\n%s\n\n%s", kind, note.Title, content, extra)
+}
+
+// GenerateNoteImageRequest asks for an image in a note
+type GenerateNoteImageRequest struct {
+	// Prompt describes the image; without one it is drawn from the note
+	Prompt string `json:"prompt" binding:"max=4000"`
+	Style  string `json:"style" binding:"omitempty,oneof=illustration diagram"`
+	// Insert appends a reference to the image to the note; defaults to true
+	Insert *bool `json:"insert"`
+}
+
+// Image generation handlers
+
+// handleGenerateNoteImage draws an image from a prompt or from a note's
+// content, stores it as an attachment of the note and, unless asked not
+// to, appends a Markdown reference to it to the note
+func (s *Server) handleGenerateNoteImage(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found"})
+		return
+	}
+
+	var req GenerateNoteImageRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Style == "" {
+		req.Style = ImageStyleIllustration
+	}
+	prompt := strings.TrimSpace(req.Prompt)
+	if prompt == "" {
+		if strings.TrimSpace(note.Content) == "" {
+			validationResponse(c, invalidField("prompt", "is required for an empty note"))
+			return
+		}
+		prompt = noteImagePrompt(note, req.Style, s.notebookLanguage(ctx, note.NotebookID))
+	}
+
+	if s.imageGenerator == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: "Image generation is not configured"})
+		return
+	}
+	data, contentType, err := s.imageGenerator.Generate(ctx, prompt)
+	if err != nil {
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		golog.Errorf("failed to generate image for note %s: %v", note.ID, err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Image generation failed: %v", err)})
+		return
+	}
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Image generation returned %s, not an image", contentType)})
+		return
+	}
+
+	// The image is kept even if the client went away meanwhile
+	ctx = context.WithoutCancel(ctx)
+	if err := s.checkStorageQuota(ctx, note.NotebookID, int64(len(data))); err != nil {
+		storeErrorResponse(c, err, "Failed to store image")
+		return
+	}
+	uniqueName, path, size, err := saveUploadData("generated"+ext, bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to store image"})
+		return
+	}
+	att := &Attachment{
+		NotebookID:  note.NotebookID,
+		NoteID:      note.ID,
+		FileName:    uniqueName,
+		ContentType: contentType,
+		FileSize:    size,
+		Path:        path,
+		Metadata: map[string]interface{}{
+			"kind":   "generated_image",
+			"style":  req.Style,
+			"prompt": strings.TrimSpace(req.Prompt),
+			"model":  s.imageGenerator.Model(),
+		},
+	}
+	s.thumbnailAttachment(ctx, att)
+	if err := s.store.CreateAttachment(ctx, att); err != nil {
+		os.Remove(path)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to store image"})
+		return
+	}
+
+	if req.Insert == nil || *req.Insert {
+		alt := note.Title
+		if runes := []rune(strings.Join(strings.Fields(req.Prompt), " ")); len(runes) > 0 {
+			alt = string(runes[:min(len(runes), 80)])
+		}
+		alt = strings.NewReplacer("[", "", "]", "").Replace(alt)
+		note.Content = strings.TrimRight(note.Content, "\n") + fmt.Sprintf("\n\n![%s](%s)\n", alt, att.URL)
+		if err := s.store.UpdateNote(ctx, note); err != nil {
+			golog.Errorf("failed to insert image into note %s: %v", note.ID, err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to insert image into note"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"attachment": att, "note": note})
+}
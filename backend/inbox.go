@@ -0,0 +1,424 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// inboxSettingKey is the workspace setting naming its inbox notebook
+const inboxSettingKey = "inbox_notebook_id"
+
+// inboxNotebookName is the name given to an inbox created on first capture
+const inboxNotebookName = "Inbox"
+
+// inboxLocks serializes inbox creation per workspace, so two first captures
+// do not make two inboxes
+var inboxLocks sync.Map
+
+// inboxNotebook returns the workspace's inbox, creating it on first use
+func (s *Server) inboxNotebook(ctx context.Context, ws *Workspace) (*Notebook, error) {
+	if id, _ := ws.Settings[inboxSettingKey].(string); id != "" {
+		if nb, err := s.store.GetNotebook(ctx, id); err == nil && nb.WorkspaceID == ws.ID {
+			return nb, nil
+		}
+	}
+
+	mu, _ := inboxLocks.LoadOrStore(ws.ID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	// Another request may have created it while this one waited
+	current, err := s.store.GetWorkspace(ctx, ws.ID)
+	if err != nil {
+		return nil, err
+	}
+	if id, _ := current.Settings[inboxSettingKey].(string); id != "" {
+		if nb, err := s.store.GetNotebook(ctx, id); err == nil && nb.WorkspaceID == ws.ID {
+			ws.Settings = current.Settings
+			return nb, nil
+		}
+	}
+
+	if err := s.checkNotebookQuota(ctx, current); err != nil {
+		return nil, err
+	}
+	nb, err := s.store.CreateNotebookInWorkspace(ctx, ws.ID, inboxNotebookName, "Quick captures waiting to be filed", map[string]interface{}{"inbox": true})
+	if err != nil {
+		return nil, err
+	}
+	current.Settings[inboxSettingKey] = nb.ID
+	if err := s.store.UpdateWorkspace(ctx, current); err != nil {
+		return nil, err
+	}
+	ws.Settings = current.Settings
+	golog.Infof("created inbox notebook %s for workspace %s", nb.ID, ws.ID)
+	return nb, nil
+}
+
+// snoozedUntil is when a snoozed inbox note comes back, or the zero time
+func snoozedUntil(note *Note) time.Time {
+	raw, _ := note.Metadata["snoozed_until"].(string)
+	until, _ := time.Parse(time.RFC3339, raw)
+	return until
+}
+
+// InboxItem is an inbox note with its triage state
+type InboxItem struct {
+	Note
+	Snoozed bool `json:"snoozed"`
+}
+
+// inboxItems lists the notes waiting in the inbox, oldest first. Snoozed
+// notes are left out unless withSnoozed is set; their snooze ends by itself.
+func (s *Server) inboxItems(ctx context.Context, inbox *Notebook, withSnoozed bool) (items []InboxItem, snoozed int, err error) {
+	notes, err := s.store.ListNotes(ctx, inbox.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now()
+	items = make([]InboxItem, 0, len(notes))
+	for _, note := range notes {
+		isSnoozed := snoozedUntil(&note).After(now)
+		if isSnoozed {
+			snoozed++
+			if !withSnoozed {
+				continue
+			}
+		}
+		items = append(items, InboxItem{Note: note, Snoozed: isSnoozed})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].CreatedAt.Before(items[j].CreatedAt) })
+	return items, snoozed, nil
+}
+
+// reminderWindow is how late a reminder is still sent: snoozes that ended
+// longer ago, e.g. while the server was down, come back silently
+const reminderWindow = 24 * time.Hour
+
+// dueReminder is a note whose snooze has ended
+type dueReminder struct {
+	NoteID     string
+	NotebookID string
+	Title      string
+	Until      string
+}
+
+// ListDueReminders returns the notes whose snooze ended by now, within the
+// reminder window, and that nobody was reminded of yet
+func (s *Store) ListDueReminders(ctx context.Context, now time.Time) ([]dueReminder, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, title, until FROM (
+			SELECT id, notebook_id, title, json_extract(metadata, '$.snoozed_until') AS until FROM notes
+		) n
+		WHERE until <= ? AND until > ?
+			AND NOT EXISTS (SELECT 1 FROM note_reminders r WHERE r.note_id = n.id AND r.snoozed_until = n.until)
+		ORDER BY until
+	`, now.UTC().Format(time.RFC3339), now.Add(-reminderWindow).UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueReminder
+	for rows.Next() {
+		var r dueReminder
+		if err := rows.Scan(&r.NoteID, &r.NotebookID, &r.Title, &r.Until); err != nil {
+			return nil, err
+		}
+		due = append(due, r)
+	}
+	return due, rows.Err()
+}
+
+// MarkReminded records that the end of a note's snooze was announced
+func (s *Store) MarkReminded(ctx context.Context, noteID, until string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO note_reminders (note_id, snoozed_until, sent_at) VALUES (?, ?, ?)
+		ON CONFLICT (note_id) DO UPDATE SET snoozed_until = excluded.snoozed_until, sent_at = excluded.sent_at
+	`, noteID, until, time.Now().Unix())
+	return err
+}
+
+// sendReminders tells the workspaces of snoozed notes that came back
+func (s *Server) sendReminders(ctx context.Context) error {
+	due, err := s.store.ListDueReminders(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to list reminders: %w", err)
+	}
+
+	for _, r := range due {
+		nb, err := s.store.GetNotebook(ctx, r.NotebookID)
+		if err != nil {
+			continue
+		}
+		recipients, err := s.workspaceRecipients(ctx, nb.WorkspaceID)
+		if err != nil {
+			return err
+		}
+		s.notify(ctx, recipients, Notification{
+			Kind:  NotificationReminder,
+			Title: fmt.Sprintf("%q is back in %s", r.Title, nb.Name),
+			Body:  "The note you snoozed is waiting to be triaged.",
+			Link:  "/api/notebooks/" + r.NotebookID + "/notes/" + r.NoteID,
+			Data:  map[string]interface{}{"notebook_id": r.NotebookID, "note_id": r.NoteID, "snoozed_until": r.Until},
+		})
+		if err := s.store.MarkReminded(ctx, r.NoteID, r.Until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inboxNote loads the :noteId note, which must be in the caller's inbox
+func (s *Server) inboxNote(c *gin.Context) (*Note, bool) {
+	ctx := c.Request.Context()
+	inbox, err := s.inboxNotebook(ctx, currentWorkspace(c))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to open the inbox")
+		return nil, false
+	}
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != inbox.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found in the inbox"})
+		return nil, false
+	}
+	if note.Metadata == nil {
+		note.Metadata = map[string]interface{}{}
+	}
+	return note, true
+}
+
+// triageNotebook loads a notebook a note is filed into, which must be
+// another notebook in the caller's workspace
+func (s *Server) triageNotebook(c *gin.Context, field, id string, from *Note) (*Notebook, bool) {
+	nb, err := s.store.GetNotebook(c.Request.Context(), id)
+	if err != nil || nb.WorkspaceID != currentWorkspace(c).ID {
+		validationResponse(c, invalidField(field, "is not a notebook in this workspace"))
+		return nil, false
+	}
+	if nb.ID == from.NotebookID {
+		validationResponse(c, invalidField(field, "must be a notebook other than the inbox"))
+		return nil, false
+	}
+	return nb, true
+}
+
+// Inbox handlers
+
+// handleListInbox lists what is waiting in the inbox, oldest first. Add
+// ?snoozed=true to include snoozed notes.
+func (s *Server) handleListInbox(c *gin.Context) {
+	ctx := c.Request.Context()
+	inbox, err := s.inboxNotebook(ctx, currentWorkspace(c))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to open the inbox")
+		return
+	}
+	items, snoozed, err := s.inboxItems(ctx, inbox, c.Query("snoozed") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list the inbox"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notebook_id": inbox.ID, "items": items, "snoozed": snoozed})
+}
+
+// handleInboxCount is the unprocessed-count badge: notes in the inbox that
+// are not snoozed
+func (s *Server) handleInboxCount(c *gin.Context) {
+	ctx := c.Request.Context()
+	inbox, err := s.inboxNotebook(ctx, currentWorkspace(c))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to open the inbox")
+		return
+	}
+	items, snoozed, err := s.inboxItems(ctx, inbox, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to count the inbox"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unprocessed": len(items), "snoozed": snoozed})
+}
+
+// handleMoveInboxNote files an inbox note in another notebook as it is
+func (s *Server) handleMoveInboxNote(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		NotebookID string `json:"notebook_id" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, ok := s.inboxNote(c)
+	if !ok {
+		return
+	}
+	nb, ok := s.triageNotebook(c, "notebook_id", req.NotebookID, note)
+	if !ok {
+		return
+	}
+	if err := s.checkStorageQuota(ctx, nb.ID, int64(len(note.Content))); err != nil {
+		storeErrorResponse(c, err, "Failed to check storage quota")
+		return
+	}
+
+	note.NotebookID = nb.ID
+	delete(note.Metadata, "snoozed_until")
+	if err := s.store.UpdateNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to move note")
+		return
+	}
+	if err := s.store.MoveNoteAttachments(ctx, note.ID, nb.ID, "", note.ID); err != nil {
+		golog.Errorf("failed to move attachments of note %s: %v", note.ID, err)
+	}
+	c.JSON(http.StatusOK, note)
+}
+
+// handleConvertInboxNote turns an inbox note into a source of a notebook,
+// so it can be chatted with and cited, and removes the note
+func (s *Server) handleConvertInboxNote(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.IngestTimeout)
+	defer cancel()
+
+	var req struct {
+		NotebookID string `json:"notebook_id" binding:"required"`
+		Name       string `json:"name" binding:"max=200"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, ok := s.inboxNote(c)
+	if !ok {
+		return
+	}
+	nb, ok := s.triageNotebook(c, "notebook_id", req.NotebookID, note)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = note.Title
+	}
+	source := &Source{
+		NotebookID: nb.ID,
+		Name:       name,
+		Type:       "text",
+		Content:    note.Content,
+		Metadata:   map[string]interface{}{"from_note_id": note.ID},
+	}
+	if url, _ := note.Metadata["url"].(string); url != "" {
+		source.URL = url
+	}
+	existing, err := s.ingestSourceDedup(context.WithoutCancel(ctx), source, "")
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to create source")
+		return
+	}
+	if existing != nil {
+		source = existing
+	}
+
+	if err := s.store.MoveNoteAttachments(ctx, note.ID, nb.ID, source.ID, ""); err != nil {
+		golog.Errorf("failed to move attachments of note %s: %v", note.ID, err)
+	}
+	if err := s.store.DeleteNote(ctx, note.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to remove the inbox note"})
+		return
+	}
+	c.JSON(http.StatusCreated, source)
+}
+
+// handleMergeInboxNote appends an inbox note to an existing note and
+// removes it from the inbox
+func (s *Server) handleMergeInboxNote(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		NoteID string `json:"note_id" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, ok := s.inboxNote(c)
+	if !ok {
+		return
+	}
+	target, err := s.store.GetNote(ctx, req.NoteID)
+	if err != nil || target.ID == note.ID {
+		validationResponse(c, invalidField("note_id", "is not a note in this workspace"))
+		return
+	}
+	if _, ok := s.triageNotebook(c, "note_id", target.NotebookID, note); !ok {
+		return
+	}
+	if err := s.checkStorageQuota(ctx, target.NotebookID, int64(len(note.Content))); err != nil {
+		storeErrorResponse(c, err, "Failed to check storage quota")
+		return
+	}
+
+	target.Content = strings.TrimRight(target.Content, "\n") + "\n\n" + note.Content
+	if target.Metadata == nil {
+		target.Metadata = map[string]interface{}{}
+	}
+	merged, _ := target.Metadata["merged_note_ids"].([]interface{})
+	target.Metadata["merged_note_ids"] = append(merged, note.ID)
+	if err := s.store.UpdateNote(ctx, target); err != nil {
+		storeErrorResponse(c, err, "Failed to update note")
+		return
+	}
+	if err := s.store.MoveNoteAttachments(ctx, note.ID, target.NotebookID, "", target.ID); err != nil {
+		golog.Errorf("failed to move attachments of note %s: %v", note.ID, err)
+	}
+	if err := s.store.DeleteNote(ctx, note.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to remove the inbox note"})
+		return
+	}
+	c.JSON(http.StatusOK, target)
+}
+
+// handleSnoozeInboxNote hides an inbox note until a date
+func (s *Server) handleSnoozeInboxNote(c *gin.Context) {
+	var req struct {
+		Until time.Time `json:"until" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !req.Until.After(time.Now()) {
+		validationResponse(c, invalidField("until", "must be in the future"))
+		return
+	}
+	note, ok := s.inboxNote(c)
+	if !ok {
+		return
+	}
+	note.Metadata["snoozed_until"] = req.Until.UTC().Format(time.RFC3339)
+	if err := s.store.UpdateNote(c.Request.Context(), note); err != nil {
+		storeErrorResponse(c, err, "Failed to snooze note")
+		return
+	}
+	c.JSON(http.StatusOK, InboxItem{Note: *note, Snoozed: true})
+}
+
+// handleUnsnoozeInboxNote brings a snoozed note back at once
+func (s *Server) handleUnsnoozeInboxNote(c *gin.Context) {
+	note, ok := s.inboxNote(c)
+	if !ok {
+		return
+	}
+	delete(note.Metadata, "snoozed_until")
+	if err := s.store.UpdateNote(c.Request.Context(), note); err != nil {
+		storeErrorResponse(c, err, "Failed to update note")
+		return
+	}
+	c.JSON(http.StatusOK, InboxItem{Note: *note})
+}
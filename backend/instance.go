@@ -0,0 +1,531 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// instanceBundleFormat names the JSON bundle an instance is exported as
+const instanceBundleFormat = "notex-instance"
+
+// instanceBundleVersion is the version of the bundle format written by this
+// server. Readers take any bundle up to their own version, and fill in or
+// leave out the tables and columns the two versions do not share.
+const instanceBundleVersion = 1
+
+// instanceDerivedTables are not exported. Import empties them: they are
+// rebuilt from the data (related_index), refer to files or requests of the
+// old instance (upload_sessions, idempotency_keys), or are delivery state
+// (outbox). The change journal is left alone, so synced clients see the
+// import as changes.
+var instanceDerivedTables = map[string]bool{
+	"related_index":    true,
+	"upload_sessions":  true,
+	"idempotency_keys": true,
+	"outbox":           true,
+	"changes":          true,
+}
+
+// InstanceImport reports what an import restored
+type InstanceImport struct {
+	Version int            `json:"version"`
+	Rows    map[string]int `json:"rows"`
+	// SkippedTables and SkippedColumns were in the bundle but not in this
+	// server's schema; columns are given as table.column
+	SkippedTables  []string `json:"skipped_tables,omitempty"`
+	SkippedColumns []string `json:"skipped_columns,omitempty"`
+}
+
+// Store
+
+// instanceTables lists the tables an instance bundle holds, in name order
+func (s *Store) instanceTables(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !instanceDerivedTables[name] {
+			tables = append(tables, name)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// ExportInstance writes every table of the instance to w as a bundle:
+//
+//	{"format": "notex-instance", "version": 1, "exported_at": "...",
+//	 "tables": {"notebooks": [{"id": "...", ...}, ...], ...}}
+//
+// Rows are read in one transaction, so the bundle is a consistent snapshot.
+func (s *Store) ExportInstance(ctx context.Context, w io.Writer) (map[string]int, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tables, err := s.instanceTables(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _ := json.Marshal(map[string]interface{}{
+		"format":      instanceBundleFormat,
+		"version":     instanceBundleVersion,
+		"exported_at": time.Now().UTC(),
+	})
+	// The header's fields come first, so readers know the version before
+	// they reach the rows
+	if _, err := io.WriteString(w, string(header[:len(header)-1])+`,"tables":{`); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(tables))
+	for i, table := range tables {
+		name, _ := json.Marshal(table)
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		if _, err := io.WriteString(w, sep+"\n"+string(name)+":["); err != nil {
+			return nil, err
+		}
+		n, err := exportTable(ctx, tx, table, w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		counts[table] = n
+		if _, err := io.WriteString(w, "]"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.WriteString(w, "\n}}\n"); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// exportTable writes the rows of a table as JSON objects keyed by column
+func exportTable(ctx context.Context, tx *sql.Tx, table string, w io.Writer) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM %q`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = values[i]
+			}
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return n, err
+		}
+		sep := ","
+		if n == 0 {
+			sep = ""
+		}
+		if _, err := io.WriteString(w, sep+"\n"+string(data)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// ImportInstance replaces every table of the instance with the rows of a
+// bundle written by ExportInstance, in one transaction. Tables the bundle
+// does not have are left empty; tables and columns this schema does not have
+// are skipped, and columns the bundle lacks take their defaults.
+func (s *Store) ImportInstance(ctx context.Context, r io.Reader) (*InstanceImport, error) {
+	// Foreign keys are checked per connection, and not at all inside a
+	// transaction that turns them off, so the import takes a connection of
+	// its own. Rows are copied as they were, in any order.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var foreignKeys int
+	if err := conn.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&foreignKeys); err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), fmt.Sprintf(`PRAGMA foreign_keys = %d`, foreignKeys))
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tables, err := s.instanceTables(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]map[string]bool, len(tables))
+	for _, table := range tables {
+		if columns[table], err = tableColumns(ctx, tx, table); err != nil {
+			return nil, err
+		}
+	}
+	var outboxSeq int64
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM outbox`).Scan(&outboxSeq); err != nil {
+		return nil, err
+	}
+	for table := range instanceDerivedTables {
+		if table != "changes" && table != "outbox" {
+			tables = append(tables, table)
+		}
+	}
+	for _, table := range tables {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %q`, table)); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &InstanceImport{Rows: map[string]int{}}
+	if err := readInstanceBundle(r, report, func(table string, row map[string]interface{}) error {
+		if columns[table] == nil {
+			return errSkipTable
+		}
+		return importRow(ctx, tx, table, columns[table], row, report)
+	}); err != nil {
+		return nil, err
+	}
+
+	// Webhooks waiting before the import stay; events for the rows it
+	// deleted and inserted are not delivered, since the server resets its
+	// indexes and caches instead
+	if _, err := tx.ExecContext(ctx, `DELETE FROM outbox WHERE seq > ? AND kind != ?`, outboxSeq, outboxWebhook); err != nil {
+		return nil, err
+	}
+	// Users of bundles from before sessions sign in with the token they
+	// were created with
+	if report.Rows["user_sessions"] == 0 {
+		if err := backfillUserSessions(ctx, tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	sort.Strings(report.SkippedTables)
+	sort.Strings(report.SkippedColumns)
+	return report, nil
+}
+
+// errSkipTable has readInstanceBundle skip the rest of a table's rows
+var errSkipTable = errors.New("skip table")
+
+// readInstanceBundle reads a bundle, checking its format and version before
+// passing each row to add
+func readInstanceBundle(r io.Reader, report *InstanceImport, add func(table string, row map[string]interface{}) error) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	format := ""
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "format":
+			if err := dec.Decode(&format); err != nil {
+				return err
+			}
+			if format != instanceBundleFormat {
+				return invalidField("format", "must be %q, got %q", instanceBundleFormat, format)
+			}
+		case "version":
+			if err := dec.Decode(&report.Version); err != nil {
+				return invalidField("version", "must be a number")
+			}
+			if report.Version < 1 || report.Version > instanceBundleVersion {
+				return invalidField("version", "must be 1 to %d, got %d; the bundle is from a newer server", instanceBundleVersion, report.Version)
+			}
+		case "tables":
+			if format == "" || report.Version == 0 {
+				return invalidField("tables", "must come after format and version")
+			}
+			if err := readInstanceTables(dec, report, add); err != nil {
+				return err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	if format == "" {
+		return invalidField("format", "is required")
+	}
+	return nil
+}
+
+// readInstanceTables reads the "tables" object of a bundle
+func readInstanceTables(dec *json.Decoder, report *InstanceImport, add func(table string, row map[string]interface{}) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		table, _ := token.(string)
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		skip := false
+		for dec.More() {
+			if skip {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return err
+				}
+				continue
+			}
+			var row map[string]interface{}
+			if err := dec.Decode(&row); err != nil {
+				return err
+			}
+			switch err := add(table, row); {
+			case errors.Is(err, errSkipTable):
+				skip = true
+				report.SkippedTables = append(report.SkippedTables, table)
+			case err != nil:
+				return fmt.Errorf("failed to import %s: %w", table, err)
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token, which must be delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("invalid bundle: expected %q, got %v", delim, token)
+	}
+	return nil
+}
+
+// tableColumns returns the names of a table's columns
+func tableColumns(ctx context.Context, tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT name FROM pragma_table_info(%s)`, sqlString(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// sqlString quotes s as an SQL string literal
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// importRow inserts a bundle row into a table, leaving out the columns the
+// table does not have
+func importRow(ctx context.Context, tx *sql.Tx, table string, columns map[string]bool, row map[string]interface{}, report *InstanceImport) error {
+	names := make([]string, 0, len(row))
+	for name := range row {
+		if columns[name] {
+			names = append(names, name)
+			continue
+		}
+		skipped := table + "." + name
+		if !containsString(report.SkippedColumns, skipped) {
+			report.SkippedColumns = append(report.SkippedColumns, skipped)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	quoted := make([]string, len(names))
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("%q", name)
+		args[i] = bundleValue(row[name])
+	}
+	query := fmt.Sprintf(`INSERT INTO %q (%s) VALUES (?%s)`, table, strings.Join(quoted, ", "), strings.Repeat(", ?", len(names)-1))
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	report.Rows[table]++
+	return nil
+}
+
+// bundleValue converts a decoded JSON value to a column value: numbers to
+// integers where they are whole, and objects and arrays back to JSON text
+func bundleValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return v
+}
+
+// containsString reports whether list has s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Instance export handlers
+
+// handleExportInstance streams every table of the instance as a JSON
+// bundle, for moving it to another machine or database
+func (s *Server) handleExportInstance(c *gin.Context) {
+	ctx := c.Request.Context()
+	if !s.requireStepUp(c) {
+		return
+	}
+	c.Header("Content-Type", "application/json")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName("notex-instance-"+time.Now().Format("20060102-150405"), "json")))
+	c.Status(http.StatusOK)
+
+	counts, err := s.store.ExportInstance(ctx, c.Writer)
+	if err != nil {
+		// The response has started, so the client sees a truncated bundle,
+		// which does not parse
+		golog.Errorf("instance export failed: %v", err)
+		return
+	}
+	golog.Infof("exported the instance: %v", counts)
+}
+
+// handleImportInstance replaces all data with a bundle from
+// handleExportInstance. The server must be in read-only maintenance mode,
+// so nothing is written while the data is swapped.
+func (s *Server) handleImportInstance(c *gin.Context) {
+	ctx := c.Request.Context()
+	if !s.maintenance.ReadOnly() {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Turn on read-only maintenance mode before importing an instance"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+
+	s.vectorMutex.Lock()
+	defer s.vectorMutex.Unlock()
+	previous, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notebooks"})
+		return
+	}
+
+	report, err := s.store.ImportInstance(ctx, c.Request.Body)
+	if err != nil {
+		if bodyTooLargeResponse(c, err) || validationResponse(c, err) {
+			return
+		}
+		var syntax *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntax) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) || strings.HasPrefix(err.Error(), "invalid bundle") {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Invalid instance bundle: " + err.Error()})
+			return
+		}
+		golog.Errorf("instance import failed: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to import instance: " + err.Error()})
+		return
+	}
+
+	// Vectors and cached reads of the old data go; notebooks load their
+	// sources again when next opened
+	for _, nb := range previous {
+		s.unloadNotebook(nb.ID, true)
+	}
+	for id := range s.loadedNotebooks {
+		s.unloadNotebook(id, true)
+	}
+	s.store.ClearCache()
+	golog.Warnf("imported an instance bundle (version %d): %v", report.Version, report.Rows)
+
+	c.JSON(http.StatusOK, report)
+}
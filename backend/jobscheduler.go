@@ -0,0 +1,507 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// schedulerTick is the longest the scheduler sleeps between looking for due
+// jobs; it is also its heartbeat
+const schedulerTick = 10 * time.Second
+
+// Job run outcomes
+const (
+	JobRunOK      = "ok"
+	JobRunFailed  = "failed"
+	JobRunSkipped = "skipped"
+)
+
+var (
+	errJobNotFound = errors.New("no such scheduled job")
+	errJobRunning  = errors.New("the job is already running")
+)
+
+// JobRun is how a background job's last run went
+type JobRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Status     string    `json:"status"` // JobRunOK, JobRunFailed or JobRunSkipped
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// JobState describes a scheduled background job for the admin API
+type JobState struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	NextRunAt    *time.Time `json:"next_run_at,omitempty"`
+	RunningSince *time.Time `json:"running_since,omitempty"`
+	// Overlaps counts the runs since startup that were dropped because the
+	// previous run was still going
+	Overlaps int     `json:"overlaps"`
+	LastRun  *JobRun `json:"last_run,omitempty"`
+}
+
+// jobSchedule gives the run times of a job
+type jobSchedule interface {
+	// Next returns the first run time after t, or the zero time for none
+	Next(t time.Time) time.Time
+}
+
+// everySchedule runs a job at a fixed interval
+type everySchedule time.Duration
+
+// Next implements jobSchedule
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// parseJobSchedule parses a cron expression or "@every" with a duration,
+// such as "@every 90m"
+func parseJobSchedule(spec string) (jobSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval %s is shorter than a minute", d)
+		}
+		return everySchedule(d), nil
+	}
+	return parseCron(spec)
+}
+
+// parseJobSchedules parses JOB_SCHEDULES: job=schedule pairs separated by
+// semicolons, where a schedule of "off" turns the job off
+func parseJobSchedules(value string) (map[string]string, error) {
+	specs := make(map[string]string)
+	for _, pair := range strings.Split(value, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(pair, "=")
+		name, spec = strings.TrimSpace(name), strings.TrimSpace(spec)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not job=schedule", pair)
+		}
+		if spec != "off" {
+			if _, err := parseJobSchedule(spec); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		specs[name] = spec
+	}
+	return specs, nil
+}
+
+// scheduledJob is a background job and its place in the schedule
+type scheduledJob struct {
+	name string
+	spec string
+	run  func(ctx context.Context) error
+	// duringMaintenance lets the job run in read-only mode, for jobs that
+	// write nothing the mode protects
+	duringMaintenance bool
+	// atStart runs the job as soon as the scheduler starts
+	atStart bool
+	// stop, when set, is called once the scheduler stops
+	stop func()
+
+	schedule jobSchedule
+	next     time.Time
+	running  time.Time
+	overlaps int
+	last     *JobRun
+}
+
+// jobScheduler runs the background jobs on their schedules from a single
+// loop. A job whose previous run is still going skips its turn, runs start
+// a random moment after they are due so jobs do not all start together,
+// and the last run of each job is saved so a restart picks the schedule up
+// where it left off.
+type jobScheduler struct {
+	mu     sync.Mutex
+	store  *Store
+	specs  map[string]string
+	jitter time.Duration
+	jobs   []*scheduledJob
+	wake   chan struct{}
+	runs   sync.WaitGroup
+}
+
+// newJobScheduler returns a scheduler with the schedules of JOB_SCHEDULES
+// taking the place of the jobs' own
+func newJobScheduler(cfg Config, store *Store) *jobScheduler {
+	specs, err := parseJobSchedules(cfg.JobSchedules)
+	if err != nil {
+		// Checked at startup, so only a reloaded file gets here
+		golog.Errorf("JOB_SCHEDULES: %v", err)
+	}
+	return &jobScheduler{
+		store:  store,
+		specs:  specs,
+		jitter: time.Duration(cfg.JobJitter) * time.Second,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// add schedules a job to run on spec, unless JOB_SCHEDULES overrides it
+func (sc *jobScheduler) add(job *scheduledJob) {
+	if spec, ok := sc.specs[job.name]; ok {
+		if spec == "off" {
+			golog.Infof("scheduled job %s is turned off", job.name)
+			return
+		}
+		job.spec = spec
+	}
+	schedule, err := parseJobSchedule(job.spec)
+	if err != nil {
+		golog.Errorf("scheduled job %s has a bad schedule %q: %v", job.name, job.spec, err)
+		return
+	}
+	job.schedule = schedule
+	sc.mu.Lock()
+	sc.jobs = append(sc.jobs, job)
+	sc.mu.Unlock()
+}
+
+// after returns the next run time of a job after t, put off by the jitter,
+// which is at most a tenth of the wait
+func (sc *jobScheduler) after(job *scheduledJob, t time.Time) time.Time {
+	next := job.schedule.Next(t)
+	if next.IsZero() {
+		return next
+	}
+	jitter := next.Sub(t) / 10
+	if sc.jitter < jitter {
+		jitter = sc.jitter
+	}
+	if jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return next
+}
+
+// start runs the jobs until stopping is closed, then waits for the runs in
+// progress. Jobs are skipped while readOnly reports true, unless they may
+// run during maintenance; beat is called every time the loop wakes.
+func (sc *jobScheduler) start(stopping <-chan struct{}, readOnly func() bool, beat func()) {
+	ctx := context.Background()
+	last, err := sc.store.ListJobRuns(ctx)
+	if err != nil {
+		golog.Errorf("failed to load the last runs of scheduled jobs: %v", err)
+	}
+
+	now := time.Now()
+	sc.mu.Lock()
+	for name := range sc.specs {
+		if !sc.has(name) && sc.specs[name] != "off" {
+			golog.Warnf("JOB_SCHEDULES names %q, which is not a scheduled job", name)
+		}
+	}
+	for _, job := range sc.jobs {
+		job.last = last[job.name]
+		switch {
+		case job.atStart:
+			job.next = now
+		case job.last == nil:
+			job.next = sc.after(job, now)
+		default:
+			// A run missed while the server was down is made up now
+			job.next = job.schedule.Next(job.last.StartedAt)
+			if job.next.After(now) {
+				job.next = sc.after(job, job.last.StartedAt)
+			}
+		}
+	}
+	sc.mu.Unlock()
+
+	for {
+		beat()
+		wait := sc.dispatch(ctx, readOnly())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-sc.wake:
+			timer.Stop()
+		case <-stopping:
+			timer.Stop()
+			sc.runs.Wait()
+			for _, job := range sc.jobs {
+				if job.stop != nil {
+					job.stop()
+				}
+			}
+			return
+		}
+	}
+}
+
+// has reports whether a job of that name is scheduled. Callers hold sc.mu.
+func (sc *jobScheduler) has(name string) bool {
+	for _, job := range sc.jobs {
+		if job.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch starts the jobs that are due and returns how long to sleep
+// until the next one is
+func (sc *jobScheduler) dispatch(ctx context.Context, readOnly bool) time.Duration {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	wait := schedulerTick
+	for _, job := range sc.jobs {
+		if job.next.IsZero() {
+			continue
+		}
+		if job.next.After(now) {
+			if until := job.next.Sub(now); until < wait {
+				wait = until
+			}
+			continue
+		}
+		job.next = sc.after(job, now)
+		switch {
+		case !job.running.IsZero():
+			job.overlaps++
+			golog.Warnf("scheduled job %s is still running since %s, skipping this run", job.name, job.running.Format(time.RFC3339))
+		case readOnly && !job.duringMaintenance:
+			sc.finish(ctx, job, &JobRun{StartedAt: now, FinishedAt: now, Status: JobRunSkipped, Error: "read-only maintenance mode"})
+		default:
+			job.running = now
+			sc.runs.Add(1)
+			go sc.runJob(ctx, job, now)
+		}
+		if until := job.next.Sub(now); !job.next.IsZero() && until < wait {
+			wait = until
+		}
+	}
+	return wait
+}
+
+// runJob runs a job once and records how it went
+func (sc *jobScheduler) runJob(ctx context.Context, job *scheduledJob, started time.Time) {
+	defer sc.runs.Done()
+	err := job.run(ctx)
+	run := &JobRun{StartedAt: started, FinishedAt: time.Now(), Status: JobRunOK}
+	run.DurationMS = run.FinishedAt.Sub(started).Milliseconds()
+	if err != nil {
+		golog.Errorf("scheduled job %s failed: %v", job.name, err)
+		run.Status, run.Error = JobRunFailed, err.Error()
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	job.running = time.Time{}
+	sc.finish(ctx, job, run)
+}
+
+// finish records a job's run. Callers hold sc.mu.
+func (sc *jobScheduler) finish(ctx context.Context, job *scheduledJob, run *JobRun) {
+	job.last = run
+	if err := sc.store.SaveJobRun(ctx, job.name, run); err != nil {
+		golog.Errorf("failed to save the run of scheduled job %s: %v", job.name, err)
+	}
+}
+
+// runNow makes a job due at once
+func (sc *jobScheduler) runNow(name string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, job := range sc.jobs {
+		if job.name != name {
+			continue
+		}
+		if !job.running.IsZero() {
+			return errJobRunning
+		}
+		job.next = time.Now()
+		select {
+		case sc.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return errJobNotFound
+}
+
+// list returns the state of every scheduled job, by name
+func (sc *jobScheduler) list() []JobState {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	states := make([]JobState, 0, len(sc.jobs))
+	for _, job := range sc.jobs {
+		state := JobState{Name: job.name, Schedule: job.spec, Overlaps: job.overlaps}
+		if !job.next.IsZero() {
+			next := job.next
+			state.NextRunAt = &next
+		}
+		if !job.running.IsZero() {
+			running := job.running
+			state.RunningSince = &running
+		}
+		if job.last != nil {
+			last := *job.last
+			state.LastRun = &last
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// scheduleJobs adds the server's background jobs to its scheduler
+func (s *Server) scheduleJobs() {
+	if s.cfg.SourceCheckInterval > 0 {
+		s.scheduler.add(&scheduledJob{
+			name: "source_freshness",
+			spec: fmt.Sprintf("@every %dm", s.cfg.SourceCheckInterval),
+			run:  s.checkAllSources,
+		})
+	}
+	if s.cfg.TopicInterval > 0 {
+		s.scheduler.add(&scheduledJob{
+			name: "topics",
+			spec: fmt.Sprintf("@every %dm", s.cfg.TopicInterval),
+			run:  s.refreshStaleTopics,
+		})
+	}
+	// Indexes every notebook at startup, then those that changed since
+	s.scheduler.add(&scheduledJob{name: "related", spec: relatedIndexSchedule, run: s.updateRelatedIndex, atStart: true})
+	// Each scheduled prompt has its own schedule; this looks for due ones
+	s.scheduler.add(&scheduledJob{name: "scheduled_prompts", spec: "* * * * *", run: s.runDueScheduledPrompts})
+	s.scheduler.add(&scheduledJob{name: "reminders", spec: "* * * * *", run: s.sendReminders})
+	s.scheduler.add(&scheduledJob{
+		name: "change_journal",
+		spec: changePruneSchedule,
+		run: func(ctx context.Context) error {
+			_, err := s.store.PruneChanges(ctx, time.Now().Add(-changeRetention))
+			return err
+		},
+	})
+	if s.retentionPolicy().enabled() {
+		s.scheduler.add(&scheduledJob{
+			name: "retention",
+			spec: retentionSchedule,
+			run: func(ctx context.Context) error {
+				if report := s.runRetention(ctx, s.retentionPolicy()); len(report.Errors) > 0 {
+					return errors.New(strings.Join(report.Errors, "; "))
+				}
+				return nil
+			},
+		})
+	}
+	if s.cfg.VectorIndexDir != "" || s.cfg.NotebookIdleMinutes > 0 {
+		s.scheduler.add(&scheduledJob{
+			name: "vector_index",
+			spec: vectorIndexSchedule,
+			run: func(ctx context.Context) error {
+				s.vectorStore.SaveIndexes(ctx)
+				s.unloadIdleNotebooks()
+				return nil
+			},
+			// Saving indexes changes no data
+			duringMaintenance: true,
+			stop:              func() { s.vectorStore.SaveIndexes(context.Background()) },
+		})
+	}
+	if s.cfg.ACMEEnabled && s.cfg.ACMEDNSProvider != "" {
+		// Certificates are issued at startup when missing, and renewed
+		// dnsRenewBefore they expire
+		s.scheduler.add(&scheduledJob{
+			name:              "certificates",
+			spec:              dnsCertificateSchedule,
+			run:               s.renewDNSCertificates,
+			atStart:           true,
+			duringMaintenance: true,
+		})
+	}
+	s.scheduler.add(&scheduledJob{name: "upload_sessions", spec: uploadSessionSchedule, run: s.cleanupUploadSessions})
+	s.scheduler.add(&scheduledJob{
+		name: "outbox",
+		spec: outboxPruneSchedule,
+		run: func(ctx context.Context) error {
+			_, err := s.store.PruneOutbox(ctx, time.Now().Add(-outboxRetention))
+			return err
+		},
+	})
+}
+
+// Store
+
+// ListJobRuns returns the last run of each scheduled job, by job name
+func (s *Store) ListJobRuns(ctx context.Context) (map[string]*JobRun, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, started_at, finished_at, status, error, duration_ms FROM job_runs
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make(map[string]*JobRun)
+	for rows.Next() {
+		var name string
+		var startedAt, finishedAt int64
+		var runErr sql.NullString
+		run := &JobRun{}
+		if err := rows.Scan(&name, &startedAt, &finishedAt, &run.Status, &runErr, &run.DurationMS); err != nil {
+			return nil, err
+		}
+		run.StartedAt = time.Unix(startedAt, 0)
+		run.FinishedAt = time.Unix(finishedAt, 0)
+		run.Error = runErr.String
+		runs[name] = run
+	}
+	return runs, rows.Err()
+}
+
+// SaveJobRun records the last run of a scheduled job
+func (s *Store) SaveJobRun(ctx context.Context, name string, run *JobRun) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO job_runs (name, started_at, finished_at, status, error, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET started_at = excluded.started_at,
+			finished_at = excluded.finished_at, status = excluded.status,
+			error = excluded.error, duration_ms = excluded.duration_ms
+	`, name, run.StartedAt.Unix(), run.FinishedAt.Unix(), run.Status, nullString(run.Error), run.DurationMS)
+	return err
+}
+
+// Scheduled job handlers
+
+// handleListSchedules lists the background jobs with their schedules and
+// last runs
+func (s *Server) handleListSchedules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"jobs": s.scheduler.list()})
+}
+
+// handleRunSchedule runs a background job now, outside its schedule
+func (s *Server) handleRunSchedule(c *gin.Context) {
+	switch err := s.scheduler.runNow(c.Param("name")); {
+	case errors.Is(err, errJobNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Scheduled job not found"})
+	case errors.Is(err, errJobRunning):
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "The job is already running"})
+	default:
+		c.Status(http.StatusAccepted)
+	}
+}
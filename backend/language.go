@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// NotebookLanguage is a language a notebook can be set to. It decides the
+// language of LLM answers and generated notes, how dates in them are
+// written, and how the notebook's sources are tokenized for search.
+type NotebookLanguage struct {
+	Code string `json:"code"`
+	Name string `json:"name"` // in the language itself
+	// dateLayout writes dates; regions listed in regionDates override it
+	dateLayout  string
+	regionDates map[string]string
+	// suffixes are stripped from words for search, longest first; cjk
+	// languages are split into character pairs instead
+	suffixes []string
+	cjk      bool
+}
+
+// notebookLanguages are the supported languages by ISO 639-1 code. A
+// notebook's language may add a region, as in "en-GB".
+var notebookLanguages = map[string]*NotebookLanguage{
+	"en": {Code: "en", Name: "English", dateLayout: "2 January 2006",
+		regionDates: map[string]string{"US": "January 2, 2006"},
+		suffixes:    []string{"ations", "ation", "ness", "ment", "ing", "ies", "ied", "ed", "es", "ly", "s", "y"}},
+	"de": {Code: "de", Name: "Deutsch", dateLayout: "02.01.2006",
+		suffixes: []string{"ungen", "ung", "keit", "heit", "isch", "ern", "em", "en", "er", "es", "e", "n", "s"}},
+	"fr": {Code: "fr", Name: "Français", dateLayout: "02/01/2006",
+		suffixes: []string{"ations", "ation", "ements", "ement", "euses", "euse", "ées", "ée", "és", "es", "é", "e", "s"}},
+	"es": {Code: "es", Name: "Español", dateLayout: "02/01/2006",
+		suffixes: []string{"aciones", "ación", "mente", "idades", "idad", "ados", "adas", "ado", "ada", "es", "os", "as", "o", "a", "s"}},
+	"it": {Code: "it", Name: "Italiano", dateLayout: "02/01/2006",
+		suffixes: []string{"azioni", "azione", "mente", "ità", "ati", "ate", "ato", "ata", "i", "e", "o", "a"}},
+	"pt": {Code: "pt", Name: "Português", dateLayout: "02/01/2006",
+		suffixes: []string{"ações", "ação", "mente", "idades", "idade", "ados", "adas", "ado", "ada", "es", "os", "as", "o", "a", "s"}},
+	"nl": {Code: "nl", Name: "Nederlands", dateLayout: "02-01-2006",
+		suffixes: []string{"heden", "heid", "ingen", "ing", "en", "er", "e", "s"}},
+	"zh": {Code: "zh", Name: "中文", dateLayout: "2006年1月2日", cjk: true},
+	"ja": {Code: "ja", Name: "日本語", dateLayout: "2006年1月2日", cjk: true},
+	"ko": {Code: "ko", Name: "한국어", dateLayout: "2006. 1. 2.", cjk: true},
+}
+
+// supportedLanguages lists the language codes for error messages
+func supportedLanguages() string {
+	codes := make([]string, 0, len(notebookLanguages))
+	for code := range notebookLanguages {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return strings.Join(codes, ", ")
+}
+
+// normalizeLanguage checks a language tag such as "de" or "en-GB" and
+// returns it as language-REGION. "" means no language is set.
+func normalizeLanguage(tag string) (string, error) {
+	tag = strings.TrimSpace(strings.ReplaceAll(tag, "_", "-"))
+	if tag == "" {
+		return "", nil
+	}
+	code, region, hasRegion := strings.Cut(tag, "-")
+	code = strings.ToLower(code)
+	if _, ok := notebookLanguages[code]; !ok {
+		return "", invalidField("language", "must be one of %s, optionally with a region as in en-GB", supportedLanguages())
+	}
+	if !hasRegion {
+		return code, nil
+	}
+	region = strings.ToUpper(region)
+	if len(region) != 2 || strings.IndexFunc(region, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		return "", invalidField("language", "must have a two-letter region, as in en-GB")
+	}
+	return code + "-" + region, nil
+}
+
+// lookupLanguage returns the language of a tag and its region, or nil when
+// the tag is empty or unknown
+func lookupLanguage(tag string) (*NotebookLanguage, string) {
+	code, region, _ := strings.Cut(tag, "-")
+	return notebookLanguages[strings.ToLower(code)], strings.ToUpper(region)
+}
+
+// formatDate writes a date the way a language tag's locale does, or as
+// 2006-01-02 without a language
+func formatDate(tag string, t time.Time) string {
+	lang, region := lookupLanguage(tag)
+	if lang == nil {
+		return t.Format("2006-01-02")
+	}
+	if layout, ok := lang.regionDates[region]; ok {
+		return t.Format(layout)
+	}
+	return t.Format(lang.dateLayout)
+}
+
+// languageInstruction is appended to prompts of a notebook with a language,
+// overriding the built-in prompts' request to answer in Chinese. It is ""
+// without a language.
+func languageInstruction(tag string) string {
+	lang, _ := lookupLanguage(tag)
+	if lang == nil {
+		return ""
+	}
+	return fmt.Sprintf("\n\n**注意：本笔记本的语言是 %s（%s），请务必使用该语言回复，这优先于上文关于回复语言的要求。今天是 %s，日期请按同样的格式书写。**",
+		lang.Name, lang.Code, formatDate(tag, time.Now()))
+}
+
+// searchTerms splits lowercased text into the terms a language's search
+// index matches on: stemmed words, or character pairs for CJK languages
+func (l *NotebookLanguage) searchTerms(text string) []string {
+	if l.cjk {
+		return cjkBigrams(text)
+	}
+	words := strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) })
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if len([]rune(w)) > 2 {
+			terms = append(terms, l.stem(w))
+		}
+	}
+	return terms
+}
+
+// stem strips the longest known suffix, keeping at least three letters
+func (l *NotebookLanguage) stem(word string) string {
+	runes := len([]rune(word))
+	for _, suffix := range l.suffixes {
+		if strings.HasSuffix(word, suffix) && runes-len([]rune(suffix)) >= 3 {
+			return strings.TrimSuffix(word, suffix)
+		}
+	}
+	return word
+}
+
+// cjkBigrams splits text into overlapping pairs of letters, the usual
+// tokenization for searching languages written without spaces. Runs of one
+// letter are kept as they are.
+func cjkBigrams(text string) []string {
+	var terms []string
+	for _, run := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }) {
+		runes := []rune(run)
+		if len(runes) == 1 {
+			terms = append(terms, run)
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			terms = append(terms, string(runes[i:i+2]))
+		}
+	}
+	return terms
+}
+
+// Notebook language operations
+
+// SetNotebookLanguage sets a notebook's language tag; "" clears it
+func (s *Store) SetNotebookLanguage(ctx context.Context, id, language string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE notebooks SET language = ?, updated_at = ? WHERE id = ?`, language, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundError("notebook")
+	}
+	return nil
+}
+
+// SetNotebookLanguage sets a notebook's language and invalidates cache
+func (cs *CachedStore) SetNotebookLanguage(ctx context.Context, id, language string) error {
+	if err := cs.Store.SetNotebookLanguage(ctx, id, language); err != nil {
+		return err
+	}
+	cs.cache.Delete(notebookKey(id))
+	cs.cache.Delete(notebookListKey())
+	return nil
+}
+
+// notebookLanguage returns a notebook's language tag, or "" when it has none
+func (s *Server) notebookLanguage(ctx context.Context, notebookID string) string {
+	nb, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		return ""
+	}
+	return nb.Language
+}
+
+// setNotebookLanguage saves a notebook's language and has the search index
+// tokenize its sources for it
+func (s *Server) setNotebookLanguage(ctx context.Context, notebookID, language string) error {
+	if err := s.store.SetNotebookLanguage(ctx, notebookID, language); err != nil {
+		return err
+	}
+	s.vectorStore.SetNotebookLanguage(notebookID, language)
+	return nil
+}
+
+// loadNotebookLanguage tells the search index the language of a notebook
+// being loaded
+func (s *Server) loadNotebookLanguage(ctx context.Context, notebookID string) {
+	nb, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		golog.Warnf("failed to load language of notebook %s: %v", notebookID, err)
+		return
+	}
+	s.vectorStore.SetNotebookLanguage(notebookID, nb.Language)
+}
+
+// handleListLanguages lists the languages a notebook can be set to
+func (s *Server) handleListLanguages(c *gin.Context) {
+	languages := make([]*NotebookLanguage, 0, len(notebookLanguages))
+	for _, lang := range notebookLanguages {
+		languages = append(languages, lang)
+	}
+	sort.Slice(languages, func(i, j int) bool { return languages[i].Code < languages[j].Code })
+	c.JSON(http.StatusOK, languages)
+}
@@ -0,0 +1,190 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// llmRetryBackoff is the wait before retrying a provider; it doubles each time
+const llmRetryBackoff = time.Second
+
+// Names of the providers an answer can come from
+const (
+	LLMPrimary  = "primary"
+	LLMFallback = "fallback"
+)
+
+// AnsweredBy records which provider produced an answer, after how many
+// attempts in all
+type AnsweredBy struct {
+	Provider string `json:"provider"` // LLMPrimary or LLMFallback
+	Model    string `json:"model"`
+	Attempts int    `json:"attempts"`
+}
+
+type answeredByKey struct{}
+
+// withAnsweredBy returns a context in which LLM calls record the provider
+// that answered them
+func withAnsweredBy(ctx context.Context) (context.Context, *AnsweredBy) {
+	answered := &AnsweredBy{}
+	return context.WithValue(ctx, answeredByKey{}, answered), answered
+}
+
+// llmStatusPattern finds the HTTP status in the langchaingo clients' errors,
+// which only carry it in their text: "status code: 503" from OpenAI
+// compatible APIs, "503 Service Unavailable" from Ollama
+var llmStatusPattern = regexp.MustCompile(`(?:status code:? ?|^)(\d{3})\b`)
+
+// isRetryableLLMError reports whether a provider turned a call away for
+// load or its own failure (429 or 5xx), so it may succeed later or elsewhere
+func isRetryableLLMError(err error) bool {
+	if isRateLimitError(err) {
+		return true
+	}
+	m := llmStatusPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return false
+	}
+	status, _ := strconv.Atoi(m[1])
+	return status >= 500 && status <= 599
+}
+
+// llmEndpoint is a provider an LLM call can go to
+type llmEndpoint struct {
+	name  string
+	model string
+	llm   llms.Model
+	// host is whose circuit breaker the calls go through
+	host string
+}
+
+// resilientLLM retries calls the provider turned away with jittered backoff
+// and then fails over to the secondary provider, if one is configured.
+// Streamed calls are not retried once part of the answer went out. A
+// provider whose circuit breaker is open is skipped without being called.
+type resilientLLM struct {
+	endpoints []llmEndpoint
+	retries   int
+}
+
+// newResilientLLM wraps the primary LLM with retries and the fallback
+// provider from cfg, which is created with the extra options, with the
+// debug log of chat calls, and with redaction of personal data when it is on
+func newResilientLLM(cfg Config, primary llms.Model, extra ...openai.Option) (llms.Model, error) {
+	model := cfg.OpenAIModel
+	if cfg.IsOllama() {
+		model = cfg.OllamaModel
+	}
+	r := &resilientLLM{
+		endpoints: []llmEndpoint{{name: LLMPrimary, model: model, llm: primary, host: providerHost(cfg.OpenAIBaseURL)}},
+		retries:   cfg.LLMMaxRetries,
+	}
+
+	if cfg.LLMFallbackModel != "" {
+		opts := []openai.Option{
+			openai.WithToken(cfg.LLMFallbackAPIKey),
+			openai.WithModel(cfg.LLMFallbackModel),
+			openai.WithHTTPClient(providerHTTPClient(cfg, 0, 0)),
+		}
+		if cfg.LLMFallbackBaseURL != "" {
+			opts = append(opts, openai.WithBaseURL(cfg.LLMFallbackBaseURL))
+		}
+		fallback, err := openai.New(append(opts, extra...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create fallback LLM: %w", err)
+		}
+		r.endpoints = append(r.endpoints, llmEndpoint{name: LLMFallback, model: cfg.LLMFallbackModel, llm: fallback, host: providerHost(cfg.LLMFallbackBaseURL)})
+	}
+	return withRedaction(cfg, &loggingLLM{llm: r, model: model, masker: newLLMCallMasker(cfg)}), nil
+}
+
+// GenerateContent implements llms.Model
+func (r *resilientLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	// Note when a streamed answer has started, after which a retry would
+	// send its start again
+	var callOpts llms.CallOptions
+	for _, opt := range options {
+		opt(&callOpts)
+	}
+	streamed := false
+	if stream := callOpts.StreamingFunc; stream != nil {
+		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			if len(chunk) > 0 {
+				streamed = true
+			}
+			return stream(ctx, chunk)
+		}))
+	}
+
+	attempts := 0
+	var err error
+	for i, ep := range r.endpoints {
+		backoff := llmRetryBackoff
+		for retry := 0; ; retry++ {
+			// The clients hide the breaker's error behind their own, so it
+			// is checked first
+			if err = providerUnavailable(ep.host); err != nil {
+				break
+			}
+			attempts++
+			var resp *llms.ContentResponse
+			resp, err = ep.llm.GenerateContent(ctx, messages, options...)
+			if err == nil {
+				if answered, ok := ctx.Value(answeredByKey{}).(*AnsweredBy); ok {
+					*answered = AnsweredBy{Provider: ep.name, Model: ep.model, Attempts: attempts}
+				}
+				return resp, nil
+			}
+			if ctx.Err() != nil || streamed || !isRetryableLLMError(err) {
+				return nil, err
+			}
+			if retry == r.retries {
+				break
+			}
+
+			// Jitter keeps concurrent calls from retrying in lockstep
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			golog.Warnf("%s LLM %s failed (%v), retrying in %s", ep.name, ep.model, err, wait.Round(time.Millisecond))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		if i+1 < len(r.endpoints) {
+			golog.Warnf("%s LLM %s is failing, trying the %s provider: %v", ep.name, ep.model, r.endpoints[i+1].name, err)
+		}
+	}
+	return nil, err
+}
+
+// Call implements llms.Model
+func (r *resilientLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, r, prompt, options...)
+}
+
+// answerMetadata is the metadata saved with an assistant message: the
+// provider that answered, when known, and how well its citations held up
+// when they were checked
+func answerMetadata(response *ChatResponse) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	for _, key := range []string{"answered_by", "citation_check", "experiment"} {
+		if value, ok := response.Metadata[key]; ok {
+			metadata[key] = value
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
@@ -0,0 +1,337 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// maxLLMCalls bounds how many logged LLM calls are kept; older ones are
+// dropped
+const maxLLMCalls = 5000
+
+// secretPattern matches API keys and bearer tokens that end up in prompts,
+// such as a pasted config
+var secretPattern = regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}|\bAIza[0-9A-Za-z_-]{35}\b|(?i:bearer)\s+[A-Za-z0-9._~+/=-]{16,}`)
+
+// LLMCall is one request to the LLM made while answering a chat message,
+// with API keys and personal data masked
+type LLMCall struct {
+	ID        string `json:"id"`
+	SessionID string `json:"session_id"`
+	MessageID string `json:"message_id"`
+	Provider  string `json:"provider,omitempty"` // LLMPrimary or LLMFallback
+	Model     string `json:"model,omitempty"`
+	// Request holds the messages and call options, Response the choices;
+	// Response is null when the call failed with Error
+	Request    json.RawMessage `json:"request"`
+	Response   json.RawMessage `json:"response"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type llmCallLogKey struct{}
+
+// llmCallLog collects the LLM calls made for one chat answer
+type llmCallLog struct {
+	mu    sync.Mutex
+	calls []LLMCall
+}
+
+// llmCallMasker masks what is logged: configured secrets, anything shaped
+// like an API key, and personal data of every kind
+type llmCallMasker struct {
+	secrets  []string
+	redactor *piiRedactor
+}
+
+func newLLMCallMasker(cfg Config) *llmCallMasker {
+	m := &llmCallMasker{secrets: cfg.secretValues(), redactor: &piiRedactor{kinds: []string{PIIEmail, PIIPhone, PIIName}}}
+	if cfg.RedactPIINames != "" {
+		m.redactor.names = blockedTermsPattern(strings.Split(cfg.RedactPIINames, ","))
+	}
+	return m
+}
+
+// mask returns v as JSON with every string in it masked. Placeholders are
+// shared across the call, so a value is masked the same way everywhere.
+func (m *llmCallMasker) mask(rd *redaction, v interface{}) json.RawMessage {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		raw, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	var tree interface{}
+	json.Unmarshal(raw, &tree)
+	masked, _ := json.Marshal(m.maskValue(rd, tree))
+	return masked
+}
+
+func (m *llmCallMasker) maskText(rd *redaction, text string) string {
+	for _, secret := range m.secrets {
+		text = strings.ReplaceAll(text, secret, "[redacted]")
+	}
+	return rd.redact(secretPattern.ReplaceAllString(text, "[redacted]"))
+}
+
+func (m *llmCallMasker) maskValue(rd *redaction, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return m.maskText(rd, v)
+	case []interface{}:
+		for i := range v {
+			v[i] = m.maskValue(rd, v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = m.maskValue(rd, v[key])
+		}
+	}
+	return v
+}
+
+// loggedPart is a message part as logged; images and other binary parts are
+// only noted
+type loggedPart struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+func loggedMessages(messages []llms.MessageContent) []map[string]interface{} {
+	logged := make([]map[string]interface{}, len(messages))
+	for i, msg := range messages {
+		parts := make([]loggedPart, 0, len(msg.Parts))
+		for _, part := range msg.Parts {
+			switch p := part.(type) {
+			case llms.TextContent:
+				parts = append(parts, loggedPart{Type: "text", Text: p.Text})
+			case llms.ImageURLContent:
+				url := p.URL
+				if strings.HasPrefix(url, "data:") {
+					url = "data:…"
+				}
+				parts = append(parts, loggedPart{Type: "image_url", URL: url})
+			case llms.BinaryContent:
+				parts = append(parts, loggedPart{Type: "binary", Text: p.MIMEType + ", " + strconv.Itoa(len(p.Data)) + " bytes"})
+			case llms.ToolCall:
+				lp := loggedPart{Type: "tool_call"}
+				if p.FunctionCall != nil {
+					lp.Name, lp.Arguments = p.FunctionCall.Name, p.FunctionCall.Arguments
+				}
+				parts = append(parts, lp)
+			case llms.ToolCallResponse:
+				parts = append(parts, loggedPart{Type: "tool_result", Name: p.Name, Text: p.Content})
+			}
+		}
+		logged[i] = map[string]interface{}{"role": msg.Role, "parts": parts}
+	}
+	return logged
+}
+
+func loggedChoices(resp *llms.ContentResponse) []map[string]interface{} {
+	choices := make([]map[string]interface{}, len(resp.Choices))
+	for i, choice := range resp.Choices {
+		c := map[string]interface{}{"content": choice.Content, "stop_reason": choice.StopReason}
+		if choice.ReasoningContent != "" {
+			c["reasoning"] = choice.ReasoningContent
+		}
+		var calls []loggedPart
+		for _, call := range choice.ToolCalls {
+			if call.FunctionCall != nil {
+				calls = append(calls, loggedPart{Type: "tool_call", Name: call.FunctionCall.Name, Arguments: call.FunctionCall.Arguments})
+			}
+		}
+		if len(calls) > 0 {
+			c["tool_calls"] = calls
+		}
+		if len(choice.GenerationInfo) > 0 {
+			c["generation_info"] = choice.GenerationInfo
+		}
+		choices[i] = c
+	}
+	return choices
+}
+
+// loggingLLM records the calls made in a context with an llmCallLog; it
+// costs nothing otherwise
+type loggingLLM struct {
+	llm    llms.Model
+	model  string
+	masker *llmCallMasker
+}
+
+// GenerateContent implements llms.Model
+func (l *loggingLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	log, ok := ctx.Value(llmCallLogKey{}).(*llmCallLog)
+	if !ok {
+		return l.llm.GenerateContent(ctx, messages, options...)
+	}
+
+	start := time.Now()
+	resp, err := l.llm.GenerateContent(ctx, messages, options...)
+
+	var callOpts llms.CallOptions
+	for _, opt := range options {
+		opt(&callOpts)
+	}
+	call := LLMCall{Model: l.model, DurationMs: time.Since(start).Milliseconds(), CreatedAt: start}
+	if callOpts.Model != "" {
+		call.Model = callOpts.Model
+	}
+	if answered, ok := ctx.Value(answeredByKey{}).(*AnsweredBy); ok && answered.Provider != "" && err == nil {
+		call.Provider, call.Model = answered.Provider, answered.Model
+	}
+	rd := l.masker.redactor.begin()
+	call.Request = l.masker.mask(rd, map[string]interface{}{"messages": loggedMessages(messages), "options": callOpts})
+	if err != nil {
+		call.Error = l.masker.maskText(rd, err.Error())
+	} else {
+		call.Response = l.masker.mask(rd, map[string]interface{}{"choices": loggedChoices(resp)})
+	}
+
+	log.mu.Lock()
+	log.calls = append(log.calls, call)
+	log.mu.Unlock()
+	return resp, err
+}
+
+// Call implements llms.Model
+func (l *loggingLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, l, prompt, options...)
+}
+
+// withLLMCallLog returns a context in which LLM calls are collected for
+// saving with the chat message they answer, when LLM_DEBUG_LOG is on
+func (s *Server) withLLMCallLog(ctx context.Context) context.Context {
+	if !s.cfg.LLMDebugLog {
+		return ctx
+	}
+	return context.WithValue(ctx, llmCallLogKey{}, &llmCallLog{})
+}
+
+// saveLLMCalls saves the LLM calls collected in ctx with the message they
+// produced. Failing to is only logged.
+func (s *Server) saveLLMCalls(ctx context.Context, sessionID, messageID string) {
+	log, ok := ctx.Value(llmCallLogKey{}).(*llmCallLog)
+	if !ok {
+		return
+	}
+	log.mu.Lock()
+	calls := log.calls
+	log.calls = nil
+	log.mu.Unlock()
+	if len(calls) == 0 {
+		return
+	}
+	for i := range calls {
+		calls[i].SessionID, calls[i].MessageID = sessionID, messageID
+	}
+	if err := s.store.SaveLLMCalls(context.WithoutCancel(ctx), calls); err != nil {
+		golog.Errorf("failed to save the LLM calls of message %s: %v", messageID, err)
+	}
+}
+
+// SaveLLMCalls records logged LLM calls, keeping only the newest
+// maxLLMCalls
+func (s *Store) SaveLLMCalls(ctx context.Context, calls []LLMCall) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := range calls {
+		call := &calls[i]
+		call.ID = uuid.New().String()
+		var response interface{}
+		if call.Response != nil {
+			response = string(call.Response)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO llm_calls (id, session_id, message_id, provider, model, request, response, error, duration_ms, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, call.ID, call.SessionID, call.MessageID, call.Provider, call.Model, string(call.Request), response, call.Error, call.DurationMs, call.CreatedAt.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM llm_calls WHERE id NOT IN (
+			SELECT id FROM llm_calls ORDER BY created_at DESC, rowid DESC LIMIT ?
+		)
+	`, maxLLMCalls); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListLLMCalls retrieves the newest logged LLM calls, optionally only those
+// of a chat session or message, oldest first
+func (s *Store) ListLLMCalls(ctx context.Context, sessionID, messageID string, limit int) ([]LLMCall, error) {
+	query := `
+		SELECT id, session_id, message_id, provider, model, request, response, error, duration_ms, created_at
+		FROM llm_calls WHERE 1 = 1`
+	var args []interface{}
+	if sessionID != "" {
+		query += ` AND session_id = ?`
+		args = append(args, sessionID)
+	}
+	if messageID != "" {
+		query += ` AND message_id = ?`
+		args = append(args, messageID)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT * FROM (`+query+` ORDER BY created_at DESC, rowid DESC LIMIT ?) ORDER BY created_at, id`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calls := make([]LLMCall, 0)
+	for rows.Next() {
+		var call LLMCall
+		var request string
+		var response *string
+		var createdAt int64
+		if err := rows.Scan(&call.ID, &call.SessionID, &call.MessageID, &call.Provider, &call.Model, &request, &response, &call.Error, &call.DurationMs, &createdAt); err != nil {
+			return nil, err
+		}
+		call.Request = json.RawMessage(request)
+		if response != nil {
+			call.Response = json.RawMessage(*response)
+		}
+		call.CreatedAt = time.UnixMilli(createdAt)
+		calls = append(calls, call)
+	}
+	return calls, rows.Err()
+}
+
+func (s *Server) handleListLLMCalls(c *gin.Context) {
+	sessionID, messageID := c.Query("session_id"), c.Query("message_id")
+	limit := 20
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			validationResponse(c, invalidField("limit", "must be between 1 and 200"))
+			return
+		}
+		limit = n
+	}
+
+	calls, err := s.store.ListLLMCalls(c.Request.Context(), sessionID, messageID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list LLM calls"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": s.cfg.LLMDebugLog, "calls": calls})
+}
@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hostAllowList is where outgoing connections may go in local-only mode:
+// localhost and loopback addresses, and the hosts, IPs and CIDR ranges of
+// LOCAL_ALLOWED_HOSTS
+type hostAllowList struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+// newHostAllowList parses a comma-separated list of hosts, IPs and CIDRs
+func newHostAllowList(spec string) (*hostAllowList, error) {
+	l := &hostAllowList{hosts: map[string]bool{"localhost": true}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			l.nets = append(l.nets, ipNet)
+		case strings.ContainsAny(entry, ":?#@ ") && net.ParseIP(entry) == nil:
+			return nil, fmt.Errorf("%q is not a host name, IP or CIDR range", entry)
+		default:
+			l.hosts[entry] = true
+		}
+	}
+	return l, nil
+}
+
+// allowsHost reports whether connections to a host name or IP are allowed
+func (l *hostAllowList) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if l.hosts[host] {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || l.hosts[ip.String()] {
+		return true
+	}
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalOnlyError is returned for a connection local-only mode refuses
+type LocalOnlyError struct {
+	Host string
+}
+
+func (e *LocalOnlyError) Error() string {
+	return fmt.Sprintf("local-only mode refuses connections to %s; add it to LOCAL_ALLOWED_HOSTS if it is a local endpoint", e.Host)
+}
+
+var (
+	// localOnlyHosts are the hosts outgoing connections may go to; nil
+	// when local-only mode is off
+	localOnlyHosts *hostAllowList
+	// baseDialer opens outgoing connections, as http.DefaultTransport does
+	baseDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+)
+
+// checkOutbound returns a *LocalOnlyError if local-only mode refuses
+// connections to host
+func checkOutbound(host string) error {
+	if localOnlyHosts != nil && !localOnlyHosts.allowsHost(host) {
+		return &LocalOnlyError{Host: host}
+	}
+	return nil
+}
+
+// checkOutboundURL checks a URL that another program (markitdown or a
+// processor plugin) is about to fetch, since its connections bypass
+// dialOutbound
+func checkOutboundURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return checkOutbound(u.Hostname())
+}
+
+// dialOutbound opens the connections of outgoing requests, refusing hosts
+// local-only mode does not allow
+func dialOutbound(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if err := checkOutbound(host); err != nil {
+		return nil, err
+	}
+	return baseDialer.DialContext(ctx, network, addr)
+}
+
+// EnforceLocalOnly turns local-only mode on when LOCAL_ONLY is set: every
+// outgoing HTTP connection is then checked against the allow list. The
+// server calls it when it is created.
+func EnforceLocalOnly(cfg Config) error {
+	if !cfg.LocalOnly {
+		return nil
+	}
+	allowed, err := newHostAllowList(cfg.LocalAllowedHosts)
+	if err != nil {
+		return fmt.Errorf("LOCAL_ALLOWED_HOSTS: %w", err)
+	}
+	localOnlyHosts = allowed
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.DialContext = dialOutbound
+		// A proxy would be dialed instead of the allow-listed host
+		t.Proxy = nil
+	}
+	return nil
+}
+
+// localOnlyProblems lists the configured endpoints local-only mode would
+// refuse, so the server fails at startup rather than on first use
+func localOnlyProblems(cfg Config) []string {
+	if !cfg.LocalOnly {
+		return nil
+	}
+	allowed, err := newHostAllowList(cfg.LocalAllowedHosts)
+	if err != nil {
+		return []string{fmt.Sprintf("LOCAL_ALLOWED_HOSTS: %v", err)}
+	}
+
+	var problems []string
+	check := func(key, endpoint string) {
+		if endpoint == "" {
+			return
+		}
+		host := endpoint
+		if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+			host = u.Hostname()
+		} else if h, _, err := net.SplitHostPort(endpoint); err == nil {
+			host = h
+		}
+		if !allowed.allowsHost(host) {
+			problems = append(problems, fmt.Sprintf("LOCAL_ONLY is on but %s (%s) is not a local endpoint; add %s to LOCAL_ALLOWED_HOSTS if it is", key, endpoint, host))
+		}
+	}
+	cloud := func(feature, key string) {
+		problems = append(problems, fmt.Sprintf("LOCAL_ONLY is on but %s needs a cloud provider; unset %s", feature, key))
+	}
+
+	if cfg.IsOllama() {
+		check("OLLAMA_BASE_URL", cfg.OllamaBaseURL)
+	} else if cfg.OpenAIAPIKey != "" {
+		_, baseURL := llmProvider(cfg)
+		check("OPENAI_BASE_URL", baseURL)
+	}
+	if cfg.LLMFallbackModel != "" {
+		if cfg.LLMFallbackBaseURL == "" {
+			cloud("the fallback LLM", "LLM_FALLBACK_MODEL")
+		}
+		check("LLM_FALLBACK_BASE_URL", cfg.LLMFallbackBaseURL)
+	}
+	if cfg.GoogleAPIKey != "" {
+		cloud("Gemini", "GOOGLE_API_KEY")
+	}
+	check("TRANSCRIPTION_BASE_URL", cfg.TranscriptionBaseURL)
+	switch cfg.WebSearchProvider {
+	case "brave", "bing":
+		cloud("web search with "+cfg.WebSearchProvider, "WEB_SEARCH_PROVIDER")
+	case "searxng":
+		check("WEB_SEARCH_URL", cfg.WebSearchURL)
+	}
+	switch cfg.VectorStoreType {
+	case "supabase":
+		check("SUPABASE_URL", cfg.SupabaseURL)
+	case "postgres":
+		check("POSTGRES_URL", cfg.PostgreSQLURL)
+	case "redis":
+		check("REDIS_URL", cfg.RedisURL)
+	}
+	if cfg.ProviderProxy != "" {
+		problems = append(problems, "LOCAL_ONLY is on but the hosts requested through PROVIDER_PROXY cannot be checked; unset PROVIDER_PROXY")
+	}
+	check("SMTP_HOST", cfg.SMTPHost)
+	if cfg.APNSKeyFile != "" {
+		check("APNS_URL", cfg.APNSURL)
+	}
+	if cfg.FCMCredentialsFile != "" {
+		check("FCM_URL", cfg.FCMURL)
+	}
+	if cfg.ACMEEnabled {
+		check("ACME_DIRECTORY_URL", cfg.ACMEDirectoryURL)
+		if cfg.ACMEDNSProvider == dnsProviderCloudflare {
+			check("CLOUDFLARE_API_URL", cfg.CloudflareAPIURL)
+		}
+	}
+	if addr := cfg.ScanClamAVAddr; addr != "" && !strings.HasPrefix(addr, "unix:") && !strings.HasPrefix(addr, "/") {
+		check("SCAN_CLAMAV_ADDR", addr)
+	}
+	return problems
+}
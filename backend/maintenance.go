@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// MaintenanceStatus describes read-only maintenance mode
+type MaintenanceStatus struct {
+	ReadOnly bool       `json:"read_only"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// maintenanceMode holds whether the server is read-only, for backups and
+// migrations. While read-only, writes through the API are rejected and
+// background jobs that write skip their runs.
+type maintenanceMode struct {
+	mu     sync.RWMutex
+	status MaintenanceStatus
+}
+
+// Status returns the current maintenance status
+func (m *maintenanceMode) Status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// ReadOnly reports whether writes are currently rejected
+func (m *maintenanceMode) ReadOnly() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status.ReadOnly
+}
+
+// Set turns read-only mode on or off
+func (m *maintenanceMode) Set(readOnly bool, reason string) MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !readOnly {
+		m.status = MaintenanceStatus{}
+		return m.status
+	}
+	if !m.status.ReadOnly {
+		now := time.Now()
+		m.status.Since = &now
+	}
+	m.status.ReadOnly = true
+	m.status.Reason = reason
+	return m.status
+}
+
+// readOnlyExempt are write routes that keep working in read-only mode: the
+// maintenance toggle itself, exports and links to download them, instance
+// imports (which require it), and calls that do not change data
+var readOnlyExempt = map[string]bool{
+	"/api/admin/maintenance":                    true,
+	"/api/admin/instance/import":                true,
+	"/api/admin/config/reload":                  true,
+	"/api/account/export":                       true,
+	"/api/admin/users/:userId/export":           true,
+	"/api/notebooks/:id/hooks/test":             true,
+	"/api/account/jobs/:jobId/signed-url":       true,
+	"/api/notebooks/:id/export/signed-url":      true,
+	"/api/attachments/:attachmentId/signed-url": true,
+	"/api/admin/account-jobs/:jobId/signed-url": true,
+}
+
+// ReadOnlyMiddleware rejects writes with 503 while the server is in read-only
+// maintenance mode. Reads (GET, HEAD, OPTIONS and WebDAV's PROPFIND) and
+// exempt routes pass through.
+func ReadOnlyMiddleware(m *maintenanceMode) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			c.Next()
+			return
+		}
+
+		status := m.Status()
+		if !status.ReadOnly || readOnlyExempt[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		msg := "The server is in read-only maintenance mode"
+		if status.Reason != "" {
+			msg += ": " + status.Reason
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: msg})
+	}
+}
+
+// Maintenance handlers
+
+func (s *Server) handleGetMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, s.maintenance.Status())
+}
+
+func (s *Server) handleSetMaintenance(c *gin.Context) {
+	var req struct {
+		ReadOnly *bool  `json:"read_only" binding:"required"`
+		Reason   string `json:"reason"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	status := s.maintenance.Set(*req.ReadOnly, strings.TrimSpace(req.Reason))
+	if status.ReadOnly {
+		golog.Warnf("read-only maintenance mode enabled: %s", status.Reason)
+	} else {
+		golog.Infof("read-only maintenance mode disabled")
+	}
+
+	c.JSON(http.StatusOK, status)
+}
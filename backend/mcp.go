@@ -0,0 +1,408 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Version is reported to MCP clients; main sets it at startup
+var Version = "dev"
+
+// mcpProtocolVersions lists the Model Context Protocol revisions we speak, newest first
+var mcpProtocolVersions = []string{"2025-03-26", "2024-11-05"}
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpTools returns the tools exposed to MCP clients. Tools that work on a
+// notebook take a notebook_id argument.
+func (s *Server) mcpTools() []*ChatTool {
+	notebookParam := map[string]any{"type": "string", "description": "Notebook ID (see list_notebooks)"}
+
+	return []*ChatTool{
+		{
+			Name:        "list_notebooks",
+			Description: "List the user's notebooks with their IDs and descriptions.",
+			Parameters:  map[string]any{"type": "object", "properties": map[string]any{}},
+			Run:         s.runMCPListNotebooks,
+		},
+		{
+			Name:        "search_notes",
+			Description: "Search notes by keyword, in one notebook or across all notebooks, and return matching excerpts.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query":       map[string]any{"type": "string", "description": "Keywords to look for"},
+					"notebook_id": map[string]any{"type": "string", "description": "Limit the search to one notebook"},
+				},
+				"required": []string{"query"},
+			},
+			Run: s.runMCPSearchNotes,
+		},
+		{
+			Name:        "get_source",
+			Description: "Get the full text of a source. Omit source_id to list the notebook's sources.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"notebook_id": notebookParam,
+					"source_id":   map[string]any{"type": "string", "description": "Source ID"},
+				},
+				"required": []string{"notebook_id"},
+			},
+			Run: s.runMCPGetSource,
+		},
+		{
+			Name:        "create_note",
+			Description: "Save a new note in a notebook.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"notebook_id": notebookParam,
+					"title":       map[string]any{"type": "string", "description": "Note title"},
+					"content":     map[string]any{"type": "string", "description": "Note content in Markdown"},
+				},
+				"required": []string{"notebook_id", "title", "content"},
+			},
+			Run: s.runCreateNote,
+		},
+		{
+			Name:        "chat_with_notebook",
+			Description: "Ask a question answered from a notebook's sources, with citations.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"notebook_id": notebookParam,
+					"message":     map[string]any{"type": "string", "description": "Question to ask"},
+				},
+				"required": []string{"notebook_id", "message"},
+			},
+			Run: s.runMCPChat,
+		},
+	}
+}
+
+func (s *Server) runMCPListNotebooks(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(notebooks) == 0 {
+		return "No notebooks.", nil
+	}
+
+	var b strings.Builder
+	for _, nb := range notebooks {
+		fmt.Fprintf(&b, "- %s (id: %s)", nb.Name, nb.ID)
+		if nb.Description != "" {
+			fmt.Fprintf(&b, ": %s", nb.Description)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+func (s *Server) runMCPSearchNotes(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	if notebookID != "" {
+		return s.runNoteLookup(ctx, notebookID, args)
+	}
+
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, nb := range notebooks {
+		result, err := s.runNoteLookup(ctx, nb.ID, args)
+		if err != nil {
+			return "", err
+		}
+		if result == "No matching notes." {
+			continue
+		}
+		fmt.Fprintf(&b, "# Notebook: %s (id: %s)\n\n%s", nb.Name, nb.ID, result)
+	}
+	if b.Len() == 0 {
+		return "No matching notes.", nil
+	}
+	return b.String(), nil
+}
+
+func (s *Server) runMCPGetSource(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	sourceID := stringArg(args, "source_id")
+	if sourceID == "" {
+		sources, err := s.store.ListSources(ctx, notebookID)
+		if err != nil {
+			return "", err
+		}
+		if len(sources) == 0 {
+			return "No sources.", nil
+		}
+		var b strings.Builder
+		for _, src := range sources {
+			fmt.Fprintf(&b, "- %s (id: %s, type: %s)\n", src.Name, src.ID, src.Type)
+		}
+		return b.String(), nil
+	}
+
+	source, err := s.store.GetSource(ctx, sourceID)
+	if err != nil || source.NotebookID != notebookID {
+		return "", notFoundError("source")
+	}
+
+	header := fmt.Sprintf("# %s\n", source.Name)
+	if source.URL != "" {
+		header += fmt.Sprintf("URL: %s\n", source.URL)
+	}
+	return header + "\n" + source.Content, nil
+}
+
+func (s *Server) runMCPChat(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	message := strings.TrimSpace(stringArg(args, "message"))
+	if message == "" {
+		return "", fmt.Errorf("message is required")
+	}
+
+	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	if err := s.moderate(ctx, moderationInput{NotebookID: notebookID, Stage: ModerationStagePrompt, Text: message}); err != nil {
+		return "", err
+	}
+	session := &ChatSession{NotebookID: notebookID, NotebookIDs: []string{notebookID}}
+	release, err := s.chatQueue.wait(ctx, "mcp", nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := s.runChat(ctx, notebookID, ChatRequest{Message: message}, session, nil)
+	release()
+	if err != nil {
+		return "", err
+	}
+	if err := s.moderate(ctx, moderationInput{NotebookID: notebookID, Stage: ModerationStageAnswer, Text: response.Message}); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(response.Message)
+	if len(response.Sources) > 0 {
+		b.WriteString("\n\nSources:\n")
+		for i, src := range response.Sources {
+			fmt.Fprintf(&b, "%d. %s (id: %s)\n", i+1, src.Name, src.ID)
+		}
+	}
+	return b.String(), nil
+}
+
+// handleRPC dispatches one JSON-RPC message. Notifications return nil.
+func (s *Server) handleRPC(ctx context.Context, req *rpcRequest) *rpcResponse {
+	if req.ID == nil {
+		// Notifications (e.g. notifications/initialized) need no reply
+		return nil
+	}
+
+	resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	if req.JSONRPC != "2.0" {
+		resp.Error = &rpcError{Code: rpcInvalidRequest, Message: "jsonrpc must be 2.0"}
+		return resp
+	}
+
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+
+		version := mcpProtocolVersions[0]
+		for _, v := range mcpProtocolVersions {
+			if v == params.ProtocolVersion {
+				version = v
+			}
+		}
+		resp.Result = map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "notex", "version": Version},
+		}
+
+	case "ping":
+		resp.Result = map[string]any{}
+
+	case "tools/list":
+		tools := make([]map[string]any, 0)
+		for _, tool := range s.mcpTools() {
+			tools = append(tools, map[string]any{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"inputSchema": tool.Parameters,
+			})
+		}
+		resp.Result = map[string]any{"tools": tools}
+
+	case "tools/call":
+		var params struct {
+			Name      string         `json:"name"`
+			Arguments map[string]any `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp.Error = &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+			return resp
+		}
+
+		var tool *ChatTool
+		for _, t := range s.mcpTools() {
+			if t.Name == params.Name {
+				tool = t
+			}
+		}
+		if tool == nil {
+			resp.Error = &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown tool: %s", params.Name)}
+			return resp
+		}
+		resp.Result = s.callMCPTool(ctx, tool, params.Arguments)
+
+	default:
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method not found: %s", req.Method)}
+	}
+
+	return resp
+}
+
+// callMCPTool runs a tool, reporting failures as tool errors the client can show
+func (s *Server) callMCPTool(ctx context.Context, tool *ChatTool, args map[string]any) mcpToolResult {
+	if args == nil {
+		args = map[string]any{}
+	}
+
+	notebookID := stringArg(args, "notebook_id")
+	if notebookID != "" {
+		if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+			return mcpToolResult{Content: []mcpContent{{Type: "text", Text: "notebook not found"}}, IsError: true}
+		}
+	}
+
+	text, err := tool.Run(ctx, notebookID, args)
+	if err != nil {
+		golog.Warnf("mcp tool %s failed: %v", tool.Name, err)
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: text}}}
+}
+
+// ServeMCP speaks MCP over newline-delimited JSON-RPC, as used by the stdio
+// transport. It returns when in is exhausted.
+func (s *Server) ServeMCP(ctx context.Context, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+
+	var mu sync.Mutex
+	write := func(resp *rpcResponse) {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			golog.Errorf("failed to encode mcp response: %v", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		out.Write(append(data, '\n'))
+	}
+
+	var wg sync.WaitGroup
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var req rpcRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			write(&rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+
+		// Tool calls can be slow (chat), so they are answered concurrently;
+		// everything else is answered in order
+		if req.Method != "tools/call" {
+			if resp := s.handleRPC(ctx, &req); resp != nil {
+				write(resp)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := s.handleRPC(ctx, &req); resp != nil {
+				write(resp)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return scanner.Err()
+}
+
+// handleMCP serves MCP over HTTP: each POST carries one JSON-RPC message and
+// gets a JSON reply
+func (s *Server) handleMCP(c *gin.Context) {
+	ctx := context.Background()
+
+	var req rpcRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+		return
+	}
+
+	resp := s.handleRPC(ctx, &req)
+	if resp == nil {
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
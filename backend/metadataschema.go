@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxMetadataValueBytes bounds the encoded size of one metadata value a
+	// client sends
+	maxMetadataValueBytes = 16 << 10
+	// maxMetadataBytes bounds the encoded metadata of a note or notebook,
+	// including what the server adds
+	maxMetadataBytes = 1 << 20
+)
+
+// metadataKeys are the metadata keys the server reads, with the type it
+// reads them as. Other keys without a dot are free-form.
+var metadataKeys = map[string]*jsonSchema{
+	// Notebooks
+	smartSearchKey: {Type: "object"},
+	"kind":         stringSchema(""),
+	// Notes
+	propertiesKey:     {Type: "object"},
+	"tags":            arraySchema(stringSchema("")),
+	"snoozed_until":   stringSchema(""),
+	"url":             stringSchema(""),
+	"summary":         stringSchema(""),
+	"capture_status":  {Type: "string", Enum: []string{CapturePending, CaptureProcessed, CaptureFailed}},
+	"capture_error":   stringSchema(""),
+	"attachment_id":   stringSchema(""),
+	"merged_note_ids": arraySchema(stringSchema("")),
+}
+
+// metadataNamespacePattern is what the name of a metadata namespace may look
+// like; keys in it are "<namespace>.<property>"
+var metadataNamespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// metadataNamespaces holds the schemas of the metadata namespaces defined by
+// processor plugins, by namespace
+var metadataNamespaces struct {
+	sync.RWMutex
+	byName map[string]*jsonSchema
+}
+
+// registerMetadataNamespace defines the keys of a namespace with an object
+// schema, whose properties are the keys' names and types
+func registerMetadataNamespace(name string, schema *jsonSchema) error {
+	if !metadataNamespacePattern.MatchString(name) {
+		return fmt.Errorf("metadata namespace %q must be 1-32 letters, digits, '_' or '-'", name)
+	}
+	if schema.Type != "object" || len(schema.Properties) == 0 {
+		return fmt.Errorf("metadata schema must be an object with properties")
+	}
+	if err := checkMetadataSchema(schema, name); err != nil {
+		return err
+	}
+
+	metadataNamespaces.Lock()
+	defer metadataNamespaces.Unlock()
+	if metadataNamespaces.byName == nil {
+		metadataNamespaces.byName = make(map[string]*jsonSchema)
+	}
+	metadataNamespaces.byName[name] = schema
+	return nil
+}
+
+// metadataNamespace returns the schema of a namespace, or nil when no plugin
+// defines it
+func metadataNamespace(name string) *jsonSchema {
+	metadataNamespaces.RLock()
+	defer metadataNamespaces.RUnlock()
+	return metadataNamespaces.byName[name]
+}
+
+// checkMetadataSchema rejects schemas that use types validation does not
+// know, or arrays without item types
+func checkMetadataSchema(s *jsonSchema, path string) error {
+	if s == nil {
+		return fmt.Errorf("%s has no schema", path)
+	}
+	switch s.Type {
+	case "object":
+		for name, p := range s.Properties {
+			if err := checkMetadataSchema(p, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		return checkMetadataSchema(s.Items, path+"[]")
+	case "string", "number", "integer", "boolean":
+	default:
+		return fmt.Errorf("%s has unknown type %q", path, s.Type)
+	}
+	return nil
+}
+
+// metadataValueProblem explains why a decoded JSON value does not fit its
+// key's registered type or namespace schema, or returns "". Keys of
+// namespaces no plugin defines are not checked here.
+func metadataValueProblem(key string, value interface{}) string {
+	schema := metadataKeys[key]
+	if namespace, property, ok := strings.Cut(key, "."); ok {
+		ns := metadataNamespace(namespace)
+		if ns == nil {
+			return ""
+		}
+		if schema = ns.Properties[property]; schema == nil {
+			return fmt.Sprintf("key %q is not defined by namespace %q", key, namespace)
+		}
+	}
+	if schema == nil {
+		return ""
+	}
+	if err := schema.validate(value, key); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// encodeMetadata checks the metadata of a note or notebook before it is
+// written, and returns it encoded for the database. Values set in this
+// process are checked as they will be read back.
+func encodeMetadata(metadata map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMetadataBytes {
+		return nil, invalidField("metadata", "must be at most %s encoded, got %s", formatBytes(maxMetadataBytes), formatBytes(int64(len(data))))
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(decoded))
+	for k := range decoded {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fields fieldErrors
+	for _, k := range keys {
+		if problem := metadataValueProblem(k, decoded[k]); problem != "" {
+			fields.add("metadata", "%s", problem)
+		}
+	}
+	if err := fields.err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
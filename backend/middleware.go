@@ -44,38 +44,11 @@ func init() {
 	auditLogger.SetTimeFormat("2006-01-02 15:04:05")
 }
 
-// getClientIP extracts the real client IP from the request, taking into account
-// proxies and load balancers that set X-Forwarded-For, X-Real-IP, etc.
+// getClientIP returns the client's IP: the one a trusted proxy names in
+// X-Forwarded-For, X-Real-IP, CF-Connecting-IP or True-Client-IP, or the
+// connection's (see configureProxies). Headers from anyone else are ignored,
+// so they cannot be used to pose as another client.
 func getClientIP(c *gin.Context) string {
-	// Check X-Forwarded-For header (set by Nginx and other proxies)
-	// Format: X-Forwarded-For: <client>, <proxy1>, <proxy2>
-	// The first IP is the original client IP
-	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
-		// Parse the first IP from the comma-separated list
-		for i, char := range xff {
-			if char == ',' {
-				return xff[:i]
-			}
-		}
-		return xff
-	}
-
-	// Check X-Real-IP header (often set by Nginx)
-	if xri := c.GetHeader("X-Real-IP"); xri != "" {
-		return xri
-	}
-
-	// Check CF-Connecting-IP (Cloudflare)
-	if cfip := c.GetHeader("CF-Connecting-IP"); cfip != "" {
-		return cfip
-	}
-
-	// Check True-Client-IP (Akamai and Cloudflare Enterprise)
-	if tci := c.GetHeader("True-Client-IP"); tci != "" {
-		return tci
-	}
-
-	// Fall back to RemoteAddr
 	return c.ClientIP()
 }
 
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package backend
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads size bytes of f into memory where mapping is not supported
+func mmapFile(f *os.File, size int) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// syncNotifications is how many unread notifications a sync returns
+const syncNotifications = 50
+
+// SyncNotebook is a notebook as mobile sync sends it
+type SyncNotebook struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	TrashedAt  *time.Time `json:"trashed_at,omitempty"`
+}
+
+// SyncNote is a note as mobile sync sends it, without its sources and
+// metadata other than tags
+type SyncNote struct {
+	ID         string    `json:"id"`
+	NotebookID string    `json:"notebook_id"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content"`
+	Type       string    `json:"type"`
+	Tags       []string  `json:"tags,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SyncResponse is everything a mobile app needs to catch up in one request
+type SyncResponse struct {
+	// Cursor is the ?since= value for the next sync
+	Cursor int64 `json:"cursor"`
+	// Full is set when the lists hold everything, rather than what was
+	// created or updated since the cursor
+	Full      bool           `json:"full"`
+	Notebooks []SyncNotebook `json:"notebooks"`
+	Notes     []SyncNote     `json:"notes"`
+	Deleted   struct {
+		Notebooks []string `json:"notebooks"`
+		Notes     []string `json:"notes"`
+	} `json:"deleted"`
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+}
+
+func syncNote(note *Note) SyncNote {
+	return SyncNote{
+		ID:         note.ID,
+		NotebookID: note.NotebookID,
+		Title:      note.Title,
+		Content:    note.Content,
+		Type:       note.Type,
+		Tags:       noteTags(note),
+		UpdatedAt:  note.UpdatedAt,
+	}
+}
+
+// handleSync returns the workspace's notebooks and notes, or with
+// ?since=<cursor> those that changed since, with the caller's unread
+// notifications. Notes of deleted notebooks are not listed as deleted.
+func (s *Server) handleSync(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	since, latest, ok := s.sinceCursor(c)
+	if !ok {
+		return
+	}
+	ws := currentWorkspace(c)
+	resp := SyncResponse{Cursor: latest, Full: since < 0, Notebooks: []SyncNotebook{}, Notes: []SyncNote{}}
+	resp.Deleted.Notebooks, resp.Deleted.Notes = []string{}, []string{}
+
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notebooks"})
+		return
+	}
+	changed := make(map[string]bool)
+	if !resp.Full {
+		set, err := s.store.ListChanges(ctx, ChangeNotebook, ws.ID, since)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to read changes"})
+			return
+		}
+		for _, id := range append(set.Created, set.Updated...) {
+			changed[id] = true
+		}
+		resp.Deleted.Notebooks = set.Deleted
+	}
+
+	for _, nb := range filterWorkspaceNotebooks(notebooks, ws.ID) {
+		if resp.Full || changed[nb.ID] {
+			resp.Notebooks = append(resp.Notebooks, SyncNotebook{
+				ID:         nb.ID,
+				Name:       nb.Name,
+				Type:       nb.Type,
+				UpdatedAt:  nb.UpdatedAt,
+				ArchivedAt: nb.ArchivedAt,
+				TrashedAt:  nb.TrashedAt,
+			})
+		}
+		// Smart notebooks show notes that live in other notebooks
+		if nb.Type == NotebookTypeSmart {
+			continue
+		}
+
+		if resp.Full {
+			notes, err := s.store.ListNotes(ctx, nb.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+				return
+			}
+			for i := range notes {
+				resp.Notes = append(resp.Notes, syncNote(&notes[i]))
+			}
+			continue
+		}
+
+		set, err := s.store.ListChanges(ctx, ChangeNote, nb.ID, since)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to read changes"})
+			return
+		}
+		for _, id := range append(set.Created, set.Updated...) {
+			// A note deleted meanwhile is reported by the next sync
+			if note, err := s.store.GetNote(ctx, id); err == nil {
+				resp.Notes = append(resp.Notes, syncNote(note))
+			}
+		}
+		resp.Deleted.Notes = append(resp.Deleted.Notes, set.Deleted...)
+	}
+
+	userID := settingsOwner(c)
+	if resp.Notifications, err = s.store.ListNotifications(ctx, userID, true, syncNotifications); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notifications"})
+		return
+	}
+	if resp.Unread, err = s.store.CountUnreadNotifications(ctx, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,495 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// What a moderation check looked at
+const (
+	ModerationStagePrompt = "prompt"
+	ModerationStageAnswer = "answer"
+)
+
+const (
+	// moderationSettingKey is the workspace setting holding its policy
+	moderationSettingKey = "moderation"
+	// blockedTermCategory is what text containing a blocked term is flagged as
+	blockedTermCategory = "blocked_term"
+	// moderationChunkSize is how much text goes into one moderation input
+	moderationChunkSize = 10000
+	// maxModerationExcerpt is how much of blocked text the log keeps
+	maxModerationExcerpt = 500
+	// maxModerationEvents is how many blocked requests a workspace's log
+	// keeps; older ones are dropped as new ones arrive
+	maxModerationEvents = 1000
+)
+
+// Moderator classifies text against a content policy
+type Moderator interface {
+	// Moderate returns the categories text is flagged for, none when it is
+	// acceptable
+	Moderate(ctx context.Context, text string) ([]string, error)
+}
+
+// ModerationProviderFactory creates a moderator from the configuration
+type ModerationProviderFactory func(cfg Config) (Moderator, error)
+
+// moderationProviders are the MODERATION_PROVIDER values by name
+var moderationProviders = map[string]ModerationProviderFactory{
+	"openai":   newOpenAIModerator,
+	"keywords": newKeywordModerator,
+}
+
+// RegisterModerationProvider adds a moderation provider that
+// MODERATION_PROVIDER can name. Call it before the configuration is loaded.
+func RegisterModerationProvider(name string, factory ModerationProviderFactory) {
+	moderationProviders[name] = factory
+}
+
+// moderationProviderNames lists the moderation providers for error messages
+func moderationProviderNames() string {
+	names := make([]string, 0, len(moderationProviders))
+	for name := range moderationProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newModerator returns the configured moderator, or nil if no provider is
+// configured
+func newModerator(cfg Config) (Moderator, error) {
+	if cfg.ModerationProvider == "" {
+		return nil, nil
+	}
+	factory, ok := moderationProviders[cfg.ModerationProvider]
+	if !ok {
+		return nil, fmt.Errorf("unknown moderation provider: %s", cfg.ModerationProvider)
+	}
+	return factory(cfg)
+}
+
+// openAIModerator classifies text with an OpenAI-compatible moderation API
+type openAIModerator struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+// newOpenAIModerator uses the OpenAI settings; Ollama has no moderation API
+func newOpenAIModerator(cfg Config) (Moderator, error) {
+	if cfg.IsOllama() {
+		return nil, fmt.Errorf("the openai moderation provider needs the OpenAI settings, not Ollama")
+	}
+	_, baseURL := llmProvider(cfg)
+	model := cfg.ModerationModel
+	if model == "" {
+		model = "omni-moderation-latest"
+	}
+	return &openAIModerator{
+		baseURL: baseURL,
+		apiKey:  cfg.OpenAIAPIKey,
+		model:   model,
+		client:  providerHTTPClient(cfg, time.Minute, cfg.ProviderMaxRetries),
+	}, nil
+}
+
+func (m *openAIModerator) Moderate(ctx context.Context, text string) ([]string, error) {
+	body, _ := json.Marshal(map[string]interface{}{"model": m.model, "input": moderationChunks(text)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/moderations", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("moderation API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Results []struct {
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid moderation response: %w", err)
+	}
+	var categories []string
+	for _, r := range result.Results {
+		for category, flagged := range r.Categories {
+			if flagged && !slices.Contains(categories, category) {
+				categories = append(categories, category)
+			}
+		}
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+// moderationChunks splits text into the inputs of one moderation call
+func moderationChunks(text string) []string {
+	var chunks []string
+	for utf8.RuneCountInString(text) > moderationChunkSize {
+		runes := []rune(text)
+		chunks = append(chunks, string(runes[:moderationChunkSize]))
+		text = string(runes[moderationChunkSize:])
+	}
+	return append(chunks, text)
+}
+
+// keywordModerator is a local classifier flagging text that contains any of
+// MODERATION_BLOCKED_TERMS
+type keywordModerator struct {
+	terms *regexp.Regexp
+}
+
+func newKeywordModerator(cfg Config) (Moderator, error) {
+	return &keywordModerator{terms: blockedTermsPattern(strings.Split(cfg.ModerationBlockedTerms, ","))}, nil
+}
+
+func (m *keywordModerator) Moderate(ctx context.Context, text string) ([]string, error) {
+	if m.terms != nil && m.terms.MatchString(text) {
+		return []string{blockedTermCategory}, nil
+	}
+	return nil, nil
+}
+
+// blockedTermsPattern matches any of the terms, ignoring case. Terms
+// starting or ending in a letter or digit only match whole words there, so
+// "ass" does not block "class", and spaces match any run of whitespace; nil
+// when there are no terms.
+func blockedTermsPattern(terms []string) *regexp.Regexp {
+	var alternatives []string
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		pattern := strings.Join(strings.Fields(regexp.QuoteMeta(term)), `\s+`)
+		if first, _ := utf8.DecodeRuneInString(term); first < utf8.RuneSelf && (unicode.IsLetter(first) || unicode.IsDigit(first)) {
+			pattern = `\b` + pattern
+		}
+		if last, _ := utf8.DecodeLastRuneInString(term); last < utf8.RuneSelf && (unicode.IsLetter(last) || unicode.IsDigit(last)) {
+			pattern += `\b`
+		}
+		alternatives = append(alternatives, pattern)
+	}
+	if len(alternatives) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(alternatives, "|"))
+}
+
+// ModerationPolicy is how a workspace moderates its chats
+type ModerationPolicy struct {
+	// Prompts and Answers turn checking of users' messages and of the
+	// model's answers on
+	Prompts bool `json:"prompts"`
+	Answers bool `json:"answers"`
+	// Categories are the provider categories that block; empty blocks every
+	// category the provider flags
+	Categories []string `json:"categories" binding:"max=50,dive,max=100"`
+	// BlockedTerms block text containing any of them, with or without a
+	// provider
+	BlockedTerms []string `json:"blocked_terms" binding:"max=500,dive,max=200"`
+}
+
+// moderationPolicy returns a workspace's policy. Workspaces without one
+// check prompts and answers when a provider is configured.
+func (s *Server) moderationPolicy(ws *Workspace) ModerationPolicy {
+	policy := ModerationPolicy{
+		Prompts:      s.moderator != nil,
+		Answers:      s.moderator != nil,
+		Categories:   []string{},
+		BlockedTerms: []string{},
+	}
+	if raw, ok := ws.Settings[moderationSettingKey]; ok {
+		data, _ := json.Marshal(raw)
+		json.Unmarshal(data, &policy)
+	}
+	return policy
+}
+
+// ModerationError is returned when text is blocked by a moderation policy
+type ModerationError struct {
+	Stage      string
+	Categories []string
+}
+
+func (e *ModerationError) Error() string {
+	what := "the message was"
+	if e.Stage == ModerationStageAnswer {
+		what = "the answer was"
+	}
+	return fmt.Sprintf("%s blocked by the workspace's content policy (%s)", what, strings.Join(e.Categories, ", "))
+}
+
+// moderationResponse writes a 422 for blocked text and reports whether err
+// was a block
+func moderationResponse(c *gin.Context, err error) bool {
+	var blocked *ModerationError
+	if !errors.As(err, &blocked) {
+		return false
+	}
+	msg := blocked.Error()
+	c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Code: CodeContentBlocked, Error: strings.ToUpper(msg[:1]) + msg[1:]})
+	return true
+}
+
+// ModerationEvent is a blocked request in a workspace's moderation log
+type ModerationEvent struct {
+	ID          string    `json:"id"`
+	WorkspaceID string    `json:"workspace_id"`
+	NotebookID  string    `json:"notebook_id,omitempty"`
+	SessionID   string    `json:"session_id,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+	Stage       string    `json:"stage"`
+	Provider    string    `json:"provider"`
+	Categories  []string  `json:"categories"`
+	Excerpt     string    `json:"excerpt"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Moderation log operations
+
+// RecordModerationEvent adds a blocked request to a workspace's log,
+// dropping the oldest beyond maxModerationEvents
+func (s *Store) RecordModerationEvent(ctx context.Context, e *ModerationEvent) error {
+	e.ID = uuid.New().String()
+	e.CreatedAt = time.Now()
+	categoriesJSON, _ := json.Marshal(e.Categories)
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO moderation_events (id, workspace_id, notebook_id, session_id, user_id, stage, provider, categories, excerpt, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, e.ID, e.WorkspaceID, e.NotebookID, e.SessionID, e.UserID, e.Stage, e.Provider, string(categoriesJSON), e.Excerpt, e.CreatedAt.Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM moderation_events WHERE workspace_id = ? AND id NOT IN (
+			SELECT id FROM moderation_events WHERE workspace_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ?
+		)
+	`, e.WorkspaceID, e.WorkspaceID, maxModerationEvents)
+	return err
+}
+
+// ListModerationEvents retrieves a workspace's newest blocked requests,
+// optionally of one stage
+func (s *Store) ListModerationEvents(ctx context.Context, workspaceID, stage string, limit int) ([]ModerationEvent, error) {
+	query := `
+		SELECT id, workspace_id, notebook_id, session_id, user_id, stage, provider, categories, excerpt, created_at
+		FROM moderation_events WHERE workspace_id = ?`
+	args := []interface{}{workspaceID}
+	if stage != "" {
+		query += ` AND stage = ?`
+		args = append(args, stage)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at DESC, rowid DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]ModerationEvent, 0)
+	for rows.Next() {
+		var e ModerationEvent
+		var categoriesJSON string
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &e.WorkspaceID, &e.NotebookID, &e.SessionID, &e.UserID, &e.Stage, &e.Provider, &categoriesJSON, &e.Excerpt, &createdAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(categoriesJSON), &e.Categories)
+		e.CreatedAt = time.Unix(createdAt, 0)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// moderationInput is text to check and where it came from
+type moderationInput struct {
+	NotebookID string
+	SessionID  string
+	UserID     string
+	Stage      string
+	Text       string
+}
+
+// moderate checks chat text against the policy of its notebook's workspace.
+// Blocked text is logged and returned as a *ModerationError; a provider
+// failure blocks too, as an ordinary error.
+func (s *Server) moderate(ctx context.Context, in moderationInput) error {
+	if strings.TrimSpace(in.Text) == "" {
+		return nil
+	}
+	ws, err := s.notebookWorkspace(ctx, in.NotebookID)
+	if err != nil {
+		return err
+	}
+	policy := s.moderationPolicy(ws)
+	if (in.Stage == ModerationStagePrompt && !policy.Prompts) || (in.Stage == ModerationStageAnswer && !policy.Answers) {
+		return nil
+	}
+
+	var blocked []string
+	provider := "policy"
+	if terms := blockedTermsPattern(policy.BlockedTerms); terms != nil && terms.MatchString(in.Text) {
+		blocked = append(blocked, blockedTermCategory)
+	} else if s.moderator != nil {
+		provider = s.cfg.ModerationProvider
+		flagged, err := s.moderator.Moderate(ctx, in.Text)
+		if err != nil {
+			return fmt.Errorf("moderation failed: %w", err)
+		}
+		for _, category := range flagged {
+			if len(policy.Categories) == 0 || category == blockedTermCategory || slices.Contains(policy.Categories, category) {
+				blocked = append(blocked, category)
+			}
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	excerpt := in.Text
+	if runes := []rune(excerpt); len(runes) > maxModerationExcerpt {
+		excerpt = string(runes[:maxModerationExcerpt]) + "…"
+	}
+	event := &ModerationEvent{
+		WorkspaceID: ws.ID,
+		NotebookID:  in.NotebookID,
+		SessionID:   in.SessionID,
+		UserID:      in.UserID,
+		Stage:       in.Stage,
+		Provider:    provider,
+		Categories:  blocked,
+		Excerpt:     excerpt,
+	}
+	// The block is logged even if the client went away meanwhile
+	if err := s.store.RecordModerationEvent(context.WithoutCancel(ctx), event); err != nil {
+		golog.Errorf("failed to log blocked %s in workspace %s: %v", in.Stage, ws.ID, err)
+	}
+	golog.Warnf("moderation blocked a %s in notebook %s (%s)", in.Stage, in.NotebookID, strings.Join(blocked, ", "))
+	return &ModerationError{Stage: in.Stage, Categories: blocked}
+}
+
+// moderateChat checks a chat's message or answer, writing the error
+// response and reporting false when it may not go through
+func (s *Server) moderateChat(c *gin.Context, ctx context.Context, sessionID, stage, text string) bool {
+	err := s.moderate(ctx, moderationInput{
+		NotebookID: c.Param("id"),
+		SessionID:  sessionID,
+		UserID:     settingsOwner(c),
+		Stage:      stage,
+		Text:       text,
+	})
+	switch {
+	case err == nil:
+		return true
+	case moderationResponse(c, err), s.canceledResponse(c, ctx, err), providerUnavailableResponse(c, err):
+	default:
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: err.Error()})
+	}
+	return false
+}
+
+// Moderation handlers
+
+// handleGetModeration returns a workspace's moderation policy and the
+// server's provider
+func (s *Server) handleGetModeration(c *gin.Context) {
+	ws, ok := s.loadWorkspace(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy": s.moderationPolicy(ws), "provider": s.cfg.ModerationProvider})
+}
+
+// handleSetModeration replaces a workspace's moderation policy
+func (s *Server) handleSetModeration(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+	var policy ModerationPolicy
+	if !bindJSON(c, &policy) {
+		return
+	}
+	terms := make([]string, 0, len(policy.BlockedTerms))
+	for _, term := range policy.BlockedTerms {
+		if term = strings.TrimSpace(term); term != "" && !slices.Contains(terms, term) {
+			terms = append(terms, term)
+		}
+	}
+	policy.BlockedTerms = terms
+	if policy.Categories == nil {
+		policy.Categories = []string{}
+	}
+
+	ws.Settings[moderationSettingKey] = policy
+	if err := s.store.UpdateWorkspace(ctx, ws); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update moderation policy"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy": policy, "provider": s.cfg.ModerationProvider})
+}
+
+// handleListModerationEvents lists a workspace's newest blocked requests.
+// Add ?stage=prompt or ?stage=answer for one kind and ?limit= for more
+// than 50.
+func (s *Server) handleListModerationEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+	stage := c.Query("stage")
+	if stage != "" && stage != ModerationStagePrompt && stage != ModerationStageAnswer {
+		validationResponse(c, invalidField("stage", "must be prompt or answer"))
+		return
+	}
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxModerationEvents {
+			validationResponse(c, invalidField("limit", "must be between 1 and %d", maxModerationEvents))
+			return
+		}
+		limit = n
+	}
+
+	events, err := s.store.ListModerationEvents(ctx, ws.ID, stage, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list moderation events"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
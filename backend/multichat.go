@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// parseSessionNotebooks decodes a session's stored notebook list, always
+// starting with the notebook that owns the session
+func parseSessionNotebooks(notebookID, notebookIDsJSON string) []string {
+	var ids []string
+	if notebookIDsJSON != "" {
+		json.Unmarshal([]byte(notebookIDsJSON), &ids)
+	}
+	return withPrimaryNotebook(notebookID, ids)
+}
+
+// withPrimaryNotebook returns ids deduplicated with primary first
+func withPrimaryNotebook(primary string, ids []string) []string {
+	result := []string{primary}
+	seen := map[string]bool{primary: true}
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// SetChatSessionNotebooks changes the notebooks a chat session retrieves from
+func (s *Store) SetChatSessionNotebooks(ctx context.Context, id string, notebookIDs []string) error {
+	notebookIDsJSON, _ := json.Marshal(notebookIDs)
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE chat_sessions SET notebook_ids = ? WHERE id = ?
+	`, string(notebookIDsJSON), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundError("chat session")
+	}
+	return nil
+}
+
+// resolveChatNotebooks validates the notebooks a chat queries and returns them
+// with primary first
+func (s *Server) resolveChatNotebooks(ctx context.Context, primary string, ids []string) ([]string, error) {
+	notebookIDs := withPrimaryNotebook(primary, ids)
+	workspaceID := ""
+	for _, id := range notebookIDs {
+		nb, err := s.store.GetNotebook(ctx, id)
+		// Notebooks from other workspaces are treated as missing
+		if err != nil || (workspaceID != "" && nb.WorkspaceID != workspaceID) {
+			return nil, fmt.Errorf("notebook not found: %s", id)
+		}
+		workspaceID = nb.WorkspaceID
+	}
+	return notebookIDs, nil
+}
+
+// chatNotebookNames loads the vector index of each notebook a chat queries and
+// returns their names for labelling citations
+func (s *Server) chatNotebookNames(ctx context.Context, notebookIDs []string) map[string]string {
+	names := make(map[string]string, len(notebookIDs))
+	for _, id := range notebookIDs {
+		if err := s.loadNotebookVectorIndex(ctx, id); err != nil {
+			golog.Errorf("failed to load vector index for notebook %s: %v", id, err)
+		}
+		if nb, err := s.store.GetNotebook(ctx, id); err == nil {
+			names[id] = nb.Name
+		}
+	}
+	return names
+}
+
+func (s *Server) handleUpdateChatSessionNotebooks(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	sessionID := c.Param("sessionId")
+
+	var req struct {
+		NotebookIDs []string `json:"notebook_ids" binding:"dive,uuid"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	session, err := s.store.GetChatSession(ctx, sessionID)
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat session not found"})
+		return
+	}
+
+	notebookIDs, err := s.resolveChatNotebooks(ctx, notebookID, req.NotebookIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
+	if err := s.store.SetChatSessionNotebooks(ctx, sessionID, notebookIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update chat session"})
+		return
+	}
+
+	session.NotebookIDs = notebookIDs
+	c.JSON(http.StatusOK, session)
+}
@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// ndjsonContentType is newline-delimited JSON: one value per line
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonFlushEvery is how many rows are written between flushes
+const ndjsonFlushEvery = 100
+
+// wantsNDJSON reports whether a list request asked to be streamed, with
+// Accept: application/x-ndjson or ?format=ndjson
+func wantsNDJSON(c *gin.Context) bool {
+	return c.Query("format") == "ndjson" || strings.Contains(c.GetHeader("Accept"), ndjsonContentType)
+}
+
+// streamNDJSON writes the rows produced by scan one per line as they are
+// read, instead of building the whole list in memory. scan calls emit for
+// each row. An error before the first row is a normal JSON error response;
+// after that the status is already sent, so a final {"error": ..., "code": ...}
+// line tells the client the list is incomplete.
+func streamNDJSON(c *gin.Context, what string, scan func(emit func(any) error) error) {
+	// The stream's headers are set only once it succeeds, so an early error
+	// goes out as application/json
+	start := func() {
+		c.Header("Content-Type", ndjsonContentType)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Status(http.StatusOK)
+	}
+
+	enc := json.NewEncoder(c.Writer)
+	rows := 0
+	err := scan(func(row any) error {
+		if rows == 0 {
+			start()
+		}
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+		rows++
+		if rows%ndjsonFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			// The client went away; nobody is left to tell
+			return
+		}
+		golog.Errorf("failed to stream %s: %v", what, err)
+		if rows == 0 {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list " + what})
+			return
+		}
+		enc.Encode(ErrorResponse{Code: CodeInternal, Error: "Failed to list " + what})
+		return
+	}
+	if rows == 0 {
+		// An empty list is an empty body
+		start()
+		c.Writer.WriteHeaderNow()
+	}
+}
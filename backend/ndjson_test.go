@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamNDJSON(t *testing.T) {
+	failure := errors.New("query failed")
+	errorBody := `{"error":"Failed to list items","code":"` + string(CodeInternal) + `"}`
+	tests := []struct {
+		name            string
+		rows            []any
+		err             error
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{name: "rows", rows: []any{1, 2}, wantStatus: http.StatusOK, wantContentType: ndjsonContentType, wantBody: "1\n2\n"},
+		{name: "empty", wantStatus: http.StatusOK, wantContentType: ndjsonContentType, wantBody: ""},
+		{name: "error before the first row", err: failure, wantStatus: http.StatusInternalServerError, wantContentType: "application/json", wantBody: errorBody},
+		{name: "error after a row", rows: []any{1}, err: failure, wantStatus: http.StatusOK, wantContentType: ndjsonContentType, wantBody: "1\n" + errorBody + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/items?format=ndjson", nil)
+			streamNDJSON(c, "items", func(emit func(any) error) error {
+				for _, row := range tt.rows {
+					if err := emit(row); err != nil {
+						return err
+					}
+				}
+				return tt.err
+			})
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.wantContentType)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
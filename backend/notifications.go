@@ -0,0 +1,283 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// Notification kinds. Each has a user setting "notifications.<kind>" saying
+// how it is delivered.
+const (
+	NotificationMention   = "mention"   // a comment mentions the user
+	NotificationComment   = "comment"   // someone commented on a note of the user's workspace
+	NotificationJob       = "job"       // an account export or deletion finished
+	NotificationScheduled = "scheduled" // a scheduled prompt of the user's workspace ran
+	NotificationReminder  = "reminder"  // a snoozed note of the user's workspace came back
+)
+
+// Notification delivery modes
+const (
+	NotifyOff   = "off"   // not recorded at all
+	NotifyInbox = "inbox" // recorded and pushed over WebSocket
+	NotifyEmail = "email" // also emailed, when SMTP is configured
+)
+
+var notifyModes = []string{NotifyOff, NotifyInbox, NotifyEmail}
+
+// maxNotifications is how many notifications a user keeps; older ones are
+// dropped as new ones arrive
+const maxNotifications = 500
+
+// Notification is an entry in a user's inbox
+type Notification struct {
+	ID        string                 `json:"id"`
+	UserID    string                 `json:"-"` // "" for callers without a token
+	Kind      string                 `json:"kind"`
+	Title     string                 `json:"title"`
+	Body      string                 `json:"body,omitempty"`
+	Link      string                 `json:"link,omitempty"` // API path of what it is about
+	Data      map[string]interface{} `json:"data,omitempty"`
+	ReadAt    *time.Time             `json:"read_at,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+func scanNotification(row rowScanner) (*Notification, error) {
+	var n Notification
+	var dataJSON string
+	var readAt sql.NullInt64
+	var createdAt int64
+	if err := row.Scan(&n.ID, &n.UserID, &n.Kind, &n.Title, &n.Body, &n.Link, &dataJSON, &readAt, &createdAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(dataJSON), &n.Data)
+	if readAt.Valid {
+		t := time.Unix(readAt.Int64, 0)
+		n.ReadAt = &t
+	}
+	n.CreatedAt = time.Unix(createdAt, 0)
+	return &n, nil
+}
+
+// Notification operations
+
+// CreateNotification stores a notification, dropping the user's oldest
+// beyond maxNotifications
+func (s *Store) CreateNotification(ctx context.Context, n *Notification) error {
+	n.ID = uuid.New().String()
+	n.CreatedAt = time.Now()
+	dataJSON, _ := json.Marshal(n.Data)
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO notifications (id, user_id, kind, title, body, link, data, read_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULL, ?)
+	`, n.ID, n.UserID, n.Kind, n.Title, n.Body, n.Link, string(dataJSON), n.CreatedAt.Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM notifications WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM notifications WHERE user_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ?
+		)
+	`, n.UserID, n.UserID, maxNotifications)
+	return err
+}
+
+// ListNotifications retrieves a user's newest notifications, optionally
+// only the unread ones
+func (s *Store) ListNotifications(ctx context.Context, userID string, unreadOnly bool, limit int) ([]Notification, error) {
+	query := `SELECT id, user_id, kind, title, body, link, data, read_at, created_at FROM notifications WHERE user_id = ?`
+	if unreadOnly {
+		query += ` AND read_at IS NULL`
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at DESC, rowid DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := make([]Notification, 0)
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, *n)
+	}
+	return notifications, rows.Err()
+}
+
+// CountUnreadNotifications returns how many of a user's notifications are unread
+func (s *Store) CountUnreadNotifications(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+// MarkNotificationsRead marks a user's notifications read: the one given, or
+// all when id is "". It returns how many changed.
+func (s *Store) MarkNotificationsRead(ctx context.Context, userID, id string) (int64, error) {
+	query := `UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL`
+	args := []interface{}{time.Now().Unix(), userID}
+	if id != "" {
+		query += ` AND id = ?`
+		args = append(args, id)
+	}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteNotification deletes one of a user's notifications
+func (s *Store) DeleteNotification(ctx context.Context, userID, id string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM notifications WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// notificationMode is how a user wants a kind of notification delivered
+func (s *Server) notificationMode(ctx context.Context, userID, kind string) string {
+	values, err := s.settings(ctx, SettingScopeUser, userID)
+	if err != nil {
+		def, _ := settingDef(SettingScopeUser, "notifications."+kind)
+		return def.Default.(string)
+	}
+	mode, _ := values["notifications."+kind].(string)
+	return mode
+}
+
+// notify delivers a notification to each user as they asked: into their
+// inbox, over WebSocket and to their push devices, and by email when they
+// want it and SMTP is configured. Pushes and email go out in the background.
+func (s *Server) notify(ctx context.Context, userIDs []string, n Notification) {
+	for _, userID := range userIDs {
+		mode := s.notificationMode(ctx, userID, n.Kind)
+		if mode == NotifyOff {
+			continue
+		}
+
+		entry := n
+		entry.UserID = userID
+		if err := s.store.CreateNotification(ctx, &entry); err != nil {
+			golog.Warnf("failed to save %s notification for user %q: %v", n.Kind, userID, err)
+			continue
+		}
+		s.events.publishUser(userID, Event{Type: "notification", Data: entry, Time: entry.CreatedAt})
+		s.pushNotification(userID, entry)
+
+		if mode != NotifyEmail || s.cfg.SMTPHost == "" || userID == "" {
+			continue
+		}
+		user, err := s.store.GetUser(ctx, userID)
+		if err != nil {
+			continue
+		}
+		body := entry.Body
+		if entry.Link != "" {
+			body += "\n\n" + s.absoluteURL(entry.Link)
+		}
+		go func(to string) {
+			if err := s.sendEmail(to, entry.Title, body+"\n"); err != nil {
+				golog.Warnf("failed to email %s notification %s: %v", entry.Kind, entry.ID, err)
+			}
+		}(user.Email)
+	}
+}
+
+// workspaceRecipients are the users notified about a workspace's activity:
+// its members, or for a workspace without members, which is open to every
+// caller, the callers without a token
+func (s *Server) workspaceRecipients(ctx context.Context, workspaceID string) ([]string, error) {
+	members, err := s.store.ListWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return []string{""}, nil
+	}
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = m.UserID
+	}
+	return ids, nil
+}
+
+// Notification handlers
+
+// handleListNotifications lists the caller's newest notifications. Add
+// ?unread=true for only the unread ones and ?limit= for more than 50.
+func (s *Server) handleListNotifications(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := settingsOwner(c)
+
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxNotifications {
+			validationResponse(c, invalidField("limit", "must be between 1 and %d", maxNotifications))
+			return
+		}
+		limit = n
+	}
+
+	notifications, err := s.store.ListNotifications(ctx, userID, c.Query("unread") == "true", limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notifications"})
+		return
+	}
+	unread, err := s.store.CountUnreadNotifications(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications, "unread": unread})
+}
+
+// handleMarkNotificationRead marks one of the caller's notifications read
+func (s *Server) handleMarkNotificationRead(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	n, err := s.store.MarkNotificationsRead(ctx, settingsOwner(c), c.Param("notificationId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update notification"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"marked": n})
+}
+
+// handleMarkAllNotificationsRead marks all the caller's notifications read
+func (s *Server) handleMarkAllNotificationsRead(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	n, err := s.store.MarkNotificationsRead(ctx, settingsOwner(c), "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update notifications"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"marked": n})
+}
+
+func (s *Server) handleDeleteNotification(c *gin.Context) {
+	deleted, err := s.store.DeleteNotification(c.Request.Context(), settingsOwner(c), c.Param("notificationId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete notification"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notification not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,312 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// Outbox message states
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	// outboxFailed messages ran out of attempts
+	outboxFailed = "failed"
+)
+
+// outboxWebhook is the kind of messages posted to a webhook; the other
+// messages are store events, of the kinds the change journal follows
+const outboxWebhook = "webhook"
+
+const (
+	// outboxPollInterval is how often the outbox is read when nothing
+	// wakes the dispatcher, for writes that bypass the cache
+	outboxPollInterval = 5 * time.Second
+	// outboxBatch is how many messages are read from the outbox at once
+	outboxBatch = 100
+	// outboxRetention is how long delivered and failed messages are kept
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxPruneSchedule is when old messages are dropped
+	outboxPruneSchedule = "@hourly"
+	// webhookRetryDelay is the wait before a failed webhook's second
+	// attempt, doubling with each further attempt up to webhookMaxRetryDelay
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = time.Hour
+)
+
+// outboxMessage is an event waiting in the outbox to be delivered
+type outboxMessage struct {
+	Seq                int64
+	Kind               string
+	Op                 string
+	ItemID             string
+	NotebookID         string
+	PreviousNotebookID string
+	WorkspaceID        string
+	// Target and Payload are the URL and JSON body of a webhook
+	Target    string
+	Payload   string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// ensureOutboxTriggers has SQLite put a store event in the outbox for every
+// insert, update and delete of the tables the change journal follows. The
+// trigger runs in the transaction of the write, so an event is recorded
+// exactly when its change is.
+func (s *Store) ensureOutboxTriggers() error {
+	for _, t := range changeTables {
+		notebook := "notebook_id"
+		if t.table == "notebooks" {
+			notebook = "id"
+		}
+		for _, op := range []struct{ event, op, row string }{
+			{"INSERT", ChangeCreated, "NEW"},
+			{"UPDATE", ChangeUpdated, "NEW"},
+			{"DELETE", ChangeDeleted, "OLD"},
+		} {
+			previous, workspace := "''", "''"
+			if op.event == "UPDATE" {
+				previous = "OLD." + notebook
+			}
+			if t.table == "notebooks" {
+				workspace = op.row + ".workspace_id"
+			}
+			trigger := fmt.Sprintf(`
+				CREATE TRIGGER IF NOT EXISTS outbox_%[1]s_%[2]s AFTER %[3]s ON %[1]s
+				BEGIN
+					INSERT INTO outbox (kind, op, item_id, notebook_id, previous_notebook_id, workspace_id, created_at)
+					VALUES ('%[4]s', '%[2]s', %[5]s.id, %[5]s.%[6]s, %[7]s, %[8]s, CAST(strftime('%%s', 'now') AS INTEGER));
+				END`, t.table, op.op, op.event, t.kind, op.row, notebook, previous, workspace)
+			if _, err := s.db.Exec(trigger); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// outboxDispatcher delivers the outbox: store events to the handlers
+// subscribed to it, and webhooks to their endpoints. A message is marked
+// delivered only once it was, so one pending at a crash is delivered after
+// the restart, and handlers may see an event more than once.
+type outboxDispatcher struct {
+	store       *Store
+	bus         eventBus
+	maxAttempts int
+	// wakeEvents and wakeWebhooks have the dispatcher read the outbox
+	// without waiting for the next poll
+	wakeEvents   chan struct{}
+	wakeWebhooks chan struct{}
+}
+
+// newOutboxDispatcher returns a dispatcher giving up on a webhook after
+// maxAttempts failed deliveries
+func newOutboxDispatcher(store *Store, maxAttempts int) *outboxDispatcher {
+	return &outboxDispatcher{
+		store:        store,
+		maxAttempts:  maxAttempts,
+		wakeEvents:   make(chan struct{}, 1),
+		wakeWebhooks: make(chan struct{}, 1),
+	}
+}
+
+// subscribe adds a handler for the store events delivered from now on
+func (d *outboxDispatcher) subscribe(h storeEventHandler) {
+	d.bus.subscribe(h)
+}
+
+// notify tells the dispatcher there may be new messages in the outbox
+func (d *outboxDispatcher) notify() {
+	for _, wake := range []chan struct{}{d.wakeEvents, d.wakeWebhooks} {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// start delivers the outbox until stopping is closed, beginning with what
+// was left from before a restart. Webhooks are posted in a loop of their
+// own so a slow endpoint does not hold the store events up. Nothing is
+// delivered while readOnly reports true.
+func (d *outboxDispatcher) start(stopping <-chan struct{}, readOnly func() bool, beat func()) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.loop(stopping, readOnly, d.wakeWebhooks, true, func() {})
+	}()
+	d.loop(stopping, readOnly, d.wakeEvents, false, beat)
+	wg.Wait()
+}
+
+// loop delivers the webhooks or the store events whenever woken or polled
+func (d *outboxDispatcher) loop(stopping <-chan struct{}, readOnly func() bool, wake <-chan struct{}, webhooks bool, beat func()) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		if !readOnly() {
+			d.deliverDue(context.Background(), webhooks)
+		}
+		beat()
+		select {
+		case <-stopping:
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue delivers the messages due, oldest first, until none are left
+// or the outbox cannot be updated
+func (d *outboxDispatcher) deliverDue(ctx context.Context, webhooks bool) {
+	for {
+		messages, err := d.store.DueOutboxMessages(ctx, webhooks, time.Now(), outboxBatch)
+		if err != nil {
+			golog.Errorf("failed to read the outbox: %v", err)
+			return
+		}
+		for _, m := range messages {
+			deliver := d.deliverEvent
+			if webhooks {
+				deliver = d.deliverWebhook
+			}
+			if err := deliver(ctx, m); err != nil {
+				golog.Errorf("failed to update outbox message %d: %v", m.Seq, err)
+				return
+			}
+		}
+		if len(messages) < outboxBatch {
+			return
+		}
+	}
+}
+
+// deliverEvent passes a store event to the handlers. The note or source is
+// loaded as it is now, and left nil once deleted.
+func (d *outboxDispatcher) deliverEvent(ctx context.Context, m outboxMessage) error {
+	ev := StoreEvent{
+		Kind:               m.Kind,
+		Op:                 m.Op,
+		ID:                 m.ItemID,
+		NotebookID:         m.NotebookID,
+		PreviousNotebookID: m.PreviousNotebookID,
+		WorkspaceID:        m.WorkspaceID,
+		Time:               m.CreatedAt,
+	}
+	if m.Op != ChangeDeleted {
+		switch m.Kind {
+		case ChangeNote:
+			if note, err := d.store.GetNote(ctx, m.ItemID); err == nil {
+				ev.Note = note
+			}
+		case ChangeSource:
+			if source, err := d.store.GetSource(ctx, m.ItemID); err == nil {
+				ev.Source = source
+			}
+		}
+	}
+	d.bus.emit(ctx, ev)
+	return d.store.SetOutboxState(ctx, m.Seq, outboxDelivered, m.Attempts+1, nil, "")
+}
+
+// deliverWebhook posts a webhook, scheduling another attempt when it fails
+func (d *outboxDispatcher) deliverWebhook(ctx context.Context, m outboxMessage) error {
+	attempts := m.Attempts + 1
+	err := postWebhook(ctx, m.Target, json.RawMessage(m.Payload))
+	if err == nil {
+		return d.store.SetOutboxState(ctx, m.Seq, outboxDelivered, attempts, nil, "")
+	}
+	if attempts >= d.maxAttempts {
+		golog.Errorf("giving up on webhook %s after %d attempts: %v", m.Target, attempts, err)
+		return d.store.SetOutboxState(ctx, m.Seq, outboxFailed, attempts, nil, err.Error())
+	}
+	wait := webhookRetryDelay << (attempts - 1)
+	if wait <= 0 || wait > webhookMaxRetryDelay {
+		wait = webhookMaxRetryDelay
+	}
+	golog.Warnf("failed to deliver webhook %s, retrying in %s: %v", m.Target, wait, err)
+	next := time.Now().Add(wait)
+	return d.store.SetOutboxState(ctx, m.Seq, outboxPending, attempts, &next, err.Error())
+}
+
+// Store
+
+// enqueueWebhook adds a webhook to the outbox through db, which may be the
+// transaction of the change it announces
+func enqueueWebhook(ctx context.Context, db sqlExecer, target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO outbox (kind, op, target, payload, created_at)
+		VALUES (?, '', ?, ?, ?)
+	`, outboxWebhook, target, string(body), time.Now().Unix())
+	return err
+}
+
+// DueOutboxMessages returns up to limit pending webhooks, or store events,
+// whose next attempt is due by now, oldest first
+func (s *Store) DueOutboxMessages(ctx context.Context, webhooks bool, now time.Time, limit int) ([]outboxMessage, error) {
+	kind := "kind != ?"
+	if webhooks {
+		kind = "kind = ?"
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, kind, op, item_id, notebook_id, previous_notebook_id, workspace_id,
+			target, payload, attempts, created_at
+		FROM outbox
+		WHERE status = ? AND next_attempt_at <= ? AND `+kind+`
+		ORDER BY seq
+		LIMIT ?
+	`, outboxPending, now.Unix(), outboxWebhook, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []outboxMessage
+	for rows.Next() {
+		var m outboxMessage
+		var createdAt int64
+		if err := rows.Scan(&m.Seq, &m.Kind, &m.Op, &m.ItemID, &m.NotebookID, &m.PreviousNotebookID, &m.WorkspaceID,
+			&m.Target, &m.Payload, &m.Attempts, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(createdAt, 0)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// SetOutboxState records the outcome of delivering a message: its new
+// state, the attempts made, when to try again (nil for no further attempt)
+// and the last error
+func (s *Store) SetOutboxState(ctx context.Context, seq int64, status string, attempts int, next *time.Time, lastError string) error {
+	deliveredAt := int64(0)
+	if status == outboxDelivered {
+		deliveredAt = time.Now().Unix()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, delivered_at = ?
+		WHERE seq = ?
+	`, status, attempts, unixOrZero(next), lastError, deliveredAt, seq)
+	return err
+}
+
+// PruneOutbox drops the delivered and failed messages added before the
+// given time
+func (s *Store) PruneOutbox(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE status != ? AND created_at < ?`, outboxPending, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
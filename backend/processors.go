@@ -0,0 +1,379 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// SourceProcessor extracts text and metadata from formats the built-in
+// extractors do not handle. Processors are consulted before the built-ins.
+type SourceProcessor interface {
+	Name() string
+	// MatchFile reports whether the processor handles a file with this name and MIME type
+	MatchFile(fileName, mimeType string) bool
+	// MatchURL reports whether the processor handles a URL
+	MatchURL(url string) bool
+	Extract(ctx context.Context, input ProcessorInput) (*ProcessorResult, error)
+}
+
+// ProcessorInput describes what to extract: a local file or a URL
+type ProcessorInput struct {
+	Path     string `json:"path,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// ProcessorResult is the extracted text with any metadata the processor found
+type ProcessorResult struct {
+	Text     string                 `json:"text"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// ProcessorInfo describes a registered processor
+type ProcessorInfo struct {
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"` // "subprocess" or "plugin"
+	Extensions []string `json:"extensions,omitempty"`
+	MIMETypes  []string `json:"mime_types,omitempty"`
+	// MetadataKeys are the keys of the metadata namespace the processor defines
+	MetadataKeys []string `json:"metadata_keys,omitempty"`
+}
+
+// processorManifest configures a subprocess processor. It lives in the plugin
+// directory as <name>.json.
+type processorManifest struct {
+	Name           string   `json:"name"`
+	Command        []string `json:"command"`
+	Extensions     []string `json:"extensions"`
+	MIMETypes      []string `json:"mime_types"`
+	URLPatterns    []string `json:"url_patterns"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+	// MetadataSchema defines the metadata namespace named after the
+	// processor: an object schema whose properties are the keys clients may
+	// set as "<name>.<property>"
+	MetadataSchema *jsonSchema `json:"metadata_schema"`
+}
+
+// subprocessProcessor runs an external command. The command receives a
+// ProcessorInput as JSON on stdin and writes a ProcessorResult as JSON to
+// stdout, optionally with an "error" field.
+type subprocessProcessor struct {
+	manifest processorManifest
+	dir      string
+	urlRes   []*regexp.Regexp
+}
+
+func (p *subprocessProcessor) Name() string { return p.manifest.Name }
+
+func (p *subprocessProcessor) MatchFile(fileName, mimeType string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, e := range p.manifest.Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return matchMIMEType(p.manifest.MIMETypes, mimeType)
+}
+
+func (p *subprocessProcessor) MatchURL(url string) bool {
+	for _, re := range p.urlRes {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *subprocessProcessor) Extract(ctx context.Context, input ProcessorInput) (*ProcessorResult, error) {
+	timeout := time.Duration(p.manifest.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if input.Path != "" {
+		if abs, err := filepath.Abs(input.Path); err == nil {
+			input.Path = abs
+		}
+	}
+	request, _ := json.Marshal(input)
+
+	cmd := exec.CommandContext(ctx, p.manifest.Command[0], p.manifest.Command[1:]...)
+	cmd.Dir = p.dir
+	cmd.Stdin = bytes.NewReader(request)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("processor %s failed: %w: %s", p.Name(), err, strings.TrimSpace(stderr.String()))
+	}
+
+	var result struct {
+		ProcessorResult
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("processor %s returned invalid output: %w", p.Name(), err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("processor %s: %s", p.Name(), result.Error)
+	}
+
+	return &result.ProcessorResult, nil
+}
+
+// matchMIMEType matches a MIME type against patterns such as "text/x-log" or "application/*"
+func matchMIMEType(patterns []string, mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	if mt, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mt
+	}
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, mimeType) {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mimeType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProcessorPlugins loads processors from a directory: *.json manifests for
+// subprocess processors and *.so files built as Go plugins. A Go plugin must
+// export either a variable "Processor" or a function "NewProcessor" returning a
+// SourceProcessor.
+func loadProcessorPlugins(dir string) ([]SourceProcessor, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	processors := make([]SourceProcessor, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		var p SourceProcessor
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json":
+			p, err = loadSubprocessProcessor(dir, path)
+		case ".so":
+			p, err = loadGoPluginProcessor(path)
+		default:
+			continue
+		}
+		if err != nil {
+			golog.Errorf("failed to load processor plugin %s: %v", entry.Name(), err)
+			continue
+		}
+
+		golog.Infof("loaded source processor %s from %s", p.Name(), entry.Name())
+		processors = append(processors, p)
+	}
+
+	return processors, nil
+}
+
+func loadSubprocessProcessor(dir, path string) (SourceProcessor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest processorManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Name == "" {
+		manifest.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if len(manifest.Command) == 0 {
+		return nil, fmt.Errorf("manifest has no command")
+	}
+
+	p := &subprocessProcessor{manifest: manifest, dir: dir}
+	for _, pattern := range manifest.URLPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url pattern %q: %w", pattern, err)
+		}
+		p.urlRes = append(p.urlRes, re)
+	}
+	if manifest.MetadataSchema != nil {
+		if err := registerMetadataNamespace(manifest.Name, manifest.MetadataSchema); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func loadGoPluginProcessor(path string) (SourceProcessor, error) {
+	plug, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if sym, err := plug.Lookup("NewProcessor"); err == nil {
+		if newProcessor, ok := sym.(func() SourceProcessor); ok {
+			return newProcessor(), nil
+		}
+		return nil, fmt.Errorf("NewProcessor has the wrong type")
+	}
+
+	sym, err := plug.Lookup("Processor")
+	if err != nil {
+		return nil, fmt.Errorf("plugin exports neither Processor nor NewProcessor")
+	}
+	switch p := sym.(type) {
+	case SourceProcessor:
+		return p, nil
+	case *SourceProcessor:
+		return *p, nil
+	}
+	return nil, fmt.Errorf("Processor does not implement SourceProcessor")
+}
+
+// RegisterProcessor adds a source processor, consulted before those registered earlier
+func (vs *VectorStore) RegisterProcessor(p SourceProcessor) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.processors = append([]SourceProcessor{p}, vs.processors...)
+}
+
+func (vs *VectorStore) fileProcessor(fileName, mimeType string) SourceProcessor {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	for _, p := range vs.processors {
+		if p.MatchFile(fileName, mimeType) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (vs *VectorStore) urlProcessor(url string) SourceProcessor {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	for _, p := range vs.processors {
+		if p.MatchURL(url) {
+			return p
+		}
+	}
+	return nil
+}
+
+// ExtractDocumentWithMetadata extracts a file's text, using a matching processor
+// plugin when there is one. fileName is the original name, used for matching.
+func (vs *VectorStore) ExtractDocumentWithMetadata(ctx context.Context, path, fileName, mimeType string) (string, map[string]interface{}, error) {
+	if fileName == "" {
+		fileName = filepath.Base(path)
+	}
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(fileName))
+	}
+
+	if p := vs.fileProcessor(fileName, mimeType); p != nil {
+		result, err := p.Extract(ctx, ProcessorInput{Path: path, FileName: fileName, MIMEType: mimeType})
+		if err != nil {
+			return "", nil, err
+		}
+		return result.Text, processorMetadata(p, result), nil
+	}
+
+	if vs.vision != nil && strings.HasPrefix(mimeType, "image/") {
+		return vs.vision.describeImage(ctx, path, mimeType)
+	}
+
+	content, err := vs.extractFile(ctx, path)
+	if err != nil || vs.vision == nil || !isPDF(path, mimeType) {
+		return content, nil, err
+	}
+	content, metadata := vs.vision.describePDFFigures(ctx, path, content)
+	return content, metadata, nil
+}
+
+// ExtractFromURLWithMetadata fetches a URL's text, using a matching processor
+// plugin when there is one
+func (vs *VectorStore) ExtractFromURLWithMetadata(ctx context.Context, url string) (string, map[string]interface{}, error) {
+	if err := checkOutboundURL(url); err != nil {
+		return "", nil, err
+	}
+	if p := vs.urlProcessor(url); p != nil {
+		result, err := p.Extract(ctx, ProcessorInput{URL: url})
+		if err != nil {
+			return "", nil, err
+		}
+		return result.Text, processorMetadata(p, result), nil
+	}
+
+	content, err := vs.extractURL(ctx, url)
+	return content, nil, err
+}
+
+// processorMetadata records which processor produced a source alongside its metadata
+func processorMetadata(p SourceProcessor, result *ProcessorResult) map[string]interface{} {
+	metadata := map[string]interface{}{"processor": p.Name()}
+	if len(result.Metadata) > 0 {
+		metadata["extracted"] = result.Metadata
+	}
+	return metadata
+}
+
+// mergeMetadata copies extra into a source's metadata
+func mergeMetadata(source *Source, extra map[string]interface{}) {
+	if len(extra) == 0 {
+		return
+	}
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	for k, v := range extra {
+		source.Metadata[k] = v
+	}
+}
+
+func (s *Server) handleListProcessors(c *gin.Context) {
+	s.vectorStore.mu.RLock()
+	defer s.vectorStore.mu.RUnlock()
+
+	infos := make([]ProcessorInfo, 0, len(s.vectorStore.processors))
+	for _, p := range s.vectorStore.processors {
+		info := ProcessorInfo{Name: p.Name(), Kind: "plugin"}
+		if sp, ok := p.(*subprocessProcessor); ok {
+			info.Kind = "subprocess"
+			info.Extensions = sp.manifest.Extensions
+			info.MIMETypes = sp.manifest.MIMETypes
+			if schema := sp.manifest.MetadataSchema; schema != nil {
+				for _, name := range schema.required() {
+					info.MetadataKeys = append(info.MetadataKeys, sp.Name()+"."+name)
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
@@ -0,0 +1,34 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handlePprof serves the Go runtime profiles under /api/admin/debug/pprof
+// when ENABLE_PPROF is set, e.g. /api/admin/debug/pprof/profile?seconds=30
+// for a CPU profile or /api/admin/debug/pprof/heap for memory
+func (s *Server) handlePprof(c *gin.Context) {
+	if !s.cfg.EnablePprof {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Profiling is disabled"})
+		return
+	}
+
+	switch name := strings.TrimPrefix(c.Param("profile"), "/"); name {
+	case "":
+		pprof.Index(c.Writer, c.Request)
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -1,52 +1,56 @@
 package backend
 
-// getTransformationPrompt returns the prompt template for each transformation type
-func getTransformationPrompt(transformType string) string {
-	switch transformType {
-	case "summary":
-		return summaryPrompt()
-
-	case "faq":
-		return faqPrompt()
-
-	case "study_guide":
-		return studyGuidePrompt()
-
-	case "outline":
-		return outlinePrompt()
-
-	case "podcast":
-		return podcastPrompt()
-
-	case "timeline":
-		return timelinePrompt()
-
-	case "glossary":
-		return glossaryPrompt()
-
-	case "quiz":
-		return quizPrompt()
-
-	case "mindmap":
-		return mindmapPrompt()
-
-	case "infograph":
-		return infographPrompt()
-
-	case "ppt":
-		return pptPrompt()
+import "strings"
+
+// builtinPrompts holds the compiled-in template for every named prompt.
+// Operators can override them with versions in the prompt store.
+var builtinPrompts = map[string]func() string{
+	"summary":      summaryPrompt,
+	"faq":          faqPrompt,
+	"study_guide":  studyGuidePrompt,
+	"outline":      outlinePrompt,
+	"podcast":      podcastPrompt,
+	"timeline":     timelinePrompt,
+	"glossary":     glossaryPrompt,
+	"quiz":         quizPrompt,
+	"flashcards":   flashcardsPrompt,
+	"mindmap":      mindmapPrompt,
+	"infograph":    infographPrompt,
+	"ppt":          pptPrompt,
+	"custom":       customPrompt,
+	"insight":      insightPrompt,
+	"tags":         tagsPrompt,
+	"entities":     entitiesPrompt,
+	"analysis":     analysisPrompt,
+	"default":      defaultPrompt,
+	"chat_persona": func() string { return defaultChatPersona },
+	"chat":         chatPromptBody,
+}
 
-	case "custom":
-		return customPrompt()
+// transformationPromptVars are the variables available to transformation prompts
+var transformationPromptVars = []string{"sources", "type", "length", "format", "prompt"}
 
-	case "insight":
-		return insightPrompt()
+// chatPromptVars are the variables available to the chat prompt
+var chatPromptVars = []string{"history", "context", "question"}
 
+// promptVars returns the template variables a named prompt may use
+func promptVars(name string) []string {
+	switch name {
+	case "chat", "chat_persona":
+		return chatPromptVars
 	default:
-		return defaultPrompt()
+		return transformationPromptVars
 	}
 }
 
+// transformationPromptName returns the prompt name for a transformation type
+func transformationPromptName(transformType string) string {
+	if _, ok := builtinPrompts[transformType]; ok && transformType != "chat" && transformType != "chat_persona" {
+		return transformType
+	}
+	return "default"
+}
+
 func summaryPrompt() string {
 	return `你是一个擅长创建综合摘要的专家。请根据以下来源，以{format}格式创建一个{length}摘要。
 **注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
@@ -116,6 +120,37 @@ func podcastPrompt() string {
 请将其格式化为带有演讲者标签（主持人1，主持人2）和[括号]中舞台指示的播客脚本。`
 }
 
+func tagsPrompt() string {
+	return `你是一个擅长整理笔记的专家。请为以下内容推荐 3 到 5 个简短的标签，用于分类和检索。
+**注意：只输出标签本身，用逗号分隔，不要编号，不要输出其他内容。**
+
+内容：
+{sources}`
+}
+
+func entitiesPrompt() string {
+	return `你是一个擅长信息抽取的专家。请找出以下内容中提到的人物、组织和项目。
+**注意：类型只能是 person、organization 或 project。名称保持原文写法，不要翻译。没有实体时输出空列表。**
+
+内容：
+{sources}`
+}
+
+func analysisPrompt() string {
+	return `你是一个严谨的研究审稿人。请通读以下来源，找出其中相互矛盾的说法和尚未回答的问题。
+**注意：无论来源是什么语言，请务必使用中文进行回复。**
+
+来源：
+{sources}
+
+请找出：
+- 矛盾：不同来源（或同一来源的不同部分）对同一事实、数据或结论给出了不一致的说法。列出每一方的说法、所在来源的编号（即"Source N"中的 N）和原文摘录，说明矛盾在哪里，并评估其严重程度。措辞不同但意思一致的不算矛盾。
+- 缺口：读者自然会问、但来源没有回答或证据不足的问题。说明为什么这是个缺口，并建议补充什么资料或做什么来回答它。
+
+只报告来源中确实存在的问题，不要编造。没有发现时输出空列表。
+{prompt}`
+}
+
 func timelinePrompt() string {
 	return `你是一个擅长创建按时间顺序排列的时间线的专家。请根据以下来源，以{format}格式创建一个时间线。
 **注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
@@ -160,6 +195,19 @@ func quizPrompt() string {
 创建一个包含10-20个问题的{length}测验。`
 }
 
+func flashcardsPrompt() string {
+	return `你是一个擅长制作学习卡片的教育家。请根据以下来源，以{format}格式创建一套抽认卡。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+来源：
+{sources}
+
+每张卡片的正面是一个问题或术语，背面是简洁准确的答案或定义。
+- 覆盖来源中的关键概念、事实和术语
+- 每张卡片只考查一个知识点
+- 创建一套{length}的卡片，通常为15-30张`
+}
+
 func mindmapPrompt() string {
 	return `你是一位资深的信息架构师和知识管理专家。请将【文本内容】提炼并转换为 Mermaid.js 的 mindmap 格式。
 **注意：无论来源是什么语言，请务必使用中文进行回复。**
@@ -422,10 +470,56 @@ func defaultPrompt() string {
 生成{length}内容。`
 }
 
-// Chat system prompt
-func chatSystemPrompt() string {
-	return `你是一个笔记本应用程序的有用人工智能助手。根据提供的上下文和聊天历史记录回答用户的问题。
-**无论来源文件是什么语言，请务必使用中文回答用户的问题。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+// Default chat persona, replaced by a notebook's custom system prompt
+const defaultChatPersona = `你是一个笔记本应用程序的有用人工智能助手。根据提供的上下文和聊天历史记录回答用户的问题。`
+
+// chatPromptWithSettings builds the chat prompt from the persona and body
+// templates with a notebook's persona and answer preferences applied
+func chatPromptWithSettings(persona, body string, settings *ChatSettings) string {
+	if settings == nil {
+		return persona + "\n" + body
+	}
+
+	if strings.TrimSpace(settings.SystemPrompt) != "" {
+		persona = escapeFString(strings.TrimSpace(settings.SystemPrompt))
+	}
+
+	var guidance []string
+	if tone := strings.TrimSpace(settings.Tone); tone != "" {
+		guidance = append(guidance, "请使用以下语气回答："+escapeFString(tone)+"。")
+	}
+	switch settings.AnswerLength {
+	case "short":
+		guidance = append(guidance, "请简洁回答，控制在几句话以内。")
+	case "medium":
+		guidance = append(guidance, "请给出长度适中的回答。")
+	case "long":
+		guidance = append(guidance, "请给出详细、全面的回答。")
+	}
+	switch settings.CitationStyle {
+	case "inline":
+		guidance = append(guidance, "引用来源时，请在相关句子后用括号注明来源名称。")
+	case "numbered":
+		guidance = append(guidance, "引用来源时，请使用 [来源 N] 的编号形式标注。")
+	case "none":
+		guidance = append(guidance, "回答中不需要标注来源。")
+	}
+
+	prompt := persona + "\n" + body
+	if len(guidance) > 0 {
+		prompt += "\n\n" + strings.Join(guidance, "\n")
+	}
+	return prompt
+}
+
+// escapeFString escapes braces so user text is not read as template variables
+func escapeFString(s string) string {
+	return strings.NewReplacer("{", "{{", "}", "}}").Replace(s)
+}
+
+// Chat prompt body
+func chatPromptBody() string {
+	return `**无论来源文件是什么语言，请务必使用中文回答用户的问题。不要使用 ` + "```markdown" + ` 标记包裹输出。**
 如果上下文中没有足够的信息，请说明情况并提供一般性的回答。
 
 聊天历史记录：
@@ -0,0 +1,352 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/prompts"
+)
+
+// PromptVersion is a stored revision of a named prompt template
+type PromptVersion struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	Template    string    `json:"template"`
+	Description string    `json:"description,omitempty"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// PromptInfo describes a named prompt and which template is in use.
+// ActiveVersion 0 means the built-in template.
+type PromptInfo struct {
+	Name          string          `json:"name"`
+	Variables     []string        `json:"variables"`
+	ActiveVersion int             `json:"active_version"`
+	Builtin       string          `json:"builtin"`
+	Template      string          `json:"template"`
+	Versions      []PromptVersion `json:"versions,omitempty"`
+}
+
+var errPromptVersionNotFound = errors.New("prompt version not found")
+
+// PromptStore serves prompt templates, preferring the active stored version
+// of each prompt over the built-in one
+type PromptStore struct {
+	store  *Store
+	mu     sync.RWMutex
+	active map[string]PromptVersion
+}
+
+// NewPromptStore creates a prompt store and loads the active versions
+func NewPromptStore(ctx context.Context, store *Store) (*PromptStore, error) {
+	ps := &PromptStore{store: store, active: make(map[string]PromptVersion)}
+	if err := ps.reload(ctx); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Get returns the template in use for a named prompt
+func (ps *PromptStore) Get(name string) string {
+	if ps != nil {
+		ps.mu.RLock()
+		v, ok := ps.active[name]
+		ps.mu.RUnlock()
+		if ok {
+			return v.Template
+		}
+	}
+
+	if builtin, ok := builtinPrompts[name]; ok {
+		return builtin()
+	}
+	return defaultPrompt()
+}
+
+// activeVersion returns the active stored version number, or 0 for the built-in
+func (ps *PromptStore) activeVersion(name string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.active[name].Version
+}
+
+func (ps *PromptStore) reload(ctx context.Context) error {
+	versions, err := ps.store.ListActivePromptVersions(ctx)
+	if err != nil {
+		return err
+	}
+
+	active := make(map[string]PromptVersion, len(versions))
+	for _, v := range versions {
+		active[v.Name] = v
+	}
+
+	ps.mu.Lock()
+	ps.active = active
+	ps.mu.Unlock()
+
+	return nil
+}
+
+// ListActivePromptVersions retrieves the active version of every overridden prompt
+func (s *Store) ListActivePromptVersions(ctx context.Context) ([]PromptVersion, error) {
+	return s.queryPromptVersions(ctx, `
+		SELECT name, version, template, description, active, created_at
+		FROM prompt_templates WHERE active = 1
+	`)
+}
+
+// ListPromptVersions retrieves every stored version of a prompt, newest first
+func (s *Store) ListPromptVersions(ctx context.Context, name string) ([]PromptVersion, error) {
+	return s.queryPromptVersions(ctx, `
+		SELECT name, version, template, description, active, created_at
+		FROM prompt_templates WHERE name = ? ORDER BY version DESC
+	`, name)
+}
+
+func (s *Store) queryPromptVersions(ctx context.Context, query string, args ...interface{}) ([]PromptVersion, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]PromptVersion, 0)
+	for rows.Next() {
+		var v PromptVersion
+		var active int
+		var createdAt int64
+		if err := rows.Scan(&v.Name, &v.Version, &v.Template, &v.Description, &active, &createdAt); err != nil {
+			return nil, err
+		}
+		v.Active = active == 1
+		v.CreatedAt = time.Unix(createdAt, 0)
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// CreatePromptVersion stores a new version of a prompt, optionally making it active
+func (s *Store) CreatePromptVersion(ctx context.Context, name, template, description string, activate bool) (*PromptVersion, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) + 1 FROM prompt_templates WHERE name = ?
+	`, name).Scan(&version); err != nil {
+		return nil, err
+	}
+
+	if activate {
+		if _, err := tx.ExecContext(ctx, `UPDATE prompt_templates SET active = 0 WHERE name = ?`, name); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	active := 0
+	if activate {
+		active = 1
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO prompt_templates (name, version, template, description, active, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, name, version, template, description, active, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &PromptVersion{
+		Name:        name,
+		Version:     version,
+		Template:    template,
+		Description: description,
+		Active:      activate,
+		CreatedAt:   now,
+	}, nil
+}
+
+// ActivatePromptVersion makes a stored version active; version 0 restores the built-in
+func (s *Store) ActivatePromptVersion(ctx context.Context, name string, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if version > 0 {
+		var exists int
+		if err := tx.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM prompt_templates WHERE name = ? AND version = ?
+		`, name, version).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errPromptVersionNotFound
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE prompt_templates SET active = CASE WHEN version = ? THEN 1 ELSE 0 END WHERE name = ?
+	`, version, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// validatePromptTemplate checks that a template only uses the variables its prompt provides
+func validatePromptTemplate(name, template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("template is required")
+	}
+
+	vars := promptVars(name)
+	values := make(map[string]any, len(vars))
+	for _, v := range vars {
+		values[v] = "x"
+	}
+
+	pt := prompts.NewPromptTemplate(template, vars)
+	pt.TemplateFormat = prompts.TemplateFormatFString
+	if _, err := pt.Format(values); err != nil {
+		return fmt.Errorf("invalid template (available variables: %s): %w", strings.Join(vars, ", "), err)
+	}
+
+	return nil
+}
+
+// Prompt handlers
+
+func (s *Server) handleListPrompts(c *gin.Context) {
+	names := make([]string, 0, len(builtinPrompts))
+	for name := range builtinPrompts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]PromptInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, s.promptInfo(name))
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (s *Server) handleGetPrompt(c *gin.Context) {
+	ctx := context.Background()
+	name := c.Param("name")
+
+	if _, ok := builtinPrompts[name]; !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Prompt not found"})
+		return
+	}
+
+	versions, err := s.store.ListPromptVersions(ctx, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list prompt versions"})
+		return
+	}
+
+	info := s.promptInfo(name)
+	info.Versions = versions
+	c.JSON(http.StatusOK, info)
+}
+
+func (s *Server) handleCreatePromptVersion(c *gin.Context) {
+	ctx := context.Background()
+	name := c.Param("name")
+
+	if _, ok := builtinPrompts[name]; !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Prompt not found"})
+		return
+	}
+
+	var req struct {
+		Template    string `json:"template" binding:"required"`
+		Description string `json:"description"`
+		Activate    *bool  `json:"activate"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if err := validatePromptTemplate(name, req.Template); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
+	// New versions go live unless explicitly staged
+	activate := req.Activate == nil || *req.Activate
+	version, err := s.store.CreatePromptVersion(ctx, name, req.Template, req.Description, activate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save prompt version"})
+		return
+	}
+
+	if err := s.prompts.reload(ctx); err != nil {
+		golog.Errorf("failed to reload prompts: %v", err)
+	}
+	golog.Infof("prompt %s version %d saved (active: %v)", name, version.Version, activate)
+
+	c.JSON(http.StatusCreated, version)
+}
+
+func (s *Server) handleActivatePromptVersion(c *gin.Context) {
+	ctx := context.Background()
+	name := c.Param("name")
+
+	if _, ok := builtinPrompts[name]; !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Prompt not found"})
+		return
+	}
+
+	var req struct {
+		Version int `json:"version"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if err := s.store.ActivatePromptVersion(ctx, name, req.Version); err != nil {
+		if errors.Is(err, errPromptVersionNotFound) {
+			c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Prompt version not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to activate prompt version"})
+		return
+	}
+
+	if err := s.prompts.reload(ctx); err != nil {
+		golog.Errorf("failed to reload prompts: %v", err)
+	}
+
+	c.JSON(http.StatusOK, s.promptInfo(name))
+}
+
+func (s *Server) promptInfo(name string) PromptInfo {
+	return PromptInfo{
+		Name:          name,
+		Variables:     promptVars(name),
+		ActiveVersion: s.prompts.activeVersion(name),
+		Builtin:       builtinPrompts[name](),
+		Template:      s.prompts.Get(name),
+	}
+}
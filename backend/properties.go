@@ -0,0 +1,656 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Note property types
+const (
+	PropertyText     = "text"
+	PropertyNumber   = "number"
+	PropertyDate     = "date"
+	PropertyCheckbox = "checkbox"
+	PropertySelect   = "select"   // One or more options
+	PropertyRelation = "relation" // IDs of notes in the same notebook
+)
+
+var propertyTypes = map[string]bool{
+	PropertyText: true, PropertyNumber: true, PropertyDate: true,
+	PropertyCheckbox: true, PropertySelect: true, PropertyRelation: true,
+}
+
+// propertiesKey is the note metadata key holding its properties
+const propertiesKey = "properties"
+
+// maxPropertyName bounds the length of a property name
+const maxPropertyName = 64
+
+// NoteProperty is a typed value on a note. Values are a string for text, a
+// float for number, a date (2006-01-02) or RFC 3339 time for date, a bool for
+// checkbox and a list of strings for select and relation.
+type NoteProperty struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// PropertyInfo describes a property used by a notebook's notes
+type PropertyInfo struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Notes   int      `json:"notes"`
+	Options []string `json:"options,omitempty"` // Values seen, for select
+}
+
+// stringList reads a string or a list of strings, dropping blanks
+func stringList(value interface{}) ([]string, bool) {
+	var items []interface{}
+	switch v := value.(type) {
+	case string:
+		items = []interface{}{v}
+	case []string:
+		for _, s := range v {
+			items = append(items, s)
+		}
+	case []interface{}:
+		items = v
+	default:
+		return nil, false
+	}
+	list := []string{}
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list, true
+}
+
+// normalizeProperty checks a value against its type and stores it in the
+// type's canonical form
+func normalizeProperty(p NoteProperty) (NoteProperty, error) {
+	switch p.Type {
+	case PropertyText:
+		if s, ok := p.Value.(string); ok {
+			return NoteProperty{Type: p.Type, Value: s}, nil
+		}
+		return p, fmt.Errorf("must be a string")
+	case PropertyNumber:
+		switch v := p.Value.(type) {
+		case float64:
+			return NoteProperty{Type: p.Type, Value: v}, nil
+		case int:
+			return NoteProperty{Type: p.Type, Value: float64(v)}, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return NoteProperty{Type: p.Type, Value: f}, nil
+			}
+		}
+		return p, fmt.Errorf("must be a number")
+	case PropertyDate:
+		switch v := p.Value.(type) {
+		case time.Time:
+			return NoteProperty{Type: p.Type, Value: formatPropertyDate(v, precisionTime)}, nil
+		case string:
+			if t, precision, ok := parseDate(v); ok && (precision == precisionDay || precision == precisionTime) {
+				return NoteProperty{Type: p.Type, Value: formatPropertyDate(t, precision)}, nil
+			}
+		}
+		return p, fmt.Errorf("must be a date (2006-01-02) or an RFC 3339 time")
+	case PropertyCheckbox:
+		if b, ok := p.Value.(bool); ok {
+			return NoteProperty{Type: p.Type, Value: b}, nil
+		}
+		return p, fmt.Errorf("must be true or false")
+	case PropertySelect:
+		if list, ok := stringList(p.Value); ok && len(list) > 0 {
+			return NoteProperty{Type: p.Type, Value: list}, nil
+		}
+		return p, fmt.Errorf("must be an option or a list of options")
+	case PropertyRelation:
+		list, ok := stringList(p.Value)
+		if ok {
+			for _, id := range list {
+				if uuid.Validate(id) != nil {
+					ok = false
+				}
+			}
+		}
+		if ok {
+			return NoteProperty{Type: p.Type, Value: list}, nil
+		}
+		return p, fmt.Errorf("must be a note ID or a list of note IDs")
+	}
+	return p, fmt.Errorf("has unknown type %q", p.Type)
+}
+
+// formatPropertyDate writes a date property, keeping the time only when it has one
+func formatPropertyDate(t time.Time, precision string) string {
+	if precision == precisionTime && !(t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0) {
+		return t.Format(time.RFC3339)
+	}
+	return t.Format("2006-01-02")
+}
+
+// normalizeProperties checks every property, reporting each bad one as a
+// field of the request
+func normalizeProperties(props map[string]NoteProperty) (map[string]NoteProperty, error) {
+	var fields fieldErrors
+	normalized := make(map[string]NoteProperty, len(props))
+	for name, p := range props {
+		field := "properties." + name
+		if strings.TrimSpace(name) == "" || len(name) > maxPropertyName {
+			fields.add(field, "name must be 1 to %d characters", maxPropertyName)
+			continue
+		}
+		if !propertyTypes[p.Type] {
+			fields.add(field, "type must be text, number, date, checkbox, select or relation")
+			continue
+		}
+		n, err := normalizeProperty(p)
+		if err != nil {
+			fields.add(field, "%s", err.Error())
+			continue
+		}
+		normalized[strings.TrimSpace(name)] = n
+	}
+	return normalized, fields.err()
+}
+
+// noteProperties reads a note's properties from its metadata
+func noteProperties(note *Note) map[string]NoteProperty {
+	props := map[string]NoteProperty{}
+	raw, _ := note.Metadata[propertiesKey].(map[string]interface{})
+	for name, value := range raw {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		kind, _ := m["type"].(string)
+		if p, err := normalizeProperty(NoteProperty{Type: kind, Value: m["value"]}); err == nil {
+			props[name] = p
+		}
+	}
+	// Set in this process and not yet read back from the database
+	if typed, ok := note.Metadata[propertiesKey].(map[string]NoteProperty); ok {
+		for name, p := range typed {
+			props[name] = p
+		}
+	}
+	return props
+}
+
+// setNoteProperties stores properties in a note's metadata, removing the key
+// when there are none
+func setNoteProperties(note *Note, props map[string]NoteProperty) {
+	if note.Metadata == nil {
+		note.Metadata = map[string]interface{}{}
+	}
+	if len(props) == 0 {
+		delete(note.Metadata, propertiesKey)
+		return
+	}
+	note.Metadata[propertiesKey] = props
+}
+
+// parseFrontmatter reads the YAML block a note may start with, between
+// "---" lines
+func parseFrontmatter(content string) (map[string]interface{}, bool) {
+	content = strings.TrimPrefix(content, "\ufeff")
+	if !strings.HasPrefix(content, "---\n") && !strings.HasPrefix(content, "---\r\n") {
+		return nil, false
+	}
+	_, rest, _ := strings.Cut(content, "\n")
+	var block []string
+	for _, line := range strings.SplitAfter(rest, "\n") {
+		if strings.TrimRight(line, "\r\n") == "---" {
+			var doc map[string]interface{}
+			if err := yaml.Unmarshal([]byte(strings.Join(block, "")), &doc); err != nil {
+				return nil, false
+			}
+			return doc, true
+		}
+		block = append(block, line)
+	}
+	return nil, false
+}
+
+// wikiLink reads "[[Title]]", the way notes link to each other in
+// frontmatter. Unquoted, YAML reads [[Title]] as a list in a list.
+func wikiLink(value interface{}) (string, bool) {
+	if outer, ok := value.([]interface{}); ok && len(outer) == 1 {
+		if inner, ok := outer[0].([]interface{}); ok && len(inner) == 1 {
+			if title, ok := inner[0].(string); ok && strings.TrimSpace(title) != "" {
+				return strings.TrimSpace(title), true
+			}
+		}
+		return "", false
+	}
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, "[[") || !strings.HasSuffix(s, "]]") {
+		return "", false
+	}
+	title, _, _ := strings.Cut(strings.TrimSpace(s[2:len(s)-2]), "|")
+	return strings.TrimSpace(title), title != ""
+}
+
+// inferProperty types a frontmatter value: dates, numbers, booleans, links
+// to other notes as relations, lists as select and anything else as text.
+// links holds the titles of links that still need resolving to note IDs.
+func inferProperty(value interface{}) (p NoteProperty, links []string, ok bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return NoteProperty{Type: PropertyDate, Value: v}, nil, true
+	case int, float64:
+		return NoteProperty{Type: PropertyNumber, Value: v}, nil, true
+	case bool:
+		return NoteProperty{Type: PropertyCheckbox, Value: v}, nil, true
+	case string:
+		if title, ok := wikiLink(v); ok {
+			return NoteProperty{Type: PropertyRelation}, []string{title}, true
+		}
+		if _, precision, ok := parseDate(v); ok && (precision == precisionDay || precision == precisionTime) {
+			return NoteProperty{Type: PropertyDate, Value: v}, nil, true
+		}
+		return NoteProperty{Type: PropertyText, Value: v}, nil, true
+	case []interface{}:
+		if title, ok := wikiLink(v); ok {
+			return NoteProperty{Type: PropertyRelation}, []string{title}, true
+		}
+		for _, item := range v {
+			title, ok := wikiLink(item)
+			if !ok {
+				links = nil
+				break
+			}
+			links = append(links, title)
+		}
+		if len(links) > 0 {
+			return NoteProperty{Type: PropertyRelation}, links, true
+		}
+		options := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return p, nil, false
+			}
+			options = append(options, fmt.Sprint(item))
+		}
+		return NoteProperty{Type: PropertySelect, Value: options}, nil, true
+	}
+	return p, nil, false
+}
+
+// applyFrontmatter turns a note's YAML frontmatter into properties. Properties
+// set explicitly win, and links to notes that can't be found are left out.
+func (s *Server) applyFrontmatter(ctx context.Context, note *Note) {
+	doc, ok := parseFrontmatter(note.Content)
+	if !ok || len(doc) == 0 {
+		return
+	}
+
+	props := noteProperties(note)
+	var titles map[string]string
+	for name, value := range doc {
+		if name == "tags" && len(noteTags(note)) == 0 {
+			// Frontmatter tags are the note's tags rather than a property
+			if p, _, ok := inferProperty(value); ok && (p.Type == PropertySelect || p.Type == PropertyText) {
+				if n, err := normalizeProperty(NoteProperty{Type: PropertySelect, Value: p.Value}); err == nil {
+					if note.Metadata == nil {
+						note.Metadata = map[string]interface{}{}
+					}
+					note.Metadata["tags"] = n.Value
+				}
+			}
+			continue
+		}
+		if _, set := props[name]; set || len(name) > maxPropertyName {
+			continue
+		}
+		p, links, ok := inferProperty(value)
+		if !ok {
+			continue
+		}
+		if p.Type == PropertyRelation {
+			if titles == nil {
+				titles = s.noteTitles(ctx, note.NotebookID)
+			}
+			ids := []string{}
+			for _, title := range links {
+				if id, ok := titles[strings.ToLower(title)]; ok {
+					ids = append(ids, id)
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			p.Value = ids
+		}
+		if n, err := normalizeProperty(p); err == nil {
+			props[name] = n
+		}
+	}
+	setNoteProperties(note, props)
+}
+
+// noteTitles maps the lowercased titles of a notebook's notes to their IDs
+func (s *Server) noteTitles(ctx context.Context, notebookID string) map[string]string {
+	titles := map[string]string{}
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		return titles
+	}
+	for _, n := range notes {
+		titles[strings.ToLower(n.Title)] = n.ID
+	}
+	return titles
+}
+
+// checkRelations reports relation properties naming notes outside the notebook
+func (s *Server) checkRelations(ctx context.Context, notebookID string, props map[string]NoteProperty) error {
+	var fields fieldErrors
+	for name, p := range props {
+		if p.Type != PropertyRelation {
+			continue
+		}
+		for _, id := range p.Value.([]string) {
+			if n, err := s.store.GetNote(ctx, id); err != nil || n.NotebookID != notebookID {
+				fields.add("properties."+name, "note %s is not in this notebook", id)
+			}
+		}
+	}
+	return fields.err()
+}
+
+// Property filters
+
+// propertyFilter is one ?filter=name:op:value condition of the notes list
+type propertyFilter struct {
+	name, op, value string
+}
+
+var filterOps = map[string]bool{
+	"eq": true, "ne": true, "lt": true, "lte": true, "gt": true, "gte": true,
+	"contains": true, "exists": true, "missing": true,
+}
+
+// parsePropertyFilters reads the ?filter= conditions
+func parsePropertyFilters(values []string) ([]propertyFilter, error) {
+	var fields fieldErrors
+	var filters []propertyFilter
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || !filterOps[parts[1]] {
+			fields.add("filter", "%q must be name:op:value with op one of eq, ne, lt, lte, gt, gte, contains, exists or missing", v)
+			continue
+		}
+		f := propertyFilter{name: parts[0], op: parts[1]}
+		if len(parts) == 3 {
+			f.value = parts[2]
+		} else if f.op != "exists" && f.op != "missing" {
+			fields.add("filter", "%q needs a value", v)
+			continue
+		}
+		filters = append(filters, f)
+	}
+	return filters, fields.err()
+}
+
+// compareProperty orders a property's value against a filter value read as
+// the property's type. ok is false when they can't be ordered.
+func compareProperty(p NoteProperty, value string) (cmp int, ok bool) {
+	switch p.Type {
+	case PropertyNumber:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+		return compareFloats(p.Value.(float64), f), true
+	case PropertyDate:
+		a, _, okA := parseDate(p.Value.(string))
+		b, _, okB := parseDate(value)
+		if !okA || !okB {
+			return 0, false
+		}
+		return a.Compare(b), true
+	case PropertyCheckbox:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return 0, false
+		}
+		if p.Value.(bool) == b {
+			return 0, true
+		}
+		return 1, true
+	case PropertyText:
+		return strings.Compare(strings.ToLower(p.Value.(string)), strings.ToLower(value)), true
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// hasOption reports whether a select or relation property includes value
+func hasOption(p NoteProperty, value string) bool {
+	for _, v := range p.Value.([]string) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether a note's properties meet the filter. Select and
+// relation properties equal a value when they include it.
+func (f propertyFilter) match(props map[string]NoteProperty) bool {
+	p, ok := props[f.name]
+	switch f.op {
+	case "exists":
+		return ok
+	case "missing":
+		return !ok
+	}
+	if !ok {
+		return f.op == "ne"
+	}
+
+	if p.Type == PropertySelect || p.Type == PropertyRelation {
+		switch f.op {
+		case "eq", "contains":
+			return hasOption(p, f.value)
+		case "ne":
+			return !hasOption(p, f.value)
+		}
+		return false
+	}
+	if f.op == "contains" {
+		return p.Type == PropertyText && strings.Contains(strings.ToLower(p.Value.(string)), strings.ToLower(f.value))
+	}
+
+	cmp, ok := compareProperty(p, f.value)
+	if !ok {
+		return f.op == "ne"
+	}
+	switch f.op {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	case "gt":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// lessProperty orders two values of a property for sorting
+func lessProperty(a, b NoteProperty) bool {
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	switch a.Type {
+	case PropertyNumber:
+		return a.Value.(float64) < b.Value.(float64)
+	case PropertyDate:
+		ta, _, _ := parseDate(a.Value.(string))
+		tb, _, _ := parseDate(b.Value.(string))
+		return ta.Before(tb)
+	case PropertyCheckbox:
+		return !a.Value.(bool) && b.Value.(bool)
+	case PropertySelect, PropertyRelation:
+		return strings.Join(a.Value.([]string), ",") < strings.Join(b.Value.([]string), ",")
+	}
+	return strings.ToLower(a.Value.(string)) < strings.ToLower(b.Value.(string))
+}
+
+// filterNotes keeps the notes matching every filter, then sorts them by the
+// property named in sortBy ("-name" for descending). Notes without the
+// property come last either way. notes may be shared with the cache, so
+// the result is a new slice.
+func filterNotes(notes []Note, filters []propertyFilter, sortBy string) []Note {
+	props := make([]map[string]NoteProperty, 0, len(notes))
+	kept := make([]Note, 0, len(notes))
+	for i := range notes {
+		p := noteProperties(&notes[i])
+		matched := true
+		for _, f := range filters {
+			if !f.match(p) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			kept = append(kept, notes[i])
+			props = append(props, p)
+		}
+	}
+	if sortBy == "" {
+		return kept
+	}
+
+	desc := strings.HasPrefix(sortBy, "-")
+	name := strings.TrimPrefix(sortBy, "-")
+	order := make([]int, len(kept))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, okA := props[order[i]][name]
+		b, okB := props[order[j]][name]
+		if !okA || !okB {
+			return okA && !okB
+		}
+		if desc {
+			return lessProperty(b, a)
+		}
+		return lessProperty(a, b)
+	})
+	sorted := make([]Note, len(kept))
+	for i, k := range order {
+		sorted[i] = kept[k]
+	}
+	return sorted
+}
+
+// Property handlers
+
+// handleListProperties lists the properties a notebook's notes use, with
+// their types and, for select, the options seen
+func (s *Server) handleListProperties(c *gin.Context) {
+	notes, err := s.store.ListNotes(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+		return
+	}
+
+	infos := map[string]*PropertyInfo{}
+	options := map[string]map[string]bool{}
+	for i := range notes {
+		for name, p := range noteProperties(&notes[i]) {
+			key := name + "\x00" + p.Type
+			info, ok := infos[key]
+			if !ok {
+				info = &PropertyInfo{Name: name, Type: p.Type}
+				infos[key] = info
+				options[key] = map[string]bool{}
+			}
+			info.Notes++
+			if p.Type == PropertySelect {
+				for _, o := range p.Value.([]string) {
+					if !options[key][o] {
+						options[key][o] = true
+						info.Options = append(info.Options, o)
+					}
+				}
+			}
+		}
+	}
+
+	list := make([]PropertyInfo, 0, len(infos))
+	for _, info := range infos {
+		sort.Strings(info.Options)
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+	c.JSON(http.StatusOK, gin.H{"properties": list})
+}
+
+// handleSetNoteProperties replaces a note's properties
+func (s *Server) handleSetNoteProperties(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Properties map[string]NoteProperty `json:"properties"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found"})
+		return
+	}
+
+	props, err := normalizeProperties(req.Properties)
+	if err == nil {
+		err = s.checkRelations(ctx, note.NotebookID, props)
+	}
+	if validationResponse(c, err) {
+		return
+	}
+	setNoteProperties(note, props)
+	if err := s.store.UpdateNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to update note")
+		return
+	}
+	c.JSON(http.StatusOK, note)
+}
@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// ProviderUnavailableError is returned for calls to a provider that kept
+// failing, without calling it, until its cooldown is over
+type ProviderUnavailableError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *ProviderUnavailableError) Error() string {
+	return fmt.Sprintf("provider %s is unavailable after repeated failures; try again in %ds", e.Host, e.retryAfterSeconds())
+}
+
+// retryAfterSeconds is RetryAfter in whole seconds, at least one
+func (e *ProviderUnavailableError) retryAfterSeconds() int {
+	return max(1, int(e.RetryAfter.Round(time.Second).Seconds()))
+}
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// How a call let through by a breaker went
+const (
+	callSucceeded = iota
+	callFailed
+	// callDropped neither proves nor disproves the provider, as when the
+	// caller gave up
+	callDropped
+)
+
+// providerBreaker tracks the calls to one provider host. It opens after a
+// run of failures, failing calls at once for a cooldown, then lets one probe
+// call through: the breaker closes if it succeeds and opens again if not.
+type providerBreaker struct {
+	mu       sync.Mutex
+	host     string
+	state    string
+	failures int
+	// until is when an open breaker lets a probe through
+	until time.Time
+}
+
+// providerBreakers holds a breaker per provider host, shared by every client
+// calling it, so the LLM, embedding and speech calls to one API trip together
+var providerBreakers struct {
+	sync.Mutex
+	byHost map[string]*providerBreaker
+}
+
+// providerBreakerFor returns the breaker of a provider host
+func providerBreakerFor(host string) *providerBreaker {
+	providerBreakers.Lock()
+	defer providerBreakers.Unlock()
+	if providerBreakers.byHost == nil {
+		providerBreakers.byHost = make(map[string]*providerBreaker)
+	}
+	b, ok := providerBreakers.byHost[host]
+	if !ok {
+		b = &providerBreaker{host: host, state: breakerClosed}
+		providerBreakers.byHost[host] = b
+	}
+	return b
+}
+
+// providerHost is the host calls to a provider's base URL go to, that of
+// the OpenAI API when it is empty
+func providerHost(baseURL string) string {
+	if baseURL == "" {
+		return "api.openai.com"
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return baseURL
+	}
+	return u.Host
+}
+
+// providerUnavailable returns a *ProviderUnavailableError while the breaker
+// of host turns calls away, and nil otherwise. It does not use up the probe
+// call of a breaker whose cooldown is over.
+func providerUnavailable(host string) error {
+	b := providerBreakerFor(host)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerOpen && time.Now().Before(b.until):
+		return &ProviderUnavailableError{Host: host, RetryAfter: time.Until(b.until)}
+	case b.state == breakerHalfOpen:
+		return &ProviderUnavailableError{Host: host, RetryAfter: time.Second}
+	}
+	return nil
+}
+
+// allow lets a call through or returns a *ProviderUnavailableError. The
+// first call after the cooldown is the probe.
+func (b *providerBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := time.Until(b.until); wait > 0 {
+			return &ProviderUnavailableError{Host: b.host, RetryAfter: wait}
+		}
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		// Only the probe goes through until it is answered
+		return &ProviderUnavailableError{Host: b.host, RetryAfter: time.Second}
+	}
+	return nil
+}
+
+// done records how a call let through went: one of callSucceeded,
+// callFailed or callDropped
+func (b *providerBreaker) done(outcome int, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case outcome == callDropped:
+		if b.state == breakerHalfOpen {
+			// The next call probes instead
+			b.state = breakerOpen
+		}
+	case outcome == callSucceeded:
+		if b.state != breakerClosed {
+			golog.Infof("provider %s is answering again", b.host)
+		}
+		b.state, b.failures = breakerClosed, 0
+	case b.state == breakerHalfOpen:
+		b.state, b.until = breakerOpen, time.Now().Add(cooldown)
+		golog.Warnf("provider %s is still failing, trying again in %s", b.host, cooldown)
+	default:
+		b.failures++
+		if b.state == breakerClosed && b.failures >= threshold {
+			b.state, b.until = breakerOpen, time.Now().Add(cooldown)
+			golog.Warnf("provider %s failed %d times in a row, failing its calls for %s", b.host, b.failures, cooldown)
+		}
+	}
+}
+
+// breakerTransport sends requests through the breaker of their host. It
+// wraps the retries, so a call retried to no avail is one failure.
+type breakerTransport struct {
+	base      http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := providerBreakerFor(req.URL.Host)
+	if err := b.allow(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	// Connection failures, timeouts, 429 and 5xx count against the provider;
+	// other answers, even errors, show it is up
+	outcome := callSucceeded
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		outcome = callDropped
+	case err != nil, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		outcome = callFailed
+	}
+	b.done(outcome, t.threshold, t.cooldown)
+	return resp, err
+}
+
+// providerUnavailableResponse answers 503 when err is a
+// *ProviderUnavailableError, and reports whether it did
+func providerUnavailableResponse(c *gin.Context, err error) bool {
+	var unavailable *ProviderUnavailableError
+	if !errors.As(err, &unavailable) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(unavailable.retryAfterSeconds()))
+	c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: unavailable.Error()})
+	return true
+}
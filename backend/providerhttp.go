@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// providerRetryBackoff is the wait before retrying a provider request; it
+// doubles each time
+const providerRetryBackoff = time.Second
+
+// providerTransports shares one transport, and so one connection pool,
+// among the clients made for the same proxy and CA bundle
+var providerTransports struct {
+	sync.Mutex
+	key       string
+	transport *http.Transport
+}
+
+// providerCertPool returns the system certificates with those of a PEM
+// bundle added
+func providerCertPool(bundle string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(bundle)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", bundle)
+	}
+	return pool, nil
+}
+
+// parseProviderProxy parses PROVIDER_PROXY
+func parseProviderProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%q is not an http, https or socks5 URL", proxy)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", proxy)
+	}
+	return u, nil
+}
+
+// providerTransport returns the transport of provider requests: the default
+// one, which takes HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the
+// environment, with PROVIDER_PROXY and PROVIDER_CA_BUNDLE applied
+func providerTransport(cfg Config) (*http.Transport, error) {
+	key := cfg.ProviderProxy + "\x00" + cfg.ProviderCABundle
+	providerTransports.Lock()
+	defer providerTransports.Unlock()
+	if providerTransports.transport != nil && providerTransports.key == key {
+		return providerTransports.transport, nil
+	}
+
+	// Cloned after EnforceLocalOnly, so local-only mode carries over
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ProviderProxy != "" {
+		proxy, err := parseProviderProxy(cfg.ProviderProxy)
+		if err != nil {
+			return nil, fmt.Errorf("PROVIDER_PROXY: %w", err)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	if cfg.ProviderCABundle != "" {
+		pool, err := providerCertPool(cfg.ProviderCABundle)
+		if err != nil {
+			return nil, fmt.Errorf("PROVIDER_CA_BUNDLE: %w", err)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	providerTransports.key, providerTransports.transport = key, t
+	return t, nil
+}
+
+// providerHTTPClient returns a client for a provider's API. timeout bounds
+// each call, retries included, unless PROVIDER_TIMEOUT overrides it; 0 is no
+// limit. Calls the provider turns away with 429 or 5xx, or that cannot
+// connect, are retried the given number of times. Calls to a provider that
+// keeps failing are turned away by its circuit breaker.
+func providerHTTPClient(cfg Config, timeout time.Duration, retries int) *http.Client {
+	if cfg.ProviderTimeout > 0 {
+		timeout = time.Duration(cfg.ProviderTimeout) * time.Second
+	}
+	var transport http.RoundTripper
+	if t, err := providerTransport(cfg); err != nil {
+		// Checked at startup, so only a file changed since gets here
+		golog.Errorf("failed to set up provider requests, using the defaults: %v", err)
+		transport = http.DefaultTransport
+	} else {
+		transport = t
+	}
+	if retries > 0 {
+		transport = &retryingTransport{base: transport, retries: retries}
+	}
+	if cfg.ProviderBreakerFailures > 0 {
+		transport = &breakerTransport{
+			base:      transport,
+			threshold: cfg.ProviderBreakerFailures,
+			cooldown:  time.Duration(cfg.ProviderBreakerCooldown) * time.Second,
+		}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// retryingTransport retries requests with jittered backoff while the server
+// answers 429 or 5xx or cannot be reached. Requests whose body cannot be
+// replayed are sent once.
+type retryingTransport struct {
+	base    http.RoundTripper
+	retries int
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := providerRetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		var reason string
+		var opErr *net.OpError
+		switch {
+		case err != nil && errors.As(err, &opErr) && opErr.Op == "dial":
+			// Nothing was sent, so even a POST is safe to send again
+			reason = err.Error()
+		case err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500):
+			reason = resp.Status
+		}
+		if reason == "" || attempt == t.retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		// Jitter keeps concurrent requests from retrying in lockstep
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		golog.Warnf("%s %s failed (%s), retrying in %s", req.Method, req.URL.Redacted(), reason, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Provider kinds that can be tested
+const (
+	providerKindLLM       = "llm"
+	providerKindEmbedding = "embedding"
+	providerKindImage     = "image"
+)
+
+// geminiModelsURL lists the models a Google API key can use
+const geminiModelsURL = "https://generativelanguage.googleapis.com/v1beta/models"
+
+// geminiImageModel is the model image generation uses
+const geminiImageModel = "gemini-3-pro-image-preview"
+
+// ProviderTestResult is the outcome of one provider check
+type ProviderTestResult struct {
+	Kind      string `json:"kind"`
+	Provider  string `json:"provider"`
+	BaseURL   string `json:"base_url,omitempty"`
+	Model     string `json:"model,omitempty"`
+	OK        bool   `json:"ok"`
+	LatencyMS int64  `json:"latency_ms"`
+	// Models the provider offers, when it lists them
+	Models []string `json:"models,omitempty"`
+	// ModelFound is false when the configured model is not among Models
+	ModelFound *bool `json:"model_found,omitempty"`
+	// Dimensions of the test embedding
+	Dimensions int    `json:"dimensions,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Hint says what to change when the check failed
+	Hint string `json:"hint,omitempty"`
+}
+
+// providerStatusError is a provider answering with an HTTP error
+type providerStatusError struct {
+	Endpoint string
+	Status   int
+	Body     string
+}
+
+func (e *providerStatusError) Error() string {
+	msg := fmt.Sprintf("%s answered %d %s", e.Endpoint, e.Status, http.StatusText(e.Status))
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// llmProvider names the provider and base URL cfg sends chat requests to
+func llmProvider(cfg Config) (provider, baseURL string) {
+	if cfg.IsOllama() {
+		return "ollama", strings.TrimSuffix(strings.TrimSuffix(cfg.OllamaBaseURL, "/"), "/v1")
+	}
+	base := cfg.GetBaseURL()
+	if base == "" {
+		base = "https://api.openai.com/v1"
+	}
+	return "openai", strings.TrimSuffix(base, "/")
+}
+
+// listProviderModels asks an OpenAI-compatible or Ollama server which models
+// it has. A rejected key or other HTTP error is a *providerStatusError.
+func listProviderModels(ctx context.Context, client *http.Client, provider, baseURL, apiKey string) ([]string, error) {
+	endpoint := baseURL + "/models"
+	if provider == "ollama" {
+		endpoint = baseURL + "/api/tags"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	return fetchModelList(client, req)
+}
+
+// fetchModelList reads the model names from an OpenAI ({"data": [{"id"}]}),
+// Ollama ({"models": [{"name"}]}) or Gemini ({"models": [{"name"}]}) listing
+func fetchModelList(client *http.Client, req *http.Request) ([]string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var body struct {
+			Error json.RawMessage `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return nil, &providerStatusError{Endpoint: req.URL.Scheme + "://" + req.URL.Host + req.URL.Path, Status: resp.StatusCode, Body: providerErrorMessage(body.Error)}
+	}
+
+	var listing struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("unexpected model listing: %w", err)
+	}
+	var models []string
+	for _, m := range listing.Data {
+		models = append(models, m.ID)
+	}
+	for _, m := range listing.Models {
+		models = append(models, strings.TrimPrefix(m.Name, "models/"))
+	}
+	sort.Strings(models)
+	return models, nil
+}
+
+// providerErrorMessage pulls the message out of an error field, which is a
+// string for some providers and an object with a message for others
+func providerErrorMessage(raw json.RawMessage) string {
+	var msg string
+	if json.Unmarshal(raw, &msg) == nil {
+		return msg
+	}
+	var obj struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(raw, &obj)
+	return obj.Message
+}
+
+// hasModel reports whether model is listed, allowing for Ollama's :latest tag
+func hasModel(models []string, model string) bool {
+	for _, m := range models {
+		if m == model || m == model+":latest" {
+			return true
+		}
+	}
+	return false
+}
+
+// providerHint turns a failed check into advice on what to fix
+func providerHint(res *ProviderTestResult, err error) string {
+	msg := strings.ToLower(err.Error())
+	var status *providerStatusError
+	code := 0
+	if errors.As(err, &status) {
+		code = status.Status
+	}
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+
+	keySetting := "OPENAI_API_KEY (or the workspace's LLM key)"
+	if res.Kind == providerKindImage {
+		keySetting = "GOOGLE_API_KEY"
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return fmt.Sprintf("%s did not answer within %s. Check the server is up and not overloaded.", res.BaseURL, providerCheckTimeout)
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("The host in %s could not be resolved. Check the base URL.", res.BaseURL)
+	case errors.As(err, &opErr) || strings.Contains(msg, "connection refused"):
+		if res.Provider == "ollama" {
+			return fmt.Sprintf("Could not connect to %s. Start Ollama with `ollama serve` or fix OLLAMA_BASE_URL.", res.BaseURL)
+		}
+		return fmt.Sprintf("Could not connect to %s. Check OPENAI_BASE_URL and your network or proxy.", res.BaseURL)
+	case code == http.StatusUnauthorized || code == http.StatusForbidden ||
+		strings.Contains(msg, "401") || strings.Contains(msg, "invalid_api_key") || strings.Contains(msg, "api key not valid"):
+		return fmt.Sprintf("The API key was rejected. Check %s.", keySetting)
+	case code == http.StatusTooManyRequests || strings.Contains(msg, "429") || strings.Contains(msg, "quota"):
+		return "The provider is rate limiting this key or its quota is used up. Check the account's billing and limits."
+	case res.ModelFound != nil && !*res.ModelFound:
+		if res.Provider == "ollama" {
+			return fmt.Sprintf("Model %s is not installed. Run `ollama pull %s` or pick one of the listed models.", res.Model, res.Model)
+		}
+		return fmt.Sprintf("Model %s is not available to this key. Pick one of the listed models.", res.Model)
+	case code == http.StatusNotFound:
+		return fmt.Sprintf("%s has no such endpoint. Check the base URL; OpenAI-compatible servers usually end in /v1.", res.BaseURL)
+	case code >= 500:
+		return "The provider is having problems. Try again later."
+	}
+	return "Check the provider settings and the server logs."
+}
+
+// finish records how a check went
+func (res *ProviderTestResult) finish(start time.Time, err error) {
+	res.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		res.Hint = providerHint(res, err)
+		return
+	}
+	res.OK = true
+}
+
+// testLLM lists the chat provider's models and asks the configured model
+// for a one-word reply
+func testLLM(ctx context.Context, cfg Config) ProviderTestResult {
+	provider, base := llmProvider(cfg)
+	res := ProviderTestResult{Kind: providerKindLLM, Provider: provider, BaseURL: base, Model: cfg.OpenAIModel}
+	if provider == "ollama" {
+		res.Model = cfg.OllamaModel
+	}
+
+	start := time.Now()
+	models, err := listProviderModels(ctx, providerHTTPClient(cfg, 0, 0), provider, base, cfg.OpenAIAPIKey)
+	if err == nil {
+		res.Models = models
+		found := hasModel(models, res.Model)
+		res.ModelFound = &found
+
+		var llm llms.Model
+		if llm, err = createLLM(cfg); err == nil {
+			_, err = llms.GenerateFromSinglePrompt(ctx, llm, "Reply with the single word OK.")
+		}
+	}
+	res.finish(start, err)
+	return res
+}
+
+// testEmbedding embeds one word with the configured embedding model
+func testEmbedding(ctx context.Context, cfg Config) ProviderTestResult {
+	provider, base := llmProvider(cfg)
+	res := ProviderTestResult{Kind: providerKindEmbedding, Provider: provider, BaseURL: base, Model: cfg.EmbeddingModel}
+	if provider == "ollama" {
+		res.Model = cfg.OllamaEmbeddingModel
+	}
+
+	start := time.Now()
+	cfg.EnableEmbeddings = true
+	embedder, err := newBatchEmbedder(cfg)
+	if err == nil {
+		var vectors [][]float32
+		if vectors, err = embedder.Embed(ctx, []string{"notex"}); err == nil && len(vectors) == 1 {
+			res.Dimensions = len(vectors[0])
+		}
+	}
+	res.finish(start, err)
+	return res
+}
+
+// testImage checks the Google API key image generation uses can see the
+// image model
+func testImage(ctx context.Context, cfg Config) ProviderTestResult {
+	res := ProviderTestResult{Kind: providerKindImage, Provider: "gemini", BaseURL: geminiModelsURL, Model: geminiImageModel}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, geminiModelsURL+"?pageSize=1000", nil)
+	if err == nil {
+		req.Header.Set("x-goog-api-key", cfg.GoogleAPIKey)
+		var models []string
+		if models, err = fetchModelList(providerHTTPClient(cfg, 0, 0), req); err == nil {
+			res.Models = models
+			found := hasModel(models, res.Model)
+			res.ModelFound = &found
+			if !found {
+				err = fmt.Errorf("model %s is not available", res.Model)
+			}
+		}
+	}
+	res.finish(start, err)
+	return res
+}
+
+// testProviders runs the checks for kinds against cfg, all at once
+func testProviders(ctx context.Context, cfg Config, kinds []string) []ProviderTestResult {
+	ctx, cancel := context.WithTimeout(ctx, providerCheckTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context, Config) ProviderTestResult{
+		providerKindLLM:       testLLM,
+		providerKindEmbedding: testEmbedding,
+		providerKindImage:     testImage,
+	}
+	results := make([]ProviderTestResult, len(kinds))
+	done := make(chan struct{})
+	for i, kind := range kinds {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			results[i] = checks[kind](ctx, cfg)
+		}()
+	}
+	for range kinds {
+		<-done
+	}
+	return results
+}
+
+// Provider test handlers
+
+// handleTestProviders checks the providers the current workspace uses,
+// using its own LLM credentials if it has them. The body may pick kinds;
+// by default every configured provider is checked.
+func (s *Server) handleTestProviders(c *gin.Context) {
+	var req struct {
+		Kinds []string `json:"kinds" binding:"omitempty,dive,oneof=llm embedding image"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+
+	cfg := workspaceLLMConfig(s.cfg, currentWorkspace(c))
+	kinds := req.Kinds
+	if len(kinds) == 0 {
+		kinds = []string{providerKindLLM}
+		if cfg.EnableEmbeddings {
+			kinds = append(kinds, providerKindEmbedding)
+		}
+		if cfg.GoogleAPIKey != "" {
+			kinds = append(kinds, providerKindImage)
+		}
+	}
+	for _, kind := range kinds {
+		if kind == providerKindImage && cfg.GoogleAPIKey == "" {
+			validationResponse(c, invalidField("kinds", "image needs GOOGLE_API_KEY to be set"))
+			return
+		}
+	}
+
+	results := testProviders(c.Request.Context(), cfg, kinds)
+	ok := true
+	for _, res := range results {
+		ok = ok && res.OK
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": ok, "results": results})
+}
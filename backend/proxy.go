@@ -0,0 +1,155 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// basePathPattern is a BASE_PATH: one or more path segments, with an
+// optional trailing slash
+var basePathPattern = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+/?$`)
+
+// clientIPHeaders are the headers a trusted proxy names the client in, in
+// the order they are believed
+var clientIPHeaders = []string{"X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP", "True-Client-IP"}
+
+// proxyContextKey is the request context key of a request's proxyInfo
+type proxyContextKey struct{}
+
+// proxyInfo is how a request reached the server
+type proxyInfo struct {
+	// trusted is set when it came from one of TRUSTED_PROXIES, so its
+	// X-Forwarded-* headers are believed
+	trusted bool
+	// basePath is the BASE_PATH it was made under; "" on custom domains,
+	// which are served at their root
+	basePath string
+}
+
+func requestProxyInfo(c *gin.Context) proxyInfo {
+	info, _ := c.Request.Context().Value(proxyContextKey{}).(proxyInfo)
+	return info
+}
+
+// requestBasePath is the prefix paths the client sees start with
+func requestBasePath(c *gin.Context) string {
+	return requestProxyInfo(c).basePath
+}
+
+// normalizeBasePath drops a trailing slash, making "/" no base path at all
+func normalizeBasePath(p string) string {
+	return strings.TrimRight(p, "/")
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES; an IP is a range of one
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR range", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// configureProxies has gin take client IPs from forwarding headers only when
+// the request comes from TRUSTED_PROXIES
+func configureProxies(router *gin.Engine, cfg Config) error {
+	nets, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trusted := make([]string, 0, len(nets))
+	for _, n := range nets {
+		trusted = append(trusted, n.String())
+	}
+	router.RemoteIPHeaders = clientIPHeaders
+	return router.SetTrustedProxies(trusted)
+}
+
+// handler is s.http as the listeners serve it: under BASE_PATH, with what
+// requestOrigin needs to know about the proxy in the request context.
+// Custom domains are served at their root, and /healthz and /readyz at the
+// root too, for probes that reach the server directly.
+func (s *Server) handler() http.Handler {
+	nets, _ := parseTrustedProxies(s.cfg.TrustedProxies)
+	base := normalizeBasePath(s.cfg.BasePath)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info proxyInfo
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				for _, n := range nets {
+					info.trusted = info.trusted || n.Contains(ip)
+				}
+			}
+		}
+
+		p := r.URL.Path
+		switch {
+		case base == "" || p == "/healthz" || p == "/readyz" || s.siteWorkspace(r.Context(), r.Host) != "":
+		case p == base:
+			target := base + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		case strings.HasPrefix(p, base+"/"):
+			u := *r.URL
+			u.Path, u.RawPath = strings.TrimPrefix(p, base), ""
+			r = r.Clone(r.Context())
+			r.URL = &u
+			info.basePath = base
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Code: CodeNotFound, Error: "Not found; the server is at " + base + "/"})
+			return
+		}
+
+		s.http.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, info)))
+	})
+}
+
+// setCookie sets a cookie for the paths under BASE_PATH, Secure when the
+// client reached the server over HTTPS
+func setCookie(c *gin.Context, cookie *http.Cookie) {
+	cookie.Path = requestBasePath(c) + cookie.Path
+	cookie.Secure = strings.HasPrefix(requestOrigin(c), "https://")
+	http.SetCookie(c.Writer, cookie)
+}
+
+// absoluteURL makes an API path a link for messages sent outside a request,
+// with PUBLIC_URL; without it the path is left as it is
+func (s *Server) absoluteURL(p string) string {
+	if s.cfg.PublicURL == "" || p == "" {
+		return p
+	}
+	return strings.TrimRight(s.cfg.PublicURL, "/") + p
+}
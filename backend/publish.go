@@ -0,0 +1,880 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// publishPrefix is where published notes are served, without an API token
+const publishPrefix = "/p"
+
+const (
+	// maxSlugLength bounds the last part of a published note's URL, in
+	// characters
+	maxSlugLength = 80
+	// publishIndexSize is how many notes the index page lists, newest first
+	publishIndexSize = 100
+	// publishFeedSize is how many notes the RSS feed holds
+	publishFeedSize = 50
+	// maxSitemapURLs is the most URLs a sitemap file may list
+	maxSitemapURLs = 50000
+)
+
+// publishBaseCSS lays out published pages; themes set its colors and fonts
+const publishBaseCSS = `
+body { margin: 0; background: var(--bg); color: var(--fg); font-family: var(--font); line-height: 1.65; }
+header, main { max-width: 42rem; margin: 0 auto; padding: 1.5rem 1.25rem; }
+header { border-bottom: 1px solid var(--rule); padding-bottom: 1rem; }
+header a { color: var(--fg); font-weight: bold; text-decoration: none; }
+a { color: var(--link); }
+h1, h2, h3, h4, h5, h6 { font-family: var(--heading-font); line-height: 1.25; }
+.date { color: var(--muted); font-size: 0.9em; }
+pre { background: var(--code-bg); padding: 0.75rem 1rem; overflow-x: auto; border-radius: 4px; }
+code { background: var(--code-bg); padding: 0.1em 0.3em; border-radius: 3px; font-size: 0.9em; }
+pre code { background: none; padding: 0; }
+blockquote { margin: 1rem 0; padding-left: 1rem; border-left: 3px solid var(--rule); color: var(--muted); }
+hr { border: 0; border-top: 1px solid var(--rule); }
+img { max-width: 100%; }
+li.task { list-style: none; }
+ul.index { list-style: none; padding: 0; }
+ul.index li { margin: 0.75rem 0; }
+.logo { height: 2rem; vertical-align: middle; margin-right: 0.5rem; }
+`
+
+// publishThemes are the looks a published note can have, as CSS setting
+// the variables publishBaseCSS uses
+var publishThemes = map[string]string{
+	"light": `:root { --bg: #fff; --fg: #222; --muted: #666; --link: #0b62c4; --rule: #ddd; --code-bg: #f4f4f4;
+	--font: -apple-system, "Segoe UI", Roboto, sans-serif; --heading-font: var(--font); }`,
+	"dark": `:root { --bg: #16181d; --fg: #e4e4e4; --muted: #9a9a9a; --link: #7ab7ff; --rule: #333; --code-bg: #23262e;
+	--font: -apple-system, "Segoe UI", Roboto, sans-serif; --heading-font: var(--font); }`,
+	"serif": `:root { --bg: #fbf8f1; --fg: #2b2b2b; --muted: #6f6a60; --link: #8a3b12; --rule: #e2dccd; --code-bg: #f0ebdf;
+	--font: Georgia, "Times New Roman", serif; --heading-font: Georgia, serif; }`,
+	"mono": `:root { --bg: #fff; --fg: #111; --muted: #555; --link: #111; --rule: #111; --code-bg: #eee;
+	--font: ui-monospace, Menlo, Consolas, monospace; --heading-font: var(--font); }`,
+}
+
+// publishThemeNames lists the themes for error messages
+func publishThemeNames() string {
+	names := make([]string, 0, len(publishThemes))
+	for name := range publishThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Publication is a note published at a public URL. The page shows the
+// note as it is now, so edits appear without publishing again.
+type Publication struct {
+	NoteID      string    `json:"note_id"`
+	NotebookID  string    `json:"notebook_id"`
+	Title       string    `json:"title"`
+	Slug        string    `json:"slug"`
+	Theme       string    `json:"theme"`
+	Path        string    `json:"path"`
+	URL         string    `json:"url,omitempty"`
+	PublishedAt time.Time `json:"published_at"`
+	// UpdatedAt is when the note last changed
+	UpdatedAt   time.Time `json:"updated_at"`
+	WorkspaceID string    `json:"-"`
+	Domain      string    `json:"-"` // the workspace's custom domain
+	Language    string    `json:"-"` // the notebook's language
+}
+
+func scanPublication(row rowScanner) (*Publication, error) {
+	var p Publication
+	var publishedAt, updatedAt int64
+
+	if err := row.Scan(&p.NoteID, &p.NotebookID, &p.Title, &p.Slug, &p.Theme, &publishedAt, &updatedAt, &p.WorkspaceID, &p.Domain, &p.Language); err != nil {
+		return nil, err
+	}
+	p.Path = publishPrefix + "/" + url.PathEscape(p.Slug)
+	p.PublishedAt = time.Unix(publishedAt, 0)
+	p.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &p, nil
+}
+
+// Publication operations
+
+const publicationQuery = `
+	SELECT p.note_id, n.notebook_id, n.title, p.slug, p.theme, p.published_at, n.updated_at,
+		nb.workspace_id, COALESCE(site.domain, ''), nb.language
+	FROM published_notes p
+	JOIN notes n ON n.id = p.note_id
+	JOIN notebooks nb ON nb.id = n.notebook_id
+	LEFT JOIN workspace_sites site ON site.workspace_id = nb.workspace_id`
+
+// PublishNote publishes a note, or changes the slug and theme of one that
+// is published, keeping when it was first published
+func (s *Store) PublishNote(ctx context.Context, noteID, slug, theme string) (*Publication, error) {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO published_notes (note_id, slug, theme, published_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(note_id) DO UPDATE SET slug = excluded.slug, theme = excluded.theme
+	`, noteID, slug, theme, time.Now().Unix())
+	if isUniqueViolation(err) {
+		return nil, conflictError(fmt.Sprintf("the slug %q is taken by another published note", slug))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetPublication(ctx, noteID)
+}
+
+// GetPublication returns how a note is published
+func (s *Store) GetPublication(ctx context.Context, noteID string) (*Publication, error) {
+	p, err := scanPublication(s.db.QueryRowContext(ctx, publicationQuery+` WHERE p.note_id = ?`, noteID))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("publication")
+	}
+	return p, err
+}
+
+// GetPublicationBySlug returns the published note at a slug. Notes in
+// notebooks in the trash are not served.
+func (s *Store) GetPublicationBySlug(ctx context.Context, slug string) (*Publication, error) {
+	p, err := scanPublication(s.db.QueryRowContext(ctx, publicationQuery+` WHERE p.slug = ? AND nb.trashed_at = 0`, slug))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("published note")
+	}
+	return p, err
+}
+
+// ListPublications returns the published notes of a workspace, or of every
+// workspace with workspaceID "", newest first. Public lists leave out the
+// notes of notebooks in the trash.
+func (s *Store) ListPublications(ctx context.Context, workspaceID string, public bool, limit int) ([]Publication, error) {
+	var conditions []string
+	var args []interface{}
+	if workspaceID != "" {
+		conditions = append(conditions, "nb.workspace_id = ?")
+		args = append(args, workspaceID)
+	}
+	if public {
+		conditions = append(conditions, "nb.trashed_at = 0")
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, publicationQuery+where+` ORDER BY p.published_at DESC, p.note_id LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	publications := []Publication{}
+	for rows.Next() {
+		p, err := scanPublication(rows)
+		if err != nil {
+			return nil, err
+		}
+		publications = append(publications, *p)
+	}
+	return publications, rows.Err()
+}
+
+// UnpublishNote takes a note off its public URL
+func (s *Store) UnpublishNote(ctx context.Context, noteID string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM published_notes WHERE note_id = ?`, noteID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundError("publication")
+	}
+	return nil
+}
+
+// freeSlug returns base, or base with the lowest number appended that no
+// other note is published at
+func (s *Store) freeSlug(ctx context.Context, base, noteID string) (string, error) {
+	if base == "" {
+		base = "note"
+	}
+	for n := 1; ; n++ {
+		slug := base
+		if n > 1 {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		var owner string
+		err := s.db.QueryRowContext(ctx, `SELECT note_id FROM published_notes WHERE slug = ?`, slug).Scan(&owner)
+		if err == sql.ErrNoRows || owner == noteID {
+			return slug, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// slugify turns a title into a slug: lowercase letters and digits of any
+// script, with runs of anything else as one hyphen
+func slugify(title string) string {
+	var sb strings.Builder
+	n, gap := 0, false
+	for _, r := range strings.ToLower(title) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			gap = true
+			continue
+		}
+		hyphen := gap && n > 0
+		if n+1+boolInt(hyphen) > maxSlugLength {
+			break
+		}
+		if hyphen {
+			sb.WriteByte('-')
+			n++
+		}
+		sb.WriteRune(r)
+		n++
+		gap = false
+	}
+	return sb.String()
+}
+
+// Markdown
+
+var (
+	mdFence    = regexp.MustCompile("^\\s*(```|~~~)\\s*([\\w+#.-]*)")
+	mdHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)(\s+#+)?\s*$`)
+	mdRule     = regexp.MustCompile(`^\s*(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdBullet   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrdered  = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+(.*)$`)
+	mdTask     = regexp.MustCompile(`^\[([ xX])\]\s+(.*)$`)
+	mdCode     = regexp.MustCompile("`([^`]+)`")
+	mdImage    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	mdLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdAutolink = regexp.MustCompile(`https?://[^\s<>"]*[^\s<>".,;:!?)'\]]`)
+	mdStrong   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEm       = regexp.MustCompile(`\*([^*\s](?:[^*]*[^*\s])?)\*|\b_([^_\s](?:[^_]*[^_\s])?)_\b`)
+	mdStrike   = regexp.MustCompile(`~~([^~]+)~~`)
+	// mdPlaceholder stands for a piece of inline HTML while the rest of
+	// the text is rendered
+	mdPlaceholder = regexp.MustCompile("\x00([0-9]+)\x00")
+)
+
+// renderMarkdown turns a note's Markdown into HTML. It covers what notes are
+// written with: headings, paragraphs, lists and task lists, quotes, code,
+// rules, emphasis, links and images. Raw HTML in a note is shown as text,
+// and links to anything but web pages, mail addresses and paths are
+// dropped.
+func renderMarkdown(src string) template.HTML {
+	var sb strings.Builder
+	renderBlocks(&sb, strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n"))
+	return template.HTML(sb.String())
+}
+
+// startsBlock reports whether a line ends the paragraph before it
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || mdFence.MatchString(line) || mdHeading.MatchString(trimmed) || mdRule.MatchString(line) ||
+		strings.HasPrefix(trimmed, ">") || mdBullet.MatchString(line) || mdOrdered.MatchString(line)
+}
+
+func renderBlocks(sb *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			i++ // the closing fence
+			if m[2] != "" {
+				fmt.Fprintf(sb, `<pre><code class="language-%s">`, html.EscapeString(m[2]))
+			} else {
+				sb.WriteString("<pre><code>")
+			}
+			sb.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			sb.WriteString("</code></pre>\n")
+		case mdHeading.MatchString(trimmed):
+			m := mdHeading.FindStringSubmatch(trimmed)
+			fmt.Fprintf(sb, "<h%d>%s</h%d>\n", len(m[1]), renderInline(m[2]), len(m[1]))
+			i++
+		case mdRule.MatchString(line):
+			sb.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(quote, " "))
+			}
+			sb.WriteString("<blockquote>\n")
+			renderBlocks(sb, quoted)
+			sb.WriteString("</blockquote>\n")
+		case mdBullet.MatchString(line), mdOrdered.MatchString(line):
+			i = renderList(sb, lines, i)
+		default:
+			var para []string
+			for ; i < len(lines) && (len(para) == 0 || !startsBlock(lines[i])); i++ {
+				para = append(para, renderInline(strings.TrimSpace(lines[i])))
+			}
+			fmt.Fprintf(sb, "<p>%s</p>\n", strings.Join(para, "<br>\n"))
+		}
+	}
+}
+
+// renderList writes the list starting at lines[i] and returns the index of
+// the line after it. Lines that are not list items continue the item
+// above them; nested items become items of the same list.
+func renderList(sb *strings.Builder, lines []string, i int) int {
+	item := mdBullet
+	tag := "ul"
+	if !mdBullet.MatchString(lines[i]) {
+		item, tag = mdOrdered, "ol"
+	}
+
+	sb.WriteString("<" + tag + ">\n")
+	for i < len(lines) {
+		// A blank line between two items does not end the list
+		if strings.TrimSpace(lines[i]) == "" && i+1 < len(lines) && item.MatchString(lines[i+1]) {
+			i++
+		}
+		m := item.FindStringSubmatch(lines[i])
+		if m == nil {
+			break
+		}
+		text := []string{m[1]}
+		for i++; i < len(lines) && !startsBlock(lines[i]); i++ {
+			text = append(text, strings.TrimSpace(lines[i]))
+		}
+		content := strings.Join(text, "\n")
+		if task := mdTask.FindStringSubmatch(content); task != nil {
+			checked := ""
+			if task[1] != " " {
+				checked = " checked"
+			}
+			fmt.Fprintf(sb, "<li class=\"task\"><input type=\"checkbox\" disabled%s> %s</li>\n", checked, renderInline(task[2]))
+		} else {
+			fmt.Fprintf(sb, "<li>%s</li>\n", renderInline(content))
+		}
+	}
+	sb.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// renderInline renders the spans of a line: code, images, links and
+// emphasis. Code and finished links are set aside as placeholders, so
+// nothing inside them is rendered again.
+func renderInline(text string) string {
+	var pieces []string
+	hold := func(piece string) string {
+		pieces = append(pieces, piece)
+		return "\x00" + strconv.Itoa(len(pieces)-1) + "\x00"
+	}
+
+	text = strings.ReplaceAll(text, "\x00", "")
+	text = mdCode.ReplaceAllStringFunc(text, func(m string) string {
+		return hold("<code>" + html.EscapeString(mdCode.FindStringSubmatch(m)[1]) + "</code>")
+	})
+	text = html.EscapeString(text)
+	text = mdImage.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdImage.FindStringSubmatch(m)
+		if !safeLinkURL(parts[2]) {
+			return parts[1]
+		}
+		return hold(`<img src="` + parts[2] + `" alt="` + parts[1] + `">`)
+	})
+	text = mdLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdLink.FindStringSubmatch(m)
+		if !safeLinkURL(parts[2]) {
+			return parts[1]
+		}
+		return hold(`<a href="`+parts[2]+`">`) + parts[1] + hold("</a>")
+	})
+	text = mdAutolink.ReplaceAllStringFunc(text, func(m string) string {
+		return hold(`<a href="` + m + `">` + m + `</a>`)
+	})
+	text = mdStrong.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = mdEm.ReplaceAllString(text, "<em>$1$2</em>")
+	text = mdStrike.ReplaceAllString(text, "<del>$1</del>")
+
+	return mdPlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		n, _ := strconv.Atoi(mdPlaceholder.FindStringSubmatch(m)[1])
+		return pieces[n]
+	})
+}
+
+// safeLinkURL reports whether a link in a note may be followed from a
+// published page: web and mail links, and paths on this server
+func safeLinkURL(escaped string) bool {
+	u := strings.ToLower(html.UnescapeString(escaped))
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "mailto:") {
+		return true
+	}
+	scheme, _, found := strings.Cut(u, ":")
+	return !found || strings.ContainsAny(scheme, "/?#")
+}
+
+// publishedBody returns a note's content without its first line when that
+// is a heading repeating the title, which the page shows anyway
+func publishedBody(title, content string) string {
+	content = strings.TrimLeft(content, "\r\n\t ")
+	first, rest, _ := strings.Cut(content, "\n")
+	if m := mdHeading.FindStringSubmatch(strings.TrimSpace(first)); m != nil && len(m[1]) == 1 && strings.TrimSpace(m[2]) == strings.TrimSpace(title) {
+		return rest
+	}
+	return content
+}
+
+// publishedExcerpt is the first paragraph of a note as plain text, for the
+// page description
+func publishedExcerpt(body string) string {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || startsBlock(line) {
+			continue
+		}
+		line = mdLink.ReplaceAllString(mdImage.ReplaceAllString(line, "$1"), "$1")
+		line = strings.Map(func(r rune) rune {
+			if strings.ContainsRune("*_`~[]", r) {
+				return -1
+			}
+			return r
+		}, line)
+		if utf8.RuneCountInString(line) > 160 {
+			line = string([]rune(line)[:159]) + "…"
+		}
+		return line
+	}
+	return ""
+}
+
+// Public pages
+
+// publishedSiteKey keys the publishedSite of a request to a custom domain in
+// its context
+type publishedSiteKey struct{}
+
+// publishedSite is where public pages are served: under /p on the server's
+// own host, listing the notes of every workspace, or at the root of a
+// workspace's custom domain, listing only its notes
+type publishedSite struct {
+	workspaceID string
+	domain      bool
+}
+
+// publishedSiteOf returns the site a request is for
+func publishedSiteOf(c *gin.Context) *publishedSite {
+	if site, ok := c.Request.Context().Value(publishedSiteKey{}).(*publishedSite); ok {
+		return site
+	}
+	return &publishedSite{}
+}
+
+// base is the path the site's pages are under
+func (site *publishedSite) base() string {
+	if site.domain {
+		return ""
+	}
+	return publishPrefix
+}
+
+// path is where a published note is on the site
+func (site *publishedSite) path(p *Publication) string {
+	return site.base() + "/" + url.PathEscape(p.Slug)
+}
+
+// publicationURL is the canonical URL of a published note: on its
+// workspace's custom domain when it has one
+func (s *Server) publicationURL(c *gin.Context, p *Publication) string {
+	if p.Domain != "" {
+		return s.siteOrigin(c, p.Domain) + "/" + url.PathEscape(p.Slug)
+	}
+	return requestOrigin(c) + p.Path
+}
+
+// publishedBrand returns a workspace's site settings, or nil when it has
+// none
+func (s *Server) publishedBrand(ctx context.Context, workspaceID string) *WorkspaceSite {
+	if workspaceID == "" {
+		return nil
+	}
+	brand, err := s.store.GetWorkspaceSite(ctx, workspaceID)
+	if err != nil {
+		return nil
+	}
+	return brand
+}
+
+type publishedPage struct {
+	Site        string
+	Logo        string
+	Home        string
+	Feed        string
+	CSS         template.CSS
+	Language    string
+	Title       string
+	Description string
+	URL         string
+	Date        string
+	Content     template.HTML
+	Notes       []publishedIndexEntry
+}
+
+type publishedIndexEntry struct {
+	Title string
+	Path  string
+	Date  string
+}
+
+var publishedTemplate = template.Must(template.New("published").Parse(`<!DOCTYPE html>
+<html{{if .Language}} lang="{{.Language}}"{{end}}>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Title}}{{.Title}} · {{end}}{{.Site}}</title>
+{{if .Description}}<meta name="description" content="{{.Description}}">
+{{end}}<link rel="canonical" href="{{.URL}}">
+<link rel="alternate" type="application/rss+xml" title="{{.Site}}" href="{{.Feed}}">
+<style>{{.CSS}}</style>
+</head>
+<body>
+<header><a href="{{.Home}}">{{if .Logo}}<img class="logo" src="{{.Logo}}" alt="">{{end}}{{.Site}}</a></header>
+<main>
+{{if .Title}}<article>
+<h1>{{.Title}}</h1>
+<p class="date">{{.Date}}</p>
+{{.Content}}</article>
+{{else}}<ul class="index">
+{{range .Notes}}<li><a href="{{.Path}}">{{.Title}}</a> <span class="date">{{.Date}}</span></li>
+{{else}}<li>Nothing has been published yet.</li>
+{{end}}</ul>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// siteTitle is the title of a site's pages and feed
+func (s *Server) siteTitle(brand *WorkspaceSite) string {
+	if brand != nil && brand.Title != "" {
+		return brand.Title
+	}
+	return s.cfg.PublishTitle
+}
+
+// renderPublished writes a public page in a theme, with the colors, fonts,
+// logo and title of the workspace's brand over it
+func (s *Server) renderPublished(c *gin.Context, theme string, brand *WorkspaceSite, page publishedPage) {
+	css, ok := publishThemes[theme]
+	if !ok {
+		css = publishThemes[s.cfg.PublishTheme]
+	}
+	css += publishBaseCSS
+	if brand != nil {
+		page.Logo = brand.LogoURL
+		css += brand.css()
+	}
+	site := publishedSiteOf(c)
+	page.Site = s.siteTitle(brand)
+	page.Home = requestBasePath(c) + site.base() + "/"
+	page.Feed = requestOrigin(c) + site.base() + "/feed.xml"
+	page.CSS = template.CSS(css)
+
+	var sb strings.Builder
+	if err := publishedTemplate.Execute(&sb, page); err != nil {
+		golog.Errorf("failed to render published page %s: %v", c.Request.URL.Path, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to render the page"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(sb.String()))
+}
+
+// handlePublishedIndex lists the site's newest published notes
+func (s *Server) handlePublishedIndex(c *gin.Context) {
+	ctx := c.Request.Context()
+	site := publishedSiteOf(c)
+
+	publications, err := s.store.ListPublications(ctx, site.workspaceID, true, publishIndexSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list published notes"})
+		return
+	}
+
+	page := publishedPage{URL: requestOrigin(c) + site.base() + "/", Notes: []publishedIndexEntry{}}
+	for i := range publications {
+		p := &publications[i]
+		page.Notes = append(page.Notes, publishedIndexEntry{Title: p.Title, Path: requestBasePath(c) + site.path(p), Date: formatDate(p.Language, p.PublishedAt)})
+	}
+	s.renderPublished(c, s.cfg.PublishTheme, s.publishedBrand(ctx, site.workspaceID), page)
+}
+
+// handlePublishedNote serves a published note as a page
+func (s *Server) handlePublishedNote(c *gin.Context) {
+	ctx := c.Request.Context()
+	site := publishedSiteOf(c)
+
+	p, err := s.store.GetPublicationBySlug(ctx, c.Param("slug"))
+	if err == nil && site.domain && p.WorkspaceID != site.workspaceID {
+		err = notFoundError("published note")
+	}
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load the note")
+		return
+	}
+	note, err := s.store.GetNote(ctx, p.NoteID)
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load the note")
+		return
+	}
+
+	body := publishedBody(note.Title, note.Content)
+	s.renderPublished(c, p.Theme, s.publishedBrand(ctx, p.WorkspaceID), publishedPage{
+		Language:    p.Language,
+		Title:       note.Title,
+		Description: publishedExcerpt(body),
+		URL:         s.publicationURL(c, p),
+		Date:        formatDate(p.Language, p.PublishedAt),
+		Content:     renderMarkdown(body),
+	})
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+// handlePublishedFeed serves the site's newest published notes as an RSS
+// feed
+func (s *Server) handlePublishedFeed(c *gin.Context) {
+	ctx := c.Request.Context()
+	site := publishedSiteOf(c)
+
+	publications, err := s.store.ListPublications(ctx, site.workspaceID, true, publishFeedSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list published notes"})
+		return
+	}
+
+	origin := requestOrigin(c)
+	title := s.siteTitle(s.publishedBrand(ctx, site.workspaceID))
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       title,
+		Link:        origin + site.base() + "/",
+		Description: "Notes published on " + title,
+		Items:       []rssItem{},
+	}}
+	for i := range publications {
+		p := &publications[i]
+		note, err := s.store.GetNote(ctx, p.NoteID)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			feed.Channel.LastBuildDate = p.PublishedAt.UTC().Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       note.Title,
+			Link:        origin + site.path(p),
+			GUID:        origin + site.path(p),
+			PubDate:     p.PublishedAt.UTC().Format(time.RFC1123Z),
+			Description: string(renderMarkdown(publishedBody(note.Title, note.Content))),
+		})
+	}
+
+	s.writePublishedXML(c, "application/rss+xml; charset=utf-8", feed)
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// handlePublishedSitemap lists the site's index and published notes for
+// search engines
+func (s *Server) handlePublishedSitemap(c *gin.Context) {
+	site := publishedSiteOf(c)
+
+	publications, err := s.store.ListPublications(c.Request.Context(), site.workspaceID, true, maxSitemapURLs-1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list published notes"})
+		return
+	}
+
+	origin := requestOrigin(c)
+	sitemap := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	sitemap.URLs = append(sitemap.URLs, sitemapURL{Loc: origin + site.base() + "/"})
+	for i := range publications {
+		p := &publications[i]
+		sitemap.URLs = append(sitemap.URLs, sitemapURL{Loc: origin + site.path(p), LastMod: p.UpdatedAt.UTC().Format("2006-01-02")})
+	}
+
+	s.writePublishedXML(c, "application/xml; charset=utf-8", sitemap)
+}
+
+func (s *Server) writePublishedXML(c *gin.Context, contentType string, v interface{}) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to render the feed"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), data...))
+}
+
+// Publishing handlers
+
+// notebookNote loads the :noteId note and checks it belongs to :id
+func (s *Server) notebookNote(c *gin.Context) (*Note, bool) {
+	note, err := s.store.GetNote(c.Request.Context(), c.Param("noteId"))
+	if err != nil || note.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found"})
+		return nil, false
+	}
+	return note, true
+}
+
+func (s *Server) handleListPublications(c *gin.Context) {
+	publications, err := s.store.ListPublications(c.Request.Context(), currentWorkspace(c).ID, false, maxSitemapURLs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list published notes"})
+		return
+	}
+
+	for i := range publications {
+		publications[i].URL = s.publicationURL(c, &publications[i])
+	}
+	c.JSON(http.StatusOK, publications)
+}
+
+func (s *Server) handleGetPublication(c *gin.Context) {
+	note, ok := s.notebookNote(c)
+	if !ok {
+		return
+	}
+
+	p, err := s.store.GetPublication(c.Request.Context(), note.ID)
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load the publication")
+		return
+	}
+	p.URL = s.publicationURL(c, p)
+	c.JSON(http.StatusOK, p)
+}
+
+// handlePublishNote publishes a note, or changes how it is published. The
+// slug defaults to the one the note has, or one made from its title.
+func (s *Server) handlePublishNote(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	note, ok := s.notebookNote(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Slug  string `json:"slug"`
+		Theme string `json:"theme"`
+	}
+	if c.Request.ContentLength != 0 && !bindJSON(c, &req) {
+		return
+	}
+
+	existing, err := s.store.GetPublication(ctx, note.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		storeErrorResponse(c, err, "Failed to load the publication")
+		return
+	}
+
+	var fields fieldErrors
+	slug := strings.TrimSpace(req.Slug)
+	switch {
+	case slug != "":
+		if slug != slugify(slug) || utf8.RuneCountInString(slug) > maxSlugLength {
+			fields.add("slug", "must be at most %d lowercase letters and digits, separated by single hyphens", maxSlugLength)
+		}
+	case existing != nil:
+		slug = existing.Slug
+	default:
+		if slug, err = s.store.freeSlug(ctx, slugify(note.Title), note.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to publish the note"})
+			return
+		}
+	}
+	theme := req.Theme
+	switch {
+	case theme != "":
+		if _, ok := publishThemes[theme]; !ok {
+			fields.add("theme", "must be one of %s", publishThemeNames())
+		}
+	case existing != nil:
+		theme = existing.Theme
+	default:
+		theme = s.cfg.PublishTheme
+	}
+	if err := fields.err(); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	p, err := s.store.PublishNote(ctx, note.ID, slug, theme)
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to publish the note")
+		return
+	}
+	p.URL = s.publicationURL(c, p)
+	c.JSON(http.StatusOK, p)
+}
+
+func (s *Server) handleUnpublishNote(c *gin.Context) {
+	note, ok := s.notebookNote(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.UnpublishNote(c.Request.Context(), note.ID); err != nil {
+		storeErrorResponse(c, err, "Failed to unpublish the note")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,583 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// Push providers a device can be registered with
+const (
+	PushAPNs = "apns" // Apple Push Notification service, for iOS apps
+	PushFCM  = "fcm"  // Firebase Cloud Messaging, for Android apps
+)
+
+const (
+	// pushTimeout bounds sending one push notification
+	pushTimeout = 15 * time.Second
+	// maxPushTokenLength bounds the device tokens clients register
+	maxPushTokenLength = 4096
+	// apnsTokenLifetime is how long an APNs provider token is used. Apple
+	// refuses tokens older than an hour, and ones renewed more often than
+	// every 20 minutes.
+	apnsTokenLifetime = 50 * time.Minute
+	// fcmScope is the OAuth scope for sending with FCM
+	fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// errPushTokenInvalid is returned by a PushSender when the provider no
+// longer accepts a device token, e.g. because the app was uninstalled
+var errPushTokenInvalid = errors.New("device token is no longer valid")
+
+// PushMessage is a notification as a device shows it
+type PushMessage struct {
+	Title string
+	Body  string
+	// Badge is the number shown on the app icon: the unread notifications
+	Badge int
+	// Data is passed to the app along with the notification
+	Data map[string]string
+}
+
+// PushSender sends push notifications through one provider
+type PushSender interface {
+	// Push sends msg to the device with the token. It returns
+	// errPushTokenInvalid when the provider says the token is gone.
+	Push(ctx context.Context, token string, msg PushMessage) error
+}
+
+// newPushSenders returns a sender for each provider that is configured
+func newPushSenders(cfg Config) (map[string]PushSender, error) {
+	senders := make(map[string]PushSender)
+	if cfg.APNSKeyFile != "" {
+		sender, err := newAPNSSender(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("APNs: %w", err)
+		}
+		senders[PushAPNs] = sender
+	}
+	if cfg.FCMCredentialsFile != "" {
+		sender, err := newFCMSender(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("FCM: %w", err)
+		}
+		senders[PushFCM] = sender
+	}
+	return senders, nil
+}
+
+// readPEMKey reads the private key in a PEM file or string
+func readPEMKey(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// signJWT returns a signed JSON Web Token; sign signs the SHA-256 digest of
+// its header and claims
+func signJWT(header, claims map[string]interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// apnsSender sends through APNs, signing in with a token-based auth key
+type apnsSender struct {
+	url    string
+	keyID  string
+	teamID string
+	topic  string
+	key    *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+func newAPNSSender(cfg Config) (*apnsSender, error) {
+	data, err := os.ReadFile(cfg.APNSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := readPEMKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.APNSKeyFile, err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECDSA key", cfg.APNSKeyFile)
+	}
+	return &apnsSender{
+		url:    strings.TrimRight(cfg.APNSURL, "/"),
+		keyID:  cfg.APNSKeyID,
+		teamID: cfg.APNSTeamID,
+		topic:  cfg.APNSTopic,
+		key:    key,
+	}, nil
+}
+
+// providerToken returns the signed token APNs requests carry, renewing it
+// when it is old
+func (a *apnsSender) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.issued) < apnsTokenLifetime {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	token, err := signJWT(
+		map[string]interface{}{"alg": "ES256", "kid": a.keyID},
+		map[string]interface{}{"iss": a.teamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, a.key, digest)
+			if err != nil {
+				return nil, err
+			}
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+		})
+	if err != nil {
+		return "", err
+	}
+	a.token, a.issued = token, now
+	return token, nil
+}
+
+func (a *apnsSender) Push(ctx context.Context, token string, msg PushMessage) error {
+	providerToken, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": msg.Title, "body": msg.Body},
+			"badge": msg.Badge,
+			"sound": "default",
+		},
+	}
+	for k, v := range msg.Data {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url+"/3/device/"+url.PathEscape(token), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var problem struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&problem)
+	if resp.StatusCode == http.StatusGone || problem.Reason == "BadDeviceToken" || problem.Reason == "DeviceTokenNotForTopic" {
+		return errPushTokenInvalid
+	}
+	return fmt.Errorf("APNs returned status %d: %s", resp.StatusCode, problem.Reason)
+}
+
+// fcmSender sends through the FCM HTTP v1 API, signing in as a service
+// account
+type fcmSender struct {
+	url         string
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+func newFCMSender(cfg Config) (*fcmSender, error) {
+	data, err := os.ReadFile(cfg.FCMCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var account struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.FCMCredentialsFile, err)
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a service account key file", cfg.FCMCredentialsFile)
+	}
+	parsed, err := readPEMKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.FCMCredentialsFile, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an RSA key", cfg.FCMCredentialsFile)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &fcmSender{
+		url:         strings.TrimRight(cfg.FCMURL, "/"),
+		projectID:   account.ProjectID,
+		clientEmail: account.ClientEmail,
+		tokenURI:    account.TokenURI,
+		key:         key,
+	}, nil
+}
+
+// token returns an OAuth access token for the service account, getting a
+// new one shortly before the last expires
+func (f *fcmSender) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessToken != "" && time.Now().Before(f.expires) {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(
+		map[string]interface{}{"alg": "RS256", "typ": "JWT"},
+		map[string]interface{}{
+			"iss":   f.clientEmail,
+			"scope": fcmScope,
+			"aud":   f.tokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest)
+		})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result); err != nil || resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("signing in to FCM failed with status %d", resp.StatusCode)
+	}
+	f.accessToken = result.AccessToken
+	f.expires = now.Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
+
+func (f *fcmSender) Push(ctx context.Context, token string, msg PushMessage) error {
+	accessToken, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": msg.Title, "body": msg.Body},
+			"data":         msg.Data,
+			"android": map[string]interface{}{
+				"notification": map[string]interface{}{"notification_count": msg.Badge},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/messages:send", f.url, url.PathEscape(f.projectID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	problem, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode == http.StatusNotFound || bytes.Contains(problem, []byte("UNREGISTERED")) {
+		return errPushTokenInvalid
+	}
+	return fmt.Errorf("FCM returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(problem)))
+}
+
+// PushDevice is a phone or tablet that gets a user's notifications
+type PushDevice struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"` // "" for callers without a token
+	Provider  string    `json:"provider"`
+	Token     string    `json:"token"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func scanPushDevice(row rowScanner) (*PushDevice, error) {
+	var d PushDevice
+	var createdAt, updatedAt int64
+	if err := row.Scan(&d.ID, &d.UserID, &d.Provider, &d.Token, &d.Name, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	d.CreatedAt = time.Unix(createdAt, 0)
+	d.UpdatedAt = time.Unix(updatedAt, 0)
+	return &d, nil
+}
+
+// Push device operations
+
+// RegisterPushDevice stores a device, or updates the one with the same
+// token, which then belongs to the user registering it
+func (s *Store) RegisterPushDevice(ctx context.Context, d *PushDevice) error {
+	now := time.Now().Unix()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO push_devices (id, user_id, provider, token, name, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (provider, token) DO UPDATE SET user_id = excluded.user_id, name = excluded.name, updated_at = excluded.updated_at
+	`, uuid.New().String(), d.UserID, d.Provider, d.Token, d.Name, now, now)
+	if err != nil {
+		return err
+	}
+
+	registered, err := scanPushDevice(s.db.QueryRowContext(ctx, `
+		SELECT id, user_id, provider, token, name, created_at, updated_at
+		FROM push_devices WHERE provider = ? AND token = ?
+	`, d.Provider, d.Token))
+	if err != nil {
+		return err
+	}
+	*d = *registered
+	return nil
+}
+
+// ListPushDevices retrieves a user's devices
+func (s *Store) ListPushDevices(ctx context.Context, userID string) ([]PushDevice, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, provider, token, name, created_at, updated_at
+		FROM push_devices WHERE user_id = ? ORDER BY created_at, id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]PushDevice, 0)
+	for rows.Next() {
+		d, err := scanPushDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *d)
+	}
+	return devices, rows.Err()
+}
+
+// DeletePushDevice deletes one of a user's devices
+func (s *Store) DeletePushDevice(ctx context.Context, userID, id string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM push_devices WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// forgetPushDevice deletes a device whose token the provider no longer takes
+func (s *Store) forgetPushDevice(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM push_devices WHERE id = ?`, id)
+	return err
+}
+
+// pushNotification sends a new notification to the user's devices in the
+// background. Devices whose token was rejected are forgotten.
+func (s *Server) pushNotification(userID string, n Notification) {
+	if len(s.push) == 0 {
+		return
+	}
+	s.runJob(func() {
+		ctx := context.Background()
+		devices, err := s.store.ListPushDevices(ctx, userID)
+		if err != nil {
+			golog.Warnf("failed to list push devices of user %q: %v", userID, err)
+			return
+		}
+		if len(devices) == 0 {
+			return
+		}
+		unread, _ := s.store.CountUnreadNotifications(ctx, userID)
+		msg := PushMessage{
+			Title: n.Title,
+			Body:  n.Body,
+			Badge: unread,
+			Data:  map[string]string{"notification_id": n.ID, "kind": n.Kind, "link": n.Link},
+		}
+
+		for _, d := range devices {
+			sender := s.push[d.Provider]
+			if sender == nil {
+				continue
+			}
+			err := sender.Push(ctx, d.Token, msg)
+			switch {
+			case errors.Is(err, errPushTokenInvalid):
+				golog.Infof("forgetting %s device %s: %v", d.Provider, d.ID, err)
+				if err := s.store.forgetPushDevice(ctx, d.ID); err != nil {
+					golog.Warnf("failed to delete push device %s: %v", d.ID, err)
+				}
+			case err != nil:
+				golog.Warnf("failed to push %s notification %s to device %s: %v", n.Kind, n.ID, d.ID, err)
+			}
+		}
+	})
+}
+
+// Push device handlers
+
+func (s *Server) handleListPushDevices(c *gin.Context) {
+	devices, err := s.store.ListPushDevices(c.Request.Context(), settingsOwner(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list devices"})
+		return
+	}
+	c.JSON(http.StatusOK, devices)
+}
+
+// handleRegisterPushDevice registers the caller's device for push
+// notifications. Apps register again whenever the provider hands them a
+// token, which updates the device.
+func (s *Server) handleRegisterPushDevice(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Provider string `json:"provider"`
+		Token    string `json:"token"`
+		Name     string `json:"name" binding:"max=100"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	var fields fieldErrors
+	switch req.Provider {
+	case PushAPNs, PushFCM:
+		if s.push[req.Provider] == nil {
+			fields.add("provider", "%s is not configured on this server", req.Provider)
+		}
+	default:
+		fields.add("provider", "must be one of %s, %s", PushAPNs, PushFCM)
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" {
+		fields.add("token", "is required")
+	} else if len(req.Token) > maxPushTokenLength {
+		fields.add("token", "must be at most %d characters", maxPushTokenLength)
+	}
+	if err := fields.err(); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	d := PushDevice{UserID: settingsOwner(c), Provider: req.Provider, Token: req.Token, Name: strings.TrimSpace(req.Name)}
+	if err := s.store.RegisterPushDevice(ctx, &d); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to register device"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, d)
+}
+
+func (s *Server) handleDeletePushDevice(c *gin.Context) {
+	deleted, err := s.store.DeletePushDevice(c.Request.Context(), settingsOwner(c), c.Param("deviceId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete device"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Device not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"math"
+)
+
+// Vector quantization settings for VECTOR_QUANTIZATION
+const (
+	quantizationNone = "none"
+	quantizationInt8 = "int8"
+	quantizationPQ   = "pq"
+)
+
+// pqCentroids is the number of centroids per product-quantization
+// subvector, so each code fits in a byte
+const pqCentroids = 256
+
+// pqIterations is how many k-means rounds train a codebook
+const pqIterations = 12
+
+// vector is a stored chunk embedding. Quantized vectors trade some ranking
+// accuracy for a smaller footprint: int8 is a quarter of the size of
+// float32, product quantization a byte per PQ_SUBVECTOR_DIMS dimensions.
+type vector interface {
+	// similarity is the cosine similarity with an unquantized query
+	similarity(query []float32) float64
+	dim() int
+	// floats returns the (approximate) original values in a new slice
+	floats() []float32
+}
+
+// float32Vector is an unquantized embedding
+type float32Vector []float32
+
+func (v float32Vector) similarity(query []float32) float64 {
+	return cosineSimilarity(query, v)
+}
+
+func (v float32Vector) dim() int { return len(v) }
+
+func (v float32Vector) floats() []float32 { return append([]float32(nil), v...) }
+
+// int8Vector stores each value as a multiple of scale, the largest
+// magnitude divided by 127
+type int8Vector struct {
+	values []int8
+	scale  float32
+}
+
+func quantizeInt8(v []float32) int8Vector {
+	var maxAbs float32
+	for _, f := range v {
+		maxAbs = max(maxAbs, float32(math.Abs(float64(f))))
+	}
+	q := int8Vector{values: make([]int8, len(v)), scale: maxAbs / 127}
+	if q.scale == 0 {
+		return q
+	}
+	for i, f := range v {
+		q.values[i] = int8(math.Round(float64(f / q.scale)))
+	}
+	return q
+}
+
+func (v int8Vector) similarity(query []float32) float64 {
+	if len(query) != len(v.values) {
+		return 0
+	}
+	// The scale is common to every value, so it cancels out of the cosine
+	var dot, normQ, normV float64
+	for i, q := range v.values {
+		dot += float64(query[i]) * float64(q)
+		normQ += float64(query[i]) * float64(query[i])
+		normV += float64(q) * float64(q)
+	}
+	if normQ == 0 || normV == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normQ) * math.Sqrt(normV))
+}
+
+func (v int8Vector) dim() int { return len(v.values) }
+
+func (v int8Vector) floats() []float32 {
+	f := make([]float32, len(v.values))
+	for i, q := range v.values {
+		f[i] = float32(q) * v.scale
+	}
+	return f
+}
+
+// pqCodebook splits vectors into subvectors of subDims dimensions (the last
+// may be shorter) and holds the centroids each subvector is coded against
+type pqCodebook struct {
+	dims    int
+	subDims int
+	// centroids[s] holds the centroids of subvector s one after another
+	centroids [][]float32
+}
+
+// pqVector stores one centroid number per subvector
+type pqVector struct {
+	codes []byte
+	book  *pqCodebook
+}
+
+func (v pqVector) similarity(query []float32) float64 {
+	return cosineSimilarity(query, v.floats())
+}
+
+func (v pqVector) dim() int { return v.book.dims }
+
+func (v pqVector) floats() []float32 {
+	f := make([]float32, 0, v.book.dims)
+	for s, code := range v.codes {
+		f = append(f, v.book.centroid(s, int(code))...)
+	}
+	return f
+}
+
+// subvectors is how many subvectors a vector is split into
+func (b *pqCodebook) subvectors() int {
+	return (b.dims + b.subDims - 1) / b.subDims
+}
+
+// bounds returns where subvector s starts and ends
+func (b *pqCodebook) bounds(s int) (int, int) {
+	return s * b.subDims, min((s+1)*b.subDims, b.dims)
+}
+
+// size returns how many centroids each subvector has
+func (b *pqCodebook) size() int {
+	start, end := b.bounds(0)
+	return len(b.centroids[0]) / (end - start)
+}
+
+func (b *pqCodebook) centroid(s, code int) []float32 {
+	start, end := b.bounds(s)
+	n := end - start
+	return b.centroids[s][code*n : (code+1)*n]
+}
+
+// trainPQ builds a codebook for vectors of dims dimensions with k-means on
+// each subvector. With fewer than pqCentroids vectors every vector gets its
+// own centroid, so the codes are exact.
+func trainPQ(vectors [][]float32, dims, subDims int) *pqCodebook {
+	if subDims <= 0 || subDims > dims {
+		subDims = dims
+	}
+	book := &pqCodebook{dims: dims, subDims: subDims}
+	k := min(pqCentroids, len(vectors))
+
+	for s := 0; s < book.subvectors(); s++ {
+		start, end := book.bounds(s)
+		n := end - start
+
+		// Start from vectors spread evenly through the input
+		centroids := make([]float32, k*n)
+		for c := 0; c < k; c++ {
+			copy(centroids[c*n:], vectors[c*len(vectors)/k][start:end])
+		}
+
+		assigned := make([]int, len(vectors))
+		for iter := 0; iter < pqIterations; iter++ {
+			changed := false
+			for i, v := range vectors {
+				c := nearestCentroid(centroids, n, v[start:end])
+				if c != assigned[i] || iter == 0 {
+					changed = true
+				}
+				assigned[i] = c
+			}
+			if !changed {
+				break
+			}
+
+			sums := make([]float64, k*n)
+			counts := make([]int, k)
+			for i, v := range vectors {
+				c := assigned[i]
+				counts[c]++
+				for j, f := range v[start:end] {
+					sums[c*n+j] += float64(f)
+				}
+			}
+			for c := 0; c < k; c++ {
+				// An empty cluster keeps its centroid
+				if counts[c] == 0 {
+					continue
+				}
+				for j := 0; j < n; j++ {
+					centroids[c*n+j] = float32(sums[c*n+j] / float64(counts[c]))
+				}
+			}
+		}
+		book.centroids = append(book.centroids, centroids)
+	}
+	return book
+}
+
+// encode returns the code of each subvector of v
+func (b *pqCodebook) encode(v []float32) []byte {
+	codes := make([]byte, b.subvectors())
+	for s := range codes {
+		start, end := b.bounds(s)
+		codes[s] = byte(nearestCentroid(b.centroids[s], end-start, v[start:end]))
+	}
+	return codes
+}
+
+// nearestCentroid returns the centroid of n dimensions closest to v
+func nearestCentroid(centroids []float32, n int, v []float32) int {
+	best, bestDist := 0, math.Inf(1)
+	for c := 0; c*n < len(centroids); c++ {
+		var dist float64
+		for j, f := range v {
+			d := float64(f - centroids[c*n+j])
+			dist += d * d
+		}
+		if dist < bestDist {
+			best, bestDist = c, dist
+		}
+	}
+	return best
+}
+
+// quantize stores a freshly embedded vector as configured. Product
+// quantization needs a codebook trained on the whole notebook, so those
+// vectors stay float32 in memory until the notebook's index is saved and
+// loaded again.
+func (vs *VectorStore) quantize(v []float32) vector {
+	if vs.cfg.VectorQuantization == quantizationInt8 {
+		return quantizeInt8(v)
+	}
+	return float32Vector(v)
+}
@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StorageUsage is how much a workspace or user stores, in bytes and rows
+type StorageUsage struct {
+	SourceBytes     int64 `json:"source_bytes"`
+	AttachmentBytes int64 `json:"attachment_bytes"`
+	NoteBytes       int64 `json:"note_bytes"`
+	ChatBytes       int64 `json:"chat_bytes"`
+	TotalBytes      int64 `json:"total_bytes"`
+
+	Notebooks    int `json:"notebooks"`
+	Sources      int `json:"sources"`
+	Notes        int `json:"notes"`
+	Attachments  int `json:"attachments"`
+	ChatMessages int `json:"chat_messages"`
+}
+
+// add accumulates other into u
+func (u *StorageUsage) add(other *StorageUsage) {
+	u.SourceBytes += other.SourceBytes
+	u.AttachmentBytes += other.AttachmentBytes
+	u.NoteBytes += other.NoteBytes
+	u.ChatBytes += other.ChatBytes
+	u.TotalBytes += other.TotalBytes
+	u.Notebooks += other.Notebooks
+	u.Sources += other.Sources
+	u.Notes += other.Notes
+	u.Attachments += other.Attachments
+	u.ChatMessages += other.ChatMessages
+}
+
+// workspaceNotebooks selects the notebooks of the workspace bound to the query
+const workspaceNotebooks = `SELECT id FROM notebooks WHERE workspace_id = ?`
+
+// GetWorkspaceStorageUsage measures what a workspace stores. Sources count their
+// uploaded file and extracted text; notes and chat messages count their content.
+func (s *Store) GetWorkspaceStorageUsage(ctx context.Context, workspaceID string) (*StorageUsage, error) {
+	var u StorageUsage
+
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notebooks WHERE workspace_id = ?`, workspaceID).Scan(&u.Notebooks); err != nil {
+		return nil, err
+	}
+
+	queries := []struct {
+		count *int
+		bytes *int64
+		query string
+	}{
+		{&u.Sources, &u.SourceBytes, `
+			SELECT COUNT(*), COALESCE(SUM(COALESCE(file_size, 0) + LENGTH(CAST(COALESCE(content, '') AS BLOB))), 0)
+			FROM sources WHERE notebook_id IN (` + workspaceNotebooks + `)`},
+		{&u.Attachments, &u.AttachmentBytes, `
+			SELECT COUNT(*), COALESCE(SUM(file_size), 0)
+			FROM attachments WHERE notebook_id IN (` + workspaceNotebooks + `)`},
+		{&u.Notes, &u.NoteBytes, `
+			SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(content AS BLOB))), 0)
+			FROM notes WHERE notebook_id IN (` + workspaceNotebooks + `)`},
+		{&u.ChatMessages, &u.ChatBytes, `
+			SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(m.content AS BLOB))), 0)
+			FROM chat_messages m JOIN chat_sessions cs ON cs.id = m.session_id
+			WHERE cs.notebook_id IN (` + workspaceNotebooks + `)`},
+	}
+	for _, q := range queries {
+		if err := s.db.QueryRowContext(ctx, q.query, workspaceID).Scan(q.count, q.bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	u.TotalBytes = u.SourceBytes + u.AttachmentBytes + u.NoteBytes + u.ChatBytes
+	return &u, nil
+}
+
+// userStorageUsage adds up the storage of every workspace a user owns
+func (s *Server) userStorageUsage(ctx context.Context, userID string) (*StorageUsage, error) {
+	workspaces, err := s.store.ListUserWorkspaces(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	total := &StorageUsage{}
+	for _, ws := range workspaces {
+		if ws.Role != RoleOwner {
+			continue
+		}
+		usage, err := s.store.GetWorkspaceStorageUsage(ctx, ws.ID)
+		if err != nil {
+			return nil, err
+		}
+		total.add(usage)
+	}
+	return total, nil
+}
+
+// workspaceStorageLimit returns a workspace's storage quota in bytes, 0 for unlimited
+func (s *Server) workspaceStorageLimit(ws *Workspace) int64 {
+	mb := ws.MaxStorageMB
+	if mb <= 0 {
+		mb = s.cfg.WorkspaceStorageQuotaMB
+	}
+	return int64(mb) << 20
+}
+
+// userStorageLimit returns the per-user storage quota in bytes, 0 for unlimited
+func (s *Server) userStorageLimit() int64 {
+	return int64(s.cfg.UserStorageQuotaMB) << 20
+}
+
+// checkStorageQuota fails when storing adding more bytes in a notebook would
+// exceed its workspace's quota or the quota of any of the workspace's owners.
+// Open workspaces have no owners, so only the workspace quota applies to them.
+func (s *Server) checkStorageQuota(ctx context.Context, notebookID string, adding int64) error {
+	if adding <= 0 {
+		return nil
+	}
+	ws, err := s.notebookWorkspace(ctx, notebookID)
+	if err != nil {
+		return nil
+	}
+
+	if limit := s.workspaceStorageLimit(ws); limit > 0 {
+		usage, err := s.store.GetWorkspaceStorageUsage(ctx, ws.ID)
+		if err != nil {
+			return err
+		}
+		if usage.TotalBytes+adding > limit {
+			return &QuotaError{Scope: "workspace", Resource: "storage", Limit: limit, Used: usage.TotalBytes, Requested: adding}
+		}
+	}
+
+	if limit := s.userStorageLimit(); limit > 0 {
+		members, err := s.store.ListWorkspaceMembers(ctx, ws.ID)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if m.Role != RoleOwner {
+				continue
+			}
+			usage, err := s.userStorageUsage(ctx, m.UserID)
+			if err != nil {
+				return err
+			}
+			if usage.TotalBytes+adding > limit {
+				return &QuotaError{Scope: "user", Resource: "storage", Limit: limit, Used: usage.TotalBytes, Requested: adding}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sourceStorageSize is how many bytes a source adds to storage usage
+func sourceStorageSize(source *Source) int64 {
+	return source.FileSize + int64(len(source.Content))
+}
+
+// formatBytes renders a byte count for messages, such as "1.5 MB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// storageReport is the usage and quota of a workspace or user
+type storageReport struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name,omitempty"`
+	Usage      *StorageUsage `json:"usage"`
+	LimitBytes int64         `json:"limit_bytes"` // 0 means unlimited
+}
+
+// handleGetAccountUsage reports storage usage and quotas for the request's
+// workspace and, when signed in, for the caller across the workspaces they own
+func (s *Server) handleGetAccountUsage(c *gin.Context) {
+	ctx := context.Background()
+
+	ws := currentWorkspace(c)
+	usage, err := s.store.GetWorkspaceStorageUsage(ctx, ws.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to measure storage usage"})
+		return
+	}
+	resp := gin.H{
+		"workspace": storageReport{ID: ws.ID, Name: ws.Name, Usage: usage, LimitBytes: s.workspaceStorageLimit(ws)},
+	}
+
+	if user := currentUser(c); user != nil {
+		usage, err := s.userStorageUsage(ctx, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to measure storage usage"})
+			return
+		}
+		resp["user"] = storageReport{ID: user.ID, Name: user.Name, Usage: usage, LimitBytes: s.userStorageLimit()}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimiter is a per-client token bucket limiter whose limits can change at
+// runtime. A per-minute limit of 0 disables it.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	rl := &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+	rl.SetLimits(perMinute, burst)
+	return rl
+}
+
+// SetLimits changes the limits; existing buckets keep their tokens up to the new burst
+func (rl *rateLimiter) SetLimits(perMinute, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if burst <= 0 {
+		burst = perMinute
+	}
+	rl.perMinute = perMinute
+	rl.burst = burst
+	for _, b := range rl.buckets {
+		b.tokens = math.Min(b.tokens, float64(burst))
+	}
+}
+
+// Allow takes a token for key, or reports how long until one is available
+func (rl *rateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.perMinute <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	rate := float64(rl.perMinute) / 60 // tokens per second
+	rl.sweep(now, rate)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rl.burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// Refund gives back a token taken for key, for a request the client
+// abandoned before it got a response
+func (rl *rateLimiter) Refund(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if b, ok := rl.buckets[key]; ok {
+		b.tokens = math.Min(float64(rl.burst), b.tokens+1)
+	}
+}
+
+// sweep drops buckets that have refilled completely, at most once a minute
+func (rl *rateLimiter) sweep(now time.Time, rate float64) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(rl.burst) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RateLimitMiddleware rejects clients that exceed the configured request rate
+func RateLimitMiddleware(rl *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, wait := rl.Allow(c.ClientIP())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, ErrorResponse{Code: CodeRateLimited, Error: "Rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Kinds of personal data that can be redacted
+const (
+	PIIEmail = "email"
+	PIIPhone = "phone"
+	PIIName  = "name"
+)
+
+// maxPlaceholderLen bounds a placeholder's length, so a stream holds back
+// at most this much while waiting for the rest of one
+const maxPlaceholderLen = 16
+
+var (
+	piiPatterns = map[string]*regexp.Regexp{
+		PIIEmail: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+		// International numbers with a +, North American numbers with
+		// separators and Chinese mobile numbers
+		PIIPhone: regexp.MustCompile(`\+\d{1,3}[\s.-]?\(?\d{1,4}\)?(?:[\s.-]?\d{2,4}){2,4}\b|\(?\b\d{3}\)?[\s.-]\d{3}[\s.-]\d{4}\b|\b1[3-9]\d{9}\b`),
+		// Capitalized names after a title; the title itself is kept
+		PIIName: regexp.MustCompile(`\b(?:Mr|Mrs|Ms|Miss|Dr|Prof)\.?\s+([A-Z][a-z]+(?:[\s-][A-Z][a-z]+)?)`),
+	}
+	// piiPlaceholder matches the placeholders redacted values are replaced with
+	piiPlaceholder = regexp.MustCompile(`\[(EMAIL|PHONE|NAME)_(\d+)\]`)
+)
+
+// piiRedactor masks personal data in text sent to the LLM and embedding
+// providers
+type piiRedactor struct {
+	kinds []string
+	// names are always masked, in addition to those found after titles
+	names *regexp.Regexp
+}
+
+// newPIIRedactor returns the configured redactor, or nil when redaction is
+// off
+func newPIIRedactor(cfg Config) *piiRedactor {
+	if !cfg.RedactPII {
+		return nil
+	}
+	r := &piiRedactor{}
+	for _, kind := range strings.Split(cfg.RedactPIIKinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			r.kinds = append(r.kinds, kind)
+		}
+	}
+	if slices.Contains(r.kinds, PIIName) {
+		r.names = blockedTermsPattern(strings.Split(cfg.RedactPIINames, ","))
+	}
+	return r
+}
+
+// redaction is the mapping between the values masked in one exchange with a
+// provider and their placeholders, so the reply can be unmasked
+type redaction struct {
+	redactor     *piiRedactor
+	placeholders map[string]string // value to placeholder
+	values       map[string]string // placeholder to value
+	counts       map[string]int
+}
+
+func (r *piiRedactor) begin() *redaction {
+	return &redaction{
+		redactor:     r,
+		placeholders: make(map[string]string),
+		values:       make(map[string]string),
+		counts:       make(map[string]int),
+	}
+}
+
+// placeholder returns the placeholder of a value, the same one each time
+// it occurs
+func (rd *redaction) placeholder(kind, value string) string {
+	if p, ok := rd.placeholders[value]; ok {
+		return p
+	}
+	rd.counts[kind]++
+	p := fmt.Sprintf("[%s_%d]", strings.ToUpper(kind), rd.counts[kind])
+	rd.placeholders[value] = p
+	rd.values[p] = value
+	return p
+}
+
+// redact replaces the personal data in text with placeholders
+func (rd *redaction) redact(text string) string {
+	for _, kind := range rd.redactor.kinds {
+		pattern := piiPatterns[kind]
+		if pattern == nil {
+			continue
+		}
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			sub := pattern.FindStringSubmatchIndex(match)
+			if len(sub) < 4 || sub[2] < 0 {
+				return rd.placeholder(kind, match)
+			}
+			return match[:sub[2]] + rd.placeholder(kind, match[sub[2]:sub[3]]) + match[sub[3]:]
+		})
+		if kind == PIIName && rd.redactor.names != nil {
+			text = rd.redactor.names.ReplaceAllStringFunc(text, func(match string) string {
+				return rd.placeholder(kind, match)
+			})
+		}
+	}
+	return text
+}
+
+// restore puts the masked values back in place of their placeholders.
+// Placeholders this exchange did not make are left alone.
+func (rd *redaction) restore(text string) string {
+	if len(rd.values) == 0 {
+		return text
+	}
+	return piiPlaceholder.ReplaceAllStringFunc(text, func(p string) string {
+		if value, ok := rd.values[p]; ok {
+			return value
+		}
+		return p
+	})
+}
+
+// redactMessages returns the messages with the personal data in their text
+// masked; images and other binary parts are sent as they are
+func (rd *redaction) redactMessages(messages []llms.MessageContent) []llms.MessageContent {
+	redacted := make([]llms.MessageContent, len(messages))
+	for i, msg := range messages {
+		parts := make([]llms.ContentPart, len(msg.Parts))
+		for j, part := range msg.Parts {
+			switch p := part.(type) {
+			case llms.TextContent:
+				p.Text = rd.redact(p.Text)
+				parts[j] = p
+			case llms.ToolCall:
+				if p.FunctionCall != nil {
+					call := *p.FunctionCall
+					call.Arguments = rd.redact(call.Arguments)
+					p.FunctionCall = &call
+				}
+				parts[j] = p
+			case llms.ToolCallResponse:
+				p.Content = rd.redact(p.Content)
+				parts[j] = p
+			default:
+				parts[j] = part
+			}
+		}
+		redacted[i] = llms.MessageContent{Role: msg.Role, Parts: parts}
+	}
+	return redacted
+}
+
+// restoreResponse unmasks a provider's reply, including the arguments of
+// the tools it calls
+func (rd *redaction) restoreResponse(resp *llms.ContentResponse) {
+	for _, choice := range resp.Choices {
+		choice.Content = rd.restore(choice.Content)
+		if choice.FuncCall != nil {
+			choice.FuncCall.Arguments = rd.restore(choice.FuncCall.Arguments)
+		}
+		for i := range choice.ToolCalls {
+			if call := choice.ToolCalls[i].FunctionCall; call != nil {
+				call.Arguments = rd.restore(call.Arguments)
+			}
+		}
+	}
+}
+
+// redactingLLM masks personal data in what is sent to an LLM and unmasks
+// the placeholders in its reply, streamed or not
+type redactingLLM struct {
+	llm      llms.Model
+	redactor *piiRedactor
+}
+
+// withRedaction wraps llm with the configured redaction, if any
+func withRedaction(cfg Config, llm llms.Model) llms.Model {
+	if redactor := newPIIRedactor(cfg); redactor != nil {
+		return &redactingLLM{llm: llm, redactor: redactor}
+	}
+	return llm
+}
+
+// GenerateContent implements llms.Model
+func (r *redactingLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	rd := r.redactor.begin()
+	messages = rd.redactMessages(messages)
+
+	var callOpts llms.CallOptions
+	for _, opt := range options {
+		opt(&callOpts)
+	}
+	stream := callOpts.StreamingFunc
+	var pending string
+	if stream != nil {
+		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			// A placeholder split between chunks is held back until it is whole
+			text := pending + string(chunk)
+			pending = ""
+			if i := strings.LastIndexByte(text, '['); i >= 0 && len(text)-i < maxPlaceholderLen && !strings.ContainsRune(text[i:], ']') {
+				text, pending = text[:i], text[i:]
+			}
+			if text == "" {
+				return nil
+			}
+			return stream(ctx, []byte(rd.restore(text)))
+		}))
+	}
+
+	resp, err := r.llm.GenerateContent(ctx, messages, options...)
+	if err != nil {
+		return nil, err
+	}
+	if stream != nil && pending != "" {
+		if err := stream(ctx, []byte(rd.restore(pending))); err != nil {
+			return nil, err
+		}
+	}
+	rd.restoreResponse(resp)
+	return resp, nil
+}
+
+// Call implements llms.Model
+func (r *redactingLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, r, prompt, options...)
+}
+
+// redactTexts masks the personal data in texts to be embedded. The
+// placeholders are the same in every text, so they still compare alike.
+func (r *piiRedactor) redactTexts(texts []string) []string {
+	rd := r.begin()
+	redacted := make([]string, len(texts))
+	for i, text := range texts {
+		redacted[i] = rd.redact(text)
+	}
+	return redacted
+}
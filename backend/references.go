@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Reference target types
+const (
+	RefSource  = "source"
+	RefMessage = "message"
+	RefNote    = "note"
+)
+
+var referenceTypes = map[string]bool{RefSource: true, RefMessage: true, RefNote: true}
+
+// NoteReference is a note's formal reference to a source, a chat message or
+// another note, resolved to the target's title and a stable link
+type NoteReference struct {
+	ID         string    `json:"id"`
+	NoteID     string    `json:"note_id"`
+	TargetType string    `json:"type"` // "source", "message" or "note"
+	TargetID   string    `json:"target_id"`
+	Label      string    `json:"label,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Title      string    `json:"title"`
+	NotebookID string    `json:"notebook_id,omitempty"`
+	Link       string    `json:"link"`
+	Missing    bool      `json:"missing,omitempty"` // The target was deleted
+}
+
+func scanReference(row rowScanner) (*NoteReference, error) {
+	var r NoteReference
+	var createdAt int64
+	if err := row.Scan(&r.ID, &r.NoteID, &r.TargetType, &r.TargetID, &r.Label, &createdAt); err != nil {
+		return nil, err
+	}
+	r.CreatedAt = time.Unix(createdAt, 0)
+	return &r, nil
+}
+
+func (s *Store) queryReferences(ctx context.Context, query string, args ...interface{}) ([]NoteReference, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make([]NoteReference, 0)
+	for rows.Next() {
+		r, err := scanReference(rows)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, *r)
+	}
+	return refs, rows.Err()
+}
+
+// Reference operations
+
+// CreateReference stores a new reference
+func (s *Store) CreateReference(ctx context.Context, r *NoteReference) error {
+	r.ID = uuid.New().String()
+	r.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO note_references (id, note_id, target_type, target_id, label, created_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, r.ID, r.NoteID, r.TargetType, r.TargetID, r.Label, r.CreatedAt.Unix())
+	if isUniqueViolation(err) {
+		return conflictError("the note already references this " + r.TargetType)
+	}
+	return err
+}
+
+// GetReference retrieves a reference by ID
+func (s *Store) GetReference(ctx context.Context, id string) (*NoteReference, error) {
+	r, err := scanReference(s.db.QueryRowContext(ctx, `
+		SELECT id, note_id, target_type, target_id, label, created_at FROM note_references WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("reference")
+	}
+	return r, err
+}
+
+// ListReferences retrieves what a note references, oldest first
+func (s *Store) ListReferences(ctx context.Context, noteID string) ([]NoteReference, error) {
+	return s.queryReferences(ctx, `
+		SELECT id, note_id, target_type, target_id, label, created_at
+		FROM note_references WHERE note_id = ? ORDER BY created_at, id
+	`, noteID)
+}
+
+// ListReferencesTo retrieves the references to a target
+func (s *Store) ListReferencesTo(ctx context.Context, targetType, targetID string) ([]NoteReference, error) {
+	return s.queryReferences(ctx, `
+		SELECT id, note_id, target_type, target_id, label, created_at
+		FROM note_references WHERE target_type = ? AND target_id = ? ORDER BY created_at, id
+	`, targetType, targetID)
+}
+
+// ListNotebookReferences retrieves the references of every note in a notebook
+func (s *Store) ListNotebookReferences(ctx context.Context, notebookID string) ([]NoteReference, error) {
+	return s.queryReferences(ctx, `
+		SELECT r.id, r.note_id, r.target_type, r.target_id, r.label, r.created_at
+		FROM note_references r JOIN notes n ON n.id = r.note_id
+		WHERE n.notebook_id = ? ORDER BY r.created_at, r.id
+	`, notebookID)
+}
+
+// DeleteReference deletes a reference
+func (s *Store) DeleteReference(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM note_references WHERE id = ?`, id)
+	return err
+}
+
+// referenceLink is the stable API link to a reference's target, built from
+// IDs alone so it stays valid when titles change
+func referenceLink(targetType, targetID, notebookID, sessionID string) string {
+	switch targetType {
+	case RefSource:
+		return fmt.Sprintf("/api/notebooks/%s/sources/%s/content", notebookID, targetID)
+	case RefNote:
+		return fmt.Sprintf("/api/notebooks/%s/notes/%s", notebookID, targetID)
+	}
+	return fmt.Sprintf("/api/notebooks/%s/chat/sessions/%s/export#%s", notebookID, sessionID, targetID)
+}
+
+// messageTitle names a chat message by its role and opening words
+func messageTitle(msg *ChatMessage) string {
+	text := strings.Join(strings.Fields(msg.Content), " ")
+	if r := []rune(text); len(r) > 80 {
+		text = string(r[:80]) + "…"
+	}
+	return msg.Role + ": " + text
+}
+
+// referenceTarget finds a target's title, notebook and link. ok is false
+// when the target no longer exists.
+func (s *Server) referenceTarget(ctx context.Context, targetType, targetID string) (title, notebookID, link string, ok bool) {
+	switch targetType {
+	case RefSource:
+		src, err := s.store.GetSource(ctx, targetID)
+		if err != nil {
+			return "", "", "", false
+		}
+		return src.Name, src.NotebookID, referenceLink(RefSource, src.ID, src.NotebookID, ""), true
+	case RefNote:
+		note, err := s.store.GetNote(ctx, targetID)
+		if err != nil {
+			return "", "", "", false
+		}
+		return note.Title, note.NotebookID, referenceLink(RefNote, note.ID, note.NotebookID, ""), true
+	case RefMessage:
+		msg, err := s.store.getChatMessage(ctx, targetID)
+		if err != nil {
+			return "", "", "", false
+		}
+		session, err := s.store.GetChatSession(ctx, msg.SessionID)
+		if err != nil {
+			return "", "", "", false
+		}
+		return messageTitle(msg), session.NotebookID, referenceLink(RefMessage, msg.ID, session.NotebookID, session.ID), true
+	}
+	return "", "", "", false
+}
+
+// resolveReferences fills in each reference's title and link, marking those
+// whose target is gone
+func (s *Server) resolveReferences(ctx context.Context, refs []NoteReference) []NoteReference {
+	for i := range refs {
+		r := &refs[i]
+		title, notebookID, link, ok := s.referenceTarget(ctx, r.TargetType, r.TargetID)
+		if !ok {
+			r.Title, r.Link, r.Missing = r.TargetID, "", true
+			if r.Label != "" {
+				r.Title = r.Label
+			}
+			continue
+		}
+		r.Title, r.NotebookID, r.Link = title, notebookID, link
+	}
+	return refs
+}
+
+// referencesMarkdown is the References section of an exported note. Notes
+// in the same export link to their file; everything else to its stable link.
+func referencesMarkdown(noteID string, refs []NoteReference, noteFiles map[string]string) string {
+	var b strings.Builder
+	for _, r := range refs {
+		if r.NoteID != noteID {
+			continue
+		}
+		if b.Len() == 0 {
+			b.WriteString("## References\n\n")
+		}
+		link := r.Link
+		if file, ok := noteFiles[r.TargetID]; ok && r.TargetType == RefNote {
+			link = file
+		}
+		if r.Missing {
+			fmt.Fprintf(&b, "- %s (%s, deleted)", r.Title, r.TargetType)
+		} else {
+			fmt.Fprintf(&b, "- [%s](%s)", r.Title, link)
+		}
+		if r.Label != "" && r.Label != r.Title {
+			fmt.Fprintf(&b, " — %s", r.Label)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Reference handlers
+
+// handleListReferences lists what a note references and the notes that
+// reference it
+func (s *Server) handleListReferences(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	refs, err := s.store.ListReferences(ctx, note.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list references"})
+		return
+	}
+	incoming, err := s.store.ListReferencesTo(ctx, RefNote, note.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list references"})
+		return
+	}
+
+	// Incoming references point back at the notes they come from
+	backlinks := make([]NoteReference, 0, len(incoming))
+	for _, r := range incoming {
+		r.TargetType, r.TargetID = RefNote, r.NoteID
+		backlinks = append(backlinks, r)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"references":    s.resolveReferences(ctx, refs),
+		"referenced_by": s.resolveReferences(ctx, backlinks),
+	})
+}
+
+// handleCreateReference makes a note reference a source, chat message or
+// note of the same workspace
+func (s *Server) handleCreateReference(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Type  string `json:"type" binding:"required"`
+		ID    string `json:"id" binding:"required,uuid"`
+		Label string `json:"label" binding:"max=200"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !referenceTypes[req.Type] {
+		validationResponse(c, invalidField("type", "must be source, message or note"))
+		return
+	}
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	if req.Type == RefNote && req.ID == note.ID {
+		validationResponse(c, invalidField("id", "a note can't reference itself"))
+		return
+	}
+
+	_, notebookID, _, found := s.referenceTarget(ctx, req.Type, req.ID)
+	if found {
+		nb, err := s.store.GetNotebook(ctx, notebookID)
+		found = err == nil && nb.WorkspaceID == currentWorkspace(c).ID
+	}
+	if !found {
+		validationResponse(c, invalidField("id", "is not a %s in this workspace", req.Type))
+		return
+	}
+
+	ref := &NoteReference{NoteID: note.ID, TargetType: req.Type, TargetID: req.ID, Label: strings.TrimSpace(req.Label)}
+	if err := s.store.CreateReference(ctx, ref); err != nil {
+		storeErrorResponse(c, err, "Failed to create reference")
+		return
+	}
+	c.JSON(http.StatusCreated, s.resolveReferences(ctx, []NoteReference{*ref})[0])
+}
+
+func (s *Server) handleDeleteReference(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	ref, err := s.store.GetReference(ctx, c.Param("referenceId"))
+	if err != nil || ref.NoteID != note.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Reference not found"})
+		return
+	}
+	if err := s.store.DeleteReference(ctx, ref.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete reference"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,511 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Where related items are looked for: the note's notebook, or every notebook
+// of its workspace
+const (
+	RelatedScopeNotebook  = "notebook"
+	RelatedScopeWorkspace = "workspace"
+)
+
+const (
+	// relatedIndexSchedule is how often changed notebooks are reindexed
+	relatedIndexSchedule = "@every 1m"
+	// maxRelated bounds how many related items are returned
+	maxRelated = 50
+	// relatedMinScore leaves out items too far from the note to be worth
+	// suggesting
+	relatedMinScore = 0.2
+	// maxRelatedResults bounds the cache of computed suggestions
+	maxRelatedResults = 1000
+)
+
+// RelatedItem is a source or note similar to a note
+type RelatedItem struct {
+	TopicItem
+	NotebookID string  `json:"notebook_id"`
+	Score      float64 `json:"score"`
+}
+
+// RelatedItems are the sources and notes most similar to a note, most
+// similar first
+type RelatedItems struct {
+	NoteID string        `json:"note_id"`
+	Scope  string        `json:"scope"`
+	Method string        `json:"method"` // topicMethodEmbeddings or topicMethodKeywords
+	Items  []RelatedItem `json:"items"`
+}
+
+// relatedEntry is a source or note in the related index, with what it is
+// compared by. The hash covers its text and how it was compared, so an
+// entry is recomputed when either changes.
+type relatedEntry struct {
+	item       TopicItem
+	notebookID string
+	hash       string
+	terms      []string
+	vector     []float32
+	text       string
+}
+
+// relatedIndex tracks how far the related index has followed the change
+// journal, and caches the suggestions computed from it
+type relatedIndex struct {
+	mu sync.Mutex
+	// cursor is the journal position indexed up to; synced is set after the
+	// first full pass
+	cursor int64
+	synced bool
+	// pending are notebooks whose indexing failed, retried on the next run
+	pending map[string]bool
+	// results are computed suggestions by note and scope, dropped whenever
+	// the index changes
+	results map[string]relatedResult
+}
+
+type relatedResult struct {
+	hash   string
+	method string
+	items  []RelatedItem
+}
+
+// invalidate drops the cached suggestions
+func (r *relatedIndex) invalidate() {
+	r.mu.Lock()
+	r.results = nil
+	r.mu.Unlock()
+}
+
+// Related index store operations
+
+// relatedHashes returns the hashes of a notebook's indexed items by ID
+func (s *Store) relatedHashes(ctx context.Context, notebookID string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT item_id, hash FROM related_index WHERE notebook_id = ?`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// SaveRelatedEntries adds or replaces items in the related index
+func (s *Store) SaveRelatedEntries(ctx context.Context, entries []relatedEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		var vector []byte
+		if e.vector != nil {
+			vector = encodeFloats(e.vector)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO related_index (item_id, kind, notebook_id, title, hash, terms, vector)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(item_id) DO UPDATE SET
+				kind = excluded.kind, notebook_id = excluded.notebook_id, title = excluded.title,
+				hash = excluded.hash, terms = excluded.terms, vector = excluded.vector
+		`, e.item.ID, e.item.Kind, e.notebookID, e.item.Title, e.hash, strings.Join(e.terms, " "), vector); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteRelatedEntries removes items from the related index
+func (s *Store) DeleteRelatedEntries(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM related_index WHERE item_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	return err
+}
+
+// ListRelatedEntries returns the indexed items of the given notebooks
+func (s *Store) ListRelatedEntries(ctx context.Context, notebookIDs []string) ([]relatedEntry, error) {
+	if len(notebookIDs) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(notebookIDs))
+	for i, id := range notebookIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT item_id, kind, notebook_id, title, hash, terms, vector FROM related_index
+		WHERE notebook_id IN (?`+strings.Repeat(", ?", len(notebookIDs)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []relatedEntry
+	for rows.Next() {
+		var e relatedEntry
+		var terms string
+		var vector []byte
+		if err := rows.Scan(&e.item.ID, &e.item.Kind, &e.notebookID, &e.item.Title, &e.hash, &terms, &vector); err != nil {
+			return nil, err
+		}
+		e.terms = strings.Fields(terms)
+		if vector != nil {
+			e.vector = decodeFloats(vector)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// encodeFloats packs a vector little-endian for storage
+func encodeFloats(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
+
+// decodeFloats unpacks a vector packed by encodeFloats
+func decodeFloats(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
+
+// relatedMethod is how items are compared: by embeddings when they are on
+func (s *Server) relatedMethod() string {
+	if s.vectorStore.embedder != nil {
+		return topicMethodEmbeddings
+	}
+	return topicMethodKeywords
+}
+
+// newRelatedEntries turns a notebook's items into index entries, not yet
+// embedded
+func (s *Server) newRelatedEntries(notebookID string, candidates []topicCandidate) []relatedEntry {
+	method := s.relatedMethod()
+	entries := make([]relatedEntry, len(candidates))
+	for i, c := range candidates {
+		sum := sha256.Sum256([]byte(method + "\n" + c.text))
+		entries[i] = relatedEntry{item: c.item, notebookID: notebookID, hash: hex.EncodeToString(sum[:]), terms: c.terms, text: c.text}
+	}
+	return entries
+}
+
+// embedRelatedEntries embeds the entries' text when embeddings are on
+func (s *Server) embedRelatedEntries(ctx context.Context, entries []relatedEntry) error {
+	embedder := s.vectorStore.embedder
+	if embedder == nil || len(entries) == 0 {
+		return nil
+	}
+	texts := make([]string, len(entries))
+	for i := range entries {
+		texts[i] = entries[i].text
+	}
+	vectors, err := topicVectors.embed(ctx, embedder, texts)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].vector = vectors[i]
+	}
+	return nil
+}
+
+// indexRelatedNotebook brings a notebook's entries in the related index up
+// to date, embedding only the items that changed since they were indexed
+func (s *Server) indexRelatedNotebook(ctx context.Context, notebookID string) error {
+	candidates, _, err := s.topicCandidates(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	hashes, err := s.store.relatedHashes(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+
+	var changed []relatedEntry
+	for _, e := range s.newRelatedEntries(notebookID, candidates) {
+		if hashes[e.item.ID] != e.hash {
+			changed = append(changed, e)
+		}
+		delete(hashes, e.item.ID)
+	}
+	// What is left was deleted, or moved to another notebook that indexes it
+	var removed []string
+	for id := range hashes {
+		removed = append(removed, id)
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	if err := s.embedRelatedEntries(ctx, changed); err != nil {
+		return err
+	}
+	if err := s.store.SaveRelatedEntries(ctx, changed); err != nil {
+		return err
+	}
+	if err := s.store.DeleteRelatedEntries(ctx, removed); err != nil {
+		return err
+	}
+	s.related.invalidate()
+	return nil
+}
+
+// updateRelatedIndex reindexes the notebooks the change journal reports
+// changes in, or every notebook on the first run and when the journal was
+// pruned past where the index got to
+func (s *Server) updateRelatedIndex(ctx context.Context) error {
+	latest, oldest, err := s.store.ChangeCursor(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read change journal for related notes: %w", err)
+	}
+
+	s.related.mu.Lock()
+	cursor, synced := s.related.cursor, s.related.synced
+	notebookIDs := make(map[string]bool, len(s.related.pending))
+	for id := range s.related.pending {
+		notebookIDs[id] = true
+	}
+	s.related.mu.Unlock()
+
+	if !synced || cursor < oldest {
+		notebooks, err := s.store.ListNotebooks(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list notebooks for related notes: %w", err)
+		}
+		for _, nb := range notebooks {
+			if nb.Type != NotebookTypeSmart {
+				notebookIDs[nb.ID] = true
+			}
+		}
+	} else if latest > cursor {
+		changed, err := s.store.ListChangedScopes(ctx, cursor, ChangeNote, ChangeSource)
+		if err != nil {
+			return fmt.Errorf("failed to read change journal for related notes: %w", err)
+		}
+		for _, id := range changed {
+			notebookIDs[id] = true
+		}
+	}
+
+	failed := make(map[string]bool)
+	for id := range notebookIDs {
+		select {
+		case <-s.stopping:
+			return nil
+		default:
+		}
+		jobCtx, cancel := withTimeout(ctx, s.cfg.LLMTimeout)
+		err := s.indexRelatedNotebook(jobCtx, id)
+		cancel()
+		if err != nil {
+			golog.Warnf("failed to index notebook %s for related notes, retrying later: %v", id, err)
+			failed[id] = true
+		}
+	}
+
+	s.related.mu.Lock()
+	s.related.cursor, s.related.synced, s.related.pending = latest, true, failed
+	s.related.mu.Unlock()
+	return nil
+}
+
+// relatedWeights weighs each term by how few of the entries use it
+func relatedWeights(entries []relatedEntry) map[string]float64 {
+	use := make(map[string]int)
+	for _, e := range entries {
+		for _, t := range e.terms {
+			use[t]++
+		}
+	}
+	weights := make(map[string]float64, len(use))
+	for t, n := range use {
+		weights[t] = termWeight(len(entries), n)
+	}
+	return weights
+}
+
+// termSimilarity is the cosine similarity of two items' weighted terms
+func termSimilarity(a, b []string, weights map[string]float64) float64 {
+	have := make(map[string]bool, len(a))
+	var normA, normB, shared float64
+	for _, t := range a {
+		have[t] = true
+		normA += weights[t] * weights[t]
+	}
+	for _, t := range b {
+		normB += weights[t] * weights[t]
+		if have[t] {
+			shared += weights[t] * weights[t]
+		}
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return shared / math.Sqrt(normA*normB)
+}
+
+// rankRelated scores entries by their similarity to the note's: mostly by
+// meaning when both are embedded, and by shared words
+func rankRelated(note relatedEntry, entries []relatedEntry) []RelatedItem {
+	weights := relatedWeights(append(entries, note))
+	items := []RelatedItem{}
+	for _, e := range entries {
+		if e.item.ID == note.item.ID {
+			continue
+		}
+		score := termSimilarity(note.terms, e.terms, weights)
+		if note.vector != nil && len(e.vector) == len(note.vector) {
+			score = 0.8*math.Max(cosineSimilarity(note.vector, e.vector), 0) + 0.2*score
+		}
+		if score >= relatedMinScore {
+			items = append(items, RelatedItem{TopicItem: e.item, NotebookID: e.notebookID, Score: math.Round(score*1000) / 1000})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Score > items[j].Score })
+	return items[:min(len(items), maxRelated)]
+}
+
+// relatedNotebooks lists the notebooks a scope covers
+func (s *Server) relatedNotebooks(ctx context.Context, note *Note, scope string, workspaceID string) ([]string, error) {
+	if scope == RelatedScopeNotebook {
+		return []string{note.NotebookID}, nil
+	}
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, nb := range filterWorkspaceNotebooks(notebooks, workspaceID) {
+		if nb.TrashedAt == nil && nb.Type != NotebookTypeSmart {
+			ids = append(ids, nb.ID)
+		}
+	}
+	return ids, nil
+}
+
+// relatedItems finds the sources and notes most similar to a note.
+// Suggestions are cached until the index or the note changes. The note's
+// notebook is reindexed before they are computed, so they follow its edits
+// straight away; other notebooks catch up in the background.
+func (s *Server) relatedItems(ctx context.Context, note *Note, scope, workspaceID string) (*RelatedItems, error) {
+	entry := s.newRelatedEntries(note.NotebookID, []topicCandidate{
+		newTopicCandidate(TopicItem{Kind: TopicItemNote, ID: note.ID, Title: note.Title}, note.Content),
+	})[0]
+	key := note.ID + "|" + scope
+
+	s.related.mu.Lock()
+	cached, ok := s.related.results[key]
+	s.related.mu.Unlock()
+	if ok && cached.hash == entry.hash {
+		return &RelatedItems{NoteID: note.ID, Scope: scope, Method: cached.method, Items: cached.items}, nil
+	}
+
+	if err := s.indexRelatedNotebook(ctx, note.NotebookID); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		golog.Warnf("failed to index notebook %s for related notes: %v", note.NotebookID, err)
+	}
+	notebookIDs, err := s.relatedNotebooks(ctx, note, scope, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.store.ListRelatedEntries(ctx, notebookIDs)
+	if err != nil {
+		return nil, err
+	}
+	// Unless the note could not be indexed, when it is compared by keywords
+	for _, e := range entries {
+		if e.item.ID == note.ID && e.hash == entry.hash {
+			entry = e
+		}
+	}
+
+	result := relatedResult{hash: entry.hash, method: topicMethodKeywords, items: rankRelated(entry, entries)}
+	if entry.vector != nil {
+		result.method = topicMethodEmbeddings
+	}
+	s.related.mu.Lock()
+	if s.related.results == nil || len(s.related.results) >= maxRelatedResults {
+		s.related.results = make(map[string]relatedResult)
+	}
+	s.related.results[key] = result
+	s.related.mu.Unlock()
+	return &RelatedItems{NoteID: note.ID, Scope: scope, Method: result.method, Items: result.items}, nil
+}
+
+// Related note handlers
+
+// handleGetRelated returns the sources and notes most similar to a note, in
+// its notebook or with ?scope=workspace in every notebook of its workspace.
+// ?limit= caps how many are returned, 10 by default.
+func (s *Server) handleGetRelated(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
+
+	scope := c.DefaultQuery("scope", RelatedScopeNotebook)
+	if scope != RelatedScopeNotebook && scope != RelatedScopeWorkspace {
+		validationResponse(c, invalidField("scope", "must be notebook or workspace"))
+		return
+	}
+	limit := 10
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRelated {
+			validationResponse(c, invalidField("limit", "must be between 1 and %d", maxRelated))
+			return
+		}
+		limit = n
+	}
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+
+	related, err := s.relatedItems(ctx, note, scope, currentWorkspace(c).ID)
+	if err != nil {
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to find related notes"})
+		return
+	}
+	related.Items = related.Items[:min(len(related.Items), limit)]
+	c.JSON(http.StatusOK, related)
+}
@@ -0,0 +1,331 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// retentionSchedule is when retention rules are applied
+const retentionSchedule = "@hourly"
+
+// RetentionPolicy is how long content is kept; 0 disables a rule
+type RetentionPolicy struct {
+	ArchiveIdleDays int  `json:"archive_idle_days"`
+	ChatDays        int  `json:"chat_days"`
+	TrashDays       int  `json:"trash_days"`
+	DryRun          bool `json:"dry_run"`
+}
+
+// enabled reports whether any rule is active
+func (p RetentionPolicy) enabled() bool {
+	return p.ArchiveIdleDays > 0 || p.ChatDays > 0 || p.TrashDays > 0
+}
+
+// RetentionItem is something a retention run acted on (or would have)
+type RetentionItem struct {
+	ID         string    `json:"id"`
+	NotebookID string    `json:"notebook_id"`
+	Name       string    `json:"name"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// RetentionReport lists what a retention run changed. In a dry run nothing
+// is changed and the report shows what would have been.
+type RetentionReport struct {
+	DryRun             bool            `json:"dry_run"`
+	StartedAt          time.Time       `json:"started_at"`
+	FinishedAt         time.Time       `json:"finished_at"`
+	ArchivedNotebooks  []RetentionItem `json:"archived_notebooks"`
+	PurgedChatSessions []RetentionItem `json:"purged_chat_sessions"`
+	DeletedNotebooks   []RetentionItem `json:"deleted_notebooks"`
+	Errors             []string        `json:"errors,omitempty"`
+}
+
+// timeOrNil maps an unset (0) unix time to nil
+func timeOrNil(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0)
+	return &t
+}
+
+// Notebook lifecycle operations
+
+// SetNotebookArchived archives a notebook, or unarchives it when at is nil
+func (s *Store) SetNotebookArchived(ctx context.Context, id string, at *time.Time) error {
+	return s.setNotebookTime(ctx, id, "archived_at", at)
+}
+
+// SetNotebookTrashed moves a notebook to the trash, or restores it when at is nil
+func (s *Store) SetNotebookTrashed(ctx context.Context, id string, at *time.Time) error {
+	return s.setNotebookTime(ctx, id, "trashed_at", at)
+}
+
+func (s *Store) setNotebookTime(ctx context.Context, id, column string, at *time.Time) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE notebooks SET `+column+` = ? WHERE id = ?`, unixOrZero(at), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundError("notebook")
+	}
+	return nil
+}
+
+// notebookLastActive is a notebook's most recent change to itself, its
+// sources, notes or chats
+const notebookLastActive = `MAX(n.updated_at,
+	COALESCE((SELECT MAX(updated_at) FROM sources WHERE notebook_id = n.id), 0),
+	COALESCE((SELECT MAX(updated_at) FROM notes WHERE notebook_id = n.id), 0),
+	COALESCE((SELECT MAX(updated_at) FROM chat_sessions WHERE notebook_id = n.id), 0))`
+
+// ListIdleNotebooks returns live notebooks with no activity since before
+func (s *Store) ListIdleNotebooks(ctx context.Context, before time.Time) ([]RetentionItem, error) {
+	return s.listRetentionItems(ctx, `
+		SELECT id, id, name, last_active FROM (
+			SELECT n.id, n.name, `+notebookLastActive+` AS last_active
+			FROM notebooks n WHERE n.archived_at = 0 AND n.trashed_at = 0
+		) WHERE last_active < ? ORDER BY last_active
+	`, before.Unix())
+}
+
+// ListStaleChatSessions returns chat sessions with no messages since before
+func (s *Store) ListStaleChatSessions(ctx context.Context, before time.Time) ([]RetentionItem, error) {
+	return s.listRetentionItems(ctx, `
+		SELECT id, notebook_id, title, updated_at FROM chat_sessions
+		WHERE updated_at < ? ORDER BY updated_at
+	`, before.Unix())
+}
+
+// ListTrashedNotebooks returns notebooks moved to the trash before the given time
+func (s *Store) ListTrashedNotebooks(ctx context.Context, before time.Time) ([]RetentionItem, error) {
+	return s.listRetentionItems(ctx, `
+		SELECT id, id, name, trashed_at FROM notebooks
+		WHERE trashed_at > 0 AND trashed_at < ? ORDER BY trashed_at
+	`, before.Unix())
+}
+
+func (s *Store) listRetentionItems(ctx context.Context, query string, args ...interface{}) ([]RetentionItem, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]RetentionItem, 0)
+	for rows.Next() {
+		var item RetentionItem
+		var lastActive int64
+		if err := rows.Scan(&item.ID, &item.NotebookID, &item.Name, &lastActive); err != nil {
+			return nil, err
+		}
+		item.LastActive = time.Unix(lastActive, 0)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// SetNotebookArchived archives or unarchives a notebook and invalidates cache
+func (cs *CachedStore) SetNotebookArchived(ctx context.Context, id string, at *time.Time) error {
+	if err := cs.Store.SetNotebookArchived(ctx, id, at); err != nil {
+		return err
+	}
+	cs.cache.Delete(notebookKey(id))
+	cs.cache.Delete(notebookListKey())
+	return nil
+}
+
+// SetNotebookTrashed trashes or restores a notebook and invalidates cache
+func (cs *CachedStore) SetNotebookTrashed(ctx context.Context, id string, at *time.Time) error {
+	if err := cs.Store.SetNotebookTrashed(ctx, id, at); err != nil {
+		return err
+	}
+	cs.cache.Delete(notebookKey(id))
+	cs.cache.Delete(notebookListKey())
+	return nil
+}
+
+// Retention job
+
+// retentionPolicy returns the configured retention rules
+func (s *Server) retentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		ArchiveIdleDays: s.cfg.RetentionArchiveIdleDays,
+		ChatDays:        s.cfg.RetentionChatDays,
+		TrashDays:       s.cfg.RetentionTrashDays,
+		DryRun:          s.cfg.RetentionDryRun,
+	}
+}
+
+// runRetention archives idle notebooks, purges old chat sessions and deletes
+// notebooks that have been in the trash too long. Failures on one item are
+// recorded in the report and do not stop the run.
+func (s *Server) runRetention(ctx context.Context, policy RetentionPolicy) *RetentionReport {
+	report := &RetentionReport{
+		DryRun:             policy.DryRun,
+		StartedAt:          time.Now(),
+		ArchivedNotebooks:  []RetentionItem{},
+		PurgedChatSessions: []RetentionItem{},
+		DeletedNotebooks:   []RetentionItem{},
+	}
+	fail := func(format string, args ...any) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+	cutoff := func(days int) time.Time {
+		return report.StartedAt.AddDate(0, 0, -days)
+	}
+
+	if policy.ArchiveIdleDays > 0 {
+		idle, err := s.store.ListIdleNotebooks(ctx, cutoff(policy.ArchiveIdleDays))
+		if err != nil {
+			fail("failed to list idle notebooks: %v", err)
+		}
+		for _, item := range idle {
+			if !policy.DryRun {
+				if err := s.store.SetNotebookArchived(ctx, item.ID, &report.StartedAt); err != nil {
+					fail("failed to archive notebook %s: %v", item.ID, err)
+					continue
+				}
+			}
+			report.ArchivedNotebooks = append(report.ArchivedNotebooks, item)
+		}
+	}
+
+	if policy.ChatDays > 0 {
+		stale, err := s.store.ListStaleChatSessions(ctx, cutoff(policy.ChatDays))
+		if err != nil {
+			fail("failed to list old chat sessions: %v", err)
+		}
+		for _, item := range stale {
+			if !policy.DryRun {
+				if err := s.store.DeleteChatSession(ctx, item.ID); err != nil {
+					fail("failed to delete chat session %s: %v", item.ID, err)
+					continue
+				}
+			}
+			report.PurgedChatSessions = append(report.PurgedChatSessions, item)
+		}
+	}
+
+	if policy.TrashDays > 0 {
+		trashed, err := s.store.ListTrashedNotebooks(ctx, cutoff(policy.TrashDays))
+		if err != nil {
+			fail("failed to list trashed notebooks: %v", err)
+		}
+		for _, item := range trashed {
+			if !policy.DryRun {
+				if err := s.purgeNotebook(ctx, item.ID); err != nil {
+					fail("failed to delete notebook %s: %v", item.ID, err)
+					continue
+				}
+			}
+			report.DeletedNotebooks = append(report.DeletedNotebooks, item)
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	verb := "applied"
+	if report.DryRun {
+		verb = "dry run"
+	}
+	golog.Infof("retention %s: %d notebooks archived, %d chat sessions purged, %d trashed notebooks deleted",
+		verb, len(report.ArchivedNotebooks), len(report.PurgedChatSessions), len(report.DeletedNotebooks))
+
+	s.retentionMu.Lock()
+	s.lastRetention = report
+	s.retentionMu.Unlock()
+
+	return report
+}
+
+// Retention handlers
+
+// handleGetRetention returns the retention policy and the last run's report
+func (s *Server) handleGetRetention(c *gin.Context) {
+	s.retentionMu.Lock()
+	last := s.lastRetention
+	s.retentionMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"policy": s.retentionPolicy(), "last_report": last})
+}
+
+// handleRunRetention applies the retention rules now. With ?dry_run=true it
+// only reports what would change.
+func (s *Server) handleRunRetention(c *gin.Context) {
+	policy := s.retentionPolicy()
+	if v := c.Query("dry_run"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "dry_run must be true or false"})
+			return
+		}
+		policy.DryRun = dryRun
+	}
+	if !policy.enabled() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "No retention rules are configured"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.runRetention(context.Background(), policy))
+}
+
+// Notebook lifecycle handlers
+
+func (s *Server) handleArchiveNotebook(c *gin.Context) {
+	now := time.Now()
+	s.setNotebookLifecycle(c, s.store.SetNotebookArchived, &now)
+}
+
+func (s *Server) handleUnarchiveNotebook(c *gin.Context) {
+	s.setNotebookLifecycle(c, s.store.SetNotebookArchived, nil)
+}
+
+func (s *Server) handleTrashNotebook(c *gin.Context) {
+	now := time.Now()
+	s.setNotebookLifecycle(c, s.store.SetNotebookTrashed, &now)
+}
+
+func (s *Server) handleRestoreNotebook(c *gin.Context) {
+	s.setNotebookLifecycle(c, s.store.SetNotebookTrashed, nil)
+}
+
+// setNotebookLifecycle applies an archive or trash change and returns the notebook
+func (s *Server) setNotebookLifecycle(c *gin.Context, set func(context.Context, string, *time.Time) error, at *time.Time) {
+	ctx := context.Background()
+	id := c.Param("id")
+
+	if err := set(ctx, id, at); err != nil {
+		storeErrorResponse(c, err, "Failed to update notebook")
+		return
+	}
+
+	notebook, err := s.store.GetNotebook(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, notebook)
+}
+
+// notebookListFilter decides which notebooks a listing shows: by default
+// neither archived nor trashed ones, archived ones too with ?archived=true,
+// and only the trash with ?trashed=true
+func notebookListFilter(c *gin.Context) func(archivedAt, trashedAt *time.Time) bool {
+	trash := c.Query("trashed") == "true"
+	includeArchived := c.Query("archived") == "true"
+
+	return func(archivedAt, trashedAt *time.Time) bool {
+		if trash {
+			return trashedAt != nil
+		}
+		return trashedAt == nil && (archivedAt == nil || includeArchived)
+	}
+}
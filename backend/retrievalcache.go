@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// retrievalCachePrefix starts every retrieval cache key
+const retrievalCachePrefix = "retrieval:"
+
+// newRetrievalCache returns the cache for search results, or nil when
+// RETRIEVAL_CACHE_SECONDS is 0
+func newRetrievalCache(cfg Config) *Cache {
+	if cfg.RetrievalCacheSeconds <= 0 {
+		return nil
+	}
+	return NewCache(time.Duration(cfg.RetrievalCacheSeconds) * time.Second)
+}
+
+// normalizeQuery folds case and spacing, so queries that differ only in
+// those share cached results
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// retrievalCacheKey identifies a search by its notebooks, their generations
+// at the time of the search, the result count, the retriever and the query. A change to a
+// notebook moves its generation on, so older results are never reused.
+// Callers hold vs.mu.
+func (vs *VectorStore) retrievalCacheKey(query string, numDocs int, notebookIDs []string, retriever string) string {
+	scope := fmt.Sprintf("*@%d", vs.generation)
+	if len(notebookIDs) > 0 {
+		ids := append([]string(nil), notebookIDs...)
+		sort.Strings(ids)
+		parts := make([]string, len(ids))
+		for i, id := range ids {
+			parts[i] = fmt.Sprintf("%s@%d", id, vs.generations[id])
+		}
+		scope = strings.Join(parts, ",")
+	}
+	sum := sha256.Sum256([]byte(normalizeQuery(query)))
+	return fmt.Sprintf("%s%s:%d:%s:%s", retrievalCachePrefix, scope, numDocs, retriever, hex.EncodeToString(sum[:]))
+}
+
+// bumpGeneration records that a notebook's searchable chunks changed. Results
+// cached for the notebook on its own, or for every notebook, are dropped now;
+// others that include it can no longer be looked up and expire with the TTL.
+// Callers hold vs.mu.
+func (vs *VectorStore) bumpGeneration(notebookID string) {
+	vs.generation++
+	vs.generations[notebookID]++
+	if vs.retrievalCache != nil {
+		vs.retrievalCache.InvalidatePattern(retrievalCachePrefix + notebookID + "@")
+		vs.retrievalCache.InvalidatePattern(retrievalCachePrefix + "*@")
+	}
+}
+
+// SimilaritySearch returns the numDocs chunks most relevant to query from
+// the given notebooks (every notebook when none are given). Repeated
+// queries are answered from the retrieval cache until a notebook changes.
+func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDocs int, notebookIDs []string) ([]schema.Document, error) {
+	return vs.Retrieve(ctx, query, numDocs, notebookIDs, RetrieverHybrid)
+}
+
+// Retrieve is SimilaritySearch with the chunks scored by the given
+// retriever; "" is RetrieverHybrid
+func (vs *VectorStore) Retrieve(ctx context.Context, query string, numDocs int, notebookIDs []string, retriever string) ([]schema.Document, error) {
+	if retriever == "" {
+		retriever = RetrieverHybrid
+	}
+	if vs.retrievalCache == nil {
+		return vs.search(ctx, query, numDocs, notebookIDs, retriever)
+	}
+
+	vs.mu.RLock()
+	key := vs.retrievalCacheKey(query, numDocs, notebookIDs, retriever)
+	vs.mu.RUnlock()
+
+	if cached, ok := vs.retrievalCache.Get(key); ok {
+		golog.Debugf("[VectorStore] retrieval cache hit for '%s'", query)
+		return append([]schema.Document(nil), cached.([]schema.Document)...), nil
+	}
+
+	docs, err := vs.search(ctx, query, numDocs, notebookIDs, retriever)
+	if err != nil {
+		return nil, err
+	}
+	// The key holds the generations seen before searching, so a change made
+	// during the search leaves this entry unreachable rather than stale
+	vs.retrievalCache.Set(key, append([]schema.Document(nil), docs...))
+	return docs, nil
+}
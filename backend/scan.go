@@ -0,0 +1,395 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// quarantineDir holds uploads the malware scanner flagged
+const quarantineDir = "./data/quarantine"
+
+// scanTimeout bounds one scan, so a stuck scanner cannot hold an upload forever
+const scanTimeout = 2 * time.Minute
+
+// clamdChunkSize is how much of a file is sent to clamd per INSTREAM chunk
+const clamdChunkSize = 64 << 10
+
+// fileScanner checks a file for malware. It returns the name of what it
+// found, or "" for a clean file.
+type fileScanner interface {
+	scan(ctx context.Context, path string) (string, error)
+}
+
+// fileScanner returns the configured scanner, or nil when uploads are not
+// scanned. SCAN_CLAMAV_ADDR wins when both are set.
+func (s *Server) fileScanner() fileScanner {
+	if addr := s.cfg.ScanClamAVAddr; addr != "" {
+		network := "tcp"
+		if rest, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, addr = "unix", rest
+		} else if strings.HasPrefix(addr, "/") {
+			network = "unix"
+		}
+		return clamdScanner{network: network, addr: addr}
+	}
+	if fields := strings.Fields(s.cfg.ScanCommand); len(fields) > 0 {
+		return commandScanner{command: fields}
+	}
+	return nil
+}
+
+// clamdScanner streams files to a clamd daemon with the INSTREAM command
+type clamdScanner struct {
+	network string
+	addr    string
+}
+
+func (cs clamdScanner) scan(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dial := dialOutbound
+	if cs.network == "unix" {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, cs.network, cs.addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", fmt.Errorf("failed to send to clamd: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads "stream: OK" or "stream: <signature> FOUND"
+func parseClamdReply(reply string) (string, error) {
+	_, result, _ := strings.Cut(reply, ": ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// commandScanner runs an external command with the file's path as its last
+// argument. Exit status 0 means clean and 1 means infected, with the first
+// line of output naming what was found; anything else is a failed scan.
+type commandScanner struct {
+	command []string
+}
+
+func (cs commandScanner) scan(ctx context.Context, path string) (string, error) {
+	args := append(cs.command[1:len(cs.command):len(cs.command)], path)
+	output, err := exec.CommandContext(ctx, cs.command[0], args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		signature, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		if signature == "" {
+			signature = "flagged by " + filepath.Base(cs.command[0])
+		}
+		return signature, nil
+	}
+	return "", fmt.Errorf("scan command failed: %w, output: %s", err, bytes.TrimSpace(output))
+}
+
+// QuarantinedFile is an upload the malware scanner flagged, kept out of the
+// notebook until an admin releases or deletes it
+type QuarantinedFile struct {
+	ID          string    `json:"id"`
+	NotebookID  string    `json:"notebook_id"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type,omitempty"`
+	FileSize    int64     `json:"file_size"`
+	Path        string    `json:"-"`
+	Signature   string    `json:"signature"`
+	Origin      string    `json:"origin"` // "upload" or "email"
+	UploadedBy  string    `json:"uploaded_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// malwareError is returned for an upload the scanner flagged
+type malwareError struct {
+	file *QuarantinedFile
+}
+
+func (e *malwareError) Error() string {
+	return fmt.Sprintf("%s was flagged by the malware scanner (%s)", e.file.FileName, e.file.Signature)
+}
+
+// errScanFailed is returned when a file could not be scanned. Unscanned
+// files are never accepted.
+var errScanFailed = errors.New("file could not be scanned")
+
+// scanUpload scans a saved upload when a scanner is configured. A flagged
+// file is moved to quarantine and a *malwareError returned; if the scan
+// fails the file is removed and errScanFailed returned.
+func (s *Server) scanUpload(ctx context.Context, upload savedUpload, origin, uploadedBy string) error {
+	scanner := s.fileScanner()
+	if scanner == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	signature, err := scanner.scan(ctx, upload.Path)
+	if err != nil {
+		golog.Errorf("failed to scan %s: %v", upload.Name, err)
+		os.Remove(upload.Path)
+		return errScanFailed
+	}
+	if signature == "" {
+		return nil
+	}
+
+	file := &QuarantinedFile{
+		NotebookID:  upload.NotebookID,
+		FileName:    upload.Name,
+		ContentType: upload.ContentType,
+		FileSize:    upload.Size,
+		Signature:   signature,
+		Origin:      origin,
+		UploadedBy:  uploadedBy,
+	}
+	if err := s.quarantine(context.WithoutCancel(ctx), file, upload.Path); err != nil {
+		golog.Errorf("failed to quarantine %s: %v", upload.Name, err)
+		os.Remove(upload.Path)
+	}
+	golog.Warnf("quarantined %s uploaded to notebook %s: %s", upload.Name, upload.NotebookID, signature)
+	return &malwareError{file: file}
+}
+
+// quarantine moves a flagged file out of the uploads directory and records it
+func (s *Server) quarantine(ctx context.Context, file *QuarantinedFile, path string) error {
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return err
+	}
+	file.ID = uuid.New().String()
+	file.Path = filepath.Join(quarantineDir, file.ID)
+	if err := os.Rename(path, file.Path); err != nil {
+		return err
+	}
+	// Nothing should be able to run or serve it from here
+	os.Chmod(file.Path, 0600)
+	if err := s.store.CreateQuarantinedFile(ctx, file); err != nil {
+		os.Remove(file.Path)
+		return err
+	}
+	return nil
+}
+
+// scanErrorResponse writes the response for an upload scanUpload refused,
+// and reports whether it did
+func scanErrorResponse(c *gin.Context, err error) bool {
+	var malware *malwareError
+	switch {
+	case errors.As(err, &malware):
+		validationResponse(c, invalidField("file", "was flagged by the malware scanner (%s) and quarantined", malware.file.Signature))
+		return true
+	case errors.Is(err, errScanFailed):
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: "The file could not be scanned for malware, try again later"})
+		return true
+	}
+	return false
+}
+
+// Quarantine operations
+
+const quarantineColumns = `id, notebook_id, file_name, content_type, file_size, path, signature, origin, uploaded_by, created_at`
+
+// CreateQuarantinedFile records a flagged upload
+func (s *Store) CreateQuarantinedFile(ctx context.Context, file *QuarantinedFile) error {
+	file.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO quarantined_files (`+quarantineColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, file.ID, file.NotebookID, file.FileName, file.ContentType, file.FileSize, file.Path, file.Signature,
+		file.Origin, file.UploadedBy, file.CreatedAt.Unix())
+	return err
+}
+
+// GetQuarantinedFile retrieves a flagged upload by ID
+func (s *Store) GetQuarantinedFile(ctx context.Context, id string) (*QuarantinedFile, error) {
+	file, err := scanQuarantinedFile(s.db.QueryRowContext(ctx, `SELECT `+quarantineColumns+` FROM quarantined_files WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("quarantined file")
+	}
+	return file, err
+}
+
+// ListQuarantinedFiles returns flagged uploads, newest first, for one
+// notebook or for all of them when notebookID is empty
+func (s *Store) ListQuarantinedFiles(ctx context.Context, notebookID string) ([]QuarantinedFile, error) {
+	query := `SELECT ` + quarantineColumns + ` FROM quarantined_files`
+	var args []interface{}
+	if notebookID != "" {
+		query += ` WHERE notebook_id = ?`
+		args = append(args, notebookID)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]QuarantinedFile, 0)
+	for rows.Next() {
+		file, err := scanQuarantinedFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *file)
+	}
+	return files, rows.Err()
+}
+
+// DeleteQuarantinedFile removes a flagged upload's record
+func (s *Store) DeleteQuarantinedFile(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM quarantined_files WHERE id = ?`, id)
+	return err
+}
+
+func scanQuarantinedFile(row rowScanner) (*QuarantinedFile, error) {
+	var file QuarantinedFile
+	var createdAt int64
+	if err := row.Scan(&file.ID, &file.NotebookID, &file.FileName, &file.ContentType, &file.FileSize, &file.Path,
+		&file.Signature, &file.Origin, &file.UploadedBy, &createdAt); err != nil {
+		return nil, err
+	}
+	file.CreatedAt = time.Unix(createdAt, 0)
+	return &file, nil
+}
+
+// Quarantine handlers
+
+func (s *Server) handleListQuarantine(c *gin.Context) {
+	files, err := s.store.ListQuarantinedFiles(c.Request.Context(), c.Query("notebook_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list quarantined files"})
+		return
+	}
+	c.JSON(http.StatusOK, files)
+}
+
+// handleReleaseQuarantined adds a file the scanner flagged wrongly to its
+// notebook as a source, as if it had just been uploaded
+func (s *Server) handleReleaseQuarantined(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.IngestTimeout)
+	defer cancel()
+
+	file, err := s.store.GetQuarantinedFile(ctx, c.Param("quarantineId"))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load quarantined file")
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, file.NotebookID); err != nil {
+		storeErrorResponse(c, err, "Failed to load notebook")
+		return
+	}
+	if err := s.checkStorageQuota(ctx, file.NotebookID, file.FileSize); err != nil {
+		if !quotaResponse(c, err) {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check storage quota"})
+		}
+		return
+	}
+
+	src, err := os.Open(file.Path)
+	if err != nil {
+		golog.Errorf("failed to open quarantined file %s: %v", file.ID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to read quarantined file"})
+		return
+	}
+	uniqueName, path, size, err := saveUploadData(file.FileName, src)
+	src.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save file"})
+		return
+	}
+	if err := s.store.DeleteQuarantinedFile(ctx, file.ID); err != nil {
+		os.Remove(path)
+		storeErrorResponse(c, err, "Failed to release quarantined file")
+		return
+	}
+	os.Remove(file.Path)
+	golog.Infof("released quarantined file %s (%s) into notebook %s", file.FileName, file.Signature, file.NotebookID)
+
+	s.createUploadedSource(c, ctx, savedUpload{
+		NotebookID:  file.NotebookID,
+		Name:        file.FileName,
+		FileName:    uniqueName,
+		Path:        path,
+		Size:        size,
+		ContentType: file.ContentType,
+		Released:    true,
+	}, "")
+}
+
+func (s *Server) handleDeleteQuarantined(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	file, err := s.store.GetQuarantinedFile(ctx, c.Param("quarantineId"))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load quarantined file")
+		return
+	}
+	if err := s.store.DeleteQuarantinedFile(ctx, file.ID); err != nil {
+		storeErrorResponse(c, err, "Failed to delete quarantined file")
+		return
+	}
+	os.Remove(file.Path)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,626 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// ScheduledPrompt is a saved prompt that runs against a notebook on a cron
+// schedule and saves its output as a note
+type ScheduledPrompt struct {
+	ID         string `json:"id"`
+	NotebookID string `json:"notebook_id"`
+	Name       string `json:"name"`
+	Prompt     string `json:"prompt"`
+	Schedule   string `json:"schedule"` // cron expression, e.g. "0 9 * * 1"
+	Enabled    bool   `json:"enabled"`
+	// NewSourcesOnly limits each run to sources added since the previous run
+	NewSourcesOnly      bool       `json:"new_sources_only"`
+	WebhookURL          string     `json:"webhook_url,omitempty"`
+	NotifyEmail         string     `json:"notify_email,omitempty"`
+	NotifyOn            string     `json:"notify_on"` // "always", "failure", "never"
+	LastRunAt           *time.Time `json:"last_run_at,omitempty"`
+	NextRunAt           *time.Time `json:"next_run_at,omitempty"`
+	LastStatus          string     `json:"last_status,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// ScheduledPromptRun records one execution of a scheduled prompt
+type ScheduledPromptRun struct {
+	ID         string    `json:"id"`
+	PromptID   string    `json:"prompt_id"`
+	Status     string    `json:"status"` // "success", "error", "skipped"
+	NoteID     string    `json:"note_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// maxScheduledFailures disables a scheduled prompt after this many failed runs in a row
+const maxScheduledFailures = 5
+
+var scheduledNotifyModes = map[string]bool{"always": true, "failure": true, "never": true}
+
+const scheduledPromptColumns = `id, notebook_id, name, prompt, schedule, enabled, new_sources_only,
+	webhook_url, notify_email, notify_on, last_run_at, next_run_at, last_status,
+	consecutive_failures, created_at, updated_at`
+
+func scanScheduledPrompt(row rowScanner) (*ScheduledPrompt, error) {
+	var p ScheduledPrompt
+	var enabled, newOnly int
+	var lastRunAt, nextRunAt, createdAt, updatedAt int64
+
+	if err := row.Scan(&p.ID, &p.NotebookID, &p.Name, &p.Prompt, &p.Schedule, &enabled, &newOnly,
+		&p.WebhookURL, &p.NotifyEmail, &p.NotifyOn, &lastRunAt, &nextRunAt, &p.LastStatus,
+		&p.ConsecutiveFailures, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	p.Enabled = enabled == 1
+	p.NewSourcesOnly = newOnly == 1
+	if lastRunAt > 0 {
+		t := time.Unix(lastRunAt, 0)
+		p.LastRunAt = &t
+	}
+	if nextRunAt > 0 {
+		t := time.Unix(nextRunAt, 0)
+		p.NextRunAt = &t
+	}
+	p.CreatedAt = time.Unix(createdAt, 0)
+	p.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &p, nil
+}
+
+// unixOrZero stores optional times as 0 when unset
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Scheduled prompt operations
+
+// CreateScheduledPrompt stores a new scheduled prompt
+func (s *Store) CreateScheduledPrompt(ctx context.Context, p *ScheduledPrompt) error {
+	p.ID = uuid.New().String()
+	now := time.Now()
+	p.CreatedAt = now
+	p.UpdatedAt = now
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO scheduled_prompts (`+scheduledPromptColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.ID, p.NotebookID, p.Name, p.Prompt, p.Schedule, boolInt(p.Enabled), boolInt(p.NewSourcesOnly),
+		p.WebhookURL, p.NotifyEmail, p.NotifyOn, unixOrZero(p.LastRunAt), unixOrZero(p.NextRunAt), p.LastStatus,
+		p.ConsecutiveFailures, now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetScheduledPrompt retrieves a scheduled prompt by ID
+func (s *Store) GetScheduledPrompt(ctx context.Context, id string) (*ScheduledPrompt, error) {
+	p, err := scanScheduledPrompt(s.db.QueryRowContext(ctx, `
+		SELECT `+scheduledPromptColumns+` FROM scheduled_prompts WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("scheduled prompt")
+	}
+	return p, err
+}
+
+// ListScheduledPrompts retrieves a notebook's scheduled prompts
+func (s *Store) ListScheduledPrompts(ctx context.Context, notebookID string) ([]ScheduledPrompt, error) {
+	return s.queryScheduledPrompts(ctx, `
+		SELECT `+scheduledPromptColumns+` FROM scheduled_prompts
+		WHERE notebook_id = ? ORDER BY created_at
+	`, notebookID)
+}
+
+// ListDueScheduledPrompts retrieves enabled prompts whose next run is at or before now
+func (s *Store) ListDueScheduledPrompts(ctx context.Context, now time.Time) ([]ScheduledPrompt, error) {
+	return s.queryScheduledPrompts(ctx, `
+		SELECT `+scheduledPromptColumns+` FROM scheduled_prompts
+		WHERE enabled = 1 AND next_run_at > 0 AND next_run_at <= ? ORDER BY next_run_at
+	`, now.Unix())
+}
+
+func (s *Store) queryScheduledPrompts(ctx context.Context, query string, args ...interface{}) ([]ScheduledPrompt, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prompts := make([]ScheduledPrompt, 0)
+	for rows.Next() {
+		p, err := scanScheduledPrompt(rows)
+		if err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, *p)
+	}
+
+	return prompts, rows.Err()
+}
+
+// UpdateScheduledPrompt saves a scheduled prompt's definition and run state
+func (s *Store) UpdateScheduledPrompt(ctx context.Context, p *ScheduledPrompt) error {
+	return updateScheduledPrompt(ctx, s.db, p)
+}
+
+// updateScheduledPrompt saves a scheduled prompt through db, which may be a
+// transaction
+func updateScheduledPrompt(ctx context.Context, db sqlExecer, p *ScheduledPrompt) error {
+	p.UpdatedAt = time.Now()
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE scheduled_prompts SET name = ?, prompt = ?, schedule = ?, enabled = ?, new_sources_only = ?,
+			webhook_url = ?, notify_email = ?, notify_on = ?, last_run_at = ?, next_run_at = ?,
+			last_status = ?, consecutive_failures = ?, updated_at = ?
+		WHERE id = ?
+	`, p.Name, p.Prompt, p.Schedule, boolInt(p.Enabled), boolInt(p.NewSourcesOnly),
+		p.WebhookURL, p.NotifyEmail, p.NotifyOn, unixOrZero(p.LastRunAt), unixOrZero(p.NextRunAt),
+		p.LastStatus, p.ConsecutiveFailures, p.UpdatedAt.Unix(), p.ID)
+
+	return err
+}
+
+// DeleteScheduledPrompt deletes a scheduled prompt and its run history
+func (s *Store) DeleteScheduledPrompt(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_prompts WHERE id = ?`, id)
+	return err
+}
+
+// RecordScheduledPromptRun records a run and the prompt's new run state in
+// one transaction, together with the webhook announcing the run unless
+// webhook is nil, so the webhook is sent if and only if the run was saved
+func (s *Store) RecordScheduledPromptRun(ctx context.Context, p *ScheduledPrompt, run *ScheduledPromptRun, webhook interface{}) error {
+	run.ID = uuid.New().String()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO scheduled_prompt_runs (id, prompt_id, status, note_id, error, started_at, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, run.ID, run.PromptID, run.Status, run.NoteID, run.Error, run.StartedAt.Unix(), run.FinishedAt.Unix()); err != nil {
+		return err
+	}
+	if err := updateScheduledPrompt(ctx, tx, p); err != nil {
+		return err
+	}
+	if webhook != nil {
+		if err := enqueueWebhook(ctx, tx, p.WebhookURL, webhook); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListScheduledPromptRuns retrieves a prompt's most recent runs, newest first
+func (s *Store) ListScheduledPromptRuns(ctx context.Context, promptID string, limit int) ([]ScheduledPromptRun, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, prompt_id, status, note_id, error, started_at, finished_at
+		FROM scheduled_prompt_runs WHERE prompt_id = ? ORDER BY started_at DESC LIMIT ?
+	`, promptID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]ScheduledPromptRun, 0)
+	for rows.Next() {
+		var run ScheduledPromptRun
+		var startedAt, finishedAt int64
+		if err := rows.Scan(&run.ID, &run.PromptID, &run.Status, &run.NoteID, &run.Error, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		run.StartedAt = time.Unix(startedAt, 0)
+		run.FinishedAt = time.Unix(finishedAt, 0)
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// Scheduler
+
+func (s *Server) runDueScheduledPrompts(ctx context.Context) error {
+	due, err := s.store.ListDueScheduledPrompts(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to list scheduled prompts: %w", err)
+	}
+
+	for i := range due {
+		if _, err := s.runScheduledPrompt(ctx, &due[i]); err != nil {
+			golog.Errorf("failed to run scheduled prompt %s: %v", due[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// runScheduledPrompt executes a prompt, records the run, advances the schedule
+// and sends notifications
+func (s *Server) runScheduledPrompt(ctx context.Context, p *ScheduledPrompt) (*ScheduledPromptRun, error) {
+	run := &ScheduledPromptRun{PromptID: p.ID, StartedAt: time.Now()}
+
+	noteID, err := s.executeScheduledPrompt(ctx, p, run.StartedAt)
+	run.FinishedAt = time.Now()
+	switch {
+	case err != nil:
+		run.Status = "error"
+		run.Error = err.Error()
+		p.ConsecutiveFailures++
+	case noteID == "":
+		run.Status = "skipped"
+		p.ConsecutiveFailures = 0
+	default:
+		run.Status = "success"
+		run.NoteID = noteID
+		p.ConsecutiveFailures = 0
+	}
+
+	disabled := false
+	if p.ConsecutiveFailures >= maxScheduledFailures {
+		p.Enabled = false
+		disabled = true
+	}
+
+	// Skipped runs leave the window open so the next run still sees the sources
+	if run.Status != "skipped" {
+		p.LastRunAt = &run.StartedAt
+	}
+	p.LastStatus = run.Status
+	p.NextRunAt = nextScheduledRun(p.Schedule, run.FinishedAt)
+
+	var webhook interface{}
+	if p.WebhookURL != "" && notifiesOfRun(p, run) {
+		payload := map[string]interface{}{
+			"event":       "scheduled_prompt.run",
+			"prompt_id":   p.ID,
+			"name":        p.Name,
+			"notebook_id": p.NotebookID,
+			"status":      run.Status,
+			"note_id":     run.NoteID,
+			"error":       run.Error,
+			"disabled":    disabled,
+			"started_at":  run.StartedAt,
+			"finished_at": run.FinishedAt,
+		}
+		if run.NoteID != "" {
+			payload["link"] = s.absoluteURL(fmt.Sprintf("/api/notebooks/%s/notes/%s", p.NotebookID, run.NoteID))
+		}
+		webhook = payload
+	}
+	if err := s.store.RecordScheduledPromptRun(ctx, p, run, webhook); err != nil {
+		return nil, err
+	}
+	if webhook != nil {
+		s.outbox.notify()
+	}
+
+	golog.Infof("scheduled prompt %s ran: %s", p.Name, run.Status)
+	s.notifyScheduledRun(ctx, p, run, disabled)
+
+	return run, nil
+}
+
+// executeScheduledPrompt generates the prompt's output from the notebook's sources
+// and saves it as a note. It returns an empty note ID when there was nothing to do.
+func (s *Server) executeScheduledPrompt(ctx context.Context, p *ScheduledPrompt, startedAt time.Time) (string, error) {
+	sources, err := s.store.ListSources(ctx, p.NotebookID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list sources: %w", err)
+	}
+
+	selected := make([]Source, 0, len(sources))
+	sourceIDs := make([]string, 0, len(sources))
+	for _, src := range sources {
+		if !src.IncludedInRetrieval {
+			continue
+		}
+		if p.NewSourcesOnly && p.LastRunAt != nil && !src.CreatedAt.After(*p.LastRunAt) {
+			continue
+		}
+		selected = append(selected, src)
+		sourceIDs = append(sourceIDs, src.ID)
+	}
+	if len(selected) == 0 {
+		return "", nil
+	}
+
+	language := s.notebookLanguage(ctx, p.NotebookID)
+	req := &TransformationRequest{Type: "custom", Prompt: p.Prompt, SourceIDs: sourceIDs, Language: language}
+	response, err := s.notebookAgent(ctx, p.NotebookID).GenerateTransformation(ctx, req, selected)
+	if err != nil {
+		return "", fmt.Errorf("generation failed: %w", err)
+	}
+
+	note := &Note{
+		NotebookID: p.NotebookID,
+		Title:      fmt.Sprintf("%s (%s)", p.Name, formatDate(language, startedAt)),
+		Content:    response.Content,
+		Type:       "custom",
+		SourceIDs:  sourceIDs,
+		Metadata: map[string]interface{}{
+			"scheduled_prompt_id": p.ID,
+		},
+	}
+	if err := s.createNote(ctx, note); err != nil {
+		return "", fmt.Errorf("failed to save note: %w", err)
+	}
+
+	return note.ID, nil
+}
+
+// nextScheduledRun returns the next run time for a valid schedule, or nil
+func nextScheduledRun(schedule string, after time.Time) *time.Time {
+	sched, err := parseCron(schedule)
+	if err != nil {
+		return nil
+	}
+	next := sched.Next(after)
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+// notifiesOfRun reports whether a prompt's notifications announce a run.
+// Failures always notify unless notifications are off.
+func notifiesOfRun(p *ScheduledPrompt, run *ScheduledPromptRun) bool {
+	if p.NotifyOn == "never" || run.Status == "skipped" {
+		return false
+	}
+	return p.NotifyOn != "failure" || run.Status == "error"
+}
+
+// notifyScheduledRun sends the run result to the workspace and the prompt's
+// email. The webhook goes through the outbox, queued with the run.
+func (s *Server) notifyScheduledRun(ctx context.Context, p *ScheduledPrompt, run *ScheduledPromptRun, disabled bool) {
+	if !notifiesOfRun(p, run) {
+		return
+	}
+
+	if nb, err := s.store.GetNotebook(ctx, p.NotebookID); err == nil {
+		n := Notification{
+			Kind:  NotificationScheduled,
+			Title: fmt.Sprintf("Scheduled prompt %q finished", p.Name),
+			Body:  fmt.Sprintf("A new note was saved to notebook %s.", nb.Name),
+			Link:  fmt.Sprintf("/api/notebooks/%s/notes/%s", p.NotebookID, run.NoteID),
+			Data:  map[string]interface{}{"prompt_id": p.ID, "notebook_id": p.NotebookID, "status": run.Status, "note_id": run.NoteID},
+		}
+		if run.Status == "error" {
+			n.Title, n.Body = fmt.Sprintf("Scheduled prompt %q failed", p.Name), run.Error
+			n.Link = fmt.Sprintf("/api/notebooks/%s/scheduled-prompts", p.NotebookID)
+			if disabled {
+				n.Body += "\nThe prompt has been disabled after repeated failures."
+			}
+		}
+		if recipients, err := s.workspaceRecipients(ctx, nb.WorkspaceID); err == nil {
+			s.notify(ctx, recipients, n)
+		}
+	}
+
+	if p.NotifyEmail != "" && s.cfg.SMTPHost != "" {
+		var body strings.Builder
+		subject := fmt.Sprintf("Scheduled prompt %q finished", p.Name)
+		if run.Status == "error" {
+			subject = fmt.Sprintf("Scheduled prompt %q failed", p.Name)
+			body.WriteString(fmt.Sprintf("Error: %s\n", run.Error))
+			body.WriteString(fmt.Sprintf("Consecutive failures: %d\n", p.ConsecutiveFailures))
+			if disabled {
+				body.WriteString("The prompt has been disabled after repeated failures.\n")
+			}
+		} else {
+			body.WriteString(fmt.Sprintf("A new note was saved to notebook %s (note %s).\n", p.NotebookID, run.NoteID))
+		}
+		body.WriteString(fmt.Sprintf("Started: %s\n", run.StartedAt.Format(time.RFC3339)))
+
+		if err := s.sendEmail(p.NotifyEmail, subject, body.String()); err != nil {
+			golog.Warnf("failed to send scheduled prompt email: %v", err)
+		}
+	}
+}
+
+// Scheduled prompt handlers
+
+// validateScheduledPrompt normalizes and checks a prompt definition
+func validateScheduledPrompt(p *ScheduledPrompt) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if strings.TrimSpace(p.Prompt) == "" {
+		return fmt.Errorf("prompt is required")
+	}
+	if _, err := parseCron(p.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	if p.NotifyOn == "" {
+		p.NotifyOn = "always"
+	}
+	if !scheduledNotifyModes[p.NotifyOn] {
+		return fmt.Errorf("notify_on must be one of always, failure, never")
+	}
+	if p.WebhookURL != "" && !strings.HasPrefix(p.WebhookURL, "http://") && !strings.HasPrefix(p.WebhookURL, "https://") {
+		return fmt.Errorf("webhook_url must be an http(s) URL")
+	}
+	return nil
+}
+
+// notebookScheduledPrompt loads :promptId and checks it belongs to :id
+func (s *Server) notebookScheduledPrompt(c *gin.Context) (*ScheduledPrompt, bool) {
+	p, err := s.store.GetScheduledPrompt(context.Background(), c.Param("promptId"))
+	if err != nil || p.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Scheduled prompt not found"})
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *Server) handleListScheduledPrompts(c *gin.Context) {
+	ctx := context.Background()
+
+	prompts, err := s.store.ListScheduledPrompts(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list scheduled prompts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, prompts)
+}
+
+func (s *Server) handleCreateScheduledPrompt(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	p := ScheduledPrompt{Enabled: true}
+	if !bindJSON(c, &p) {
+		return
+	}
+	if err := validateScheduledPrompt(&p); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
+	p.NotebookID = notebookID
+	p.LastRunAt, p.LastStatus, p.ConsecutiveFailures = nil, "", 0
+	p.NextRunAt = nil
+	if p.Enabled {
+		p.NextRunAt = nextScheduledRun(p.Schedule, time.Now())
+	}
+
+	if err := s.store.CreateScheduledPrompt(ctx, &p); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create scheduled prompt"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, p)
+}
+
+func (s *Server) handleUpdateScheduledPrompt(c *gin.Context) {
+	ctx := context.Background()
+
+	existing, ok := s.notebookScheduledPrompt(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name           string `json:"name"`
+		Prompt         string `json:"prompt"`
+		Schedule       string `json:"schedule"`
+		Enabled        bool   `json:"enabled"`
+		NewSourcesOnly bool   `json:"new_sources_only"`
+		WebhookURL     string `json:"webhook_url"`
+		NotifyEmail    string `json:"notify_email"`
+		NotifyOn       string `json:"notify_on"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	p := *existing
+	p.Name, p.Prompt, p.Schedule = req.Name, req.Prompt, req.Schedule
+	p.Enabled, p.NewSourcesOnly = req.Enabled, req.NewSourcesOnly
+	p.WebhookURL, p.NotifyEmail, p.NotifyOn = req.WebhookURL, req.NotifyEmail, req.NotifyOn
+	if err := validateScheduledPrompt(&p); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
+	p.NextRunAt = nil
+	if p.Enabled {
+		p.NextRunAt = nextScheduledRun(p.Schedule, time.Now())
+		// Re-enabling clears the failure streak
+		if !existing.Enabled {
+			p.ConsecutiveFailures = 0
+		}
+	}
+
+	if err := s.store.UpdateScheduledPrompt(ctx, &p); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update scheduled prompt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+func (s *Server) handleDeleteScheduledPrompt(c *gin.Context) {
+	ctx := context.Background()
+
+	p, ok := s.notebookScheduledPrompt(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteScheduledPrompt(ctx, p.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete scheduled prompt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled prompt deleted"})
+}
+
+// handleRunScheduledPrompt runs a prompt immediately, outside its schedule
+func (s *Server) handleRunScheduledPrompt(c *gin.Context) {
+	ctx := context.Background()
+
+	p, ok := s.notebookScheduledPrompt(c)
+	if !ok {
+		return
+	}
+
+	run, err := s.runScheduledPrompt(ctx, p)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to run scheduled prompt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
+}
+
+func (s *Server) handleListScheduledPromptRuns(c *gin.Context) {
+	ctx := context.Background()
+
+	p, ok := s.notebookScheduledPrompt(c)
+	if !ok {
+		return
+	}
+
+	runs, err := s.store.ListScheduledPromptRuns(ctx, p.ID, 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
@@ -2,37 +2,104 @@ package backend
 
 import (
 	"context"
-	"embed"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/fs"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/kataras/golog"
+	"golang.org/x/net/webdav"
 )
 
-//go:embed frontend/index.html frontend/static
-var frontendFS embed.FS
-
 // Server handles HTTP requests
 type Server struct {
 	cfg         Config
 	vectorStore *VectorStore
 	store       *CachedStore
 	agent       *Agent
+	prompts     *PromptStore
+	webSearcher WebSearcher
 	http        *gin.Engine
-	// Track which notebooks have been loaded into vector store
-	loadedNotebooks map[string]bool
-	vectorMutex     sync.RWMutex
+	heartbeats  *jobHeartbeats
+	scheduler   *jobScheduler
+	outbox      *outboxDispatcher
+	llmCheck    llmCheckCache
+	httpServer  *http.Server
+	rateLimiter *rateLimiter
+	// Two-factor codes tried, by user, so codes can't be guessed
+	otpAttempts *rateLimiter
+	maintenance *maintenanceMode
+	// Configuration as last (re)loaded; hot-reloadable settings change at runtime
+	cfgMu   sync.RWMutex
+	liveCfg Config
+	// Agents for workspaces with their own LLM credentials
+	agentsMu        sync.Mutex
+	workspaceAgents map[string]workspaceAgent
+	// Report of the most recent retention run
+	retentionMu   sync.Mutex
+	lastRetention *RetentionReport
+	// Closed when shutdown begins; background jobs stop and /readyz fails
+	stopping chan struct{}
+	stopOnce sync.Once
+	jobs     sync.WaitGroup
+	// Track which notebooks have been loaded into vector store, and when
+	// each was last used so idle ones can be unloaded
+	loadedNotebooks  map[string]bool
+	notebookLastUsed map[string]time.Time
+	vectorMutex      sync.RWMutex
+	// Upload sessions with a chunk being written
+	uploadLocks uploadLocks
+	// Locks WebDAV clients hold on notes while editing them
+	davLocks webdav.LockSystem
+	// Key for signed download links when none is configured
+	signingKeyOnce sync.Once
+	signingKey     []byte
+	// First-run setup; setupDone is set in setup mode and closed when done
+	setupMu   sync.Mutex
+	setupDone chan struct{}
+	// WebSocket clients listening for changes
+	events eventHub
+	// Chat answers being generated, so they can be stopped
+	chatRuns chatRuns
+	// Chats waiting for their turn to be answered
+	chatQueue *chatQueue
+	// Draws images into notes; nil when not configured
+	imageGenerator ImageGenerator
+	// Transcribes questions asked by voice; nil when not configured
+	transcriber *transcriber
+	// Reads answers and notes aloud; nil when not configured
+	speech SpeechSynthesizer
+	// Classifies chat messages and answers; nil when not configured
+	moderator Moderator
+	// Sends push notifications to mobile devices, by provider; empty when
+	// none is configured
+	push map[string]PushSender
+	// Custom domains of workspaces' published notes, and the HTTPS servers
+	// for them when ACME is on, with the certificates issued through a DNS
+	// provider
+	sites       siteDomains
+	acmeServers []*http.Server
+	dnsCerts    dnsCertificates
+	// Index of similar sources and notes, and suggestions made from it
+	related relatedIndex
 }
 
 // NewServer creates a new server
 func NewServer(cfg Config) (*Server, error) {
+	if err := EnforceLocalOnly(cfg); err != nil {
+		return nil, err
+	}
+
 	// Initialize vector store
 	vectorStore, err := NewVectorStore(cfg)
 	if err != nil {
@@ -48,25 +115,80 @@ func NewServer(cfg Config) (*Server, error) {
 	// Wrap store with cache (5 minute TTL)
 	store := NewCachedStore(baseStore, 5*time.Minute)
 
+	// Load prompt overrides
+	promptStore, err := NewPromptStore(context.Background(), baseStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load prompts: %w", err)
+	}
+
 	// Initialize agent
-	agent, err := NewAgent(cfg, vectorStore)
+	agent, err := NewAgent(cfg, vectorStore, promptStore)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create agent: %w", err)
 	}
 
+	webSearcher, err := newWebSearcher(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure web search: %w", err)
+	}
+
+	imageGenerator, err := newImageGenerator(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure image generation: %w", err)
+	}
+
+	speech, err := newSpeechSynthesizer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure text-to-speech: %w", err)
+	}
+
+	moderator, err := newModerator(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure moderation: %w", err)
+	}
+
+	push, err := newPushSenders(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure push notifications: %w", err)
+	}
+
 	// Create Gin router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(gin.Recovery(), gin.Logger())
+	if err := configureProxies(router, cfg); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
 
 	s := &Server{
-		cfg:             cfg,
-		vectorStore:     vectorStore,
-		store:           store,
-		agent:           agent,
-		http:            router,
-		loadedNotebooks: make(map[string]bool),
-	}
+		cfg:              cfg,
+		vectorStore:      vectorStore,
+		store:            store,
+		agent:            agent,
+		prompts:          promptStore,
+		webSearcher:      webSearcher,
+		imageGenerator:   imageGenerator,
+		transcriber:      newTranscriber(cfg),
+		speech:           speech,
+		moderator:        moderator,
+		push:             push,
+		http:             router,
+		heartbeats:       newJobHeartbeats(),
+		scheduler:        newJobScheduler(cfg, store.Store),
+		outbox:           newOutboxDispatcher(store.Store, cfg.WebhookMaxAttempts),
+		stopping:         make(chan struct{}),
+		rateLimiter:      newRateLimiter(cfg.RateLimitPerMinute, cfg.RateLimitBurst),
+		otpAttempts:      newRateLimiter(5, 5),
+		chatQueue:        newChatQueue(cfg.ChatConcurrency, cfg.ChatQueueSize),
+		maintenance:      &maintenanceMode{},
+		davLocks:         webdav.NewMemLS(),
+		liveCfg:          cfg,
+		workspaceAgents:  make(map[string]workspaceAgent),
+		loadedNotebooks:  make(map[string]bool),
+		notebookLastUsed: make(map[string]time.Time),
+	}
+
+	s.subscribeStoreEvents()
 
 	// 延迟加载向量索引，不在启动时加载
 	golog.Infof("✅ server initialized (vector index will load on demand)")
@@ -78,65 +200,414 @@ func NewServer(cfg Config) (*Server, error) {
 
 // setupRoutes configures all routes
 func (s *Server) setupRoutes() {
+	if s.cfg.EnableCompression {
+		s.http.Use(CompressionMiddleware())
+	}
+	// Preflight requests carry no credentials, so CORS comes first
+	s.http.Use(s.CORSMiddleware())
+	if s.cfg.DesktopToken != "" {
+		s.http.Use(s.DesktopTokenMiddleware())
+	}
+	s.http.Use(s.CustomDomainMiddleware())
+	s.http.Use(s.CSRFMiddleware())
+
 	// Serve static files from embedded filesystem (no audit)
-	staticFS, _ := fs.Sub(frontendFS, "frontend/static")
-	s.http.StaticFS("/static", http.FS(staticFS))
-
-	// Serve uploaded files (with audit)
-	uploads := s.http.Group("/uploads")
-	uploads.Use(AuditMiddlewareLite())
-	uploads.Static("/", "./data/uploads")
-
-	// Serve index.html at root (with audit)
-	s.http.GET("/", AuditMiddlewareLite(), func(c *gin.Context) {
-		c.Header("Cache-Control", "no-cache")
-		content, _ := frontendFS.ReadFile("frontend/index.html")
-		c.Data(http.StatusOK, "text/html; charset=utf-8", content)
-	})
+	assets, err := loadFrontendAssets()
+	if err != nil {
+		panic(fmt.Sprintf("embedded frontend is unreadable: %v", err))
+	}
+	assets.withBasePath(normalizeBasePath(s.cfg.BasePath))
+	s.http.GET("/static/*filepath", assets.handleStatic)
+	s.http.HEAD("/static/*filepath", assets.handleStatic)
+
+	// Generated infographic and slide images (with audit); other uploads are
+	// only served through the access-checked or signed attachment routes
+	s.http.GET("/uploads/:fileName", AuditMiddlewareLite(), handleGeneratedImage)
+
+	// Liveness and readiness probes (no audit)
+	s.http.GET("/healthz", s.handleHealthz)
+	s.http.GET("/readyz", s.handleReadyz)
+
+	// Serve index.html at root and for client-side routes (with audit)
+	s.http.NoRoute(AuditMiddlewareLite(), assets.handleFallback)
+
+	// Signed download links work without an API token until they expire
+	dl := s.http.Group("/dl")
+	dl.Use(AuditMiddlewareLite())
+	dl.Use(RateLimitMiddleware(s.rateLimiter))
+	dl.Use(ValidateIDParams())
+	dl.Use(s.SignedURLMiddleware())
+	{
+		dl.GET("/attachments/:attachmentId", s.handleGetAttachment)
+		dl.GET("/attachments/:attachmentId/thumbnail", s.handleGetAttachmentThumbnail)
+		dl.GET("/notebooks/:id/export", s.handleExportNotebook)
+		dl.GET("/account-jobs/:jobId", s.handleSignedAccountExport)
+	}
+
+	// Notes as Markdown files over WebDAV; clients sign in with Basic
+	// authentication
+	dav := s.http.Group(davPrefix)
+	dav.Use(AuditMiddlewareLite())
+	dav.Use(RateLimitMiddleware(s.rateLimiter))
+	dav.Use(ReadOnlyMiddleware(s.maintenance))
+	dav.Use(s.BodyLimitMiddleware())
+	for _, method := range davMethods {
+		dav.Handle(method, "", s.handleWebDAV)
+		dav.Handle(method, "/*path", s.handleWebDAV)
+	}
+
+	// Published notes, their feed and sitemap are public
+	published := s.http.Group(publishPrefix)
+	published.Use(AuditMiddlewareLite())
+	published.Use(RateLimitMiddleware(s.rateLimiter))
+	{
+		published.GET("/", s.handlePublishedIndex)
+		published.GET("/feed.xml", s.handlePublishedFeed)
+		published.GET("/sitemap.xml", s.handlePublishedSitemap)
+		published.GET("/:slug", s.handlePublishedNote)
+	}
+
+	// Change notifications; the socket signs in by itself, since browsers
+	// cannot send headers with it
+	s.http.GET("/api/ws", AuditMiddlewareLite(), RateLimitMiddleware(s.rateLimiter), s.handleEvents)
+
+	// Bot webhooks; the platforms sign them instead of sending an API token
+	s.http.POST("/api/inbound/bots/:token", AuditMiddlewareLite(), RateLimitMiddleware(s.rateLimiter), ReadOnlyMiddleware(s.maintenance), s.BodyLimitMiddleware(), s.handleBotWebhook)
 
 	// API routes
 	api := s.http.Group("/api")
 	api.Use(AuditMiddlewareLite()) // Only audit API routes, not static resources
+	api.Use(RateLimitMiddleware(s.rateLimiter))
+	api.Use(ReadOnlyMiddleware(s.maintenance))
+	api.Use(ValidateIDParams())
+	api.Use(s.BodyLimitMiddleware())
+
+	// Create endpoints deduplicate retries that send an Idempotency-Key
+	idempotent := s.IdempotencyMiddleware()
+	api.Use(s.WorkspaceMiddleware())
 	{
 		// Health check
 		api.GET("/health", s.handleHealth)
 		api.GET("/config", s.handleConfig)
+		api.GET("/languages", s.handleListLanguages)
+		api.GET("/output-schemas", s.handleListOutputSchemas)
+		api.POST("/tts", s.handleTextToSpeech)
+
+		// Users and workspaces
+		api.POST("/users", s.handleCreateUser)
+		api.GET("/me", s.handleGetMe)
+		api.GET("/account/usage", s.handleGetAccountUsage)
+		api.POST("/account/export", s.handleExportAccount)
+		api.DELETE("/account", s.handleDeleteAccount)
+		api.GET("/account/jobs/:jobId", s.handleGetAccountJob)
+		api.GET("/account/jobs/:jobId/download", s.handleDownloadAccountExport)
+		api.POST("/account/jobs/:jobId/signed-url", s.handleSignAccountExport)
+		api.GET("/account/2fa", s.handleGetTwoFactor)
+		api.POST("/account/2fa", s.handleStartTwoFactor)
+		api.DELETE("/account/2fa", s.handleDisableTwoFactor)
+		api.POST("/account/2fa/confirm", s.handleConfirmTwoFactor)
+		api.POST("/account/2fa/verify", s.handleVerifyTwoFactor)
+		api.POST("/account/2fa/recovery-codes", s.handleRegenerateRecoveryCodes)
+		api.GET("/account/sessions", s.handleListSessions)
+		api.POST("/account/sessions", s.handleCreateSession)
+		api.DELETE("/account/sessions", s.handleRevokeOtherSessions)
+		api.DELETE("/account/sessions/:sessionId", s.handleRevokeSession)
+		api.GET("/workspaces", s.handleListWorkspaces)
+		api.POST("/workspaces", s.handleCreateWorkspace)
+		api.GET("/workspaces/:workspaceId", s.handleGetWorkspace)
+		api.PUT("/workspaces/:workspaceId", s.handleUpdateWorkspace)
+		api.DELETE("/workspaces/:workspaceId", s.handleDeleteWorkspace)
+		api.GET("/workspaces/:workspaceId/members", s.handleListWorkspaceMembers)
+		api.POST("/workspaces/:workspaceId/members", s.handleAddWorkspaceMember)
+		api.DELETE("/workspaces/:workspaceId/members/:userId", s.handleRemoveWorkspaceMember)
+		api.GET("/workspaces/:workspaceId/moderation", s.handleGetModeration)
+		api.PUT("/workspaces/:workspaceId/moderation", s.handleSetModeration)
+		api.GET("/workspaces/:workspaceId/moderation/events", s.handleListModerationEvents)
+		api.GET("/workspaces/:workspaceId/security", s.handleGetSecurityPolicy)
+		api.PUT("/workspaces/:workspaceId/security", s.handleSetSecurityPolicy)
+		api.GET("/workspaces/:workspaceId/site", s.handleGetWorkspaceSite)
+		api.PUT("/workspaces/:workspaceId/site", s.handleSetWorkspaceSite)
+		api.DELETE("/workspaces/:workspaceId/site", s.handleDeleteWorkspaceSite)
 
 		// Notebook routes
 		notebooks := api.Group("/notebooks")
+		notebooks.Use(s.NotebookWorkspaceMiddleware())
 		{
 			notebooks.GET("", s.handleListNotebooks)
 			notebooks.GET("/stats", s.handleListNotebooksWithStats)
-			notebooks.POST("", s.handleCreateNotebook)
+			notebooks.POST("", idempotent, s.handleCreateNotebook)
+			notebooks.POST("/smart", idempotent, s.handleCreateSmartNotebook)
 			notebooks.GET("/:id", s.handleGetNotebook)
+			notebooks.GET("/:id/bundle", s.handleGetNotebookBundle)
 			notebooks.PUT("/:id", s.handleUpdateNotebook)
 			notebooks.DELETE("/:id", s.handleDeleteNotebook)
+			notebooks.POST("/:id/archive", s.handleArchiveNotebook)
+			notebooks.DELETE("/:id/archive", s.handleUnarchiveNotebook)
+			notebooks.POST("/:id/trash", s.handleTrashNotebook)
+			notebooks.DELETE("/:id/trash", s.handleRestoreNotebook)
+			notebooks.GET("/:id/export", s.handleExportNotebook)
+			notebooks.POST("/:id/export/signed-url", s.handleSignNotebookExport)
 
 			// Sources within a notebook
 			notebooks.GET("/:id/sources", s.handleListSources)
-			notebooks.POST("/:id/sources", s.handleAddSource)
+			notebooks.POST("/:id/sources", idempotent, s.handleAddSource)
+			notebooks.PUT("/:id/sources/:sourceId", s.handleUpdateSource)
 			notebooks.DELETE("/:id/sources/:sourceId", s.handleDeleteSource)
+			notebooks.GET("/:id/sources/duplicates", s.handleListDuplicateSources)
+			notebooks.GET("/:id/sources/stale", s.handleListStaleSources)
+			notebooks.GET("/:id/sources/:sourceId/freshness", s.handleGetSourceFreshness)
+			notebooks.POST("/:id/sources/:sourceId/check", s.handleCheckSource)
+			notebooks.POST("/:id/sources/:sourceId/refresh", s.handleRefreshSource)
+			notebooks.PUT("/:id/sources/:sourceId/retrieval", s.handleSetSourceRetrieval)
+			notebooks.GET("/:id/sources/:sourceId/content", s.handleGetSourceContent)
+			notebooks.GET("/:id/sources/:sourceId/chunks/:chunkId", s.handleGetSourceChunk)
+			notebooks.GET("/:id/sources/:sourceId/highlights", s.handleListSourceHighlights)
+			notebooks.POST("/:id/sources/:sourceId/highlights", s.handleCreateSourceHighlight)
+			notebooks.PUT("/:id/sources/:sourceId/highlights/:highlightId", s.handleUpdateSourceHighlight)
+			notebooks.DELETE("/:id/sources/:sourceId/highlights/:highlightId", s.handleDeleteSourceHighlight)
+			notebooks.POST("/:id/sources/:sourceId/highlights/:highlightId/note", s.handleHighlightToNote)
+			notebooks.POST("/:id/import/highlights", s.handleImportHighlights)
+			notebooks.POST("/:id/import/bibtex", s.handleImportBibTeX)
+			notebooks.POST("/:id/import/zotero", s.handleImportZotero)
+			notebooks.GET("/:id/sources/:sourceId/citation", s.handleGetCitation)
+			notebooks.GET("/:id/bibliography", s.handleBibliography)
 
 			// Notes within a notebook
 			notebooks.GET("/:id/notes", s.handleListNotes)
-			notebooks.POST("/:id/notes", s.handleCreateNote)
+			notebooks.POST("/:id/notes", idempotent, s.handleCreateNote)
+			notebooks.GET("/:id/notes/:noteId", s.handleGetNote)
 			notebooks.DELETE("/:id/notes/:noteId", s.handleDeleteNote)
+			notebooks.PUT("/:id/notes/:noteId/properties", s.handleSetNoteProperties)
+			notebooks.POST("/:id/notes/:noteId/images", s.handleGenerateNoteImage)
+			notebooks.GET("/:id/notes/:noteId/speech", s.handleNoteSpeech)
+			notebooks.GET("/:id/notes/:noteId/publish", s.handleGetPublication)
+			notebooks.PUT("/:id/notes/:noteId/publish", s.handlePublishNote)
+			notebooks.DELETE("/:id/notes/:noteId/publish", s.handleUnpublishNote)
+			notebooks.GET("/:id/properties", s.handleListProperties)
+
+			// Smart notebooks
+			notebooks.PUT("/:id/search", s.handleUpdateSmartSearch)
+			notebooks.GET("/:id/search/results", s.handleGetSmartResults)
+
+			// Saved views over notes
+			notebooks.GET("/:id/views", s.handleListViews)
+			notebooks.POST("/:id/views", s.handleCreateView)
+			notebooks.GET("/:id/views/:viewId", s.handleGetView)
+			notebooks.PUT("/:id/views/:viewId", s.handleUpdateView)
+			notebooks.DELETE("/:id/views/:viewId", s.handleDeleteView)
+			notebooks.GET("/:id/views/:viewId/notes", s.handleGetViewNotes)
 
 			// Transformations
 			notebooks.POST("/:id/transform", s.handleTransform)
+			notebooks.POST("/:id/structured", s.handleStructured)
+			notebooks.POST("/:id/analysis", s.handleAnalyzeSources)
+
+			// Topics
+			notebooks.GET("/:id/topics", s.handleGetTopics)
+			notebooks.POST("/:id/topics/refresh", s.handleRefreshTopics)
+
+			// Timeline
+			notebooks.GET("/:id/timeline", s.handleGetTimeline)
+
+			// Entities
+			notebooks.POST("/:id/entities/extract", s.handleExtractNotebookEntities)
 
 			// Chat within a notebook
 			notebooks.GET("/:id/chat/sessions", s.handleListChatSessions)
-			notebooks.POST("/:id/chat/sessions", s.handleCreateChatSession)
+			notebooks.POST("/:id/chat/sessions", idempotent, s.handleCreateChatSession)
 			notebooks.DELETE("/:id/chat/sessions/:sessionId", s.handleDeleteChatSession)
-			notebooks.POST("/:id/chat/sessions/:sessionId/messages", s.handleSendMessage)
+			notebooks.POST("/:id/chat/sessions/:sessionId/messages", idempotent, s.handleSendMessage)
+			notebooks.POST("/:id/chat/sessions/:sessionId/stop", s.handleStopChat)
+			notebooks.GET("/:id/chat/sessions/:sessionId/messages/:messageId/speech", s.handleChatMessageSpeech)
+			notebooks.PUT("/:id/chat/sessions/:sessionId/messages/:messageId/feedback", s.handleSetMessageFeedback)
+			notebooks.DELETE("/:id/chat/sessions/:sessionId/messages/:messageId/feedback", s.handleDeleteMessageFeedback)
+			notebooks.PUT("/:id/chat/sessions/:sessionId/notebooks", s.handleUpdateChatSessionNotebooks)
+			notebooks.GET("/:id/chat/sessions/:sessionId/export", s.handleExportChatSession)
+			notebooks.POST("/:id/chat/finetune-export", s.handleFineTuneExport)
 
 			// Quick chat (auto-create session)
-			notebooks.POST("/:id/chat", s.handleChat)
+			notebooks.POST("/:id/chat", idempotent, s.handleChat)
+
+			// Chat settings
+			notebooks.GET("/:id/chat/settings", s.handleGetChatSettings)
+			notebooks.PUT("/:id/chat/settings", s.handleUpdateChatSettings)
+			notebooks.POST("/:id/chat/settings/reset", s.handleResetChatSettings)
+
+			// Scheduled prompts
+			notebooks.GET("/:id/scheduled-prompts", s.handleListScheduledPrompts)
+			notebooks.POST("/:id/scheduled-prompts", s.handleCreateScheduledPrompt)
+			notebooks.PUT("/:id/scheduled-prompts/:promptId", s.handleUpdateScheduledPrompt)
+			notebooks.DELETE("/:id/scheduled-prompts/:promptId", s.handleDeleteScheduledPrompt)
+			notebooks.POST("/:id/scheduled-prompts/:promptId/run", s.handleRunScheduledPrompt)
+			notebooks.GET("/:id/scheduled-prompts/:promptId/runs", s.handleListScheduledPromptRuns)
+
+			// Evaluation of the chat pipeline against test questions
+			notebooks.GET("/:id/evals/cases", s.handleListEvalCases)
+			notebooks.POST("/:id/evals/cases", s.handleCreateEvalCase)
+			notebooks.PUT("/:id/evals/cases/:caseId", s.handleUpdateEvalCase)
+			notebooks.DELETE("/:id/evals/cases/:caseId", s.handleDeleteEvalCase)
+			notebooks.POST("/:id/evals/runs", s.handleStartEvalRun)
+			notebooks.GET("/:id/evals/runs", s.handleListEvalRuns)
+			notebooks.GET("/:id/evals/runs/:runId", s.handleGetEvalRun)
+
+			// A/B experiments splitting chat sessions between variants
+			notebooks.GET("/:id/experiments", s.handleListExperiments)
+			notebooks.POST("/:id/experiments", s.handleCreateExperiment)
+			notebooks.GET("/:id/experiments/:experimentId", s.handleGetExperiment)
+			notebooks.POST("/:id/experiments/:experimentId/stop", s.handleStopExperiment)
+			notebooks.DELETE("/:id/experiments/:experimentId", s.handleDeleteExperiment)
+			notebooks.GET("/:id/experiments/:experimentId/results", s.handleExperimentResults)
+
+			// Kanban boards
+			notebooks.GET("/:id/boards", s.handleListBoards)
+			notebooks.POST("/:id/boards", s.handleCreateBoard)
+			notebooks.GET("/:id/boards/:boardId", s.handleGetBoard)
+			notebooks.PUT("/:id/boards/:boardId", s.handleUpdateBoard)
+			notebooks.DELETE("/:id/boards/:boardId", s.handleDeleteBoard)
+			notebooks.POST("/:id/boards/:boardId/columns", s.handleCreateBoardColumn)
+			notebooks.PUT("/:id/boards/:boardId/columns/:columnId", s.handleUpdateBoardColumn)
+			notebooks.DELETE("/:id/boards/:boardId/columns/:columnId", s.handleDeleteBoardColumn)
+			notebooks.POST("/:id/boards/:boardId/cards", s.handleCreateBoardCard)
+			notebooks.PUT("/:id/boards/:boardId/cards/:cardId/move", s.handleMoveBoardCard)
+			notebooks.DELETE("/:id/boards/:boardId/cards/:cardId", s.handleDeleteBoardCard)
+
+			// Scripting hooks
+			notebooks.GET("/:id/hooks", s.handleListHooks)
+			notebooks.POST("/:id/hooks", s.handleCreateHook)
+			notebooks.POST("/:id/hooks/test", s.handleTestHook)
+			notebooks.PUT("/:id/hooks/:hookId", s.handleUpdateHook)
+			notebooks.DELETE("/:id/hooks/:hookId", s.handleDeleteHook)
+
+			// Email-in address
+			notebooks.GET("/:id/email", s.handleGetEmailInbox)
+			notebooks.POST("/:id/email", s.handleCreateEmailInbox)
+			notebooks.PUT("/:id/email", s.handleUpdateEmailInbox)
+
+			// Telegram and Slack bots
+			notebooks.GET("/:id/bots", s.handleListBots)
+			notebooks.POST("/:id/bots", s.handleCreateBot)
+			notebooks.PUT("/:id/bots/:botId", s.handleUpdateBot)
+			notebooks.DELETE("/:id/bots/:botId", s.handleDeleteBot)
 		}
 
 		// Upload endpoint
-		api.POST("/upload", s.handleUpload)
+		api.POST("/upload", idempotent, s.handleUpload)
+		api.POST("/upload/sessions", s.handleCreateUploadSession)
+		api.HEAD("/upload/sessions/:uploadId", s.handleGetUploadSession)
+		api.GET("/upload/sessions/:uploadId", s.handleGetUploadSession)
+		api.PATCH("/upload/sessions/:uploadId", s.handleAppendUploadChunk)
+		api.POST("/upload/sessions/:uploadId/complete", idempotent, s.handleCompleteUploadSession)
+		api.DELETE("/upload/sessions/:uploadId", s.handleDeleteUploadSession)
+
+		// Inbound email webhook
+		api.POST("/inbound/email", s.handleInboundEmail)
+
+		// Browser clipper
+		api.POST("/clip", idempotent, s.handleClip)
+
+		// Quick capture
+		api.POST("/capture", idempotent, s.handleCapture)
+		api.GET("/inbox", s.handleListInbox)
+		api.GET("/inbox/count", s.handleInboxCount)
+		api.POST("/inbox/:noteId/move", s.handleMoveInboxNote)
+		api.POST("/inbox/:noteId/convert", s.handleConvertInboxNote)
+		api.POST("/inbox/:noteId/merge", s.handleMergeInboxNote)
+		api.POST("/inbox/:noteId/snooze", s.handleSnoozeInboxNote)
+		api.DELETE("/inbox/:noteId/snooze", s.handleUnsnoozeInboxNote)
+
+		// Entities and the graph of what mentions them
+		api.GET("/entities", s.handleListEntities)
+		api.GET("/entities/:entityId", s.handleGetEntity)
+		api.GET("/graph", s.handleGetGraph)
+
+		// Tag and filing suggestions
+		api.GET("/notes/:noteId/suggestions", s.handleGetNoteSuggestions)
+		api.POST("/notes/:noteId/suggestions/feedback", s.handleSuggestionFeedback)
+
+		// Related notes and sources
+		api.GET("/notes/:noteId/related", s.handleGetRelated)
+
+		// References to sources, chat messages and notes
+		api.GET("/notes/:noteId/references", s.handleListReferences)
+		api.POST("/notes/:noteId/references", s.handleCreateReference)
+		api.DELETE("/notes/:noteId/references/:referenceId", s.handleDeleteReference)
+
+		// Comment threads
+		api.GET("/notes/:noteId/comments", s.handleListComments)
+		api.POST("/notes/:noteId/comments", s.handleCreateComment)
+		api.PUT("/notes/:noteId/comments/:commentId", s.handleUpdateComment)
+		api.DELETE("/notes/:noteId/comments/:commentId", s.handleDeleteComment)
+
+		// Attachments
+		api.GET("/attachments/:attachmentId", s.handleGetAttachment)
+		api.GET("/attachments/:attachmentId/thumbnail", s.handleGetAttachmentThumbnail)
+		api.POST("/attachments/:attachmentId/signed-url", s.handleSignAttachmentURL)
+
+		// Chat tools
+		api.GET("/tools", s.handleListTools)
+
+		// Source processor plugins
+		api.GET("/processors", s.handleListProcessors)
+
+		// Model Context Protocol endpoint
+		api.POST("/mcp", s.handleMCP)
+
+		// First-run setup, until the first user exists
+		s.addSetupRoutes(api)
+		api.POST("/settings/providers/test", s.handleTestProviders)
+
+		// Settings
+		api.GET("/settings", s.handleGetSettings)
+		api.PATCH("/settings", s.handleUpdateSettings)
+		api.GET("/settings/schema", s.handleGetSettingsSchema)
+
+		// Notification inbox
+		api.GET("/notifications", s.handleListNotifications)
+		api.POST("/notifications/read", s.handleMarkAllNotificationsRead)
+		api.POST("/notifications/:notificationId/read", s.handleMarkNotificationRead)
+		api.DELETE("/notifications/:notificationId", s.handleDeleteNotification)
+
+		// Mobile apps: push notification devices and catching up in one request
+		api.GET("/devices", s.handleListPushDevices)
+		api.POST("/devices", s.handleRegisterPushDevice)
+		api.DELETE("/devices/:deviceId", s.handleDeletePushDevice)
+		api.GET("/sync", s.handleSync)
+
+		// The workspace's notes published at public URLs
+		api.GET("/published", s.handleListPublications)
+
+		admin := api.Group("/admin")
+		admin.Use(s.AdminMiddleware())
+		{
+			admin.GET("/settings", s.handleGetInstanceSettings)
+			admin.PATCH("/settings", s.handleUpdateInstanceSettings)
+			admin.GET("/config", s.handleGetConfig)
+			admin.POST("/config/reload", s.handleReloadConfig)
+			admin.GET("/maintenance", s.handleGetMaintenance)
+			admin.PUT("/maintenance", s.handleSetMaintenance)
+			admin.GET("/instance/export", s.handleExportInstance)
+			admin.POST("/instance/import", s.handleImportInstance)
+			admin.GET("/retention", s.handleGetRetention)
+			admin.POST("/retention/run", s.handleRunRetention)
+			admin.GET("/schedules", s.handleListSchedules)
+			admin.POST("/schedules/:name/run", s.handleRunSchedule)
+			admin.POST("/users/:userId/export", s.handleAdminExportUser)
+			admin.DELETE("/users/:userId", s.handleAdminDeleteUser)
+			admin.DELETE("/users/:userId/2fa", s.handleAdminResetTwoFactor)
+			admin.GET("/account-jobs/:jobId", s.handleAdminGetAccountJob)
+			admin.GET("/account-jobs/:jobId/download", s.handleAdminDownloadAccountExport)
+			admin.POST("/account-jobs/:jobId/signed-url", s.handleAdminSignAccountExport)
+			admin.GET("/prompts", s.handleListPrompts)
+			admin.GET("/prompts/:name", s.handleGetPrompt)
+			admin.POST("/prompts/:name/versions", s.handleCreatePromptVersion)
+			admin.PUT("/prompts/:name/active", s.handleActivatePromptVersion)
+			admin.GET("/llm-calls", s.handleListLLMCalls)
+			admin.GET("/quarantine", s.handleListQuarantine)
+			admin.POST("/quarantine/:quarantineId/release", s.handleReleaseQuarantined)
+			admin.DELETE("/quarantine/:quarantineId", s.handleDeleteQuarantined)
+			admin.GET("/debug/pprof/*profile", s.handlePprof)
+			admin.POST("/debug/pprof/*profile", s.handlePprof)
+		}
 	}
 }
 
@@ -146,6 +617,7 @@ func (s *Server) loadNotebookVectorIndex(ctx context.Context, notebookID string)
 	defer s.vectorMutex.Unlock()
 
 	// Check if already loaded
+	s.touchNotebook(notebookID)
 	if s.loadedNotebooks[notebookID] {
 		return nil
 	}
@@ -157,15 +629,21 @@ func (s *Server) loadNotebookVectorIndex(ctx context.Context, notebookID string)
 		return fmt.Errorf("failed to list sources: %w", err)
 	}
 
+	// Embeddings saved with the notebook are reused instead of recomputed
+	s.vectorStore.OpenNotebookIndex(notebookID)
 	for _, src := range sources {
-		if src.Content != "" {
-			if _, err := s.vectorStore.IngestText(ctx, src.Name, src.Content); err != nil {
+		// Sources added since the notebook was unloaded are already indexed
+		if src.Content != "" && !s.vectorStore.HasSource(src.ID) {
+			if _, err := s.indexSource(ctx, &src); err != nil {
 				golog.Errorf("failed to load source %s: %v", src.Name, err)
 			}
 		}
 	}
+	s.loadNotebookHighlights(ctx, notebookID)
+	s.loadNotebookLanguage(ctx, notebookID)
 
 	s.loadedNotebooks[notebookID] = true
+	s.evictNotebooks(notebookID)
 	stats, _ := s.vectorStore.GetStats(ctx)
 	golog.Infof("✅ notebook %s loaded into vector store (%d total documents)", notebookID, stats.TotalDocuments)
 
@@ -175,8 +653,108 @@ func (s *Server) loadNotebookVectorIndex(ctx context.Context, notebookID string)
 // Start starts the server
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%s", s.cfg.ServerHost, s.cfg.ServerPort)
-	golog.Infof("server starting on %s", addr)
-	return s.http.Run(addr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve starts the background jobs and serves HTTP on l until Shutdown
+func (s *Server) Serve(l net.Listener) error {
+	golog.Infof("server starting on %s", l.Addr())
+
+	if err := s.store.FailInterruptedEvalRuns(context.Background()); err != nil {
+		golog.Errorf("failed to close interrupted eval runs: %v", err)
+	}
+
+	s.scheduleJobs()
+	s.heartbeats.register("scheduler", schedulerTick)
+	s.runJob(func() {
+		s.scheduler.start(s.stopping, s.maintenance.ReadOnly, func() { s.heartbeats.beat("scheduler") })
+	})
+	s.heartbeats.register("outbox", outboxPollInterval)
+	s.runJob(func() {
+		s.outbox.start(s.stopping, s.maintenance.ReadOnly, func() { s.heartbeats.beat("outbox") })
+	})
+	if file := s.cfg.ConfigFile(); file != "" {
+		s.runJob(func() { s.startConfigWatcher(file) })
+	}
+
+	if s.cfg.ACMEEnabled {
+		if err := s.serveACME(); err != nil {
+			return fmt.Errorf("failed to serve HTTPS: %w", err)
+		}
+	}
+
+	s.httpServer = &http.Server{Addr: l.Addr().String(), Handler: s.handler()}
+	if err := s.httpServer.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// runJob starts a background job that Shutdown waits for
+func (s *Server) runJob(job func()) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		job()
+	}()
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests
+// (including streaming chat responses) and background jobs to finish, then
+// closes the stores. Jobs stop between runs, so a run in progress completes.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopping) })
+	golog.Infof("shutting down, draining in-flight requests")
+
+	var err error
+	if s.httpServer != nil {
+		if err = s.httpServer.Shutdown(ctx); err != nil {
+			golog.Errorf("http server shutdown: %v", err)
+		}
+	}
+	for _, srv := range s.acmeServers {
+		if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil {
+			golog.Errorf("https server shutdown: %v", shutdownErr)
+			if err == nil {
+				err = shutdownErr
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		golog.Errorf("background jobs did not stop before the shutdown deadline")
+		if err == nil {
+			err = ctx.Err()
+		}
+		return err
+	}
+
+	if closeErr := s.store.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	golog.Infof("shutdown complete")
+	return err
+}
+
+// isStopping reports whether shutdown has begun
+func (s *Server) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
 }
 
 // Health check handler
@@ -202,44 +780,89 @@ func (s *Server) handleConfig(c *gin.Context) {
 
 func (s *Server) handleListNotebooks(c *gin.Context) {
 	ctx := context.Background()
+	fields, err := parseFields(c, Notebook{})
+	if validationResponse(c, err) {
+		return
+	}
+	// With ?since=<cursor> only the IDs changed since then
+	if s.listChanges(c, ChangeNotebook, currentWorkspace(c).ID) {
+		return
+	}
 	notebooks, err := s.store.ListNotebooks(ctx)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebooks"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notebooks"})
 		return
 	}
-	c.JSON(http.StatusOK, notebooks)
+	visible := notebookListFilter(c)
+	filtered := make([]Notebook, 0, len(notebooks))
+	for _, nb := range filterWorkspaceNotebooks(notebooks, currentWorkspace(c).ID) {
+		if visible(nb.ArchivedAt, nb.TrashedAt) {
+			filtered = append(filtered, nb)
+		}
+	}
+	c.JSON(http.StatusOK, fields.projectRows(filtered))
 }
 
 func (s *Server) handleListNotebooksWithStats(c *gin.Context) {
 	ctx := context.Background()
+	fields, err := parseFields(c, NotebookWithStats{})
+	if validationResponse(c, err) {
+		return
+	}
 	notebooks, err := s.store.ListNotebooksWithStats(ctx)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebooks with stats"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notebooks with stats"})
 		return
 	}
-	c.JSON(http.StatusOK, notebooks)
+
+	workspaceID := currentWorkspace(c).ID
+	visible := notebookListFilter(c)
+	filtered := make([]NotebookWithStats, 0, len(notebooks))
+	for _, nb := range notebooks {
+		if nb.WorkspaceID == workspaceID && visible(nb.ArchivedAt, nb.TrashedAt) {
+			filtered = append(filtered, nb)
+		}
+	}
+	c.JSON(http.StatusOK, fields.projectRows(filtered))
 }
 
 func (s *Server) handleCreateNotebook(c *gin.Context) {
 	ctx := context.Background()
 
 	var req struct {
-		Name        string                 `json:"name" binding:"required"`
-		Description string                 `json:"description"`
-		Metadata    map[string]interface{} `json:"metadata"`
+		Name        string                 `json:"name" binding:"required,max=200"`
+		Description string                 `json:"description" binding:"max=2000"`
+		Language    string                 `json:"language"`
+		Metadata    map[string]interface{} `json:"metadata" binding:"metadata"`
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	if !bindJSON(c, &req) {
+		return
+	}
+	language, err := normalizeLanguage(req.Language)
+	if validationResponse(c, err) {
 		return
 	}
 
-	notebook, err := s.store.CreateNotebook(ctx, req.Name, req.Description, req.Metadata)
+	ws := currentWorkspace(c)
+	if err := s.checkNotebookQuota(ctx, ws); err != nil {
+		storeErrorResponse(c, err, "Failed to create notebook")
+		return
+	}
+
+	notebook, err := s.store.CreateNotebookInWorkspace(ctx, ws.ID, req.Name, req.Description, req.Metadata)
 	if err != nil {
 		golog.Errorf("error creating notebook: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to create notebook: %v", err)})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to create notebook: %v", err)})
 		return
 	}
+	if language != "" {
+		if err := s.setNotebookLanguage(ctx, notebook.ID, language); err != nil {
+			storeErrorResponse(c, err, "Failed to create notebook")
+			return
+		}
+		notebook.Language = language
+	}
 
 	c.JSON(http.StatusCreated, notebook)
 }
@@ -250,7 +873,7 @@ func (s *Server) handleGetNotebook(c *gin.Context) {
 
 	notebook, err := s.store.GetNotebook(ctx, id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
 		return
 	}
 
@@ -262,21 +885,46 @@ func (s *Server) handleUpdateNotebook(c *gin.Context) {
 	id := c.Param("id")
 
 	var req struct {
-		Name        string                 `json:"name"`
-		Description string                 `json:"description"`
-		Metadata    map[string]interface{} `json:"metadata"`
+		Name        string `json:"name" binding:"max=200"`
+		Description string `json:"description" binding:"max=2000"`
+		// Language is kept when left out; "" clears it
+		Language *string                `json:"language"`
+		Metadata map[string]interface{} `json:"metadata" binding:"metadata"`
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	if !bindJSON(c, &req) {
 		return
 	}
+	if req.Language != nil {
+		language, err := normalizeLanguage(*req.Language)
+		if validationResponse(c, err) {
+			return
+		}
+		req.Language = &language
+	}
+
+	// A smart notebook keeps its search unless the metadata replaces it
+	if existing, err := s.store.GetNotebook(ctx, id); err == nil && existing.Type == NotebookTypeSmart {
+		if _, ok := req.Metadata[smartSearchKey]; !ok {
+			if req.Metadata == nil {
+				req.Metadata = map[string]interface{}{}
+			}
+			req.Metadata[smartSearchKey] = existing.Metadata[smartSearchKey]
+		}
+	}
 
 	notebook, err := s.store.UpdateNotebook(ctx, id, req.Name, req.Description, req.Metadata)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update notebook"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update notebook"})
 		return
 	}
+	if req.Language != nil && *req.Language != notebook.Language {
+		if err := s.setNotebookLanguage(ctx, id, *req.Language); err != nil {
+			storeErrorResponse(c, err, "Failed to update notebook")
+			return
+		}
+		notebook.Language = *req.Language
+	}
 
 	c.JSON(http.StatusOK, notebook)
 }
@@ -285,8 +933,12 @@ func (s *Server) handleDeleteNotebook(c *gin.Context) {
 	ctx := context.Background()
 	id := c.Param("id")
 
+	if !s.requireStepUp(c) {
+		return
+	}
+
 	if err := s.store.DeleteNotebook(ctx, id); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete notebook"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete notebook"})
 		return
 	}
 
@@ -299,29 +951,70 @@ func (s *Server) handleListSources(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
 
+	// Leave out heavy fields with ?fields=id,name,type
+	fields, err := parseFields(c, Source{})
+	if validationResponse(c, err) {
+		return
+	}
+
+	if nb, err := s.store.GetNotebook(ctx, notebookID); err == nil && nb.Type == NotebookTypeSmart {
+		if c.Query("since") != "" {
+			validationResponse(c, invalidField("since", "is not supported for smart notebooks"))
+			return
+		}
+		results, err := s.smartResults(ctx, nb)
+		if err != nil {
+			storeErrorResponse(c, err, "Failed to list sources")
+			return
+		}
+		c.JSON(http.StatusOK, fields.projectRows(results.Sources))
+		return
+	}
+
+	// With ?since=<cursor> only the IDs changed since then
+	if s.listChanges(c, ChangeSource, notebookID) {
+		return
+	}
+
+	if wantsNDJSON(c) {
+		streamNDJSON(c, "sources", func(emit func(any) error) error {
+			return s.store.Store.EachSource(c.Request.Context(), notebookID, func(src *Source) error {
+				return emit(fields.project(src))
+			})
+		})
+		return
+	}
+
 	sources, err := s.store.ListSources(ctx, notebookID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
 		return
 	}
 
-	c.JSON(http.StatusOK, sources)
+	c.JSON(http.StatusOK, fields.projectRows(sources))
 }
 
 func (s *Server) handleAddSource(c *gin.Context) {
-	ctx := context.Background()
+	// Fetching and extracting stop when the client disconnects or take too long
+	ctx, cancel := operationContext(c, s.cfg.IngestTimeout)
+	defer cancel()
 	notebookID := c.Param("id")
 
 	var req struct {
-		Name     string                 `json:"name" binding:"required"`
-		Type     string                 `json:"type" binding:"required"`
-		URL      string                 `json:"url"`
+		Name     string                 `json:"name" binding:"required,max=200"`
+		Type     string                 `json:"type" binding:"required,max=50"`
+		URL      string                 `json:"url" binding:"omitempty,url"`
 		Content  string                 `json:"content"`
-		Metadata map[string]interface{} `json:"metadata"`
+		Metadata map[string]interface{} `json:"metadata" binding:"metadata"`
+		// OnDuplicate is "link" (default), "allow" or "reject"
+		OnDuplicate string `json:"on_duplicate" binding:"omitempty,oneof=link allow reject"`
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := s.checkUploadSize("content", int64(len(req.Content))); err != nil {
+		validationResponse(c, err)
 		return
 	}
 
@@ -337,28 +1030,36 @@ func (s *Server) handleAddSource(c *gin.Context) {
 	// If URL is provided and Content is empty, fetch content from URL
 	if req.URL != "" {
 		golog.Infof("fetching content from URL: %s", req.URL)
-		content, err := s.vectorStore.ExtractFromURL(ctx, req.URL)
+		content, extracted, err := s.vectorStore.ExtractFromURLWithMetadata(ctx, req.URL)
 		if err != nil {
+			if s.canceledResponse(c, ctx, err) {
+				return
+			}
+			var localErr *LocalOnlyError
+			if errors.As(err, &localErr) {
+				c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: err.Error()})
+				return
+			}
 			golog.Errorf("failed to fetch URL content: %v", err)
-			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to fetch URL content: %v", err)})
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to fetch URL content: %v", err)})
 			return
 		}
 		source.Content = content
+		mergeMetadata(source, extracted)
 		golog.Infof("URL content fetched successfully, size: %d bytes", len(content))
 	}
 
-	if err := s.store.CreateSource(ctx, source); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
+	// Ingest into vector store (synchronous for immediate availability). This
+	// is not cancelled when the client goes away, so a source is never left
+	// half indexed; embedding is still bounded by INGEST_TIMEOUT.
+	existing, err := s.ingestSourceDedup(context.WithoutCancel(ctx), source, req.OnDuplicate)
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to create source")
 		return
 	}
-
-	// Ingest into vector store (synchronous for immediate availability)
-	if source.Content != "" {
-		if chunkCount, err := s.vectorStore.IngestText(ctx, source.Name, source.Content); err != nil {
-			golog.Errorf("failed to ingest text: %v", err)
-		} else {
-			s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
-		}
+	if existing != nil {
+		c.JSON(http.StatusOK, existing)
+		return
 	}
 
 	c.JSON(http.StatusCreated, source)
@@ -366,27 +1067,127 @@ func (s *Server) handleAddSource(c *gin.Context) {
 
 func (s *Server) handleDeleteSource(c *gin.Context) {
 	ctx := context.Background()
-	sourceID := c.Param("sourceId")
 
-	if err := s.store.DeleteSource(ctx, sourceID); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete source"})
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteSource(ctx, source.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete source"})
 		return
 	}
 
 	c.Status(http.StatusNoContent)
 }
 
-func (s *Server) handleUpload(c *gin.Context) {
+// handleUpdateSource renames a source or replaces its text. Only the chunks
+// the edit touches are embedded again.
+func (s *Server) handleUpdateSource(c *gin.Context) {
 	ctx := context.Background()
+
+	var req struct {
+		Name    *string `json:"name" binding:"omitempty,min=1,max=200"`
+		Content *string `json:"content"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	if req.Content != nil {
+		if err := s.checkUploadSize("content", int64(len(*req.Content))); err != nil {
+			validationResponse(c, err)
+			return
+		}
+		if err := s.checkStorageQuota(ctx, source.NotebookID, int64(len(*req.Content)-len(source.Content))); err != nil {
+			storeErrorResponse(c, err, "Failed to check storage quota")
+			return
+		}
+		source.Content = *req.Content
+	}
+	if req.Name != nil {
+		source.Name = *req.Name
+	}
+
+	if err := s.store.UpdateSource(ctx, source); err != nil {
+		storeErrorResponse(c, err, "Failed to update source")
+		return
+	}
+
+	chunkCount, err := s.reindexSource(ctx, source)
+	if err != nil {
+		golog.Errorf("failed to reindex source %s: %v", source.ID, err)
+	} else {
+		source.ChunkCount = chunkCount
+		s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
+	}
+
+	c.JSON(http.StatusOK, source)
+}
+
+func (s *Server) handleSetSourceRetrieval(c *gin.Context) {
+	ctx := context.Background()
+
+	var req struct {
+		Included *bool `json:"included" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.SetSourceIncluded(ctx, source.ID, *req.Included); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update source"})
+		return
+	}
+
+	source.IncludedInRetrieval = *req.Included
+
+	c.JSON(http.StatusOK, source)
+}
+
+func (s *Server) handleUpload(c *gin.Context) {
+	// Fetching and extracting stop when the client disconnects or take too long
+	ctx, cancel := operationContext(c, s.cfg.IngestTimeout)
+	defer cancel()
+
+	// Parse the form first, so a body over the limit is reported as such
+	if err := c.Request.ParseMultipartForm(s.http.MaxMultipartMemory); bodyTooLargeResponse(c, err) {
+		return
+	}
 	notebookID := c.PostForm("notebook_id")
 	if notebookID == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "notebook_id required"})
+		validationResponse(c, invalidField("notebook_id", "is required"))
 		return
 	}
 
 	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required"})
+		if bodyTooLargeResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "file required"})
+		return
+	}
+
+	if err := s.checkUploadSize("file", file.Size); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	// Reject uploads that cannot fit before saving and extracting them
+	if err := s.checkStorageQuota(ctx, notebookID, file.Size); err != nil {
+		if !quotaResponse(c, err) {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check storage quota"})
+		}
 		return
 	}
 
@@ -399,67 +1200,99 @@ func (s *Server) handleUpload(c *gin.Context) {
 	// Ensure uploads directory exists
 	if err := os.MkdirAll("./data/uploads", 0755); err != nil {
 		golog.Errorf("failed to create uploads directory: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create uploads directory"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create uploads directory"})
 		return
 	}
 
 	// Save file
 	if err := c.SaveUploadedFile(file, tempPath); err != nil {
 		golog.Errorf("failed to save file: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to save file: %v", err)})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to save file: %v", err)})
 		return
 	}
 
-	// Create source
+	s.createUploadedSource(c, ctx, savedUpload{
+		NotebookID:  notebookID,
+		Name:        file.Filename,
+		FileName:    uniqueFileName,
+		Path:        tempPath,
+		Size:        file.Size,
+		ContentType: file.Header.Get("Content-Type"),
+	}, c.PostForm("on_duplicate"))
+}
+
+// savedUpload is a file stored in the uploads directory that is about to
+// become a source
+type savedUpload struct {
+	NotebookID string
+	// Name is the original file name, shown as the source name
+	Name string
+	// FileName is the unique name the file is stored under
+	FileName    string
+	Path        string
+	Size        int64
+	ContentType string
+	// Released files were flagged by the malware scanner and then released
+	// by an admin, so they are not scanned again
+	Released bool
+}
+
+// createUploadedSource extracts and indexes an uploaded file as a new source
+// and writes the response. The file is removed if no source is created.
+func (s *Server) createUploadedSource(c *gin.Context, ctx context.Context, upload savedUpload, onDuplicate string) {
+	if !upload.Released {
+		uploadedBy := ""
+		if user := currentUser(c); user != nil {
+			uploadedBy = user.ID
+		}
+		if err := s.scanUpload(ctx, upload, "upload", uploadedBy); scanErrorResponse(c, err) {
+			return
+		}
+	}
+
 	source := &Source{
-		NotebookID: notebookID,
-		Name:       file.Filename, // Keep original filename for display
+		NotebookID: upload.NotebookID,
+		Name:       upload.Name, // Keep original filename for display
 		Type:       "file",
-		FileName:   uniqueFileName, // Store unique filename
-		FileSize:   file.Size,
-		Metadata:   map[string]interface{}{"path": tempPath},
+		FileName:   upload.FileName, // Store unique filename
+		FileSize:   upload.Size,
+		Metadata:   map[string]interface{}{"path": upload.Path},
 	}
 
 	// Extract content
-	content, err := s.vectorStore.ExtractDocument(ctx, tempPath)
+	content, extracted, err := s.vectorStore.ExtractDocumentWithMetadata(ctx, upload.Path, upload.Name, upload.ContentType)
 	if err != nil {
 		golog.Errorf("failed to extract document content: %v", err)
 		// Clean up uploaded file on error
-		os.Remove(tempPath)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to extract document content: %v", err)})
+		os.Remove(upload.Path)
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to extract document content: %v", err)})
 		return
 	}
 	source.Content = content
+	mergeMetadata(source, extracted)
 
-	if err := s.store.CreateSource(ctx, source); err != nil {
+	// Ingest into vector store (synchronous for immediate availability). This
+	// is not cancelled when the client goes away, so a source is never left
+	// half indexed; embedding is still bounded by INGEST_TIMEOUT.
+	existing, err := s.ingestSourceDedup(context.WithoutCancel(ctx), source, onDuplicate)
+	if err != nil || existing != nil {
+		// The uploaded file is not needed when no new source was created
+		os.Remove(upload.Path)
+	}
+	if err != nil {
 		golog.Errorf("failed to create source: %v", err)
-		// Clean up uploaded file on error
-		os.Remove(tempPath)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
+		storeErrorResponse(c, err, "Failed to create source")
 		return
 	}
-
-	// Ingest into vector store (synchronous for immediate availability)
-	// Get chunk count from vector store stats
-	stats, _ := s.vectorStore.GetStats(ctx)
-	totalDocsBefore := stats.TotalDocuments
-
-	if source.Content != "" {
-		if _, err := s.vectorStore.IngestText(ctx, source.Name, source.Content); err != nil {
-			golog.Errorf("failed to ingest document: %v", err)
-		} else {
-			// Get updated stats to calculate chunk count
-			stats, _ = s.vectorStore.GetStats(ctx)
-			chunkCount := stats.TotalDocuments - totalDocsBefore
-
-			// Update source with chunk count
-			source.ChunkCount = chunkCount
-
-			// Update in database
-			s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
-		}
+	if existing != nil {
+		c.JSON(http.StatusOK, existing)
+		return
 	}
 
+	s.createSourcePreview(context.WithoutCancel(ctx), source, upload.Path, upload.ContentType)
 	c.JSON(http.StatusCreated, source)
 }
 
@@ -469,13 +1302,75 @@ func (s *Server) handleListNotes(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
 
-	notes, err := s.store.ListNotes(ctx, notebookID)
+	// Narrow by properties with ?filter=name:op:value and order with ?sort=name
+	filters, err := parsePropertyFilters(c.QueryArray("filter"))
+	if validationResponse(c, err) {
+		return
+	}
+	sortBy := c.Query("sort")
+	// Leave out heavy fields with ?fields=id,title,type
+	fields, err := parseFields(c, Note{})
+	if validationResponse(c, err) {
+		return
+	}
+
+	// A smart notebook's notes are its search results
+	smart := false
+	if nb, err := s.store.GetNotebook(ctx, notebookID); err == nil && nb.Type == NotebookTypeSmart {
+		smart = true
+	}
+
+	// With ?since=<cursor> only the IDs changed since then
+	if smart && c.Query("since") != "" {
+		validationResponse(c, invalidField("since", "is not supported for smart notebooks"))
+		return
+	}
+	if !smart && s.listChanges(c, ChangeNote, notebookID) {
+		return
+	}
+
+	if wantsNDJSON(c) && sortBy == "" && !smart {
+		streamNDJSON(c, "notes", func(emit func(any) error) error {
+			return s.store.Store.EachNote(c.Request.Context(), notebookID, func(note *Note) error {
+				if len(filterNotes([]Note{*note}, filters, "")) == 0 {
+					return nil
+				}
+				return emit(fields.project(note))
+			})
+		})
+		return
+	}
+
+	var notes []Note
+	if smart {
+		nb, _ := s.store.GetNotebook(ctx, notebookID)
+		var results *SmartResults
+		if results, err = s.smartResults(ctx, nb); err == nil {
+			notes = results.Notes
+		}
+	} else {
+		notes, err = s.store.ListNotes(ctx, notebookID)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notes"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
 		return
 	}
+	if len(filters) > 0 || sortBy != "" {
+		notes = filterNotes(notes, filters, sortBy)
+	}
 
-	c.JSON(http.StatusOK, notes)
+	if wantsNDJSON(c) {
+		streamNDJSON(c, "notes", func(emit func(any) error) error {
+			for i := range notes {
+				if err := emit(fields.project(&notes[i])); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return
+	}
+	c.JSON(http.StatusOK, fields.projectRows(notes))
 }
 
 func (s *Server) handleCreateNote(c *gin.Context) {
@@ -483,14 +1378,22 @@ func (s *Server) handleCreateNote(c *gin.Context) {
 	notebookID := c.Param("id")
 
 	var req struct {
-		Title     string   `json:"title" binding:"required"`
+		Title     string   `json:"title" binding:"required,max=200"`
 		Content   string   `json:"content" binding:"required"`
-		Type      string   `json:"type" binding:"required"`
-		SourceIDs []string `json:"source_ids"`
+		Type      string   `json:"type" binding:"required,max=50"`
+		SourceIDs []string `json:"source_ids" binding:"dive,uuid"`
+		// Typed properties; YAML frontmatter in the content adds more
+		Properties map[string]NoteProperty `json:"properties"`
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	if !bindJSON(c, &req) {
+		return
+	}
+	props, err := normalizeProperties(req.Properties)
+	if err == nil {
+		err = s.checkRelations(ctx, notebookID, props)
+	}
+	if validationResponse(c, err) {
 		return
 	}
 
@@ -501,21 +1404,39 @@ func (s *Server) handleCreateNote(c *gin.Context) {
 		Type:       req.Type,
 		SourceIDs:  req.SourceIDs,
 	}
+	if len(props) > 0 {
+		setNoteProperties(note, props)
+	}
 
-	if err := s.store.CreateNote(ctx, note); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create note"})
+	if err := s.createNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to create note")
 		return
 	}
 
 	c.JSON(http.StatusCreated, note)
 }
 
+func (s *Server) handleGetNote(c *gin.Context) {
+	ctx := context.Background()
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
 func (s *Server) handleDeleteNote(c *gin.Context) {
 	ctx := context.Background()
-	noteID := c.Param("noteId")
 
-	if err := s.store.DeleteNote(ctx, noteID); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete note"})
+	note, ok := s.notebookNote(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteNote(ctx, note.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete note"})
 		return
 	}
 
@@ -525,7 +1446,9 @@ func (s *Server) handleDeleteNote(c *gin.Context) {
 // Transformation handlers
 
 func (s *Server) handleTransform(c *gin.Context) {
-	ctx := context.Background()
+	// Stop generating when the client disconnects or the LLM takes too long
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
 	notebookID := c.Param("id")
 
 	// 按需加载向量索引
@@ -534,63 +1457,38 @@ func (s *Server) handleTransform(c *gin.Context) {
 	}
 
 	var req TransformationRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	if !bindJSON(c, &req) {
 		return
 	}
+	req.Language = s.notebookLanguage(ctx, notebookID)
 
 	// Check if multiple notes of same type are allowed
 	if !s.cfg.AllowMultipleNotesOfSameType {
 		existingNotes, err := s.store.ListNotes(ctx, notebookID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check existing notes"})
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check existing notes"})
 			return
 		}
 		for _, note := range existingNotes {
 			if note.Type == req.Type {
-				c.JSON(http.StatusConflict, ErrorResponse{Error: "该笔记本已存在相同类型的笔记，不允许创建重复类型"})
+				c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "该笔记本已存在相同类型的笔记，不允许创建重复类型"})
 				return
 			}
 		}
 	}
 
-	// Get sources
-	sources, err := s.store.ListSources(ctx, notebookID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get sources"})
-		return
-	}
-
-	if len(req.SourceIDs) > 0 {
-		// Filter by specified source IDs
-		filtered := make([]Source, 0)
-		sourceMap := make(map[string]bool)
-		for _, id := range req.SourceIDs {
-			sourceMap[id] = true
-		}
-		for _, src := range sources {
-			if sourceMap[src.ID] {
-				filtered = append(filtered, src)
-			}
-		}
-		sources = filtered
-	} else {
-		// If no source IDs specified, use all and populate the list for the note
-		req.SourceIDs = make([]string, len(sources))
-		for i, src := range sources {
-			req.SourceIDs[i] = src.ID
-		}
-	}
-
-	if len(sources) == 0 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No sources available"})
+	sources, ok := s.transformSources(c, ctx, notebookID, &req)
+	if !ok {
 		return
 	}
 
 	// Generate transformation
-	response, err := s.agent.GenerateTransformation(ctx, &req, sources)
+	response, err := s.notebookAgent(ctx, notebookID).GenerateTransformation(ctx, &req, sources)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Generation failed: %v", err)})
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Generation failed: %v", err)})
 		return
 	}
 
@@ -598,10 +1496,16 @@ func (s *Server) handleTransform(c *gin.Context) {
 		"length": req.Length,
 		"format": req.Format,
 	}
+	if answered, ok := response.Metadata["answered_by"]; ok {
+		metadata["answered_by"] = answered
+	}
 
 	// If type is infograph, generate the image as well
 	if req.Type == "infograph" {
 		extra := "**注意：无论来源是什么语言，请务必使用中文**"
+		if req.Language != "" {
+			extra = languageInstruction(req.Language)
+		}
 		prompt := response.Content + "\n\n" + extra
 		imagePath, err := s.agent.provider.GenerateImage(ctx, "gemini-3-pro-image-preview", prompt)
 		if err != nil {
@@ -628,7 +1532,11 @@ func (s *Server) handleTransform(c *gin.Context) {
 				golog.Infof("generating image for slide %d/%d...", i+1, len(slides))
 				// Combine style and slide content for the image generator
 				prompt := fmt.Sprintf("Style: %s\n\nSlide Content: %s", slides[0].Style, slide.Content)
-				prompt += "\n\n**注意：无论来源是什么语言，请务必使用中文**\n"
+				if req.Language != "" {
+					prompt += languageInstruction(req.Language) + "\n"
+				} else {
+					prompt += "\n\n**注意：无论来源是什么语言，请务必使用中文**\n"
+				}
 				imagePath, err := s.agent.provider.GenerateImage(ctx, "gemini-3-pro-image-preview", prompt)
 				if err != nil {
 					golog.Errorf("failed to generate slide %d: %v", i+1, err)
@@ -656,8 +1564,8 @@ func (s *Server) handleTransform(c *gin.Context) {
 		Metadata:   metadata,
 	}
 
-	if err := s.store.CreateNote(ctx, note); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save note"})
+	if err := s.createNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to save note")
 		return
 	}
 
@@ -678,7 +1586,7 @@ func (s *Server) handleTransform(c *gin.Context) {
 			golog.Errorf("failed to create insight source: %v", err)
 		} else {
 			// Ingest into vector store for future reference
-			if chunkCount, err := s.vectorStore.IngestText(ctx, insightSource.Name, insightSource.Content); err != nil {
+			if chunkCount, err := s.indexSource(ctx, insightSource); err != nil {
 				golog.Errorf("failed to ingest insight text: %v", err)
 			} else {
 				s.store.UpdateSourceChunkCount(ctx, insightSource.ID, chunkCount)
@@ -689,6 +1597,50 @@ func (s *Server) handleTransform(c *gin.Context) {
 	c.JSON(http.StatusOK, note)
 }
 
+// transformSources returns the sources a transformation is generated from:
+// those in req.SourceIDs, or else the notebook's sources included in
+// retrieval, whose IDs it fills in. It writes an error response and reports
+// false when there are none.
+func (s *Server) transformSources(c *gin.Context, ctx context.Context, notebookID string, req *TransformationRequest) ([]Source, bool) {
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get sources"})
+		return nil, false
+	}
+
+	if len(req.SourceIDs) > 0 {
+		// Filter by specified source IDs (explicit selection overrides the retrieval toggle)
+		filtered := make([]Source, 0)
+		sourceMap := make(map[string]bool)
+		for _, id := range req.SourceIDs {
+			sourceMap[id] = true
+		}
+		for _, src := range sources {
+			if sourceMap[src.ID] {
+				filtered = append(filtered, src)
+			}
+		}
+		sources = filtered
+	} else {
+		// If no source IDs specified, use all included sources and populate the list for the note
+		included := make([]Source, 0, len(sources))
+		req.SourceIDs = make([]string, 0, len(sources))
+		for _, src := range sources {
+			if src.IncludedInRetrieval {
+				included = append(included, src)
+				req.SourceIDs = append(req.SourceIDs, src.ID)
+			}
+		}
+		sources = included
+	}
+
+	if len(sources) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "No sources available"})
+		return nil, false
+	}
+	return sources, true
+}
+
 func getTitleForType(t string) string {
 	titles := map[string]string{
 		"summary":     "摘要",
@@ -699,10 +1651,12 @@ func getTitleForType(t string) string {
 		"timeline":    "时间线",
 		"glossary":    "术语表",
 		"quiz":        "测验",
+		"flashcards":  "抽认卡",
 		"infograph":   "信息图",
 		"ppt":         "幻灯片",
 		"mindmap":     "思维导图",
 		"insight":     "洞察报告",
+		"analysis":    "矛盾与缺口分析",
 	}
 	if title, ok := titles[t]; ok {
 		return title
@@ -716,13 +1670,21 @@ func (s *Server) handleListChatSessions(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
 
+	fields, err := parseFields(c, ChatSession{})
+	if validationResponse(c, err) {
+		return
+	}
+	// With ?since=<cursor> only the IDs changed since then
+	if s.listChanges(c, ChangeChatSession, notebookID) {
+		return
+	}
 	sessions, err := s.store.ListChatSessions(ctx, notebookID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat sessions"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list chat sessions"})
 		return
 	}
 
-	c.JSON(http.StatusOK, sessions)
+	c.JSON(http.StatusOK, fields.projectRows(sessions))
 }
 
 func (s *Server) handleCreateChatSession(c *gin.Context) {
@@ -730,26 +1692,55 @@ func (s *Server) handleCreateChatSession(c *gin.Context) {
 	notebookID := c.Param("id")
 
 	var req struct {
-		Title string `json:"title"`
+		Title       string   `json:"title"`
+		NotebookIDs []string `json:"notebook_ids"` // additional notebooks to query
 	}
 
 	c.ShouldBindJSON(&req)
 
+	notebookIDs, err := s.resolveChatNotebooks(ctx, notebookID, req.NotebookIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
 	session, err := s.store.CreateChatSession(ctx, notebookID, req.Title)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create chat session"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create chat session"})
 		return
 	}
 
+	if len(notebookIDs) > 1 {
+		if err := s.store.SetChatSessionNotebooks(ctx, session.ID, notebookIDs); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create chat session"})
+			return
+		}
+		session.NotebookIDs = notebookIDs
+	}
+
 	c.JSON(http.StatusCreated, session)
 }
 
+// notebookChatSession loads a chat session of the :id notebook, answering
+// 404 for one of another notebook
+func (s *Server) notebookChatSession(c *gin.Context, sessionID string) (*ChatSession, bool) {
+	session, err := s.store.GetChatSession(c.Request.Context(), sessionID)
+	if err != nil || session.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat session not found"})
+		return nil, false
+	}
+	return session, true
+}
+
 func (s *Server) handleDeleteChatSession(c *gin.Context) {
 	ctx := context.Background()
-	sessionID := c.Param("sessionId")
 
-	if err := s.store.DeleteChatSession(ctx, sessionID); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete chat session"})
+	session, ok := s.notebookChatSession(c, c.Param("sessionId"))
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteChatSession(ctx, session.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete chat session"})
 		return
 	}
 
@@ -757,9 +1748,14 @@ func (s *Server) handleDeleteChatSession(c *gin.Context) {
 }
 
 func (s *Server) handleSendMessage(c *gin.Context) {
-	ctx := context.Background()
+	// Stop generating when the client disconnects or the LLM takes too long
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
 	notebookID := c.Param("id")
 	sessionID := c.Param("sessionId")
+	if _, ok := s.notebookChatSession(c, sessionID); !ok {
+		return
+	}
 
 	// 按需加载向量索引
 	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
@@ -767,29 +1763,48 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 	}
 
 	var req ChatRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	transcript, ok := s.bindChatRequest(c, ctx, notebookID, &req)
+	if !ok {
+		return
+	}
+	if req.WebSearch && s.webSearcher == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Web search is not configured"})
+		return
+	}
+	if !s.moderateChat(c, ctx, sessionID, ModerationStagePrompt, req.Message) {
 		return
 	}
 
 	// Add user message
-	_, err := s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil)
+	_, err := s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil, nil, questionMetadata(transcript))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to add message"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to add message"})
 		return
 	}
 
 	// Get session history
 	session, err := s.store.GetChatSession(ctx, sessionID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get session"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get session"})
 		return
 	}
 
-	// Generate response
-	response, err := s.agent.Chat(ctx, notebookID, req.Message, session.Messages)
+	// Generate response; a stop request ends it with the answer so far
+	ctx, run, done := s.chatRuns.start(s.withLLMCallLog(ctx), sessionID)
+	defer done()
+	response, err := s.runQueuedChat(c, ctx, notebookID, req, session, &run.partial)
+	if chatStopped(ctx) {
+		s.stoppedChatResponse(c, ctx, sessionID, run)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		if chatQueueFullResponse(c, err) || s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Chat failed: %v", err)})
+		return
+	}
+	if !s.moderateChat(c, ctx, sessionID, ModerationStageAnswer, response.Message) {
 		return
 	}
 
@@ -798,17 +1813,22 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 	for i, src := range response.Sources {
 		sourceIDs[i] = src.ID
 	}
-	_, err = s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs)
+	msg, err := s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs, response.ToolCalls, answerMetadata(response))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save response"})
 		return
 	}
+	response.MessageID = msg.ID
+	s.saveLLMCalls(ctx, sessionID, msg.ID)
 
+	response.Transcript = transcript
 	c.JSON(http.StatusOK, response)
 }
 
 func (s *Server) handleChat(c *gin.Context) {
-	ctx := context.Background()
+	// Stop generating when the client disconnects or the LLM takes too long
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
 	notebookID := c.Param("id")
 
 	// 按需加载向量索引
@@ -817,51 +1837,244 @@ func (s *Server) handleChat(c *gin.Context) {
 	}
 
 	var req ChatRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	transcript, ok := s.bindChatRequest(c, ctx, notebookID, &req)
+	if !ok {
+		return
+	}
+	if req.WebSearch && s.webSearcher == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Web search is not configured"})
+		return
+	}
+	if req.SessionID != "" {
+		if _, ok := s.notebookChatSession(c, req.SessionID); !ok {
+			return
+		}
+	}
+	if !s.moderateChat(c, ctx, req.SessionID, ModerationStagePrompt, req.Message) {
 		return
 	}
 
 	// Create or get session
 	sessionID := req.SessionID
 	if sessionID == "" {
+		notebookIDs, err := s.resolveChatNotebooks(ctx, notebookID, req.NotebookIDs)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+			return
+		}
+
 		session, err := s.store.CreateChatSession(ctx, notebookID, "")
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create session"})
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create session"})
 			return
 		}
 		sessionID = session.ID
+
+		if len(notebookIDs) > 1 {
+			if err := s.store.SetChatSessionNotebooks(ctx, sessionID, notebookIDs); err != nil {
+				golog.Errorf("failed to set chat session notebooks: %v", err)
+			}
+		}
 	}
 
 	// Get session history
 	session, err := s.store.GetChatSession(ctx, sessionID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get session"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get session"})
 		return
 	}
 
-	// Generate response
-	response, err := s.agent.Chat(ctx, notebookID, req.Message, session.Messages)
+	// Generate response; a stop request ends it with the answer so far
+	ctx, run, done := s.chatRuns.start(s.withLLMCallLog(ctx), sessionID)
+	defer done()
+	response, err := s.runQueuedChat(c, ctx, notebookID, req, session, &run.partial)
+	if chatStopped(ctx) {
+		s.store.AddChatMessage(context.WithoutCancel(ctx), sessionID, "user", req.Message, nil, nil, questionMetadata(transcript))
+		s.stoppedChatResponse(c, ctx, sessionID, run)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		if chatQueueFullResponse(c, err) || s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Chat failed: %v", err)})
 		return
 	}
 
 	response.SessionID = sessionID
+	if !s.moderateChat(c, ctx, sessionID, ModerationStageAnswer, response.Message) {
+		// The question stays in the session; the answer is withheld
+		s.store.AddChatMessage(context.WithoutCancel(ctx), sessionID, "user", req.Message, nil, nil, questionMetadata(transcript))
+		return
+	}
 
 	// Add messages
 	sourceIDs := make([]string, len(response.Sources))
 	for i, src := range response.Sources {
 		sourceIDs[i] = src.ID
 	}
-	s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil)
-	s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs)
+	response.Transcript = transcript
+	s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil, nil, questionMetadata(transcript))
+	if msg, err := s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs, response.ToolCalls, answerMetadata(response)); err == nil {
+		response.MessageID = msg.ID
+		s.saveLLMCalls(ctx, sessionID, msg.ID)
+	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+// runQueuedChat is runChat once the chat's turn in the queue comes
+func (s *Server) runQueuedChat(c *gin.Context, ctx context.Context, notebookID string, req ChatRequest, session *ChatSession, partial *strings.Builder) (*ChatResponse, error) {
+	release, err := s.queueChat(c, ctx, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.runChat(ctx, notebookID, req, session, partial)
+}
+
+// runChat answers a message with the notebook's chat settings and allowed tools,
+// retrieving from every notebook the session references and optionally
+// blending in web search results. When partial is given the answer is
+// streamed into it, so the part generated before a stop is kept.
+func (s *Server) runChat(ctx context.Context, notebookID string, req ChatRequest, session *ChatSession, partial *strings.Builder) (*ChatResponse, error) {
+	settings, err := s.store.GetChatSettings(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to load chat settings: %v", err)
+	}
+
+	opts := ChatOptions{
+		Settings:    settings,
+		Tools:       s.notebookTools(settings),
+		NotebookIDs: session.NotebookIDs,
+		Language:    s.notebookLanguage(ctx, notebookID),
+		Partial:     partial,
+	}
+	assignment := s.applyExperiment(ctx, notebookID, session.ID, &opts)
+	if len(session.NotebookIDs) > 1 {
+		opts.NotebookNames = s.chatNotebookNames(ctx, session.NotebookIDs)
+	}
+
+	if req.WebSearch {
+		if s.webSearcher == nil {
+			return nil, fmt.Errorf("web search is not configured")
+		}
+		results, err := s.searchWeb(ctx, req.Message)
+		if err != nil {
+			// Answer from notebook sources alone rather than failing the chat
+			golog.Errorf("web search failed: %v", err)
+		}
+		opts.WebResults = results
+	}
+
+	response, err := s.notebookAgent(ctx, notebookID).Chat(ctx, notebookID, req.Message, session.Messages, opts)
+	if err == nil && assignment != nil {
+		response.Metadata["experiment"] = assignment
+	}
+	return response, err
+}
+
+// ingestSource persists a source and indexes its content in the vector store.
+// Indexing failures are logged but do not fail the call, matching the upload flow.
+func (s *Server) ingestSource(ctx context.Context, source *Source) error {
+	if err := s.checkWritable(ctx, source.NotebookID); err != nil {
+		return err
+	}
+	if err := s.checkSourceQuota(ctx, source.NotebookID); err != nil {
+		return err
+	}
+	if err := s.checkStorageQuota(ctx, source.NotebookID, sourceStorageSize(source)); err != nil {
+		return err
+	}
+
+	if err := s.store.CreateSource(ctx, source); err != nil {
+		return err
+	}
+
+	if source.Content != "" {
+		if chunkCount, err := s.indexSource(ctx, source); err != nil {
+			golog.Errorf("failed to ingest source %s: %v", source.Name, err)
+		} else {
+			source.ChunkCount = chunkCount
+			s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
+		}
+	}
+
+	s.applySourceHooks(ctx, source)
+
+	return nil
+}
+
+// indexSource adds a source's content to the vector store, keeping
+// pre-split sources (such as imported highlights) one chunk per entry
+func (s *Server) indexSource(ctx context.Context, source *Source) (int, error) {
+	s.vectorStore.SetSourceExcluded(source.ID, !source.IncludedInRetrieval)
+	return s.vectorStore.IngestChunks(ctx, source.Name, s.sourceChunks(source), sourceIndexMetadata(source))
+}
+
+// reindexSource updates the index after a source's content changed, only
+// embedding the chunks that differ from before
+func (s *Server) reindexSource(ctx context.Context, source *Source) (int, error) {
+	s.vectorStore.SetSourceExcluded(source.ID, !source.IncludedInRetrieval)
+	return s.vectorStore.ReindexSource(ctx, source.Name, s.sourceChunks(source), sourceIndexMetadata(source))
+}
+
+// sourceChunks splits a source's content the way it is indexed, so chunk IDs
+// in search results index into the returned slice
+func (s *Server) sourceChunks(source *Source) []string {
+	if source.Type == "highlights" {
+		return splitHighlights(source.Content)
+	}
+	return s.vectorStore.splitText(source.Content, s.cfg.ChunkSize, s.cfg.ChunkOverlap)
+}
+
+// sourceIndexMetadata tags indexed chunks with the source they came from
+func sourceIndexMetadata(source *Source) map[string]any {
+	return map[string]any{
+		"source_id":   source.ID,
+		"notebook_id": source.NotebookID,
+	}
+}
+
+// saveUploadData writes r into the uploads directory under a unique name derived
+// from fileName and returns the stored file name, path and size
+func saveUploadData(fileName string, r io.Reader) (string, string, int64, error) {
+	if err := os.MkdirAll("./data/uploads", 0755); err != nil {
+		return "", "", 0, fmt.Errorf("failed to create uploads directory: %w", err)
+	}
+
+	fileName = filepath.Base(fileName)
+	ext := filepath.Ext(fileName)
+	baseName := fileName[:len(fileName)-len(ext)]
+	uniqueFileName := fmt.Sprintf("%s_%s%s", baseName, uuid.New().String()[:8], ext)
+	path := fmt.Sprintf("./data/uploads/%s", uniqueFileName)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		os.Remove(path)
+		return "", "", 0, err
+	}
+
+	return uniqueFileName, path, size, nil
+}
+
 // Utility functions
 
+// randomToken returns a random hex string built from n bytes of entropy
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
 func writeFile(path, content string) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
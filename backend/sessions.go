@@ -0,0 +1,367 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// sessionTouchInterval is how often a session's last use is saved while
+// it stays on one device and address
+const sessionTouchInterval = time.Minute
+
+// Session is a device signed in to an account, with its own API token
+type Session struct {
+	ID     string `json:"id"`
+	UserID string `json:"-"`
+	// Name is what the user called the device; empty for the session made
+	// with the account
+	Name string `json:"name,omitempty"`
+	// Device describes the user agent, e.g. "Firefox on Linux"
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// Current is set on the session the request was made with
+	Current bool `json:"current"`
+	// StepUpAt is when a two-factor code was last verified on this session
+	StepUpAt *time.Time `json:"-"`
+}
+
+// steppedUp reports whether a code verified on the session still confirms
+// destructive changes
+func (sess *Session) steppedUp(now time.Time) bool {
+	return sess != nil && sess.StepUpAt != nil && now.Sub(*sess.StepUpAt) < stepUpWindow
+}
+
+// describeUserAgent names the browser or client and the system of a
+// User-Agent header
+func describeUserAgent(ua string) string {
+	if strings.TrimSpace(ua) == "" {
+		return "Unknown device"
+	}
+	var client string
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			client = b.name
+			break
+		}
+	}
+	if client == "" {
+		// Scripts and apps, such as curl/8.5.0 or python-requests/2.31
+		client, _, _ = strings.Cut(strings.Fields(ua)[0], "/")
+	}
+	for _, system := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iOS"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, system.token) {
+			return client + " on " + system.name
+		}
+	}
+	return client
+}
+
+// Session operations
+
+const sessionColumns = `id, user_id, name, user_agent, ip, created_at, last_used_at, step_up_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	var sess Session
+	var createdAt, lastUsedAt int64
+	var stepUpAt sql.NullInt64
+	if err := row.Scan(&sess.ID, &sess.UserID, &sess.Name, &sess.UserAgent, &sess.IP, &createdAt, &lastUsedAt, &stepUpAt); err != nil {
+		return nil, err
+	}
+	if stepUpAt.Valid {
+		at := time.Unix(stepUpAt.Int64, 0)
+		sess.StepUpAt = &at
+	}
+	sess.Device = describeUserAgent(sess.UserAgent)
+	sess.CreatedAt = time.Unix(createdAt, 0)
+	sess.LastUsedAt = time.Unix(lastUsedAt, 0)
+	return &sess, nil
+}
+
+// insertSession saves a session for the hash of its token
+func insertSession(ctx context.Context, q interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, userID, name, tokenHash string) (*Session, error) {
+	now := time.Now()
+	sess := &Session{ID: uuid.New().String(), UserID: userID, Name: name, Device: describeUserAgent(""), CreatedAt: now, LastUsedAt: now}
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO user_sessions (id, user_id, token_hash, name, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, '', '', ?, ?)
+	`, sess.ID, userID, tokenHash, name, now.Unix(), now.Unix())
+	return sess, err
+}
+
+// backfillUserSessions makes the token users were created with their first
+// session, for databases and instance bundles from before sessions
+func backfillUserSessions(ctx context.Context, q interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}) error {
+	rows, err := q.QueryContext(ctx, `
+		SELECT id, token_hash, created_at FROM users
+		WHERE NOT EXISTS (SELECT 1 FROM user_sessions WHERE user_sessions.user_id = users.id)
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type userToken struct {
+		id, tokenHash string
+		createdAt     int64
+	}
+	var users []userToken
+	for rows.Next() {
+		var u userToken
+		if err := rows.Scan(&u.id, &u.tokenHash, &u.createdAt); err != nil {
+			return err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, u := range users {
+		if _, err := q.ExecContext(ctx, `
+			INSERT INTO user_sessions (id, user_id, token_hash, name, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, '', '', '', ?, ?)
+		`, uuid.New().String(), u.id, u.tokenHash, u.createdAt, u.createdAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateSession signs a new device in to a user's account and returns the
+// session's API token, which is not stored in clear
+func (s *Store) CreateSession(ctx context.Context, userID, name string) (*Session, string, error) {
+	token := newAPIToken()
+	sess, err := insertSession(ctx, s.db, userID, name, hashToken(token))
+	if err != nil {
+		return nil, "", err
+	}
+	return sess, token, nil
+}
+
+// GetSessionByToken retrieves the session an API token belongs to, and its user
+func (s *Store) GetSessionByToken(ctx context.Context, token string) (*User, *Session, error) {
+	sess, err := scanSession(s.db.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+` FROM user_sessions WHERE token_hash = ?
+	`, hashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, nil, notFoundError("session")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := s.GetUser(ctx, sess.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, sess, nil
+}
+
+// TouchSession records a session's use from a user agent and address
+func (s *Store) TouchSession(ctx context.Context, id, userAgent, ip string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE user_sessions SET user_agent = ?, ip = ?, last_used_at = ? WHERE id = ?
+	`, userAgent, ip, time.Now().Unix(), id)
+	return err
+}
+
+// StepUpSession records a two-factor code as verified on a session now
+func (s *Store) StepUpSession(ctx context.Context, id string) (time.Time, error) {
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, `UPDATE user_sessions SET step_up_at = ? WHERE id = ?`, now.Unix(), id)
+	return now, err
+}
+
+// ListSessions retrieves a user's sessions, most recently used first
+func (s *Store) ListSessions(ctx context.Context, userID string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+sessionColumns+` FROM user_sessions WHERE user_id = ? ORDER BY last_used_at DESC, created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession signs one of a user's devices out
+func (s *Store) DeleteSession(ctx context.Context, userID, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM user_sessions WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return notFoundError("session")
+	}
+	return nil
+}
+
+// DeleteOtherSessions signs every device of a user out but one, returning
+// the sessions removed
+func (s *Store) DeleteOtherSessions(ctx context.Context, userID, keepID string) ([]string, error) {
+	// The IDs come from the DELETE itself, so a session created meanwhile is
+	// either both removed and returned or left alone
+	rows, err := s.db.QueryContext(ctx, `DELETE FROM user_sessions WHERE user_id = ? AND id != ? RETURNING id`, userID, keepID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// authenticate signs a caller in with an API token, recording the device
+// and address it is used from
+func (s *Server) authenticate(c *gin.Context, token string) (*User, *Session, error) {
+	ctx := c.Request.Context()
+	user, sess, err := s.store.GetSessionByToken(ctx, strings.TrimSpace(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	userAgent, ip := c.Request.UserAgent(), c.ClientIP()
+	if len(userAgent) > 500 {
+		userAgent = userAgent[:500]
+	}
+	if userAgent != sess.UserAgent || ip != sess.IP || time.Since(sess.LastUsedAt) > sessionTouchInterval {
+		if err := s.store.TouchSession(ctx, sess.ID, userAgent, ip); err == nil {
+			sess.UserAgent, sess.IP, sess.LastUsedAt = userAgent, ip, time.Now()
+			sess.Device = describeUserAgent(userAgent)
+		}
+	}
+	return user, sess, nil
+}
+
+// currentSession returns the session the request was signed in with, or nil
+func currentSession(c *gin.Context) *Session {
+	if v, ok := c.Get("session"); ok {
+		return v.(*Session)
+	}
+	return nil
+}
+
+// Session handlers
+
+// sessionUser returns the signed-in user and session, answering 401 without
+func sessionUser(c *gin.Context) (*User, *Session, bool) {
+	user, sess := currentUser(c), currentSession(c)
+	if user == nil || sess == nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "An API token is required to manage sessions"})
+		return nil, nil, false
+	}
+	return user, sess, true
+}
+
+// handleListSessions lists the devices signed in to the caller's account
+func (s *Server) handleListSessions(c *gin.Context) {
+	user, current, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	sessions, err := s.store.ListSessions(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sessions"})
+		return
+	}
+	for _, sess := range sessions {
+		sess.Current = sess.ID == current.ID
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// handleCreateSession signs another device in, such as a phone or a
+// script, with a token of its own that can be revoked alone. The token is
+// shown only once.
+func (s *Server) handleCreateSession(c *gin.Context) {
+	user, _, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name string `json:"name" binding:"max=100"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	sess, token, err := s.store.CreateSession(c.Request.Context(), user.ID, strings.TrimSpace(req.Name))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create session"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"session": sess, "token": token})
+}
+
+// handleRevokeSession signs one device out; revoking the current session
+// signs the caller out
+func (s *Server) handleRevokeSession(c *gin.Context) {
+	user, _, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	id := c.Param("sessionId")
+	if err := s.store.DeleteSession(c.Request.Context(), user.ID, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to revoke session"})
+		return
+	}
+	s.events.disconnectSessions([]string{id})
+	c.Status(http.StatusNoContent)
+}
+
+// handleRevokeOtherSessions signs out every device but the caller's
+func (s *Server) handleRevokeOtherSessions(c *gin.Context) {
+	user, current, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	ids, err := s.store.DeleteOtherSessions(c.Request.Context(), user.ID, current.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to revoke sessions"})
+		return
+	}
+	s.events.disconnectSessions(ids)
+	c.JSON(http.StatusOK, gin.H{"revoked": len(ids)})
+}
@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDeleteOtherSessions(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	user, _, err := store.CreateUser(ctx, "user@example.com", "User")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	sessions, err := store.ListSessions(ctx, user.ID)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("ListSessions = %v, %v; want the account's session", sessions, err)
+	}
+	keep := sessions[0]
+	var want []string
+	for _, name := range []string{"laptop", "phone"} {
+		sess, _, err := store.CreateSession(ctx, user.ID, name)
+		if err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		want = append(want, sess.ID)
+	}
+
+	got, err := store.DeleteOtherSessions(ctx, user.ID, keep.ID)
+	if err != nil {
+		t.Fatalf("DeleteOtherSessions: %v", err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DeleteOtherSessions = %v, want %v", got, want)
+	}
+	left, err := store.ListSessions(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(left) != 1 || left[0].ID != keep.ID {
+		t.Errorf("sessions left = %v, want only %s", left, keep.ID)
+	}
+}
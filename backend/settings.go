@@ -0,0 +1,346 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Setting scopes
+const (
+	SettingScopeUser     = "user"     // a person's preferences
+	SettingScopeInstance = "instance" // server-wide, changed by admins
+)
+
+// Setting value types
+const (
+	settingString = "string"
+	settingBool   = "bool"
+	settingInt    = "int"
+	settingEnum   = "enum"
+)
+
+// SettingDef declares a setting: its type, default and allowed values
+type SettingDef struct {
+	Key         string      `json:"key"`
+	Scope       string      `json:"scope"`
+	Type        string      `json:"type"`
+	Default     interface{} `json:"default"`
+	Options     []string    `json:"options,omitempty"`    // enum values
+	Min         int         `json:"min,omitempty"`        // int bounds
+	Max         int         `json:"max,omitempty"`        // int bounds
+	MaxLength   int         `json:"max_length,omitempty"` // string length
+	Description string      `json:"description"`
+}
+
+// settingDefs are every known setting. Unknown keys are refused.
+var settingDefs = []SettingDef{
+	{Key: "theme", Scope: SettingScopeUser, Type: settingEnum, Default: "system", Options: []string{"system", "light", "dark"},
+		Description: "Color theme of the web UI"},
+	{Key: "default_model", Scope: SettingScopeUser, Type: settingString, Default: "", MaxLength: 200,
+		Description: "Model preselected for chat; empty uses the server's"},
+	{Key: "default_notebook_id", Scope: SettingScopeUser, Type: settingString, Default: "", MaxLength: 64,
+		Description: "Notebook opened on start; empty shows the notebook list"},
+	{Key: "editor.mode", Scope: SettingScopeUser, Type: settingEnum, Default: "rich", Options: []string{"rich", "markdown"},
+		Description: "Note editor: formatted text or plain Markdown"},
+	{Key: "editor.font_size", Scope: SettingScopeUser, Type: settingInt, Default: 14, Min: 10, Max: 32,
+		Description: "Note editor font size in pixels"},
+	{Key: "editor.line_wrap", Scope: SettingScopeUser, Type: settingBool, Default: true,
+		Description: "Wrap long lines in the note editor"},
+	{Key: "editor.spellcheck", Scope: SettingScopeUser, Type: settingBool, Default: true,
+		Description: "Check spelling in the note editor"},
+	{Key: "notifications.mention", Scope: SettingScopeUser, Type: settingEnum, Default: NotifyEmail, Options: notifyModes,
+		Description: "Notify when a comment mentions you: off, inbox, or inbox and email"},
+	{Key: "notifications.comment", Scope: SettingScopeUser, Type: settingEnum, Default: NotifyInbox, Options: notifyModes,
+		Description: "Notify of comments on your workspace's notes"},
+	{Key: "notifications.job", Scope: SettingScopeUser, Type: settingEnum, Default: NotifyEmail, Options: notifyModes,
+		Description: "Notify when an account export or deletion finishes"},
+	{Key: "notifications.scheduled", Scope: SettingScopeUser, Type: settingEnum, Default: NotifyInbox, Options: notifyModes,
+		Description: "Notify when a scheduled prompt of your workspace runs"},
+	{Key: "notifications.reminder", Scope: SettingScopeUser, Type: settingEnum, Default: NotifyInbox, Options: notifyModes,
+		Description: "Notify when a note you snoozed comes back to the inbox"},
+
+	{Key: "instance.name", Scope: SettingScopeInstance, Type: settingString, Default: "Notex", MaxLength: 100,
+		Description: "Name shown in the web UI's title bar"},
+	{Key: "instance.announcement", Scope: SettingScopeInstance, Type: settingString, Default: "", MaxLength: 500,
+		Description: "Banner shown to every user; empty shows none"},
+	{Key: "signups_enabled", Scope: SettingScopeInstance, Type: settingBool, Default: true,
+		Description: "Whether anyone may create a user; when off only admins can"},
+}
+
+// settingDef looks up a setting by scope and key
+func settingDef(scope, key string) (*SettingDef, bool) {
+	for i := range settingDefs {
+		if settingDefs[i].Scope == scope && settingDefs[i].Key == key {
+			return &settingDefs[i], true
+		}
+	}
+	return nil, false
+}
+
+// parse decodes and checks a value for the setting; errors say what the
+// value must be
+func (d *SettingDef) parse(raw json.RawMessage) (interface{}, error) {
+	switch d.Type {
+	case settingBool:
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return v, nil
+	case settingInt:
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a whole number")
+		}
+		if v < d.Min || v > d.Max {
+			return nil, fmt.Errorf("must be between %d and %d", d.Min, d.Max)
+		}
+		return v, nil
+	case settingEnum:
+		var v string
+		if err := json.Unmarshal(raw, &v); err == nil {
+			for _, option := range d.Options {
+				if v == option {
+					return v, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("must be one of %v", d.Options)
+	default:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		if d.MaxLength > 0 && len(v) > d.MaxLength {
+			return nil, fmt.Errorf("must be at most %d characters", d.MaxLength)
+		}
+		return v, nil
+	}
+}
+
+// instanceSettingsOwner owns instance settings in the settings table
+const instanceSettingsOwner = ""
+
+// ListSettings returns the values saved for an owner in a scope. User
+// settings are owned by the user's ID, or "" for callers without a token.
+func (s *Store) ListSettings(ctx context.Context, scope, ownerID string) (map[string]json.RawMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT key, value FROM settings WHERE scope = ? AND owner_id = ?`, scope, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = json.RawMessage(value)
+	}
+	return values, rows.Err()
+}
+
+// SaveSettings stores values for an owner; a nil value removes the saved
+// one so the default applies again
+func (s *Store) SaveSettings(ctx context.Context, scope, ownerID string, values map[string]interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for key, value := range values {
+		if value == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM settings WHERE scope = ? AND owner_id = ? AND key = ?`, scope, ownerID, key)
+		} else {
+			encoded, _ := json.Marshal(value)
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO settings (scope, owner_id, key, value, updated_at) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT(scope, owner_id, key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+			`, scope, ownerID, key, string(encoded), now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// effectiveSettings is every setting in a scope, saved values over defaults.
+// Saved values for settings that no longer exist or no longer validate are
+// ignored.
+func effectiveSettings(scope string, saved map[string]json.RawMessage) map[string]interface{} {
+	values := make(map[string]interface{})
+	for i := range settingDefs {
+		def := &settingDefs[i]
+		if def.Scope != scope {
+			continue
+		}
+		values[def.Key] = def.Default
+		if raw, ok := saved[def.Key]; ok {
+			if v, err := def.parse(raw); err == nil {
+				values[def.Key] = v
+			}
+		}
+	}
+	return values
+}
+
+// settings returns the effective settings for an owner
+func (s *Server) settings(ctx context.Context, scope, ownerID string) (map[string]interface{}, error) {
+	saved, err := s.store.ListSettings(ctx, scope, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	return effectiveSettings(scope, saved), nil
+}
+
+// instanceSetting returns one instance setting, or its default if it cannot
+// be read
+func (s *Server) instanceSetting(ctx context.Context, key string) interface{} {
+	values, err := s.settings(ctx, SettingScopeInstance, instanceSettingsOwner)
+	if err != nil {
+		def, _ := settingDef(SettingScopeInstance, key)
+		return def.Default
+	}
+	return values[key]
+}
+
+// settingsOwner is the owner of the caller's user settings
+func settingsOwner(c *gin.Context) string {
+	if user := currentUser(c); user != nil {
+		return user.ID
+	}
+	return ""
+}
+
+// parseSettings checks a patch of settings in a scope. null resets a setting
+// to its default.
+func parseSettings(scope string, patch map[string]json.RawMessage) (map[string]interface{}, error) {
+	var fields fieldErrors
+	values := make(map[string]interface{}, len(patch))
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		def, ok := settingDef(scope, key)
+		if !ok {
+			fields.add(key, "is not a %s setting", scope)
+			continue
+		}
+		if string(patch[key]) == "null" {
+			values[key] = nil
+			continue
+		}
+		v, err := def.parse(patch[key])
+		if err != nil {
+			fields.add(key, "%v", err)
+			continue
+		}
+		values[key] = v
+	}
+	return values, fields.err()
+}
+
+// updateSettings saves a patch and tells the owner's clients, or everyone
+// for instance settings, what changed
+func (s *Server) updateSettings(c *gin.Context, scope, ownerID string, values map[string]interface{}) {
+	ctx := c.Request.Context()
+	if err := s.store.SaveSettings(ctx, scope, ownerID, values); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save settings"})
+		return
+	}
+	current, err := s.settings(ctx, scope, ownerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load settings"})
+		return
+	}
+
+	changed := make(map[string]interface{}, len(values))
+	for key := range values {
+		changed[key] = current[key]
+	}
+	ev := Event{Type: "settings.changed", Data: gin.H{"scope": scope, "values": changed}}
+	if scope == SettingScopeInstance {
+		s.events.publishAll(ev)
+	} else {
+		s.events.publishUser(ownerID, ev)
+	}
+
+	c.JSON(http.StatusOK, current)
+}
+
+// Settings handlers
+
+func (s *Server) handleGetSettingsSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"settings": settingDefs})
+}
+
+// handleGetSettings returns the caller's preferences and the instance
+// settings every client needs
+func (s *Server) handleGetSettings(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := s.settings(ctx, SettingScopeUser, settingsOwner(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load settings"})
+		return
+	}
+	instance, err := s.settings(ctx, SettingScopeInstance, instanceSettingsOwner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load settings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{SettingScopeUser: user, SettingScopeInstance: instance})
+}
+
+// handleUpdateSettings changes the caller's preferences
+func (s *Server) handleUpdateSettings(c *gin.Context) {
+	var patch map[string]json.RawMessage
+	if !bindJSON(c, &patch) {
+		return
+	}
+	values, err := parseSettings(SettingScopeUser, patch)
+	if validationResponse(c, err) {
+		return
+	}
+	if id, ok := values["default_notebook_id"].(string); ok && id != "" {
+		nb, err := s.store.GetNotebook(c.Request.Context(), id)
+		if err != nil || nb.WorkspaceID != currentWorkspace(c).ID {
+			validationResponse(c, invalidField("default_notebook_id", "is not a notebook in this workspace"))
+			return
+		}
+	}
+	s.updateSettings(c, SettingScopeUser, settingsOwner(c), values)
+}
+
+func (s *Server) handleGetInstanceSettings(c *gin.Context) {
+	values, err := s.settings(c.Request.Context(), SettingScopeInstance, instanceSettingsOwner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load settings"})
+		return
+	}
+	c.JSON(http.StatusOK, values)
+}
+
+func (s *Server) handleUpdateInstanceSettings(c *gin.Context) {
+	var patch map[string]json.RawMessage
+	if !bindJSON(c, &patch) {
+		return
+	}
+	values, err := parseSettings(SettingScopeInstance, patch)
+	if validationResponse(c, err) {
+		return
+	}
+	s.updateSettings(c, SettingScopeInstance, instanceSettingsOwner, values)
+}
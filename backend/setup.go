@@ -0,0 +1,408 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSetupConfigFile is where setup writes its settings when the server
+// was started without a config file
+const defaultSetupConfigFile = "notex.yaml"
+
+// providerCheckTimeout bounds the call that checks provider credentials
+const providerCheckTimeout = 15 * time.Second
+
+// SetupStatus tells a client whether first-run setup still has to be done
+type SetupStatus struct {
+	Needed bool `json:"needed"`
+	// ProviderConfigured is false when the server runs in setup mode and
+	// setup must configure an LLM provider
+	ProviderConfigured bool     `json:"provider_configured"`
+	ConfigFile         string   `json:"config_file"`
+	Providers          []string `json:"providers"`
+}
+
+// setupProvider is the LLM provider chosen during setup
+type setupProvider struct {
+	Provider       string `json:"provider" binding:"required,oneof=openai ollama"`
+	APIKey         string `json:"api_key"`
+	BaseURL        string `json:"base_url" binding:"omitempty,url"`
+	Model          string `json:"model" binding:"max=200"`
+	EmbeddingModel string `json:"embedding_model" binding:"max=200"`
+}
+
+func (p *setupProvider) validate() error {
+	if p.Provider == "openai" && p.APIKey == "" {
+		return invalidField("llm.api_key", "is required for openai")
+	}
+	return nil
+}
+
+func (p *setupProvider) baseURL() string {
+	if p.BaseURL != "" {
+		return strings.TrimRight(p.BaseURL, "/")
+	}
+	if p.Provider == "ollama" {
+		return "http://localhost:11434"
+	}
+	return "https://api.openai.com/v1"
+}
+
+// settings are the config keys that select the provider, by env name
+func (p *setupProvider) settings() map[string]string {
+	values := make(map[string]string)
+	if p.Provider == "ollama" {
+		// Ollama is recognised by OPENAI_BASE_URL pointing at it
+		values["OLLAMA_BASE_URL"] = p.baseURL()
+		values["OPENAI_BASE_URL"] = p.baseURL()
+		if p.Model != "" {
+			values["OLLAMA_MODEL"] = p.Model
+		}
+		if p.EmbeddingModel != "" {
+			values["OLLAMA_EMBEDDING_MODEL"] = p.EmbeddingModel
+		}
+		return values
+	}
+
+	values["OPENAI_API_KEY"] = p.APIKey
+	if p.BaseURL != "" {
+		values["OPENAI_BASE_URL"] = p.baseURL()
+	}
+	if p.Model != "" {
+		values["OPENAI_MODEL"] = p.Model
+	}
+	if p.EmbeddingModel != "" {
+		values["EMBEDDING_MODEL"] = p.EmbeddingModel
+	}
+	return values
+}
+
+// check makes a cheap authenticated call, listing models, to prove the
+// provider is reachable and accepts the credentials
+func (p *setupProvider) check(ctx context.Context, client *http.Client) ProviderTestResult {
+	ctx, cancel := context.WithTimeout(ctx, providerCheckTimeout)
+	defer cancel()
+
+	res := ProviderTestResult{Kind: providerKindLLM, Provider: p.Provider, BaseURL: p.baseURL(), Model: p.Model}
+	start := time.Now()
+	models, err := listProviderModels(ctx, client, p.Provider, p.baseURL(), p.APIKey)
+	res.Models = models
+	if err == nil && p.Model != "" {
+		found := hasModel(models, p.Model)
+		res.ModelFound = &found
+		if !found {
+			err = fmt.Errorf("model %s is not available", p.Model)
+		}
+	}
+	res.finish(start, err)
+	return res
+}
+
+// writeSetupConfig sets values in the config file at path, keeping the
+// settings already there, and creates the file if needed. The file holds
+// credentials, so only its owner may read it.
+func writeSetupConfig(path string, values map[string]string) error {
+	doc := make(map[string]any)
+	ext := strings.ToLower(filepath.Ext(path))
+	if data, err := os.ReadFile(path); err == nil {
+		switch ext {
+		case ".toml":
+			err = toml.Unmarshal(data, &doc)
+		default:
+			err = yaml.Unmarshal(data, &doc)
+		}
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if doc == nil {
+		doc = make(map[string]any)
+	}
+
+	for key, value := range values {
+		key = strings.ToLower(key)
+		deleteConfigKey(doc, key)
+		doc[key] = value
+	}
+
+	var data []byte
+	var err error
+	switch ext {
+	case ".toml":
+		data, err = toml.Marshal(doc)
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(doc)
+	default:
+		return fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// deleteConfigKey removes a flat key from doc, including where it is spelled
+// with sections, so a setting is never given twice
+func deleteConfigKey(doc map[string]any, key string) {
+	for k, v := range doc {
+		name := strings.ToLower(k)
+		if name == key {
+			delete(doc, k)
+			continue
+		}
+		if section, ok := v.(map[string]any); ok {
+			if rest, ok := strings.CutPrefix(key, name+"_"); ok {
+				deleteConfigKey(section, rest)
+			}
+		}
+	}
+}
+
+// setupConfigFile is the file setup writes to
+func (s *Server) setupConfigFile() string {
+	if file := s.cfg.ConfigFile(); file != "" {
+		return file
+	}
+	return defaultSetupConfigFile
+}
+
+// setupNeeded reports whether no user exists yet
+func (s *Server) setupNeeded(ctx context.Context) (bool, error) {
+	users, _, err := s.store.CountUsers(ctx)
+	return users == 0, err
+}
+
+// AdminMiddleware limits the admin API to instance admins. Installs that
+// never ran setup have no admin, and keep the admin API open as before.
+func (s *Server) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, admins, err := s.store.CountUsers(c.Request.Context())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check admin rights"})
+			return
+		}
+		if admins == 0 {
+			c.Next()
+			return
+		}
+
+		user := currentUser(c)
+		if user == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Sign in as an admin"})
+			return
+		}
+		if !user.IsAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Admin rights required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RunSetup serves only the setup API on l, for a server started without an
+// LLM provider. It returns once setup has finished, with the configuration
+// read back from the file setup wrote, or with ctx's error if ctx is done
+// first.
+func RunSetup(ctx context.Context, cfg Config, l net.Listener) (Config, error) {
+	store, err := NewStore(cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to create store: %w", err)
+	}
+	defer store.Close()
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery(), gin.Logger())
+	if err := configureProxies(router, cfg); err != nil {
+		return cfg, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	s := &Server{
+		cfg:         cfg,
+		store:       NewCachedStore(store, 5*time.Minute),
+		http:        router,
+		rateLimiter: newRateLimiter(cfg.RateLimitPerMinute, cfg.RateLimitBurst),
+		maintenance: &maintenanceMode{},
+		liveCfg:     cfg,
+		setupDone:   make(chan struct{}),
+	}
+	router.Use(s.CORSMiddleware())
+	if cfg.DesktopToken != "" {
+		router.Use(s.DesktopTokenMiddleware())
+	}
+	router.Use(s.CSRFMiddleware())
+	assets, err := loadFrontendAssets()
+	if err != nil {
+		return cfg, fmt.Errorf("embedded frontend is unreadable: %w", err)
+	}
+	assets.withBasePath(normalizeBasePath(cfg.BasePath))
+	router.GET("/static/*filepath", assets.handleStatic)
+	router.HEAD("/static/*filepath", assets.handleStatic)
+	router.NoRoute(AuditMiddlewareLite(), assets.handleFallback)
+
+	api := router.Group("/api")
+	api.Use(AuditMiddlewareLite())
+	api.Use(RateLimitMiddleware(s.rateLimiter))
+	api.Use(s.BodyLimitMiddleware())
+	s.addSetupRoutes(api)
+
+	golog.Warnf("no LLM provider is configured; serving only the setup API on %s", l.Addr())
+	srv := &http.Server{Handler: s.handler()}
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(l) }()
+
+	select {
+	case <-s.setupDone:
+	case err := <-errCh:
+		return cfg, err
+	case <-ctx.Done():
+		srv.Close()
+		return cfg, ctx.Err()
+	}
+
+	// Let the setup response reach the client before the listener closes
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+
+	opts := cfg.options
+	opts.File = s.setupConfigFile()
+	updated, err := LoadConfigWithOptions(opts)
+	if err != nil {
+		return cfg, err
+	}
+	// Keep what the caller decided at startup, such as desktop mode's address
+	updated.ServerHost, updated.ServerPort, updated.DesktopToken = cfg.ServerHost, cfg.ServerPort, cfg.DesktopToken
+	return updated, ValidateConfig(updated)
+}
+
+// addSetupRoutes registers the first-run setup API
+func (s *Server) addSetupRoutes(api *gin.RouterGroup) {
+	api.GET("/setup", s.handleGetSetup)
+	api.POST("/setup/test", s.handleTestSetupProvider)
+	api.POST("/setup", s.handleSetup)
+}
+
+// Setup handlers
+
+func (s *Server) handleGetSetup(c *gin.Context) {
+	needed, err := s.setupNeeded(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check setup status"})
+		return
+	}
+	c.JSON(http.StatusOK, SetupStatus{
+		Needed:             needed,
+		ProviderConfigured: ProviderConfigured(s.cfg),
+		ConfigFile:         s.setupConfigFile(),
+		Providers:          []string{"openai", "ollama"},
+	})
+}
+
+// setupAvailable answers 404 and reports false once a user exists, which is
+// when setup is done and must not be run again
+func (s *Server) setupAvailable(c *gin.Context) bool {
+	needed, err := s.setupNeeded(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check setup status"})
+		return false
+	}
+	if !needed {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Setup is complete"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleTestSetupProvider(c *gin.Context) {
+	if !s.setupAvailable(c) {
+		return
+	}
+	var req setupProvider
+	if !bindJSON(c, &req) || validationResponse(c, req.validate()) {
+		return
+	}
+
+	c.JSON(http.StatusOK, req.check(c.Request.Context(), providerHTTPClient(s.cfg, 0, 0)))
+}
+
+// handleSetup finishes first-run setup: it checks and saves the LLM
+// provider, then creates the admin account and returns its API token
+func (s *Server) handleSetup(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Admin struct {
+			Email string `json:"email" binding:"required,email"`
+			Name  string `json:"name" binding:"max=200"`
+		} `json:"admin"`
+		LLM *setupProvider `json:"llm"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.LLM == nil && !ProviderConfigured(s.cfg) {
+		validationResponse(c, invalidField("llm", "is required until an LLM provider is configured"))
+		return
+	}
+	if req.LLM != nil && validationResponse(c, req.LLM.validate()) {
+		return
+	}
+
+	// One setup at a time, so two racing requests cannot both create an admin
+	s.setupMu.Lock()
+	defer s.setupMu.Unlock()
+	if !s.setupAvailable(c) {
+		return
+	}
+
+	file := s.setupConfigFile()
+	if req.LLM != nil {
+		if res := req.LLM.check(ctx, providerHTTPClient(s.cfg, 0, 0)); !res.OK {
+			c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Provider check failed: %s. %s", res.Error, res.Hint)})
+			return
+		}
+		if err := writeSetupConfig(file, req.LLM.settings()); err != nil {
+			golog.Errorf("setup: failed to write %s: %v", file, err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write config file"})
+			return
+		}
+		golog.Infof("setup: saved %s provider settings to %s", req.LLM.Provider, file)
+	}
+
+	user, token, err := s.store.CreateUser(ctx, req.Admin.Email, req.Admin.Name)
+	if err == nil {
+		err = s.store.SetUserAdmin(ctx, user.ID, true)
+		user.IsAdmin = true
+	}
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to create admin")
+		return
+	}
+	golog.Infof("setup: created admin %s", user.Email)
+
+	// In setup mode the server restarts with the new provider by itself; a
+	// running server picks up a changed provider on its next restart
+	restart := req.LLM != nil && s.setupDone == nil
+	c.JSON(http.StatusCreated, gin.H{"user": user, "token": token, "config_file": file, "restart_required": restart})
+	if s.setupDone != nil {
+		close(s.setupDone)
+	}
+}
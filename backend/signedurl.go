@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// signingKeyPath is where the generated key is kept when
+// DOWNLOAD_SIGNING_KEY is not set, so links survive restarts
+const signingKeyPath = "./data/download_signing.key"
+
+// maxSignedURLTTL is the longest a signed link may stay valid
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// SignedURL is a download link that works without an API token until it
+// expires
+type SignedURL struct {
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// downloadSigningKey returns the key links are signed with: the configured
+// one, or one generated on first use and stored under ./data
+func (s *Server) downloadSigningKey() []byte {
+	if s.cfg.DownloadSigningKey != "" {
+		return []byte(s.cfg.DownloadSigningKey)
+	}
+	s.signingKeyOnce.Do(func() {
+		if data, err := os.ReadFile(signingKeyPath); err == nil && len(strings.TrimSpace(string(data))) >= 32 {
+			s.signingKey = []byte(strings.TrimSpace(string(data)))
+			return
+		}
+		key := randomToken(32)
+		if err := os.MkdirAll(filepath.Dir(signingKeyPath), 0755); err == nil {
+			err = os.WriteFile(signingKeyPath, []byte(key), 0600)
+			if err != nil {
+				golog.Warnf("failed to store download signing key, links will not survive a restart: %v", err)
+			}
+		}
+		s.signingKey = []byte(key)
+	})
+	return s.signingKey
+}
+
+// signature is the HMAC of a path and its query, which includes the expiry
+// time but not the signature itself
+func (s *Server) signature(path string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.downloadSigningKey())
+	mac.Write([]byte(path))
+	mac.Write([]byte{'?'})
+	mac.Write([]byte(query.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns path with query parameters that let anyone download it
+// until ttl has passed
+func (s *Server) signURL(path string, query url.Values, ttl time.Duration) (string, time.Time) {
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", s.signature(path, query))
+	return path + "?" + query.Encode(), expires
+}
+
+// SignedURLMiddleware lets a request through only if its URL was signed by
+// signURL and has not expired
+func (s *Server) SignedURLMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		sig := query.Get("sig")
+		query.Del("sig")
+		expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+
+		want := s.signature(c.Request.URL.Path, query)
+		if sig == "" || err != nil || !hmac.Equal([]byte(sig), []byte(want)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Invalid download link"})
+			return
+		}
+		if time.Now().Unix() > expires {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Download link has expired"})
+			return
+		}
+		// The link is shared, so caches in between must not keep it
+		c.Header("Cache-Control", "private, no-store")
+		c.Set("signed", true)
+		c.Next()
+	}
+}
+
+// signedRequest reports whether the request came through a valid signed
+// link, which grants access without a workspace
+func signedRequest(c *gin.Context) bool {
+	return c.GetBool("signed")
+}
+
+// signedURLResponse answers with a signed link to path. The body may ask
+// for a lifetime with expires_in (seconds), up to seven days.
+func (s *Server) signedURLResponse(c *gin.Context, path string, query url.Values) {
+	var req struct {
+		ExpiresIn int `json:"expires_in" binding:"omitempty,min=60"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	ttl := time.Duration(s.cfg.DownloadURLMinutes) * time.Minute
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxSignedURLTTL {
+		validationResponse(c, invalidField("expires_in", "must be at most %d seconds", int(maxSignedURLTTL.Seconds())))
+		return
+	}
+
+	signed, expires := s.signURL(path, query, ttl)
+	c.JSON(http.StatusOK, SignedURL{URL: requestOrigin(c) + signed, Path: signed, ExpiresAt: expires})
+}
+
+// requestOrigin is the scheme, host and base path the client reached the
+// server at; X-Forwarded-Proto and X-Forwarded-Host count only from a
+// trusted proxy
+func requestOrigin(c *gin.Context) string {
+	info := requestProxyInfo(c)
+	scheme := "http"
+	if c.Request.TLS != nil || (info.trusted && c.GetHeader("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	if forwarded := c.GetHeader("X-Forwarded-Host"); info.trusted && forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host + info.basePath
+}
+
+// Signed URL handlers
+
+func (s *Server) handleSignAttachmentURL(c *gin.Context) {
+	// Only sign attachments the caller can see
+	att, ok := s.workspaceAttachment(c)
+	if !ok {
+		return
+	}
+
+	path := "/dl/attachments/" + att.ID
+	if c.Query("thumbnail") == "true" {
+		path += "/thumbnail"
+	}
+	s.signedURLResponse(c, path, nil)
+}
+
+// handleSignNotebookExport signs a link to the notebook's zip export, with
+// the same chat_format and include_chats options as the export itself
+func (s *Server) handleSignNotebookExport(c *gin.Context) {
+	if _, err := s.store.GetNotebook(c.Request.Context(), c.Param("id")); err != nil {
+		storeErrorResponse(c, err, "Failed to load notebook")
+		return
+	}
+	query := url.Values{}
+	for _, key := range []string{"chat_format", "include_chats"} {
+		if v := c.Query(key); v != "" {
+			query.Set(key, v)
+		}
+	}
+	s.signedURLResponse(c, "/dl/notebooks/"+c.Param("id")+"/export", query)
+}
+
+func (s *Server) handleSignAccountExport(c *gin.Context) {
+	s.signAccountExport(c, false)
+}
+
+func (s *Server) handleAdminSignAccountExport(c *gin.Context) {
+	s.signAccountExport(c, true)
+}
+
+func (s *Server) signAccountExport(c *gin.Context, admin bool) {
+	job, ok := s.loadAccountJob(c, admin)
+	if !ok {
+		return
+	}
+	if job.Kind != AccountJobExport || job.Status != JobCompleted || job.ResultPath == "" {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Export is not ready"})
+		return
+	}
+	s.signedURLResponse(c, "/dl/account-jobs/"+job.ID, nil)
+}
+
+// handleSignedAccountExport serves an export archive to a signed link; the
+// signature stands in for the owner's token
+func (s *Server) handleSignedAccountExport(c *gin.Context) {
+	if job, ok := s.loadAccountJob(c, true); ok {
+		serveAccountExport(c, job)
+	}
+}
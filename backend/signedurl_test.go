@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignedURLMiddleware(t *testing.T) {
+	s := &Server{cfg: Config{DownloadSigningKey: strings.Repeat("k", 32)}}
+	router := gin.New()
+	router.GET("/dl/attachments/:attachmentId", s.SignedURLMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, "file")
+	})
+
+	valid, _ := s.signURL("/dl/attachments/a1", nil, time.Hour)
+	expired, _ := s.signURL("/dl/attachments/a1", nil, -time.Minute)
+	withQuery, _ := s.signURL("/dl/attachments/a1", url.Values{"download": {"1"}}, time.Hour)
+	otherKey := &Server{cfg: Config{DownloadSigningKey: strings.Repeat("x", 32)}}
+	foreign, _ := otherKey.signURL("/dl/attachments/a1", nil, time.Hour)
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{name: "valid", target: valid, wantStatus: http.StatusOK},
+		{name: "valid with extra signed query", target: withQuery, wantStatus: http.StatusOK},
+		{name: "expired", target: expired, wantStatus: http.StatusForbidden},
+		{name: "other path", target: strings.Replace(valid, "/a1?", "/a2?", 1), wantStatus: http.StatusForbidden},
+		{name: "extended expiry", target: replaceQuery(valid, "expires", strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)), wantStatus: http.StatusForbidden},
+		{name: "added parameter", target: valid + "&download=1", wantStatus: http.StatusForbidden},
+		{name: "signed with another key", target: foreign, wantStatus: http.StatusForbidden},
+		{name: "no signature", target: replaceQuery(valid, "sig", ""), wantStatus: http.StatusForbidden},
+		{name: "no expiry", target: replaceQuery(valid, "expires", ""), wantStatus: http.StatusForbidden},
+		{name: "unsigned", target: "/dl/attachments/a1", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GET %s = %d, want %d: %s", tt.target, w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK && w.Header().Get("Cache-Control") != "private, no-store" {
+				t.Errorf("Cache-Control = %q, want private, no-store", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+// replaceQuery sets one query parameter of a URL path, removing it when
+// value is empty
+func replaceQuery(target, key, value string) string {
+	path, rawQuery, _ := strings.Cut(target, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	if value == "" {
+		query.Del(key)
+	} else {
+		query.Set(key, value)
+	}
+	return path + "?" + query.Encode()
+}
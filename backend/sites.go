@@ -0,0 +1,329 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// siteDomainsTTL is how long the list of custom domains is used before it
+// is read again, which also catches workspaces deleted meanwhile
+const siteDomainsTTL = 30 * time.Second
+
+var (
+	siteColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+	// siteFontPattern allows a CSS font family list, and nothing that could
+	// end the declaration
+	siteFontPattern = regexp.MustCompile(`^[\p{L}0-9 ,'"-]{1,200}$`)
+	domainPattern   = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+)
+
+// WorkspaceSite is how a workspace's published notes look, and the custom
+// domain they are served on besides /p
+type WorkspaceSite struct {
+	WorkspaceID string `json:"workspace_id"`
+	// Domain is a host name pointed at this server, e.g. notes.example.com
+	Domain string `json:"domain,omitempty"`
+	// Title replaces PUBLISH_TITLE on the workspace's pages and feed
+	Title   string `json:"title,omitempty" binding:"max=200"`
+	LogoURL string `json:"logo_url,omitempty" binding:"max=2000"`
+	// Colors are CSS hex colors and fonts CSS font family lists; each
+	// overrides the note's theme when set
+	AccentColor     string    `json:"accent_color,omitempty"`
+	BackgroundColor string    `json:"background_color,omitempty"`
+	TextColor       string    `json:"text_color,omitempty"`
+	Font            string    `json:"font,omitempty"`
+	HeadingFont     string    `json:"heading_font,omitempty"`
+	URL             string    `json:"url,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// css returns the rules that apply the site's colors and fonts over a theme
+func (w *WorkspaceSite) css() string {
+	var vars []string
+	for _, v := range []struct{ name, value string }{
+		{"--link", w.AccentColor},
+		{"--bg", w.BackgroundColor},
+		{"--fg", w.TextColor},
+		{"--font", w.Font},
+		{"--heading-font", w.HeadingFont},
+	} {
+		if v.value != "" {
+			vars = append(vars, v.name+": "+v.value+";")
+		}
+	}
+	if len(vars) == 0 {
+		return ""
+	}
+	return "\n:root { " + strings.Join(vars, " ") + " }"
+}
+
+// validDomain reports whether a name can be a custom domain: a lowercase
+// host name with a top-level domain, not an IP address
+func validDomain(domain string) bool {
+	return len(domain) <= 253 && domainPattern.MatchString(domain) && net.ParseIP(domain) == nil
+}
+
+// normalizeDomain lowercases a domain and drops a trailing dot
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// validate checks a site's settings, normalizing the domain
+func (w *WorkspaceSite) validate(cfg Config) error {
+	var fields fieldErrors
+	w.Domain = normalizeDomain(w.Domain)
+	if w.Domain != "" {
+		if !validDomain(w.Domain) {
+			fields.add("domain", "must be a domain name such as notes.example.com")
+		}
+		for _, own := range acmeDomains(cfg) {
+			if w.Domain == own {
+				fields.add("domain", "is the server's own domain")
+			}
+		}
+	}
+	w.Title = strings.TrimSpace(w.Title)
+	w.LogoURL = strings.TrimSpace(w.LogoURL)
+	if w.LogoURL != "" && !strings.HasPrefix(w.LogoURL, "https://") && !strings.HasPrefix(w.LogoURL, "http://") {
+		fields.add("logo_url", "must be an http or https URL")
+	}
+	for field, color := range map[string]string{"accent_color": w.AccentColor, "background_color": w.BackgroundColor, "text_color": w.TextColor} {
+		if color != "" && !siteColorPattern.MatchString(color) {
+			fields.add(field, "must be a hex color such as #1a73e8")
+		}
+	}
+	for field, font := range map[string]string{"font": w.Font, "heading_font": w.HeadingFont} {
+		if font != "" && !siteFontPattern.MatchString(font) {
+			fields.add(field, "must be a font family list such as \"Inter\", sans-serif")
+		}
+	}
+	return fields.err()
+}
+
+// Workspace site operations
+
+const workspaceSiteColumns = `workspace_id, COALESCE(domain, ''), title, logo_url, accent_color, background_color, text_color, font, heading_font, updated_at`
+
+func scanWorkspaceSite(row rowScanner) (*WorkspaceSite, error) {
+	var w WorkspaceSite
+	var updatedAt int64
+	if err := row.Scan(&w.WorkspaceID, &w.Domain, &w.Title, &w.LogoURL, &w.AccentColor, &w.BackgroundColor, &w.TextColor,
+		&w.Font, &w.HeadingFont, &updatedAt); err != nil {
+		return nil, err
+	}
+	w.UpdatedAt = time.Unix(updatedAt, 0)
+	return &w, nil
+}
+
+// GetWorkspaceSite returns a workspace's site settings
+func (s *Store) GetWorkspaceSite(ctx context.Context, workspaceID string) (*WorkspaceSite, error) {
+	w, err := scanWorkspaceSite(s.db.QueryRowContext(ctx, `
+		SELECT `+workspaceSiteColumns+` FROM workspace_sites WHERE workspace_id = ?
+	`, workspaceID))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("site")
+	}
+	return w, err
+}
+
+// SetWorkspaceSite saves a workspace's site settings
+func (s *Store) SetWorkspaceSite(ctx context.Context, w *WorkspaceSite) error {
+	w.UpdatedAt = time.Now()
+	var domain interface{}
+	if w.Domain != "" {
+		domain = w.Domain
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO workspace_sites (workspace_id, domain, title, logo_url, accent_color, background_color, text_color, font, heading_font, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(workspace_id) DO UPDATE SET domain = excluded.domain, title = excluded.title, logo_url = excluded.logo_url,
+			accent_color = excluded.accent_color, background_color = excluded.background_color, text_color = excluded.text_color,
+			font = excluded.font, heading_font = excluded.heading_font, updated_at = excluded.updated_at
+	`, w.WorkspaceID, domain, w.Title, w.LogoURL, w.AccentColor, w.BackgroundColor, w.TextColor, w.Font, w.HeadingFont, w.UpdatedAt.Unix())
+	if isUniqueViolation(err) {
+		return conflictError("the domain " + w.Domain + " is used by another workspace")
+	}
+	return err
+}
+
+// DeleteWorkspaceSite removes a workspace's domain and branding
+func (s *Store) DeleteWorkspaceSite(ctx context.Context, workspaceID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM workspace_sites WHERE workspace_id = ?`, workspaceID)
+	return err
+}
+
+// ListSiteDomains maps each custom domain to its workspace
+func (s *Store) ListSiteDomains(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT domain, workspace_id FROM workspace_sites
+		WHERE domain IS NOT NULL AND workspace_id IN (SELECT id FROM workspaces)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := make(map[string]string)
+	for rows.Next() {
+		var domain, workspaceID string
+		if err := rows.Scan(&domain, &workspaceID); err != nil {
+			return nil, err
+		}
+		domains[domain] = workspaceID
+	}
+	return domains, rows.Err()
+}
+
+// Custom domains
+
+// siteDomains caches the custom domains, which every request is checked
+// against
+type siteDomains struct {
+	mu      sync.Mutex
+	domains map[string]string
+	loaded  time.Time
+}
+
+// siteWorkspace returns the workspace whose custom domain a request's host
+// is, or ""
+func (s *Server) siteWorkspace(ctx context.Context, host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeDomain(host)
+
+	s.sites.mu.Lock()
+	defer s.sites.mu.Unlock()
+	if time.Since(s.sites.loaded) > siteDomainsTTL {
+		domains, err := s.store.ListSiteDomains(ctx)
+		if err != nil {
+			golog.Errorf("failed to load custom domains: %v", err)
+		} else {
+			s.sites.domains, s.sites.loaded = domains, time.Now()
+		}
+	}
+	return s.sites.domains[host]
+}
+
+// reloadSiteDomains has the next request read the custom domains again
+func (s *Server) reloadSiteDomains() {
+	s.sites.mu.Lock()
+	s.sites.loaded = time.Time{}
+	s.sites.mu.Unlock()
+}
+
+// siteOrigin is the scheme and host of a custom domain's pages
+func (s *Server) siteOrigin(c *gin.Context, domain string) string {
+	if s.cfg.ACMEEnabled {
+		return "https://" + domain
+	}
+	scheme, _, _ := strings.Cut(requestOrigin(c), "://")
+	return scheme + "://" + domain
+}
+
+// CustomDomainMiddleware serves a workspace's published notes at the root of
+// its custom domain, by routing / to /p/, /<slug> to /p/<slug>, and the feed
+// and sitemap alike. Nothing else is served there, the app and API included.
+func (s *Server) CustomDomainMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if publishedSiteOf(c).domain {
+			c.Next()
+			return
+		}
+		workspaceID := s.siteWorkspace(c.Request.Context(), c.Request.Host)
+		if workspaceID == "" {
+			c.Next()
+			return
+		}
+
+		p := c.Request.URL.Path
+		if strings.Count(p, "/") != 1 || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Not found"})
+			return
+		}
+		site := &publishedSite{workspaceID: workspaceID, domain: true}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), publishedSiteKey{}, site))
+		c.Request.URL.Path = publishPrefix + p
+		c.Request.URL.RawPath = ""
+		s.http.HandleContext(c)
+		c.Abort()
+	}
+}
+
+// Workspace site handlers
+
+func (s *Server) handleGetWorkspaceSite(c *gin.Context) {
+	ws, ok := s.loadWorkspace(c)
+	if !ok {
+		return
+	}
+
+	site, err := s.store.GetWorkspaceSite(c.Request.Context(), ws.ID)
+	if errors.Is(err, ErrNotFound) {
+		site, err = &WorkspaceSite{WorkspaceID: ws.ID}, nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load site settings"})
+		return
+	}
+	if site.Domain != "" {
+		site.URL = s.siteOrigin(c, site.Domain) + "/"
+	}
+	c.JSON(http.StatusOK, site)
+}
+
+// handleSetWorkspaceSite replaces a workspace's site settings. Point the
+// domain's DNS at the server before setting it when ACME is on, so the
+// certificate can be issued.
+func (s *Server) handleSetWorkspaceSite(c *gin.Context) {
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+
+	var site WorkspaceSite
+	if !bindJSON(c, &site) {
+		return
+	}
+	site.WorkspaceID = ws.ID
+	if err := site.validate(s.cfg); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	if err := s.store.SetWorkspaceSite(c.Request.Context(), &site); err != nil {
+		storeErrorResponse(c, err, "Failed to save site settings")
+		return
+	}
+	s.reloadSiteDomains()
+
+	if site.Domain != "" {
+		site.URL = s.siteOrigin(c, site.Domain) + "/"
+	}
+	c.JSON(http.StatusOK, site)
+}
+
+func (s *Server) handleDeleteWorkspaceSite(c *gin.Context) {
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteWorkspaceSite(c.Request.Context(), ws.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete site settings"})
+		return
+	}
+	s.reloadSiteDomains()
+
+	c.Status(http.StatusNoContent)
+}
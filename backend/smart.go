@@ -0,0 +1,332 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notebook types
+const (
+	NotebookTypeNotebook = "notebook"
+	NotebookTypeSmart    = "smart"
+)
+
+// smartSearchKey is the notebook metadata key holding a smart notebook's search
+const smartSearchKey = "smart_search"
+
+// maxSmartResults bounds the notes and the sources a smart notebook shows
+const maxSmartResults = 200
+
+// SmartSearch is the saved search a smart notebook shows the results of
+type SmartSearch struct {
+	Query       string   `json:"query" binding:"max=500"`
+	NotebookIDs []string `json:"notebook_ids,omitempty" binding:"omitempty,max=100,dive,uuid"` // Every notebook of the workspace when empty
+	Tags        []string `json:"tags,omitempty" binding:"omitempty,max=20,dive,max=100"`
+	Filters     []string `json:"filters,omitempty" binding:"omitempty,max=20"` // Note property filters, name:op:value
+}
+
+// SmartResults are a smart notebook's contents, computed from its search
+type SmartResults struct {
+	Notes   []Note   `json:"notes"`
+	Sources []Source `json:"sources"`
+}
+
+// notebookType tells smart notebooks from ordinary ones by their metadata
+func notebookType(metadata map[string]interface{}) string {
+	if _, ok := metadata[smartSearchKey]; ok {
+		return NotebookTypeSmart
+	}
+	return NotebookTypeNotebook
+}
+
+// notebookSearch reads a smart notebook's saved search
+func notebookSearch(nb *Notebook) (*SmartSearch, bool) {
+	raw, ok := nb.Metadata[smartSearchKey]
+	if !ok {
+		return nil, false
+	}
+	data, _ := json.Marshal(raw)
+	var search SmartSearch
+	if err := json.Unmarshal(data, &search); err != nil {
+		return nil, false
+	}
+	return &search, true
+}
+
+// searchMetadata is a saved search as notebook metadata
+func searchMetadata(search *SmartSearch) map[string]interface{} {
+	data, _ := json.Marshal(search)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
+
+// validateSearch checks a saved search can run and matches something less
+// than everything
+func validateSearch(search *SmartSearch) error {
+	var fields fieldErrors
+	search.Query = strings.TrimSpace(search.Query)
+	if search.Query == "" && len(search.Tags) == 0 && len(search.Filters) == 0 {
+		fields.add("query", "is required unless tags or filters are given")
+	}
+	if _, err := parsePropertyFilters(search.Filters); err != nil {
+		fields = append(fields, err.(*ValidationError).Fields...)
+	}
+	return fields.err()
+}
+
+// checkWritable refuses to add notes or sources to a smart notebook, whose
+// contents come from its search
+func (s *Server) checkWritable(ctx context.Context, notebookID string) error {
+	if nb, err := s.store.GetNotebook(ctx, notebookID); err == nil && nb.Type == NotebookTypeSmart {
+		return conflictError("smart notebooks show search results and can't hold notes or sources of their own")
+	}
+	return nil
+}
+
+// searchScope lists the notebooks a smart notebook searches: those it names,
+// or every ordinary, untrashed notebook of its workspace
+func (s *Server) searchScope(ctx context.Context, nb *Notebook, search *SmartSearch) ([]string, error) {
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	named := map[string]bool{}
+	for _, id := range search.NotebookIDs {
+		named[id] = true
+	}
+
+	var scope []string
+	for _, other := range filterWorkspaceNotebooks(notebooks, nb.WorkspaceID) {
+		if other.Type == NotebookTypeSmart || other.TrashedAt != nil {
+			continue
+		}
+		if len(named) == 0 || named[other.ID] {
+			scope = append(scope, other.ID)
+		}
+	}
+	sort.Strings(scope)
+	return scope, nil
+}
+
+// matchScore counts the query words in text, or returns 0 unless every word is there
+func matchScore(text string, words []string) int {
+	text = strings.ToLower(text)
+	score := 0
+	for _, w := range words {
+		n := strings.Count(text, w)
+		if n == 0 {
+			return 0
+		}
+		score += n
+	}
+	return score
+}
+
+// runSearch finds the notes and sources of the scope matching a search, best
+// matches first
+func (s *Server) runSearch(ctx context.Context, search *SmartSearch, scope []string) (*SmartResults, error) {
+	filters, err := parsePropertyFilters(search.Filters)
+	if err != nil {
+		return nil, err
+	}
+	words := strings.Fields(normalizeQuery(search.Query))
+
+	type scoredNote struct {
+		item  Note
+		score int
+	}
+	type scoredSource struct {
+		item  Source
+		score int
+	}
+	var notes []scoredNote
+	var sources []scoredSource
+	for _, id := range scope {
+		list, err := s.store.ListNotes(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		list = filterNotes(list, filters, "")
+		for i := range list {
+			if len(search.Tags) > 0 && !hasTags(&list[i], search.Tags) {
+				continue
+			}
+			score := 1
+			if len(words) > 0 {
+				score = matchScore(list[i].Title+"\n"+list[i].Content, words)
+			}
+			if score > 0 {
+				notes = append(notes, scoredNote{list[i], score})
+			}
+		}
+
+		// Sources have no tags or properties, so only a query finds them
+		if len(words) == 0 || len(search.Tags) > 0 || len(filters) > 0 {
+			continue
+		}
+		srcs, err := s.store.ListSources(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, src := range srcs {
+			if score := matchScore(src.Name+"\n"+src.Content, words); score > 0 {
+				sources = append(sources, scoredSource{src, score})
+			}
+		}
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].score != notes[j].score {
+			return notes[i].score > notes[j].score
+		}
+		return notes[i].item.UpdatedAt.After(notes[j].item.UpdatedAt)
+	})
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].score > sources[j].score })
+
+	results := &SmartResults{Notes: []Note{}, Sources: []Source{}}
+	for i := 0; i < len(notes) && i < maxSmartResults; i++ {
+		results.Notes = append(results.Notes, notes[i].item)
+	}
+	for i := 0; i < len(sources) && i < maxSmartResults; i++ {
+		results.Sources = append(results.Sources, sources[i].item)
+	}
+	return results, nil
+}
+
+// smartResults computes a smart notebook's contents, or reuses them while
+// the search and the generation of every notebook it covers are unchanged
+func (s *Server) smartResults(ctx context.Context, nb *Notebook) (*SmartResults, error) {
+	search, ok := notebookSearch(nb)
+	if !ok {
+		return nil, conflictError("not a smart notebook")
+	}
+	scope, err := s.searchScope(ctx, nb, search)
+	if err != nil {
+		return nil, err
+	}
+
+	def, _ := json.Marshal(search)
+	h := sha256.New()
+	h.Write(def)
+	for _, id := range scope {
+		fmt.Fprintf(h, "\n%s@%d", id, s.store.Generation(id))
+	}
+	key := "smart:" + nb.ID + ":" + hex.EncodeToString(h.Sum(nil))
+
+	if cached, ok := s.store.cache.Get(key); ok {
+		if results, ok := cached.(*SmartResults); ok {
+			return results, nil
+		}
+	}
+	results, err := s.runSearch(ctx, search, scope)
+	if err != nil {
+		return nil, err
+	}
+	// Older results of this notebook can't be looked up any more
+	s.store.cache.InvalidatePattern("smart:" + nb.ID + ":")
+	s.store.cache.Set(key, results)
+	return results, nil
+}
+
+// smartNotebook loads :id and checks it is a smart notebook
+func (s *Server) smartNotebook(c *gin.Context) (*Notebook, bool) {
+	nb, err := s.store.GetNotebook(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return nil, false
+	}
+	if nb.Type != NotebookTypeSmart {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Not a smart notebook"})
+		return nil, false
+	}
+	return nb, true
+}
+
+// Smart notebook handlers
+
+// handleCreateSmartNotebook saves a search as a smart notebook in the
+// current workspace
+func (s *Server) handleCreateSmartNotebook(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Name        string `json:"name" binding:"required,max=200"`
+		Description string `json:"description" binding:"max=2000"`
+		SmartSearch
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := validateSearch(&req.SmartSearch); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	ws := currentWorkspace(c)
+	if err := s.checkNotebookQuota(ctx, ws); err != nil {
+		storeErrorResponse(c, err, "Failed to create notebook")
+		return
+	}
+	metadata := map[string]interface{}{smartSearchKey: searchMetadata(&req.SmartSearch)}
+	notebook, err := s.store.CreateNotebookInWorkspace(ctx, ws.ID, req.Name, req.Description, metadata)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create notebook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, notebook)
+}
+
+// handleUpdateSmartSearch replaces a smart notebook's search
+func (s *Server) handleUpdateSmartSearch(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var search SmartSearch
+	if !bindJSON(c, &search) {
+		return
+	}
+	if err := validateSearch(&search); err != nil {
+		validationResponse(c, err)
+		return
+	}
+	nb, ok := s.smartNotebook(c)
+	if !ok {
+		return
+	}
+
+	metadata := make(map[string]interface{}, len(nb.Metadata))
+	for k, v := range nb.Metadata {
+		metadata[k] = v
+	}
+	metadata[smartSearchKey] = searchMetadata(&search)
+	updated, err := s.store.UpdateNotebook(ctx, nb.ID, nb.Name, nb.Description, metadata)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update notebook"})
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// handleGetSmartResults returns the notes and sources a smart notebook's
+// search finds now
+func (s *Server) handleGetSmartResults(c *gin.Context) {
+	nb, ok := s.smartNotebook(c)
+	if !ok {
+		return
+	}
+	results, err := s.smartResults(c.Request.Context(), nb)
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to run the search")
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
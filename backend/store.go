@@ -2,11 +2,14 @@ package backend
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -29,7 +32,9 @@ func NewStore(cfg Config) (*Store, error) {
 	absPath, _ := filepath.Abs(cfg.StorePath)
 	fmt.Printf("📦 Initializing SQLite Store at: %s\n", absPath)
 
-	db, err := sql.Open("sqlite", cfg.StorePath)
+	// Writers wait for each other, and for readers such as the outbox
+	// dispatcher, instead of failing at once with SQLITE_BUSY
+	db, err := sql.Open("sqlite", cfg.StorePath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -127,30 +132,724 @@ func (s *Store) initSchema() error {
 		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS email_inboxes (
+		notebook_id TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		allowed_senders TEXT,
+		mode TEXT NOT NULL DEFAULT 'source',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		source_id TEXT,
+		note_id TEXT,
+		file_name TEXT NOT NULL,
+		content_type TEXT,
+		file_size INTEGER DEFAULT 0,
+		path TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		metadata TEXT,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS source_freshness (
+		source_id TEXT PRIMARY KEY,
+		etag TEXT NOT NULL DEFAULT '',
+		last_modified TEXT NOT NULL DEFAULT '',
+		upstream_hash TEXT NOT NULL DEFAULT '',
+		upstream_content TEXT NOT NULL DEFAULT '',
+		stale INTEGER NOT NULL DEFAULT 0,
+		checked_at INTEGER NOT NULL,
+		changed_at INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		scope TEXT NOT NULL,
+		owner_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (scope, owner_id, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS entities (
+		id TEXT PRIMARY KEY,
+		workspace_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		name TEXT NOT NULL,
+		name_key TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (workspace_id, type, name_key)
+	);
+
+	CREATE TABLE IF NOT EXISTS entity_mentions (
+		entity_id TEXT NOT NULL,
+		source_id TEXT,
+		note_id TEXT,
+		snippet TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (entity_id) REFERENCES entities(id) ON DELETE CASCADE,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS suggestion_feedback (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		workspace_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		accepted INTEGER NOT NULL,
+		terms TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS note_references (
+		id TEXT PRIMARY KEY,
+		note_id TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		UNIQUE (note_id, target_type, target_id),
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS note_comments (
+		id TEXT PRIMARY KEY,
+		note_id TEXT NOT NULL,
+		parent_id TEXT,
+		author_id TEXT NOT NULL DEFAULT '',
+		author_name TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		anchor_quote TEXT NOT NULL DEFAULT '',
+		anchor_start INTEGER NOT NULL DEFAULT 0,
+		mentions TEXT NOT NULL DEFAULT '[]',
+		resolved_at INTEGER,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE,
+		FOREIGN KEY (parent_id) REFERENCES note_comments(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS source_highlights (
+		id TEXT PRIMARY KEY,
+		source_id TEXT NOT NULL,
+		text TEXT NOT NULL,
+		start INTEGER NOT NULL,
+		color TEXT NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		note_id TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notifications (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		link TEXT NOT NULL DEFAULT '',
+		data TEXT NOT NULL DEFAULT '{}',
+		read_at INTEGER,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		item_id TEXT NOT NULL,
+		scope_id TEXT NOT NULL,
+		op TEXT NOT NULL,
+		changed_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS note_views (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		filters TEXT NOT NULL DEFAULT '[]',
+		tags TEXT NOT NULL DEFAULT '[]',
+		sort TEXT NOT NULL DEFAULT '',
+		group_by TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS boards (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS board_columns (
+		id TEXT PRIMARY KEY,
+		board_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		FOREIGN KEY (board_id) REFERENCES boards(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS board_cards (
+		id TEXT PRIMARY KEY,
+		board_id TEXT NOT NULL,
+		column_id TEXT NOT NULL,
+		note_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		UNIQUE (board_id, note_id),
+		FOREIGN KEY (board_id) REFERENCES boards(id) ON DELETE CASCADE,
+		FOREIGN KEY (column_id) REFERENCES board_columns(id) ON DELETE CASCADE,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notebook_chat_settings (
+		notebook_id TEXT PRIMARY KEY,
+		system_prompt TEXT NOT NULL DEFAULT '',
+		tone TEXT NOT NULL DEFAULT '',
+		answer_length TEXT NOT NULL DEFAULT '',
+		citation_style TEXT NOT NULL DEFAULT '',
+		temperature REAL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS prompt_templates (
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		template TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		active INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (name, version)
+	);
+
+	CREATE TABLE IF NOT EXISTS scheduled_prompts (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		schedule TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		new_sources_only INTEGER NOT NULL DEFAULT 0,
+		webhook_url TEXT NOT NULL DEFAULT '',
+		notify_email TEXT NOT NULL DEFAULT '',
+		notify_on TEXT NOT NULL DEFAULT 'always',
+		last_run_at INTEGER NOT NULL DEFAULT 0,
+		next_run_at INTEGER NOT NULL DEFAULT 0,
+		last_status TEXT NOT NULL DEFAULT '',
+		consecutive_failures INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		settings TEXT NOT NULL DEFAULT '{}',
+		llm_api_key TEXT NOT NULL DEFAULT '',
+		llm_base_url TEXT NOT NULL DEFAULT '',
+		llm_model TEXT NOT NULL DEFAULT '',
+		max_notebooks INTEGER NOT NULL DEFAULT 0,
+		max_sources INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+
+	INSERT OR IGNORE INTO workspaces (id, name, created_at, updated_at)
+	VALUES ('default', 'Default', strftime('%s', 'now'), strftime('%s', 'now'));
+
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (workspace_id, user_id),
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS account_jobs (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		result_path TEXT NOT NULL DEFAULT '',
+		summary TEXT NOT NULL DEFAULT '{}',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL DEFAULT '',
+		response BLOB,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (scope, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS notebook_hooks (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		event TEXT NOT NULL,
+		script TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS scheduled_prompt_runs (
+		id TEXT PRIMARY KEY,
+		prompt_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		note_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL,
+		FOREIGN KEY (prompt_id) REFERENCES scheduled_prompts(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		content_type TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		received INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notebook_topics (
+		notebook_id TEXT PRIMARY KEY,
+		topics TEXT NOT NULL,
+		method TEXT NOT NULL DEFAULT '',
+		fingerprint TEXT NOT NULL,
+		generated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS related_index (
+		item_id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		notebook_id TEXT NOT NULL,
+		title TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		terms TEXT NOT NULL,
+		vector BLOB,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS moderation_events (
+		id TEXT PRIMARY KEY,
+		workspace_id TEXT NOT NULL,
+		notebook_id TEXT NOT NULL DEFAULT '',
+		session_id TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL DEFAULT '',
+		stage TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		categories TEXT NOT NULL DEFAULT '[]',
+		excerpt TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS llm_calls (
+		id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		provider TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		request TEXT NOT NULL,
+		response TEXT,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES chat_sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS eval_cases (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		question TEXT NOT NULL,
+		expected_source_ids TEXT NOT NULL DEFAULT '[]',
+		expected_answer TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS eval_runs (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		prompts TEXT NOT NULL DEFAULT '{}',
+		model TEXT NOT NULL DEFAULT '',
+		cases INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		scores TEXT NOT NULL DEFAULT '{}',
+		results TEXT NOT NULL DEFAULT '[]',
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS experiments (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		variants TEXT NOT NULL DEFAULT '[]',
+		created_at INTEGER NOT NULL,
+		stopped_at INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS message_feedback (
+		message_id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		rating INTEGER NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (message_id) REFERENCES chat_messages(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS job_runs (
+		name TEXT PRIMARY KEY,
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		duration_ms INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS outbox (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		op TEXT NOT NULL,
+		item_id TEXT NOT NULL DEFAULT '',
+		notebook_id TEXT NOT NULL DEFAULT '',
+		previous_notebook_id TEXT NOT NULL DEFAULT '',
+		workspace_id TEXT NOT NULL DEFAULT '',
+		target TEXT NOT NULL DEFAULT '',
+		payload TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		delivered_at INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS bot_connections (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		platform TEXT NOT NULL,
+		mode TEXT NOT NULL DEFAULT 'chat',
+		token TEXT NOT NULL UNIQUE,
+		bot_token TEXT NOT NULL DEFAULT '',
+		signing_secret TEXT NOT NULL DEFAULT '',
+		allowed_users TEXT NOT NULL DEFAULT '[]',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS bot_threads (
+		connection_id TEXT NOT NULL,
+		thread_key TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (connection_id, thread_key),
+		FOREIGN KEY (connection_id) REFERENCES bot_connections(id) ON DELETE CASCADE,
+		FOREIGN KEY (session_id) REFERENCES chat_sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS push_devices (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		token TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (provider, token)
+	);
+
+	CREATE TABLE IF NOT EXISTS note_reminders (
+		note_id TEXT PRIMARY KEY,
+		snoozed_until TEXT NOT NULL,
+		sent_at INTEGER NOT NULL,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS published_notes (
+		note_id TEXT PRIMARY KEY,
+		slug TEXT NOT NULL UNIQUE,
+		theme TEXT NOT NULL,
+		published_at INTEGER NOT NULL,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS workspace_sites (
+		workspace_id TEXT PRIMARY KEY,
+		domain TEXT UNIQUE,
+		title TEXT NOT NULL DEFAULT '',
+		logo_url TEXT NOT NULL DEFAULT '',
+		accent_color TEXT NOT NULL DEFAULT '',
+		background_color TEXT NOT NULL DEFAULT '',
+		text_color TEXT NOT NULL DEFAULT '',
+		font TEXT NOT NULL DEFAULT '',
+		heading_font TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at INTEGER,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at INTEGER,
+		PRIMARY KEY (user_id, code_hash),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS user_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL,
+		step_up_at INTEGER,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS quarantined_files (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		content_type TEXT NOT NULL DEFAULT '',
+		file_size INTEGER NOT NULL DEFAULT 0,
+		path TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		origin TEXT NOT NULL,
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_sources_notebook ON sources(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_attachments_notebook ON attachments(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_notes_notebook ON notes(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_chat_sessions_notebook ON chat_sessions(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_chat_messages_session ON chat_messages(session_id);
 	CREATE INDEX IF NOT EXISTS idx_podcasts_notebook ON podcasts(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_notebook_hooks_notebook ON notebook_hooks(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_scheduled_prompts_notebook ON scheduled_prompts(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_scheduled_prompt_runs_prompt ON scheduled_prompt_runs(prompt_id, started_at);
+	CREATE INDEX IF NOT EXISTS idx_upload_sessions_updated ON upload_sessions(updated_at);
+	CREATE INDEX IF NOT EXISTS idx_quarantined_files_notebook ON quarantined_files(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_entity_mentions_entity ON entity_mentions(entity_id);
+	CREATE INDEX IF NOT EXISTS idx_entity_mentions_source ON entity_mentions(source_id);
+	CREATE INDEX IF NOT EXISTS idx_entity_mentions_note ON entity_mentions(note_id);
+	CREATE INDEX IF NOT EXISTS idx_suggestion_feedback_user ON suggestion_feedback(user_id, workspace_id, kind);
+	CREATE INDEX IF NOT EXISTS idx_note_references_target ON note_references(target_type, target_id);
+	CREATE INDEX IF NOT EXISTS idx_note_comments_note ON note_comments(note_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_source_highlights_source ON source_highlights(source_id, start);
+	CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_changes_scope ON changes(kind, scope_id, seq);
+	CREATE INDEX IF NOT EXISTS idx_changes_changed ON changes(changed_at);
+	CREATE INDEX IF NOT EXISTS idx_related_index_notebook ON related_index(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_note_views_notebook ON note_views(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_boards_notebook ON boards(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_board_columns_board ON board_columns(board_id, position);
+	CREATE INDEX IF NOT EXISTS idx_board_cards_column ON board_cards(column_id, position);
+	CREATE INDEX IF NOT EXISTS idx_moderation_events_workspace ON moderation_events(workspace_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_llm_calls_message ON llm_calls(message_id);
+	CREATE INDEX IF NOT EXISTS idx_llm_calls_session ON llm_calls(session_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_eval_cases_notebook ON eval_cases(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_eval_runs_notebook ON eval_runs(notebook_id, started_at);
+	CREATE INDEX IF NOT EXISTS idx_experiments_notebook ON experiments(notebook_id, status);
+	CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox(status, next_attempt_at, seq);
+	CREATE INDEX IF NOT EXISTS idx_bot_connections_notebook ON bot_connections(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_push_devices_user ON push_devices(user_id);
+	CREATE INDEX IF NOT EXISTS idx_user_sessions_user ON user_sessions(user_id);
 	`
 
-	_, err := s.db.Exec(schema)
+	// Sessions took over from the one API token of each user; when they
+	// are new, the tokens become the users' first sessions
+	var hadSessions int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'user_sessions'`).Scan(&hadSessions); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	if hadSessions == 0 {
+		if err := backfillUserSessions(context.Background(), s.db); err != nil {
+			return err
+		}
+	}
+
+	return s.migrate()
+}
+
+// migrate applies additive changes to databases created by older versions
+func (s *Store) migrate() error {
+	columns := []struct{ table, column, definition string }{
+		{"sources", "content_hash", "TEXT"},
+		{"sources", "linked_source_id", "TEXT"},
+		{"sources", "included_in_retrieval", "INTEGER NOT NULL DEFAULT 1"},
+		{"chat_messages", "tool_calls", "TEXT"},
+		{"chat_sessions", "notebook_ids", "TEXT"},
+		{"notebook_chat_settings", "tools", "TEXT"},
+		{"notebooks", "workspace_id", "TEXT NOT NULL DEFAULT 'default'"},
+		{"workspaces", "max_storage_mb", "INTEGER NOT NULL DEFAULT 0"},
+		{"notebooks", "archived_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"notebooks", "trashed_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"attachments", "thumbnail_path", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "is_admin", "INTEGER NOT NULL DEFAULT 0"},
+		{"notebooks", "language", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range columns {
+		if err := s.ensureColumn(col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_sources_content_hash ON sources(content_hash)`); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_notebooks_workspace ON notebooks(workspace_id)`); err != nil {
+		return err
+	}
+	// Triggers read notebooks.workspace_id, so they come after the columns
+	if err := s.ensureChangeTriggers(); err != nil {
+		return err
+	}
+	if err := s.ensureOutboxTriggers(); err != nil {
+		return err
+	}
+
+	return s.backfillContentHashes()
+}
+
+// ensureColumn adds a column to a table if it does not exist yet
+func (s *Store) ensureColumn(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
+// backfillContentHashes hashes sources created before content hashing existed
+func (s *Store) backfillContentHashes() error {
+	rows, err := s.db.Query(`SELECT id, content FROM sources WHERE content_hash IS NULL AND content != ''`)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var id, content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = ContentHash(content)
+	}
+	rows.Close()
+
+	for id, hash := range hashes {
+		if _, err := s.db.Exec(`UPDATE sources SET content_hash = ? WHERE id = ?`, hash, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Notebook operations
 
-// CreateNotebook creates a new notebook
+// CreateNotebook creates a new notebook in the default workspace
 func (s *Store) CreateNotebook(ctx context.Context, name, description string, metadata map[string]interface{}) (*Notebook, error) {
+	return s.CreateNotebookInWorkspace(ctx, DefaultWorkspaceID, name, description, metadata)
+}
+
+// CreateNotebookInWorkspace creates a new notebook in a workspace
+func (s *Store) CreateNotebookInWorkspace(ctx context.Context, workspaceID, name, description string, metadata map[string]interface{}) (*Notebook, error) {
 	id := uuid.New().String()
 	now := time.Now()
 
-	metadataJSON, _ := json.Marshal(metadata)
+	metadataJSON, err := encodeMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO notebooks (id, name, description, created_at, updated_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, id, name, description, now.Unix(), now.Unix(), string(metadataJSON))
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO notebooks (id, name, description, created_at, updated_at, metadata, workspace_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, name, description, now.Unix(), now.Unix(), string(metadataJSON), workspaceID)
 	if err != nil {
 		return nil, err
 	}
@@ -162,14 +861,14 @@ func (s *Store) CreateNotebook(ctx context.Context, name, description string, me
 func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 	var nb Notebook
 	var metadataJSON string
-	var createdAt, updatedAt int64
+	var createdAt, updatedAt, archivedAt, trashedAt int64
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, name, description, created_at, updated_at, metadata
+		SELECT id, name, description, created_at, updated_at, metadata, workspace_id, archived_at, trashed_at, language
 		FROM notebooks WHERE id = ?
-	`, id).Scan(&nb.ID, &nb.Name, &nb.Description, &createdAt, &updatedAt, &metadataJSON)
+	`, id).Scan(&nb.ID, &nb.Name, &nb.Description, &createdAt, &updatedAt, &metadataJSON, &nb.WorkspaceID, &archivedAt, &trashedAt, &nb.Language)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("notebook not found")
+		return nil, notFoundError("notebook")
 	}
 	if err != nil {
 		return nil, err
@@ -177,6 +876,8 @@ func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 
 	nb.CreatedAt = time.Unix(createdAt, 0)
 	nb.UpdatedAt = time.Unix(updatedAt, 0)
+	nb.ArchivedAt = timeOrNil(archivedAt)
+	nb.TrashedAt = timeOrNil(trashedAt)
 
 	if metadataJSON != "" {
 		json.Unmarshal([]byte(metadataJSON), &nb.Metadata)
@@ -184,13 +885,14 @@ func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 		nb.Metadata = make(map[string]interface{})
 	}
 
+	nb.Type = notebookType(nb.Metadata)
 	return &nb, nil
 }
 
 // ListNotebooks retrieves all notebooks
 func (s *Store) ListNotebooks(ctx context.Context) ([]Notebook, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, name, description, created_at, updated_at, metadata
+		SELECT id, name, description, created_at, updated_at, metadata, workspace_id, archived_at, trashed_at, language
 		FROM notebooks ORDER BY updated_at DESC
 	`)
 	if err != nil {
@@ -202,14 +904,16 @@ func (s *Store) ListNotebooks(ctx context.Context) ([]Notebook, error) {
 	for rows.Next() {
 		var nb Notebook
 		var metadataJSON string
-		var createdAt, updatedAt int64
+		var createdAt, updatedAt, archivedAt, trashedAt int64
 
-		if err := rows.Scan(&nb.ID, &nb.Name, &nb.Description, &createdAt, &updatedAt, &metadataJSON); err != nil {
+		if err := rows.Scan(&nb.ID, &nb.Name, &nb.Description, &createdAt, &updatedAt, &metadataJSON, &nb.WorkspaceID, &archivedAt, &trashedAt, &nb.Language); err != nil {
 			return nil, err
 		}
 
 		nb.CreatedAt = time.Unix(createdAt, 0)
 		nb.UpdatedAt = time.Unix(updatedAt, 0)
+		nb.ArchivedAt = timeOrNil(archivedAt)
+		nb.TrashedAt = timeOrNil(trashedAt)
 
 		if metadataJSON != "" {
 			json.Unmarshal([]byte(metadataJSON), &nb.Metadata)
@@ -217,6 +921,7 @@ func (s *Store) ListNotebooks(ctx context.Context) ([]Notebook, error) {
 			nb.Metadata = make(map[string]interface{})
 		}
 
+		nb.Type = notebookType(nb.Metadata)
 		notebooks = append(notebooks, nb)
 	}
 
@@ -227,9 +932,12 @@ func (s *Store) ListNotebooks(ctx context.Context) ([]Notebook, error) {
 func (s *Store) UpdateNotebook(ctx context.Context, id string, name, description string, metadata map[string]interface{}) (*Notebook, error) {
 	now := time.Now()
 
-	metadataJSON, _ := json.Marshal(metadata)
+	metadataJSON, err := encodeMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := s.db.ExecContext(ctx, `
+	_, err = s.db.ExecContext(ctx, `
 		UPDATE notebooks
 		SET name = ?, description = ?, updated_at = ?, metadata = ?
 		WHERE id = ?
@@ -251,7 +959,7 @@ func (s *Store) DeleteNotebook(ctx context.Context, id string) error {
 func (s *Store) ListNotebooksWithStats(ctx context.Context) ([]NotebookWithStats, error) {
 	query := `
 		SELECT
-			n.id, n.name, n.description, n.created_at, n.updated_at, n.metadata,
+			n.id, n.name, n.description, n.created_at, n.updated_at, n.metadata, n.workspace_id, n.archived_at, n.trashed_at, n.language,
 			COALESCE((SELECT COUNT(*) FROM sources WHERE notebook_id = n.id), 0) as source_count,
 			COALESCE((SELECT COUNT(*) FROM notes WHERE notebook_id = n.id), 0) as note_count
 		FROM notebooks n
@@ -268,14 +976,17 @@ func (s *Store) ListNotebooksWithStats(ctx context.Context) ([]NotebookWithStats
 	for rows.Next() {
 		var nb NotebookWithStats
 		var metadataJSON string
-		var createdAt, updatedAt int64
+		var createdAt, updatedAt, archivedAt, trashedAt int64
 
-		if err := rows.Scan(&nb.ID, &nb.Name, &nb.Description, &createdAt, &updatedAt, &metadataJSON, &nb.SourceCount, &nb.NoteCount); err != nil {
+		if err := rows.Scan(&nb.ID, &nb.Name, &nb.Description, &createdAt, &updatedAt, &metadataJSON, &nb.WorkspaceID,
+			&archivedAt, &trashedAt, &nb.Language, &nb.SourceCount, &nb.NoteCount); err != nil {
 			return nil, err
 		}
 
 		nb.CreatedAt = time.Unix(createdAt, 0)
 		nb.UpdatedAt = time.Unix(updatedAt, 0)
+		nb.ArchivedAt = timeOrNil(archivedAt)
+		nb.TrashedAt = timeOrNil(trashedAt)
 
 		if metadataJSON != "" {
 			json.Unmarshal([]byte(metadataJSON), &nb.Metadata)
@@ -283,6 +994,7 @@ func (s *Store) ListNotebooksWithStats(ctx context.Context) ([]NotebookWithStats
 			nb.Metadata = make(map[string]interface{})
 		}
 
+		nb.Type = notebookType(nb.Metadata)
 		notebooks = append(notebooks, nb)
 	}
 
@@ -291,94 +1003,234 @@ func (s *Store) ListNotebooksWithStats(ctx context.Context) ([]NotebookWithStats
 
 // Source operations
 
-// CreateSource creates a new source
+// sourceSelect selects source columns, resolving the content of linked
+// (deduplicated) sources from the source they point to
+const sourceSelect = `
+	SELECT s.id, s.notebook_id, s.name, s.type, s.url, COALESCE(NULLIF(s.content, ''), l.content, ''),
+		s.file_name, s.file_size, s.chunk_count, COALESCE(s.content_hash, ''), COALESCE(s.linked_source_id, ''),
+		s.included_in_retrieval, s.created_at, s.updated_at, s.metadata
+	FROM sources s LEFT JOIN sources l ON l.id = s.linked_source_id`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqlExecer is implemented by *sql.DB and *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func scanSource(row rowScanner) (*Source, error) {
+	var src Source
+	var metadataJSON string
+	var createdAt, updatedAt int64
+	var included int
+
+	if err := row.Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
+		&src.FileName, &src.FileSize, &src.ChunkCount, &src.ContentHash, &src.LinkedSourceID,
+		&included, &createdAt, &updatedAt, &metadataJSON); err != nil {
+		return nil, err
+	}
+
+	src.IncludedInRetrieval = included == 1
+	src.CreatedAt = time.Unix(createdAt, 0)
+	src.UpdatedAt = time.Unix(updatedAt, 0)
+
+	if metadataJSON != "" {
+		json.Unmarshal([]byte(metadataJSON), &src.Metadata)
+	}
+	if src.Metadata == nil {
+		src.Metadata = make(map[string]interface{})
+	}
+
+	return &src, nil
+}
+
+// ContentHash returns the hash used to detect duplicate source content.
+// Whitespace is normalized so re-extractions of the same document match.
+func ContentHash(content string) string {
+	normalized := strings.Join(strings.Fields(content), " ")
+	if normalized == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSource creates a new source. New sources are included in retrieval;
+// linked sources store no content of their own.
 func (s *Store) CreateSource(ctx context.Context, source *Source) error {
 	source.ID = uuid.New().String()
 	now := time.Now()
 	source.CreatedAt = now
 	source.UpdatedAt = now
+	source.IncludedInRetrieval = true
+
+	if source.ContentHash == "" {
+		source.ContentHash = ContentHash(source.Content)
+	}
+
+	content := source.Content
+	if source.LinkedSourceID != "" {
+		content = ""
+	}
 
 	metadataJSON, _ := json.Marshal(source.Metadata)
 
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO sources (id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, source.ID, source.NotebookID, source.Name, source.Type, source.URL, source.Content,
-		source.FileName, source.FileSize, source.ChunkCount, now.Unix(), now.Unix(), string(metadataJSON))
+		INSERT INTO sources (id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, content_hash, linked_source_id, created_at, updated_at, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, source.ID, source.NotebookID, source.Name, source.Type, source.URL, content,
+		source.FileName, source.FileSize, source.ChunkCount, source.ContentHash, nullString(source.LinkedSourceID),
+		now.Unix(), now.Unix(), string(metadataJSON))
 
 	return err
 }
 
 // GetSource retrieves a source by ID
 func (s *Store) GetSource(ctx context.Context, id string) (*Source, error) {
-	var src Source
-	var metadataJSON string
-	var createdAt, updatedAt int64
-
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata
-		FROM sources WHERE id = ?
-	`, id).Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
-		&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON)
+	src, err := scanSource(s.db.QueryRowContext(ctx, sourceSelect+` WHERE s.id = ?`, id))
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("source not found")
+		return nil, notFoundError("source")
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	src.CreatedAt = time.Unix(createdAt, 0)
-	src.UpdatedAt = time.Unix(updatedAt, 0)
+	return src, nil
+}
 
-	if metadataJSON != "" {
-		json.Unmarshal([]byte(metadataJSON), &src.Metadata)
-	} else {
-		src.Metadata = make(map[string]interface{})
+// ListSources retrieves all sources for a notebook
+func (s *Store) ListSources(ctx context.Context, notebookID string) ([]Source, error) {
+	return s.querySources(ctx, sourceSelect+` WHERE s.notebook_id = ? ORDER BY s.created_at DESC`, notebookID)
+}
+
+// FindSourcesByHash retrieves every source, across notebooks, whose content hash matches
+func (s *Store) FindSourcesByHash(ctx context.Context, hash string) ([]Source, error) {
+	if hash == "" {
+		return []Source{}, nil
 	}
+	return s.querySources(ctx, sourceSelect+` WHERE s.content_hash = ? ORDER BY s.created_at ASC`, hash)
+}
 
-	return &src, nil
+// EachSource calls fn with each source of a notebook, newest first, as the
+// rows are read. An error from fn stops the scan and is returned.
+func (s *Store) EachSource(ctx context.Context, notebookID string, fn func(*Source) error) error {
+	return s.eachSource(ctx, fn, sourceSelect+` WHERE s.notebook_id = ? ORDER BY s.created_at DESC`, notebookID)
 }
 
-// ListSources retrieves all sources for a notebook
-func (s *Store) ListSources(ctx context.Context, notebookID string) ([]Source, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata
-		FROM sources WHERE notebook_id = ? ORDER BY created_at DESC
-	`, notebookID)
+func (s *Store) querySources(ctx context.Context, query string, args ...interface{}) ([]Source, error) {
+	sources := make([]Source, 0)
+	err := s.eachSource(ctx, func(src *Source) error {
+		sources = append(sources, *src)
+		return nil
+	}, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	return sources, nil
+}
+
+func (s *Store) eachSource(ctx context.Context, fn func(*Source) error, query string, args ...interface{}) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	sources := make([]Source, 0)
 	for rows.Next() {
-		var src Source
-		var metadataJSON string
-		var createdAt, updatedAt int64
-
-		if err := rows.Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
-			&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON); err != nil {
-			return nil, err
+		src, err := scanSource(rows)
+		if err != nil {
+			return err
 		}
+		if err := fn(src); err != nil {
+			return err
+		}
+	}
 
-		src.CreatedAt = time.Unix(createdAt, 0)
-		src.UpdatedAt = time.Unix(updatedAt, 0)
+	return rows.Err()
+}
 
-		if metadataJSON != "" {
-			json.Unmarshal([]byte(metadataJSON), &src.Metadata)
-		} else {
-			src.Metadata = make(map[string]interface{})
+// DeleteSource deletes a source. Sources linked to it are repointed to the
+// first of them, which takes over the stored content.
+func (s *Store) DeleteSource(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var heir string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM sources WHERE linked_source_id = ? ORDER BY created_at ASC LIMIT 1
+	`, id).Scan(&heir)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if heir != "" {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE sources SET content = (SELECT content FROM sources WHERE id = ?), linked_source_id = NULL
+			WHERE id = ?
+		`, id, heir); err != nil {
+			return err
 		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE sources SET linked_source_id = ? WHERE linked_source_id = ?
+		`, heir, id); err != nil {
+			return err
+		}
+	}
 
-		sources = append(sources, src)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sources WHERE id = ?`, id); err != nil {
+		return err
 	}
 
-	return sources, nil
+	return tx.Commit()
 }
 
-// DeleteSource deletes a source
-func (s *Store) DeleteSource(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM sources WHERE id = ?`, id)
+// UpdateSource updates a source's name, content, metadata and chunk count.
+// Changing the content of a linked source detaches it from the original.
+func (s *Store) UpdateSource(ctx context.Context, source *Source) error {
+	now := time.Now()
+	source.UpdatedAt = now
+	source.ContentHash = ContentHash(source.Content)
+
+	metadataJSON, _ := json.Marshal(source.Metadata)
+
+	if source.LinkedSourceID != "" {
+		original, err := s.GetSource(ctx, source.LinkedSourceID)
+		if err == nil && original.ContentHash == source.ContentHash {
+			_, err := s.db.ExecContext(ctx, `
+				UPDATE sources SET name = ?, url = ?, chunk_count = ?, updated_at = ?, metadata = ?
+				WHERE id = ?
+			`, source.Name, source.URL, source.ChunkCount, now.Unix(), string(metadataJSON), source.ID)
+			return err
+		}
+		source.LinkedSourceID = ""
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sources SET name = ?, url = ?, content = ?, content_hash = ?, linked_source_id = NULL,
+			chunk_count = ?, updated_at = ?, metadata = ?
+		WHERE id = ?
+	`, source.Name, source.URL, source.Content, source.ContentHash, source.ChunkCount, now.Unix(), string(metadataJSON), source.ID)
+
+	return err
+}
+
+// SetSourceIncluded includes or excludes a source from retrieval
+func (s *Store) SetSourceIncluded(ctx context.Context, id string, included bool) error {
+	value := 0
+	if included {
+		value = 1
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sources SET included_in_retrieval = ?, updated_at = ? WHERE id = ?
+	`, value, time.Now().Unix(), id)
+
 	return err
 }
 
@@ -397,10 +1249,13 @@ func (s *Store) CreateNote(ctx context.Context, note *Note) error {
 	note.CreatedAt = now
 	note.UpdatedAt = now
 
-	metadataJSON, _ := json.Marshal(note.Metadata)
+	metadataJSON, err := encodeMetadata(note.Metadata)
+	if err != nil {
+		return err
+	}
 	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
 
-	_, err := s.db.ExecContext(ctx, `
+	_, err = s.db.ExecContext(ctx, `
 		INSERT INTO notes (id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, note.ID, note.NotebookID, note.Title, note.Content, note.Type, string(sourceIDsJSON),
@@ -421,7 +1276,7 @@ func (s *Store) GetNote(ctx context.Context, id string) (*Note, error) {
 	`, id).Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
 		&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("note not found")
+		return nil, notFoundError("note")
 	}
 	if err != nil {
 		return nil, err
@@ -445,16 +1300,30 @@ func (s *Store) GetNote(ctx context.Context, id string) (*Note, error) {
 
 // ListNotes retrieves all notes for a notebook
 func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error) {
+	notes := make([]Note, 0)
+	err := s.EachNote(ctx, notebookID, func(note *Note) error {
+		notes = append(notes, *note)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// EachNote calls fn with each note of a notebook, newest first, as the rows
+// are read, so large notebooks can be streamed without loading every note.
+// An error from fn stops the scan and is returned.
+func (s *Store) EachNote(ctx context.Context, notebookID string, fn func(*Note) error) error {
 	rows, err := s.db.QueryContext(ctx, `
 		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata
 		FROM notes WHERE notebook_id = ? ORDER BY created_at DESC
 	`, notebookID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	notes := make([]Note, 0)
 	for rows.Next() {
 		var note Note
 		var metadataJSON, sourceIDsJSON string
@@ -462,7 +1331,7 @@ func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error
 
 		if err := rows.Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
 			&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON); err != nil {
-			return nil, err
+			return err
 		}
 
 		note.CreatedAt = time.Unix(createdAt, 0)
@@ -478,10 +1347,56 @@ func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error
 			json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
 		}
 
-		notes = append(notes, note)
+		if err := fn(&note); err != nil {
+			return err
+		}
 	}
 
-	return notes, nil
+	return rows.Err()
+}
+
+// UpdateNote saves a note's notebook, title, content, source IDs and metadata
+func (s *Store) UpdateNote(ctx context.Context, note *Note) error {
+	return s.updateNote(ctx, note, nil)
+}
+
+// UpdateNoteIfUnchanged saves a note like UpdateNote, unless it was changed
+// since base was read, in which case it fails with ErrConflict
+func (s *Store) UpdateNoteIfUnchanged(ctx context.Context, note, base *Note) error {
+	return s.updateNote(ctx, note, base)
+}
+
+func (s *Store) updateNote(ctx context.Context, note, base *Note) error {
+	note.UpdatedAt = time.Now()
+	metadataJSON, err := encodeMetadata(note.Metadata)
+	if err != nil {
+		return err
+	}
+	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
+
+	query := `
+		UPDATE notes SET notebook_id = ?, title = ?, content = ?, source_ids = ?, metadata = ?, updated_at = ?
+		WHERE id = ?`
+	args := []interface{}{note.NotebookID, note.Title, note.Content, string(sourceIDsJSON), string(metadataJSON), note.UpdatedAt.Unix(), note.ID}
+	if base != nil {
+		// Timestamps are in seconds, so the content is compared as well
+		query += ` AND updated_at = ? AND content = ?`
+		args = append(args, base.UpdatedAt.Unix(), base.Content)
+	}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if base != nil {
+			if _, err := s.GetNote(ctx, note.ID); err != nil {
+				return err
+			}
+			return conflictError("the note was changed since it was read")
+		}
+		return notFoundError("note")
+	}
+	return nil
 }
 
 // DeleteNote deletes a note
@@ -517,15 +1432,15 @@ func (s *Store) CreateChatSession(ctx context.Context, notebookID, title string)
 // GetChatSession retrieves a chat session by ID
 func (s *Store) GetChatSession(ctx context.Context, id string) (*ChatSession, error) {
 	var session ChatSession
-	var metadataJSON string
+	var metadataJSON, notebookIDsJSON string
 	var createdAt, updatedAt int64
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, notebook_id, title, created_at, updated_at, metadata
+		SELECT id, notebook_id, title, created_at, updated_at, metadata, COALESCE(notebook_ids, '')
 		FROM chat_sessions WHERE id = ?
-	`, id).Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON)
+	`, id).Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON, &notebookIDsJSON)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("chat session not found")
+		return nil, notFoundError("chat session")
 	}
 	if err != nil {
 		return nil, err
@@ -539,6 +1454,7 @@ func (s *Store) GetChatSession(ctx context.Context, id string) (*ChatSession, er
 	} else {
 		session.Metadata = make(map[string]interface{})
 	}
+	session.NotebookIDs = parseSessionNotebooks(session.NotebookID, notebookIDsJSON)
 
 	// Load messages
 	session.Messages, err = s.listChatMessages(ctx, id)
@@ -552,7 +1468,7 @@ func (s *Store) GetChatSession(ctx context.Context, id string) (*ChatSession, er
 // ListChatSessions retrieves all chat sessions for a notebook
 func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]ChatSession, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, notebook_id, title, created_at, updated_at, metadata
+		SELECT id, notebook_id, title, created_at, updated_at, metadata, COALESCE(notebook_ids, '')
 		FROM chat_sessions WHERE notebook_id = ? ORDER BY updated_at DESC
 	`, notebookID)
 	if err != nil {
@@ -563,10 +1479,10 @@ func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]Chat
 	sessions := make([]ChatSession, 0)
 	for rows.Next() {
 		var session ChatSession
-		var metadataJSON string
+		var metadataJSON, notebookIDsJSON string
 		var createdAt, updatedAt int64
 
-		if err := rows.Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON); err != nil {
+		if err := rows.Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON, &notebookIDsJSON); err != nil {
 			return nil, err
 		}
 
@@ -578,6 +1494,7 @@ func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]Chat
 		} else {
 			session.Metadata = make(map[string]interface{})
 		}
+		session.NotebookIDs = parseSessionNotebooks(session.NotebookID, notebookIDsJSON)
 
 		sessions = append(sessions, session)
 	}
@@ -585,18 +1502,26 @@ func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]Chat
 	return sessions, nil
 }
 
-// AddChatMessage adds a message to a chat session
-func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content string, sources []string) (*ChatMessage, error) {
+// AddChatMessage adds a message to a chat session; metadata may be nil
+func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content string, sources []string, toolCalls []ToolCallTrace, metadata map[string]interface{}) (*ChatMessage, error) {
 	id := uuid.New().String()
 	now := time.Now()
 
-	metadataJSON, _ := json.Marshal(map[string]interface{}{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadataJSON, _ := json.Marshal(metadata)
 	sourcesJSON, _ := json.Marshal(sources)
+	var toolCallsJSON interface{}
+	if len(toolCalls) > 0 {
+		b, _ := json.Marshal(toolCalls)
+		toolCallsJSON = string(b)
+	}
 
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO chat_messages (id, session_id, role, content, sources, created_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, id, sessionID, role, content, string(sourcesJSON), now.Unix(), string(metadataJSON))
+		INSERT INTO chat_messages (id, session_id, role, content, sources, tool_calls, created_at, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, sessionID, role, content, string(sourcesJSON), toolCallsJSON, now.Unix(), string(metadataJSON))
 	if err != nil {
 		return nil, err
 	}
@@ -613,7 +1538,7 @@ func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content str
 // listChatMessages retrieves all messages for a session
 func (s *Store) listChatMessages(ctx context.Context, sessionID string) ([]ChatMessage, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, session_id, role, content, sources, created_at, metadata
+		SELECT id, session_id, role, content, sources, COALESCE(tool_calls, ''), created_at, metadata
 		FROM chat_messages WHERE session_id = ? ORDER BY created_at ASC
 	`, sessionID)
 	if err != nil {
@@ -624,10 +1549,10 @@ func (s *Store) listChatMessages(ctx context.Context, sessionID string) ([]ChatM
 	messages := make([]ChatMessage, 0)
 	for rows.Next() {
 		var msg ChatMessage
-		var metadataJSON, sourcesJSON string
+		var metadataJSON, sourcesJSON, toolCallsJSON string
 		var createdAt int64
 
-		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &toolCallsJSON, &createdAt, &metadataJSON); err != nil {
 			return nil, err
 		}
 
@@ -643,6 +1568,10 @@ func (s *Store) listChatMessages(ctx context.Context, sessionID string) ([]ChatM
 			json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
 		}
 
+		if toolCallsJSON != "" {
+			json.Unmarshal([]byte(toolCallsJSON), &msg.ToolCalls)
+		}
+
 		messages = append(messages, msg)
 	}
 
@@ -652,15 +1581,15 @@ func (s *Store) listChatMessages(ctx context.Context, sessionID string) ([]ChatM
 // getChatMessage retrieves a single message by ID
 func (s *Store) getChatMessage(ctx context.Context, id string) (*ChatMessage, error) {
 	var msg ChatMessage
-	var metadataJSON, sourcesJSON string
+	var metadataJSON, sourcesJSON, toolCallsJSON string
 	var createdAt int64
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, session_id, role, content, sources, created_at, metadata
+		SELECT id, session_id, role, content, sources, COALESCE(tool_calls, ''), created_at, metadata
 		FROM chat_messages WHERE id = ?
-	`, id).Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON)
+	`, id).Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &toolCallsJSON, &createdAt, &metadataJSON)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("chat message not found")
+		return nil, notFoundError("chat message")
 	}
 	if err != nil {
 		return nil, err
@@ -678,6 +1607,10 @@ func (s *Store) getChatMessage(ctx context.Context, id string) (*ChatMessage, er
 		json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
 	}
 
+	if toolCallsJSON != "" {
+		json.Unmarshal([]byte(toolCallsJSON), &msg.ToolCalls)
+	}
+
 	return &msg, nil
 }
 
@@ -687,6 +1620,14 @@ func (s *Store) DeleteChatSession(ctx context.Context, id string) error {
 	return err
 }
 
+// nullString maps an empty string to SQL NULL
+func nullString(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
 // Close closes the database connection
 func (s *Store) Close() error {
 	return s.db.Close()
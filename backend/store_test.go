@@ -0,0 +1,24 @@
+package backend
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestStore opens a store on a fresh database that is closed when the
+// test ends
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(Config{StorePath: filepath.Join(t.TempDir(), "notex.db")})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
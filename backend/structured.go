@@ -0,0 +1,406 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// structuredRepairs is how many times output that does not match its schema
+// is sent back to the model to be fixed
+const structuredRepairs = 2
+
+// jsonSchema is the subset of JSON Schema that output schemas use. It is
+// also what providers accept in their strict structured output modes, so
+// every property is required and no others are allowed.
+type jsonSchema struct {
+	Type        string                 `json:"type"`
+	Description string                 `json:"description,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+}
+
+// MarshalJSON writes the schema with its required properties and with
+// additionalProperties false for objects
+func (s *jsonSchema) MarshalJSON() ([]byte, error) {
+	type plain jsonSchema
+	if s.Type != "object" {
+		return json.Marshal((*plain)(s))
+	}
+	return json.Marshal(struct {
+		*plain
+		Required             []string `json:"required"`
+		AdditionalProperties bool     `json:"additionalProperties"`
+	}{(*plain)(s), s.required(), false})
+}
+
+// required lists an object's properties in a stable order
+func (s *jsonSchema) required() []string {
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openAI converts the schema to the OpenAI client's response format type
+func (s *jsonSchema) openAI() *openai.ResponseFormatJSONSchemaProperty {
+	p := &openai.ResponseFormatJSONSchemaProperty{Type: s.Type, Description: s.Description}
+	for _, v := range s.Enum {
+		p.Enum = append(p.Enum, v)
+	}
+	if s.Items != nil {
+		p.Items = s.Items.openAI()
+	}
+	if s.Type == "object" {
+		p.Properties = make(map[string]*openai.ResponseFormatJSONSchemaProperty, len(s.Properties))
+		for name, prop := range s.Properties {
+			p.Properties[name] = prop.openAI()
+		}
+		p.Required = s.required()
+	}
+	return p
+}
+
+// validate checks a decoded JSON value against the schema. The error names
+// the path of the first mismatch, for the model to repair.
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range s.required() {
+			v, ok := obj[name]
+			if !ok {
+				return fmt.Errorf("%s is missing property %q", path, name)
+			}
+			if err := s.Properties[name].validate(v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		for i, item := range items {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fmt.Errorf("%s must be one of %s", path, strings.Join(s.Enum, ", "))
+		}
+	case "number", "integer":
+		n, ok := value.(float64)
+		if !ok || (s.Type == "integer" && n != float64(int64(n))) {
+			return fmt.Errorf("%s must be a %s", path, s.Type)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+	return nil
+}
+
+// OutputSchema is the shape a transformation type's output is generated in
+// by the structured endpoint
+type OutputSchema struct {
+	Name   string      `json:"name"`
+	Schema *jsonSchema `json:"schema"`
+}
+
+func stringSchema(description string) *jsonSchema {
+	return &jsonSchema{Type: "string", Description: description}
+}
+
+func arraySchema(items *jsonSchema) *jsonSchema {
+	return &jsonSchema{Type: "array", Items: items}
+}
+
+func objectSchema(properties map[string]*jsonSchema) *jsonSchema {
+	return &jsonSchema{Type: "object", Properties: properties}
+}
+
+// outputSchemas are the transformation types that can be generated as JSON
+var outputSchemas = map[string]*OutputSchema{
+	"flashcards": {Name: "flashcards", Schema: objectSchema(map[string]*jsonSchema{
+		"cards": arraySchema(objectSchema(map[string]*jsonSchema{
+			"front": stringSchema("the question or term"),
+			"back":  stringSchema("the answer or definition"),
+		})),
+	})},
+	"quiz": {Name: "quiz", Schema: objectSchema(map[string]*jsonSchema{
+		"questions": arraySchema(objectSchema(map[string]*jsonSchema{
+			"type":        {Type: "string", Enum: []string{"multiple_choice", "true_false", "short_answer"}},
+			"question":    stringSchema(""),
+			"options":     {Type: "array", Items: stringSchema(""), Description: "the choices of a multiple choice question, empty otherwise"},
+			"answer":      stringSchema("the correct option, true or false, or a model answer"),
+			"explanation": stringSchema("why the answer is correct"),
+		})),
+	})},
+	"analysis": {Name: "analysis", Schema: objectSchema(map[string]*jsonSchema{
+		"contradictions": arraySchema(objectSchema(map[string]*jsonSchema{
+			"topic": stringSchema("what the claims disagree about"),
+			"claims": arraySchema(objectSchema(map[string]*jsonSchema{
+				"source": {Type: "integer", Description: "the number N of the Source N the claim is made in"},
+				"claim":  stringSchema("what the source says"),
+				"quote":  stringSchema("the passage it says it in, verbatim"),
+			})),
+			"explanation": stringSchema("why the claims cannot both be true"),
+			"severity":    {Type: "string", Enum: []string{AnalysisSeverityHigh, AnalysisSeverityMedium, AnalysisSeverityLow}},
+		})),
+		"gaps": arraySchema(objectSchema(map[string]*jsonSchema{
+			"question":   stringSchema("the question the sources leave open"),
+			"reason":     stringSchema("why it matters and what the sources lack"),
+			"suggestion": stringSchema("what to add or do to answer it"),
+			"severity":   {Type: "string", Enum: []string{AnalysisSeverityHigh, AnalysisSeverityMedium, AnalysisSeverityLow}},
+		})),
+	})},
+	"entities": {Name: "entities", Schema: objectSchema(map[string]*jsonSchema{
+		"entities": arraySchema(objectSchema(map[string]*jsonSchema{
+			"type": {Type: "string", Enum: []string{EntityPerson, EntityOrganization, EntityProject}},
+			"name": stringSchema("as written in the text, untranslated"),
+		})),
+	})},
+}
+
+// structuredLLMs caches an agent's LLMs constrained to each output schema
+type structuredLLMs struct {
+	mu   sync.Mutex
+	llms map[string]llms.Model
+}
+
+// structuredLLM returns the LLM to generate a schema's output with. OpenAI
+// compatible providers are given the schema as their response format, which
+// is set per client; Ollama is asked for JSON per call instead.
+func (a *Agent) structuredLLM(schema *OutputSchema) (llms.Model, error) {
+	if a.cfg.IsOllama() || !a.cfg.LLMNativeStructuredOutput {
+		return a.llm, nil
+	}
+
+	a.structured.mu.Lock()
+	defer a.structured.mu.Unlock()
+	if llm, ok := a.structured.llms[schema.Name]; ok {
+		return llm, nil
+	}
+
+	format := openai.WithResponseFormat(&openai.ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &openai.ResponseFormatJSONSchema{
+			Name:   schema.Name,
+			Strict: true,
+			Schema: schema.Schema.openAI(),
+		},
+	})
+	llm, err := createLLM(a.cfg, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LLM: %w", err)
+	}
+	if llm, err = newResilientLLM(a.cfg, llm, format); err != nil {
+		return nil, err
+	}
+	if a.structured.llms == nil {
+		a.structured.llms = make(map[string]llms.Model)
+	}
+	a.structured.llms[schema.Name] = llm
+	return llm, nil
+}
+
+// schemaInstruction is appended to the prompt of structured output, so
+// providers without native support know the shape too
+func schemaInstruction(schema *OutputSchema) string {
+	data, _ := json.Marshal(schema.Schema)
+	return "\n\n**注意：只输出一个符合以下 JSON Schema 的 JSON 对象，不要输出其他内容，也不要用代码块包裹：**\n" + string(data)
+}
+
+// decodeStructured parses a model's JSON output and checks it against the
+// schema, tolerating code fences and text around the object
+func decodeStructured(content string, schema *OutputSchema) (interface{}, error) {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("output is not a JSON object")
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(content[start:end+1]), &value); err != nil {
+		return nil, fmt.Errorf("output is not valid JSON: %v", err)
+	}
+	if err := schema.Schema.validate(value, "$"); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// GenerateStructured generates a transformation type's output as JSON
+// matching its schema and decodes it into out. Output that does not match
+// is sent back to the model with the mismatch to be repaired, up to
+// structuredRepairs times.
+func (a *Agent) GenerateStructured(ctx context.Context, req *TransformationRequest, sources []Source, out interface{}) (*TransformationResponse, error) {
+	schema, ok := outputSchemas[req.Type]
+	if !ok {
+		return nil, fmt.Errorf("no output schema for %q", req.Type)
+	}
+	prompt, err := a.transformationPrompt(req, sources)
+	if err != nil {
+		return nil, err
+	}
+	data, repairs, answered, err := a.generateJSON(ctx, schema, prompt, out)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"length":  req.Length,
+		"schema":  schema.Name,
+		"repairs": repairs,
+	}
+	if answered.Provider != "" {
+		metadata["answered_by"] = *answered
+	}
+	return &TransformationResponse{
+		Type:      req.Type,
+		Content:   string(data),
+		Sources:   sourceSummaries(sources),
+		CreatedAt: time.Now(),
+		Metadata:  metadata,
+	}, nil
+}
+
+// generateJSON has the model answer a prompt with JSON matching the schema,
+// repairing mismatches, and decodes it into out. It returns the JSON, how
+// many repairs it took and the provider that answered.
+func (a *Agent) generateJSON(ctx context.Context, schema *OutputSchema, prompt string, out interface{}) ([]byte, int, *AnsweredBy, error) {
+	llm, err := a.structuredLLM(schema)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, a.cfg.LLMTimeout)
+	defer cancel()
+	ctx, answered := withAnsweredBy(ctx)
+
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, prompt+schemaInstruction(schema))}
+	var value interface{}
+	repairs := 0
+	for ; ; repairs++ {
+		resp, err := llm.GenerateContent(ctx, messages, llms.WithJSONMode())
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to generate response: %w", err)
+		}
+		if len(resp.Choices) == 0 {
+			return nil, 0, nil, fmt.Errorf("failed to generate response: no choices")
+		}
+		content := resp.Choices[0].Content
+		if value, err = decodeStructured(content, schema); err == nil {
+			break
+		}
+		if repairs == structuredRepairs {
+			return nil, 0, nil, fmt.Errorf("output does not match the %s schema: %w", schema.Name, err)
+		}
+		messages = append(messages,
+			llms.TextParts(llms.ChatMessageTypeAI, content),
+			llms.TextParts(llms.ChatMessageTypeHuman, fmt.Sprintf("上面的输出不符合 JSON Schema：%v。请修正并只输出完整的 JSON 对象。", err)),
+		)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, 0, nil, fmt.Errorf("output does not match the %s schema: %w", schema.Name, err)
+	}
+	return data, repairs, answered, nil
+}
+
+// StructuredResponse is a transformation generated as JSON
+type StructuredResponse struct {
+	Type     string                 `json:"type"`
+	Data     json.RawMessage        `json:"data"`
+	Sources  []SourceSummary        `json:"sources"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// handleStructured generates flashcards, a quiz or the entities of a
+// notebook's sources as JSON matching the type's schema
+func (s *Server) handleStructured(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
+	notebookID := c.Param("id")
+
+	var req TransformationRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if _, ok := outputSchemas[req.Type]; !ok {
+		validationResponse(c, invalidField("type", "must be one of %s", structuredTypes()))
+		return
+	}
+	req.Language = s.notebookLanguage(ctx, notebookID)
+	if req.Format == "" {
+		req.Format = "JSON"
+	}
+
+	sources, ok := s.transformSources(c, ctx, notebookID, &req)
+	if !ok {
+		return
+	}
+
+	var data json.RawMessage
+	response, err := s.notebookAgent(ctx, notebookID).GenerateStructured(ctx, &req, sources, &data)
+	if err != nil {
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Generation failed: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, StructuredResponse{
+		Type:     response.Type,
+		Data:     data,
+		Sources:  response.Sources,
+		Metadata: response.Metadata,
+	})
+}
+
+// structuredTypes lists the types with an output schema for error messages
+func structuredTypes() string {
+	types := make([]string, 0, len(outputSchemas))
+	for t := range outputSchemas {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// handleListOutputSchemas lists the JSON schemas of structured output
+func (s *Server) handleListOutputSchemas(c *gin.Context) {
+	schemas := make([]*OutputSchema, 0, len(outputSchemas))
+	for _, schema := range outputSchemas {
+		schemas = append(schemas, schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Name < schemas[j].Name })
+	c.JSON(http.StatusOK, schemas)
+}
@@ -0,0 +1,541 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Suggestion kinds recorded as feedback
+const (
+	suggestionTag      = "tag"
+	suggestionNotebook = "notebook"
+)
+
+const (
+	// maxSuggestedNotebooks is how many destinations are suggested
+	maxSuggestedNotebooks = 3
+	// maxNoteTerms is how many of a note's terms describe it
+	maxNoteTerms = 30
+	// feedbackHistory is how many recent feedback entries shape suggestions
+	feedbackHistory = 500
+	// maxProfileVectors bounds the cache of embedded notebook profiles
+	maxProfileVectors = 1000
+)
+
+// TagSuggestion is a tag the note could be given
+type TagSuggestion struct {
+	Tag   string  `json:"tag"`
+	Score float64 `json:"score"`
+	// Reason is "model" for tags the LLM proposed and "history" for tags the
+	// user accepted on similar notes
+	Reason string `json:"reason"`
+}
+
+// NotebookSuggestion is a notebook the note could be filed in
+type NotebookSuggestion struct {
+	NotebookID string   `json:"notebook_id"`
+	Name       string   `json:"name"`
+	Score      float64  `json:"score"`
+	Reasons    []string `json:"reasons"`
+}
+
+// NoteSuggestions are the tags and destinations suggested for a note
+type NoteSuggestions struct {
+	NoteID    string               `json:"note_id"`
+	Tags      []TagSuggestion      `json:"tags"`
+	Notebooks []NotebookSuggestion `json:"notebooks"`
+}
+
+// suggestionFeedback is one accepted or rejected suggestion, with the terms
+// of the note it was made for
+type suggestionFeedback struct {
+	Kind     string
+	Value    string
+	Accepted bool
+	Terms    []string
+}
+
+// RecordSuggestionFeedback stores what a user did with suggestions
+func (s *Store) RecordSuggestionFeedback(ctx context.Context, userID, workspaceID string, feedback []suggestionFeedback) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for _, f := range feedback {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO suggestion_feedback (user_id, workspace_id, kind, value, accepted, terms, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, userID, workspaceID, f.Kind, f.Value, f.Accepted, strings.Join(f.Terms, " "), now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListSuggestionFeedback returns a user's most recent feedback in a workspace
+func (s *Store) ListSuggestionFeedback(ctx context.Context, userID, workspaceID string, limit int) ([]suggestionFeedback, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT kind, value, accepted, terms FROM suggestion_feedback
+		WHERE user_id = ? AND workspace_id = ?
+		ORDER BY id DESC LIMIT ?
+	`, userID, workspaceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feedback []suggestionFeedback
+	for rows.Next() {
+		var f suggestionFeedback
+		var accepted int
+		var terms string
+		if err := rows.Scan(&f.Kind, &f.Value, &accepted, &terms); err != nil {
+			return nil, err
+		}
+		f.Accepted = accepted == 1
+		f.Terms = strings.Fields(terms)
+		feedback = append(feedback, f)
+	}
+	return feedback, rows.Err()
+}
+
+// noteTerms are the most frequent words of a text, longest first among
+// equals, ignoring short words. Han characters count as words of their own,
+// since Chinese text has no spaces.
+func noteTerms(text string) []string {
+	counts := make(map[string]int)
+	var word []rune
+	flush := func() {
+		if len(word) > 2 {
+			counts[string(word)]++
+		}
+		word = word[:0]
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			counts[string(r)]++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	terms := make([]string, 0, len(counts))
+	for term := range counts {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		if len(terms[i]) != len(terms[j]) {
+			return len(terms[i]) > len(terms[j])
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > maxNoteTerms {
+		terms = terms[:maxNoteTerms]
+	}
+	return terms
+}
+
+// termOverlap is the share of a's terms that are also in b
+func termOverlap(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	in := make(map[string]bool, len(b))
+	for _, t := range b {
+		in[t] = true
+	}
+	shared := 0
+	for _, t := range a {
+		if in[t] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a))
+}
+
+// embeddingCache keeps the vectors of texts embedded before by content
+// hash, so unchanged texts are not embedded again. It is emptied when it
+// grows past limit.
+type embeddingCache struct {
+	sync.Mutex
+	limit   int
+	vectors map[string][]float32
+}
+
+// embed returns the vector of each text, embedding those not cached
+func (c *embeddingCache) embed(ctx context.Context, embedder *batchEmbedder, texts []string) ([][]float32, error) {
+	keys := make([]string, len(texts))
+	vectors := make([][]float32, len(texts))
+	var missing []string
+	var missingAt []int
+	c.Lock()
+	for i, text := range texts {
+		sum := sha256.Sum256([]byte(text))
+		keys[i] = hex.EncodeToString(sum[:])
+		if v, ok := c.vectors[keys[i]]; ok {
+			vectors[i] = v
+			continue
+		}
+		missing = append(missing, text)
+		missingAt = append(missingAt, i)
+	}
+	c.Unlock()
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	embedded, err := embedder.Embed(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.vectors == nil || len(c.vectors) > c.limit {
+		c.vectors = make(map[string][]float32)
+	}
+	for j, i := range missingAt {
+		vectors[i] = embedded[j]
+		c.vectors[keys[i]] = embedded[j]
+	}
+	return vectors, nil
+}
+
+// profileVectors caches embedded notebook profiles
+var profileVectors = &embeddingCache{limit: maxProfileVectors}
+
+// embedProfiles embeds the note and the notebook profiles, reusing cached
+// profile vectors. It returns nil when embeddings are off or fail.
+func (s *Server) embedProfiles(ctx context.Context, note string, profiles []string) [][]float32 {
+	embedder := s.vectorStore.embedder
+	if embedder == nil {
+		return nil
+	}
+	vectors, err := profileVectors.embed(ctx, embedder, append([]string{note}, profiles...))
+	if err != nil {
+		golog.Warnf("failed to embed notebook profiles, using keywords only: %v", err)
+		return nil
+	}
+	return vectors
+}
+
+// notebookProfile is the text a notebook is recognised by: its name,
+// description and the titles of what is in it
+func (s *Server) notebookProfile(ctx context.Context, nb *Notebook) string {
+	parts := []string{nb.Name, nb.Description}
+	if notes, err := s.store.ListNotes(ctx, nb.ID); err == nil {
+		for _, n := range notes {
+			parts = append(parts, n.Title)
+		}
+	}
+	if sources, err := s.store.ListSources(ctx, nb.ID); err == nil {
+		for _, src := range sources {
+			parts = append(parts, src.Name)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// suggestNotebooks ranks the workspace's notebooks as destinations for a
+// note. Each notebook is scored by how close its profile is to the note, by
+// meaning when embeddings are on and always by shared words, then nudged by
+// where the user filed, or refused to file, notes with similar words.
+func (s *Server) suggestNotebooks(ctx context.Context, ws *Workspace, note *Note, terms []string, feedback []suggestionFeedback) ([]NotebookSuggestion, error) {
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inboxID, _ := ws.Settings[inboxSettingKey].(string)
+	var candidates []Notebook
+	for _, nb := range filterWorkspaceNotebooks(notebooks, ws.ID) {
+		if nb.ID == note.NotebookID || nb.ID == inboxID || nb.ArchivedAt != nil || nb.TrashedAt != nil {
+			continue
+		}
+		candidates = append(candidates, nb)
+	}
+	if len(candidates) == 0 {
+		return []NotebookSuggestion{}, nil
+	}
+
+	profiles := make([]string, len(candidates))
+	for i := range candidates {
+		profiles[i] = s.notebookProfile(ctx, &candidates[i])
+	}
+	vectors := s.embedProfiles(ctx, note.Title+"\n"+note.Content, profiles)
+
+	suggestions := make([]NotebookSuggestion, 0, len(candidates))
+	for i, nb := range candidates {
+		sg := NotebookSuggestion{NotebookID: nb.ID, Name: nb.Name, Reasons: []string{}}
+		lexical := termOverlap(terms, noteTerms(profiles[i]))
+		if vectors != nil {
+			semantic := math.Max(cosineSimilarity(vectors[0], vectors[i+1]), 0)
+			sg.Score = 0.7*semantic + 0.3*lexical
+			if semantic >= 0.5 {
+				sg.Reasons = append(sg.Reasons, "similar content")
+			}
+		} else {
+			sg.Score = lexical
+		}
+		if lexical > 0 {
+			sg.Reasons = append(sg.Reasons, "shared words")
+		}
+
+		var learned float64
+		for _, f := range feedback {
+			if f.Kind != suggestionNotebook || f.Value != nb.ID {
+				continue
+			}
+			weight := 0.1 + termOverlap(terms, f.Terms)
+			if f.Accepted {
+				learned += weight
+			} else {
+				learned -= weight
+			}
+		}
+		if learned > 0 {
+			sg.Reasons = append(sg.Reasons, "you filed similar notes here")
+		}
+		sg.Score = math.Round((sg.Score+0.5*math.Tanh(learned))*1000) / 1000
+		suggestions = append(suggestions, sg)
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].Score > suggestions[j].Score })
+	kept := suggestions[:0]
+	for _, sg := range suggestions {
+		if sg.Score > 0 && len(kept) < maxSuggestedNotebooks {
+			kept = append(kept, sg)
+		}
+	}
+	return kept, nil
+}
+
+// suggestTags combines the tags the LLM proposes with tags the user accepted
+// on notes with similar words, and leaves out tags the user has refused more
+// often than accepted
+func (s *Server) suggestTags(ctx context.Context, note *Note, terms []string, feedback []suggestionFeedback, useModel bool) []TagSuggestion {
+	votes := make(map[string]int)
+	learned := make(map[string]float64)
+	names := make(map[string]string)
+	for _, f := range feedback {
+		if f.Kind != suggestionTag {
+			continue
+		}
+		key := strings.ToLower(f.Value)
+		if f.Accepted {
+			votes[key]++
+			names[key] = f.Value
+			learned[key] += termOverlap(terms, f.Terms)
+		} else {
+			votes[key]--
+		}
+	}
+
+	existing := make(map[string]bool)
+	for _, tag := range noteTags(note) {
+		existing[strings.ToLower(tag)] = true
+	}
+
+	suggestions := []TagSuggestion{}
+	seen := make(map[string]bool)
+	add := func(tag string, score float64, reason string) {
+		key := strings.ToLower(tag)
+		if seen[key] || existing[key] || votes[key] < 0 {
+			return
+		}
+		seen[key] = true
+		suggestions = append(suggestions, TagSuggestion{Tag: tag, Score: math.Round(score*1000) / 1000, Reason: reason})
+	}
+
+	if useModel && strings.TrimSpace(note.Content) != "" {
+		sources := []Source{{Name: note.Title, Type: note.Type, Content: note.Content}}
+		tags, err := s.notebookAgent(ctx, note.NotebookID).SuggestTags(ctx, sources)
+		if err != nil {
+			golog.Warnf("failed to suggest tags for note %s: %v", note.ID, err)
+		}
+		for i, tag := range tags {
+			key := strings.ToLower(tag)
+			add(tag, math.Min(1, 0.8-0.05*float64(i)+0.1*float64(votes[key])), "model")
+		}
+	}
+
+	history := make([]string, 0, len(learned))
+	for key, overlap := range learned {
+		if overlap >= 0.2 {
+			history = append(history, key)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool { return learned[history[i]] > learned[history[j]] })
+	for _, key := range history {
+		add(names[key], math.Min(1, 0.5*learned[key]), "history")
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].Score > suggestions[j].Score })
+	if len(suggestions) > maxSuggestedTags {
+		suggestions = suggestions[:maxSuggestedTags]
+	}
+	return suggestions
+}
+
+// noteTags are the tags saved in a note's metadata
+func noteTags(note *Note) []string {
+	var tags []string
+	switch v := note.Metadata["tags"].(type) {
+	case []string:
+		tags = v
+	case []interface{}:
+		for _, t := range v {
+			if tag, ok := t.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// workspaceNote loads the :noteId note, which must be in the caller's workspace
+func (s *Server) workspaceNote(c *gin.Context) (*Note, bool) {
+	ctx := c.Request.Context()
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err == nil {
+		var nb *Notebook
+		if nb, err = s.store.GetNotebook(ctx, note.NotebookID); err == nil && nb.WorkspaceID == currentWorkspace(c).ID {
+			if note.Metadata == nil {
+				note.Metadata = map[string]interface{}{}
+			}
+			return note, true
+		}
+	}
+	c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found"})
+	return nil, false
+}
+
+// Suggestion handlers
+
+// handleGetNoteSuggestions suggests tags and notebooks for a note. Add
+// ?tags=false to skip the LLM and only rank notebooks.
+func (s *Server) handleGetNoteSuggestions(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
+
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	ws := currentWorkspace(c)
+	feedback, err := s.store.ListSuggestionFeedback(ctx, settingsOwner(c), ws.ID, feedbackHistory)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to load suggestion feedback"})
+		return
+	}
+
+	terms := noteTerms(note.Title + "\n" + note.Content)
+	notebooks, err := s.suggestNotebooks(ctx, ws, note, terms, feedback)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to suggest notebooks"})
+		return
+	}
+	tags := s.suggestTags(ctx, note, terms, feedback, c.Query("tags") != "false")
+	if s.canceledResponse(c, ctx, ctx.Err()) {
+		return
+	}
+
+	c.JSON(http.StatusOK, NoteSuggestions{NoteID: note.ID, Tags: tags, Notebooks: notebooks})
+}
+
+// handleSuggestionFeedback applies the suggestions the user accepted, adding
+// tags and filing the note, and remembers both the accepted and the
+// rejected ones for next time
+func (s *Server) handleSuggestionFeedback(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		Tags                []string `json:"tags" binding:"omitempty,dive,min=1,max=50"`
+		RejectedTags        []string `json:"rejected_tags" binding:"omitempty,dive,min=1,max=50"`
+		NotebookID          string   `json:"notebook_id"`
+		RejectedNotebookIDs []string `json:"rejected_notebook_ids"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	note, ok := s.workspaceNote(c)
+	if !ok {
+		return
+	}
+	ws := currentWorkspace(c)
+
+	terms := noteTerms(note.Title + "\n" + note.Content)
+	var feedback []suggestionFeedback
+	for _, tag := range req.Tags {
+		feedback = append(feedback, suggestionFeedback{Kind: suggestionTag, Value: strings.TrimSpace(tag), Accepted: true, Terms: terms})
+	}
+	for _, tag := range req.RejectedTags {
+		feedback = append(feedback, suggestionFeedback{Kind: suggestionTag, Value: strings.TrimSpace(tag), Terms: terms})
+	}
+	for _, id := range req.RejectedNotebookIDs {
+		feedback = append(feedback, suggestionFeedback{Kind: suggestionNotebook, Value: id, Terms: terms})
+	}
+
+	if len(req.Tags) > 0 {
+		tags := noteTags(note)
+		have := make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			have[strings.ToLower(tag)] = true
+		}
+		for _, tag := range req.Tags {
+			if tag = strings.TrimSpace(tag); !have[strings.ToLower(tag)] {
+				have[strings.ToLower(tag)] = true
+				tags = append(tags, tag)
+			}
+		}
+		note.Metadata["tags"] = tags
+	}
+
+	if req.NotebookID != "" && req.NotebookID != note.NotebookID {
+		nb, err := s.store.GetNotebook(ctx, req.NotebookID)
+		if err != nil || nb.WorkspaceID != ws.ID {
+			validationResponse(c, invalidField("notebook_id", "is not a notebook in this workspace"))
+			return
+		}
+		if err := s.checkStorageQuota(ctx, nb.ID, int64(len(note.Content))); err != nil {
+			storeErrorResponse(c, err, "Failed to check storage quota")
+			return
+		}
+		note.NotebookID = nb.ID
+		delete(note.Metadata, "snoozed_until")
+		feedback = append(feedback, suggestionFeedback{Kind: suggestionNotebook, Value: nb.ID, Accepted: true, Terms: terms})
+	}
+
+	if err := s.store.UpdateNote(ctx, note); err != nil {
+		storeErrorResponse(c, err, "Failed to update note")
+		return
+	}
+	if err := s.store.MoveNoteAttachments(ctx, note.ID, note.NotebookID, "", note.ID); err != nil {
+		golog.Errorf("failed to move attachments of note %s: %v", note.ID, err)
+	}
+	if err := s.store.RecordSuggestionFeedback(ctx, settingsOwner(c), ws.ID, feedback); err != nil {
+		golog.Errorf("failed to record suggestion feedback for note %s: %v", note.ID, err)
+	}
+	c.JSON(http.StatusOK, note)
+}
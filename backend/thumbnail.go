@@ -0,0 +1,233 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// thumbnailDir holds thumbnails and previews derived from uploaded files
+const thumbnailDir = "./data/uploads/thumbnails"
+
+// maxThumbnailPixels keeps a huge image from being decoded just to shrink it
+const maxThumbnailPixels = 50_000_000
+
+// errNoThumbnail means a file is of a type that has no thumbnail
+var errNoThumbnail = errors.New("no thumbnail for this file type")
+
+// createThumbnail writes a JPEG no larger than size pixels on either side
+// showing an image, or the first page of a PDF, and returns its path
+func createThumbnail(ctx context.Context, path, contentType string, size int) (string, error) {
+	if size <= 0 {
+		return "", errNoThumbnail
+	}
+	if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create thumbnails directory: %w", err)
+	}
+	out := filepath.Join(thumbnailDir, uuid.New().String()+".jpg")
+
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return out, imageThumbnail(path, out, size)
+	case isPDF(path, contentType):
+		return out, pdfThumbnail(ctx, path, out, size)
+	}
+	return "", errNoThumbnail
+}
+
+func isPDF(path, contentType string) bool {
+	return contentType == "application/pdf" || strings.EqualFold(filepath.Ext(path), ".pdf")
+}
+
+// imageThumbnail shrinks a PNG, JPEG or GIF. Other image formats have no
+// decoder in the standard library and get no thumbnail.
+func imageThumbnail(path, out string, size int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if errors.Is(err, image.ErrFormat) {
+		return errNoThumbnail
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return fmt.Errorf("image is too large to thumbnail (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := jpeg.Encode(dst, shrinkImage(img, size), &jpeg.Options{Quality: 80}); err != nil {
+		os.Remove(out)
+		return err
+	}
+	return nil
+}
+
+// pdfThumbnail renders the first page of a PDF with pdftoppm from poppler.
+// Without it installed, PDFs get no preview.
+func pdfThumbnail(ctx context.Context, path, out string, size int) error {
+	if _, err := exec.LookPath("pdftoppm"); err != nil {
+		return errNoThumbnail
+	}
+	prefix := strings.TrimSuffix(out, ".jpg")
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-f", "1", "-l", "1", "-singlefile",
+		"-jpeg", "-scale-to", fmt.Sprint(size), path, prefix)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pdftoppm failed: %w, output: %s", err, output)
+	}
+	return nil
+}
+
+// shrinkImage scales img to fit within size pixels, averaging the source
+// pixels under each thumbnail pixel. Smaller images are only re-encoded.
+func shrinkImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, max(1, h*size/w)
+	if h > w {
+		tw, th = max(1, w*size/h), size
+	}
+
+	// Average at most a 4x4 grid per pixel so very large images stay cheap
+	const samples = 4
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, max((y+1)*h/th, y*h/th+1)
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+			var r, g, b, a, n uint32
+			for sy := 0; sy < samples; sy++ {
+				py := y0 + (y1-y0)*sy/samples
+				for sx := 0; sx < samples; sx++ {
+					px := x0 + (x1-x0)*sx/samples
+					cr, cg, cb, ca := img.At(bounds.Min.X+px, bounds.Min.Y+py).RGBA()
+					r, g, b, a, n = r+cr, g+cg, b+cb, a+ca, n+1
+				}
+			}
+			// JPEG has no alpha, so transparent areas become white
+			alpha := a / n
+			white := 0xffff - alpha
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white), G: uint16(g/n + white), B: uint16(b/n + white), A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
+
+// thumbnailAttachment gives an attachment a thumbnail before it is stored.
+// A file that cannot be thumbnailed is still stored, without one.
+func (s *Server) thumbnailAttachment(ctx context.Context, att *Attachment) {
+	path, err := createThumbnail(ctx, att.Path, att.ContentType, s.cfg.ThumbnailSize)
+	if err != nil {
+		if !errors.Is(err, errNoThumbnail) {
+			golog.Warnf("failed to create thumbnail for %s: %v", att.FileName, err)
+		}
+		return
+	}
+	att.ThumbnailPath = path
+}
+
+// createSourcePreview renders the first page of an uploaded PDF and stores
+// it as an attachment of the source, recording where to find it in the
+// source's metadata. Other files get no preview.
+func (s *Server) createSourcePreview(ctx context.Context, source *Source, path, contentType string) {
+	if !isPDF(path, contentType) {
+		return
+	}
+	preview, err := createThumbnail(ctx, path, contentType, s.cfg.ThumbnailSize)
+	if err != nil {
+		if !errors.Is(err, errNoThumbnail) {
+			golog.Warnf("failed to create preview for source %s: %v", source.ID, err)
+		}
+		return
+	}
+	info, err := os.Stat(preview)
+	if err != nil {
+		golog.Warnf("failed to create preview for source %s: %v", source.ID, err)
+		return
+	}
+	att := &Attachment{
+		NotebookID:    source.NotebookID,
+		SourceID:      source.ID,
+		FileName:      strings.TrimSuffix(source.Name, filepath.Ext(source.Name)) + " preview.jpg",
+		ContentType:   "image/jpeg",
+		FileSize:      info.Size(),
+		Path:          preview,
+		ThumbnailPath: preview,
+		Metadata:      map[string]interface{}{"kind": "source_preview"},
+	}
+	if err := s.store.CreateAttachment(ctx, att); err != nil {
+		golog.Errorf("failed to store preview for source %s: %v", source.ID, err)
+		os.Remove(preview)
+		return
+	}
+
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["preview_attachment_id"] = att.ID
+	source.Metadata["thumbnail_url"] = att.ThumbnailURL
+	if err := s.store.UpdateSourceMetadata(ctx, source.ID, source.Metadata); err != nil {
+		golog.Errorf("failed to record preview for source %s: %v", source.ID, err)
+	}
+}
+
+// handleGetAttachmentThumbnail serves an attachment's thumbnail, creating it
+// on first request for attachments stored before thumbnails existed
+func (s *Server) handleGetAttachmentThumbnail(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	att, ok := s.workspaceAttachment(c)
+	if !ok {
+		return
+	}
+
+	if att.ThumbnailPath == "" {
+		s.thumbnailAttachment(ctx, att)
+		if att.ThumbnailPath == "" {
+			c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Attachment has no thumbnail"})
+			return
+		}
+		if err := s.store.SetAttachmentThumbnail(ctx, att.ID, att.ThumbnailPath); err != nil {
+			golog.Errorf("failed to record thumbnail for attachment %s: %v", att.ID, err)
+		}
+	}
+
+	// A thumbnail never changes once made
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("Content-Type", "image/jpeg")
+	c.File(att.ThumbnailPath)
+}
@@ -0,0 +1,328 @@
+package backend
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxEventsPerItem bounds the dated events taken from one source or note
+const maxEventsPerItem = 50
+
+// Timeline item kinds
+const (
+	timelineNote   = "note"
+	timelineSource = "source"
+	timelineEvent  = "event"
+)
+
+// Date precisions
+const (
+	precisionTime  = "time"
+	precisionDay   = "day"
+	precisionMonth = "month"
+	precisionYear  = "year"
+)
+
+// TimelineItem is one dated entry of a notebook's timeline
+type TimelineItem struct {
+	Date      time.Time `json:"date"`
+	Precision string    `json:"precision"` // time, day, month or year
+	Kind      string    `json:"kind"`      // note, source or event
+	// What happened on the date: created, updated, added, published or
+	// mentioned (for events found in the text)
+	Event    string `json:"event"`
+	Title    string `json:"title"`
+	Text     string `json:"text,omitempty"`
+	NoteID   string `json:"note_id,omitempty"`
+	SourceID string `json:"source_id,omitempty"`
+}
+
+// sourceDateKeys are metadata keys that may hold a source's publication date,
+// most specific first
+var sourceDateKeys = []string{"published_at", "publication_date", "published", "date", "pub_date"}
+
+// dateLayouts are the formats publication dates are read in
+var dateLayouts = []struct{ layout, precision string }{
+	{time.RFC3339, precisionTime},
+	{"2006-01-02T15:04:05", precisionTime},
+	{"2006-01-02 15:04:05", precisionTime},
+	{time.RFC1123Z, precisionTime},
+	{time.RFC1123, precisionTime},
+	{"2006-01-02", precisionDay},
+	{"2006/01/02", precisionDay},
+	{"January 2, 2006", precisionDay},
+	{"Jan 2, 2006", precisionDay},
+	{"2 January 2006", precisionDay},
+	{"2006-01", precisionMonth},
+	{"January 2006", precisionMonth},
+	{"2006", precisionYear},
+}
+
+// parseDate reads a date in one of dateLayouts
+func parseDate(value string) (time.Time, string, bool) {
+	value = strings.TrimSpace(value)
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l.layout, value); err == nil {
+			return t, l.precision, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// sourcePublished finds when a source was published from its metadata,
+// including what processors extracted and its citation
+func sourcePublished(source *Source) (time.Time, string, bool) {
+	maps := []map[string]interface{}{source.Metadata}
+	if extracted, ok := source.Metadata["extracted"].(map[string]interface{}); ok {
+		maps = append(maps, extracted)
+	}
+	for _, m := range maps {
+		for _, key := range sourceDateKeys {
+			if value, ok := m[key].(string); ok {
+				if t, precision, ok := parseDate(value); ok {
+					return t, precision, true
+				}
+			}
+		}
+	}
+	if _, ok := source.Metadata["citation"]; ok {
+		if cit := sourceCitation(source); cit.Year != "" {
+			if t, precision, ok := parseDate(cit.Year); ok {
+				return t, precision, true
+			}
+		}
+	}
+	return time.Time{}, "", false
+}
+
+var monthNames = map[string]time.Month{
+	"january": time.January, "february": time.February, "march": time.March, "april": time.April,
+	"may": time.May, "june": time.June, "july": time.July, "august": time.August,
+	"september": time.September, "october": time.October, "november": time.November, "december": time.December,
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April, "jun": time.June,
+	"jul": time.July, "aug": time.August, "sep": time.September, "sept": time.September,
+	"oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+const monthPattern = `(January|February|March|April|May|June|July|August|September|October|November|December|Jan|Feb|Mar|Apr|Jun|Jul|Aug|Sept|Sep|Oct|Nov|Dec)\.?`
+
+// Dates written in text: ISO dates, "March 5, 2024", "5 March 2024",
+// "March 2024", "2024年3月5日" and "2024年3月"
+var (
+	isoDatePattern      = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	monthDayYearPattern = regexp.MustCompile(`(?i)\b` + monthPattern + `\s+(\d{1,2})(?:st|nd|rd|th)?,?\s+(\d{4})\b`)
+	dayMonthYearPattern = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+` + monthPattern + `,?\s+(\d{4})\b`)
+	monthYearPattern    = regexp.MustCompile(`(?i)\b` + monthPattern + `\s+(\d{4})\b`)
+	chineseDatePattern  = regexp.MustCompile(`(\d{4})\s*年\s*(\d{1,2})\s*月(?:\s*(\d{1,2})\s*[日号])?`)
+)
+
+// textDate is a date found in text, at byte offsets start to end
+type textDate struct {
+	date       time.Time
+	precision  string
+	start, end int
+}
+
+// findDates finds the dates written in text, in order, ignoring invalid ones
+// and dates inside a longer match
+func findDates(text string) []textDate {
+	var found []textDate
+	add := func(loc []int, year, month, day int, precision string) {
+		if year < 1 || month < 1 || month > 12 || day < 1 || day > 31 {
+			return
+		}
+		date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+		if date.Day() != day {
+			return
+		}
+		for _, f := range found {
+			if loc[0] < f.end && f.start < loc[1] {
+				return
+			}
+		}
+		found = append(found, textDate{date: date, precision: precision, start: loc[0], end: loc[1]})
+	}
+	num := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	month := func(s string) int {
+		return int(monthNames[strings.ToLower(s)])
+	}
+
+	for _, m := range isoDatePattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m, num(text[m[2]:m[3]]), num(text[m[4]:m[5]]), num(text[m[6]:m[7]]), precisionDay)
+	}
+	for _, m := range chineseDatePattern.FindAllStringSubmatchIndex(text, -1) {
+		if m[6] >= 0 {
+			add(m, num(text[m[2]:m[3]]), num(text[m[4]:m[5]]), num(text[m[6]:m[7]]), precisionDay)
+		} else {
+			add(m, num(text[m[2]:m[3]]), num(text[m[4]:m[5]]), 1, precisionMonth)
+		}
+	}
+	for _, m := range monthDayYearPattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m, num(text[m[6]:m[7]]), month(text[m[2]:m[3]]), num(text[m[4]:m[5]]), precisionDay)
+	}
+	for _, m := range dayMonthYearPattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m, num(text[m[6]:m[7]]), month(text[m[4]:m[5]]), num(text[m[2]:m[3]]), precisionDay)
+	}
+	for _, m := range monthYearPattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m, num(text[m[4]:m[5]]), month(text[m[2]:m[3]]), 1, precisionMonth)
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].start < found[j].start })
+	return found
+}
+
+// sentenceAround is the sentence or line containing text[start:end]
+func sentenceAround(text string, start, end int) string {
+	isEnd := func(r rune) bool { return strings.ContainsRune(".!?。！？\n", r) }
+	from := 0
+	if i := strings.LastIndexFunc(text[:start], isEnd); i >= 0 {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		from = i + size
+	}
+	to := len(text)
+	if i := strings.IndexFunc(text[end:], isEnd); i >= 0 {
+		r, size := utf8.DecodeRuneInString(text[end+i:])
+		to = end + i
+		if r != '\n' {
+			to += size
+		}
+	}
+	sentence := strings.Join(strings.Fields(text[from:to]), " ")
+	if r := []rune(sentence); len(r) > 300 {
+		sentence = string(r[:300]) + "…"
+	}
+	return sentence
+}
+
+// textEvents are the dated events mentioned in a source's or note's text
+func textEvents(title, content string) []TimelineItem {
+	var events []TimelineItem
+	for _, d := range findDates(content) {
+		events = append(events, TimelineItem{
+			Date:      d.date,
+			Precision: d.precision,
+			Kind:      timelineEvent,
+			Event:     "mentioned",
+			Title:     title,
+			Text:      sentenceAround(content, d.start, d.end),
+		})
+		if len(events) == maxEventsPerItem {
+			break
+		}
+	}
+	return events
+}
+
+// parseTimelineBound reads a from or to query parameter as a date or time
+func parseTimelineBound(c *gin.Context, name string) (time.Time, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true
+	}
+	validationResponse(c, invalidField(name, "must be a date (2006-01-02) or an RFC 3339 time"))
+	return time.Time{}, false
+}
+
+// Timeline handlers
+
+// handleGetTimeline arranges a notebook's notes, sources and the dated
+// events mentioned in them chronologically. Narrow it with ?from= and ?to=
+// and ?kinds=note,source,event.
+func (s *Server) handleGetTimeline(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	from, ok := parseTimelineBound(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := parseTimelineBound(c, "to")
+	if !ok {
+		return
+	}
+	kinds := map[string]bool{timelineNote: true, timelineSource: true, timelineEvent: true}
+	if value := c.Query("kinds"); value != "" {
+		kinds = make(map[string]bool)
+		for _, kind := range strings.Split(value, ",") {
+			kind = strings.TrimSpace(kind)
+			if kind != timelineNote && kind != timelineSource && kind != timelineEvent {
+				validationResponse(c, invalidField("kinds", "must list note, source or event"))
+				return
+			}
+			kinds[kind] = true
+		}
+	}
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		storeErrorResponse(c, err, "Failed to get notebook")
+		return
+	}
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+		return
+	}
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
+		return
+	}
+
+	items := []TimelineItem{}
+	for _, note := range notes {
+		if kinds[timelineNote] {
+			items = append(items, TimelineItem{Date: note.CreatedAt, Precision: precisionTime, Kind: timelineNote, Event: "created", Title: note.Title, NoteID: note.ID})
+			if note.UpdatedAt.Sub(note.CreatedAt) >= time.Minute {
+				items = append(items, TimelineItem{Date: note.UpdatedAt, Precision: precisionTime, Kind: timelineNote, Event: "updated", Title: note.Title, NoteID: note.ID})
+			}
+		}
+		if kinds[timelineEvent] {
+			for _, ev := range textEvents(note.Title, note.Content) {
+				ev.NoteID = note.ID
+				items = append(items, ev)
+			}
+		}
+	}
+	for i := range sources {
+		src := &sources[i]
+		if kinds[timelineSource] {
+			item := TimelineItem{Date: src.CreatedAt, Precision: precisionTime, Kind: timelineSource, Event: "added", Title: src.Name, SourceID: src.ID}
+			if published, precision, ok := sourcePublished(src); ok {
+				item.Date, item.Precision, item.Event = published, precision, "published"
+			}
+			items = append(items, item)
+		}
+		if kinds[timelineEvent] {
+			for _, ev := range textEvents(src.Name, src.Content) {
+				ev.SourceID = src.ID
+				items = append(items, ev)
+			}
+		}
+	}
+
+	filtered := items[:0]
+	for _, item := range items {
+		if (from.IsZero() || !item.Date.Before(from)) && (to.IsZero() || !item.Date.After(to)) {
+			filtered = append(filtered, item)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool { return filtered[i].Date.Before(filtered[j].Date) })
+
+	c.JSON(http.StatusOK, gin.H{"items": filtered})
+}
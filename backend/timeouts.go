@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// withTimeout bounds ctx to the given number of seconds, or leaves it
+// unbounded when seconds is 0
+func withTimeout(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+// operationContext returns a context that ends when the client disconnects
+// or the operation runs longer than seconds
+func operationContext(c *gin.Context, seconds int) (context.Context, context.CancelFunc) {
+	return withTimeout(c.Request.Context(), seconds)
+}
+
+// canceledResponse handles an operation stopped by its context and reports
+// whether err was such a failure. A timeout is a 504. When the client went
+// away nobody reads the response, so the request is only aborted and its rate
+// limit token refunded.
+func (s *Server) canceledResponse(c *gin.Context, ctx context.Context, err error) bool {
+	if c.Request.Context().Err() != nil {
+		golog.Infof("client disconnected, stopped %s %s", c.Request.Method, c.Request.URL.Path)
+		s.rateLimiter.Refund(c.ClientIP())
+		c.AbortWithStatus(499)
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, ErrorResponse{Code: CodeTimeout, Error: "The operation took too long and was stopped"})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,576 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// maxToolRounds bounds how many times the model may call tools for one answer
+const maxToolRounds = 5
+
+// ChatTool is a function the chat model may call while answering
+type ChatTool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments
+	Parameters map[string]any
+	Run        func(ctx context.Context, notebookID string, args map[string]any) (string, error)
+}
+
+// ToolCallTrace records a tool call made while answering, persisted on the message
+type ToolCallTrace struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// ToolInfo describes a registered tool
+type ToolInfo struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+	Available   bool           `json:"available"`
+}
+
+// toolCallRe matches the tool call line used with models without native function calling
+var toolCallRe = regexp.MustCompile(`(?m)^\s*TOOL_CALL:\s*(\{.*\})\s*$`)
+
+// toolRegistry returns every tool keyed by name
+func (s *Server) toolRegistry() map[string]*ChatTool {
+	return map[string]*ChatTool{
+		"calculator": {
+			Name:        "calculator",
+			Description: "Evaluate an arithmetic expression with + - * / % ^ and parentheses.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"expression": map[string]any{"type": "string", "description": "Expression to evaluate, e.g. (3 + 4) * 2"},
+				},
+				"required": []string{"expression"},
+			},
+			Run: func(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+				value, err := evalExpression(stringArg(args, "expression"))
+				if err != nil {
+					return "", err
+				}
+				return strconv.FormatFloat(value, 'g', -1, 64), nil
+			},
+		},
+		"note_lookup": {
+			Name:        "note_lookup",
+			Description: "Search the notes of the current notebook by keyword and return matching excerpts.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{"type": "string", "description": "Keywords to look for"},
+				},
+				"required": []string{"query"},
+			},
+			Run: s.runNoteLookup,
+		},
+		"create_note": {
+			Name:        "create_note",
+			Description: "Save a new note in the current notebook.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"title":   map[string]any{"type": "string", "description": "Note title"},
+					"content": map[string]any{"type": "string", "description": "Note content in Markdown"},
+				},
+				"required": []string{"title", "content"},
+			},
+			Run: s.runCreateNote,
+		},
+		"web_search": {
+			Name:        "web_search",
+			Description: "Search the web and return the top results with titles, links and snippets.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{"type": "string", "description": "Search query"},
+				},
+				"required": []string{"query"},
+			},
+			Run: s.runWebSearch,
+		},
+	}
+}
+
+// toolAvailable reports whether a tool's required configuration is present
+func (s *Server) toolAvailable(name string) bool {
+	if name == "web_search" {
+		return s.webSearcher != nil
+	}
+	return true
+}
+
+// notebookTools returns the tools a notebook's chat settings allow
+func (s *Server) notebookTools(settings *ChatSettings) []*ChatTool {
+	if settings == nil || len(settings.Tools) == 0 {
+		return nil
+	}
+
+	registry := s.toolRegistry()
+	tools := make([]*ChatTool, 0, len(settings.Tools))
+	for _, name := range settings.Tools {
+		if tool, ok := registry[name]; ok && s.toolAvailable(name) {
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
+
+func (s *Server) runNoteLookup(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	query := strings.ToLower(strings.TrimSpace(stringArg(args, "query")))
+	if query == "" {
+		return "", fmt.Errorf("query is required")
+	}
+
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		return "", err
+	}
+
+	words := strings.Fields(query)
+	type match struct {
+		note  Note
+		score int
+	}
+	matches := make([]match, 0)
+	for _, note := range notes {
+		text := strings.ToLower(note.Title + "\n" + note.Content)
+		score := 0
+		for _, w := range words {
+			score += strings.Count(text, w)
+		}
+		if score > 0 {
+			matches = append(matches, match{note: note, score: score})
+		}
+	}
+	if len(matches) == 0 {
+		return "No matching notes.", nil
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	var b strings.Builder
+	for i, m := range matches {
+		if i >= 5 {
+			break
+		}
+		excerpt := []rune(m.note.Content)
+		if len(excerpt) > 500 {
+			excerpt = append(excerpt[:500], []rune("...")...)
+		}
+		fmt.Fprintf(&b, "## %s (id: %s)\n%s\n\n", m.note.Title, m.note.ID, string(excerpt))
+	}
+	return b.String(), nil
+}
+
+func (s *Server) runCreateNote(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	title := strings.TrimSpace(stringArg(args, "title"))
+	content := stringArg(args, "content")
+	if title == "" || strings.TrimSpace(content) == "" {
+		return "", fmt.Errorf("title and content are required")
+	}
+
+	note := &Note{
+		NotebookID: notebookID,
+		Title:      title,
+		Content:    content,
+		Type:       "custom",
+		SourceIDs:  []string{},
+		Metadata:   map[string]interface{}{"created_by": "chat_tool"},
+	}
+	if err := s.createNote(ctx, note); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Created note %q (id: %s).", note.Title, note.ID), nil
+}
+
+func (s *Server) runWebSearch(ctx context.Context, notebookID string, args map[string]any) (string, error) {
+	query := strings.TrimSpace(stringArg(args, "query"))
+	if query == "" {
+		return "", fmt.Errorf("query is required")
+	}
+
+	results, err := s.webSearcher.Search(ctx, query, 5)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "No results.", nil
+	}
+
+	var b strings.Builder
+	for i, r := range results {
+		fmt.Fprintf(&b, "%d. %s\n%s\n%s\n\n", i+1, r.Title, r.URL, r.Snippet)
+	}
+	return b.String(), nil
+}
+
+// stringArg reads a string argument from decoded tool arguments
+func stringArg(args map[string]any, name string) string {
+	switch v := args[name].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// runTool executes one tool call and records its trace
+func runTool(ctx context.Context, tools []*ChatTool, notebookID, id, name, arguments string) ToolCallTrace {
+	trace := ToolCallTrace{ID: id, Name: name, Arguments: arguments}
+	start := time.Now()
+
+	var tool *ChatTool
+	for _, t := range tools {
+		if t.Name == name {
+			tool = t
+			break
+		}
+	}
+	if tool == nil {
+		trace.Error = fmt.Sprintf("unknown tool %q", name)
+		trace.DurationMs = time.Since(start).Milliseconds()
+		return trace
+	}
+
+	args := make(map[string]any)
+	if strings.TrimSpace(arguments) != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			trace.Error = fmt.Sprintf("invalid arguments: %v", err)
+			trace.DurationMs = time.Since(start).Milliseconds()
+			return trace
+		}
+	}
+
+	result, err := tool.Run(ctx, notebookID, args)
+	if err != nil {
+		trace.Error = err.Error()
+	} else {
+		trace.Result = result
+	}
+	trace.DurationMs = time.Since(start).Milliseconds()
+
+	golog.Infof("tool %s called (%d ms, error: %q)", name, trace.DurationMs, trace.Error)
+	return trace
+}
+
+// toolOutput is what the model sees for a tool call
+func (t ToolCallTrace) toolOutput() string {
+	if t.Error != "" {
+		return "Error: " + t.Error
+	}
+	return t.Result
+}
+
+// generateWithTools answers a prompt, letting the model call tools. Models with
+// native function calling use it; others follow a plain-text TOOL_CALL protocol.
+func (a *Agent) generateWithTools(ctx context.Context, notebookID, prompt string, tools []*ChatTool, options []llms.CallOption) (string, []ToolCallTrace, error) {
+	if a.cfg.IsOllama() {
+		return a.generateWithPromptTools(ctx, notebookID, prompt, tools, options)
+	}
+
+	defs := make([]llms.Tool, 0, len(tools))
+	for _, t := range tools {
+		defs = append(defs, llms.Tool{
+			Type: "function",
+			Function: &llms.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
+		})
+	}
+	options = append(options, llms.WithTools(defs))
+
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt),
+	}
+	traces := make([]ToolCallTrace, 0)
+
+	for round := 0; round <= maxToolRounds; round++ {
+		if round == maxToolRounds {
+			// Out of tool budget: ask for a final answer without tools
+			options = append(options, llms.WithToolChoice("none"))
+		}
+
+		resp, err := a.llm.GenerateContent(ctx, messages, options...)
+		if err != nil {
+			return "", traces, err
+		}
+		if len(resp.Choices) == 0 {
+			return "", traces, fmt.Errorf("empty response from model")
+		}
+
+		choice := resp.Choices[0]
+		if len(choice.ToolCalls) == 0 {
+			return choice.Content, traces, nil
+		}
+
+		callParts := make([]llms.ContentPart, 0, len(choice.ToolCalls))
+		for _, call := range choice.ToolCalls {
+			callParts = append(callParts, call)
+		}
+		messages = append(messages, llms.MessageContent{Role: llms.ChatMessageTypeAI, Parts: callParts})
+
+		for _, call := range choice.ToolCalls {
+			if call.FunctionCall == nil {
+				continue
+			}
+			trace := runTool(ctx, tools, notebookID, call.ID, call.FunctionCall.Name, call.FunctionCall.Arguments)
+			traces = append(traces, trace)
+			messages = append(messages, llms.MessageContent{
+				Role: llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{llms.ToolCallResponse{
+					ToolCallID: call.ID,
+					Name:       call.FunctionCall.Name,
+					Content:    trace.toolOutput(),
+				}},
+			})
+		}
+	}
+
+	return "", traces, fmt.Errorf("tool call limit reached")
+}
+
+// generateWithPromptTools implements tool calling through the prompt for models
+// without native function calling
+func (a *Agent) generateWithPromptTools(ctx context.Context, notebookID, prompt string, tools []*ChatTool, options []llms.CallOption) (string, []ToolCallTrace, error) {
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\n你可以使用以下工具。如需调用工具，请只输出一行：TOOL_CALL: {\"name\": \"工具名\", \"arguments\": {...}}，然后等待工具结果。不需要工具时直接回答。\n")
+	for _, t := range tools {
+		params, _ := json.Marshal(t.Parameters)
+		fmt.Fprintf(&b, "- %s: %s 参数: %s\n", t.Name, t.Description, params)
+	}
+
+	conversation := b.String()
+	traces := make([]ToolCallTrace, 0)
+
+	for round := 0; round < maxToolRounds; round++ {
+		response, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, conversation, options...)
+		if err != nil {
+			return "", traces, err
+		}
+
+		m := toolCallRe.FindStringSubmatch(response)
+		if m == nil {
+			return response, traces, nil
+		}
+
+		var call struct {
+			Name      string         `json:"name"`
+			Arguments map[string]any `json:"arguments"`
+		}
+		if err := json.Unmarshal([]byte(m[1]), &call); err != nil {
+			return response, traces, nil
+		}
+		arguments, _ := json.Marshal(call.Arguments)
+
+		trace := runTool(ctx, tools, notebookID, fmt.Sprintf("call_%d", round+1), call.Name, string(arguments))
+		traces = append(traces, trace)
+		conversation += "\n" + m[0] + "\n工具结果：\n" + trace.toolOutput() + "\n"
+	}
+
+	response, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, conversation+"\n请根据以上工具结果直接给出最终回答。", options...)
+	return response, traces, err
+}
+
+// evalExpression evaluates an arithmetic expression
+func evalExpression(expr string) (float64, error) {
+	p := &exprParser{input: []rune(expr)}
+	value, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", string(p.input[p.pos]), p.pos)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions
+type exprParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() rune {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (float64, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			right, err := p.parseProduct()
+			if err != nil {
+				return 0, err
+			}
+			left += right
+		case '-':
+			p.pos++
+			right, err := p.parseProduct()
+			if err != nil {
+				return 0, err
+			}
+			left -= right
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *exprParser) parseProduct() (float64, error) {
+	left, err := p.parsePower()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parsePower()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			left *= right
+		case '/':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left /= right
+		case '%':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *exprParser) parsePower() (float64, error) {
+	base, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		// Right associative
+		exp, err := p.parsePower()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exp), nil
+	}
+	return base, nil
+}
+
+func (p *exprParser) parseUnary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.parseUnary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (float64, error) {
+	if p.peek() == '(' {
+		p.pos++
+		v, err := p.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return v, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos >= len(p.input) {
+			return 0, fmt.Errorf("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", string(p.input[p.pos]), p.pos)
+	}
+	return strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+}
+
+// Tool handlers
+
+func (s *Server) handleListTools(c *gin.Context) {
+	registry := s.toolRegistry()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]ToolInfo, 0, len(names))
+	for _, name := range names {
+		tool := registry[name]
+		infos = append(infos, ToolInfo{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  tool.Parameters,
+			Available:   s.toolAvailable(name),
+		})
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
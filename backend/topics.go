@@ -0,0 +1,642 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Kinds of items grouped into topics
+const (
+	TopicItemSource = "source"
+	TopicItemNote   = "note"
+)
+
+// How items were compared: by their embeddings, or by the words they use
+// when embeddings are off
+const (
+	topicMethodEmbeddings = "embeddings"
+	topicMethodKeywords   = "keywords"
+)
+
+const (
+	// maxTopics bounds how many topics a notebook is split into
+	maxTopics = 12
+	// minClusterItems is the fewest items worth splitting; smaller
+	// notebooks are one topic
+	minClusterItems = 4
+	// topicRounds bounds the k-means iterations, and topicRestarts is how
+	// many seedings are tried
+	topicRounds   = 25
+	topicRestarts = 5
+	// topicKeywords is how many keywords describe a topic
+	topicKeywords = 5
+	// topicHashDims is the size of the word vectors used without embeddings
+	topicHashDims = 512
+	// topicItemText is how much of an item is embedded or counted
+	topicItemText = 2000
+	// topicLabelItems is how many items of a topic the model is shown
+	topicLabelItems = 12
+	// maxTopicVectors bounds the cache of embedded notes
+	maxTopicVectors = 5000
+)
+
+// TopicItem is a source or note in a topic
+type TopicItem struct {
+	Kind  string `json:"kind"` // TopicItemSource or TopicItemNote
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// Topic is a group of a notebook's sources and notes about the same thing,
+// most central first
+type Topic struct {
+	Label    string      `json:"label"`
+	Summary  string      `json:"summary,omitempty"`
+	Keywords []string    `json:"keywords"`
+	Items    []TopicItem `json:"items"`
+}
+
+// NotebookTopics is the topic overview of a notebook, largest topic first
+type NotebookTopics struct {
+	NotebookID  string     `json:"notebook_id"`
+	Topics      []Topic    `json:"topics"`
+	Method      string     `json:"method,omitempty"`
+	GeneratedAt *time.Time `json:"generated_at"`
+	// Stale is set when sources or notes changed since the topics were
+	// generated; the background job catches up
+	Stale       bool   `json:"stale"`
+	Fingerprint string `json:"-"`
+}
+
+// topicVectors caches embedded notes and sources without chunk embeddings
+var topicVectors = &embeddingCache{limit: maxTopicVectors}
+
+// topicCandidate is an item with what it is clustered by
+type topicCandidate struct {
+	item   TopicItem
+	text   string
+	terms  []string
+	vector []float32
+}
+
+// Topic store operations
+
+// GetNotebookTopics returns a notebook's last generated topics, or nil if
+// none were generated yet
+func (s *Store) GetNotebookTopics(ctx context.Context, notebookID string) (*NotebookTopics, error) {
+	topics := NotebookTopics{NotebookID: notebookID}
+	var topicsJSON string
+	var generatedAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT topics, method, fingerprint, generated_at FROM notebook_topics WHERE notebook_id = ?
+	`, notebookID).Scan(&topicsJSON, &topics.Method, &topics.Fingerprint, &generatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(topicsJSON), &topics.Topics); err != nil {
+		return nil, fmt.Errorf("failed to decode topics: %w", err)
+	}
+	t := time.Unix(generatedAt, 0)
+	topics.GeneratedAt = &t
+	return &topics, nil
+}
+
+// SaveNotebookTopics replaces a notebook's topics
+func (s *Store) SaveNotebookTopics(ctx context.Context, topics *NotebookTopics) error {
+	now := time.Now()
+	topics.GeneratedAt = &now
+	topicsJSON, _ := json.Marshal(topics.Topics)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notebook_topics (notebook_id, topics, method, fingerprint, generated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(notebook_id) DO UPDATE SET
+			topics = excluded.topics, method = excluded.method,
+			fingerprint = excluded.fingerprint, generated_at = excluded.generated_at
+	`, topics.NotebookID, string(topicsJSON), topics.Method, topics.Fingerprint, now.Unix())
+	return err
+}
+
+// topicCandidates lists a notebook's sources and notes, and a fingerprint
+// that changes whenever one is added, edited or removed
+func (s *Server) topicCandidates(ctx context.Context, notebookID string) ([]topicCandidate, string, error) {
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		return nil, "", err
+	}
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.New()
+	candidates := make([]topicCandidate, 0, len(sources)+len(notes))
+	for _, src := range sources {
+		fmt.Fprintf(hash, "%s:%s:%d\n", TopicItemSource, src.ID, src.UpdatedAt.Unix())
+		candidates = append(candidates, newTopicCandidate(TopicItem{Kind: TopicItemSource, ID: src.ID, Title: src.Name}, src.Content))
+	}
+	for _, note := range notes {
+		fmt.Fprintf(hash, "%s:%s:%d\n", TopicItemNote, note.ID, note.UpdatedAt.Unix())
+		candidates = append(candidates, newTopicCandidate(TopicItem{Kind: TopicItemNote, ID: note.ID, Title: note.Title}, note.Content))
+	}
+	return candidates, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// newTopicCandidate describes an item by its title and the start of its
+// content
+func newTopicCandidate(item TopicItem, content string) topicCandidate {
+	text := item.Title + "\n" + content
+	if runes := []rune(text); len(runes) > topicItemText {
+		text = string(runes[:topicItemText])
+	}
+	return topicCandidate{item: item, text: text, terms: topicTerms(text)}
+}
+
+// topicTerms are the most frequent words of a text, as word pairs for
+// Chinese, Japanese and Korean, which have no spaces
+func topicTerms(text string) []string {
+	counts := make(map[string]int)
+	var word []rune
+	flush := func() {
+		switch {
+		case len(word) > 1 && isCJK(word[0]):
+			for i := 0; i+1 < len(word); i++ {
+				counts[string(word[i:i+2])]++
+			}
+		case len(word) > 2:
+			counts[string(word)]++
+		}
+		word = word[:0]
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			flush()
+		case len(word) > 0 && isCJK(r) != isCJK(word[0]):
+			flush()
+			word = append(word, r)
+		default:
+			word = append(word, r)
+		}
+	}
+	flush()
+
+	terms := make([]string, 0, len(counts))
+	for term := range counts {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > maxNoteTerms {
+		terms = terms[:maxNoteTerms]
+	}
+	return terms
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// termUse counts the items that use each term
+func termUse(candidates []topicCandidate) map[string]int {
+	use := make(map[string]int)
+	for _, c := range candidates {
+		for _, t := range c.terms {
+			use[t]++
+		}
+	}
+	return use
+}
+
+// termWeight weighs a term by how few of n items use it, so words every
+// item shares say little about any topic
+func termWeight(n, use int) float64 {
+	return math.Log(1 + float64(n)/float64(use))
+}
+
+// embedTopicCandidates gives each candidate the direction of its
+// embedding: a source's chunks, or its text embedded for notes and sources
+// without chunk embeddings. It reports false when embeddings are off or
+// fail.
+func (s *Server) embedTopicCandidates(ctx context.Context, notebookID string, candidates []topicCandidate) bool {
+	embedder := s.vectorStore.embedder
+	if embedder == nil {
+		return false
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
+		golog.Warnf("failed to load vector index of notebook %s: %v", notebookID, err)
+	}
+	sourceVectors := s.vectorStore.sourceVectors(notebookID)
+
+	var texts []string
+	var textAt []int
+	for i := range candidates {
+		if v, ok := sourceVectors[candidates[i].item.ID]; ok && candidates[i].item.Kind == TopicItemSource {
+			candidates[i].vector = v
+			continue
+		}
+		texts = append(texts, candidates[i].text)
+		textAt = append(textAt, i)
+	}
+	if len(texts) > 0 {
+		vectors, err := topicVectors.embed(ctx, embedder, texts)
+		if err != nil {
+			golog.Warnf("failed to embed notebook %s for topics, clustering by keywords: %v", notebookID, err)
+			return false
+		}
+		for j, i := range textAt {
+			candidates[i].vector = vectors[j]
+		}
+	}
+	return true
+}
+
+// hashTopicCandidates gives each candidate a vector of its weighted words,
+// hashed into topicHashDims dimensions
+func hashTopicCandidates(candidates []topicCandidate) {
+	use := termUse(candidates)
+	for i := range candidates {
+		v := make([]float32, topicHashDims)
+		for _, t := range candidates[i].terms {
+			h := fnv.New32a()
+			h.Write([]byte(t))
+			v[h.Sum32()%topicHashDims] += float32(termWeight(len(candidates), use[t]))
+		}
+		candidates[i].vector = v
+	}
+}
+
+// normalize scales v to unit length in place, leaving zero vectors alone
+func normalize(v []float32) []float32 {
+	var norm float64
+	for _, f := range v {
+		norm += float64(f) * float64(f)
+	}
+	if norm == 0 {
+		return v
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range v {
+		v[i] *= scale
+	}
+	return v
+}
+
+// topicCount picks how many topics n items are split into
+func topicCount(n int) int {
+	if n < minClusterItems {
+		return 1
+	}
+	return max(1, min(maxTopics, int(math.Round(math.Sqrt(float64(n)/2)))))
+}
+
+// clusterVectors groups unit vectors into k clusters by cosine similarity
+// and returns each vector's cluster and the clusters' centroids. k-means is
+// run from topicRestarts seedings and the tightest clustering is kept; the
+// seeds are fixed, so the same items cluster the same way.
+func clusterVectors(vectors [][]float32, k int) ([]int, [][]float32) {
+	var bestAssigned []int
+	var bestCentroids [][]float32
+	bestFit := math.Inf(-1)
+	for seed := int64(1); seed <= topicRestarts; seed++ {
+		assigned, centroids := kMeans(vectors, k, rand.New(rand.NewSource(seed)))
+		var fit float64
+		for i, v := range vectors {
+			fit += cosineSimilarity(v, centroids[assigned[i]])
+		}
+		if fit > bestFit {
+			bestAssigned, bestCentroids, bestFit = assigned, centroids, fit
+		}
+	}
+	return bestAssigned, bestCentroids
+}
+
+// kMeans runs spherical k-means, seeded with k-means++
+func kMeans(vectors [][]float32, k int, rng *rand.Rand) ([]int, [][]float32) {
+	dims := len(vectors[0])
+	centroids := [][]float32{append([]float32(nil), vectors[rng.Intn(len(vectors))]...)}
+	for len(centroids) < k {
+		// The next seed is likelier the further it is from the chosen ones
+		dist := make([]float64, len(vectors))
+		var total float64
+		for i, v := range vectors {
+			best := math.Inf(1)
+			for _, c := range centroids {
+				best = math.Min(best, 1-cosineSimilarity(v, c))
+			}
+			dist[i] = best * best
+			total += dist[i]
+		}
+		if total == 0 {
+			break
+		}
+		pick := rng.Float64() * total
+		i := 0
+		for ; i < len(vectors)-1 && pick > dist[i]; i++ {
+			pick -= dist[i]
+		}
+		centroids = append(centroids, append([]float32(nil), vectors[i]...))
+	}
+
+	assigned := make([]int, len(vectors))
+	for round := 0; round < topicRounds; round++ {
+		changed := false
+		for i, v := range vectors {
+			best, bestSim := 0, math.Inf(-1)
+			for c, centroid := range centroids {
+				if sim := cosineSimilarity(v, centroid); sim > bestSim {
+					best, bestSim = c, sim
+				}
+			}
+			if best != assigned[i] || round == 0 {
+				changed = true
+			}
+			assigned[i] = best
+		}
+		if !changed {
+			break
+		}
+
+		// An empty cluster keeps its centroid
+		sums := make([][]float32, len(centroids))
+		for i, v := range vectors {
+			c := assigned[i]
+			if len(v) != dims {
+				continue
+			}
+			if sums[c] == nil {
+				sums[c] = make([]float32, dims)
+			}
+			for j, f := range v {
+				sums[c][j] += f
+			}
+		}
+		for c, sum := range sums {
+			if sum != nil {
+				centroids[c] = normalize(sum)
+			}
+		}
+	}
+	return assigned, centroids
+}
+
+// buildTopics turns clusters into topics: their items, most central first,
+// and the words that set them apart from the rest of the notebook
+func buildTopics(candidates []topicCandidate, assigned []int, centroids [][]float32) []Topic {
+	use := termUse(candidates)
+	type member struct {
+		candidate *topicCandidate
+		sim       float64
+	}
+	members := make([][]member, len(centroids))
+	for i := range candidates {
+		c := assigned[i]
+		members[c] = append(members[c], member{&candidates[i], cosineSimilarity(candidates[i].vector, centroids[c])})
+	}
+
+	topics := make([]Topic, 0, len(centroids))
+	for _, group := range members {
+		if len(group) == 0 {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool { return group[i].sim > group[j].sim })
+
+		topic := Topic{Items: make([]TopicItem, len(group))}
+		counts := make(map[string]int)
+		for i, m := range group {
+			topic.Items[i] = m.candidate.item
+			for _, t := range m.candidate.terms {
+				counts[t]++
+			}
+		}
+		minCount := 1
+		if len(group) > 1 {
+			minCount = 2
+		}
+		terms := make([]string, 0, len(counts))
+		for t, n := range counts {
+			// Words most of the notebook uses set no topic apart
+			if len(candidates) >= minClusterItems && use[t]*2 >= len(candidates) {
+				continue
+			}
+			if n >= minCount {
+				terms = append(terms, t)
+			}
+		}
+		score := func(t string) float64 { return float64(counts[t]) * termWeight(len(candidates), use[t]) }
+		sort.Slice(terms, func(i, j int) bool {
+			if score(terms[i]) != score(terms[j]) {
+				return score(terms[i]) > score(terms[j])
+			}
+			return terms[i] < terms[j]
+		})
+		topic.Keywords = terms[:min(len(terms), topicKeywords)]
+		topics = append(topics, topic)
+	}
+	sort.SliceStable(topics, func(i, j int) bool { return len(topics[i].Items) > len(topics[j].Items) })
+	return topics
+}
+
+// topicLabelSchema is the shape topic names are generated in
+var topicLabelSchema = &OutputSchema{Name: "topic_labels", Schema: objectSchema(map[string]*jsonSchema{
+	"topics": arraySchema(objectSchema(map[string]*jsonSchema{
+		"label":   stringSchema("a short name for the topic"),
+		"summary": stringSchema("one sentence on what the topic covers"),
+	})),
+})}
+
+func topicLabelsPrompt(topics []Topic, snippets map[string]string, language string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "以下是一个笔记本中的资料和笔记按内容聚类得到的 %d 个主题，每个主题列出了关键词和其中的部分条目。请为每个主题起一个简短的名称（不超过十个字），并用一句话概括它涵盖的内容，用作笔记本的目录。按给出的顺序输出，每个主题一项。\n", len(topics))
+	for i, topic := range topics {
+		fmt.Fprintf(&b, "\n## 主题 %d\n关键词：%s\n", i+1, strings.Join(topic.Keywords, "、"))
+		for _, item := range topic.Items[:min(len(topic.Items), topicLabelItems)] {
+			fmt.Fprintf(&b, "- %s：%s\n", item.Title, snippets[item.ID])
+		}
+	}
+	if language != "" {
+		b.WriteString(languageInstruction(language))
+	} else {
+		b.WriteString("\n**注意：请务必使用中文进行回复。**")
+	}
+	return b.String()
+}
+
+// LabelTopics names each topic and sums it up in a sentence. snippets hold
+// the start of each item's text by ID.
+func (a *Agent) LabelTopics(ctx context.Context, topics []Topic, snippets map[string]string, language string) error {
+	var out struct {
+		Topics []struct {
+			Label   string `json:"label"`
+			Summary string `json:"summary"`
+		} `json:"topics"`
+	}
+	if _, _, _, err := a.generateJSON(ctx, topicLabelSchema, topicLabelsPrompt(topics, snippets, language), &out); err != nil {
+		return err
+	}
+	for i := range topics {
+		if i < len(out.Topics) && strings.TrimSpace(out.Topics[i].Label) != "" {
+			topics[i].Label = strings.TrimSpace(out.Topics[i].Label)
+			topics[i].Summary = strings.TrimSpace(out.Topics[i].Summary)
+		}
+	}
+	return nil
+}
+
+// generateTopics clusters a notebook's sources and notes into topics, has
+// the LLM name them and saves them. Topics the LLM could not name are named
+// after their keywords.
+func (s *Server) generateTopics(ctx context.Context, notebookID string) (*NotebookTopics, error) {
+	candidates, fingerprint, err := s.topicCandidates(ctx, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	result := &NotebookTopics{NotebookID: notebookID, Topics: []Topic{}, Fingerprint: fingerprint}
+
+	if len(candidates) > 0 {
+		result.Method = topicMethodEmbeddings
+		if !s.embedTopicCandidates(ctx, notebookID, candidates) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			result.Method = topicMethodKeywords
+			hashTopicCandidates(candidates)
+		}
+		vectors := make([][]float32, len(candidates))
+		for i := range candidates {
+			vectors[i] = normalize(candidates[i].vector)
+		}
+		assigned, centroids := clusterVectors(vectors, topicCount(len(candidates)))
+		result.Topics = buildTopics(candidates, assigned, centroids)
+
+		for i := range result.Topics {
+			result.Topics[i].Label = strings.Join(result.Topics[i].Keywords[:min(len(result.Topics[i].Keywords), 3)], " / ")
+			if result.Topics[i].Label == "" {
+				result.Topics[i].Label = result.Topics[i].Items[0].Title
+			}
+		}
+		snippets := make(map[string]string, len(candidates))
+		for _, c := range candidates {
+			text := strings.Join(strings.Fields(c.text), " ")
+			if runes := []rune(text); len(runes) > 200 {
+				text = string(runes[:200])
+			}
+			snippets[c.item.ID] = text
+		}
+		if err := s.agent.LabelTopics(ctx, result.Topics, snippets, s.notebookLanguage(ctx, notebookID)); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			golog.Warnf("failed to name topics of notebook %s, using keywords: %v", notebookID, err)
+		}
+	}
+
+	if err := s.store.SaveNotebookTopics(context.WithoutCancel(ctx), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// refreshStaleTopics regenerates the topics of each notebook that changed
+// since its topics were generated
+func (s *Server) refreshStaleTopics(ctx context.Context) error {
+	notebooks, err := s.store.ListNotebooks(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list notebooks for topics: %w", err)
+	}
+
+	refreshed := 0
+	for _, nb := range notebooks {
+		select {
+		case <-s.stopping:
+			return nil
+		default:
+		}
+		if nb.Type == NotebookTypeSmart || nb.ArchivedAt != nil || nb.TrashedAt != nil {
+			continue
+		}
+		_, fingerprint, err := s.topicCandidates(ctx, nb.ID)
+		if err != nil {
+			golog.Errorf("failed to list items of notebook %s for topics: %v", nb.ID, err)
+			continue
+		}
+		if topics, err := s.store.GetNotebookTopics(ctx, nb.ID); err == nil && topics != nil && topics.Fingerprint == fingerprint {
+			continue
+		}
+
+		jobCtx, cancel := withTimeout(ctx, s.cfg.LLMTimeout)
+		_, err = s.generateTopics(jobCtx, nb.ID)
+		cancel()
+		if err != nil {
+			golog.Errorf("failed to generate topics of notebook %s: %v", nb.ID, err)
+			continue
+		}
+		refreshed++
+	}
+	if refreshed > 0 {
+		golog.Infof("regenerated the topics of %d notebooks", refreshed)
+	}
+	return nil
+}
+
+// Topic handlers
+
+// handleGetTopics returns a notebook's topics as last generated, with no
+// topics if they were not generated yet
+func (s *Server) handleGetTopics(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+
+	topics, err := s.store.GetNotebookTopics(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get topics"})
+		return
+	}
+	_, fingerprint, err := s.topicCandidates(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get topics"})
+		return
+	}
+	if topics == nil {
+		topics = &NotebookTopics{NotebookID: notebookID, Topics: []Topic{}}
+	}
+	topics.Stale = topics.Fingerprint != fingerprint
+	c.JSON(http.StatusOK, topics)
+}
+
+// handleRefreshTopics generates a notebook's topics now
+func (s *Server) handleRefreshTopics(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+	defer cancel()
+
+	topics, err := s.generateTopics(ctx, c.Param("id"))
+	if err != nil {
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: fmt.Sprintf("Failed to generate topics: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, topics)
+}
@@ -0,0 +1,726 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Two-factor authentication: time-based codes (RFC 6238) from an
+// authenticator app, with one-time recovery codes for a lost phone
+
+const (
+	// totpPeriod is how long a code is valid, in seconds, and totpDigits its length
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods before and after the current one a code
+	// is accepted from, for phones whose clock is off
+	totpSkew = 1
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// stepUpWindow is how long after a code was verified destructive changes
+	// don't ask for another
+	stepUpWindow = 5 * time.Minute
+	// otpHeader carries the code that confirms a destructive change
+	otpHeader = "X-OTP-Code"
+	// securitySettingKey is the workspace setting holding its security policy
+	securitySettingKey = "security"
+)
+
+// totpEncoding is how secrets are shown: base32 without padding, as
+// authenticator apps take them
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// errTooManyCodes is returned when a user tries codes faster than the limit
+var errTooManyCodes = errors.New("too many two-factor codes tried; wait a minute")
+
+// TwoFactorStatus is whether a user has two-factor authentication on
+type TwoFactorStatus struct {
+	Enabled bool `json:"enabled"`
+	// Pending is set between enrolling and confirming the first code
+	Pending           bool       `json:"pending,omitempty"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+	// VerifiedUntil is when destructive changes ask for a code again
+	VerifiedUntil *time.Time `json:"verified_until,omitempty"`
+}
+
+// userTOTP is a user's authenticator secret
+type userTOTP struct {
+	UserID    string
+	Secret    string
+	EnabledAt *time.Time
+	// LastStep is the period of the last code used, so a code works once
+	LastStep int64
+}
+
+func (t *userTOTP) enabled() bool {
+	return t != nil && t.EnabledAt != nil
+}
+
+// SecurityPolicy is what a workspace requires of its members
+type SecurityPolicy struct {
+	// RequireTwoFactor refuses members who don't have two-factor
+	// authentication on
+	RequireTwoFactor bool `json:"require_two_factor"`
+}
+
+// newTOTPSecret returns a random 160-bit secret, base32 encoded
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode computes the code of a period with HMAC-SHA1
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// matchTOTP returns the period a code belongs to, looking totpSkew periods
+// around now and only after the last one used
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && tokenMatches(code, totpCode(key, step)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURL is the otpauth:// link authenticator apps add an account from,
+// usually shown as a QR code
+func totpURL(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + q.Encode()
+}
+
+// newRecoveryCodes returns recoveryCodeCount codes such as 3f9a1-c07d2
+func newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := randomToken(5)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes
+}
+
+// normalizeOTPCode drops the spaces and dashes people type codes with
+func normalizeOTPCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// isTOTPCode reports whether a normalized code is an authenticator code
+// rather than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Two-factor operations
+
+func scanUserTOTP(row rowScanner) (*userTOTP, error) {
+	var t userTOTP
+	var enabledAt sql.NullInt64
+	if err := row.Scan(&t.UserID, &t.Secret, &enabledAt, &t.LastStep); err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		at := time.Unix(enabledAt.Int64, 0)
+		t.EnabledAt = &at
+	}
+	return &t, nil
+}
+
+// GetUserTOTP returns a user's authenticator secret, confirmed or not
+func (s *Store) GetUserTOTP(ctx context.Context, userID string) (*userTOTP, error) {
+	t, err := scanUserTOTP(s.db.QueryRowContext(ctx, `
+		SELECT user_id, secret, enabled_at, last_step FROM user_totp WHERE user_id = ?
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("two-factor authentication")
+	}
+	return t, err
+}
+
+// TwoFactorEnabled reports whether a user has confirmed an authenticator
+func (s *Store) TwoFactorEnabled(ctx context.Context, userID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM user_totp WHERE user_id = ? AND enabled_at IS NOT NULL
+	`, userID).Scan(&n)
+	return n > 0, err
+}
+
+// StartUserTOTP saves a new secret waiting for its first code, replacing
+// an unconfirmed one
+func (s *Store) StartUserTOTP(ctx context.Context, userID, secret string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO user_totp (user_id, secret, enabled_at, last_step, created_at) VALUES (?, ?, NULL, 0, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_step = 0, created_at = excluded.created_at
+		WHERE user_totp.enabled_at IS NULL
+	`, userID, secret, time.Now().Unix())
+	return err
+}
+
+// EnableUserTOTP turns two-factor authentication on with the first code's
+// period and the user's recovery codes
+func (s *Store) EnableUserTOTP(ctx context.Context, userID string, step int64, recoveryCodes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE user_totp SET enabled_at = ?, last_step = ? WHERE user_id = ? AND enabled_at IS NULL
+	`, now, step, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return conflictError("two-factor authentication is already on")
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes saves the hashes of a user's new recovery codes in
+// place of the old ones
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID string, codes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO recovery_codes (user_id, code_hash, used_at) VALUES (?, ?, NULL)
+		`, userID, hashToken(normalizeOTPCode(code))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes gives a user new recovery codes, voiding the old ones
+func (s *Store) ReplaceRecoveryCodes(ctx context.Context, userID string, codes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(ctx, tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CountRecoveryCodes returns how many of a user's recovery codes are unused
+func (s *Store) CountRecoveryCodes(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL
+	`, userID).Scan(&n)
+	return n, err
+}
+
+// UseTOTPStep records a code's period as used. It reports false when a code
+// of that period or later was used already.
+func (s *Store) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?
+	`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode spends one of a user's recovery codes. It reports false
+// for a wrong or used code.
+func (s *Store) UseRecoveryCode(ctx context.Context, userID, code string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now().Unix(), userID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteUserTOTP turns two-factor authentication off for a user
+func (s *Store) DeleteUserTOTP(ctx context.Context, userID string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = ?`, userID)
+	return err
+}
+
+// Checks
+
+// checkSecondFactor verifies an authenticator or recovery code of a user
+// with two-factor authentication on. Each code works once, and a user may
+// try only a few a minute.
+func (s *Server) checkSecondFactor(ctx context.Context, t *userTOTP, code string) (bool, error) {
+	if ok, _ := s.otpAttempts.Allow(t.UserID); !ok {
+		return false, errTooManyCodes
+	}
+	code = normalizeOTPCode(code)
+	if !isTOTPCode(code) {
+		return s.store.UseRecoveryCode(ctx, t.UserID, code)
+	}
+	step, ok := matchTOTP(t.Secret, code, time.Now(), t.LastStep)
+	if !ok {
+		return false, nil
+	}
+	return s.store.UseTOTPStep(ctx, t.UserID, step)
+}
+
+// secondFactorFailed answers a request whose code was refused
+func secondFactorFailed(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errTooManyCodes):
+		c.Header("Retry-After", "60")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, ErrorResponse{Code: CodeRateLimited, Error: "Too many two-factor codes tried; wait a minute"})
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check the two-factor code"})
+	default:
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeStepUpRequired, Error: "Invalid or already used two-factor code"})
+	}
+}
+
+// stepUpSession records a code as verified on the session of the request,
+// so destructive changes from that device only don't ask for another
+func (s *Server) stepUpSession(c *gin.Context) error {
+	sess := currentSession(c)
+	if sess == nil {
+		return nil
+	}
+	at, err := s.store.StepUpSession(c.Request.Context(), sess.ID)
+	if err != nil {
+		return err
+	}
+	sess.StepUpAt = &at
+	return nil
+}
+
+// requireStepUp has a user with two-factor authentication on confirm a
+// destructive change, such as deleting a notebook or exporting an account,
+// with a code in the X-OTP-Code header. A code verified on the same session
+// in the last stepUpWindow counts, so a run of changes needs one code.
+func (s *Server) requireStepUp(c *gin.Context) bool {
+	user := currentUser(c)
+	if user == nil {
+		return true
+	}
+	ctx := c.Request.Context()
+
+	t, err := s.store.GetUserTOTP(ctx, user.ID)
+	if errors.Is(err, ErrNotFound) || (err == nil && !t.enabled()) {
+		return true
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check two-factor authentication"})
+		return false
+	}
+	if currentSession(c).steppedUp(time.Now()) {
+		return true
+	}
+
+	code := c.GetHeader(otpHeader)
+	if code == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Code: CodeStepUpRequired, Error: "Confirm this with a two-factor code in the X-OTP-Code header"})
+		return false
+	}
+	if ok, err := s.checkSecondFactor(ctx, t, code); !ok {
+		secondFactorFailed(c, err)
+		return false
+	}
+	if err := s.stepUpSession(c); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check two-factor authentication"})
+		return false
+	}
+	return true
+}
+
+// securityPolicy returns a workspace's security policy
+func securityPolicy(ws *Workspace) SecurityPolicy {
+	var policy SecurityPolicy
+	if raw, ok := ws.Settings[securitySettingKey]; ok {
+		data, _ := json.Marshal(raw)
+		json.Unmarshal(data, &policy)
+	}
+	return policy
+}
+
+// twoFactorExempt reports whether a request may be made by members who
+// have yet to turn on two-factor authentication their workspace requires:
+// turning it on, and seeing who they are signed in as
+func twoFactorExempt(p string) bool {
+	return p == "/api/me" || p == "/api/account/2fa" || strings.HasPrefix(p, "/api/account/2fa/")
+}
+
+// checkTwoFactorPolicy refuses a user who doesn't have two-factor
+// authentication on in a workspace that requires it
+func (s *Server) checkTwoFactorPolicy(ctx context.Context, ws *Workspace, user *User) (int, error) {
+	if user == nil || !securityPolicy(ws).RequireTwoFactor {
+		return 0, nil
+	}
+	enabled, err := s.store.TwoFactorEnabled(ctx, user.ID)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to check two-factor authentication")
+	}
+	if !enabled {
+		return http.StatusForbidden, fmt.Errorf("this workspace requires two-factor authentication; turn it on with POST /api/account/2fa")
+	}
+	return 0, nil
+}
+
+// twoFactorPolicyResponse answers a request refused by checkTwoFactorPolicy
+func twoFactorPolicyResponse(c *gin.Context, status int, err error) {
+	code := CodeInternal
+	if status == http.StatusForbidden {
+		code = CodeTwoFactorRequired
+	}
+	c.AbortWithStatusJSON(status, ErrorResponse{Code: code, Error: err.Error()})
+}
+
+// Two-factor handlers
+
+// twoFactorUser returns the signed-in user, answering 401 without one
+func twoFactorUser(c *gin.Context) (*User, bool) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "An API token is required for two-factor authentication"})
+		return nil, false
+	}
+	return user, true
+}
+
+// twoFactorStatus describes a user's two-factor authentication, as seen
+// from one of their sessions
+func (s *Server) twoFactorStatus(ctx context.Context, userID string, sess *Session) (*TwoFactorStatus, error) {
+	status := &TwoFactorStatus{}
+	t, err := s.store.GetUserTOTP(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Enabled = t.enabled()
+	status.Pending = !t.enabled()
+	status.EnabledAt = t.EnabledAt
+	if t.enabled() && sess.steppedUp(time.Now()) {
+		until := sess.StepUpAt.Add(stepUpWindow)
+		status.VerifiedUntil = &until
+	}
+	if status.RecoveryCodesLeft, err = s.store.CountRecoveryCodes(ctx, userID); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// handleGetTwoFactor shows whether the caller has two-factor authentication on
+func (s *Server) handleGetTwoFactor(c *gin.Context) {
+	user, ok := twoFactorUser(c)
+	if !ok {
+		return
+	}
+	status, err := s.twoFactorStatus(c.Request.Context(), user.ID, currentSession(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// handleStartTwoFactor creates an authenticator secret for the caller. It
+// takes effect once a code from it is confirmed.
+func (s *Server) handleStartTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := twoFactorUser(c)
+	if !ok {
+		return
+	}
+	enabled, err := s.store.TwoFactorEnabled(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to set up two-factor authentication"})
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Two-factor authentication is already on; turn it off first to use another authenticator"})
+		return
+	}
+
+	secret := newTOTPSecret()
+	if err := s.store.StartUserTOTP(ctx, user.ID, secret); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to set up two-factor authentication"})
+		return
+	}
+	issuer, _ := s.instanceSetting(ctx, "instance.name").(string)
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_url": totpURL(issuer, user.Email, secret),
+		"digits":      totpDigits,
+		"period":      totpPeriod,
+	})
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required,max=32"`
+}
+
+// handleConfirmTwoFactor turns two-factor authentication on with a first
+// code from the authenticator, and returns the recovery codes. They are
+// shown only this once.
+func (s *Server) handleConfirmTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := twoFactorUser(c)
+	if !ok {
+		return
+	}
+	var req twoFactorCodeRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	t, err := s.store.GetUserTOTP(ctx, user.ID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Start with POST /api/account/2fa"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to confirm two-factor authentication"})
+		return
+	}
+	if t.enabled() {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Two-factor authentication is already on"})
+		return
+	}
+	if ok, _ := s.otpAttempts.Allow(user.ID); !ok {
+		secondFactorFailed(c, errTooManyCodes)
+		return
+	}
+	step, ok := matchTOTP(t.Secret, normalizeOTPCode(req.Code), time.Now(), 0)
+	if !ok {
+		validationResponse(c, invalidField("code", "is not the authenticator's current code; check the phone's clock"))
+		return
+	}
+
+	codes := newRecoveryCodes()
+	if err := s.store.EnableUserTOTP(ctx, user.ID, step, codes); err != nil {
+		storeErrorResponse(c, err, "Failed to confirm two-factor authentication")
+		return
+	}
+	if err := s.stepUpSession(c); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to confirm two-factor authentication"})
+		return
+	}
+	status, err := s.twoFactorStatus(ctx, user.ID, currentSession(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status, "recovery_codes": codes})
+}
+
+// handleVerifyTwoFactor checks a code ahead of destructive changes, which
+// then don't ask for one on this session for stepUpWindow
+func (s *Server) handleVerifyTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := twoFactorUser(c)
+	if !ok {
+		return
+	}
+	var req twoFactorCodeRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	t, err := s.store.GetUserTOTP(ctx, user.ID)
+	if errors.Is(err, ErrNotFound) || (err == nil && !t.enabled()) {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Two-factor authentication is off"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check the two-factor code"})
+		return
+	}
+	if ok, err := s.checkSecondFactor(ctx, t, req.Code); !ok {
+		secondFactorFailed(c, err)
+		return
+	}
+	if err := s.stepUpSession(c); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check the two-factor code"})
+		return
+	}
+	status, err := s.twoFactorStatus(ctx, user.ID, currentSession(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to get two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// handleRegenerateRecoveryCodes replaces the caller's recovery codes
+func (s *Server) handleRegenerateRecoveryCodes(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := twoFactorUser(c)
+	if !ok {
+		return
+	}
+	enabled, err := s.store.TwoFactorEnabled(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create recovery codes"})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Two-factor authentication is off"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+
+	codes := newRecoveryCodes()
+	if err := s.store.ReplaceRecoveryCodes(ctx, user.ID, codes); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// handleDisableTwoFactor turns the caller's two-factor authentication off,
+// or drops an unconfirmed setup
+func (s *Server) handleDisableTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := twoFactorUser(c)
+	if !ok {
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	if err := s.store.DeleteUserTOTP(ctx, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to turn off two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication turned off"})
+}
+
+// handleAdminResetTwoFactor turns two-factor authentication off for a user
+// who lost both their authenticator and recovery codes
+func (s *Server) handleAdminResetTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	if _, err := s.store.GetUser(ctx, c.Param("userId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "User not found"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	if err := s.store.DeleteUserTOTP(ctx, c.Param("userId")); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to reset two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication turned off"})
+}
+
+// Security policy handlers
+
+// handleGetSecurityPolicy returns a workspace's security policy
+func (s *Server) handleGetSecurityPolicy(c *gin.Context) {
+	ws, ok := s.loadWorkspace(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, securityPolicy(ws))
+}
+
+// handleSetSecurityPolicy replaces a workspace's security policy. Only
+// workspaces with members can require two-factor authentication, and the
+// owner setting it must have it on, so they can't lock themselves out.
+func (s *Server) handleSetSecurityPolicy(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+	var policy SecurityPolicy
+	if !bindJSON(c, &policy) {
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+	if policy.RequireTwoFactor {
+		user := currentUser(c)
+		if user == nil {
+			validationResponse(c, invalidField("require_two_factor", "needs a workspace with members"))
+			return
+		}
+		enabled, err := s.store.TwoFactorEnabled(ctx, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update security policy"})
+			return
+		}
+		if !enabled {
+			validationResponse(c, invalidField("require_two_factor", "needs two-factor authentication on for you first"))
+			return
+		}
+	}
+
+	ws.Settings[securitySettingKey] = policy
+	if err := s.store.UpdateWorkspace(ctx, ws); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update security policy"})
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
@@ -0,0 +1,171 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the key of the RFC 6238 SHA-1 test vectors, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The RFC lists 8-digit codes; these are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	key, _ := totpEncoding.DecodeString(rfcSecret)
+	step := now.Unix() / totpPeriod
+	code := func(offset int64) string { return totpCode(key, step+offset) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current period", secret: rfcSecret, code: code(0), wantStep: step, wantOK: true},
+		{name: "previous period", secret: rfcSecret, code: code(-1), wantStep: step - 1, wantOK: true},
+		{name: "next period", secret: rfcSecret, code: code(1), wantStep: step + 1, wantOK: true},
+		{name: "too old", secret: rfcSecret, code: code(-2)},
+		{name: "too new", secret: rfcSecret, code: code(2)},
+		{name: "already used", secret: rfcSecret, code: code(0), lastStep: step},
+		{name: "older than the last used", secret: rfcSecret, code: code(-1), lastStep: step},
+		{name: "newer than the last used", secret: rfcSecret, code: code(1), lastStep: step, wantStep: step + 1, wantOK: true},
+		{name: "wrong code", secret: rfcSecret, code: "000000"},
+		{name: "empty code", secret: rfcSecret, code: ""},
+		{name: "bad secret", secret: "not base32!", code: code(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := matchTOTP(tt.secret, tt.code, now, tt.lastStep)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("matchTOTP = %d, %v, want %d, %v", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNormalizeOTPCode(t *testing.T) {
+	tests := []struct {
+		code     string
+		want     string
+		wantTOTP bool
+	}{
+		{code: "123456", want: "123456", wantTOTP: true},
+		{code: " 123 456 ", want: "123456", wantTOTP: true},
+		{code: "123-456", want: "123456", wantTOTP: true},
+		{code: "3F9A1-C07D2", want: "3f9a1c07d2"},
+		{code: "3f9a1 c07d2", want: "3f9a1c07d2"},
+		{code: "12345", want: "12345"},
+		{code: "1234567", want: "1234567"},
+		{code: "12345a", want: "12345a"},
+		{code: "", want: ""},
+	}
+	for _, tt := range tests {
+		got := normalizeOTPCode(tt.code)
+		if got != tt.want {
+			t.Errorf("normalizeOTPCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+		if isTOTP := isTOTPCode(got); isTOTP != tt.wantTOTP {
+			t.Errorf("isTOTPCode(%q) = %v, want %v", got, isTOTP, tt.wantTOTP)
+		}
+	}
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	s := &Server{store: &CachedStore{Store: store}, otpAttempts: newRateLimiter(1000, 1000)}
+
+	user, _, err := store.CreateUser(ctx, "totp@example.com", "TOTP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StartUserTOTP(ctx, user.ID, rfcSecret); err != nil {
+		t.Fatal(err)
+	}
+	recovery := newRecoveryCodes()
+	if err := store.EnableUserTOTP(ctx, user.ID, 0, recovery); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(rfcSecret)
+	current := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{name: "authenticator code", code: current, want: true},
+		{name: "authenticator code again", code: current},
+		{name: "wrong authenticator code", code: "000000"},
+		{name: "recovery code", code: recovery[0], want: true},
+		{name: "recovery code again", code: recovery[0]},
+		{name: "recovery code typed loosely", code: " " + strings.ToUpper(recovery[1]) + " ", want: true},
+		{name: "recovery code without dash", code: normalizeOTPCode(recovery[2]), want: true},
+		{name: "unknown recovery code", code: "00000-00000"},
+		{name: "empty", code: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			totp, err := store.GetUserTOTP(ctx, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := s.checkSecondFactor(ctx, totp, tt.code)
+			if err != nil {
+				t.Fatalf("checkSecondFactor: %v", err)
+			}
+			if ok != tt.want {
+				t.Errorf("checkSecondFactor(%q) = %v, want %v", tt.code, ok, tt.want)
+			}
+		})
+	}
+
+	left, err := store.CountRecoveryCodes(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := recoveryCodeCount - 3; left != want {
+		t.Errorf("%d recovery codes left, want %d", left, want)
+	}
+}
+
+func TestCheckSecondFactorRateLimit(t *testing.T) {
+	s := &Server{otpAttempts: newRateLimiter(2, 2)}
+	totp := &userTOTP{UserID: "u1", Secret: rfcSecret}
+	for i := 0; i < 2; i++ {
+		if _, err := s.checkSecondFactor(context.Background(), totp, "000000"); err != nil {
+			t.Fatalf("try %d: %v", i+1, err)
+		}
+	}
+	if _, err := s.checkSecondFactor(context.Background(), totp, "000000"); !errors.Is(err, errTooManyCodes) {
+		t.Errorf("third try: err = %v, want errTooManyCodes", err)
+	}
+}
@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/kataras/golog"
+)
+
+// maxAudioSize bounds a spoken question, the most transcription APIs accept
+const maxAudioSize = 25 << 20
+
+// transcriber turns speech into text with an OpenAI-compatible
+// audio transcriptions API
+type transcriber struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+// newTranscriber creates the transcriber, or returns nil when there is no
+// API to transcribe with: Ollama has none, so TRANSCRIPTION_BASE_URL must
+// name one
+func newTranscriber(cfg Config) *transcriber {
+	baseURL := cfg.TranscriptionBaseURL
+	if baseURL == "" {
+		if cfg.IsOllama() {
+			return nil
+		}
+		_, baseURL = llmProvider(cfg)
+	}
+	apiKey := cfg.TranscriptionAPIKey
+	if apiKey == "" {
+		apiKey = cfg.OpenAIAPIKey
+	}
+	return &transcriber{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   cfg.TranscriptionModel,
+		client:  providerHTTPClient(cfg, 5*time.Minute, cfg.ProviderMaxRetries),
+	}
+}
+
+// transcribe returns the text spoken in an audio file. language is an ISO
+// 639-1 code hinting at the spoken language, or "" to have it detected.
+func (t *transcriber) transcribe(ctx context.Context, audio io.Reader, fileName, language string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("model", t.model)
+	form.WriteField("response_format", "json")
+	if language != "" {
+		form.WriteField("language", language)
+	}
+	part, err := form.CreateFormFile("file", filepath.Base(fileName))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("transcription API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode transcription: %w", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// bindChatRequest binds a chat request from a JSON body, or from a
+// multipart form with the same fields. A form may ask the question by voice
+// instead, as an "audio" file, which is transcribed into the message; the
+// transcript is returned. It reports whether the handler can go on.
+func (s *Server) bindChatRequest(c *gin.Context, ctx context.Context, notebookID string, req *ChatRequest) (string, bool) {
+	if c.ContentType() != binding.MIMEMultipartPOSTForm {
+		return "", bindJSON(c, req)
+	}
+	if !bindResponse(c, c.ShouldBindWith(req, binding.FormMultipart)) {
+		return "", false
+	}
+	header, err := c.FormFile("audio")
+	if err == http.ErrMissingFile {
+		return "", true
+	}
+	if err != nil {
+		if !bodyTooLargeResponse(c, err) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		}
+		return "", false
+	}
+
+	if strings.TrimSpace(req.Message) != "" {
+		validationResponse(c, invalidField("message", "must be empty when the question is asked by audio"))
+		return "", false
+	}
+	if header.Size > maxAudioSize {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Code: CodePayloadTooLarge, Error: fmt.Sprintf("Audio is larger than the %s limit", formatBytes(maxAudioSize))})
+		return "", false
+	}
+	if s.transcriber == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: "Transcription is not configured"})
+		return "", false
+	}
+
+	audio, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read audio"})
+		return "", false
+	}
+	defer audio.Close()
+
+	// Hint the notebook's language; without one the API detects it
+	language := ""
+	if lang, _ := lookupLanguage(s.notebookLanguage(ctx, notebookID)); lang != nil {
+		language = lang.Code
+	}
+	transcript, err := s.transcriber.transcribe(ctx, audio, header.Filename, language)
+	if err != nil {
+		if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+			return "", false
+		}
+		golog.Errorf("failed to transcribe question for notebook %s: %v", notebookID, err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Transcription failed: %v", err)})
+		return "", false
+	}
+	if transcript == "" {
+		validationResponse(c, invalidField("audio", "has no speech in it"))
+		return "", false
+	}
+	req.Message = transcript
+	return transcript, true
+}
+
+// questionMetadata is the metadata saved with a user message: how it was
+// asked, when by voice
+func questionMetadata(transcript string) map[string]interface{} {
+	if transcript == "" {
+		return nil
+	}
+	return map[string]interface{}{"input": "voice"}
+}
@@ -0,0 +1,361 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TranscriptCitation is a chat citation resolved to its source
+type TranscriptCitation struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Type       string `json:"type"` // source type, "web" or "deleted"
+	URL        string `json:"url,omitempty"`
+	NotebookID string `json:"notebook_id,omitempty"`
+}
+
+// TranscriptMessage is a chat message with resolved citations
+type TranscriptMessage struct {
+	Role      string               `json:"role"`
+	Content   string               `json:"content"`
+	CreatedAt time.Time            `json:"created_at"`
+	Citations []TranscriptCitation `json:"citations,omitempty"`
+}
+
+// ChatTranscript is an exportable copy of a chat session
+type ChatTranscript struct {
+	SessionID    string              `json:"session_id"`
+	NotebookID   string              `json:"notebook_id"`
+	NotebookName string              `json:"notebook_name"`
+	Title        string              `json:"title"`
+	CreatedAt    time.Time           `json:"created_at"`
+	ExportedAt   time.Time           `json:"exported_at"`
+	Messages     []TranscriptMessage `json:"messages"`
+}
+
+// transcriptFormats maps export formats to content type and file extension
+var transcriptFormats = map[string]struct{ contentType, ext string }{
+	"markdown": {"text/markdown; charset=utf-8", "md"},
+	"json":     {"application/json; charset=utf-8", "json"},
+	"html":     {"text/html; charset=utf-8", "html"},
+}
+
+// buildTranscript resolves a session's citations to source titles and links
+func (s *Server) buildTranscript(ctx context.Context, session *ChatSession) (*ChatTranscript, error) {
+	notebook, err := s.store.GetNotebook(ctx, session.NotebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &ChatTranscript{
+		SessionID:    session.ID,
+		NotebookID:   session.NotebookID,
+		NotebookName: notebook.Name,
+		Title:        session.Title,
+		CreatedAt:    session.CreatedAt,
+		ExportedAt:   time.Now(),
+		Messages:     make([]TranscriptMessage, 0, len(session.Messages)),
+	}
+
+	resolved := make(map[string]TranscriptCitation)
+	for _, msg := range session.Messages {
+		tm := TranscriptMessage{Role: msg.Role, Content: msg.Content, CreatedAt: msg.CreatedAt}
+		for _, id := range msg.Sources {
+			citation, ok := resolved[id]
+			if !ok {
+				citation = s.resolveCitation(ctx, id)
+				resolved[id] = citation
+			}
+			tm.Citations = append(tm.Citations, citation)
+		}
+		t.Messages = append(t.Messages, tm)
+	}
+
+	return t, nil
+}
+
+// resolveCitation looks up a cited ID. Web citations are stored by URL.
+func (s *Server) resolveCitation(ctx context.Context, id string) TranscriptCitation {
+	if strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://") {
+		return TranscriptCitation{ID: id, Title: id, Type: "web", URL: id}
+	}
+
+	source, err := s.store.GetSource(ctx, id)
+	if err != nil {
+		return TranscriptCitation{ID: id, Title: id, Type: "deleted"}
+	}
+
+	url := source.URL
+	if url == "" {
+		url = fmt.Sprintf("/api/notebooks/%s/sources/%s/content", source.NotebookID, source.ID)
+	}
+	return TranscriptCitation{
+		ID:         source.ID,
+		Title:      source.Name,
+		Type:       source.Type,
+		URL:        url,
+		NotebookID: source.NotebookID,
+	}
+}
+
+// renderTranscript renders a transcript in the given format
+func renderTranscript(t *ChatTranscript, format string) ([]byte, error) {
+	switch format {
+	case "markdown":
+		return []byte(transcriptMarkdown(t)), nil
+	case "json":
+		return json.MarshalIndent(t, "", "  ")
+	case "html":
+		var buf bytes.Buffer
+		if err := transcriptHTML.Execute(&buf, t); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+func transcriptMarkdown(t *ChatTranscript) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# %s\n\n", t.Title))
+	sb.WriteString(fmt.Sprintf("- Notebook: %s\n", t.NotebookName))
+	sb.WriteString(fmt.Sprintf("- Created: %s\n", t.CreatedAt.Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("- Exported: %s\n\n", t.ExportedAt.Format(time.RFC3339)))
+
+	for _, msg := range t.Messages {
+		sb.WriteString(fmt.Sprintf("## %s\n\n", transcriptRole(msg.Role)))
+		sb.WriteString(strings.TrimSpace(msg.Content))
+		sb.WriteString("\n\n")
+		if len(msg.Citations) > 0 {
+			sb.WriteString("**Sources**\n\n")
+			for i, c := range msg.Citations {
+				if c.URL != "" {
+					sb.WriteString(fmt.Sprintf("%d. [%s](%s)\n", i+1, c.Title, c.URL))
+				} else {
+					sb.WriteString(fmt.Sprintf("%d. %s\n", i+1, c.Title))
+				}
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
+
+func transcriptRole(role string) string {
+	switch role {
+	case "user":
+		return "User"
+	case "assistant":
+		return "Assistant"
+	default:
+		return "System"
+	}
+}
+
+var transcriptHTML = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"role": transcriptRole,
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; line-height: 1.5; }
+.message { margin-bottom: 1.5rem; }
+.role { font-weight: bold; }
+.content { white-space: pre-wrap; }
+.citations { font-size: 0.9em; color: #555; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Notebook: {{.NotebookName}}<br>Created: {{time .CreatedAt}}<br>Exported: {{time .ExportedAt}}</p>
+{{range .Messages}}<div class="message">
+<div class="role">{{role .Role}}</div>
+<div class="content">{{.Content}}</div>
+{{if .Citations}}<ol class="citations">
+{{range .Citations}}<li>{{if .URL}}<a href="{{.URL}}">{{.Title}}</a>{{else}}{{.Title}}{{end}}</li>
+{{end}}</ol>
+{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+// exportFileName turns a title into a safe download file name
+func exportFileName(title, ext string) string {
+	name := safeFileName(title)
+	if name == "" {
+		name = "export"
+	}
+	return name + "." + ext
+}
+
+// safeFileName replaces the characters file systems refuse in a title
+func safeFileName(title string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+}
+
+// Export handlers
+
+func (s *Server) handleExportChatSession(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	format := c.DefaultQuery("format", "markdown")
+	f, ok := transcriptFormats[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "format must be one of markdown, json, html"})
+		return
+	}
+
+	session, err := s.store.GetChatSession(ctx, c.Param("sessionId"))
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat session not found"})
+		return
+	}
+
+	transcript, err := s.buildTranscript(ctx, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to build transcript"})
+		return
+	}
+
+	data, err := renderTranscript(transcript, format)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to render transcript"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(session.Title, f.ext)))
+	c.Data(http.StatusOK, f.contentType, data)
+}
+
+// handleExportNotebook downloads a zip of the notebook's metadata, sources and
+// notes, with chat transcripts when include_chats is set
+func (s *Server) handleExportNotebook(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	chatFormat := c.DefaultQuery("chat_format", "markdown")
+	f, ok := transcriptFormats[chatFormat]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "chat_format must be one of markdown, json, html"})
+		return
+	}
+
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list sources"})
+		return
+	}
+
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+		return
+	}
+
+	references, err := s.store.ListNotebookReferences(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list references"})
+		return
+	}
+	references = s.resolveReferences(ctx, references)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	writeFile := func(name string, data []byte) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	meta, _ := json.MarshalIndent(map[string]interface{}{
+		"notebook":   notebook,
+		"sources":    sources,
+		"references": references,
+	}, "", "  ")
+	if err := writeFile("notebook.json", meta); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write export"})
+		return
+	}
+
+	noteFiles := make(map[string]string, len(notes))
+	for i, note := range notes {
+		noteFiles[note.ID] = fmt.Sprintf("%03d-%s", i+1, exportFileName(note.Title, "md"))
+	}
+	for _, note := range notes {
+		name := "notes/" + noteFiles[note.ID]
+		text := fmt.Sprintf("# %s\n\n%s\n", note.Title, note.Content)
+		if section := referencesMarkdown(note.ID, references, noteFiles); section != "" {
+			text += "\n" + section
+		}
+		if err := writeFile(name, []byte(text)); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write export"})
+			return
+		}
+	}
+
+	if c.Query("include_chats") == "true" {
+		sessions, err := s.store.ListChatSessions(ctx, notebookID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list chat sessions"})
+			return
+		}
+
+		for i, summary := range sessions {
+			session, err := s.store.GetChatSession(ctx, summary.ID)
+			if err != nil {
+				continue
+			}
+			transcript, err := s.buildTranscript(ctx, session)
+			if err != nil {
+				continue
+			}
+			data, err := renderTranscript(transcript, chatFormat)
+			if err != nil {
+				continue
+			}
+			name := fmt.Sprintf("chats/%03d-%s", i+1, exportFileName(session.Title, f.ext))
+			if err := writeFile(name, data); err != nil {
+				c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write export"})
+				return
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write export"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(notebook.Name, "zip")))
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
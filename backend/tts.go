@@ -0,0 +1,336 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	// speechCacheDir holds generated speech, named by a hash of what was
+	// said and how, so the same text is only paid for once
+	speechCacheDir = "./data/tts"
+	// maxSpeechText bounds how much text is read aloud in one request
+	maxSpeechText = 40000
+	// speechChunkSize is how much text goes into one provider call; OpenAI
+	// takes up to 4096 characters
+	speechChunkSize = 4000
+)
+
+// SpeechSynthesizer reads text aloud
+type SpeechSynthesizer interface {
+	// Synthesize returns the text spoken in voice as MP3, so the audio of
+	// consecutive calls can be joined. An empty voice is the default one.
+	Synthesize(ctx context.Context, text, voice string) ([]byte, error)
+	// Model names the model that speaks, which is part of the cache key
+	Model() string
+}
+
+// TTSProviderFactory creates a speech synthesizer from the configuration. It
+// returns nil when the provider is not configured, which disables reading
+// aloud.
+type TTSProviderFactory func(cfg Config) (SpeechSynthesizer, error)
+
+// ttsProviders are the TTS_PROVIDER values by name
+var ttsProviders = map[string]TTSProviderFactory{
+	"openai": newOpenAISpeechSynthesizer,
+}
+
+// RegisterTTSProvider adds a speech provider that TTS_PROVIDER can name.
+// Call it before the configuration is loaded.
+func RegisterTTSProvider(name string, factory TTSProviderFactory) {
+	ttsProviders[name] = factory
+}
+
+// ttsProviderNames lists the speech providers for error messages
+func ttsProviderNames() string {
+	names := make([]string, 0, len(ttsProviders))
+	for name := range ttsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newSpeechSynthesizer returns the configured speech synthesizer, or nil if
+// reading aloud is not configured
+func newSpeechSynthesizer(cfg Config) (SpeechSynthesizer, error) {
+	factory, ok := ttsProviders[cfg.TTSProvider]
+	if !ok {
+		return nil, fmt.Errorf("unknown TTS provider: %s", cfg.TTSProvider)
+	}
+	return factory(cfg)
+}
+
+// openAISpeechSynthesizer speaks with an OpenAI-compatible speech API
+type openAISpeechSynthesizer struct {
+	baseURL string
+	apiKey  string
+	model   string
+	voice   string
+	client  *http.Client
+}
+
+// newOpenAISpeechSynthesizer uses the OpenAI settings; Ollama has no speech
+// API, so with it reading aloud is off
+func newOpenAISpeechSynthesizer(cfg Config) (SpeechSynthesizer, error) {
+	if cfg.IsOllama() {
+		return nil, nil
+	}
+	_, baseURL := llmProvider(cfg)
+	model := cfg.TTSModel
+	if model == "" {
+		model = "tts-1"
+	}
+	return &openAISpeechSynthesizer{
+		baseURL: baseURL,
+		apiKey:  cfg.OpenAIAPIKey,
+		model:   model,
+		voice:   cfg.TTSVoice,
+		client:  providerHTTPClient(cfg, 5*time.Minute, cfg.ProviderMaxRetries),
+	}, nil
+}
+
+func (t *openAISpeechSynthesizer) Model() string { return t.model }
+
+func (t *openAISpeechSynthesizer) Synthesize(ctx context.Context, text, voice string) ([]byte, error) {
+	if voice == "" {
+		voice = t.voice
+	}
+	body, _ := json.Marshal(map[string]string{"model": t.model, "input": text, "voice": voice, "response_format": "mp3"})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/audio/speech", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("speech API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+var (
+	speechCodeBlock = regexp.MustCompile("(?s)```.*?```")
+	speechImage     = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)`)
+	speechLink      = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	speechCitation  = regexp.MustCompile(`\[\d+(?:,\s*\d+)*\]`)
+	speechHTML      = regexp.MustCompile(`<[^>]+>`)
+	speechLineMark  = regexp.MustCompile(`(?m)^\s*(?:#{1,6}\s+|>\s?|[-*+]\s+(?:\[[ xX]\]\s+)?|\d+\.\s+)`)
+	speechRule      = regexp.MustCompile(`(?m)^\s*(?:[-*_]\s*){3,}$|^\s*\|?(?:\s*:?-+:?\s*\|)+\s*$`)
+	speechEmphasis  = strings.NewReplacer("**", "", "__", "", "~~", "", "`", "", "*", "", "|", " ")
+	speechBlank     = regexp.MustCompile(`\n{3,}`)
+)
+
+// speechText turns Markdown into the plain text that is read aloud: code
+// blocks, images, citation markers and markup are left out
+func speechText(markdown string) string {
+	text := speechCodeBlock.ReplaceAllString(markdown, "")
+	text = speechImage.ReplaceAllString(text, "")
+	text = speechLink.ReplaceAllString(text, "$1")
+	text = speechCitation.ReplaceAllString(text, "")
+	text = speechHTML.ReplaceAllString(text, "")
+	text = speechRule.ReplaceAllString(text, "")
+	text = speechLineMark.ReplaceAllString(text, "")
+	text = speechEmphasis.Replace(text)
+	return strings.TrimSpace(speechBlank.ReplaceAllString(text, "\n\n"))
+}
+
+// speechChunks splits text into pieces of at most speechChunkSize
+// characters, at paragraph or sentence ends where it can
+func speechChunks(text string) []string {
+	var chunks []string
+	for utf8.RuneCountInString(text) > speechChunkSize {
+		runes := []rune(text)
+		head := string(runes[:speechChunkSize])
+		cut := strings.LastIndex(head, "\n\n")
+		if cut < len(head)/2 {
+			cut = strings.LastIndexAny(head, ".!?。！？\n")
+			if cut >= 0 {
+				_, size := utf8.DecodeRuneInString(head[cut:])
+				cut += size
+			}
+		}
+		if cut < len(head)/2 {
+			cut = strings.LastIndex(head, " ")
+		}
+		if cut <= 0 {
+			cut = len(head)
+		}
+		chunks = append(chunks, strings.TrimSpace(head[:cut]))
+		text = strings.TrimSpace(text[cut:])
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// speechCachePath is where the speech for text in voice is kept
+func (s *Server) speechCachePath(text, voice string) string {
+	if voice == "" {
+		voice = s.cfg.TTSVoice
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{s.cfg.TTSProvider, s.speech.Model(), voice, text}, "\x00")))
+	return filepath.Join(speechCacheDir, hex.EncodeToString(sum[:])+".mp3")
+}
+
+// serveSpeech answers with text read aloud as MP3. Speech generated before
+// for the same text, voice and model is served from the cache; the
+// X-TTS-Cache header says which it was.
+func (s *Server) serveSpeech(c *gin.Context, text, voice string) {
+	if s.speech == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Code: CodeUnavailable, Error: "Text-to-speech is not configured"})
+		return
+	}
+	if text == "" {
+		validationResponse(c, invalidField("text", "has nothing to read aloud"))
+		return
+	}
+	if utf8.RuneCountInString(text) > maxSpeechText {
+		validationResponse(c, invalidField("text", "must be at most %d characters to read aloud", maxSpeechText))
+		return
+	}
+
+	path := s.speechCachePath(text, voice)
+	cache := "hit"
+	if _, err := os.Stat(path); err != nil {
+		cache = "miss"
+		ctx, cancel := operationContext(c, s.cfg.LLMTimeout)
+		defer cancel()
+
+		var audio bytes.Buffer
+		for _, chunk := range speechChunks(text) {
+			data, err := s.speech.Synthesize(ctx, chunk, voice)
+			if err != nil {
+				if s.canceledResponse(c, ctx, err) || providerUnavailableResponse(c, err) {
+					return
+				}
+				golog.Errorf("failed to synthesize speech: %v", err)
+				c.JSON(http.StatusBadGateway, ErrorResponse{Code: CodeProviderError, Error: fmt.Sprintf("Text-to-speech failed: %v", err)})
+				return
+			}
+			audio.Write(data)
+		}
+		if err := writeSpeechCache(path, audio.Bytes()); err != nil {
+			golog.Errorf("failed to cache speech: %v", err)
+			c.Data(http.StatusOK, "audio/mpeg", audio.Bytes())
+			return
+		}
+	}
+
+	c.Header("Content-Type", "audio/mpeg")
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("X-TTS-Cache", cache)
+	c.File(path)
+}
+
+// writeSpeechCache saves generated speech; it is written aside and renamed
+// so a request reading the cache never sees part of a file
+func writeSpeechCache(path string, data []byte) error {
+	if err := os.MkdirAll(speechCacheDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(speechCacheDir, "speech-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SpeechRequest asks for text to be read aloud
+type SpeechRequest struct {
+	Text  string `json:"text" binding:"required,max=40000"`
+	Voice string `json:"voice" binding:"max=64"`
+}
+
+// speechVoice reads the voice query parameter; empty means the default voice
+func speechVoice(c *gin.Context) (string, bool) {
+	voice := c.Query("voice")
+	if len(voice) > 64 {
+		validationResponse(c, invalidField("voice", "must be at most 64 characters"))
+		return "", false
+	}
+	return voice, true
+}
+
+// Text-to-speech handlers
+
+// handleTextToSpeech reads the text in the body aloud. Markdown is read as
+// plain text.
+func (s *Server) handleTextToSpeech(c *gin.Context) {
+	var req SpeechRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	s.serveSpeech(c, speechText(req.Text), req.Voice)
+}
+
+// handleChatMessageSpeech reads a chat message aloud, in the voice given by
+// the voice query parameter or the default one
+func (s *Server) handleChatMessageSpeech(c *gin.Context) {
+	ctx := c.Request.Context()
+	session, err := s.store.GetChatSession(ctx, c.Param("sessionId"))
+	if err != nil || session.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat session not found"})
+		return
+	}
+	msg, err := s.store.getChatMessage(ctx, c.Param("messageId"))
+	if err != nil || msg.SessionID != session.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chat message not found"})
+		return
+	}
+	voice, ok := speechVoice(c)
+	if !ok {
+		return
+	}
+	s.serveSpeech(c, speechText(msg.Content), voice)
+}
+
+// handleNoteSpeech reads a note aloud, its title first
+func (s *Server) handleNoteSpeech(c *gin.Context) {
+	note, err := s.store.GetNote(c.Request.Context(), c.Param("noteId"))
+	if err != nil || note.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Note not found"})
+		return
+	}
+	voice, ok := speechVoice(c)
+	if !ok {
+		return
+	}
+	text := speechText(note.Content)
+	if title := strings.TrimSpace(note.Title); title != "" {
+		text = strings.TrimSpace(title + "\n\n" + text)
+	}
+	s.serveSpeech(c, text, voice)
+}
@@ -6,18 +6,21 @@ import (
 
 // Source represents a document source added to a notebook
 type Source struct {
-	ID          string                 `json:"id"`
-	NotebookID  string                 `json:"notebook_id"`
-	Name        string                 `json:"name"`
-	Type        string                 `json:"type"` // "file", "url", "text", "youtube"
-	URL         string                 `json:"url,omitempty"`
-	Content     string                 `json:"content,omitempty"`
-	FileName    string                 `json:"file_name,omitempty"`
-	FileSize    int64                  `json:"file_size,omitempty"`
-	ChunkCount  int                    `json:"chunk_count"`
-	CreatedAt   time.Time              `json:"created_at"`
-	UpdatedAt   time.Time              `json:"updated_at"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	ID                  string                 `json:"id"`
+	NotebookID          string                 `json:"notebook_id"`
+	Name                string                 `json:"name"`
+	Type                string                 `json:"type"` // "file", "url", "text", "youtube"
+	URL                 string                 `json:"url,omitempty"`
+	Content             string                 `json:"content,omitempty"`
+	FileName            string                 `json:"file_name,omitempty"`
+	FileSize            int64                  `json:"file_size,omitempty"`
+	ChunkCount          int                    `json:"chunk_count"`
+	ContentHash         string                 `json:"content_hash,omitempty"`
+	LinkedSourceID      string                 `json:"linked_source_id,omitempty"` // source whose content this one shares
+	IncludedInRetrieval bool                   `json:"included_in_retrieval"`      // false leaves the source out of chat answers
+	CreatedAt           time.Time              `json:"created_at"`
+	UpdatedAt           time.Time              `json:"updated_at"`
+	Metadata            map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // Note represents a note generated from sources
@@ -38,8 +41,13 @@ type Notebook struct {
 	ID          string                 `json:"id"`
 	Name        string                 `json:"name"`
 	Description string                 `json:"description,omitempty"`
+	Type        string                 `json:"type"` // "notebook", or "smart" for a saved search
+	WorkspaceID string                 `json:"workspace_id"`
 	CreatedAt   time.Time              `json:"created_at"`
 	UpdatedAt   time.Time              `json:"updated_at"`
+	ArchivedAt  *time.Time             `json:"archived_at,omitempty"`
+	TrashedAt   *time.Time             `json:"trashed_at,omitempty"`
+	Language    string                 `json:"language,omitempty"` // e.g. "de" or "en-GB"
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 }
 
@@ -48,8 +56,13 @@ type NotebookWithStats struct {
 	ID          string                 `json:"id"`
 	Name        string                 `json:"name"`
 	Description string                 `json:"description,omitempty"`
+	Type        string                 `json:"type"`
+	WorkspaceID string                 `json:"workspace_id"`
 	CreatedAt   time.Time              `json:"created_at"`
 	UpdatedAt   time.Time              `json:"updated_at"`
+	ArchivedAt  *time.Time             `json:"archived_at,omitempty"`
+	TrashedAt   *time.Time             `json:"trashed_at,omitempty"`
+	Language    string                 `json:"language,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 	SourceCount int                    `json:"source_count"`
 	NoteCount   int                    `json:"note_count"`
@@ -62,6 +75,7 @@ type ChatMessage struct {
 	Role       string                 `json:"role"` // "user", "assistant", "system"
 	Content    string                 `json:"content"`
 	Sources    []string               `json:"sources,omitempty"` // Source IDs referenced
+	ToolCalls  []ToolCallTrace        `json:"tool_calls,omitempty"`
 	CreatedAt  time.Time              `json:"created_at"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 }
@@ -71,6 +85,7 @@ type ChatSession struct {
 	ID           string                 `json:"id"`
 	NotebookID   string                 `json:"notebook_id"`
 	Title        string                 `json:"title"`
+	NotebookIDs  []string               `json:"notebook_ids"` // notebooks queried, starting with NotebookID
 	Messages     []ChatMessage          `json:"messages"`
 	CreatedAt    time.Time              `json:"created_at"`
 	UpdatedAt    time.Time              `json:"updated_at"`
@@ -100,6 +115,7 @@ type TransformationRequest struct {
 	SourceIDs  []string `json:"source_ids"` // Specific sources to use, empty = all
 	Length     string   `json:"length"`     // "short", "medium", "long"
 	Format     string   `json:"format"`     // "markdown", "bullet_points", "paragraphs"
+	Language   string   `json:"-"`          // the notebook's language, set by the server
 }
 
 // TransformationResponse represents the response from a transformation
@@ -114,16 +130,24 @@ type TransformationResponse struct {
 
 // SourceSummary is a lightweight source reference
 type SourceSummary struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Chunks []int  `json:"chunks,omitempty"` // IDs of the chunks cited
+	URL    string `json:"url,omitempty"`    // set for web citations
+	// Notebook the cited source belongs to
+	NotebookID   string `json:"notebook_id,omitempty"`
+	NotebookName string `json:"notebook_name,omitempty"`
 }
 
 // ChatRequest represents a chat request
 type ChatRequest struct {
-	Message   string                 `json:"message"`
-	SessionID string                 `json:"session_id,omitempty"`
-	Context   map[string]interface{} `json:"context,omitempty"`
+	Message   string                 `json:"message" form:"message" binding:"max=32000"`
+	SessionID string                 `json:"session_id,omitempty" form:"session_id" binding:"omitempty,uuid"`
+	Context   map[string]interface{} `json:"context,omitempty" form:"-"`
+	WebSearch bool                   `json:"web_search,omitempty" form:"web_search"` // blend web search results into the answer
+	// Additional notebooks to query when creating a new session
+	NotebookIDs []string `json:"notebook_ids,omitempty" form:"notebook_ids" binding:"omitempty,dive,uuid"`
 }
 
 // ChatResponse represents a chat response
@@ -132,7 +156,10 @@ type ChatResponse struct {
 	Sources     []SourceSummary        `json:"sources"`
 	SessionID   string                 `json:"session_id"`
 	MessageID   string                 `json:"message_id"`
+	ToolCalls   []ToolCallTrace        `json:"tool_calls,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// Transcript is the question as transcribed, when it was asked by voice
+	Transcript string `json:"transcript,omitempty"`
 }
 
 // ErrorResponse represents an error response
@@ -140,6 +167,8 @@ type ErrorResponse struct {
 	Error   string `json:"error"`
 	Code    string `json:"code,omitempty"`
 	Details string `json:"details,omitempty"`
+	// Fields lists the invalid fields of a VALIDATION_FAILED request
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 // HealthResponse represents the health check response
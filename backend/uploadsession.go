@@ -0,0 +1,426 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// partialUploadDir holds the files of unfinished upload sessions
+const partialUploadDir = "./data/uploads/partial"
+
+// uploadSessionSchedule is when expired upload sessions are removed
+const uploadSessionSchedule = "@hourly"
+
+// UploadSession is a file upload sent in chunks. Each chunk is appended at
+// the session's offset, so after a dropped connection the client asks for
+// the offset and carries on from there instead of starting over.
+type UploadSession struct {
+	ID          string    `json:"id"`
+	NotebookID  string    `json:"notebook_id"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// path is where the session's bytes are collected
+func (u *UploadSession) path() string {
+	return filepath.Join(partialUploadDir, u.ID+".part")
+}
+
+// uploadLocks keeps two requests from writing to one session at once
+type uploadLocks struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// acquire claims a session, reporting false if another request holds it
+func (l *uploadLocks) acquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		l.active = make(map[string]bool)
+	}
+	if l.active[id] {
+		return false
+	}
+	l.active[id] = true
+	return true
+}
+
+func (l *uploadLocks) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.active, id)
+}
+
+// Upload session operations
+
+const uploadSessionColumns = `id, notebook_id, file_name, content_type, size, received, created_at, updated_at`
+
+// CreateUploadSession records a new, empty upload session
+func (s *Store) CreateUploadSession(ctx context.Context, upload *UploadSession) error {
+	now := time.Now()
+	upload.ID = uuid.New().String()
+	upload.Offset = 0
+	upload.CreatedAt = now
+	upload.UpdatedAt = now
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO upload_sessions (`+uploadSessionColumns+`) VALUES (?, ?, ?, ?, ?, 0, ?, ?)
+	`, upload.ID, upload.NotebookID, upload.FileName, upload.ContentType, upload.Size, now.Unix(), now.Unix())
+	return err
+}
+
+// GetUploadSession retrieves an upload session by ID
+func (s *Store) GetUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	var upload UploadSession
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, `SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE id = ?`, id).Scan(
+		&upload.ID, &upload.NotebookID, &upload.FileName, &upload.ContentType, &upload.Size, &upload.Offset, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("upload session")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload.CreatedAt = time.Unix(createdAt, 0)
+	upload.UpdatedAt = time.Unix(updatedAt, 0)
+	return &upload, nil
+}
+
+// SetUploadSessionOffset records how many bytes of a session have arrived
+func (s *Store) SetUploadSessionOffset(ctx context.Context, id string, offset int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE upload_sessions SET received = ?, updated_at = ? WHERE id = ?
+	`, offset, time.Now().Unix(), id)
+	return err
+}
+
+// DeleteUploadSession removes an upload session record
+func (s *Store) DeleteUploadSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = ?`, id)
+	return err
+}
+
+// ListStaleUploadSessions returns the sessions not written to since before
+func (s *Store) ListStaleUploadSessions(ctx context.Context, before time.Time) ([]UploadSession, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE updated_at < ?
+	`, before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]UploadSession, 0)
+	for rows.Next() {
+		var upload UploadSession
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&upload.ID, &upload.NotebookID, &upload.FileName, &upload.ContentType,
+			&upload.Size, &upload.Offset, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		upload.CreatedAt = time.Unix(createdAt, 0)
+		upload.UpdatedAt = time.Unix(updatedAt, 0)
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// Upload session handlers
+
+// uploadSessionTTL is how long a session may go without a chunk
+func (s *Server) uploadSessionTTL() time.Duration {
+	return time.Duration(s.cfg.UploadSessionHours) * time.Hour
+}
+
+// uploadSessionResponse sets the offset headers and fills in the expiry
+func (s *Server) uploadSessionResponse(c *gin.Context, upload *UploadSession) {
+	upload.ExpiresAt = upload.UpdatedAt.Add(s.uploadSessionTTL())
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	c.Header("Cache-Control", "no-store")
+}
+
+// loadUploadSession looks up the session in the URL, writing 404 if it is gone
+func (s *Server) loadUploadSession(c *gin.Context) (*UploadSession, bool) {
+	upload, err := s.store.GetUploadSession(c.Request.Context(), c.Param("uploadId"))
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to load upload session")
+		return nil, false
+	}
+	return upload, true
+}
+
+func (s *Server) handleCreateUploadSession(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var req struct {
+		NotebookID  string `json:"notebook_id" binding:"required,uuid"`
+		FileName    string `json:"file_name" binding:"required,max=255"`
+		ContentType string `json:"content_type" binding:"max=255"`
+		Size        int64  `json:"size" binding:"required,min=1"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := s.checkUploadSize("size", req.Size); err != nil {
+		validationResponse(c, err)
+		return
+	}
+	if _, err := s.store.GetNotebook(ctx, req.NotebookID); err != nil {
+		storeErrorResponse(c, err, "Failed to load notebook")
+		return
+	}
+	// Refuse files that cannot fit before any of them is sent
+	if err := s.checkStorageQuota(ctx, req.NotebookID, req.Size); err != nil {
+		if !quotaResponse(c, err) {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check storage quota"})
+		}
+		return
+	}
+
+	upload := &UploadSession{
+		NotebookID:  req.NotebookID,
+		FileName:    filepath.Base(req.FileName),
+		ContentType: req.ContentType,
+		Size:        req.Size,
+	}
+	if err := s.store.CreateUploadSession(ctx, upload); err != nil {
+		storeErrorResponse(c, err, "Failed to create upload session")
+		return
+	}
+	if err := os.MkdirAll(partialUploadDir, 0755); err != nil {
+		golog.Errorf("failed to create partial uploads directory: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create upload session"})
+		return
+	}
+	if err := os.WriteFile(upload.path(), nil, 0644); err != nil {
+		golog.Errorf("failed to create partial upload file: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create upload session"})
+		return
+	}
+
+	s.uploadSessionResponse(c, upload)
+	c.Header("Location", requestBasePath(c)+"/api/upload/sessions/"+upload.ID)
+	c.JSON(http.StatusCreated, upload)
+}
+
+func (s *Server) handleGetUploadSession(c *gin.Context) {
+	upload, ok := s.loadUploadSession(c)
+	if !ok {
+		return
+	}
+	s.uploadSessionResponse(c, upload)
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, upload)
+}
+
+// handleAppendUploadChunk appends the request body to a session. The
+// Upload-Offset header must match the bytes received so far; on a mismatch
+// the response is 409 with the current offset. If the connection drops,
+// whatever arrived is kept and the offset says where to resume.
+func (s *Server) handleAppendUploadChunk(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		validationResponse(c, invalidField("Upload-Offset", "must be a byte offset"))
+		return
+	}
+
+	id := c.Param("uploadId")
+	if !s.uploadLocks.acquire(id) {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "Another chunk is being written to this upload"})
+		return
+	}
+	defer s.uploadLocks.release(id)
+
+	upload, ok := s.loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		s.uploadSessionResponse(c, upload)
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Code:  CodeConflict,
+			Error: fmt.Sprintf("Upload-Offset is %d but the upload has %d bytes", offset, upload.Offset),
+		})
+		return
+	}
+
+	remaining := upload.Size - upload.Offset
+	if c.Request.ContentLength > remaining {
+		validationResponse(c, invalidField("body", "runs past the declared size of %d bytes", upload.Size))
+		return
+	}
+
+	f, err := os.OpenFile(upload.path(), os.O_WRONLY, 0)
+	if err != nil {
+		golog.Errorf("failed to open partial upload %s: %v", upload.ID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to open upload"})
+		return
+	}
+	defer f.Close()
+	// Drop anything past the recorded offset left by an interrupted write
+	if err := f.Truncate(upload.Offset); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write upload"})
+		return
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write upload"})
+		return
+	}
+
+	// Read one byte more than fits to tell a chunk that runs past the end
+	written, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, remaining+1))
+	if written > remaining {
+		f.Truncate(upload.Size)
+		written = remaining
+		copyErr = invalidField("body", "runs past the declared size of %d bytes", upload.Size)
+	}
+
+	// Keep what arrived even if the body was cut short
+	upload.Offset += written
+	ctx := context.WithoutCancel(c.Request.Context())
+	if err := s.store.SetUploadSessionOffset(ctx, upload.ID, upload.Offset); err != nil {
+		golog.Errorf("failed to record upload offset %s: %v", upload.ID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to write upload"})
+		return
+	}
+	upload.UpdatedAt = time.Now()
+	s.uploadSessionResponse(c, upload)
+
+	if copyErr != nil {
+		if bodyTooLargeResponse(c, copyErr) || validationResponse(c, copyErr) {
+			return
+		}
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "Failed to read chunk"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleCompleteUploadSession turns a fully received upload into a source,
+// the same way a single-request upload is
+func (s *Server) handleCompleteUploadSession(c *gin.Context) {
+	ctx, cancel := operationContext(c, s.cfg.IngestTimeout)
+	defer cancel()
+
+	var req struct {
+		// OnDuplicate is "link" (default), "allow" or "reject"
+		OnDuplicate string `json:"on_duplicate" binding:"omitempty,oneof=link allow reject"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+
+	id := c.Param("uploadId")
+	if !s.uploadLocks.acquire(id) {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "A chunk is being written to this upload"})
+		return
+	}
+	defer s.uploadLocks.release(id)
+
+	upload, ok := s.loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if upload.Offset != upload.Size {
+		s.uploadSessionResponse(c, upload)
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Code:  CodeConflict,
+			Error: fmt.Sprintf("Upload has %d of %d bytes", upload.Offset, upload.Size),
+		})
+		return
+	}
+
+	// Move the file next to the other uploads under a unique name
+	if err := os.MkdirAll("./data/uploads", 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create uploads directory"})
+		return
+	}
+	ext := filepath.Ext(upload.FileName)
+	uniqueFileName := fmt.Sprintf("%s_%s%s", upload.FileName[:len(upload.FileName)-len(ext)], uuid.New().String()[:8], ext)
+	path := fmt.Sprintf("./data/uploads/%s", uniqueFileName)
+	if err := os.Rename(upload.path(), path); err != nil {
+		golog.Errorf("failed to move completed upload %s: %v", upload.ID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to save file"})
+		return
+	}
+	if err := s.store.DeleteUploadSession(context.WithoutCancel(ctx), upload.ID); err != nil {
+		golog.Errorf("failed to delete upload session %s: %v", upload.ID, err)
+	}
+
+	s.createUploadedSource(c, ctx, savedUpload{
+		NotebookID:  upload.NotebookID,
+		Name:        upload.FileName,
+		FileName:    uniqueFileName,
+		Path:        path,
+		Size:        upload.Size,
+		ContentType: upload.ContentType,
+	}, req.OnDuplicate)
+}
+
+func (s *Server) handleDeleteUploadSession(c *gin.Context) {
+	id := c.Param("uploadId")
+	if !s.uploadLocks.acquire(id) {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: "A chunk is being written to this upload"})
+		return
+	}
+	defer s.uploadLocks.release(id)
+
+	upload, ok := s.loadUploadSession(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteUploadSession(c.Request.Context(), upload.ID); err != nil {
+		storeErrorResponse(c, err, "Failed to delete upload session")
+		return
+	}
+	os.Remove(upload.path())
+	c.Status(http.StatusNoContent)
+}
+
+// cleanupUploadSessions removes expired upload sessions and their files
+func (s *Server) cleanupUploadSessions(ctx context.Context) error {
+	stale, err := s.store.ListStaleUploadSessions(ctx, time.Now().Add(-s.uploadSessionTTL()))
+	if err != nil {
+		return fmt.Errorf("failed to list expired upload sessions: %w", err)
+	}
+	for _, upload := range stale {
+		if !s.uploadLocks.acquire(upload.ID) {
+			continue
+		}
+		if err := s.store.DeleteUploadSession(ctx, upload.ID); err != nil {
+			golog.Errorf("failed to delete expired upload session %s: %v", upload.ID, err)
+		} else if err := os.Remove(upload.path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			golog.Warnf("failed to remove expired upload %s: %v", upload.path(), err)
+		}
+		s.uploadLocks.release(upload.ID)
+	}
+	if len(stale) > 0 {
+		golog.Infof("removed %d expired upload sessions", len(stale))
+	}
+	return nil
+}
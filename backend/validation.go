@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+// maxMetadataKeys bounds how many metadata keys a client may send. Other
+// field limits are binding tags on the request structs.
+const maxMetadataKeys = 50
+
+// metadataKeyPattern is what a metadata key may look like
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// reservedMetadataKeys are set by the server and cannot be sent by clients.
+// "path" in particular points at the uploaded file on disk.
+var reservedMetadataKeys = map[string]bool{
+	"path":                  true,
+	"extracted":             true,
+	"highlight_hashes":      true,
+	"clipped_at":            true,
+	"clip_selection":        true,
+	"preview_attachment_id": true,
+	"thumbnail_url":         true,
+}
+
+// uuidParams are route parameters that hold generated IDs
+var uuidParams = []string{"id", "sourceId", "noteId", "sessionId", "promptId", "hookId", "attachmentId", "userId", "jobId", "uploadId", "quarantineId", "entityId", "boardId", "columnId", "cardId", "viewId", "referenceId", "commentId", "highlightId", "notificationId", "caseId", "runId", "experimentId", "messageId", "botId", "deviceId"}
+
+// FieldError is the problem with one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// fieldErrors collects problems found by hand-written checks
+type fieldErrors []FieldError
+
+func (f *fieldErrors) add(field, format string, args ...interface{}) {
+	*f = append(*f, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the collected problems as a *ValidationError, or nil
+func (f fieldErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: f}
+}
+
+// invalidField reports a single invalid field
+func invalidField(field, format string, args ...interface{}) error {
+	var fields fieldErrors
+	fields.add(field, format, args...)
+	return fields.err()
+}
+
+// validationResponse writes a 422 for invalid input and reports whether err was one
+func validationResponse(c *gin.Context, err error) bool {
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Code: CodeValidationFailed, Error: invalid.Error(), Fields: invalid.Fields})
+	return true
+}
+
+// bindJSON decodes the request body into obj and checks its binding tags.
+// Malformed JSON is a 400; well-formed bodies that break the rules are a 422
+// listing each bad field. It reports whether the handler can go on.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	return bindResponse(c, c.ShouldBindJSON(obj))
+}
+
+// bindResponse writes the error response for a failed binding, and reports
+// whether binding succeeded
+func bindResponse(c *gin.Context, err error) bool {
+	if err == nil {
+		return true
+	}
+	if bodyTooLargeResponse(c, err) {
+		return false
+	}
+
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		fields := make(fieldErrors, 0, len(invalid))
+		for _, fe := range invalid {
+			fields = append(fields, FieldError{Field: fe.Field(), Message: fieldMessage(fe)})
+		}
+		validationResponse(c, fields.err())
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+	return false
+}
+
+// fieldMessage describes a failed binding rule in words
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		if fe.Kind() == reflect.String && fe.Param() == "1" {
+			return "must not be empty"
+		}
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at least %s characters", fe.Param())
+		}
+		return fmt.Sprintf("must have at least %s items", fe.Param())
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters", fe.Param())
+		}
+		return fmt.Sprintf("must have at most %s items", fe.Param())
+	case "uuid":
+		return "must be a UUID"
+	case "url":
+		return "must be a URL"
+	case "email":
+		return "must be an email address"
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "metadata":
+		if m, ok := fe.Value().(map[string]interface{}); ok {
+			return metadataProblem(m)
+		}
+	}
+	return "is invalid (" + fe.Tag() + ")"
+}
+
+// metadataProblem explains why client-supplied metadata is not accepted, or
+// returns "" when it is fine. Besides the stored metadata's checks (see
+// encodeMetadata), clients may only use the namespaces plugins define.
+func metadataProblem(m map[string]interface{}) string {
+	if len(m) > maxMetadataKeys {
+		return fmt.Sprintf("must have at most %d keys", maxMetadataKeys)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !metadataKeyPattern.MatchString(k) {
+			return fmt.Sprintf("key %q must be 1-64 letters, digits, '_', '-' or '.'", k)
+		}
+		if reservedMetadataKeys[k] {
+			return fmt.Sprintf("key %q is reserved", k)
+		}
+		if namespace, _, ok := strings.Cut(k, "."); ok && metadataNamespace(namespace) == nil {
+			return fmt.Sprintf("key %q is in namespace %q, which no plugin defines", k, namespace)
+		}
+		if problem := metadataValueProblem(k, m[k]); problem != "" {
+			return problem
+		}
+		if data, _ := json.Marshal(m[k]); len(data) > maxMetadataValueBytes {
+			return fmt.Sprintf("key %q must be at most %s encoded, got %s", k, formatBytes(maxMetadataValueBytes), formatBytes(int64(len(data))))
+		}
+	}
+	return ""
+}
+
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	// Report fields by their JSON names
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterValidation("metadata", func(fl validator.FieldLevel) bool {
+		m, ok := fl.Field().Interface().(map[string]interface{})
+		return !ok || metadataProblem(m) == ""
+	})
+}
+
+// ValidateIDParams rejects requests whose ID route parameters are not UUIDs,
+// before any handler looks them up
+func ValidateIDParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var fields fieldErrors
+		for _, name := range uuidParams {
+			if value := c.Param(name); value != "" && uuid.Validate(value) != nil {
+				fields.add(name, "must be a UUID")
+			}
+		}
+		if ws := c.Param("workspaceId"); ws != "" && ws != DefaultWorkspaceID && uuid.Validate(ws) != nil {
+			fields.add("workspaceId", "must be a UUID")
+		}
+
+		if err := fields.err(); err != nil {
+			validationResponse(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// uploadSizeLimit returns the largest accepted upload in bytes, 0 for unlimited
+func (s *Server) uploadSizeLimit() int64 {
+	return int64(s.cfg.MaxUploadSizeMB) << 20
+}
+
+// checkUploadSize fails when a file of size bytes is larger than uploads may be
+func (s *Server) checkUploadSize(field string, size int64) error {
+	limit := s.uploadSizeLimit()
+	if limit <= 0 || size <= limit {
+		return nil
+	}
+	return invalidField(field, "must be at most %s, got %s", formatBytes(limit), formatBytes(size))
+}
@@ -2,22 +2,59 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/kataras/golog"
 	"github.com/tmc/langchaingo/schema"
+	"golang.org/x/net/html"
+)
+
+const (
+	// highlightBoost raises the score of chunks overlapping a highlight
+	highlightBoost = 5.0
+	// highlightEdge is how much of a passage's start or end a chunk must
+	// contain to overlap it
+	highlightEdge = 60
 )
 
 // VectorStore wraps different vector store implementations
 type VectorStore struct {
 	cfg  Config
 	docs []schema.Document
-	mu   sync.RWMutex
+	// excluded holds IDs of sources left out of retrieval
+	excluded map[string]bool
+	// highlights holds each source's highlighted passages, lowercased
+	highlights map[string][]string
+	// languages holds the language of notebooks that have one, deciding how
+	// their chunks are matched to words of a query
+	languages map[string]*NotebookLanguage
+	// processors are consulted before the built-in extractors
+	processors []SourceProcessor
+	// vision describes images and PDF figures; nil when disabled
+	vision *visionDescriber
+	// embedder is nil when embeddings are disabled; vectors holds the
+	// embedding of each chunk by chunkKey
+	embedder *batchEmbedder
+	vectors  map[string]vector
+	// indexFiles are the mapped index files of loaded notebooks, and dirty
+	// the notebooks whose chunks changed since their file was written
+	indexFiles map[string]*vectorIndexFile
+	dirty      map[string]bool
+	// generations counts changes to each notebook's chunks, and generation
+	// changes to any; retrievalCache is nil when disabled
+	generations    map[string]uint64
+	generation     uint64
+	retrievalCache *Cache
+	mu             sync.RWMutex
 }
 
 // VectorStats contains statistics about the vector store
@@ -34,10 +71,38 @@ func NewVectorStore(cfg Config) (*VectorStore, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	return &VectorStore{
-		cfg:  cfg,
-		docs: make([]schema.Document, 0),
-	}, nil
+	vs := &VectorStore{
+		cfg:            cfg,
+		docs:           make([]schema.Document, 0),
+		excluded:       make(map[string]bool),
+		highlights:     make(map[string][]string),
+		languages:      make(map[string]*NotebookLanguage),
+		vectors:        make(map[string]vector),
+		indexFiles:     make(map[string]*vectorIndexFile),
+		dirty:          make(map[string]bool),
+		generations:    make(map[string]uint64),
+		retrievalCache: newRetrievalCache(cfg),
+	}
+
+	embedder, err := newBatchEmbedder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedder: %w", err)
+	}
+	vs.embedder = embedder
+
+	if vs.vision, err = newVisionDescriber(cfg); err != nil {
+		return nil, fmt.Errorf("failed to create vision model: %w", err)
+	}
+
+	if cfg.ProcessorPluginDir != "" {
+		processors, err := loadProcessorPlugins(cfg.ProcessorPluginDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load processor plugins: %w", err)
+		}
+		vs.processors = processors
+	}
+
+	return vs, nil
 }
 
 // IngestDocuments loads and indexes documents from file paths
@@ -61,10 +126,16 @@ func (vs *VectorStore) IngestDocuments(ctx context.Context, paths []string) erro
 
 // ExtractDocument reads and converts a document to text/markdown
 func (vs *VectorStore) ExtractDocument(ctx context.Context, path string) (string, error) {
+	content, _, err := vs.ExtractDocumentWithMetadata(ctx, path, "", "")
+	return content, err
+}
+
+// extractFile converts a document with the built-in extractors
+func (vs *VectorStore) extractFile(ctx context.Context, path string) (string, error) {
 	// Check if file needs markitdown conversion
 	ext := strings.ToLower(filepath.Ext(path))
 	if vs.cfg.EnableMarkitdown && vs.needsMarkitdown(ext) {
-		return vs.convertWithMarkitdown(path)
+		return vs.convertWithMarkitdown(ctx, path)
 	}
 
 	// Direct read for text files or when markitdown is disabled
@@ -77,6 +148,10 @@ func (vs *VectorStore) ExtractDocument(ctx context.Context, path string) (string
 
 // IngestText ingests raw text content
 func (vs *VectorStore) IngestText(ctx context.Context, sourceName, content string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	// Split content into chunks
 	chunks := vs.splitText(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap)
 
@@ -99,6 +174,193 @@ func (vs *VectorStore) IngestText(ctx context.Context, sourceName, content strin
 	return len(chunks), nil
 }
 
+// IngestChunks ingests content that is already split into chunks (e.g. one highlight per chunk).
+// metadata, typically the source and notebook IDs, is added to every chunk.
+func (vs *VectorStore) IngestChunks(ctx context.Context, sourceName string, chunks []string, metadata map[string]any) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Embed before taking the lock; this is the slow part. Without vectors
+	// the chunks are still found by keyword.
+	vectors, err := vs.embedChunks(ctx, chunks, metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	offset := 0
+	for _, doc := range vs.docs {
+		if docSource, ok := doc.Metadata["source"].(string); ok && docSource == sourceName {
+			offset++
+		}
+	}
+
+	for i, chunk := range chunks {
+		docMetadata := map[string]any{
+			"source": sourceName,
+			"chunk":  offset + i,
+		}
+		for k, v := range metadata {
+			docMetadata[k] = v
+		}
+		doc := schema.Document{
+			PageContent: chunk,
+			Metadata:    docMetadata,
+		}
+		vs.docs = append(vs.docs, doc)
+		if vectors != nil && vectors[i] != nil {
+			vs.vectors[chunkKey(doc)] = vectors[i]
+		}
+	}
+	vs.markDirty(docNotebookID(schema.Document{Metadata: metadata}))
+
+	golog.Infof("[VectorStore] Ingested %d pre-split chunks from source '%s' (total docs: %d)\n", len(chunks), sourceName, len(vs.docs))
+	return len(chunks), nil
+}
+
+// ReindexSource replaces a source's chunks in place after its content changed.
+// Chunks whose text is unchanged keep their embedding, so only the edited
+// regions are embedded again, and searches never see the source missing.
+func (vs *VectorStore) ReindexSource(ctx context.Context, sourceName string, chunks []string, metadata map[string]any) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	sourceID, _ := metadata["source_id"].(string)
+
+	// Look up the embeddings the source already has, by chunk text
+	previous := make(map[string]vector)
+	vs.mu.RLock()
+	for _, doc := range vs.docs {
+		if id, _ := doc.Metadata["source_id"].(string); id == sourceID {
+			if vector, ok := vs.vectors[chunkKey(doc)]; ok {
+				previous[doc.PageContent] = vector
+			}
+		}
+	}
+	vs.mu.RUnlock()
+
+	vectors := make([]vector, len(chunks))
+	var changed []string
+	var changedAt []int
+	for i, chunk := range chunks {
+		if vector, ok := previous[chunk]; ok {
+			vectors[i] = vector
+			continue
+		}
+		changed = append(changed, chunk)
+		changedAt = append(changedAt, i)
+	}
+	embedded, err := vs.embedChunks(ctx, changed, metadata)
+	if err != nil {
+		return 0, err
+	}
+	for j, i := range changedAt {
+		if embedded != nil {
+			vectors[i] = embedded[j]
+		}
+	}
+
+	newDocs := make([]schema.Document, len(chunks))
+	for i, chunk := range chunks {
+		docMetadata := map[string]any{
+			"source": sourceName,
+			"chunk":  i,
+		}
+		for k, v := range metadata {
+			docMetadata[k] = v
+		}
+		newDocs[i] = schema.Document{PageContent: chunk, Metadata: docMetadata}
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	// Swap the old chunks for the new ones where the source was
+	docs := make([]schema.Document, 0, len(vs.docs)-len(previous)+len(newDocs))
+	inserted := false
+	for _, doc := range vs.docs {
+		if id, _ := doc.Metadata["source_id"].(string); id != sourceID {
+			docs = append(docs, doc)
+			continue
+		}
+		delete(vs.vectors, chunkKey(doc))
+		if !inserted {
+			docs = append(docs, newDocs...)
+			inserted = true
+		}
+	}
+	if !inserted {
+		docs = append(docs, newDocs...)
+	}
+	vs.docs = docs
+
+	for i, doc := range newDocs {
+		if vectors[i] != nil {
+			vs.vectors[chunkKey(doc)] = vectors[i]
+		}
+	}
+	vs.markDirty(docNotebookID(schema.Document{Metadata: metadata}))
+
+	golog.Infof("[VectorStore] Reindexed source '%s': %d chunks, %d changed", sourceName, len(chunks), len(changed))
+	return len(chunks), nil
+}
+
+// embedChunks embeds the chunks of a source, or returns nil when embeddings
+// are off or the provider fails. Chunks found in the notebook's saved index
+// are not embedded again. Only cancellation is reported as an error.
+func (vs *VectorStore) embedChunks(ctx context.Context, chunks []string, metadata map[string]any) ([]vector, error) {
+	if vs.embedder == nil || len(chunks) == 0 {
+		return nil, nil
+	}
+	if _, ok := metadata["source_id"].(string); !ok {
+		return nil, nil
+	}
+	notebookID, _ := metadata["notebook_id"].(string)
+
+	vectors := make([]vector, len(chunks))
+	var missing []string
+	var missingAt []int
+	for i, chunk := range chunks {
+		if vector, ok := vs.savedVector(notebookID, chunk); ok {
+			vectors[i] = vector
+			continue
+		}
+		missing = append(missing, chunk)
+		missingAt = append(missingAt, i)
+	}
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	ctx, cancel := withTimeout(ctx, vs.cfg.IngestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	embedded, err := vs.embedder.Embed(ctx, missing)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		golog.Warnf("failed to embed %d chunks, falling back to keyword retrieval: %v", len(missing), err)
+		return nil, nil
+	}
+	for j, i := range missingAt {
+		vectors[i] = vs.quantize(embedded[j])
+	}
+	golog.Infof("embedded %d chunks in %s", len(missing), time.Since(start).Round(time.Millisecond))
+	return vectors, nil
+}
+
+// chunkKey identifies an indexed chunk by its source ID and chunk number
+func chunkKey(doc schema.Document) string {
+	sourceID, _ := doc.Metadata["source_id"].(string)
+	chunk, _ := doc.Metadata["chunk"].(int)
+	return fmt.Sprintf("%s:%d", sourceID, chunk)
+}
+
 // splitText splits text into chunks
 func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []string {
 	if chunkSize <= 0 {
@@ -162,12 +424,68 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 	return chunks
 }
 
-// SimilaritySearch performs a similarity search (simple keyword matching for now)
-func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDocs int) ([]schema.Document, error) {
+// embedQuery embeds a search query, or returns nil when there is nothing to
+// compare it with or the provider fails
+func (vs *VectorStore) embedQuery(ctx context.Context, query string) []float32 {
+	if vs.embedder == nil {
+		return nil
+	}
+	vs.mu.RLock()
+	empty := len(vs.vectors) == 0
+	vs.mu.RUnlock()
+	if empty {
+		return nil
+	}
+
+	vectors, err := vs.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		golog.Warnf("failed to embed query, using keyword retrieval: %v", err)
+		return nil
+	}
+	return vectors[0]
+}
+
+// Retrievers pick how search scores chunks: RetrieverHybrid by keyword and,
+// when embedded, by meaning, RetrieverKeyword by keyword alone and
+// RetrieverSemantic by meaning alone
+const (
+	RetrieverHybrid   = "hybrid"
+	RetrieverKeyword  = "keyword"
+	RetrieverSemantic = "semantic"
+)
+
+// search scores every chunk against the query with the given retriever.
+// When notebookIDs is non-empty, only documents from those notebooks are considered.
+func (vs *VectorStore) search(ctx context.Context, query string, numDocs int, notebookIDs []string, retriever string) ([]schema.Document, error) {
 	if numDocs <= 0 {
 		numDocs = 5
 	}
 
+	var scope map[string]bool
+	if len(notebookIDs) > 0 {
+		scope = make(map[string]bool, len(notebookIDs))
+		for _, id := range notebookIDs {
+			scope[id] = true
+		}
+	}
+	searchable := func(doc schema.Document) bool {
+		if vs.isExcluded(doc) {
+			return false
+		}
+		if scope == nil {
+			return true
+		}
+		notebookID, _ := doc.Metadata["notebook_id"].(string)
+		return scope[notebookID]
+	}
+
+	var queryVector []float32
+	if retriever != RetrieverKeyword {
+		queryVector = vs.embedQuery(ctx, query)
+	}
+	// Without embeddings, semantic retrieval falls back to keywords
+	semanticOnly := retriever == RetrieverSemantic && queryVector != nil
+
 	vs.mu.RLock()
 	defer vs.mu.RUnlock()
 
@@ -189,10 +507,37 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDo
 	}
 
 	scores := make([]docScore, 0, len(vs.docs))
-	for _, doc := range vs.docs {
+	queryTerms := make(map[*NotebookLanguage][]string)
+	for i, doc := range vs.docs {
+		// Give up on large scans once the caller has gone away
+		if i%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if !searchable(doc) {
+			continue
+		}
+
 		content := strings.ToLower(doc.PageContent)
 		score := 0.0
 
+		// 0. Semantic similarity, when both the query and the chunk are embedded
+		if queryVector != nil {
+			if vector, ok := vs.vectors[chunkKey(doc)]; ok {
+				score += vector.similarity(queryVector) * 10.0
+			}
+		}
+		if semanticOnly {
+			if score > 0 && vs.isHighlighted(doc, content) {
+				score += highlightBoost
+			}
+			if score > 0 {
+				scores = append(scores, docScore{doc: doc, score: score})
+			}
+			continue
+		}
+
 		// 1. Check if query appears as substring in content (good for Chinese)
 		if strings.Contains(content, queryLower) {
 			score += 10.0
@@ -211,15 +556,40 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDo
 			score += charMatchRatio * 5.0
 		}
 
-		// 3. Word-based matching for English/Space-separated languages
-		queryWords := strings.Fields(queryLower)
-		for _, word := range queryWords {
-			if len(word) > 2 && strings.Contains(content, word) {
-				score += 2.0
+		// 3. Word-based matching for English/Space-separated languages, or
+		// by the terms of the notebook's language when it has one
+		if lang := vs.languages[docNotebookID(doc)]; lang != nil {
+			terms, ok := queryTerms[lang]
+			if !ok {
+				terms = lang.searchTerms(queryLower)
+				queryTerms[lang] = terms
+			}
+			if len(terms) > 0 {
+				contentTerms := make(map[string]bool)
+				for _, t := range lang.searchTerms(content) {
+					contentTerms[t] = true
+				}
+				for _, t := range terms {
+					if contentTerms[t] {
+						score += 2.0
+					}
+				}
+			}
+		} else {
+			queryWords := strings.Fields(queryLower)
+			for _, word := range queryWords {
+				if len(word) > 2 && strings.Contains(content, word) {
+					score += 2.0
+				}
 			}
 		}
 
-		// 4. Check for common question keywords in Chinese
+		// 4. Passages the user highlighted outrank equally relevant ones
+		if score > 0 && vs.isHighlighted(doc, content) {
+			score += highlightBoost
+		}
+
+		// 5. Check for common question keywords in Chinese
 		questionKeywords := []string{"介绍", "什么", "啥", "内容", "文档", "说"}
 		for _, keyword := range questionKeywords {
 			if strings.Contains(queryLower, keyword) {
@@ -237,21 +607,19 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDo
 	fmt.Printf("[VectorStore] Found %d matching documents\n", len(scores))
 
 	// Sort by score descending
-	for i := 0; i < len(scores); i++ {
-		for j := i + 1; j < len(scores); j++ {
-			if scores[j].score > scores[i].score {
-				scores[i], scores[j] = scores[j], scores[i]
-			}
-		}
-	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
 
 	// If no matches found, return all documents (fallback)
 	// This allows the LLM to use the full context
 	if len(scores) == 0 {
 		fmt.Println("[VectorStore] No matches found, returning all documents as fallback")
 		result := make([]schema.Document, 0, min(numDocs, len(vs.docs)))
-		for i := 0; i < len(result); i++ {
-			result = append(result, vs.docs[i])
+		for i := 0; i < len(vs.docs) && len(result) < numDocs; i++ {
+			if searchable(vs.docs[i]) {
+				result = append(result, vs.docs[i])
+			}
 		}
 		return result, nil
 	}
@@ -269,6 +637,62 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, query string, numDo
 	return result, nil
 }
 
+// widenPassages joins each retrieved chunk with up to n chunks of the same
+// source on either side, as if the source had been split into larger chunks
+func (vs *VectorStore) widenPassages(docs []schema.Document, n int) []schema.Document {
+	if n <= 0 || len(docs) == 0 {
+		return docs
+	}
+	sources := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		if sourceID, _ := doc.Metadata["source_id"].(string); sourceID != "" {
+			sources[sourceID] = true
+		}
+	}
+
+	vs.mu.RLock()
+	chunks := make(map[string]string)
+	for _, doc := range vs.docs {
+		if sourceID, _ := doc.Metadata["source_id"].(string); sources[sourceID] {
+			chunks[chunkKey(doc)] = doc.PageContent
+		}
+	}
+	vs.mu.RUnlock()
+
+	widened := make([]schema.Document, len(docs))
+	for i, doc := range docs {
+		sourceID, _ := doc.Metadata["source_id"].(string)
+		chunk, _ := doc.Metadata["chunk"].(int)
+		content := doc.PageContent
+		for d := 1; sourceID != "" && d <= n; d++ {
+			if before, ok := chunks[fmt.Sprintf("%s:%d", sourceID, chunk-d)]; ok {
+				content = joinChunks(before, content, vs.cfg.ChunkOverlap)
+			}
+			if after, ok := chunks[fmt.Sprintf("%s:%d", sourceID, chunk+d)]; ok {
+				content = joinChunks(content, after, vs.cfg.ChunkOverlap)
+			}
+		}
+		widened[i] = schema.Document{PageContent: content, Metadata: doc.Metadata, Score: doc.Score}
+	}
+	return widened
+}
+
+// joinChunks joins consecutive chunks, dropping the overlap words (runes for
+// CJK text) that splitText repeats at the start of b
+func joinChunks(a, b string, overlap int) string {
+	if overlap > 0 {
+		aWords, bWords := strings.Fields(a), strings.Fields(b)
+		if len(aWords) >= overlap && len(bWords) > overlap && slices.Equal(aWords[len(aWords)-overlap:], bWords[:overlap]) {
+			return a + " " + strings.Join(bWords[overlap:], " ")
+		}
+		aRunes, bRunes := []rune(a), []rune(b)
+		if len(aRunes) >= overlap && len(bRunes) > overlap && string(aRunes[len(aRunes)-overlap:]) == string(bRunes[:overlap]) {
+			return a + string(bRunes[overlap:])
+		}
+	}
+	return a + "\n" + b
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -285,6 +709,9 @@ func (vs *VectorStore) Delete(ctx context.Context, source string) error {
 	for _, doc := range vs.docs {
 		if docSource, ok := doc.Metadata["source"].(string); !ok || docSource != source {
 			filtered = append(filtered, doc)
+		} else {
+			delete(vs.vectors, chunkKey(doc))
+			vs.markDirty(docNotebookID(doc))
 		}
 	}
 	vs.docs = filtered
@@ -292,6 +719,144 @@ func (vs *VectorStore) Delete(ctx context.Context, source string) error {
 	return nil
 }
 
+// DeleteSource removes the documents ingested for a source ID
+func (vs *VectorStore) DeleteSource(ctx context.Context, sourceID string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	filtered := make([]schema.Document, 0, len(vs.docs))
+	for _, doc := range vs.docs {
+		if docSourceID, ok := doc.Metadata["source_id"].(string); !ok || docSourceID != sourceID {
+			filtered = append(filtered, doc)
+		} else {
+			delete(vs.vectors, chunkKey(doc))
+			vs.markDirty(docNotebookID(doc))
+		}
+	}
+	vs.docs = filtered
+	delete(vs.highlights, sourceID)
+
+	return nil
+}
+
+// SetSourceExcluded includes or excludes a source's documents from search results
+// without removing them, so toggling takes effect immediately
+func (vs *VectorStore) SetSourceExcluded(sourceID string, excluded bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if excluded {
+		vs.excluded[sourceID] = true
+	} else {
+		delete(vs.excluded, sourceID)
+	}
+
+	for _, doc := range vs.docs {
+		if id, _ := doc.Metadata["source_id"].(string); id == sourceID {
+			vs.bumpGeneration(docNotebookID(doc))
+			break
+		}
+	}
+}
+
+// SetSourceHighlights replaces the passages of a source that boost the
+// chunks containing them in search results
+func (vs *VectorStore) SetSourceHighlights(sourceID string, passages []string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if len(passages) == 0 && len(vs.highlights[sourceID]) == 0 {
+		return
+	}
+	lower := make([]string, len(passages))
+	for i, p := range passages {
+		lower[i] = strings.ToLower(p)
+	}
+	if len(lower) > 0 {
+		vs.highlights[sourceID] = lower
+	} else {
+		delete(vs.highlights, sourceID)
+	}
+
+	for _, doc := range vs.docs {
+		if id, _ := doc.Metadata["source_id"].(string); id == sourceID {
+			vs.bumpGeneration(docNotebookID(doc))
+			break
+		}
+	}
+}
+
+// SetNotebookLanguage sets the language whose terms a notebook's chunks are
+// matched on; "" goes back to plain word matching
+func (vs *VectorStore) SetNotebookLanguage(notebookID, tag string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	lang, _ := lookupLanguage(tag)
+	if vs.languages[notebookID] == lang {
+		return
+	}
+	if lang != nil {
+		vs.languages[notebookID] = lang
+	} else {
+		delete(vs.languages, notebookID)
+	}
+	vs.bumpGeneration(notebookID)
+}
+
+// isHighlighted reports whether a chunk overlaps a highlighted passage of its
+// source, given the chunk's lowercased content; callers hold vs.mu. Passages
+// longer than a chunk or split between two count by their ends.
+func (vs *VectorStore) isHighlighted(doc schema.Document, content string) bool {
+	sourceID, _ := doc.Metadata["source_id"].(string)
+	for _, p := range vs.highlights[sourceID] {
+		if strings.Contains(content, p) || strings.Contains(p, content) {
+			return true
+		}
+		if len(p) > highlightEdge && (strings.Contains(content, p[:highlightEdge]) || strings.Contains(content, p[len(p)-highlightEdge:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded reports whether a document belongs to an excluded source; callers hold vs.mu
+func (vs *VectorStore) isExcluded(doc schema.Document) bool {
+	sourceID, ok := doc.Metadata["source_id"].(string)
+	return ok && vs.excluded[sourceID]
+}
+
+// sourceVectors returns the sum of the chunk embeddings of each of a
+// notebook's embedded sources, which points the same way as their mean
+func (vs *VectorStore) sourceVectors(notebookID string) map[string][]float32 {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	sums := make(map[string][]float32)
+	for _, doc := range vs.docs {
+		if docNotebookID(doc) != notebookID {
+			continue
+		}
+		v, ok := vs.vectors[chunkKey(doc)]
+		if !ok {
+			continue
+		}
+		sourceID, _ := doc.Metadata["source_id"].(string)
+		sum := sums[sourceID]
+		if sum == nil {
+			sum = make([]float32, v.dim())
+			sums[sourceID] = sum
+		}
+		if len(sum) != v.dim() {
+			continue
+		}
+		for i, f := range v.floats() {
+			sum[i] += f
+		}
+	}
+	return sums
+}
+
 // GetStats returns statistics about the vector store
 func (vs *VectorStore) GetStats(ctx context.Context) (VectorStats, error) {
 	vs.mu.RLock()
@@ -299,12 +864,17 @@ func (vs *VectorStore) GetStats(ctx context.Context) (VectorStats, error) {
 
 	stats := VectorStats{
 		TotalDocuments: len(vs.docs),
+		TotalVectors:   len(vs.vectors),
 		Dimension:      1536, // Default for OpenAI embeddings
 	}
 
 	if vs.cfg.IsOllama() {
 		stats.Dimension = 768 // Common for Ollama models
 	}
+	for _, vector := range vs.vectors {
+		stats.Dimension = vector.dim()
+		break
+	}
 
 	return stats, nil
 }
@@ -323,8 +893,14 @@ func (vs *VectorStore) needsMarkitdown(ext string) bool {
 	return markitdownExts[ext]
 }
 
-// ExtractFromURL fetches and converts content from a URL using markitdown
+// ExtractFromURL fetches and converts content from a URL
 func (vs *VectorStore) ExtractFromURL(ctx context.Context, url string) (string, error) {
+	content, _, err := vs.ExtractFromURLWithMetadata(ctx, url)
+	return content, err
+}
+
+// extractURL fetches and converts content from a URL using markitdown
+func (vs *VectorStore) extractURL(ctx context.Context, url string) (string, error) {
 	fmt.Printf("[VectorStore] Fetching content from URL: %s\n", url)
 
 	if !vs.cfg.EnableMarkitdown {
@@ -335,7 +911,7 @@ func (vs *VectorStore) ExtractFromURL(ctx context.Context, url string) (string,
 	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("markitdown_url_%d.md", os.Getpid()))
 
 	// Run markitdown command with URL
-	cmd := exec.Command("markitdown", url, "-o", tmpFile)
+	cmd := exec.CommandContext(ctx, "markitdown", url, "-o", tmpFile)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Printf("[VectorStore] markitdown error: %s\n", string(output))
@@ -355,15 +931,85 @@ func (vs *VectorStore) ExtractFromURL(ctx context.Context, url string) (string,
 	return string(content), nil
 }
 
+// htmlToText extracts readable text from an HTML fragment, dropping scripts,
+// styles and other non-content elements and keeping block-level line breaks
+func htmlToText(input string) string {
+	skip := map[string]bool{
+		"script": true, "style": true, "noscript": true, "head": true,
+		"nav": true, "footer": true, "iframe": true, "svg": true, "form": true,
+	}
+	block := map[string]bool{
+		"p": true, "div": true, "br": true, "li": true, "tr": true, "section": true,
+		"article": true, "blockquote": true, "pre": true, "table": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+
+	var sb strings.Builder
+	depth := 0
+	z := html.NewTokenizer(strings.NewReader(input))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return collapseBlankLines(sb.String())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tt := z.Token()
+			tag := tt.Data
+			if skip[tag] && tt.Type == html.StartTagToken {
+				depth++
+			}
+			if block[tag] {
+				sb.WriteString("\n")
+			}
+			if tag == "li" {
+				sb.WriteString("- ")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if skip[tag] && depth > 0 {
+				depth--
+			}
+			if block[tag] {
+				sb.WriteString("\n")
+			}
+		case html.TextToken:
+			if depth == 0 {
+				sb.WriteString(strings.Join(strings.Fields(string(z.Text())), " "))
+				sb.WriteString(" ")
+			}
+		}
+	}
+}
+
+// collapseBlankLines trims each line and collapses runs of blank lines
+func collapseBlankLines(text string) string {
+	lines := strings.Split(text, "\n")
+	out := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank && len(out) > 0 {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
 // convertWithMarkitdown converts a document to Markdown using the markitdown CLI tool
-func (vs *VectorStore) convertWithMarkitdown(filePath string) (string, error) {
+func (vs *VectorStore) convertWithMarkitdown(ctx context.Context, filePath string) (string, error) {
 	fmt.Printf("[VectorStore] Converting with markitdown: %s\n", filePath)
 
 	// Create temporary output file
 	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("markitdown_%s.md", filepath.Base(filePath)))
 
 	// Run markitdown command
-	cmd := exec.Command("markitdown", filePath, "-o", tmpFile)
+	cmd := exec.CommandContext(ctx, "markitdown", filePath, "-o", tmpFile)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Printf("[VectorStore] markitdown error: %s\n", string(output))
@@ -0,0 +1,583 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unsafe"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Vector index files keep a notebook's chunk embeddings on disk, so loading a
+// notebook reuses them instead of embedding every chunk again. A file is a
+// 16-byte header, the vectors in the notebook's encoding, then one 8-byte
+// text hash per vector:
+//
+//	magic "NTXVEC" | version | encoding | dimension uint32 | count uint32
+//	float32: count × dimension float32
+//	int8:    count × float32 scale, count × dimension int8
+//	pq:      subvector dimensions uint32 | centroids uint32 | codebook float32s
+//	         count × subvectors byte
+//	count × uint64
+//
+// All numbers are little-endian. The float32 sections start at multiples of
+// four bytes, so they stay aligned when the file is memory-mapped.
+const (
+	vectorIndexMagic      = "NTXVEC"
+	vectorIndexVersion    = 1
+	vectorIndexHeaderSize = 16
+)
+
+// Vector encodings in an index file
+const (
+	vectorEncodingFloat32 = 0
+	vectorEncodingInt8    = 1
+	vectorEncodingPQ      = 2
+)
+
+// vectorIndexSchedule is how often indexes are saved and idle notebooks unloaded
+const vectorIndexSchedule = "@every 1m"
+
+// littleEndian reports whether this machine stores numbers little-endian,
+// which lets mapped vectors be used in place
+var littleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// vectorIndexFile is an opened index file. Its vectors may point into the
+// mapped file, so they must not be used after close.
+type vectorIndexFile struct {
+	vectors map[uint64]vector
+	unmap   func() error
+}
+
+func (f *vectorIndexFile) close() error {
+	if f.unmap == nil {
+		return nil
+	}
+	return f.unmap()
+}
+
+// chunkHash identifies a chunk's text in an index file
+func chunkHash(text string) uint64 {
+	sum := sha256.Sum256([]byte(text))
+	return binary.LittleEndian.Uint64(sum[:8])
+}
+
+// vectorIndexPath is where a notebook's index file lives
+func vectorIndexPath(dir, notebookID string) string {
+	return filepath.Join(dir, notebookID+".vec")
+}
+
+// openVectorIndex maps an index file, or returns nil when there is none
+func openVectorIndex(path string) (*vectorIndexFile, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < vectorIndexHeaderSize {
+		return nil, fmt.Errorf("%s: too short for a vector index", path)
+	}
+
+	data, unmap, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseVectorIndex(data)
+	if err != nil {
+		unmap()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	index.unmap = unmap
+	return index, nil
+}
+
+// errTruncatedIndex reports an index file shorter than its header promises
+var errTruncatedIndex = errors.New("vector index is truncated")
+
+// indexReader hands out consecutive sections of an index file
+type indexReader struct {
+	data []byte
+	err  error
+}
+
+func (r *indexReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errTruncatedIndex
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *indexReader) uint32() int {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(b))
+}
+
+// parseVectorIndex reads the vectors of an index file held in data
+func parseVectorIndex(data []byte) (*vectorIndexFile, error) {
+	if string(data[:6]) != vectorIndexMagic {
+		return nil, fmt.Errorf("not a vector index")
+	}
+	if data[6] != vectorIndexVersion {
+		return nil, fmt.Errorf("unsupported vector index version %d", data[6])
+	}
+	encoding := data[7]
+	dim := int(binary.LittleEndian.Uint32(data[8:12]))
+	count := int(binary.LittleEndian.Uint32(data[12:16]))
+	r := &indexReader{data: data[vectorIndexHeaderSize:]}
+
+	vectors := make([]vector, count)
+	switch encoding {
+	case vectorEncodingFloat32:
+		for i := range vectors {
+			vectors[i] = float32Vector(mappedFloats(r.next(dim*4), dim))
+		}
+	case vectorEncodingInt8:
+		scales := r.next(count * 4)
+		for i := range vectors {
+			values := r.next(dim)
+			if values == nil {
+				break
+			}
+			vectors[i] = int8Vector{
+				values: mappedInt8s(values),
+				scale:  math.Float32frombits(binary.LittleEndian.Uint32(scales[i*4:])),
+			}
+		}
+	case vectorEncodingPQ:
+		book := &pqCodebook{dims: dim, subDims: r.uint32()}
+		k := r.uint32()
+		if r.err == nil && (book.subDims <= 0 || k <= 0 || k > pqCentroids) {
+			return nil, fmt.Errorf("invalid product quantization codebook")
+		}
+		for s := 0; r.err == nil && s < book.subvectors(); s++ {
+			start, end := book.bounds(s)
+			n := k * (end - start)
+			book.centroids = append(book.centroids, mappedFloats(r.next(n*4), n))
+		}
+		for i := range vectors {
+			if r.err != nil {
+				break
+			}
+			codes := r.next(book.subvectors())
+			for _, code := range codes {
+				if int(code) >= k {
+					return nil, fmt.Errorf("invalid product quantization code %d", code)
+				}
+			}
+			vectors[i] = pqVector{codes: codes, book: book}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported vector encoding %d", encoding)
+	}
+
+	hashes := r.next(count * 8)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("vector index has trailing data")
+	}
+
+	index := &vectorIndexFile{vectors: make(map[uint64]vector, count)}
+	for i, v := range vectors {
+		index.vectors[binary.LittleEndian.Uint64(hashes[i*8:])] = v
+	}
+	return index, nil
+}
+
+// mappedFloats returns the n float32s in b, sharing b's memory when the
+// machine's byte order allows it
+func mappedFloats(b []byte, n int) []float32 {
+	if n == 0 || b == nil {
+		return []float32{}
+	}
+	if littleEndian {
+		return unsafe.Slice((*float32)(unsafe.Pointer(&b[0])), n)
+	}
+	v := make([]float32, n)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return v
+}
+
+// mappedInt8s returns b as int8s, sharing its memory
+func mappedInt8s(b []byte) []int8 {
+	if len(b) == 0 {
+		return []int8{}
+	}
+	return unsafe.Slice((*int8)(unsafe.Pointer(&b[0])), len(b))
+}
+
+// writeVectorIndex saves vectors by chunk hash in the given quantization,
+// replacing the file atomically so a mapped copy of the old file stays valid
+func writeVectorIndex(path string, vectors map[uint64][]float32, quantization string, pqSubDims int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	hashes := make([]uint64, 0, len(vectors))
+	dim := 0
+	for h, v := range vectors {
+		hashes = append(hashes, h)
+		dim = len(v)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".vec-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := encodeVectorIndex(w, hashes, vectors, dim, quantization, pqSubDims); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// encodeVectorIndex writes an index file; vectors that are not dim long are
+// left out
+func encodeVectorIndex(w io.Writer, hashes []uint64, vectors map[uint64][]float32, dim int, quantization string, pqSubDims int) error {
+	var kept []uint64
+	var keptVectors [][]float32
+	for _, h := range hashes {
+		if len(vectors[h]) == dim {
+			kept = append(kept, h)
+			keptVectors = append(keptVectors, vectors[h])
+		}
+	}
+
+	var encoding byte
+	switch quantization {
+	case quantizationInt8:
+		encoding = vectorEncodingInt8
+	case quantizationPQ:
+		encoding = vectorEncodingPQ
+	default:
+		encoding = vectorEncodingFloat32
+	}
+	if len(kept) == 0 {
+		encoding = vectorEncodingFloat32
+	}
+
+	header := make([]byte, vectorIndexHeaderSize)
+	copy(header, vectorIndexMagic)
+	header[6] = vectorIndexVersion
+	header[7] = encoding
+	binary.LittleEndian.PutUint32(header[8:], uint32(dim))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(kept)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	putUint32 := func(n uint32) error {
+		binary.LittleEndian.PutUint32(buf, n)
+		_, err := w.Write(buf[:4])
+		return err
+	}
+	putFloats := func(fs []float32) error {
+		for _, f := range fs {
+			if err := putUint32(math.Float32bits(f)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch encoding {
+	case vectorEncodingFloat32:
+		for _, v := range keptVectors {
+			if err := putFloats(v); err != nil {
+				return err
+			}
+		}
+	case vectorEncodingInt8:
+		quantized := make([]int8Vector, len(keptVectors))
+		for i, v := range keptVectors {
+			quantized[i] = quantizeInt8(v)
+			if err := putUint32(math.Float32bits(quantized[i].scale)); err != nil {
+				return err
+			}
+		}
+		for _, q := range quantized {
+			values := make([]byte, len(q.values))
+			for i, v := range q.values {
+				values[i] = byte(v)
+			}
+			if _, err := w.Write(values); err != nil {
+				return err
+			}
+		}
+	case vectorEncodingPQ:
+		book := trainPQ(keptVectors, dim, pqSubDims)
+		if err := putUint32(uint32(book.subDims)); err != nil {
+			return err
+		}
+		if err := putUint32(uint32(book.size())); err != nil {
+			return err
+		}
+		for _, centroids := range book.centroids {
+			if err := putFloats(centroids); err != nil {
+				return err
+			}
+		}
+		for _, v := range keptVectors {
+			if _, err := w.Write(book.encode(v)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, h := range kept {
+		binary.LittleEndian.PutUint64(buf, h)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index persistence on the vector store
+
+// OpenNotebookIndex maps a notebook's saved index so loading its chunks can
+// reuse their embeddings
+func (vs *VectorStore) OpenNotebookIndex(notebookID string) {
+	if vs.cfg.VectorIndexDir == "" {
+		return
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if _, ok := vs.indexFiles[notebookID]; ok {
+		return
+	}
+	index, err := openVectorIndex(vectorIndexPath(vs.cfg.VectorIndexDir, notebookID))
+	if err != nil {
+		golog.Warnf("ignoring vector index of notebook %s: %v", notebookID, err)
+		return
+	}
+	if index != nil {
+		vs.indexFiles[notebookID] = index
+	}
+}
+
+// savedVector returns the saved embedding of a chunk, if its notebook's index has one
+func (vs *VectorStore) savedVector(notebookID, text string) (vector, bool) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	index, ok := vs.indexFiles[notebookID]
+	if !ok {
+		return nil, false
+	}
+	v, ok := index.vectors[chunkHash(text)]
+	return v, ok
+}
+
+// markDirty records that a notebook's chunks changed and its index needs
+// saving; callers hold vs.mu
+func (vs *VectorStore) markDirty(notebookID string) {
+	vs.bumpGeneration(notebookID)
+	if notebookID != "" && vs.cfg.VectorIndexDir != "" {
+		vs.dirty[notebookID] = true
+	}
+}
+
+// SaveNotebookIndex writes a notebook's chunk embeddings to its index file.
+// A notebook without embeddings has its file removed.
+func (vs *VectorStore) SaveNotebookIndex(notebookID string) error {
+	if vs.cfg.VectorIndexDir == "" {
+		return nil
+	}
+
+	vs.mu.Lock()
+	delete(vs.dirty, notebookID)
+	vectors := make(map[uint64][]float32)
+	for _, doc := range vs.docs {
+		if docNotebookID(doc) != notebookID {
+			continue
+		}
+		if v, ok := vs.vectors[chunkKey(doc)]; ok {
+			// A copy, so the file can be written after the lock is released
+			vectors[chunkHash(doc.PageContent)] = v.floats()
+		}
+	}
+	vs.mu.Unlock()
+
+	path := vectorIndexPath(vs.cfg.VectorIndexDir, notebookID)
+	if len(vectors) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return writeVectorIndex(path, vectors, vs.cfg.VectorQuantization, vs.cfg.PQSubvectorDims)
+}
+
+// SaveIndexes writes the index of every notebook changed since its last save
+func (vs *VectorStore) SaveIndexes(ctx context.Context) {
+	vs.mu.RLock()
+	notebookIDs := make([]string, 0, len(vs.dirty))
+	for id := range vs.dirty {
+		notebookIDs = append(notebookIDs, id)
+	}
+	vs.mu.RUnlock()
+
+	for _, id := range notebookIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := vs.SaveNotebookIndex(id); err != nil {
+			golog.Errorf("failed to save vector index of notebook %s: %v", id, err)
+		}
+	}
+}
+
+// UnloadNotebook drops a notebook's chunks from memory and unmaps its index
+// file. Unsaved changes are saved first unless the notebook is being deleted,
+// in which case the file is removed.
+func (vs *VectorStore) UnloadNotebook(notebookID string, deleted bool) {
+	if !deleted {
+		vs.mu.RLock()
+		dirty := vs.dirty[notebookID]
+		vs.mu.RUnlock()
+		if dirty {
+			if err := vs.SaveNotebookIndex(notebookID); err != nil {
+				golog.Errorf("failed to save vector index of notebook %s: %v", notebookID, err)
+			}
+		}
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	docs := make([]schema.Document, 0, len(vs.docs))
+	for _, doc := range vs.docs {
+		if docNotebookID(doc) == notebookID {
+			delete(vs.vectors, chunkKey(doc))
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	vs.docs = docs
+	delete(vs.dirty, notebookID)
+	vs.bumpGeneration(notebookID)
+
+	// Nothing refers to the mapped vectors any more
+	if index, ok := vs.indexFiles[notebookID]; ok {
+		delete(vs.indexFiles, notebookID)
+		if err := index.close(); err != nil {
+			golog.Warnf("failed to unmap vector index of notebook %s: %v", notebookID, err)
+		}
+	}
+
+	if deleted && vs.cfg.VectorIndexDir != "" {
+		os.Remove(vectorIndexPath(vs.cfg.VectorIndexDir, notebookID))
+	}
+}
+
+// HasSource reports whether a source's chunks are in the index
+func (vs *VectorStore) HasSource(sourceID string) bool {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	for _, doc := range vs.docs {
+		if id, _ := doc.Metadata["source_id"].(string); id == sourceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Notebook activation on the server
+
+// touchNotebook records that a loaded notebook was just used; callers hold s.vectorMutex
+func (s *Server) touchNotebook(notebookID string) {
+	s.notebookLastUsed[notebookID] = time.Now()
+}
+
+// unloadNotebook frees a loaded notebook's index; callers hold s.vectorMutex
+func (s *Server) unloadNotebook(notebookID string, deleted bool) {
+	s.vectorStore.UnloadNotebook(notebookID, deleted)
+	delete(s.loadedNotebooks, notebookID)
+	delete(s.notebookLastUsed, notebookID)
+}
+
+// evictNotebooks unloads the least recently used notebooks beyond
+// MaxActiveNotebooks, keeping keep loaded; callers hold s.vectorMutex
+func (s *Server) evictNotebooks(keep string) {
+	limit := s.cfg.MaxActiveNotebooks
+	if limit <= 0 || len(s.loadedNotebooks) <= limit {
+		return
+	}
+
+	ids := make([]string, 0, len(s.loadedNotebooks))
+	for id := range s.loadedNotebooks {
+		if id != keep {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.notebookLastUsed[ids[i]].Before(s.notebookLastUsed[ids[j]])
+	})
+
+	for _, id := range ids[:len(s.loadedNotebooks)-limit] {
+		golog.Infof("unloading least recently used notebook %s from the vector store", id)
+		s.unloadNotebook(id, false)
+	}
+}
+
+// unloadIdleNotebooks unloads notebooks not used for NotebookIdleMinutes
+func (s *Server) unloadIdleNotebooks() {
+	if s.cfg.NotebookIdleMinutes <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(s.cfg.NotebookIdleMinutes) * time.Minute)
+
+	s.vectorMutex.Lock()
+	defer s.vectorMutex.Unlock()
+
+	for id := range s.loadedNotebooks {
+		if s.notebookLastUsed[id].Before(cutoff) {
+			golog.Infof("unloading idle notebook %s from the vector store", id)
+			s.unloadNotebook(id, false)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package backend
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SourceParagraph is an addressable block of a source's extracted text.
+// Offsets are in characters (Unicode code points) into the source content.
+type SourceParagraph struct {
+	Anchor string `json:"anchor"`
+	Index  int    `json:"index"`
+	Page   int    `json:"page,omitempty"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Text   string `json:"text"`
+}
+
+// SourceView is a source's extracted text split into anchored paragraphs
+type SourceView struct {
+	SourceID   string            `json:"source_id"`
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	URL        string            `json:"url,omitempty"`
+	Content    string            `json:"content"`
+	Pages      int               `json:"pages,omitempty"`
+	ChunkCount int               `json:"chunk_count"`
+	Paragraphs []SourceParagraph `json:"paragraphs"`
+}
+
+// SourcePassage is the location of a chunk within a source's content
+type SourcePassage struct {
+	SourceID string   `json:"source_id"`
+	ChunkID  int      `json:"chunk_id"`
+	Text     string   `json:"text"`
+	Found    bool     `json:"found"`
+	Start    int      `json:"start"`
+	End      int      `json:"end"`
+	Page     int      `json:"page,omitempty"`
+	Anchor   string   `json:"anchor,omitempty"`
+	Anchors  []string `json:"anchors,omitempty"` // every paragraph the passage spans
+}
+
+// Viewer handlers
+
+func (s *Server) handleGetSourceContent(c *gin.Context) {
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	paragraphs := splitParagraphs(source.Content)
+	pages := 0
+	if len(paragraphs) > 0 {
+		pages = paragraphs[len(paragraphs)-1].Page
+	}
+
+	c.JSON(http.StatusOK, SourceView{
+		SourceID:   source.ID,
+		Name:       source.Name,
+		Type:       source.Type,
+		URL:        source.URL,
+		Content:    source.Content,
+		Pages:      pages,
+		ChunkCount: source.ChunkCount,
+		Paragraphs: paragraphs,
+	})
+}
+
+func (s *Server) handleGetSourceChunk(c *gin.Context) {
+	source, ok := s.notebookSource(c)
+	if !ok {
+		return
+	}
+
+	chunkID, err := strconv.Atoi(c.Param("chunkId"))
+	if err != nil || chunkID < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "invalid chunk id"})
+		return
+	}
+
+	chunks := s.sourceChunks(source)
+	if chunkID >= len(chunks) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Chunk not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resolvePassage(source, chunkID, chunks[chunkID]))
+}
+
+// resolvePassage locates a chunk in the source content and the paragraphs it covers
+func resolvePassage(source *Source, chunkID int, chunk string) SourcePassage {
+	passage := SourcePassage{
+		SourceID: source.ID,
+		ChunkID:  chunkID,
+		Text:     chunk,
+	}
+
+	start, end, ok := locateChunk(source.Content, chunk)
+	if !ok {
+		return passage
+	}
+
+	passage.Found = true
+	passage.Text = source.Content[start:end]
+	passage.Start = utf8.RuneCountInString(source.Content[:start])
+	passage.End = passage.Start + utf8.RuneCountInString(passage.Text)
+
+	for _, p := range splitParagraphs(source.Content) {
+		if p.End <= passage.Start || p.Start >= passage.End {
+			continue
+		}
+		if passage.Anchor == "" {
+			passage.Anchor = p.Anchor
+			passage.Page = p.Page
+		}
+		passage.Anchors = append(passage.Anchors, p.Anchor)
+	}
+
+	return passage
+}
+
+// locateChunk finds the byte range of chunk in content. Chunks are either exact
+// substrings or, for word-split text, the same words with whitespace collapsed.
+func locateChunk(content, chunk string) (int, int, bool) {
+	if chunk == "" {
+		return 0, 0, false
+	}
+	if i := strings.Index(content, chunk); i >= 0 {
+		return i, i + len(chunk), true
+	}
+
+	words := strings.Fields(chunk)
+	spans := wordSpans(content)
+	for i := 0; i+len(words) <= len(spans); i++ {
+		match := true
+		for j, word := range words {
+			span := spans[i+j]
+			if content[span[0]:span[1]] != word {
+				match = false
+				break
+			}
+		}
+		if match {
+			return spans[i][0], spans[i+len(words)-1][1], true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// wordSpans returns the byte ranges of the whitespace separated words in text
+func wordSpans(text string) [][2]int {
+	spans := make([][2]int, 0)
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+// splitParagraphs splits text on blank lines into anchored paragraphs. Form
+// feeds, as emitted by PDF text extraction, start a new page.
+func splitParagraphs(text string) []SourceParagraph {
+	paragraphs := make([]SourceParagraph, 0)
+	page := 1
+	hasPages := strings.Contains(text, "\f")
+
+	offset := 0 // rune offset of the current line
+	start := -1
+	var b strings.Builder
+
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		p := SourceParagraph{
+			Index: len(paragraphs),
+			Start: start,
+			End:   end,
+			Text:  strings.TrimRight(b.String(), "\n"),
+		}
+		p.Anchor = "p-" + strconv.Itoa(p.Index+1)
+		if hasPages {
+			p.Page = page
+		}
+		paragraphs = append(paragraphs, p)
+		start = -1
+		b.Reset()
+	}
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineLen := utf8.RuneCountInString(line)
+
+		if strings.Contains(line, "\f") {
+			// Text before the form feed ends the page; text after it begins the next
+			parts := strings.Split(line, "\f")
+			pos := offset
+			for i, part := range parts {
+				if i > 0 {
+					flush(pos)
+					page++
+					pos++
+				}
+				if strings.TrimSpace(part) != "" {
+					if start < 0 {
+						start = pos
+					}
+					b.WriteString(part)
+				}
+				pos += utf8.RuneCountInString(part)
+			}
+			offset += lineLen
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			flush(offset)
+		} else {
+			if start < 0 {
+				start = offset
+			}
+			b.WriteString(line)
+		}
+		offset += lineLen
+	}
+	flush(offset)
+
+	// Trailing newlines are not part of a paragraph
+	for i := range paragraphs {
+		p := &paragraphs[i]
+		p.End = p.Start + utf8.RuneCountInString(strings.TrimRightFunc(p.Text, unicode.IsSpace))
+		p.Text = strings.TrimSpace(p.Text)
+	}
+
+	return paragraphs
+}
@@ -0,0 +1,391 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// groupByTags groups a view by the notes' tags instead of a property
+const groupByTags = "tags"
+
+// View is a saved, database-style look at a notebook's notes: the notes
+// matching its filters and tags, sorted and optionally grouped
+type View struct {
+	ID         string    `json:"id"`
+	NotebookID string    `json:"notebook_id"`
+	Name       string    `json:"name"`
+	Filters    []string  `json:"filters"`  // name:op:value, as in ?filter= of the notes list
+	Tags       []string  `json:"tags"`     // Notes must have all of these
+	Sort       string    `json:"sort"`     // Property name, "-name" for descending
+	GroupBy    string    `json:"group_by"` // Property name, or "tags"
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ViewGroup is the notes of a grouped view sharing one value. Key is "" for
+// notes without the property; a note with several values is in each group.
+type ViewGroup struct {
+	Key   string `json:"key"`
+	Notes []Note `json:"notes"`
+}
+
+// ViewResult is a view's notes, grouped when the view says so
+type ViewResult struct {
+	View   *View       `json:"view"`
+	Total  int         `json:"total"`
+	Notes  []Note      `json:"notes,omitempty"`
+	Groups []ViewGroup `json:"groups,omitempty"`
+}
+
+func scanView(row rowScanner) (*View, error) {
+	var v View
+	var filtersJSON, tagsJSON string
+	var createdAt, updatedAt int64
+
+	if err := row.Scan(&v.ID, &v.NotebookID, &v.Name, &filtersJSON, &tagsJSON, &v.Sort, &v.GroupBy, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	json.Unmarshal([]byte(filtersJSON), &v.Filters)
+	json.Unmarshal([]byte(tagsJSON), &v.Tags)
+	if v.Filters == nil {
+		v.Filters = []string{}
+	}
+	if v.Tags == nil {
+		v.Tags = []string{}
+	}
+	v.CreatedAt = time.Unix(createdAt, 0)
+	v.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &v, nil
+}
+
+// View operations
+
+// CreateView stores a new view
+func (s *Store) CreateView(ctx context.Context, v *View) error {
+	v.ID = uuid.New().String()
+	now := time.Now()
+	v.CreatedAt = now
+	v.UpdatedAt = now
+
+	filtersJSON, _ := json.Marshal(v.Filters)
+	tagsJSON, _ := json.Marshal(v.Tags)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO note_views (id, notebook_id, name, filters, tags, sort, group_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, v.ID, v.NotebookID, v.Name, string(filtersJSON), string(tagsJSON), v.Sort, v.GroupBy, now.Unix(), now.Unix())
+
+	return err
+}
+
+// GetView retrieves a view by ID
+func (s *Store) GetView(ctx context.Context, id string) (*View, error) {
+	v, err := scanView(s.db.QueryRowContext(ctx, `
+		SELECT id, notebook_id, name, filters, tags, sort, group_by, created_at, updated_at
+		FROM note_views WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("view")
+	}
+	return v, err
+}
+
+// ListViews retrieves a notebook's views
+func (s *Store) ListViews(ctx context.Context, notebookID string) ([]View, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, name, filters, tags, sort, group_by, created_at, updated_at
+		FROM note_views WHERE notebook_id = ? ORDER BY created_at, id
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := make([]View, 0)
+	for rows.Next() {
+		v, err := scanView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, *v)
+	}
+
+	return views, rows.Err()
+}
+
+// UpdateView saves a view's name, filters, tags, sort and grouping
+func (s *Store) UpdateView(ctx context.Context, v *View) error {
+	v.UpdatedAt = time.Now()
+
+	filtersJSON, _ := json.Marshal(v.Filters)
+	tagsJSON, _ := json.Marshal(v.Tags)
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE note_views SET name = ?, filters = ?, tags = ?, sort = ?, group_by = ?, updated_at = ?
+		WHERE id = ?
+	`, v.Name, string(filtersJSON), string(tagsJSON), v.Sort, v.GroupBy, v.UpdatedAt.Unix(), v.ID)
+
+	return err
+}
+
+// DeleteView deletes a view
+func (s *Store) DeleteView(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM note_views WHERE id = ?`, id)
+	return err
+}
+
+// validateView checks a view's name and filters and tidies its tags
+func validateView(v *View) error {
+	var fields fieldErrors
+	v.Name = strings.TrimSpace(v.Name)
+	if v.Name == "" || len(v.Name) > 200 {
+		fields.add("name", "must be 1 to 200 characters")
+	}
+	if v.Filters == nil {
+		v.Filters = []string{}
+	}
+	if _, err := parsePropertyFilters(v.Filters); err != nil {
+		fields = append(fields, err.(*ValidationError).Fields...)
+	}
+
+	tags := []string{}
+	for _, t := range v.Tags {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	v.Tags = tags
+	v.Sort = strings.TrimSpace(v.Sort)
+	if len(strings.TrimPrefix(v.Sort, "-")) > maxPropertyName {
+		fields.add("sort", "must be a property name")
+	}
+	v.GroupBy = strings.TrimSpace(v.GroupBy)
+	if len(v.GroupBy) > maxPropertyName {
+		fields.add("group_by", "must be a property name or tags")
+	}
+	return fields.err()
+}
+
+// hasTags reports whether a note has every one of tags, ignoring case
+func hasTags(note *Note, tags []string) bool {
+	have := map[string]bool{}
+	for _, t := range noteTags(note) {
+		have[strings.ToLower(t)] = true
+	}
+	for _, t := range tags {
+		if !have[strings.ToLower(t)] {
+			return false
+		}
+	}
+	return true
+}
+
+// propertyKeys are the values of a property as group keys
+func propertyKeys(p NoteProperty) []string {
+	switch p.Type {
+	case PropertySelect, PropertyRelation:
+		return p.Value.([]string)
+	case PropertyNumber:
+		return []string{strconv.FormatFloat(p.Value.(float64), 'f', -1, 64)}
+	}
+	return []string{fmt.Sprint(p.Value)}
+}
+
+// groupNotes splits notes by a property or their tags, keeping the notes'
+// order within each group. Groups are ordered by key with notes lacking a
+// value last.
+func groupNotes(notes []Note, groupBy string) []ViewGroup {
+	index := map[string]int{}
+	groups := []ViewGroup{}
+	add := func(key string, note Note) {
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, ViewGroup{Key: key, Notes: []Note{}})
+		}
+		groups[i].Notes = append(groups[i].Notes, note)
+	}
+
+	for i := range notes {
+		var keys []string
+		if groupBy == groupByTags {
+			keys = noteTags(&notes[i])
+		} else if p, ok := noteProperties(&notes[i])[groupBy]; ok {
+			keys = propertyKeys(p)
+		}
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			add(key, notes[i])
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Key == "" || groups[j].Key == "" {
+			return groups[j].Key == ""
+		}
+		return strings.ToLower(groups[i].Key) < strings.ToLower(groups[j].Key)
+	})
+	return groups
+}
+
+// Server helpers
+
+// notebookView loads :viewId and checks it belongs to :id
+func (s *Server) notebookView(c *gin.Context) (*View, bool) {
+	v, err := s.store.GetView(context.Background(), c.Param("viewId"))
+	if err != nil || v.NotebookID != c.Param("id") {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "View not found"})
+		return nil, false
+	}
+	return v, true
+}
+
+// View handlers
+
+func (s *Server) handleListViews(c *gin.Context) {
+	ctx := context.Background()
+
+	views, err := s.store.ListViews(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list views"})
+		return
+	}
+
+	c.JSON(http.StatusOK, views)
+}
+
+func (s *Server) handleCreateView(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+
+	if _, err := s.store.GetNotebook(ctx, notebookID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+		return
+	}
+
+	var v View
+	if !bindJSON(c, &v) {
+		return
+	}
+	if err := validateView(&v); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	v.NotebookID = notebookID
+	if err := s.store.CreateView(ctx, &v); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create view"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, v)
+}
+
+func (s *Server) handleGetView(c *gin.Context) {
+	v, ok := s.notebookView(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+func (s *Server) handleUpdateView(c *gin.Context) {
+	ctx := context.Background()
+
+	existing, ok := s.notebookView(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name    string   `json:"name"`
+		Filters []string `json:"filters"`
+		Tags    []string `json:"tags"`
+		Sort    string   `json:"sort"`
+		GroupBy string   `json:"group_by"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	v := *existing
+	v.Name, v.Filters, v.Tags, v.Sort, v.GroupBy = req.Name, req.Filters, req.Tags, req.Sort, req.GroupBy
+	if err := validateView(&v); err != nil {
+		validationResponse(c, err)
+		return
+	}
+
+	if err := s.store.UpdateView(ctx, &v); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update view"})
+		return
+	}
+
+	c.JSON(http.StatusOK, v)
+}
+
+func (s *Server) handleDeleteView(c *gin.Context) {
+	ctx := context.Background()
+
+	v, ok := s.notebookView(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteView(ctx, v.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete view"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleGetViewNotes runs a view over the notebook's notes, read through the
+// same cached list as the notes endpoint
+func (s *Server) handleGetViewNotes(c *gin.Context) {
+	ctx := context.Background()
+
+	v, ok := s.notebookView(c)
+	if !ok {
+		return
+	}
+	filters, err := parsePropertyFilters(v.Filters)
+	if validationResponse(c, err) {
+		return
+	}
+
+	notes, err := s.store.ListNotes(ctx, v.NotebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list notes"})
+		return
+	}
+	notes = filterNotes(notes, filters, v.Sort)
+	if len(v.Tags) > 0 {
+		tagged := notes[:0]
+		for i := range notes {
+			if hasTags(&notes[i], v.Tags) {
+				tagged = append(tagged, notes[i])
+			}
+		}
+		notes = tagged
+	}
+
+	result := ViewResult{View: v, Total: len(notes)}
+	if v.GroupBy != "" {
+		result.Groups = groupNotes(notes, v.GroupBy)
+	} else {
+		result.Notes = notes
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// visionImageSize is the longest side images are shrunk to before they
+	// are sent, about what providers scale them to anyway
+	visionImageSize = 1536
+	// minFigurePixels skips icons, logos and rules when looking for figures
+	// on PDF pages
+	minFigurePixels = 100
+)
+
+// visionDescriber has a vision-capable model describe images, so diagrams,
+// charts and screenshots can be found by their descriptions
+type visionDescriber struct {
+	llm      llms.Model
+	model    string
+	ollama   bool
+	maxPages int
+}
+
+// newVisionDescriber creates the describer, or returns nil when image
+// understanding is disabled
+func newVisionDescriber(cfg Config) (*visionDescriber, error) {
+	if !cfg.EnableVision {
+		return nil, nil
+	}
+	if cfg.VisionModel != "" {
+		if cfg.IsOllama() {
+			cfg.OllamaModel = cfg.VisionModel
+		} else {
+			cfg.OpenAIModel = cfg.VisionModel
+		}
+	}
+	model := cfg.OpenAIModel
+	if cfg.IsOllama() {
+		model = cfg.OllamaModel
+	}
+
+	llm, err := createLLM(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if llm, err = newResilientLLM(cfg, llm); err != nil {
+		return nil, err
+	}
+	return &visionDescriber{llm: llm, model: model, ollama: cfg.IsOllama(), maxPages: cfg.VisionMaxPages}, nil
+}
+
+func imageDescriptionPrompt() string {
+	return `请详细描述这张图片，以便之后能通过文字检索到它：说明图片的类型（照片、图表、示意图、截图等）、主要内容，以及其中的数据、趋势或各部分之间的关系。图片中的文字请按原文转录。
+**注意：请务必使用中文进行回复，只输出描述本身。**`
+}
+
+func pageFiguresPrompt() string {
+	return `这是一份 PDF 文档中的一页。请只描述页面中的图片、图表和示意图：说明它们的类型、主要内容，以及其中的数据、趋势或各部分之间的关系。页面正文已单独提取，无需转录。
+**注意：请务必使用中文进行回复，只输出描述本身。页面中没有图片时只输出“无”。**`
+}
+
+// describe asks the model to describe an image
+func (v *visionDescriber) describe(ctx context.Context, data []byte, mimeType, prompt string) (string, error) {
+	var part llms.ContentPart = llms.BinaryPart(mimeType, data)
+	if !v.ollama {
+		// OpenAI-compatible APIs take images as data URLs
+		part = llms.ImageURLPart(llms.BinaryPart(mimeType, data).String())
+	}
+	resp, err := v.llm.GenerateContent(ctx, []llms.MessageContent{{
+		Role:  llms.ChatMessageTypeHuman,
+		Parts: []llms.ContentPart{part, llms.TextPart(prompt)},
+	}})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("no description returned")
+	}
+	return strings.TrimSpace(resp.Choices[0].Content), nil
+}
+
+// readVisionImage reads an image to send, shrinking PNG, JPEG and GIF images
+// larger than visionImageSize. Other formats are sent as they are.
+func readVisionImage(path, mimeType string) ([]byte, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (cfg.Width <= visionImageSize && cfg.Height <= visionImageSize) || cfg.Width*cfg.Height > maxThumbnailPixels {
+		return data, mimeType, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, mimeType, nil
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, shrinkImage(img, visionImageSize), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
+
+// describeImage returns the text indexed for an image source: its
+// description
+func (v *visionDescriber) describeImage(ctx context.Context, path, mimeType string) (string, map[string]interface{}, error) {
+	data, mimeType, err := readVisionImage(path, mimeType)
+	if err != nil {
+		return "", nil, err
+	}
+	description, err := v.describe(ctx, data, mimeType, imageDescriptionPrompt())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to describe image: %w", err)
+	}
+	return description, map[string]interface{}{"vision": map[string]interface{}{"model": v.model, "described": "image"}}, nil
+}
+
+// describePDFFigures appends descriptions of the figures on a PDF's pages to
+// its extracted text. Pages with figures are found with pdfimages and
+// rendered with pdftoppm, both from poppler; without them, or when a page
+// fails, the text is kept as it is.
+func (v *visionDescriber) describePDFFigures(ctx context.Context, path, content string) (string, map[string]interface{}) {
+	for _, tool := range []string{"pdfimages", "pdftoppm"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return content, nil
+		}
+	}
+	pages, err := pdfFigurePages(ctx, path)
+	if err != nil {
+		golog.Warnf("failed to find figures in %s: %v", filepath.Base(path), err)
+		return content, nil
+	}
+	if len(pages) > v.maxPages {
+		golog.Infof("describing the figures on %d of %d pages of %s", v.maxPages, len(pages), filepath.Base(path))
+		pages = pages[:v.maxPages]
+	}
+
+	var b strings.Builder
+	b.WriteString(content)
+	var described []int
+	for _, page := range pages {
+		data, err := renderPDFPage(ctx, path, page)
+		if err != nil {
+			golog.Warnf("failed to render page %d of %s: %v", page, filepath.Base(path), err)
+			continue
+		}
+		description, err := v.describe(ctx, data, "image/jpeg", pageFiguresPrompt())
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			golog.Warnf("failed to describe page %d of %s: %v", page, filepath.Base(path), err)
+			continue
+		}
+		if description == "" || description == "无" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n\n## 第 %d 页的图片\n\n%s", page, description)
+		described = append(described, page)
+	}
+	if len(described) == 0 {
+		return content, nil
+	}
+	return b.String(), map[string]interface{}{"vision": map[string]interface{}{"model": v.model, "described": "figures", "pages": described}}
+}
+
+// pdfFigurePages lists the pages of a PDF that hold images large enough to
+// be figures, in order. Figures drawn as vectors are not found.
+func pdfFigurePages(ctx context.Context, path string) ([]int, error) {
+	output, err := exec.CommandContext(ctx, "pdfimages", "-list", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("pdfimages failed: %w", err)
+	}
+
+	// page num type width height ...; the header ends with a rule of dashes
+	var pages []int
+	seen := make(map[int]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[2] != "image" {
+			continue
+		}
+		page, err1 := strconv.Atoi(fields[0])
+		width, err2 := strconv.Atoi(fields[3])
+		height, err3 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || err3 != nil || width < minFigurePixels || height < minFigurePixels || seen[page] {
+			continue
+		}
+		seen[page] = true
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+// renderPDFPage renders one page of a PDF as a JPEG
+func renderPDFPage(ctx context.Context, path string, page int) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "notex-page-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	prefix := filepath.Join(dir, "page")
+	n := strconv.Itoa(page)
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-f", n, "-l", n, "-singlefile",
+		"-jpeg", "-scale-to", strconv.Itoa(visionImageSize), path, prefix)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("pdftoppm failed: %w, output: %s", err, output)
+	}
+	return os.ReadFile(prefix + ".jpg")
+}
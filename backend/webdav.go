@@ -0,0 +1,664 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// davPrefix is where the WebDAV tree is mounted
+	davPrefix = "/dav"
+	// davNoteExt is the extension of the files notes are shown as
+	davNoteExt = ".md"
+	// davNoteType is the type of notes created as files
+	davNoteType = "custom"
+	// davMaxName bounds the names of notes and notebooks made from file names
+	davMaxName = 200
+)
+
+// davMethods are the methods WebDAV clients use
+var davMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// errDAVPrecondition is a write whose If-Match does not match the note
+var errDAVPrecondition = errors.New("the note was changed since it was read")
+
+// davForbidden is an operation the folder layout does not allow
+func davForbidden(msg string) error {
+	return &storeError{kind: os.ErrPermission, msg: msg}
+}
+
+// handleWebDAV serves notes over WebDAV, so they can be mounted in a file
+// manager and edited with any editor. The top folders are the caller's
+// workspaces, with a folder per notebook in them, and each note is a
+// Markdown file.
+func (s *Server) handleWebDAV(c *gin.Context) {
+	user, ok := s.davUser(c)
+	if !ok {
+		return
+	}
+
+	// Under BASE_PATH, hrefs and Destination headers carry the base path
+	req := c.Request
+	base := requestBasePath(c)
+	if base != "" {
+		req = req.Clone(req.Context())
+		req.URL.Path = base + req.URL.Path
+	}
+
+	fs := &davFS{s: s, user: user, ifMatch: strings.TrimSpace(c.GetHeader("If-Match"))}
+	h := &webdav.Handler{
+		Prefix:     base + davPrefix,
+		FileSystem: fs,
+		LockSystem: s.davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				golog.Debugf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(&davResponseWriter{ResponseWriter: c.Writer, c: c, fs: fs}, req)
+}
+
+// davUser identifies the caller from an API token, sent as the password of
+// Basic authentication, since file managers cannot send Bearer tokens, or
+// as a Bearer token. Once the instance has users, callers must sign in.
+func (s *Server) davUser(c *gin.Context) (*User, bool) {
+	ctx := c.Request.Context()
+
+	token := ""
+	if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(bearer)
+	} else if _, password, ok := c.Request.BasicAuth(); ok {
+		token = password
+	}
+	if token == "" {
+		users, _, err := s.store.CountUsers(ctx)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to check users"})
+			return nil, false
+		}
+		if users > 0 {
+			davChallenge(c, "Sign in with an API token as the password")
+			return nil, false
+		}
+		return nil, true
+	}
+
+	user, _, err := s.authenticate(c, token)
+	if err != nil {
+		davChallenge(c, "Invalid API token")
+		return nil, false
+	}
+	c.Set("user", user)
+	return user, true
+}
+
+// davChallenge asks the client to sign in with Basic authentication
+func davChallenge(c *gin.Context, msg string) {
+	c.Header("WWW-Authenticate", `Basic realm="Notex", charset="UTF-8"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: msg})
+}
+
+// davResponseWriter replaces the bare status the WebDAV handler gives a
+// failed write with the response for the error behind it, such as 409 for a
+// conflicting edit or 507 for a full quota
+type davResponseWriter struct {
+	http.ResponseWriter
+	c        *gin.Context
+	fs       *davFS
+	replaced bool
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	err := w.fs.failure
+	if status < 400 || err == nil {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.replaced = true
+	switch {
+	case errors.Is(err, errDAVPrecondition):
+		w.c.JSON(http.StatusPreconditionFailed, ErrorResponse{Code: CodeConflict, Error: err.Error()})
+	case errors.Is(err, os.ErrPermission):
+		w.c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: err.Error()})
+	case errors.As(err, new(*QuotaError)):
+		w.c.JSON(http.StatusInsufficientStorage, ErrorResponse{Code: CodeQuotaExceeded, Error: err.Error()})
+	default:
+		storeErrorResponse(w.c, err, "Failed to save note")
+	}
+}
+
+func (w *davResponseWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// davFS shows the caller's notes as a file system to the WebDAV handler.
+// It lives for one request.
+type davFS struct {
+	s       *Server
+	user    *User
+	ifMatch string
+	// failure is the error that failed the request's write, if any
+	failure error
+}
+
+// fail records err as the reason the request failed, and returns it
+func (fs *davFS) fail(err error) error {
+	fs.failure = err
+	return err
+}
+
+// davNode is what a path names: the root, a workspace, a notebook or a note
+type davNode struct {
+	name      string
+	workspace *Workspace
+	notebook  *Notebook
+	note      *Note
+	modTime   time.Time
+}
+
+func (n *davNode) isDir() bool {
+	return n.note == nil
+}
+
+// resolve finds what a path names, or fails with os.ErrNotExist
+func (fs *davFS) resolve(ctx context.Context, name string) (*davNode, error) {
+	parts := strings.FieldsFunc(name, func(r rune) bool { return r == '/' })
+	node := &davNode{name: "/", modTime: time.Now()}
+	if len(parts) > 3 {
+		return nil, os.ErrNotExist
+	}
+	for depth, part := range parts {
+		children, err := fs.children(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		var found *davNode
+		for _, child := range children {
+			if strings.EqualFold(child.name, part) {
+				found = child
+				break
+			}
+		}
+		if found == nil || (depth < len(parts)-1 && !found.isDir()) {
+			return nil, os.ErrNotExist
+		}
+		node = found
+	}
+	return node, nil
+}
+
+// children lists what is in a folder, named in the order the items were
+// created so names stay put as items are added
+func (fs *davFS) children(ctx context.Context, dir *davNode) ([]*davNode, error) {
+	var nodes []*davNode
+	var titles, ids []string
+	ext := ""
+
+	switch {
+	case dir.notebook != nil:
+		notes, err := fs.s.store.ListNotes(ctx, dir.notebook.ID)
+		if err != nil {
+			return nil, err
+		}
+		// The list may be the cache's, so it is sorted as a copy
+		notes = append([]Note(nil), notes...)
+		sort.SliceStable(notes, func(i, j int) bool { return notes[i].CreatedAt.Before(notes[j].CreatedAt) })
+		for i := range notes {
+			note := notes[i]
+			nodes = append(nodes, &davNode{workspace: dir.workspace, notebook: dir.notebook, note: &note, modTime: note.UpdatedAt})
+			titles = append(titles, note.Title)
+			ids = append(ids, note.ID)
+		}
+		ext = davNoteExt
+	case dir.workspace != nil:
+		notebooks, err := fs.s.store.ListNotebooks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		notebooks = append([]Notebook(nil), notebooks...)
+		sort.SliceStable(notebooks, func(i, j int) bool { return notebooks[i].CreatedAt.Before(notebooks[j].CreatedAt) })
+		for i := range notebooks {
+			nb := notebooks[i]
+			// Smart notebooks hold no notes of their own
+			if nb.WorkspaceID != dir.workspace.ID || nb.ArchivedAt != nil || nb.TrashedAt != nil || nb.Type == NotebookTypeSmart {
+				continue
+			}
+			nodes = append(nodes, &davNode{workspace: dir.workspace, notebook: &nb, modTime: nb.UpdatedAt})
+			titles = append(titles, nb.Name)
+			ids = append(ids, nb.ID)
+		}
+	default:
+		workspaces, err := fs.s.store.ListOpenWorkspaces(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if fs.user != nil {
+			mine, err := fs.s.store.ListUserWorkspaces(ctx, fs.user.ID)
+			if err != nil {
+				return nil, err
+			}
+			// Workspaces that require two-factor authentication the user
+			// hasn't turned on are left out
+			for i := range mine {
+				if _, err := fs.s.checkTwoFactorPolicy(ctx, &mine[i], fs.user); err == nil {
+					workspaces = append(workspaces, mine[i])
+				}
+			}
+		}
+		sort.SliceStable(workspaces, func(i, j int) bool { return workspaces[i].CreatedAt.Before(workspaces[j].CreatedAt) })
+		for i := range workspaces {
+			ws := workspaces[i]
+			nodes = append(nodes, &davNode{workspace: &ws, modTime: ws.UpdatedAt})
+			titles = append(titles, ws.Name)
+			ids = append(ids, ws.ID)
+		}
+	}
+
+	for i, name := range davNames(titles, ids, ext) {
+		nodes[i].name = name
+	}
+	return nodes, nil
+}
+
+// davNames turns titles into file names. Characters file systems refuse are
+// replaced, and titles taken already, ignoring case, get the start of their
+// item's ID added.
+func davNames(titles, ids []string, ext string) []string {
+	names := make([]string, len(titles))
+	taken := make(map[string]bool, len(titles))
+	for i, title := range titles {
+		// Names starting with a dot are hidden
+		name := strings.TrimLeft(safeFileName(title), ".")
+		if name == "" {
+			name = "Untitled"
+		}
+		if taken[strings.ToLower(name)] {
+			name += " (" + ids[i][:min(8, len(ids[i]))] + ")"
+		}
+		taken[strings.ToLower(name)] = true
+		names[i] = name + ext
+	}
+	return names
+}
+
+// davNoteTitle returns the title of a note saved under a file name, or
+// fails for files that can't be notes, such as the dot files of macOS
+func davNoteTitle(name string) (string, error) {
+	title, ok := strings.CutSuffix(name, davNoteExt)
+	if !ok || strings.HasPrefix(name, ".") || strings.TrimSpace(title) == "" {
+		return "", davForbidden("only Markdown (" + davNoteExt + ") files can be saved as notes")
+	}
+	if len(title) > davMaxName {
+		return "", invalidField("title", "must be at most %d characters", davMaxName)
+	}
+	return strings.TrimSpace(title), nil
+}
+
+// checkIfMatch fails when the request's If-Match does not name the note
+func (fs *davFS) checkIfMatch(note *Note) error {
+	if fs.ifMatch == "" || (fs.ifMatch == "*" && note != nil) {
+		return nil
+	}
+	if note != nil {
+		for _, tag := range strings.Split(fs.ifMatch, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == davETag(note.Content) {
+				return nil
+			}
+		}
+	}
+	return fs.fail(errDAVPrecondition)
+}
+
+// davETag tags the content of a note
+func davETag(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// webdav.FileSystem
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return newDAVFileInfo(node), nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	node, err := fs.resolve(ctx, name)
+	switch {
+	case err == nil && node.isDir():
+		if writing {
+			return nil, fs.fail(davForbidden("folders can't be written"))
+		}
+		return &davDir{fs: fs, ctx: ctx, node: node}, nil
+	case err == nil:
+		f := &davFile{fs: fs, ctx: ctx, node: node, writing: writing}
+		if writing {
+			if err := fs.checkIfMatch(node.note); err != nil {
+				return nil, err
+			}
+			if flag&os.O_TRUNC == 0 {
+				f.buf.WriteString(node.note.Content)
+			}
+		} else {
+			f.reader = strings.NewReader(node.note.Content)
+		}
+		return f, nil
+	case !os.IsNotExist(err) || flag&os.O_CREATE == 0:
+		return nil, err
+	}
+
+	// A new note
+	parent, err := fs.resolve(ctx, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	if parent.notebook == nil || parent.note != nil {
+		return nil, fs.fail(davForbidden("notes can only be saved in a notebook's folder"))
+	}
+	title, err := davNoteTitle(path.Base(name))
+	if err != nil {
+		return nil, fs.fail(err)
+	}
+	if err := fs.checkIfMatch(nil); err != nil {
+		return nil, err
+	}
+	node = &davNode{
+		name:      path.Base(name),
+		workspace: parent.workspace,
+		notebook:  parent.notebook,
+		note:      &Note{NotebookID: parent.notebook.ID, Title: title, Type: davNoteType},
+		modTime:   time.Now(),
+	}
+	return &davFile{fs: fs, ctx: ctx, node: node, writing: true, creating: true}, nil
+}
+
+// Mkdir creates a notebook in a workspace's folder
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fs.resolve(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	parent, err := fs.resolve(ctx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if parent.workspace == nil || parent.notebook != nil {
+		return fs.fail(davForbidden("folders can only be created in a workspace's folder, as notebooks"))
+	}
+	title := strings.TrimSpace(path.Base(name))
+	if len(title) > davMaxName {
+		return fs.fail(invalidField("name", "must be at most %d characters", davMaxName))
+	}
+	if err := fs.s.checkNotebookQuota(ctx, parent.workspace); err != nil {
+		return fs.fail(err)
+	}
+	if _, err := fs.s.store.CreateNotebookInWorkspace(ctx, parent.workspace.ID, title, "", nil); err != nil {
+		return fs.fail(err)
+	}
+	return nil
+}
+
+// RemoveAll deletes a note, or moves a notebook to the trash
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	node, err := fs.resolve(ctx, name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case node.note != nil:
+		if err := fs.checkIfMatch(node.note); err != nil {
+			return err
+		}
+		if err := fs.s.store.DeleteNote(ctx, node.note.ID); err != nil {
+			return fs.fail(err)
+		}
+	case node.notebook != nil:
+		now := time.Now()
+		if err := fs.s.store.SetNotebookTrashed(ctx, node.notebook.ID, &now); err != nil {
+			return fs.fail(err)
+		}
+	default:
+		return fs.fail(davForbidden("workspaces can't be deleted over WebDAV"))
+	}
+	return nil
+}
+
+// Rename renames or moves a note, or renames a notebook
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	node, err := fs.resolve(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	parent, err := fs.resolve(ctx, path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	base := path.Base(newName)
+
+	switch {
+	case node.note != nil:
+		if parent.notebook == nil || parent.note != nil {
+			return fs.fail(davForbidden("notes can only be moved to a notebook's folder"))
+		}
+		note := *node.note
+		note.NotebookID = parent.notebook.ID
+		// A note moved under the same name keeps its title as it was
+		if !strings.EqualFold(base, node.name) {
+			if note.Title, err = davNoteTitle(base); err != nil {
+				return fs.fail(err)
+			}
+		}
+		if err := fs.s.store.UpdateNoteIfUnchanged(ctx, &note, node.note); err != nil {
+			return fs.fail(err)
+		}
+	case node.notebook != nil:
+		if parent.workspace == nil || parent.notebook != nil || parent.workspace.ID != node.workspace.ID {
+			return fs.fail(davForbidden("notebooks can only be renamed within their workspace"))
+		}
+		if len(base) > davMaxName {
+			return fs.fail(invalidField("name", "must be at most %d characters", davMaxName))
+		}
+		nb := node.notebook
+		if _, err := fs.s.store.UpdateNotebook(ctx, nb.ID, strings.TrimSpace(base), nb.Description, nb.Metadata); err != nil {
+			return fs.fail(err)
+		}
+	default:
+		return fs.fail(davForbidden("workspaces can't be renamed over WebDAV"))
+	}
+	return nil
+}
+
+// save stores what was written to a note file, as a new note or over the
+// note as it was when the file was opened
+func (fs *davFS) save(ctx context.Context, node *davNode, content string, creating bool) error {
+	if creating {
+		note := *node.note
+		note.Content = content
+		return fs.s.createNote(ctx, &note)
+	}
+
+	base := node.note
+	if content == base.Content {
+		return nil
+	}
+	note := *base
+	note.Content = content
+	fs.s.applyNoteHooks(ctx, &note)
+	fs.s.applyFrontmatter(ctx, &note)
+	if err := fs.s.checkStorageQuota(ctx, note.NotebookID, int64(len(note.Content)-len(base.Content))); err != nil {
+		return err
+	}
+	return fs.s.store.UpdateNoteIfUnchanged(ctx, &note, base)
+}
+
+// davFileInfo describes a folder or note file
+type davFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	etag    string
+}
+
+func newDAVFileInfo(node *davNode) *davFileInfo {
+	fi := &davFileInfo{name: node.name, modTime: node.modTime, dir: node.isDir()}
+	if node.note != nil {
+		fi.size = int64(len(node.note.Content))
+		fi.etag = davETag(node.note.Content)
+	}
+	return fi
+}
+
+func (fi *davFileInfo) Name() string       { return fi.name }
+func (fi *davFileInfo) Size() int64        { return fi.size }
+func (fi *davFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *davFileInfo) IsDir() bool        { return fi.dir }
+func (fi *davFileInfo) Sys() interface{}   { return nil }
+
+func (fi *davFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag tags notes by their content, so an If-Match from a GET fails once
+// the note changes
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.etag, nil
+}
+
+// ContentType saves sniffing the content of notes
+func (fi *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.dir {
+		return "", webdav.ErrNotImplemented
+	}
+	return "text/markdown; charset=utf-8", nil
+}
+
+// davDir is an open folder
+type davDir struct {
+	fs      *davFS
+	ctx     context.Context
+	node    *davNode
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return newDAVFileInfo(d.node), nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		children, err := d.fs.children(d.ctx, d.node)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			d.entries = append(d.entries, newDAVFileInfo(child))
+		}
+		d.listed = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// davFile is an open note. Writes are kept until the file is closed, and
+// then saved through the store.
+type davFile struct {
+	fs       *davFS
+	ctx      context.Context
+	node     *davNode
+	reader   *strings.Reader
+	writing  bool
+	creating bool
+	buf      bytes.Buffer
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.reader.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, os.ErrPermission
+	}
+	return f.buf.Write(p)
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	fi := newDAVFileInfo(f.node)
+	if f.writing {
+		fi.size = int64(f.buf.Len())
+		fi.etag = davETag(f.buf.String())
+	}
+	return fi, nil
+}
+
+func (f *davFile) Close() error {
+	if !f.writing {
+		return nil
+	}
+	f.writing = false
+	if err := f.fs.save(f.ctx, f.node, f.buf.String(), f.creating); err != nil {
+		return f.fs.fail(err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// maxWebPageChars bounds how much of a fetched page is added to the chat context
+const maxWebPageChars = 4000
+
+// WebResult is a single web search result
+type WebResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
+	// Content is the fetched page text, when available
+	Content string `json:"-"`
+}
+
+// WebSearcher queries a web search provider
+type WebSearcher interface {
+	Search(ctx context.Context, query string, limit int) ([]WebResult, error)
+}
+
+// newWebSearcher returns the configured search provider, or nil if web search is not configured
+func newWebSearcher(cfg Config) (WebSearcher, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	switch strings.ToLower(cfg.WebSearchProvider) {
+	case "":
+		// A SearxNG URL alone enables web search
+		if cfg.WebSearchURL == "" {
+			return nil, nil
+		}
+		return &searxngSearcher{baseURL: cfg.WebSearchURL, client: client}, nil
+	case "searxng":
+		if cfg.WebSearchURL == "" {
+			return nil, fmt.Errorf("WEB_SEARCH_URL is required for searxng")
+		}
+		return &searxngSearcher{baseURL: cfg.WebSearchURL, client: client}, nil
+	case "brave":
+		if cfg.WebSearchAPIKey == "" {
+			return nil, fmt.Errorf("WEB_SEARCH_API_KEY is required for brave")
+		}
+		return &braveSearcher{apiKey: cfg.WebSearchAPIKey, client: client}, nil
+	case "bing":
+		if cfg.WebSearchAPIKey == "" {
+			return nil, fmt.Errorf("WEB_SEARCH_API_KEY is required for bing")
+		}
+		return &bingSearcher{apiKey: cfg.WebSearchAPIKey, endpoint: cfg.WebSearchURL, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown web search provider: %s", cfg.WebSearchProvider)
+	}
+}
+
+// searxngSearcher queries a SearxNG instance's JSON API
+type searxngSearcher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (s *searxngSearcher) Search(ctx context.Context, query string, limit int) ([]WebResult, error) {
+	endpoint := strings.TrimRight(s.baseURL, "/") + "/search?format=json&q=" + url.QueryEscape(query)
+
+	var body struct {
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+	}
+	if err := getSearchJSON(ctx, s.client, endpoint, nil, &body); err != nil {
+		return nil, err
+	}
+
+	results := make([]WebResult, 0, limit)
+	for _, r := range body.Results {
+		if len(results) >= limit {
+			break
+		}
+		results = append(results, WebResult{Title: r.Title, URL: r.URL, Snippet: r.Content})
+	}
+	return results, nil
+}
+
+// braveSearcher queries the Brave Search API
+type braveSearcher struct {
+	apiKey string
+	client *http.Client
+}
+
+func (s *braveSearcher) Search(ctx context.Context, query string, limit int) ([]WebResult, error) {
+	endpoint := fmt.Sprintf("https://api.search.brave.com/res/v1/web/search?q=%s&count=%d", url.QueryEscape(query), limit)
+
+	var body struct {
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	headers := map[string]string{"X-Subscription-Token": s.apiKey, "Accept": "application/json"}
+	if err := getSearchJSON(ctx, s.client, endpoint, headers, &body); err != nil {
+		return nil, err
+	}
+
+	results := make([]WebResult, 0, limit)
+	for _, r := range body.Web.Results {
+		if len(results) >= limit {
+			break
+		}
+		results = append(results, WebResult{Title: r.Title, URL: r.URL, Snippet: htmlToText(r.Description)})
+	}
+	return results, nil
+}
+
+// bingSearcher queries the Bing Web Search API
+type bingSearcher struct {
+	apiKey   string
+	endpoint string
+	client   *http.Client
+}
+
+func (s *bingSearcher) Search(ctx context.Context, query string, limit int) ([]WebResult, error) {
+	base := s.endpoint
+	if base == "" {
+		base = "https://api.bing.microsoft.com/v7.0/search"
+	}
+	endpoint := fmt.Sprintf("%s?q=%s&count=%d", base, url.QueryEscape(query), limit)
+
+	var body struct {
+		WebPages struct {
+			Value []struct {
+				Name    string `json:"name"`
+				URL     string `json:"url"`
+				Snippet string `json:"snippet"`
+			} `json:"value"`
+		} `json:"webPages"`
+	}
+	headers := map[string]string{"Ocp-Apim-Subscription-Key": s.apiKey}
+	if err := getSearchJSON(ctx, s.client, endpoint, headers, &body); err != nil {
+		return nil, err
+	}
+
+	results := make([]WebResult, 0, limit)
+	for _, r := range body.WebPages.Value {
+		if len(results) >= limit {
+			break
+		}
+		results = append(results, WebResult{Title: r.Name, URL: r.URL, Snippet: r.Snippet})
+	}
+	return results, nil
+}
+
+// getSearchJSON performs a GET request and decodes the JSON response
+func getSearchJSON(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	for k, val := range headers {
+		req.Header.Set(k, val)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("web search failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("web search returned status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode web search results: %w", err)
+	}
+	return nil
+}
+
+// searchWeb runs a web search for a chat message and fetches the result pages
+// in parallel. Pages that cannot be fetched keep only their snippet.
+func (s *Server) searchWeb(ctx context.Context, query string) ([]WebResult, error) {
+	results, err := s.webSearcher.Search(ctx, query, s.cfg.WebSearchResults)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.WebSearchFetchPages {
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(r *WebResult) {
+				defer wg.Done()
+				content, err := fetchWebPage(ctx, r.URL)
+				if err != nil {
+					golog.Warnf("failed to fetch web result %s: %v", r.URL, err)
+					return
+				}
+				r.Content = content
+			}(&results[i])
+		}
+		wg.Wait()
+	}
+
+	return results, nil
+}
+
+// fetchWebPage downloads a page and returns its text, truncated for the chat context
+func fetchWebPage(ctx context.Context, pageURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") && !strings.HasPrefix(ct, "text/") {
+		return "", fmt.Errorf("unsupported content type %s", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		return "", err
+	}
+
+	text := []rune(htmlToText(string(body)))
+	if len(text) > maxWebPageChars {
+		text = text[:maxWebPageChars]
+	}
+	return string(text), nil
+}
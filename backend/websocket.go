@@ -0,0 +1,215 @@
+package backend
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventBuffer is how many events a client may fall behind before it is
+	// disconnected
+	eventBuffer = 32
+	// eventPingInterval keeps idle connections open through proxies
+	eventPingInterval = 30 * time.Second
+	// eventWriteTimeout bounds each write to a client
+	eventWriteTimeout = 10 * time.Second
+)
+
+// Event is a change pushed to WebSocket clients
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+	Time time.Time   `json:"time"`
+}
+
+// eventClient is one WebSocket connection. userID is "" until the client
+// signs in, which matches callers without a token.
+type eventClient struct {
+	userID string
+	// sessionID is the session the client signed in with, and revoked is
+	// set when that session is revoked before send is closed
+	sessionID string
+	revoked   bool
+	send      chan Event
+}
+
+// eventHub fans events out to connected clients. The zero value is ready
+// to use.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[*eventClient]struct{}
+}
+
+func (h *eventHub) add(client *eventClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients == nil {
+		h.clients = make(map[*eventClient]struct{})
+	}
+	h.clients[client] = struct{}{}
+}
+
+func (h *eventHub) remove(client *eventClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.send)
+	}
+}
+
+// setUser signs a client in and confirms it to that client alone
+func (h *eventHub) setUser(client *eventClient, userID, sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client.userID = userID
+	client.sessionID = sessionID
+	if _, ok := h.clients[client]; ok {
+		select {
+		case client.send <- Event{Type: "authenticated", Data: gin.H{"user_id": userID}, Time: time.Now()}:
+		default:
+		}
+	}
+}
+
+// publish sends ev to every client, or only to userID's when all is false.
+// Clients too far behind are dropped rather than holding up the rest.
+func (h *eventHub) publish(ev Event, userID string, all bool) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if !all && client.userID != userID {
+			continue
+		}
+		select {
+		case client.send <- ev:
+		default:
+			delete(h.clients, client)
+			close(client.send)
+		}
+	}
+}
+
+// disconnectSessions drops the clients signed in with revoked sessions
+func (h *eventHub) disconnectSessions(ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.sessionID != "" && slices.Contains(ids, client.sessionID) {
+			client.revoked = true
+			delete(h.clients, client)
+			close(client.send)
+		}
+	}
+}
+
+// publishAll sends ev to every connected client
+func (h *eventHub) publishAll(ev Event) {
+	h.publish(ev, "", true)
+}
+
+// publishUser sends ev to the clients signed in as userID
+func (h *eventHub) publishUser(userID string, ev Event) {
+	h.publish(ev, userID, false)
+}
+
+// Same-origin only: the default check refuses pages on other sites
+var eventUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// handleEvents streams events over a WebSocket. Clients sign in with the
+// usual Authorization header or, since browsers cannot set headers on
+// WebSockets, by sending {"type": "auth", "token": "..."} first.
+func (s *Server) handleEvents(c *gin.Context) {
+	client := &eventClient{send: make(chan Event, eventBuffer)}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && token != "" {
+		user, sess, err := s.authenticate(c, token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Invalid API token"})
+			return
+		}
+		client.userID, client.sessionID = user.ID, sess.ID
+	}
+
+	conn, err := eventUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already answered
+		return
+	}
+	defer conn.Close()
+
+	s.events.add(client)
+	defer s.events.remove(client)
+	client.send <- Event{Type: "hello", Data: gin.H{"user_id": client.userID}, Time: time.Now()}
+
+	// Read sign-ins and pongs until the client goes away
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		conn.SetReadLimit(4096)
+		conn.SetReadDeadline(time.Now().Add(2 * eventPingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * eventPingInterval))
+		})
+		for {
+			var msg struct {
+				Type  string `json:"type"`
+				Token string `json:"token"`
+			}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type != "auth" {
+				continue
+			}
+			user, sess, err := s.authenticate(c, msg.Token)
+			if err != nil {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid API token"), time.Now().Add(eventWriteTimeout))
+				return
+			}
+			s.events.setUser(client, user.ID, sess.ID)
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev, ok := <-client.send:
+			if !ok && client.revoked {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"), time.Now().Add(eventWriteTimeout))
+				return
+			}
+			if !ok {
+				// Dropped for falling behind
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(eventWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)); err != nil {
+				return
+			}
+		case <-readDone:
+			return
+		case <-s.stopping:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(eventWriteTimeout))
+			return
+		}
+	}
+}
@@ -0,0 +1,991 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// DefaultWorkspaceID is the workspace notebooks belong to unless another is chosen.
+// While it has no members it is open to every caller, as single-user installs expect.
+const DefaultWorkspaceID = "default"
+
+// Workspace roles
+const (
+	RoleOwner  = "owner"
+	RoleMember = "member"
+)
+
+// User is a person who can belong to workspaces. Users authenticate with an
+// API token sent as "Authorization: Bearer <token>".
+type User struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	IsAdmin   bool      `json:"is_admin,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Workspace groups notebooks with their own members, settings, LLM credentials
+// and quotas so teams can share a deployment
+type Workspace struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	Settings     map[string]interface{} `json:"settings"`
+	LLMAPIKey    string                 `json:"-"`
+	HasLLMAPIKey bool                   `json:"has_llm_api_key"`
+	LLMBaseURL   string                 `json:"llm_base_url,omitempty"`
+	LLMModel     string                 `json:"llm_model,omitempty"`
+	MaxNotebooks int                    `json:"max_notebooks"`  // 0 means unlimited
+	MaxSources   int                    `json:"max_sources"`    // 0 means unlimited
+	MaxStorageMB int                    `json:"max_storage_mb"` // 0 means the server default
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+	// Role is the caller's role, set when listing a user's workspaces
+	Role string `json:"role,omitempty"`
+}
+
+// WorkspaceMember is a user's membership in a workspace
+type WorkspaceMember struct {
+	WorkspaceID string    `json:"workspace_id"`
+	UserID      string    `json:"user_id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// QuotaError is returned when a workspace or user quota would be exceeded
+type QuotaError struct {
+	Scope    string // "workspace" or "user"
+	Resource string
+	Limit    int64
+	// Used and Requested are set for storage quotas, in bytes
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Resource == "storage" {
+		return fmt.Sprintf("%s storage quota of %s exceeded: %s already used, %s more needed",
+			e.Scope, formatBytes(e.Limit), formatBytes(e.Used), formatBytes(e.Requested))
+	}
+	return fmt.Sprintf("%s %s quota of %d reached", e.Scope, e.Resource, e.Limit)
+}
+
+// quotaResponse writes a 403 for an exceeded quota and reports whether err was one
+func quotaResponse(c *gin.Context, err error) bool {
+	var quota *QuotaError
+	if !errors.As(err, &quota) {
+		return false
+	}
+	c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeQuotaExceeded, Error: quota.Error()})
+	return true
+}
+
+// hashToken hashes an API token for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIToken generates a random API token
+func newAPIToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "ntx_" + hex.EncodeToString(b)
+}
+
+// User operations
+
+// CreateUser creates a user and returns the API token of its first
+// session, which is not stored in clear
+func (s *Store) CreateUser(ctx context.Context, email, name string) (*User, string, error) {
+	u := &User{ID: uuid.New().String(), Email: strings.ToLower(strings.TrimSpace(email)), Name: name, CreatedAt: time.Now()}
+	token := newAPIToken()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users (id, email, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)
+	`, u.ID, u.Email, u.Name, hashToken(token), u.CreatedAt.Unix())
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, "", conflictError(fmt.Sprintf("a user with email %s already exists", u.Email))
+		}
+		return nil, "", err
+	}
+	if _, err := insertSession(ctx, tx, u.ID, "", hashToken(token)); err != nil {
+		return nil, "", err
+	}
+
+	return u, token, tx.Commit()
+}
+
+const userColumns = `id, email, name, is_admin, created_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	var createdAt int64
+	if err := row.Scan(&u.ID, &u.Email, &u.Name, &u.IsAdmin, &createdAt); err != nil {
+		return nil, err
+	}
+	u.CreatedAt = time.Unix(createdAt, 0)
+	return &u, nil
+}
+
+// GetUser retrieves a user by ID
+func (s *Store) GetUser(ctx context.Context, id string) (*User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("user")
+	}
+	return u, err
+}
+
+// GetUserByEmail retrieves a user by email address
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+` FROM users WHERE email = ?
+	`, strings.ToLower(strings.TrimSpace(email))))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("user")
+	}
+	return u, err
+}
+
+// CountUsers returns how many users exist, and how many of them are admins
+func (s *Store) CountUsers(ctx context.Context) (users, admins int, err error) {
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(is_admin), 0) FROM users
+	`).Scan(&users, &admins)
+	return users, admins, err
+}
+
+// SetUserAdmin grants or revokes a user's instance admin rights
+func (s *Store) SetUserAdmin(ctx context.Context, id string, admin bool) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET is_admin = ? WHERE id = ?`, admin, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return notFoundError("user")
+	}
+	return nil
+}
+
+// Workspace operations
+
+const workspaceColumns = `id, name, settings, llm_api_key, llm_base_url, llm_model, max_notebooks, max_sources, max_storage_mb, created_at, updated_at`
+
+func scanWorkspace(row rowScanner) (*Workspace, error) {
+	var ws Workspace
+	var settingsJSON string
+	var createdAt, updatedAt int64
+
+	if err := row.Scan(&ws.ID, &ws.Name, &settingsJSON, &ws.LLMAPIKey, &ws.LLMBaseURL, &ws.LLMModel,
+		&ws.MaxNotebooks, &ws.MaxSources, &ws.MaxStorageMB, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	ws.HasLLMAPIKey = ws.LLMAPIKey != ""
+	ws.CreatedAt = time.Unix(createdAt, 0)
+	ws.UpdatedAt = time.Unix(updatedAt, 0)
+	if settingsJSON != "" {
+		json.Unmarshal([]byte(settingsJSON), &ws.Settings)
+	}
+	if ws.Settings == nil {
+		ws.Settings = make(map[string]interface{})
+	}
+
+	return &ws, nil
+}
+
+// CreateWorkspace creates a workspace owned by ownerID
+func (s *Store) CreateWorkspace(ctx context.Context, ws *Workspace, ownerID string) error {
+	ws.ID = uuid.New().String()
+	now := time.Now()
+	ws.CreatedAt = now
+	ws.UpdatedAt = now
+	settingsJSON, _ := json.Marshal(ws.Settings)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO workspaces (`+workspaceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ws.ID, ws.Name, string(settingsJSON), ws.LLMAPIKey, ws.LLMBaseURL, ws.LLMModel,
+		ws.MaxNotebooks, ws.MaxSources, ws.MaxStorageMB, now.Unix(), now.Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+	`, ws.ID, ownerID, RoleOwner, now.Unix()); err != nil {
+		return err
+	}
+
+	ws.HasLLMAPIKey = ws.LLMAPIKey != ""
+	ws.Role = RoleOwner
+	return tx.Commit()
+}
+
+// GetWorkspace retrieves a workspace by ID
+func (s *Store) GetWorkspace(ctx context.Context, id string) (*Workspace, error) {
+	ws, err := scanWorkspace(s.db.QueryRowContext(ctx, `SELECT `+workspaceColumns+` FROM workspaces WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("workspace")
+	}
+	return ws, err
+}
+
+// ListUserWorkspaces retrieves the workspaces a user belongs to, with the user's role
+func (s *Store) ListUserWorkspaces(ctx context.Context, userID string) ([]Workspace, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT w.id, w.name, w.settings, w.llm_api_key, w.llm_base_url, w.llm_model,
+			w.max_notebooks, w.max_sources, w.max_storage_mb, w.created_at, w.updated_at, m.role
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ? ORDER BY w.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := make([]Workspace, 0)
+	for rows.Next() {
+		var role string
+		ws, err := scanWorkspace(rowScannerFunc(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &role)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		ws.Role = role
+		workspaces = append(workspaces, *ws)
+	}
+
+	return workspaces, rows.Err()
+}
+
+// ListOpenWorkspaces retrieves workspaces without members, which anyone may use
+func (s *Store) ListOpenWorkspaces(ctx context.Context) ([]Workspace, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+workspaceColumns+` FROM workspaces w
+		WHERE NOT EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id)
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := make([]Workspace, 0)
+	for rows.Next() {
+		ws, err := scanWorkspace(rows)
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, *ws)
+	}
+
+	return workspaces, rows.Err()
+}
+
+// rowScannerFunc adapts a function to rowScanner
+type rowScannerFunc func(dest ...interface{}) error
+
+func (f rowScannerFunc) Scan(dest ...interface{}) error { return f(dest...) }
+
+// UpdateWorkspace saves a workspace's name, settings, LLM credentials and quotas
+func (s *Store) UpdateWorkspace(ctx context.Context, ws *Workspace) error {
+	ws.UpdatedAt = time.Now()
+	settingsJSON, _ := json.Marshal(ws.Settings)
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE workspaces SET name = ?, settings = ?, llm_api_key = ?, llm_base_url = ?, llm_model = ?,
+			max_notebooks = ?, max_sources = ?, max_storage_mb = ?, updated_at = ?
+		WHERE id = ?
+	`, ws.Name, string(settingsJSON), ws.LLMAPIKey, ws.LLMBaseURL, ws.LLMModel,
+		ws.MaxNotebooks, ws.MaxSources, ws.MaxStorageMB, ws.UpdatedAt.Unix(), ws.ID)
+
+	ws.HasLLMAPIKey = ws.LLMAPIKey != ""
+	return err
+}
+
+// DeleteWorkspace deletes a workspace and its memberships
+func (s *Store) DeleteWorkspace(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM workspaces WHERE id = ?`, id)
+	return err
+}
+
+// GetWorkspaceRole returns a user's role in a workspace, or "" if not a member
+func (s *Store) GetWorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT role FROM workspace_members WHERE workspace_id = ? AND user_id = ?
+	`, workspaceID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// CountWorkspaceMembers returns how many members a workspace has
+func (s *Store) CountWorkspaceMembers(ctx context.Context, workspaceID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ?`, workspaceID).Scan(&n)
+	return n, err
+}
+
+// ListWorkspaceMembers retrieves a workspace's members
+func (s *Store) ListWorkspaceMembers(ctx context.Context, workspaceID string) ([]WorkspaceMember, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.workspace_id, m.user_id, u.email, u.name, m.role, m.created_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ? ORDER BY m.created_at
+	`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]WorkspaceMember, 0)
+	for rows.Next() {
+		var m WorkspaceMember
+		var createdAt int64
+		if err := rows.Scan(&m.WorkspaceID, &m.UserID, &m.Email, &m.Name, &m.Role, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(createdAt, 0)
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// SetWorkspaceMember adds a user to a workspace or changes their role
+func (s *Store) SetWorkspaceMember(ctx context.Context, workspaceID, userID, role string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(workspace_id, user_id) DO UPDATE SET role = excluded.role
+	`, workspaceID, userID, role, time.Now().Unix())
+	return err
+}
+
+// RemoveWorkspaceMember removes a user from a workspace
+func (s *Store) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?
+	`, workspaceID, userID)
+	return err
+}
+
+// CountWorkspaceNotebooks returns how many notebooks a workspace has
+func (s *Store) CountWorkspaceNotebooks(ctx context.Context, workspaceID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notebooks WHERE workspace_id = ?`, workspaceID).Scan(&n)
+	return n, err
+}
+
+// CountWorkspaceSources returns how many sources a workspace's notebooks have
+func (s *Store) CountWorkspaceSources(ctx context.Context, workspaceID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM sources s JOIN notebooks n ON n.id = s.notebook_id WHERE n.workspace_id = ?
+	`, workspaceID).Scan(&n)
+	return n, err
+}
+
+// Request scoping
+
+// WorkspaceMiddleware identifies the caller from their API token and the
+// workspace from the X-Workspace-ID header (or ?workspace_id=), defaulting to
+// the default workspace. Workspaces with members are only open to members.
+func (s *Server) WorkspaceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var user *User
+		if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && token != "" {
+			u, sess, err := s.authenticate(c, token)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Invalid API token"})
+				return
+			}
+			user = u
+			c.Set("user", u)
+			c.Set("session", sess)
+		}
+
+		workspaceID := c.GetHeader("X-Workspace-ID")
+		if workspaceID == "" {
+			workspaceID = c.Query("workspace_id")
+		}
+		if workspaceID == "" {
+			workspaceID = DefaultWorkspaceID
+		}
+
+		ws, err := s.store.GetWorkspace(ctx, workspaceID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Workspace not found"})
+			return
+		}
+
+		role, status, err := s.workspaceRole(ctx, ws.ID, user)
+		if err != nil {
+			c.AbortWithStatusJSON(status, ErrorResponse{Code: codeForStatus(status), Error: err.Error()})
+			return
+		}
+		ws.Role = role
+		if !twoFactorExempt(c.Request.URL.Path) {
+			if status, err := s.checkTwoFactorPolicy(ctx, ws, user); err != nil {
+				twoFactorPolicyResponse(c, status, err)
+				return
+			}
+		}
+
+		c.Set("workspace", ws)
+		c.Next()
+	}
+}
+
+// workspaceRole returns the caller's role in a workspace. Open workspaces
+// (without members) grant everyone the owner role.
+func (s *Server) workspaceRole(ctx context.Context, workspaceID string, user *User) (string, int, error) {
+	members, err := s.store.CountWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to check workspace access")
+	}
+	if members == 0 {
+		return RoleOwner, 0, nil
+	}
+	if user == nil {
+		return "", http.StatusUnauthorized, fmt.Errorf("this workspace requires an API token")
+	}
+
+	role, err := s.store.GetWorkspaceRole(ctx, workspaceID, user.ID)
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to check workspace access")
+	}
+	if role == "" {
+		return "", http.StatusForbidden, fmt.Errorf("you are not a member of this workspace")
+	}
+	return role, 0, nil
+}
+
+// currentWorkspace returns the request's workspace
+func currentWorkspace(c *gin.Context) *Workspace {
+	if v, ok := c.Get("workspace"); ok {
+		return v.(*Workspace)
+	}
+	return &Workspace{ID: DefaultWorkspaceID, Role: RoleOwner}
+}
+
+// currentUser returns the authenticated user, or nil
+func currentUser(c *gin.Context) *User {
+	if v, ok := c.Get("user"); ok {
+		return v.(*User)
+	}
+	return nil
+}
+
+// NotebookWorkspaceMiddleware hides notebooks outside the request's workspace
+// from every /notebooks/:id route
+func (s *Server) NotebookWorkspaceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if id == "" {
+			c.Next()
+			return
+		}
+
+		notebook, err := s.store.GetNotebook(c.Request.Context(), id)
+		if err == nil && notebook.WorkspaceID != currentWorkspace(c).ID {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Notebook not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// filterWorkspaceNotebooks keeps the notebooks in a workspace
+func filterWorkspaceNotebooks(notebooks []Notebook, workspaceID string) []Notebook {
+	filtered := make([]Notebook, 0, len(notebooks))
+	for _, nb := range notebooks {
+		if nb.WorkspaceID == workspaceID {
+			filtered = append(filtered, nb)
+		}
+	}
+	return filtered
+}
+
+// checkNotebookQuota fails when a workspace already has its maximum number of notebooks
+func (s *Server) checkNotebookQuota(ctx context.Context, ws *Workspace) error {
+	if ws.MaxNotebooks <= 0 {
+		return nil
+	}
+	n, err := s.store.CountWorkspaceNotebooks(ctx, ws.ID)
+	if err != nil {
+		return err
+	}
+	if n >= ws.MaxNotebooks {
+		return &QuotaError{Scope: "workspace", Resource: "notebook", Limit: int64(ws.MaxNotebooks)}
+	}
+	return nil
+}
+
+// checkSourceQuota fails when the notebook's workspace already has its maximum number of sources
+func (s *Server) checkSourceQuota(ctx context.Context, notebookID string) error {
+	ws, err := s.notebookWorkspace(ctx, notebookID)
+	if err != nil || ws.MaxSources <= 0 {
+		return nil
+	}
+	n, err := s.store.CountWorkspaceSources(ctx, ws.ID)
+	if err != nil {
+		return err
+	}
+	if n >= ws.MaxSources {
+		return &QuotaError{Scope: "workspace", Resource: "source", Limit: int64(ws.MaxSources)}
+	}
+	return nil
+}
+
+// notebookWorkspace returns the workspace a notebook belongs to
+func (s *Server) notebookWorkspace(ctx context.Context, notebookID string) (*Workspace, error) {
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.GetWorkspace(ctx, notebook.WorkspaceID)
+}
+
+// notebookAgent returns the agent for a notebook, using its workspace's LLM
+// credentials when the workspace has its own
+func (s *Server) notebookAgent(ctx context.Context, notebookID string) *Agent {
+	ws, err := s.notebookWorkspace(ctx, notebookID)
+	if err != nil || (ws.LLMAPIKey == "" && ws.LLMBaseURL == "" && ws.LLMModel == "") {
+		return s.agent
+	}
+
+	s.agentsMu.Lock()
+	defer s.agentsMu.Unlock()
+
+	if cached, ok := s.workspaceAgents[ws.ID]; ok && cached.updatedAt.Equal(ws.UpdatedAt) {
+		return cached.agent
+	}
+
+	agent, err := NewAgent(workspaceLLMConfig(s.cfg, ws), s.vectorStore, s.prompts)
+	if err != nil {
+		golog.Errorf("failed to create agent for workspace %s, using the default: %v", ws.ID, err)
+		return s.agent
+	}
+	s.workspaceAgents[ws.ID] = workspaceAgent{agent: agent, updatedAt: ws.UpdatedAt}
+	return agent
+}
+
+// workspaceLLMConfig is cfg with a workspace's own LLM credentials, if any
+func workspaceLLMConfig(cfg Config, ws *Workspace) Config {
+	if ws == nil {
+		return cfg
+	}
+	if ws.LLMAPIKey != "" {
+		cfg.OpenAIAPIKey = ws.LLMAPIKey
+	}
+	if ws.LLMBaseURL != "" {
+		cfg.OpenAIBaseURL = ws.LLMBaseURL
+		cfg.OllamaBaseURL = ws.LLMBaseURL
+	}
+	if ws.LLMModel != "" {
+		cfg.OpenAIModel = ws.LLMModel
+		cfg.OllamaModel = ws.LLMModel
+	}
+	return cfg
+}
+
+// workspaceAgent is an agent built from a workspace's LLM settings
+type workspaceAgent struct {
+	agent     *Agent
+	updatedAt time.Time
+}
+
+// Handlers
+
+func (s *Server) handleCreateUser(c *gin.Context) {
+	ctx := context.Background()
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+		Name  string `json:"name" binding:"max=200"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if enabled, _ := s.instanceSetting(ctx, "signups_enabled").(bool); !enabled {
+		if caller := currentUser(c); caller == nil || !caller.IsAdmin {
+			c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Signups are disabled; ask an admin to create your user"})
+			return
+		}
+	}
+
+	user, token, err := s.store.CreateUser(ctx, req.Email, req.Name)
+	if err != nil {
+		storeErrorResponse(c, err, "Failed to create user")
+		return
+	}
+
+	// The token is only ever shown here
+	c.JSON(http.StatusCreated, gin.H{"user": user, "token": token})
+}
+
+func (s *Server) handleGetMe(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "Not signed in"})
+		return
+	}
+
+	workspaces, err := s.store.ListUserWorkspaces(context.Background(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list workspaces"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "workspaces": workspaces})
+}
+
+func (s *Server) handleListWorkspaces(c *gin.Context) {
+	ctx := context.Background()
+
+	workspaces, err := s.store.ListOpenWorkspaces(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list workspaces"})
+		return
+	}
+	if user := currentUser(c); user != nil {
+		mine, err := s.store.ListUserWorkspaces(ctx, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list workspaces"})
+			return
+		}
+		workspaces = append(workspaces, mine...)
+	}
+
+	c.JSON(http.StatusOK, workspaces)
+}
+
+// workspaceRequest is the editable part of a workspace
+type workspaceRequest struct {
+	Name         *string                `json:"name"`
+	Settings     map[string]interface{} `json:"settings"`
+	LLMAPIKey    *string                `json:"llm_api_key"`
+	LLMBaseURL   *string                `json:"llm_base_url"`
+	LLMModel     *string                `json:"llm_model"`
+	MaxNotebooks *int                   `json:"max_notebooks"`
+	MaxSources   *int                   `json:"max_sources"`
+	MaxStorageMB *int                   `json:"max_storage_mb"`
+}
+
+// reservedWorkspaceSettings are settings keys only their own handlers may
+// change, since those validate what is stored under them
+var reservedWorkspaceSettings = []string{securitySettingKey, moderationSettingKey, inboxSettingKey}
+
+// mergeWorkspaceSettings merges settings into ws.Settings: keys present are
+// set, and keys set to null are removed. Reserved keys are rejected.
+func mergeWorkspaceSettings(ws *Workspace, settings map[string]interface{}) error {
+	for _, key := range reservedWorkspaceSettings {
+		if _, ok := settings[key]; ok {
+			return fmt.Errorf("setting %q cannot be changed here", key)
+		}
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	if ws.Settings == nil {
+		ws.Settings = map[string]interface{}{}
+	}
+	for key, value := range settings {
+		if value == nil {
+			delete(ws.Settings, key)
+			continue
+		}
+		ws.Settings[key] = value
+	}
+	return nil
+}
+
+// apply copies the fields present in the request onto ws
+func (r *workspaceRequest) apply(ws *Workspace) error {
+	if r.Name != nil {
+		ws.Name = strings.TrimSpace(*r.Name)
+	}
+	if err := mergeWorkspaceSettings(ws, r.Settings); err != nil {
+		return err
+	}
+	if r.LLMAPIKey != nil {
+		ws.LLMAPIKey = *r.LLMAPIKey
+	}
+	if r.LLMBaseURL != nil {
+		ws.LLMBaseURL = *r.LLMBaseURL
+	}
+	if r.LLMModel != nil {
+		ws.LLMModel = *r.LLMModel
+	}
+	if r.MaxNotebooks != nil {
+		ws.MaxNotebooks = *r.MaxNotebooks
+	}
+	if r.MaxSources != nil {
+		ws.MaxSources = *r.MaxSources
+	}
+	if r.MaxStorageMB != nil {
+		ws.MaxStorageMB = *r.MaxStorageMB
+	}
+
+	if ws.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if ws.MaxNotebooks < 0 || ws.MaxSources < 0 || ws.MaxStorageMB < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	return nil
+}
+
+func (s *Server) handleCreateWorkspace(c *gin.Context) {
+	ctx := context.Background()
+
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Code: CodeUnauthorized, Error: "An API token is required to create a workspace"})
+		return
+	}
+
+	var req workspaceRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	ws := &Workspace{Settings: map[string]interface{}{}}
+	if err := req.apply(ws); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
+	if err := s.store.CreateWorkspace(ctx, ws, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to create workspace"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ws)
+}
+
+// loadWorkspace loads :workspaceId and the caller's role in it
+func (s *Server) loadWorkspace(c *gin.Context) (*Workspace, bool) {
+	ctx := context.Background()
+
+	ws, err := s.store.GetWorkspace(ctx, c.Param("workspaceId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Workspace not found"})
+		return nil, false
+	}
+
+	role, status, err := s.workspaceRole(ctx, ws.ID, currentUser(c))
+	if err != nil {
+		c.JSON(status, ErrorResponse{Code: codeForStatus(status), Error: err.Error()})
+		return nil, false
+	}
+	if status, err := s.checkTwoFactorPolicy(ctx, ws, currentUser(c)); err != nil {
+		twoFactorPolicyResponse(c, status, err)
+		return nil, false
+	}
+	ws.Role = role
+	return ws, true
+}
+
+// loadOwnedWorkspace loads :workspaceId, requiring the caller to own it
+func (s *Server) loadOwnedWorkspace(c *gin.Context) (*Workspace, bool) {
+	ws, ok := s.loadWorkspace(c)
+	if !ok {
+		return nil, false
+	}
+	if ws.Role != RoleOwner {
+		c.JSON(http.StatusForbidden, ErrorResponse{Code: CodeForbidden, Error: "Only workspace owners can do this"})
+		return nil, false
+	}
+	return ws, true
+}
+
+func (s *Server) handleGetWorkspace(c *gin.Context) {
+	ws, ok := s.loadWorkspace(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, ws)
+}
+
+func (s *Server) handleUpdateWorkspace(c *gin.Context) {
+	ctx := context.Background()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+
+	var req workspaceRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := req.apply(ws); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: err.Error()})
+		return
+	}
+
+	if err := s.store.UpdateWorkspace(ctx, ws); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to update workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ws)
+}
+
+func (s *Server) handleDeleteWorkspace(c *gin.Context) {
+	ctx := context.Background()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+	if ws.ID == DefaultWorkspaceID {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "The default workspace cannot be deleted"})
+		return
+	}
+	if !s.requireStepUp(c) {
+		return
+	}
+
+	n, err := s.store.CountWorkspaceNotebooks(ctx, ws.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete workspace"})
+		return
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, ErrorResponse{Code: CodeConflict, Error: fmt.Sprintf("Workspace still has %d notebooks", n)})
+		return
+	}
+
+	if err := s.store.DeleteWorkspace(ctx, ws.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to delete workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Workspace deleted"})
+}
+
+func (s *Server) handleListWorkspaceMembers(c *gin.Context) {
+	ws, ok := s.loadWorkspace(c)
+	if !ok {
+		return
+	}
+
+	members, err := s.store.ListWorkspaceMembers(context.Background(), ws.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to list members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+func (s *Server) handleAddWorkspaceMember(c *gin.Context) {
+	ctx := context.Background()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role" binding:"omitempty,oneof=owner member"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleMember
+	}
+
+	user, err := s.store.GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "User not found"})
+		return
+	}
+
+	// The first member of an open workspace must be an owner, or nobody could manage it
+	if n, _ := s.store.CountWorkspaceMembers(ctx, ws.ID); n == 0 {
+		req.Role = RoleOwner
+	}
+
+	if err := s.store.SetWorkspaceMember(ctx, ws.ID, user.ID, req.Role); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to add member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WorkspaceMember{
+		WorkspaceID: ws.ID, UserID: user.ID, Email: user.Email, Name: user.Name, Role: req.Role, CreatedAt: time.Now(),
+	})
+}
+
+func (s *Server) handleRemoveWorkspaceMember(c *gin.Context) {
+	ctx := context.Background()
+
+	ws, ok := s.loadOwnedWorkspace(c)
+	if !ok {
+		return
+	}
+
+	userID := c.Param("userId")
+	members, err := s.store.ListWorkspaceMembers(ctx, ws.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to remove member"})
+		return
+	}
+	owners, found := 0, false
+	for _, m := range members {
+		if m.Role == RoleOwner && m.UserID != userID {
+			owners++
+		}
+		found = found || m.UserID == userID
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Error: "Member not found"})
+		return
+	}
+	if owners == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Code: CodeInvalidRequest, Error: "A workspace must keep at least one owner"})
+		return
+	}
+
+	if err := s.store.RemoveWorkspaceMember(ctx, ws.ID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Error: "Failed to remove member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
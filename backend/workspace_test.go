@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMergeWorkspaceSettings(t *testing.T) {
+	existing := func() map[string]interface{} {
+		return map[string]interface{}{
+			"theme":              "dark",
+			"locale":             "en",
+			securitySettingKey:   map[string]interface{}{"require_two_factor": true},
+			moderationSettingKey: map[string]interface{}{"enabled": true},
+			inboxSettingKey:      "nb-inbox",
+		}
+	}
+	reserved := func(extra map[string]interface{}) map[string]interface{} {
+		m := map[string]interface{}{
+			securitySettingKey:   map[string]interface{}{"require_two_factor": true},
+			moderationSettingKey: map[string]interface{}{"enabled": true},
+			inboxSettingKey:      "nb-inbox",
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		current  map[string]interface{}
+		settings map[string]interface{}
+		want     map[string]interface{}
+		wantErr  bool
+	}{
+		{name: "no settings keeps everything", current: existing(), settings: nil, want: existing()},
+		{name: "empty settings keep everything", current: existing(), settings: map[string]interface{}{}, want: existing()},
+		{name: "new key is added", current: existing(), settings: map[string]interface{}{"color": "blue"},
+			want: reserved(map[string]interface{}{"theme": "dark", "locale": "en", "color": "blue"})},
+		{name: "existing key is replaced", current: existing(), settings: map[string]interface{}{"theme": "light"},
+			want: reserved(map[string]interface{}{"theme": "light", "locale": "en"})},
+		{name: "null removes a key", current: existing(), settings: map[string]interface{}{"locale": nil},
+			want: reserved(map[string]interface{}{"theme": "dark"})},
+		{name: "workspace without settings", current: nil, settings: map[string]interface{}{"theme": "light"},
+			want: map[string]interface{}{"theme": "light"}},
+		{name: "security policy is refused", current: existing(), settings: map[string]interface{}{securitySettingKey: nil}, want: existing(), wantErr: true},
+		{name: "moderation policy is refused", current: existing(), settings: map[string]interface{}{moderationSettingKey: map[string]interface{}{}}, want: existing(), wantErr: true},
+		{name: "inbox is refused", current: existing(), settings: map[string]interface{}{"theme": "light", inboxSettingKey: "other"}, want: existing(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &Workspace{Settings: tt.current}
+			err := mergeWorkspaceSettings(ws, tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			got := ws.Settings
+			if got == nil {
+				got = map[string]interface{}{}
+			}
+			want := tt.want
+			if want == nil {
+				want = map[string]interface{}{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("settings = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNotebookChildrenOfOtherWorkspaces(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	owner, _, err := store.CreateUser(ctx, "owner@example.com", "Owner")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	other := &Workspace{Name: "Other"}
+	if err := store.CreateWorkspace(ctx, other, owner.ID); err != nil {
+		t.Fatalf("CreateWorkspace: %v", err)
+	}
+
+	// The caller works in the default workspace; the children belong to a
+	// notebook of the other one
+	own, err := store.CreateNotebookInWorkspace(ctx, DefaultWorkspaceID, "Own", "", nil)
+	if err != nil {
+		t.Fatalf("CreateNotebookInWorkspace: %v", err)
+	}
+	foreign, err := store.CreateNotebookInWorkspace(ctx, other.ID, "Foreign", "", nil)
+	if err != nil {
+		t.Fatalf("CreateNotebookInWorkspace: %v", err)
+	}
+	note := &Note{NotebookID: foreign.ID, Title: "Secret", Content: "secret", Type: "custom"}
+	if err := store.CreateNote(ctx, note); err != nil {
+		t.Fatalf("CreateNote: %v", err)
+	}
+	source := &Source{NotebookID: foreign.ID, Name: "Secret", Type: "text", Content: "secret"}
+	if err := store.CreateSource(ctx, source); err != nil {
+		t.Fatalf("CreateSource: %v", err)
+	}
+	session, err := store.CreateChatSession(ctx, foreign.ID, "Secret")
+	if err != nil {
+		t.Fatalf("CreateChatSession: %v", err)
+	}
+	att := &Attachment{NotebookID: foreign.ID, FileName: "secret.txt", ContentType: "text/plain"}
+	if err := store.CreateAttachment(ctx, att); err != nil {
+		t.Fatalf("CreateAttachment: %v", err)
+	}
+
+	cached := NewCachedStore(store, time.Minute)
+	t.Cleanup(cached.cache.Close)
+	s := &Server{
+		store:            cached,
+		loadedNotebooks:  map[string]bool{own.ID: true},
+		notebookLastUsed: map[string]time.Time{},
+	}
+	router := gin.New()
+	api := router.Group("/api", s.NotebookWorkspaceMiddleware())
+	api.GET("/attachments/:attachmentId", s.handleGetAttachment)
+	api.GET("/attachments/:attachmentId/thumbnail", s.handleGetAttachmentThumbnail)
+	api.POST("/attachments/:attachmentId/sign", s.handleSignAttachmentURL)
+	api.DELETE("/notebooks/:id/notes/:noteId", s.handleDeleteNote)
+	api.DELETE("/notebooks/:id/sources/:sourceId", s.handleDeleteSource)
+	api.DELETE("/notebooks/:id/chat/sessions/:sessionId", s.handleDeleteChatSession)
+	api.POST("/notebooks/:id/chat/sessions/:sessionId/messages", s.handleSendMessage)
+	api.POST("/notebooks/:id/chat", s.handleChat)
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{method: http.MethodGet, target: "/api/attachments/" + att.ID},
+		{method: http.MethodGet, target: "/api/attachments/" + att.ID + "/thumbnail"},
+		{method: http.MethodPost, target: "/api/attachments/" + att.ID + "/sign"},
+		{method: http.MethodDelete, target: "/api/notebooks/" + own.ID + "/notes/" + note.ID},
+		{method: http.MethodDelete, target: "/api/notebooks/" + own.ID + "/sources/" + source.ID},
+		{method: http.MethodDelete, target: "/api/notebooks/" + own.ID + "/chat/sessions/" + session.ID},
+		{method: http.MethodPost, target: "/api/notebooks/" + own.ID + "/chat/sessions/" + session.ID + "/messages", body: `{"message":"hi"}`},
+		{method: http.MethodPost, target: "/api/notebooks/" + own.ID + "/chat", body: `{"message":"hi","session_id":"` + session.ID + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("%s %s = %d, want 404: %s", tt.method, tt.target, w.Code, w.Body)
+			}
+		})
+	}
+
+	if _, err := store.GetNote(ctx, note.ID); err != nil {
+		t.Errorf("note was deleted: %v", err)
+	}
+	if _, err := store.GetSource(ctx, source.ID); err != nil {
+		t.Errorf("source was deleted: %v", err)
+	}
+	got, err := store.GetChatSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("chat session was deleted: %v", err)
+	}
+	if len(got.Messages) != 0 {
+		t.Errorf("chat session has %d messages, want 0", len(got.Messages))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+
+	"github.com/kataras/golog"
+	"github.com/smallnest/notex/backend"
+)
+
+// DesktopApp is the running desktop instance, as seen by a tray or menu bar
+// integration
+type DesktopApp struct {
+	url  string
+	quit context.CancelFunc
+}
+
+// URL is the link that opens the app signed in
+func (a *DesktopApp) URL() string {
+	return a.url
+}
+
+// Open shows the app in the default browser
+func (a *DesktopApp) Open() error {
+	return openBrowser(a.url)
+}
+
+// Quit shuts the server down
+func (a *DesktopApp) Quit() {
+	a.quit()
+}
+
+// trayIntegration, when set, shows a tray icon or menu bar item for the
+// desktop app. Platform integrations are compiled in with a build tag and set
+// it from init. It is called on the main goroutine, which some toolkits
+// require, and must return once ctx is done or the user picks Quit.
+var trayIntegration func(ctx context.Context, app *DesktopApp)
+
+// runDesktopMode runs the server as a personal app: bound to localhost,
+// behind a token generated for this run, with the browser opened on it
+func runDesktopMode(ctx context.Context, cfg backend.Config, open bool) {
+	cfg.ServerHost = "127.0.0.1"
+	if cfg.DesktopToken == "" {
+		cfg.DesktopToken = newDesktopToken()
+	}
+
+	// Fall back to any free port when the configured one is taken
+	l, err := net.Listen("tcp", net.JoinHostPort(cfg.ServerHost, cfg.ServerPort))
+	if err != nil {
+		golog.Warnf("port %s is busy, using a free one: %v", cfg.ServerPort, err)
+		if l, err = net.Listen("tcp", net.JoinHostPort(cfg.ServerHost, "0")); err != nil {
+			golog.Fatalf("failed to listen: %v", err)
+		}
+	}
+	_, cfg.ServerPort, _ = net.SplitHostPort(l.Addr().String())
+
+	ctx, quit := context.WithCancel(ctx)
+	defer quit()
+	app := &DesktopApp{url: backend.DesktopLaunchURL(l.Addr().String(), cfg.DesktopToken), quit: quit}
+
+	// Logs go to a file, so say where to find the app on the terminal
+	fmt.Printf("Notex is running at %s\n", app.URL())
+	if open {
+		if err := app.Open(); err != nil {
+			golog.Warnf("failed to open the browser: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runServerMode(ctx, cfg, l)
+	}()
+	if trayIntegration != nil {
+		trayIntegration(ctx, app)
+		quit()
+	}
+	<-done
+}
+
+func newDesktopToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		golog.Fatalf("crypto/rand failed: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// openBrowser opens url with the platform's default handler
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kataras/golog"
@@ -19,9 +23,29 @@ var Version = "1.0.0"
 func main() {
 	// Command line flags
 	serverMode := flag.Bool("server", false, "Run in HTTP server mode")
+	desktopMode := flag.Bool("desktop", false, "Run as a personal app on localhost and open the browser")
+	noBrowser := flag.Bool("no-browser", false, "Do not open the browser (for desktop)")
+	mcpMode := flag.Bool("mcp", false, "Run as an MCP server over stdio")
 	ingestFile := flag.String("ingest", "", "Path to a file to ingest")
 	notebookName := flag.String("notebook", "", "Notebook name (for ingest)")
+	benchMode := flag.Bool("bench", false, "Seed a throwaway data set and measure store, cache and search latencies")
+	benchOpts := backend.DefaultBenchOptions
+	flag.IntVar(&benchOpts.Notebooks, "bench-notebooks", benchOpts.Notebooks, "Notebooks to seed (for bench)")
+	flag.IntVar(&benchOpts.NotesPerNotebook, "bench-notes", benchOpts.NotesPerNotebook, "Notes per notebook (for bench)")
+	flag.IntVar(&benchOpts.SourcesPerNotebook, "bench-sources", benchOpts.SourcesPerNotebook, "Sources per notebook (for bench)")
+	flag.IntVar(&benchOpts.Queries, "bench-queries", benchOpts.Queries, "Timed reads and searches (for bench)")
+	flag.IntVar(&benchOpts.Dimensions, "bench-dims", benchOpts.Dimensions, "Synthetic embedding dimensions, 0 for keyword search only (for bench)")
 	version := flag.Bool("version", false, "Show version information")
+	configFile := flag.String("config", "", "Path to a YAML or TOML config file")
+	overrides := make(map[string]string)
+	flag.Func("set", "Override a setting, e.g. -set SERVER_PORT=9090 (repeatable)", func(v string) error {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected KEY=value, got %q", v)
+		}
+		overrides[key] = value
+		return nil
+	})
 	flag.Parse()
 
 	if *version {
@@ -54,8 +78,17 @@ func main() {
 	golog.SetOutput(w)
 
 	// Load and validate configuration
-	cfg := backend.LoadConfig()
-	if err := backend.ValidateConfig(cfg); err != nil {
+	cfg, err := backend.LoadConfigWithOptions(backend.ConfigOptions{File: *configFile, Overrides: overrides})
+	if err != nil {
+		golog.Fatalf("configuration error:\n%v", err)
+	}
+	golog.SetLevel(strings.ToLower(cfg.LogLevel))
+	validate := backend.ValidateConfig
+	if *serverMode || *desktopMode {
+		// Without an LLM provider the server starts in setup mode to configure one
+		validate = backend.ValidateSetupConfig
+	}
+	if err := validate(cfg); err != nil {
 		golog.Fatalf("configuration error: %v\n\n"+
 			"Required environment variables:\n"+
 			"  - OPENAI_API_KEY (for OpenAI) or\n"+
@@ -66,13 +99,29 @@ func main() {
 			"  - SERVER_PORT (default: 8080)\n"+
 			"Error: %v", err, err)
 	}
+	if err := backend.EnforceLocalOnly(cfg); err != nil {
+		golog.Fatalf("configuration error: %v", err)
+	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	switch {
 	case *serverMode:
 		// Server mode
-		runServerMode(cfg)
+		runServerMode(ctx, cfg, nil)
+
+	case *desktopMode:
+		// Desktop mode
+		runDesktopMode(ctx, cfg, !*noBrowser)
+
+	case *mcpMode:
+		// MCP stdio mode
+		runMCPMode(ctx, cfg)
+
+	case *benchMode:
+		// Benchmark mode
+		runBenchMode(ctx, cfg, benchOpts)
 
 	case *ingestFile != "":
 		// Ingest mode
@@ -86,7 +135,16 @@ func main() {
 	}
 }
 
-func runServerMode(cfg backend.Config) {
+// runServerMode serves until ctx is done, on l if given or else on the
+// configured host and port
+func runServerMode(ctx context.Context, cfg backend.Config, l net.Listener) {
+	if !backend.ProviderConfigured(cfg) {
+		var ok bool
+		if cfg, l, ok = runSetupMode(ctx, cfg, l); !ok {
+			return
+		}
+	}
+
 	server, err := backend.NewServer(cfg)
 	if err != nil {
 		golog.Fatalf("failed to create server: %v", err)
@@ -97,8 +155,103 @@ func runServerMode(cfg backend.Config) {
 	golog.Infof("llm:         %s", cfg.OpenAIModel)
 	golog.Infof("vector store: %s", cfg.VectorStoreType)
 
-	if err := server.Start(); err != nil {
-		golog.Fatalf("server error: %v", err)
+	backend.Version = Version
+	errCh := make(chan error, 1)
+	go func() {
+		if l != nil {
+			errCh <- server.Serve(l)
+			return
+		}
+		errCh <- server.Start()
+	}()
+
+	// SIGHUP reloads the configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+wait:
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				golog.Fatalf("server error: %v", err)
+			}
+			return
+		case <-hup:
+			if err := server.ReloadConfig(); err != nil {
+				golog.Errorf("config reload failed, keeping current settings: %v", err)
+			}
+		case <-ctx.Done():
+			golog.Infof("received shutdown signal")
+			break wait
+		}
+	}
+
+	// Drain in-flight requests and background jobs before exiting
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		golog.Errorf("shutdown error: %v", err)
+	}
+}
+
+// runSetupMode serves the first-run setup API until an admin has set up an
+// LLM provider, then hands back the new configuration and a listener on the
+// same address for the full server. It reports false if ctx ended first.
+func runSetupMode(ctx context.Context, cfg backend.Config, l net.Listener) (backend.Config, net.Listener, bool) {
+	var err error
+	if l == nil {
+		if l, err = net.Listen("tcp", net.JoinHostPort(cfg.ServerHost, cfg.ServerPort)); err != nil {
+			golog.Fatalf("failed to listen: %v", err)
+		}
+	}
+	addr := l.Addr().String()
+	host, port, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	fmt.Printf("No LLM provider is configured. Finish setup with POST http://%s/api/setup\n", net.JoinHostPort(host, port))
+
+	cfg, err = backend.RunSetup(ctx, cfg, l)
+	if ctx.Err() != nil {
+		return cfg, nil, false
+	}
+	if err != nil {
+		golog.Fatalf("setup failed: %v", err)
+	}
+	golog.Infof("setup complete, starting the server")
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		golog.Fatalf("failed to listen: %v", err)
+	}
+	return cfg, l, true
+}
+
+func runMCPMode(ctx context.Context, cfg backend.Config) {
+	// stdout carries the protocol, so route everything else printed there to stderr
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	backend.Version = Version
+	server, err := backend.NewServer(cfg)
+	if err != nil {
+		golog.Fatalf("failed to create server: %v", err)
+	}
+
+	golog.Infof("mcp server started on stdio")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ServeMCP(ctx, os.Stdin, stdout)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			golog.Fatalf("mcp server error: %v", err)
+		}
+	case <-ctx.Done():
+		golog.Infof("received shutdown signal")
 	}
 }
 
@@ -167,20 +320,46 @@ func runIngestMode(ctx context.Context, cfg backend.Config, filePath, notebookNa
 	golog.Infof("📓 notebook: %s (ID: %s)", notebookName, notebookID)
 }
 
+func runBenchMode(ctx context.Context, cfg backend.Config, opts backend.BenchOptions) {
+	// Searches print progress to stdout; keep it for the report
+	stdout := os.Stdout
+	if devNull, err := os.Open(os.DevNull); err == nil {
+		os.Stdout = devNull
+		defer devNull.Close()
+	}
+
+	results, err := backend.RunBenchmark(ctx, cfg, opts, stdout)
+	if err != nil {
+		golog.Fatalf("benchmark failed: %v", err)
+	}
+	backend.WriteBenchResults(stdout, results)
+}
+
 func printUsage() {
 	fmt.Println("Notex - Privacy-first AI notebook")
 	fmt.Println("\nUsage:")
 	fmt.Println("  open-notebook [options]")
 	fmt.Println("\nOptions:")
 	fmt.Println("  -server          Start the web server")
+	fmt.Println("  -desktop         Run as a personal app: localhost only, behind a generated token, browser opened")
+	fmt.Println("  -no-browser      Do not open the browser in desktop mode")
+	fmt.Println("  -mcp             Run as an MCP server over stdio (for desktop AI assistants)")
 	fmt.Println("  -ingest <file>   Ingest a file into the vector store")
 	fmt.Println("  -notebook <name> Notebook name for ingest (default: 'Default Notebook')")
+	fmt.Println("  -bench           Measure store, cache, search and retrieval latencies on synthetic data")
+	fmt.Println("                   (size with -bench-notebooks, -bench-notes, -bench-sources, -bench-queries, -bench-dims)")
+	fmt.Println("  -config <file>   YAML or TOML config file (default: notex.yaml, notex.yml or notex.toml)")
+	fmt.Println("  -set KEY=value   Override a setting; repeatable, takes precedence over env and file")
 	fmt.Println("  -version         Show version information")
 	fmt.Println("\nExamples:")
 	fmt.Println("  # Start web server")
 	fmt.Println("  open-notebook -server")
+	fmt.Println("\n  # Use as a local app")
+	fmt.Println("  open-notebook -desktop")
 	fmt.Println("\n  # Ingest a file")
 	fmt.Println("  open-notebook -ingest document.pdf -notebook 'My Notes'")
+	fmt.Println("\n  # Benchmark with 50 notebooks")
+	fmt.Println("  open-notebook -bench -bench-notebooks 50")
 	fmt.Println("\nEnvironment Variables:")
 	fmt.Println("  OPENAI_API_KEY      Your OpenAI API key")
 	fmt.Println("  OLLAMA_BASE_URL     Ollama server URL (default: http://localhost:11434)")